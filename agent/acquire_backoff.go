@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// Why the agent has stopped asking for work for a while
+const (
+	// The agent's queue has been paused in Buildkite
+	BackoffQueuePaused = "queue-paused"
+
+	// Buildkite responded with a 503, such as during maintenance
+	BackoffMaintenance = "maintenance"
+
+	// Buildkite responded with a 429
+	BackoffRateLimited = "rate-limited"
+)
+
+// The longest the agent will go without asking for work while backing off,
+// however long it's asked to wait
+const maxAcquireBackoff = 5 * time.Minute
+
+// acquireBackoff tracks when the API has asked the agent to stop asking for
+// work for a while. Unless the API says how long to wait, the wait starts at
+// the ping interval and doubles each time the API asks again for the same
+// reason.
+type acquireBackoff struct {
+	mu       sync.Mutex
+	reason   string
+	until    time.Time
+	interval time.Duration
+}
+
+// start backs off until now plus retryAfter, or the next interval if
+// retryAfter is zero. It returns whether the agent wasn't already backing
+// off for this reason.
+func (b *acquireBackoff) start(reason string, now time.Time, retryAfter, base time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if base <= 0 {
+		base = time.Second
+	}
+
+	started := b.reason != reason
+	if started || b.interval == 0 {
+		b.interval = base
+	} else if b.interval *= 2; b.interval > maxAcquireBackoff {
+		b.interval = maxAcquireBackoff
+	}
+
+	wait := b.interval
+	if retryAfter > 0 {
+		wait = retryAfter
+	}
+	if wait > maxAcquireBackoff {
+		wait = maxAcquireBackoff
+	}
+
+	b.reason = reason
+	b.until = now.Add(wait)
+
+	return started
+}
+
+// clear stops backing off, returning the reason the agent was backing off
+// or an empty string if it wasn't
+func (b *acquireBackoff) clear() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	reason := b.reason
+	b.reason = ""
+	b.until = time.Time{}
+	b.interval = 0
+
+	return reason
+}
+
+// waiting returns whether the agent should wait before asking for work at now
+func (b *acquireBackoff) waiting(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.reason != "" && now.Before(b.until)
+}
+
+// status returns why the agent is backing off and until when, with an empty
+// reason if it isn't
+func (b *acquireBackoff) status() (string, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.reason, b.until
+}
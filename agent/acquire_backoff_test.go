@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireBackoff(t *testing.T) {
+	var b acquireBackoff
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.False(t, b.waiting(now))
+
+	// Without a Retry-After, the wait doubles up to the maximum
+	assert.True(t, b.start(BackoffQueuePaused, now, 0, time.Minute))
+	assert.True(t, b.waiting(now.Add(59*time.Second)))
+	assert.False(t, b.waiting(now.Add(time.Minute)))
+
+	for _, expected := range []time.Duration{2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		assert.False(t, b.start(BackoffQueuePaused, now, 0, time.Minute))
+		_, until := b.status()
+		assert.Equal(t, expected, until.Sub(now))
+	}
+
+	// A different reason starts again, and Retry-After is used if it's given
+	// as long as it's not too long
+	assert.True(t, b.start(BackoffMaintenance, now, 30*time.Second, time.Minute))
+	_, until := b.status()
+	assert.Equal(t, 30*time.Second, until.Sub(now))
+
+	b.start(BackoffMaintenance, now, time.Hour, time.Minute)
+	_, until = b.status()
+	assert.Equal(t, maxAcquireBackoff, until.Sub(now))
+
+	assert.Equal(t, BackoffMaintenance, b.clear())
+	assert.Equal(t, "", b.clear())
+	assert.False(t, b.waiting(now))
+}
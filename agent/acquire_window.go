@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AcquireWindowDelimiter separates windows in the acquire-window config.
+// Lists of days use commas, so they can't be used.
+const AcquireWindowDelimiter = ";"
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// An AcquireWindow is a recurring time of the week during which an agent
+// accepts jobs, such as "Mon-Fri 08:00-20:00 Europe/Berlin"
+type AcquireWindow struct {
+	Spec string
+
+	days     [7]bool
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+// AcquireWindows are windows that jobs are accepted within, if they're in
+// any of them
+type AcquireWindows []*AcquireWindow
+
+// ParseAcquireWindows parses windows separated by semicolons. Each is a list
+// or range of days (or * for every day), a time range in 24 hour time and an
+// optional time zone, which defaults to the local one. Time ranges that end
+// before they start run over midnight.
+func ParseAcquireWindows(s string) (AcquireWindows, error) {
+	var windows AcquireWindows
+
+	for _, spec := range strings.Split(s, AcquireWindowDelimiter) {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		window, err := parseAcquireWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+func parseAcquireWindow(spec string) (*AcquireWindow, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("Acquire window %q should look like \"Mon-Fri 08:00-20:00 Europe/Berlin\"", spec)
+	}
+
+	w := &AcquireWindow{Spec: spec, location: time.Local}
+
+	if err := w.parseDays(parts[0]); err != nil {
+		return nil, fmt.Errorf("Invalid days in acquire window %q: %v", spec, err)
+	}
+
+	times := strings.SplitN(parts[1], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("Invalid time range in acquire window %q, expected one like 08:00-20:00", spec)
+	}
+
+	var err error
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return nil, fmt.Errorf("Invalid start time in acquire window %q: %v", spec, err)
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return nil, fmt.Errorf("Invalid end time in acquire window %q: %v", spec, err)
+	}
+
+	if len(parts) == 3 {
+		if w.location, err = time.LoadLocation(parts[2]); err != nil {
+			return nil, fmt.Errorf("Invalid time zone in acquire window %q: %v", spec, err)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *AcquireWindow) parseDays(s string) error {
+	if s == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+
+		from, err := parseWeekday(bounds[0])
+		if err != nil {
+			return err
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			if to, err = parseWeekday(bounds[1]); err != nil {
+				return err
+			}
+		}
+
+		// Ranges can wrap around the end of the week, like Sat-Mon
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseWeekday(s string) (int, error) {
+	name := strings.ToLower(s)
+	if len(name) > 3 {
+		name = name[:3]
+	}
+
+	for i, day := range weekdayNames {
+		if name == day {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown day %q", s)
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Expected a time like 08:00, got %q", s)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("Invalid hour in %q", s)
+	}
+
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("Invalid minute in %q", s)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Contains returns whether t is within the window
+func (w *AcquireWindow) Contains(t time.Time) bool {
+	t = t.In(w.location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.location)
+	sinceMidnight := t.Sub(midnight)
+	today := int(t.Weekday())
+
+	if w.start < w.end {
+		return w.days[today] && sinceMidnight >= w.start && sinceMidnight < w.end
+	}
+
+	// The window runs over midnight, so the early hours belong to a window
+	// that started the day before
+	yesterday := (today + 6) % 7
+	return (w.days[today] && sinceMidnight >= w.start) || (w.days[yesterday] && sinceMidnight < w.end)
+}
+
+// Contains returns whether t is within any of the windows. If there are no
+// windows, jobs can be accepted at any time.
+func (ws AcquireWindows) Contains(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+
+	for _, w := range ws {
+		if w.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ws AcquireWindows) String() string {
+	var specs []string
+	for _, w := range ws {
+		specs = append(specs, w.Spec)
+	}
+	return strings.Join(specs, AcquireWindowDelimiter+" ")
+}
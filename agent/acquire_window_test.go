@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAcquireWindows(t *testing.T) {
+	windows, err := ParseAcquireWindows("Mon-Fri 08:00-20:00 UTC; Sat,Sun 22:00-02:00 UTC;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, windows, 2)
+
+	for _, bad := range []string{
+		"Mon-Fri",
+		"Mon-Fri 08:00",
+		"Llamas 08:00-20:00",
+		"Mon 25:00-26:00",
+		"Mon 08:00-20:00 Mars/Olympus_Mons",
+	} {
+		_, err := ParseAcquireWindows(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAcquireWindowsContains(t *testing.T) {
+	windows, err := ParseAcquireWindows("Mon-Fri 08:00-20:00 Europe/Berlin; Sat 22:00-02:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(s string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// 2019-01-07 is a Monday, when Berlin is UTC+1
+	assert.True(t, windows.Contains(at("2019-01-07T07:30:00Z")))
+	assert.False(t, windows.Contains(at("2019-01-07T06:30:00Z")))
+	assert.False(t, windows.Contains(at("2019-01-07T19:00:00Z")))
+
+	// Saturday night runs over into Sunday morning, but not Sunday night
+	assert.True(t, windows.Contains(at("2019-01-12T23:00:00Z")))
+	assert.True(t, windows.Contains(at("2019-01-13T01:59:00Z")))
+	assert.False(t, windows.Contains(at("2019-01-13T02:00:00Z")))
+	assert.False(t, windows.Contains(at("2019-01-13T23:00:00Z")))
+
+	// Without any windows, jobs are always accepted
+	assert.True(t, AcquireWindows(nil).Contains(at("2019-01-13T23:00:00Z")))
+}
+
+func TestAgentWorkerAcquireWindowIsReportedInHealth(t *testing.T) {
+	windows, err := ParseAcquireWindows("Mon 08:00-20:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{Name: "llamas-1"},
+		agentConfiguration: AgentConfiguration{AcquireWindows: windows},
+	}
+	pool := NewAgentPool(logger.Discard, []*AgentWorker{worker})
+
+	assert.False(t, worker.checkAcquireWindow(time.Date(2019, 1, 7, 21, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "closed", pool.Health().Agents[0].AcquireWindow)
+
+	assert.True(t, worker.checkAcquireWindow(time.Date(2019, 1, 7, 9, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "open", pool.Health().Agents[0].AcquireWindow)
+}
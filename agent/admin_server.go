@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// AdminServer serves a small HTTP API on a local unix socket that tools on the
+// same host (such as `buildkite-agent control`) can use to inspect and control
+// the running agent
+type AdminServer struct {
+	logger   logger.Logger
+	path     string
+	mux      *http.ServeMux
+	listener net.Listener
+}
+
+// NewAdminServer returns an admin server that will listen on the socket path
+func NewAdminServer(l logger.Logger, path string) *AdminServer {
+	return &AdminServer{
+		logger: l,
+		path:   path,
+		mux:    http.NewServeMux(),
+	}
+}
+
+// Handle registers a handler for a path on the admin server
+func (s *AdminServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Listen creates the socket and starts serving requests in the background
+func (s *AdminServer) Listen() error {
+	// Servers should unlink the socket path name prior to binding it, any
+	// socket left here is from an agent that didn't shut down cleanly
+	if _, err := os.Stat(s.path); err == nil {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+
+	// Restrict to owner r+w permissions
+	if err = os.Chmod(s.path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	s.listener = l
+	s.logger.Debug("[AdminServer] Listening on unix socket %s", s.path)
+
+	go func() {
+		_ = http.Serve(l, s.mux)
+	}()
+
+	return nil
+}
+
+// Close stops the server and removes the socket
+func (s *AdminServer) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// NewAdminClient returns a http client that talks to an admin server over the
+// socket, along with the base URL to make requests to
+func NewAdminClient(socket string) (*http.Client, *url.URL) {
+	client := &http.Client{
+		Transport: &socketTransport{
+			Socket:      socket,
+			DialTimeout: 10 * time.Second,
+		},
+	}
+
+	u, _ := url.Parse(`http+unix://buildkite-agent`)
+	return client, u
+}
+
+// writeJSON is a helper for admin server handlers
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
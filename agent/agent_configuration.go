@@ -1,9 +1,12 @@
 package agent
 
+import "time"
+
 // AgentConfiguration is the run-time configuration for an agent that
 // has been loaded from the config file and command-line params
 type AgentConfiguration struct {
 	ConfigPath                 string
+	ConfigProfile              string
 	BootstrapScript            string
 	BuildPath                  string
 	HooksPath                  string
@@ -22,9 +25,27 @@ type AgentConfiguration struct {
 	RunInPty                   bool
 	DisableColors              bool
 	TimestampLines             bool
+	MaxLogLineLength           int
 	DisconnectAfterJob         bool
 	DisconnectAfterJobTimeout  int
 	DisconnectAfterIdleTimeout int
+	AgentIdleHookTimeout       int
 	CancelGracePeriod          int
 	Shell                      string
+	JobHistoryPath             string
+	JobLogPathTemplate         string
+	JobLogFormat               string
+	JobEnvFiles                []string
+	ArtifactCacheDir           string
+	AcquireWindows             AcquireWindows
+	Capabilities               []string
+	ClockDriftThreshold        time.Duration
+	ClockDriftAction           string
+	SoftFailExitCodes          ExitCodeRanges
+	LongPoll                   bool
+	Tracing                    bool
+	ResourceUsageAnnotation    bool
+	EncryptedWorkspace         bool
+	EncryptedWorkspaceSize     string
+	CleanCheckoutEvery         string
 }
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// AccessTokenOverlap is how long an agent's previous access token is kept
+// after it's rotated, for requests the new one isn't accepted for yet
+var AccessTokenOverlap = 10 * time.Minute
+
+// ControlCommand is a command sent to a running agent via the admin socket
+type ControlCommand struct {
+	// An optional identifier that is echoed back in the response
+	ID string `json:"id,omitempty"`
+
+	// One of pause, resume, set-tag, gc, stop-after-job, log-level or
+	// rotate-token
+	Command string `json:"command"`
+
+	// Arguments for the set-tag command. For log-level, the key is the level,
+	// levels for subsystems like "api=debug,job=info", or "reset". For
+	// rotate-token, the value is the new access token and the key is the
+	// name of the agent it's for, which can be left out if there's only one
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// ControlResponse is the result of a ControlCommand
+type ControlResponse struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Control runs a control command against all the workers in the pool
+func (r *AgentPool) Control(cmd ControlCommand) ControlResponse {
+	resp := ControlResponse{ID: cmd.ID, Command: cmd.Command, OK: true}
+
+	switch cmd.Command {
+	case "pause":
+		for _, worker := range r.workers {
+			worker.Pause()
+		}
+		resp.Message = fmt.Sprintf("Paused %d agent(s), running jobs will continue", len(r.workers))
+
+	case "resume":
+		for _, worker := range r.workers {
+			worker.Resume()
+		}
+		resp.Message = fmt.Sprintf("Resumed %d agent(s)", len(r.workers))
+
+	case "set-tag":
+		if cmd.Key == "" {
+			return controlError(resp, "set-tag requires a key")
+		}
+		for _, worker := range r.workers {
+			worker.SetLocalTag(cmd.Key, cmd.Value)
+		}
+		resp.Message = fmt.Sprintf("Set tag %s=%s in the environment of future jobs, it isn't used for job targeting", cmd.Key, cmd.Value)
+
+	case "gc":
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		debug.FreeOSMemory()
+		runtime.ReadMemStats(&after)
+		resp.Message = fmt.Sprintf("Heap in use went from %d to %d bytes", before.HeapInuse, after.HeapInuse)
+
+	case "stop-after-job":
+		for _, worker := range r.workers {
+			worker.Stop(true)
+		}
+		resp.Message = fmt.Sprintf("Stopping %d agent(s) once their current jobs finish", len(r.workers))
+
+	case "log-level":
+		if cmd.Key == "" {
+			return controlError(resp, "log-level requires a level, or reset")
+		}
+		if strings.EqualFold(cmd.Key, "reset") {
+			r.ResetLogLevel()
+		} else {
+			// Either a level, or levels for subsystems like "api=debug"
+			named, level, hasDefault, err := logger.ParseLevels(cmd.Key)
+			if err != nil {
+				return controlError(resp, err.Error())
+			}
+			r.SetNamedLogLevels(named)
+			if hasDefault {
+				r.SetLogLevel(level)
+			}
+		}
+		resp.Message = fmt.Sprintf("Log level set to %s", r.logger.GetLevel())
+
+	case "rotate-token":
+		if cmd.Value == "" {
+			return controlError(resp, "rotate-token requires a new access token")
+		}
+		worker, err := r.workerNamed(cmd.Key)
+		if err != nil {
+			return controlError(resp, err.Error())
+		}
+		if err := worker.RotateAccessToken(cmd.Value, AccessTokenOverlap); err != nil {
+			return controlError(resp, err.Error())
+		}
+		resp.Message = fmt.Sprintf("Rotated the access token for %s, the previous one will be retired in %s", worker.currentAgent().Name, AccessTokenOverlap)
+
+	case "":
+		return controlError(resp, "No command provided")
+
+	default:
+		return controlError(resp, fmt.Sprintf("Unknown command %q", cmd.Command))
+	}
+
+	r.logger.Info("Control command %q: %s", cmd.Command, resp.Message)
+	return resp
+}
+
+// workerNamed returns the worker for the named agent, or the only worker if
+// the name is empty
+func (r *AgentPool) workerNamed(name string) (*AgentWorker, error) {
+	if name == "" {
+		if len(r.workers) != 1 {
+			return nil, fmt.Errorf("There are %d agents running, so the name of one is required", len(r.workers))
+		}
+		return r.workers[0], nil
+	}
+
+	for _, worker := range r.workers {
+		if ag := worker.currentAgent(); ag != nil && ag.Name == name {
+			return worker, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No agent named %q is running", name)
+}
+
+func controlError(resp ControlResponse, message string) ControlResponse {
+	resp.OK = false
+	resp.Error = message
+	return resp
+}
+
+// ControlHandler returns a http handler for control commands posted as JSON
+func (r *AgentPool) ControlHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			writeJSON(w, http.StatusMethodNotAllowed, ControlResponse{Error: "Control commands must be POSTed"})
+			return
+		}
+
+		var cmd ControlCommand
+		if err := json.NewDecoder(req.Body).Decode(&cmd); err != nil {
+			writeJSON(w, http.StatusBadRequest, ControlResponse{Error: fmt.Sprintf("Invalid command: %v", err)})
+			return
+		}
+
+		resp := r.Control(cmd)
+		if resp.OK {
+			writeJSON(w, http.StatusOK, resp)
+		} else {
+			writeJSON(w, http.StatusBadRequest, resp)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentPoolControlViaAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	worker := &AgentWorker{logger: logger.Discard, stop: make(chan struct{})}
+	pool := NewAgentPool(logger.Discard, []*AgentWorker{worker})
+
+	socket := filepath.Join(dir, "agent.sock")
+	server := NewAdminServer(logger.Discard, socket)
+	server.Handle("/control", pool.ControlHandler())
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, baseURL := NewAdminClient(socket)
+
+	send := func(cmd ControlCommand) ControlResponse {
+		body, _ := json.Marshal(cmd)
+		res, err := client.Post(baseURL.String()+"/control", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var resp ControlResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send(ControlCommand{ID: "1", Command: "pause"})
+	assert.True(t, resp.OK)
+	assert.Equal(t, "1", resp.ID)
+	assert.True(t, worker.Paused())
+
+	resp = send(ControlCommand{Command: "resume"})
+	assert.True(t, resp.OK)
+	assert.False(t, worker.Paused())
+
+	resp = send(ControlCommand{Command: "set-tag", Key: "docker", Value: "true"})
+	assert.True(t, resp.OK)
+	assert.Equal(t, map[string]string{"docker": "true"}, worker.copyLocalTags())
+
+	resp = send(ControlCommand{Command: "set-tag"})
+	assert.False(t, resp.OK)
+
+	resp = send(ControlCommand{Command: "llamas"})
+	assert.False(t, resp.OK)
+	assert.Equal(t, `Unknown command "llamas"`, resp.Error)
+}
+
+func TestAgentPoolControlLogLevel(t *testing.T) {
+	poolLogger := logger.NewConsoleLogger(logger.NewTextPrinter(ioutil.Discard), nil)
+	workerLogger := poolLogger.WithPrefix("agent-1")
+
+	worker := &AgentWorker{logger: workerLogger, stop: make(chan struct{})}
+	pool := NewAgentPool(poolLogger, []*AgentWorker{worker})
+
+	resp := pool.Control(ControlCommand{Command: "log-level", Key: "debug"})
+	assert.True(t, resp.OK)
+	assert.Equal(t, logger.DEBUG, poolLogger.GetLevel())
+	assert.Equal(t, logger.DEBUG, workerLogger.GetLevel())
+
+	resp = pool.Control(ControlCommand{Command: "log-level", Key: "reset"})
+	assert.True(t, resp.OK)
+	assert.Equal(t, "Log level set to NOTICE", resp.Message)
+	assert.Equal(t, logger.NOTICE, workerLogger.GetLevel())
+
+	resp = pool.Control(ControlCommand{Command: "log-level", Key: "api=debug"})
+	assert.True(t, resp.OK)
+	assert.Equal(t, map[string]logger.Level{"api": logger.DEBUG}, logger.NamedLevels())
+	assert.Equal(t, logger.NOTICE, workerLogger.GetLevel())
+
+	resp = pool.Control(ControlCommand{Command: "log-level", Key: "reset"})
+	assert.True(t, resp.OK)
+	assert.Empty(t, logger.NamedLevels())
+
+	resp = pool.Control(ControlCommand{Command: "log-level", Key: "llamas"})
+	assert.False(t, resp.OK)
+
+	resp = pool.Control(ControlCommand{Command: "log-level"})
+	assert.False(t, resp.OK)
+}
+
+func TestAgentPoolControlRotateToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Token new-token" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(rw, `{}`)
+	}))
+	defer server.Close()
+
+	worker := &AgentWorker{
+		logger:       logger.Discard,
+		agent:        &api.AgentRegisterResponse{Name: "agent-1"},
+		endpoint:     server.URL,
+		accessTokens: api.NewRotatingToken("old-token"),
+		stop:         make(chan struct{}),
+	}
+	pool := NewAgentPool(logger.Discard, []*AgentWorker{worker})
+
+	resp := pool.Control(ControlCommand{Command: "rotate-token", Key: "agent-1", Value: "bad-token"})
+	assert.False(t, resp.OK)
+	assert.Equal(t, "old-token", worker.accessTokens.Get())
+
+	resp = pool.Control(ControlCommand{Command: "rotate-token", Key: "agent-2", Value: "new-token"})
+	assert.False(t, resp.OK)
+
+	resp = pool.Control(ControlCommand{Command: "rotate-token", Value: "new-token"})
+	assert.True(t, resp.OK)
+	assert.Equal(t, "new-token", worker.accessTokens.Get())
+
+	previous, ok := worker.accessTokens.Previous()
+	assert.True(t, ok)
+	assert.Equal(t, "old-token", previous)
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+)
+
+// HealthStatus is the response from the health handler
+type HealthStatus struct {
+	// Either ok or degraded
+	Status string        `json:"status"`
+	Agents []AgentHealth `json:"agents"`
+}
+
+// AgentHealth is the health of a single worker in the pool
+type AgentHealth struct {
+	Name    string `json:"name"`
+	Paused  bool   `json:"paused"`
+	Circuit string `json:"circuit"`
+
+	// Either open or closed when the agent has acquire windows
+	AcquireWindow string `json:"acquire_window,omitempty"`
+
+	// Why the agent has stopped asking for work for a while, such as
+	// queue-paused or maintenance, and when it will next ask
+	Backoff      string     `json:"backoff,omitempty"`
+	BackoffUntil *time.Time `json:"backoff_until,omitempty"`
+}
+
+// Health returns the health of the workers in the pool. The pool is degraded
+// if any of its workers have stopped contacting the API.
+func (r *AgentPool) Health() HealthStatus {
+	health := HealthStatus{Status: "ok"}
+
+	for _, worker := range r.workers {
+		circuit := "closed"
+		if worker.circuitBreaker != nil {
+			circuit = string(worker.circuitBreaker.State())
+		}
+
+		if worker.Degraded() {
+			health.Status = "degraded"
+		}
+
+		acquireWindow := ""
+		if len(worker.agentConfiguration.AcquireWindows) > 0 {
+			acquireWindow = "closed"
+			if worker.InAcquireWindow() {
+				acquireWindow = "open"
+			}
+		}
+
+		agentHealth := AgentHealth{
+			Name:          worker.currentAgent().Name,
+			Paused:        worker.Paused(),
+			Circuit:       circuit,
+			AcquireWindow: acquireWindow,
+		}
+
+		// A paused queue or maintenance isn't a problem with the agent, so
+		// it doesn't make the pool degraded
+		if reason, until := worker.backoff.status(); reason != "" {
+			agentHealth.Backoff = reason
+			agentHealth.BackoffUntil = &until
+		}
+
+		health.Agents = append(health.Agents, agentHealth)
+	}
+
+	return health
+}
+
+// HealthHandler returns a http handler that reports the health of the pool,
+// responding with a 503 when it is degraded
+func (r *AgentPool) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		health := r.Health()
+		if health.Status == "ok" {
+			writeJSON(w, http.StatusOK, health)
+		} else {
+			writeJSON(w, http.StatusServiceUnavailable, health)
+		}
+	})
+}
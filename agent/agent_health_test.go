@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentPoolHealthReportsDegradedWorkers(t *testing.T) {
+	cb := &api.CircuitBreaker{Threshold: 1, Cooldown: time.Minute}
+
+	worker := &AgentWorker{
+		logger:         logger.Discard,
+		agent:          &api.AgentRegisterResponse{Name: "llamas-1"},
+		circuitBreaker: cb,
+	}
+	pool := NewAgentPool(logger.Discard, []*AgentWorker{worker})
+
+	get := func() (int, HealthStatus) {
+		rec := httptest.NewRecorder()
+		pool.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+		var health HealthStatus
+		if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, health
+	}
+
+	code, health := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", health.Status)
+
+	cb.Failure()
+
+	code, health = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "degraded", health.Status)
+	assert.Equal(t, []AgentHealth{{Name: "llamas-1", Circuit: "open"}}, health.Agents)
+}
+
+func TestAgentPoolHealthReportsBackoff(t *testing.T) {
+	worker := &AgentWorker{
+		logger: logger.Discard,
+		agent:  &api.AgentRegisterResponse{Name: "llamas-1"},
+	}
+	pool := NewAgentPool(logger.Discard, []*AgentWorker{worker})
+
+	now := time.Now()
+	worker.backoff.start(BackoffQueuePaused, now, time.Minute, time.Second)
+
+	health := pool.Health()
+	assert.Equal(t, "ok", health.Status)
+	assert.Equal(t, BackoffQueuePaused, health.Agents[0].Backoff)
+	if assert.NotNil(t, health.Agents[0].BackoffUntil) {
+		assert.Equal(t, now.Add(time.Minute), *health.Agents[0].BackoffUntil)
+	}
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+)
+
+// Agent hooks are run by the agent itself (rather than the bootstrap) in
+// response to agent lifecycle events, such as starting up or being idle. They
+// live in the hooks-path alongside the global job hooks.
+
+// findAgentHook returns the path to an agent hook, or os.ErrNotExist if none
+// is found in the hooks path
+func findAgentHook(hooksPath string, name string) (string, error) {
+	if hooksPath == "" {
+		return "", os.ErrNotExist
+	}
+
+	var candidates []string
+	if runtime.GOOS == "windows" {
+		candidates = append(candidates, name+".bat", name+".cmd")
+	}
+	candidates = append(candidates, name)
+
+	for _, c := range candidates {
+		p := filepath.Join(hooksPath, c)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p, nil
+		}
+	}
+
+	return "", os.ErrNotExist
+}
+
+// runAgentHook runs the named agent hook if it exists, sending its output to
+// the logger. Agents hooks failing are logged, but otherwise ignored.
+func runAgentHook(l logger.Logger, conf AgentConfiguration, ag *api.AgentRegisterResponse, name string) {
+	hookPath, err := findAgentHook(conf.HooksPath, name)
+	if err != nil {
+		return
+	}
+
+	l.Info("Running %s hook %s", name, hookPath)
+
+	// Batch files are run directly, everything else is run with bash
+	command, args := "bash", []string{hookPath}
+	if ext := strings.ToLower(filepath.Ext(hookPath)); ext == ".bat" || ext == ".cmd" {
+		command, args = hookPath, []string{}
+	}
+
+	pr, pw := io.Pipe()
+	scanned := make(chan struct{})
+
+	go func() {
+		defer close(scanned)
+		_ = process.NewScanner(l).ScanLines(pr, func(line string) {
+			l.Info("[%s] %s", name, line)
+		})
+	}()
+
+	p := process.New(l, process.Config{
+		Path:   command,
+		Args:   args,
+		Env:    agentHookEnv(conf, ag),
+		Stdout: pw,
+		Stderr: pw,
+		Dir:    filepath.Dir(hookPath),
+	})
+
+	err = p.Run()
+
+	// Wait for all the output to be logged
+	pw.Close()
+	<-scanned
+
+	if err != nil {
+		l.Error("Failed to run %s hook: %v", name, err)
+		return
+	}
+
+	if status := p.WaitStatus().ExitStatus(); status != 0 {
+		l.Warn("The %s hook exited with status %d", name, status)
+	}
+}
+
+func agentHookEnv(conf AgentConfiguration, ag *api.AgentRegisterResponse) []string {
+	return []string{
+		fmt.Sprintf("BUILDKITE_AGENT_NAME=%s", ag.Name),
+		fmt.Sprintf("BUILDKITE_AGENT_TAGS=%s", strings.Join(ag.Tags, ",")),
+		fmt.Sprintf("BUILDKITE_AGENT_PID=%d", os.Getpid()),
+		fmt.Sprintf("BUILDKITE_BUILD_PATH=%s", conf.BuildPath),
+		fmt.Sprintf("BUILDKITE_HOOKS_PATH=%s", conf.HooksPath),
+		fmt.Sprintf("BUILDKITE_PLUGINS_PATH=%s", conf.PluginsPath),
+		fmt.Sprintf("BUILDKITE_GIT_MIRRORS_PATH=%s", conf.GitMirrorsPath),
+	}
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindAgentHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = findAgentHook(dir, "agent-idle")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = findAgentHook("", "agent-idle")
+	assert.True(t, os.IsNotExist(err))
+
+	name := "agent-idle"
+	if runtime.GOOS == "windows" {
+		name += ".bat"
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, name), []byte("echo hello"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := findAgentHook(dir, "agent-idle")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, name), p)
+}
+
+func TestIdleHookDoesntRunWhileAJobIsRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("agent hooks are run with bash")
+	}
+
+	dir, err := ioutil.TempDir("", "agent-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ran := filepath.Join(dir, "ran")
+	if err = ioutil.WriteFile(filepath.Join(dir, "agent-idle"), []byte("touch "+ran), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{},
+		agentConfiguration: AgentConfiguration{HooksPath: dir},
+		jobRunner:          &JobRunner{},
+	}
+
+	worker.runIdleHook()
+	_, err = os.Stat(ran)
+	assert.True(t, os.IsNotExist(err))
+
+	worker.setJobRunner(nil)
+	worker.runIdleHook()
+	_, err = os.Stat(ran)
+	assert.NoError(t, err)
+}
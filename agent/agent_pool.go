@@ -13,13 +13,23 @@ import (
 type AgentPool struct {
 	logger  logger.Logger
 	workers []*AgentWorker
+
+	// Tracks the workers that are running, so that Stop can wait for them
+	running sync.WaitGroup
+
+	// The log levels the agent was started with, which are restored by
+	// ResetLogLevel
+	defaultLogLevel    logger.Level
+	defaultNamedLevels map[string]logger.Level
 }
 
 // NewAgentPool returns a new AgentPool
 func NewAgentPool(l logger.Logger, workers []*AgentWorker) *AgentPool {
 	return &AgentPool{
-		logger:  l,
-		workers: workers,
+		logger:             l,
+		workers:            workers,
+		defaultLogLevel:    l.GetLevel(),
+		defaultNamedLevels: logger.NamedLevels(),
 	}
 }
 
@@ -32,9 +42,11 @@ func (r *AgentPool) Start() error {
 	// Spawn goroutines for each parallel worker
 	for _, worker := range r.workers {
 		wg.Add(1)
+		r.running.Add(1)
 
 		go func(worker *AgentWorker) {
 			defer wg.Done()
+			defer r.running.Done()
 
 			if err := r.runWorker(worker); err != nil {
 				errs <- err
@@ -56,6 +68,15 @@ func (r *AgentPool) Start() error {
 	return <-errs
 }
 
+// Stop stops every worker, canceling their jobs unless graceful, and waits
+// for them to disconnect
+func (r *AgentPool) Stop(graceful bool) {
+	for _, worker := range r.workers {
+		worker.Stop(graceful)
+	}
+	r.running.Wait()
+}
+
 func (r *AgentPool) runWorker(worker *AgentWorker) error {
 	// Connect the worker to the API
 	if err := worker.Connect(); err != nil {
@@ -102,12 +123,49 @@ func (r *AgentPool) watchWorkers() {
 					worker.Stop(false)
 				}
 			}
+		} else if sig == signalwatcher.USR1 {
+			r.SetLogLevel(logger.DEBUG)
+		} else if sig == signalwatcher.USR2 {
+			r.ResetLogLevel()
+		} else if sig == signalwatcher.HUP {
+			if err := logger.ReopenLogFiles(); err != nil {
+				r.logger.Error("Failed to reopen log files: %v", err)
+			} else {
+				r.logger.Debug("Reopened log files")
+			}
 		} else {
 			r.logger.Debug("Ignoring signal `%s`", sig.String())
 		}
 	})
 }
 
+// SetLogLevel changes the log level of the agent and all of its workers,
+// including any jobs they're running. Their loggers, and those of their API
+// clients, are all made from the agent's logger and share its level.
+func (r *AgentPool) SetLogLevel(level logger.Level) {
+	r.logger.SetLevel(level)
+
+	r.logger.Notice("Log level set to %s", level)
+}
+
+// SetNamedLogLevels changes the log levels of some of the agent's
+// subsystems, such as "api", leaving the others as they are
+func (r *AgentPool) SetNamedLogLevels(levels map[string]logger.Level) {
+	named := logger.NamedLevels()
+	for name, level := range levels {
+		named[name] = level
+		r.logger.Notice("Log level of %s set to %s", name, level)
+	}
+	logger.SetNamedLevels(named)
+}
+
+// ResetLogLevel changes the log levels back to what the agent was started
+// with
+func (r *AgentPool) ResetLogLevel() {
+	logger.SetNamedLevels(r.defaultNamedLevels)
+	r.SetLogLevel(r.defaultLogLevel)
+}
+
 // ShowBanner prints a welcome banner and the configuration options
 func ShowBanner(l logger.Logger, conf AgentConfiguration) {
 	welcomeMessage :=
@@ -133,6 +191,9 @@ func ShowBanner(l logger.Logger, conf AgentConfiguration) {
 
 	if conf.ConfigPath != "" {
 		l.Info("Configuration loaded from: %s", conf.ConfigPath)
+		if conf.ConfigProfile != "" {
+			l.Info("Using configuration profile: %s", conf.ConfigProfile)
+		}
 	}
 
 	l.Debug("Bootstrap command: %s", conf.BootstrapScript)
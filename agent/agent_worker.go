@@ -1,7 +1,9 @@
 package agent
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,6 +16,16 @@ import (
 	"github.com/buildkite/agent/retry"
 )
 
+// How long a long-polled ping asks the API to wait for work, which is less
+// than the API client's timeout
+const longPollWait = 50 * time.Second
+
+// How long a long-polled ping has to have been held open for the next one to
+// start straight away. Pings that return sooner, because the agent is
+// degraded or the endpoint answered without waiting, wait for the ticker so
+// that the agent doesn't hammer the API.
+const minLongPollHold = time.Second
+
 type AgentWorkerConfig struct {
 	// Whether to set debug in the job
 	Debug bool
@@ -26,6 +38,9 @@ type AgentWorkerConfig struct {
 
 	// The configuration of the agent from the CLI
 	AgentConfiguration AgentConfiguration
+
+	// Called whenever a job the agent runs moves from one state to another
+	JobTransitionHooks []JobTransitionHook
 }
 
 type AgentWorker struct {
@@ -35,15 +50,55 @@ type AgentWorker struct {
 	// of the struct
 	lastPing, lastHeartbeat int64
 
+	// Whether the agent has been paused via a control command, accessed
+	// atomically
+	paused int32
+
+	// Whether the agent is outside of its acquire windows, accessed
+	// atomically
+	outsideAcquireWindow int32
+
+	// Whether the endpoint held the last ping open until there was work,
+	// accessed atomically
+	longPolled int32
+
+	// Whether the API has asked the agent to stop asking for work for a
+	// while, because its queue is paused or Buildkite is unavailable
+	backoff acquireBackoff
+
+	// Cancels a ping that's being held open when the agent stops
+	pingContext context.Context
+
 	// The API Client used when this agent is communicating with the API
 	apiClient *api.Client
 
+	// The endpoint the API Client is using
+	endpoint string
+
+	// Guards the API Client, its endpoint and the agent's registration,
+	// which the ping loop replaces when the agent switches to a new
+	// registration or endpoint while other goroutines are using them
+	clientLock sync.RWMutex
+
+	// The agent's access token, shared by the API Clients of the agent and
+	// its jobs so that it can be rotated
+	accessTokens *api.RotatingToken
+
+	// Whether to disable HTTP2 for the API Client
+	disableHTTP2 bool
+
+	// Stops the agent hammering the API when it's failing
+	circuitBreaker *api.CircuitBreaker
+
 	// The logger instance to use
 	logger logger.Logger
 
 	// The configuration of the agent from the CLI
 	agentConfiguration AgentConfiguration
 
+	// Called whenever a job the agent runs moves from one state to another
+	jobTransitionHooks []JobTransitionHook
+
 	// The registered agent API record
 	agent *api.AgentRegisterResponse
 
@@ -68,6 +123,9 @@ type AgentWorker struct {
 	// Track the idle disconnect timer
 	idleTimer *time.Timer
 
+	// Track the timer for running the agent-idle hook
+	idleHookTimer *time.Timer
+
 	// Stop controls
 	stop      chan struct{}
 	stopping  bool
@@ -75,7 +133,17 @@ type AgentWorker struct {
 
 	// When this worker runs a job, we'll store an instance of the
 	// JobRunner here
-	jobRunner *JobRunner
+	jobRunner      *JobRunner
+	jobRunnerMutex sync.Mutex
+
+	// Tags that have been set locally via a control command
+	localTags     map[string]string
+	localTagsLock sync.Mutex
+
+	// A new registration of the agent, such as one with updated tags, that
+	// the agent switches to between jobs
+	registration     *api.AgentRegisterResponse
+	registrationLock sync.Mutex
 }
 
 // Creates the agent worker and initializes it's API Client
@@ -87,11 +155,25 @@ func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Co
 		endpoint = c.Endpoint
 	}
 
+	// Pings and heartbeats share a circuit breaker, so that when the API is
+	// down the agent backs off as a whole instead of each retrying on its own
+	circuitBreaker := api.NewCircuitBreaker()
+	circuitBreaker.OnStateChange = func(from, to api.CircuitState) {
+		switch to {
+		case api.CircuitOpen:
+			l.Warn("The Buildkite Agent API is failing, the agent is degraded and will stop asking for work for a while")
+		case api.CircuitClosed:
+			l.Info("The Buildkite Agent API is reachable again")
+		}
+	}
+
 	// Create an APIClient with the agent's access token
+	accessTokens := api.NewRotatingToken(a.AccessToken)
 	apiClient := NewAPIClient(l, APIClientConfig{
-		Endpoint:     endpoint,
-		Token:        a.AccessToken,
-		DisableHTTP2: c.DisableHTTP2,
+		Endpoint:       endpoint,
+		Tokens:         accessTokens,
+		DisableHTTP2:   c.DisableHTTP2,
+		CircuitBreaker: circuitBreaker,
 	})
 
 	return &AgentWorker{
@@ -99,8 +181,13 @@ func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Co
 		agent:              a,
 		metricsCollector:   m,
 		apiClient:          apiClient,
+		endpoint:           endpoint,
+		accessTokens:       accessTokens,
+		disableHTTP2:       c.DisableHTTP2,
+		circuitBreaker:     circuitBreaker,
 		debug:              c.Debug,
 		agentConfiguration: c.AgentConfiguration,
+		jobTransitionHooks: c.JobTransitionHooks,
 		stop:               make(chan struct{}),
 	}
 }
@@ -108,7 +195,7 @@ func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Co
 // Starts the agent worker
 func (a *AgentWorker) Start() error {
 	a.metrics = a.metricsCollector.Scope(metrics.Tags{
-		"agent_name": a.agent.Name,
+		"agent_name": a.currentAgent().Name,
 	})
 
 	// Start running our metrics collector
@@ -121,12 +208,22 @@ func (a *AgentWorker) Start() error {
 	a.running = true
 
 	// Create the intervals we'll be using
-	pingInterval := time.Second * time.Duration(a.agent.PingInterval)
-	heartbeatInterval := time.Second * time.Duration(a.agent.HeartbeatInterval)
+	pingInterval := time.Second * time.Duration(a.currentAgent().PingInterval)
+	heartbeatInterval := time.Second * time.Duration(a.currentAgent().HeartbeatInterval)
 
 	// Create the ticker
 	a.ticker = time.NewTicker(pingInterval)
 
+	// Stop waiting on a long-polled ping when the agent stops
+	var cancelPing context.CancelFunc
+	a.pingContext, cancelPing = context.WithCancel(context.Background())
+	defer cancelPing()
+
+	go func() {
+		<-a.stop
+		cancelPing()
+	}()
+
 	// Setup and start the heartbeater
 	go func() {
 		for {
@@ -178,6 +275,18 @@ func (a *AgentWorker) Start() error {
 		}()
 	}
 
+	// Setup a timer to run the agent-idle hook after periods of idleness.
+	// The hook is run by the ping loop, so that no job can be accepted while
+	// it's running.
+	var idleHook <-chan time.Time
+	if a.agentConfiguration.AgentIdleHookTimeout > 0 {
+		a.idleHookTimer = time.NewTimer(time.Second * time.Duration(a.agentConfiguration.AgentIdleHookTimeout))
+		idleHook = a.idleHookTimer.C
+	}
+
+	// Give the host a chance to prepare itself before taking any work
+	runAgentHook(a.logger, a.agentConfiguration, a.currentAgent(), "agent-startup")
+
 	if a.agentConfiguration.DisconnectAfterJob {
 		a.logger.Info("Waiting for job to be assigned...")
 		a.logger.Info("The agent will automatically disconnect after %d seconds if no job is assigned", a.agentConfiguration.DisconnectAfterJobTimeout)
@@ -191,13 +300,36 @@ func (a *AgentWorker) Start() error {
 	// Continue this loop until the the ticker is stopped, and we received
 	// a message on the stop channel.
 	for {
-		if !a.stopping {
+		select {
+		case <-idleHook:
+			a.runIdleHook()
+		default:
+		}
+
+		a.switchRegistration()
+
+		pinged := false
+		pingStarted := time.Now()
+		if !a.stopping && !a.Paused() && a.checkAcquireWindow(pingStarted) && !a.backoff.waiting(pingStarted) {
 			a.Ping()
+			pinged = true
+		}
+
+		// While the endpoint is holding pings open until there's work,
+		// the next ping can start straight away
+		if pinged && a.longPollAgain(pingStarted) {
+			select {
+			case <-a.stop:
+			default:
+				continue
+			}
 		}
 
 		select {
 		case <-a.ticker.C:
 			continue
+		case <-idleHook:
+			a.runIdleHook()
 		case <-a.stop:
 			a.ticker.Stop()
 
@@ -223,7 +355,7 @@ func (a *AgentWorker) Stop(graceful bool) {
 		} else {
 			// If we have a job, tell the user that we'll wait for
 			// it to finish before disconnecting
-			if a.jobRunner != nil {
+			if a.currentJobRunner() != nil {
 				a.logger.Info("Gracefully stopping agent. Waiting for current job to finish before disconnecting...")
 			} else {
 				a.logger.Info("Gracefully stopping agent. Since there is no job running, the agent will disconnect immediately")
@@ -231,13 +363,13 @@ func (a *AgentWorker) Stop(graceful bool) {
 		}
 	} else {
 		// If there's a job running, kill it, then disconnect
-		if a.jobRunner != nil {
+		if jobRunner := a.currentJobRunner(); jobRunner != nil {
 			a.logger.Info("Forcefully stopping agent. The current job will be canceled before disconnecting...")
 
 			// Kill the current job. Doesn't do anything if the job
 			// is already being killed, so it's safe to call
 			// multiple times.
-			a.jobRunner.Cancel()
+			jobRunner.Cancel()
 		} else {
 			a.logger.Info("Forcefully stopping agent. Since there is no job running, the agent will disconnect immediately")
 		}
@@ -260,8 +392,166 @@ func (a *AgentWorker) Stop(graceful bool) {
 	a.stopping = true
 }
 
+// Pause stops the agent from accepting new jobs, without affecting any job
+// that is currently running
+func (a *AgentWorker) Pause() {
+	if atomic.CompareAndSwapInt32(&a.paused, 0, 1) {
+		a.UpdateProcTitle("paused")
+	}
+}
+
+// Resume undoes Pause
+func (a *AgentWorker) Resume() {
+	atomic.StoreInt32(&a.paused, 0)
+}
+
+// Paused returns whether the agent has been paused
+func (a *AgentWorker) Paused() bool {
+	return atomic.LoadInt32(&a.paused) == 1
+}
+
+// checkAcquireWindow returns whether the agent can accept jobs at t because
+// of its acquire windows, logging whenever that changes
+func (a *AgentWorker) checkAcquireWindow(t time.Time) bool {
+	inside := a.agentConfiguration.AcquireWindows.Contains(t)
+
+	if inside && atomic.CompareAndSwapInt32(&a.outsideAcquireWindow, 1, 0) {
+		a.logger.Info("Inside the acquire window, accepting jobs again")
+	} else if !inside && atomic.CompareAndSwapInt32(&a.outsideAcquireWindow, 0, 1) {
+		a.logger.Info("Outside the acquire window %q, not accepting jobs until it opens", a.agentConfiguration.AcquireWindows.String())
+		a.UpdateProcTitle("waiting for acquire window")
+	}
+
+	return inside
+}
+
+// InAcquireWindow returns whether the agent was within its acquire windows
+// when it last checked
+func (a *AgentWorker) InAcquireWindow() bool {
+	return atomic.LoadInt32(&a.outsideAcquireWindow) == 0
+}
+
+// Busy returns whether the agent is running a job
+func (a *AgentWorker) Busy() bool {
+	return a.currentJobRunner() != nil
+}
+
+func (a *AgentWorker) currentJobRunner() *JobRunner {
+	a.jobRunnerMutex.Lock()
+	defer a.jobRunnerMutex.Unlock()
+
+	return a.jobRunner
+}
+
+func (a *AgentWorker) setJobRunner(r *JobRunner) {
+	a.jobRunnerMutex.Lock()
+	defer a.jobRunnerMutex.Unlock()
+
+	a.jobRunner = r
+}
+
+func (a *AgentWorker) currentClient() *api.Client {
+	a.clientLock.RLock()
+	defer a.clientLock.RUnlock()
+
+	return a.apiClient
+}
+
+func (a *AgentWorker) currentEndpoint() string {
+	a.clientLock.RLock()
+	defer a.clientLock.RUnlock()
+
+	return a.endpoint
+}
+
+func (a *AgentWorker) currentAgent() *api.AgentRegisterResponse {
+	a.clientLock.RLock()
+	defer a.clientLock.RUnlock()
+
+	return a.agent
+}
+
+// SetLocalTag sets a tag that is exposed to future jobs
+func (a *AgentWorker) SetLocalTag(key, value string) {
+	a.localTagsLock.Lock()
+	defer a.localTagsLock.Unlock()
+
+	if a.localTags == nil {
+		a.localTags = map[string]string{}
+	}
+	a.localTags[key] = value
+}
+
+func (a *AgentWorker) copyLocalTags() map[string]string {
+	a.localTagsLock.Lock()
+	defer a.localTagsLock.Unlock()
+
+	tags := make(map[string]string, len(a.localTags))
+	for k, v := range a.localTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Reregister gives the agent a new registration to switch to, as the API only
+// sets an agent's tags when it registers. The agent switches to it once it has
+// finished any job it's running.
+func (a *AgentWorker) Reregister(ag *api.AgentRegisterResponse) {
+	a.registrationLock.Lock()
+	defer a.registrationLock.Unlock()
+
+	a.registration = ag
+}
+
+// switchRegistration disconnects the agent and connects its new registration,
+// if it has one. It's only called from the ping loop between jobs.
+func (a *AgentWorker) switchRegistration() {
+	a.registrationLock.Lock()
+	ag := a.registration
+	a.registration = nil
+	a.registrationLock.Unlock()
+
+	if ag == nil || a.stopping {
+		return
+	}
+
+	a.logger.Info("Switching to the agent's new registration")
+	_ = a.Disconnect()
+
+	logger.Redact(a.logger, ag.AccessToken)
+	a.accessTokens.Rotate(ag.AccessToken, 0)
+
+	a.clientLock.Lock()
+	if ag.Endpoint != "" && ag.Endpoint != a.endpoint {
+		a.apiClient = NewAPIClient(a.logger, APIClientConfig{
+			Endpoint:       ag.Endpoint,
+			Tokens:         a.accessTokens,
+			DisableHTTP2:   a.disableHTTP2,
+			CircuitBreaker: a.circuitBreaker,
+		})
+		a.endpoint = ag.Endpoint
+	}
+	a.agent = ag
+	a.clientLock.Unlock()
+
+	if err := a.Connect(); err != nil {
+		a.logger.Error("Failed to connect the agent's new registration: %v", err)
+	}
+}
+
+// runIdleHook runs the agent-idle hook. It's only called from the ping loop
+// between jobs, so the agent can't accept a job until the hook has finished.
+func (a *AgentWorker) runIdleHook() {
+	if a.currentJobRunner() != nil || a.stopping {
+		return
+	}
+
+	a.logger.Debug("Agent has been idle for %d seconds", a.agentConfiguration.AgentIdleHookTimeout)
+	runAgentHook(a.logger, a.agentConfiguration, a.currentAgent(), "agent-idle")
+}
+
 func (a *AgentWorker) stopIfIdle() {
-	if a.jobRunner == nil && !a.stopping {
+	if a.currentJobRunner() == nil && !a.stopping {
 		a.Stop(true)
 	} else {
 		a.logger.Debug("Agent is running a job, going to let it finish it's work")
@@ -277,7 +567,7 @@ func (a *AgentWorker) Connect() error {
 	a.UpdateProcTitle("connecting")
 
 	return retry.Do(func(s *retry.Stats) error {
-		_, err := a.apiClient.Agents.Connect()
+		_, err := a.currentClient().Agents.Connect()
 		if err != nil {
 			a.logger.Warn("%s (%s)", err, s)
 		}
@@ -293,7 +583,7 @@ func (a *AgentWorker) Heartbeat() error {
 
 	// Retry the heartbeat a few times
 	err = retry.Do(func(s *retry.Stats) error {
-		beat, _, err = a.apiClient.Heartbeats.Beat()
+		beat, _, err = a.currentClient().Heartbeats.Beat()
 		if err != nil {
 			a.logger.Warn("%s (%s)", err, s)
 		}
@@ -311,19 +601,121 @@ func (a *AgentWorker) Heartbeat() error {
 	return nil
 }
 
+// Degraded returns whether the agent has stopped contacting the API because it
+// has been failing
+func (a *AgentWorker) Degraded() bool {
+	return a.circuitBreaker != nil && a.circuitBreaker.State() == api.CircuitOpen
+}
+
+// backOff stops the agent asking for work for a while if the ping shows that
+// its queue is paused, or that Buildkite wants fewer requests, returning
+// whether it has. A successful ping otherwise ends any backoff.
+func (a *AgentWorker) backOff(ping *api.Ping, resp *api.Response, err error) bool {
+	var reason, message string
+	var retryAfter time.Duration
+
+	if errResp, ok := err.(*api.ErrorResponse); ok && errResp.Response != nil {
+		switch errResp.Response.StatusCode {
+		case http.StatusServiceUnavailable:
+			reason, message = BackoffMaintenance, "Buildkite is unavailable, it may be down for maintenance"
+		case http.StatusTooManyRequests:
+			reason, message = BackoffRateLimited, "Buildkite is rate limiting this agent"
+		}
+		retryAfter, _ = errResp.RetryAfter()
+	} else if err == nil && ping != nil && ping.Action == "pause" {
+		reason, message = BackoffQueuePaused, "This agent's queue is paused"
+		retryAfter, _ = resp.RetryAfter()
+	}
+
+	if reason == "" {
+		if err == nil {
+			if previous := a.backoff.clear(); previous != "" {
+				a.logger.Info("Buildkite is accepting pings again, asking for work (was %s)", previous)
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	pingInterval := time.Second * time.Duration(a.currentAgent().PingInterval)
+	started := a.backoff.start(reason, now, retryAfter, pingInterval)
+	_, until := a.backoff.status()
+
+	// Only the start of a backoff is worth a warning, rather than every ping
+	// while it goes on
+	if started {
+		a.logger.Warn("%s, not asking for work for %s", message, until.Sub(now))
+		if a.metrics != nil {
+			a.metrics.Count("agent.backoff", 1, metrics.Tags{"reason": reason})
+		}
+	} else {
+		a.logger.Debug("%s, not asking for work for %s", message, until.Sub(now))
+	}
+
+	a.UpdateProcTitle(strings.Replace(reason, "-", " ", -1))
+	return true
+}
+
+// longPollAgain returns whether the next ping can start straight away, which
+// it can only if the endpoint held the last one, started at pingStarted, open
+// until there was work or it timed out
+func (a *AgentWorker) longPollAgain(pingStarted time.Time) bool {
+	return atomic.LoadInt32(&a.longPolled) == 1 && time.Since(pingStarted) >= minLongPollHold
+}
+
 // Performs a ping, which returns what action the agent should take next.
 func (a *AgentWorker) Ping() {
+	// Don't bother trying while the circuit breaker is open, once it's
+	// half-open this ping will check whether the API has recovered
+	if a.Degraded() {
+		atomic.StoreInt32(&a.longPolled, 0)
+		a.UpdateProcTitle("degraded")
+		a.logger.Debug("Skipping ping while the Buildkite Agent API is failing")
+		return
+	}
+
 	// Update the proc title
 	a.UpdateProcTitle("pinging")
 
-	ping, _, err := a.apiClient.Pings.Get()
-	if err != nil {
-		// Get the last ping time to the nearest microsecond
-		lastPing := time.Unix(atomic.LoadInt64(&a.lastPing), 0)
+	var ping *api.Ping
+	var resp *api.Response
+	var err error
+
+	if a.agentConfiguration.LongPoll {
+		ctx := a.pingContext
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ping, resp, err = a.currentClient().Pings.GetWait(ctx, longPollWait)
+
+		// The agent is stopping, so there's nothing to report
+		if ctx.Err() != nil {
+			return
+		}
+	} else {
+		ping, resp, err = a.currentClient().Pings.Get()
+	}
+
+	// Endpoints that don't support long polling respond straight away, in
+	// which case the agent goes back to pinging at its interval
+	if err == nil && a.agentConfiguration.LongPoll && resp != nil && resp.Header.Get(api.LongPollHeader) != "" {
+		if atomic.SwapInt32(&a.longPolled, 1) == 0 {
+			a.logger.Debug("The endpoint is holding pings open until there's work")
+		}
+	} else {
+		atomic.StoreInt32(&a.longPolled, 0)
+	}
 
-		// If a ping fails, we don't really care, because it'll
-		// ping again after the interval.
-		a.logger.Warn("Failed to ping: %s (Last successful was %v ago)", err, time.Now().Sub(lastPing))
+	if err != nil {
+		// If a ping fails, we don't really care, because it'll ping again
+		// after the interval. Unless Buildkite is asking for fewer pings,
+		// in which case it waits a while longer.
+		if !a.backOff(ping, resp, err) {
+			// Get the last ping time to the nearest microsecond
+			lastPing := time.Unix(atomic.LoadInt64(&a.lastPing), 0)
+
+			a.logger.Warn("Failed to ping: %s (Last successful was %v ago)", err, time.Now().Sub(lastPing))
+		}
 
 		// When the ping fails, we wan't to reset our disconnection
 		// timer. It wouldnt' be very nice if we just killed the agent
@@ -342,22 +734,30 @@ func (a *AgentWorker) Ping() {
 	}
 
 	// Should we switch endpoints?
-	if ping.Endpoint != "" && ping.Endpoint != a.agent.Endpoint {
+	if ping.Endpoint != "" && ping.Endpoint != a.currentAgent().Endpoint {
 		// Before switching to the new one, do a ping test to make sure it's
 		// valid. If it is, switch and carry on, otherwise ignore the switch
 		// for now.
 		newAPIClient := NewAPIClient(a.logger, APIClientConfig{
-			Endpoint: ping.Endpoint,
-			Token:    a.agent.AccessToken,
+			Endpoint:       ping.Endpoint,
+			Tokens:         a.accessTokens,
+			DisableHTTP2:   a.disableHTTP2,
+			CircuitBreaker: a.circuitBreaker,
 		})
 
 		newPing, _, err := newAPIClient.Pings.Get()
 		if err != nil {
 			a.logger.Warn("Failed to ping the new endpoint %s - ignoring switch for now (%s)", ping.Endpoint, err)
 		} else {
-			// Replace the APIClient and process the new ping
+			// Replace the APIClient and process the new ping. The
+			// registration is copied, as jobs may still be using the old one.
+			a.clientLock.Lock()
+			ag := *a.agent
+			ag.Endpoint = ping.Endpoint
 			a.apiClient = newAPIClient
-			a.agent.Endpoint = ping.Endpoint
+			a.endpoint = ping.Endpoint
+			a.agent = &ag
+			a.clientLock.Unlock()
 			ping = newPing
 		}
 	}
@@ -367,6 +767,11 @@ func (a *AgentWorker) Ping() {
 		a.logger.Info(ping.Message)
 	}
 
+	// Has the agent's queue been paused?
+	if a.backOff(ping, resp, nil) {
+		return
+	}
+
 	// Should the agent disconnect?
 	if ping.Action == "disconnect" {
 		a.Stop(false)
@@ -391,7 +796,7 @@ func (a *AgentWorker) Ping() {
 	// re-ping, and try the whole process again.
 	var accepted *api.Job
 	retry.Do(func(s *retry.Stats) error {
-		accepted, _, err = a.apiClient.Jobs.Accept(ping.Job)
+		accepted, _, err = a.currentClient().Jobs.Accept(ping.Job)
 
 		if err != nil {
 			if api.IsRetryableError(err) {
@@ -403,7 +808,7 @@ func (a *AgentWorker) Ping() {
 		}
 
 		return err
-	}, &retry.Config{Maximum: 30, Interval: 5 * time.Second})
+	}, &retry.Config{Maximum: 30, Interval: 5 * time.Second, Multiplier: 1.5, MaxInterval: time.Minute, FullJitter: true})
 
 	// If `accepted` is nil, then the job was never accepted
 	if accepted == nil {
@@ -419,10 +824,13 @@ func (a *AgentWorker) Ping() {
 	})
 
 	// Now that the job has been accepted, we can start it.
-	a.jobRunner, err = NewJobRunner(a.logger, jobMetricsScope, a.agent, accepted, JobRunnerConfig{
+	jobRunner, err := NewJobRunner(a.logger, jobMetricsScope, a.currentAgent(), accepted, JobRunnerConfig{
 		Debug:              a.debug,
 		Endpoint:           accepted.Endpoint,
 		AgentConfiguration: a.agentConfiguration,
+		LocalTags:          a.copyLocalTags(),
+		AccessTokens:       a.accessTokens,
+		TransitionHooks:    a.jobTransitionHooks,
 	})
 
 	// Woo! We've got a job, and successfully accepted it, let's kill our auto-disconnect timer
@@ -438,12 +846,13 @@ func (a *AgentWorker) Ping() {
 	}
 
 	// Start running the job
-	if err = a.jobRunner.Run(); err != nil {
+	a.setJobRunner(jobRunner)
+	if err = jobRunner.Run(); err != nil {
 		a.logger.Error("Failed to run job: %s", err)
 	}
 
 	// No more job, no more runner.
-	a.jobRunner = nil
+	a.setJobRunner(nil)
 
 	if a.agentConfiguration.DisconnectAfterJob {
 		a.logger.Info("Job finished. Disconnecting...")
@@ -461,6 +870,18 @@ func (a *AgentWorker) Ping() {
 		a.logger.Info("Job finished. Resetting idle timer...")
 		a.idleTimer.Reset(time.Second * time.Duration(a.agentConfiguration.DisconnectAfterIdleTimeout))
 	}
+
+	if a.idleHookTimer != nil {
+		// The timer may have fired while the job was running, in which case
+		// it's drained so that the hook doesn't run straight away
+		if !a.idleHookTimer.Stop() {
+			select {
+			case <-a.idleHookTimer.C:
+			default:
+			}
+		}
+		a.idleHookTimer.Reset(time.Second * time.Duration(a.agentConfiguration.AgentIdleHookTimeout))
+	}
 }
 
 // Disconnects the agent from the Buildkite Agent API, doesn't bother retrying
@@ -471,7 +892,7 @@ func (a *AgentWorker) Disconnect() error {
 	// Update the proc title
 	a.UpdateProcTitle("disconnecting")
 
-	_, err := a.apiClient.Agents.Disconnect()
+	_, err := a.currentClient().Agents.Disconnect()
 	if err != nil {
 		a.logger.Warn("There was an error sending the disconnect API call to Buildkite. If this agent still appears online, you may have to manually stop it (%s)", err)
 	}
@@ -482,3 +903,26 @@ func (a *AgentWorker) Disconnect() error {
 func (a *AgentWorker) UpdateProcTitle(action string) {
 	proctitle.Replace(fmt.Sprintf("buildkite-agent v%s [%s]", Version(), action))
 }
+
+// RotateAccessToken switches the agent, and any job it's running, to a new
+// access token. The token is checked with a heartbeat first, and the old one
+// is kept as a fallback for overlap in case the new one isn't accepted
+// everywhere yet.
+func (a *AgentWorker) RotateAccessToken(token string, overlap time.Duration) error {
+	logger.Redact(a.logger, token)
+
+	client := NewAPIClient(a.logger, APIClientConfig{
+		Endpoint:     a.currentEndpoint(),
+		Token:        token,
+		DisableHTTP2: a.disableHTTP2,
+	})
+
+	if _, _, err := client.Heartbeats.Beat(); err != nil {
+		return fmt.Errorf("Failed to authenticate with the new access token: %v", err)
+	}
+
+	a.accessTokens.Rotate(token, overlap)
+	a.logger.Info("Rotated the access token, the previous one will be retired in %s", overlap)
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingLongPollsOnlyWhenTheEndpointSupportsIt(t *testing.T) {
+	supported := true
+	var waits []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		waits = append(waits, req.URL.Query().Get("wait"))
+		if supported {
+			rw.Header().Set(api.LongPollHeader, "50")
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{},
+		apiClient:          NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas"}),
+		agentConfiguration: AgentConfiguration{LongPoll: true},
+	}
+
+	worker.Ping()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&worker.longPolled))
+
+	supported = false
+	worker.Ping()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&worker.longPolled))
+
+	assert.Equal(t, []string{"50", "50"}, waits)
+}
+
+func TestPingDoesntLongPollUnlessEnabled(t *testing.T) {
+	var wait string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		wait = req.URL.Query().Get("wait")
+		rw.Header().Set(api.LongPollHeader, "50")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	worker := &AgentWorker{
+		logger:    logger.Discard,
+		agent:     &api.AgentRegisterResponse{},
+		apiClient: NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas"}),
+	}
+
+	// Without asking to wait, the header doesn't mean the ping was held
+	// open, so pinging again straight away would hammer the API
+	worker.Ping()
+	assert.Equal(t, "", wait)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&worker.longPolled))
+}
+
+func TestLongPollingWaitsForTheTickerUnlessThePingWasHeldOpen(t *testing.T) {
+	var pings int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&pings, 1)
+		rw.Header().Set(api.LongPollHeader, "50")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	circuitBreaker := &api.CircuitBreaker{Threshold: 1, Cooldown: time.Minute}
+	worker := &AgentWorker{
+		logger:             logger.Discard,
+		agent:              &api.AgentRegisterResponse{},
+		apiClient:          NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas", CircuitBreaker: circuitBreaker}),
+		circuitBreaker:     circuitBreaker,
+		agentConfiguration: AgentConfiguration{LongPoll: true},
+	}
+
+	// A ping that's held open can be followed straight away
+	started := time.Now()
+	worker.Ping()
+	assert.True(t, worker.longPollAgain(started.Add(-minLongPollHold)))
+
+	// One that the endpoint answers straight away can't, even though it
+	// says it long polls
+	assert.False(t, worker.longPollAgain(started))
+
+	// Nor can one skipped because the agent is degraded
+	circuitBreaker.Failure()
+	assert.True(t, worker.Degraded())
+
+	started = time.Now()
+	worker.Ping()
+	assert.False(t, worker.longPollAgain(started.Add(-minLongPollHold)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pings))
+}
+
+func TestPingBacksOffWhileTheQueueIsPausedOrBuildkiteIsUnavailable(t *testing.T) {
+	var status int
+	var body string
+	var pings int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		pings++
+		rw.Header().Set("Content-Type", "application/json")
+		if status == http.StatusServiceUnavailable {
+			rw.Header().Set("Retry-After", "120")
+		}
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	worker := &AgentWorker{
+		logger:    logger.Discard,
+		agent:     &api.AgentRegisterResponse{PingInterval: 10},
+		apiClient: NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas"}),
+	}
+
+	status, body = http.StatusOK, `{"action":"pause","message":"The queue is paused"}`
+	worker.Ping()
+	reason, until := worker.backoff.status()
+	assert.Equal(t, BackoffQueuePaused, reason)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), until, time.Second)
+	assert.True(t, worker.backoff.waiting(time.Now()))
+
+	// The wait doubles while the queue stays paused
+	worker.Ping()
+	_, until = worker.backoff.status()
+	assert.WithinDuration(t, time.Now().Add(20*time.Second), until, time.Second)
+
+	status, body = http.StatusServiceUnavailable, `{"message":"Down for maintenance"}`
+	worker.Ping()
+	reason, until = worker.backoff.status()
+	assert.Equal(t, BackoffMaintenance, reason)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), until, time.Second)
+
+	status, body = http.StatusOK, `{}`
+	worker.Ping()
+	reason, _ = worker.backoff.status()
+	assert.Equal(t, "", reason)
+	assert.False(t, worker.backoff.waiting(time.Now()))
+	assert.Equal(t, 4, pings)
+}
+
+func TestSwitchRegistrationReconnectsWithTheNewAccessToken(t *testing.T) {
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.Path+" "+req.Header.Get("Authorization"))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	accessTokens := api.NewRotatingToken("old")
+	worker := &AgentWorker{
+		logger:       logger.Discard,
+		agent:        &api.AgentRegisterResponse{Name: "old"},
+		endpoint:     server.URL,
+		accessTokens: accessTokens,
+		apiClient:    NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Tokens: accessTokens}),
+	}
+
+	// Nothing happens without a new registration
+	worker.switchRegistration()
+	assert.Empty(t, requests)
+
+	worker.Reregister(&api.AgentRegisterResponse{Name: "new", AccessToken: "new", Endpoint: server.URL})
+	worker.switchRegistration()
+
+	assert.Equal(t, []string{"/disconnect Token old", "/connect Token new"}, requests)
+	assert.Equal(t, "new", worker.agent.Name)
+}
+
+func TestSwitchRegistrationWhileTheClientIsInUse(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{}`))
+	})
+
+	// Alternating between endpoints replaces the API client each time
+	servers := []*httptest.Server{httptest.NewServer(handler), httptest.NewServer(handler)}
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	accessTokens := api.NewRotatingToken("llamas")
+	worker := &AgentWorker{
+		logger:       logger.Discard,
+		agent:        &api.AgentRegisterResponse{Name: "agent"},
+		endpoint:     servers[0].URL,
+		accessTokens: accessTokens,
+		apiClient:    NewAPIClient(logger.Discard, APIClientConfig{Endpoint: servers[0].URL, Tokens: accessTokens}),
+	}
+
+	// Like the heartbeats and the health check, which run alongside the
+	// ping loop. Run with -race to catch unguarded access.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NotNil(t, worker.currentClient())
+			assert.NotEmpty(t, worker.currentAgent().Name)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		worker.Reregister(&api.AgentRegisterResponse{
+			Name:        fmt.Sprintf("agent-%d", i),
+			AccessToken: "llamas",
+			Endpoint:    servers[i%2].URL,
+		})
+		worker.switchRegistration()
+	}
+
+	close(stop)
+	wg.Wait()
+
+	assert.Equal(t, "agent-9", worker.currentAgent().Name)
+	assert.Equal(t, servers[1].URL, worker.currentEndpoint())
+}
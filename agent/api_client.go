@@ -22,6 +22,13 @@ type APIClientConfig struct {
 	Endpoint     string
 	Token        string
 	DisableHTTP2 bool
+
+	// An optional token that can be rotated while the client is in use,
+	// which is used instead of Token
+	Tokens *api.RotatingToken
+
+	// An optional circuit breaker shared between clients
+	CircuitBreaker *api.CircuitBreaker
 }
 
 type APIClient struct {
@@ -43,18 +50,7 @@ func NewAPIClient(l logger.Logger, c APIClientConfig) *api.Client {
 		return NewAPIClientFromSocket(l, u.Path, c)
 	}
 
-	httpTransport := &http.Transport{
-		Proxy:              http.ProxyFromEnvironment,
-		DisableCompression: false,
-		DisableKeepAlives:  false,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:        100,
-		IdleConnTimeout:     90 * time.Second,
-		TLSHandshakeTimeout: 30 * time.Second,
-	}
+	httpTransport := newHTTPTransport()
 
 	if c.DisableHTTP2 {
 		httpTransport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
@@ -63,15 +59,17 @@ func NewAPIClient(l logger.Logger, c APIClientConfig) *api.Client {
 	// Configure the HTTP client
 	httpClient := &http.Client{Transport: &api.AuthenticatedTransport{
 		Token:     c.Token,
+		Tokens:    c.Tokens,
 		Transport: httpTransport,
 	}}
 	httpClient.Timeout = 60 * time.Second
 
 	// Create the Buildkite Agent API Client
-	client := api.NewClient(httpClient, l)
+	client := api.NewClient(httpClient, l.Named("api"))
 	client.BaseURL, _ = url.Parse(c.Endpoint)
 	client.UserAgent = userAgent()
 	client.DebugHTTP = debugHTTP
+	client.CircuitBreaker = c.CircuitBreaker
 
 	return client
 }
@@ -79,7 +77,8 @@ func NewAPIClient(l logger.Logger, c APIClientConfig) *api.Client {
 func NewAPIClientFromSocket(l logger.Logger, socket string, c APIClientConfig) *api.Client {
 	httpClient := &http.Client{
 		Transport: &api.AuthenticatedTransport{
-			Token: c.Token,
+			Token:  c.Token,
+			Tokens: c.Tokens,
 			Transport: &socketTransport{
 				Socket:      socket,
 				DialTimeout: 30 * time.Second,
@@ -88,10 +87,11 @@ func NewAPIClientFromSocket(l logger.Logger, socket string, c APIClientConfig) *
 	}
 
 	// Create the Buildkite Agent API Client
-	client := api.NewClient(httpClient, l)
+	client := api.NewClient(httpClient, l.Named("api"))
 	client.BaseURL, _ = url.Parse(`http+unix://buildkite-agent`)
 	client.UserAgent = userAgent()
 	client.DebugHTTP = debugHTTP
+	client.CircuitBreaker = c.CircuitBreaker
 
 	return client
 }
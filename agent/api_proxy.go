@@ -21,7 +21,7 @@ import (
 // that will authenticate to the Buildkite Agent API
 type APIProxy struct {
 	logger           logger.Logger
-	upstreamToken    string
+	upstreamTokens   *api.RotatingToken
 	upstreamEndpoint string
 	token            string
 	socket           *os.File
@@ -29,13 +29,13 @@ type APIProxy struct {
 	listenerWg       *sync.WaitGroup
 }
 
-func NewAPIProxy(l logger.Logger, endpoint string, token string) *APIProxy {
+func NewAPIProxy(l logger.Logger, endpoint string, tokens *api.RotatingToken) *APIProxy {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	return &APIProxy{
 		logger:           l,
-		upstreamToken:    token,
+		upstreamTokens:   tokens,
 		upstreamEndpoint: endpoint,
 		token:            fmt.Sprintf("%x", sha256.Sum256([]byte(string(time.Now().UnixNano())))),
 		listenerWg:       &wg,
@@ -65,7 +65,7 @@ func (p *APIProxy) Listen() error {
 
 	go func() {
 		proxy := httputil.NewSingleHostReverseProxy(endpoint)
-		proxy.Transport = &api.AuthenticatedTransport{Token: p.upstreamToken}
+		proxy.Transport = &api.AuthenticatedTransport{Tokens: p.upstreamTokens}
 
 		// customize the reverse proxy director so that we can make some changes to the request
 		director := proxy.Director
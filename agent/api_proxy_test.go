@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/logger"
 )
 
@@ -20,7 +21,7 @@ func TestAPIProxy(t *testing.T) {
 	defer ts.Close()
 
 	// create proxy to our fake api
-	proxy := NewAPIProxy(logger.Discard, ts.URL, `llamas`)
+	proxy := NewAPIProxy(logger.Discard, ts.URL, api.NewRotatingToken(`llamas`))
 	go proxy.Listen()
 	proxy.Wait()
 	defer proxy.Close()
@@ -53,7 +54,7 @@ func TestAPIProxyFailsWithoutAccessToken(t *testing.T) {
 	defer ts.Close()
 
 	// create proxy to our fake api
-	proxy := NewAPIProxy(logger.Discard, ts.URL, `llamas`)
+	proxy := NewAPIProxy(logger.Discard, ts.URL, api.NewRotatingToken(`llamas`))
 	go proxy.Listen()
 	proxy.Wait()
 	defer proxy.Close()
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// An ArtifactBackend stores artifacts somewhere other than Buildkite, and is
+// chosen by the scheme of the upload destination, such as s3:// or gs://.
+// Backends are registered with RegisterArtifactBackend, usually in an init
+// func, so that third-party backends can be compiled in without changing
+// the uploader or downloader. Destinations with schemes that no backend is
+// registered for are handed to a buildkite-artifact-<scheme> helper on the
+// PATH, if there is one.
+type ArtifactBackend interface {
+	// NewUploader returns an uploader for the destination in the config
+	NewUploader(l logger.Logger, c ArtifactBackendUploadConfig) (Uploader, error)
+
+	// NewDownloader returns a downloader for a single artifact
+	NewDownloader(l logger.Logger, c ArtifactBackendDownloadConfig) (Downloader, error)
+}
+
+// A Downloader downloads a single artifact
+type Downloader interface {
+	Start() error
+}
+
+// ArtifactBackendUploadConfig is the configuration given to a backend's
+// uploader
+type ArtifactBackendUploadConfig struct {
+	// The destination, including the scheme, e.g s3://my-bucket-name/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+
+	// Extra configuration for finding AWS credentials
+	AWSCredentials AWSCredentialsConfig
+
+	// How artifacts are stored in S3
+	S3Options S3UploadOptions
+}
+
+// ArtifactBackendDownloadConfig is the configuration given to a backend's
+// downloader
+type ArtifactBackendDownloadConfig struct {
+	// Where the artifact was uploaded to, e.g s3://my-bucket-name/foo/bar
+	UploadDestination string
+
+	// The root directory of the download
+	Destination string
+
+	// The path of the artifact, which is also where it's saved to in the
+	// download folder unless LocalPath is set
+	Path string
+
+	// An optional path to save the file as instead of Path, relative to the
+	// download folder
+	LocalPath string
+
+	// Where to write the file while it's downloading, defaults to the folder
+	// it's being downloaded to
+	TempDir string
+
+	// Whether to fsync the file before moving it into place
+	Fsync bool
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// Where to record how the download is going, if anywhere
+	Progress *TransferProgress
+
+	// Limits how fast the download is read, if it's limited
+	Bandwidth *BandwidthLimiter
+
+	// The checksums the downloaded file must have, if they're known
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Where to write the file instead of saving it, if anywhere
+	Writer io.Writer
+
+	// How the file was compressed when it was uploaded, if it was
+	ContentEncoding string
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+
+	// Extra configuration for finding AWS credentials
+	AWSCredentials AWSCredentialsConfig
+}
+
+var (
+	artifactBackendsMutex sync.RWMutex
+	artifactBackends      = map[string]ArtifactBackend{}
+)
+
+// RegisterArtifactBackend makes a backend available for destinations with
+// the scheme, such as "s3". It panics if the scheme already has a backend.
+func RegisterArtifactBackend(scheme string, backend ArtifactBackend) {
+	artifactBackendsMutex.Lock()
+	defer artifactBackendsMutex.Unlock()
+
+	if _, exists := artifactBackends[scheme]; exists {
+		panic(fmt.Sprintf("An artifact backend is already registered for %s://", scheme))
+	}
+	artifactBackends[scheme] = backend
+}
+
+// ArtifactBackendSchemes returns the schemes that have a backend registered
+func ArtifactBackendSchemes() []string {
+	artifactBackendsMutex.RLock()
+	defer artifactBackendsMutex.RUnlock()
+
+	var schemes []string
+	for scheme := range artifactBackends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// artifactBackendFor returns the backend for a destination, which is a helper
+// if no backend is registered for its scheme
+func artifactBackendFor(destination string) (ArtifactBackend, error) {
+	i := strings.Index(destination, "://")
+	if i <= 0 {
+		return nil, fmt.Errorf("Invalid artifact destination %q, expected a scheme like s3://", destination)
+	}
+	scheme := destination[:i]
+
+	artifactBackendsMutex.RLock()
+	backend, ok := artifactBackends[scheme]
+	artifactBackendsMutex.RUnlock()
+	if ok {
+		return backend, nil
+	}
+
+	path, err := exec.LookPath(artifactHelperPrefix + scheme)
+	if err != nil {
+		var schemes []string
+		for _, s := range ArtifactBackendSchemes() {
+			schemes = append(schemes, s+"://")
+		}
+		return nil, fmt.Errorf("No artifact backend for %s:// destinations. Only %s destinations are supported, or ones with a %s%s helper on the PATH",
+			scheme, strings.Join(schemes, ", "), artifactHelperPrefix, scheme)
+	}
+
+	return &helperArtifactBackend{path: path}, nil
+}
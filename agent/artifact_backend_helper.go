@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// Helpers for destinations like foo://bucket are called buildkite-artifact-foo
+const artifactHelperPrefix = "buildkite-artifact-"
+
+// helperArtifactBackend stores artifacts with an external helper program,
+// in the same way as git credential helpers, so that stores the agent doesn't
+// know about can be used without changing it. The helper is run as:
+//
+//	buildkite-artifact-<scheme> url <destination> <path>
+//	buildkite-artifact-<scheme> upload <destination> <path>
+//	buildkite-artifact-<scheme> download <destination> <path>
+//
+// url prints the URL the artifact will have, if any. upload reads the
+// artifact from stdin, with its content type and metadata (as a JSON
+// object) in $BUILDKITE_ARTIFACT_CONTENT_TYPE and
+// $BUILDKITE_ARTIFACT_METADATA. download writes the artifact to stdout.
+// Anything a helper writes to stderr is included in the error if it fails.
+type helperArtifactBackend struct {
+	path string
+}
+
+func (b *helperArtifactBackend) NewUploader(l logger.Logger, c ArtifactBackendUploadConfig) (Uploader, error) {
+	return &helperUploader{logger: l, path: b.path, destination: c.Destination}, nil
+}
+
+func (b *helperArtifactBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloadConfig) (Downloader, error) {
+	// The helper is run as the transport of a client, so that the regular
+	// downloader's retries and checks are used
+	client := &http.Client{Transport: &helperTransport{path: b.path, destination: c.UploadDestination, artifactPath: c.Path}}
+
+	return NewDownload(l, client, DownloadConfig{
+		URL:             strings.TrimSuffix(c.UploadDestination, "/") + "/" + c.Path,
+		Path:            c.Path,
+		LocalPath:       c.LocalPath,
+		TempDir:         c.TempDir,
+		Fsync:           c.Fsync,
+		Destination:     c.Destination,
+		Retries:         c.Retries,
+		DebugHTTP:       c.DebugHTTP,
+		Progress:        c.Progress,
+		Bandwidth:       c.Bandwidth,
+		Sha1Sum:         c.Sha1Sum,
+		Sha256Sum:       c.Sha256Sum,
+		Writer:          c.Writer,
+		ContentEncoding: c.ContentEncoding,
+	}), nil
+}
+
+type helperUploader struct {
+	logger      logger.Logger
+	path        string
+	destination string
+}
+
+// URL asks the helper for the artifact's URL, which can be left blank
+func (u *helperUploader) URL(artifact *api.Artifact) string {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(u.path, "url", u.destination, artifact.Path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		u.logger.Warn("Failed to get the URL of %s from %s: %v", artifact.Path, u.path, helperError(err, &stderr))
+		return ""
+	}
+
+	return strings.TrimSpace(stdout.String())
+}
+
+func (u *helperUploader) Upload(artifact *api.Artifact) error {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	return u.UploadStream(artifact, f)
+}
+
+func (u *helperUploader) UploadStream(artifact *api.Artifact, r io.Reader) error {
+	metadata, err := json.Marshal(artifact.Metadata)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(u.path, "upload", u.destination, artifact.Path)
+	cmd.Env = append(os.Environ(),
+		"BUILDKITE_ARTIFACT_CONTENT_TYPE="+artifact.ContentType,
+		"BUILDKITE_ARTIFACT_METADATA="+string(metadata),
+	)
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+
+	u.logger.Debug("Uploading \"%s\" with %s", artifact.Path, u.path)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to upload %s with %s: %v", artifact.Path, u.path, helperError(err, &stderr))
+	}
+
+	return nil
+}
+
+// helperTransport answers every request by running the helper's download
+// command, so resuming isn't supported and each retry starts again
+type helperTransport struct {
+	path         string
+	destination  string
+	artifactPath string
+}
+
+func (t *helperTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(req.Context(), t.path, "download", t.destination, t.artifactPath)
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          &helperBody{ReadCloser: stdout, cmd: cmd, stderr: stderr},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// helperBody is the output of a helper's download command, which fails at
+// the end if the helper does
+type helperBody struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	waited bool
+}
+
+func (b *helperBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.waited {
+		b.waited = true
+		if werr := b.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("Failed to download with %s: %v", b.cmd.Path, helperError(werr, b.stderr))
+		}
+	}
+	return n, err
+}
+
+func (b *helperBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.waited {
+		b.waited = true
+		_ = b.cmd.Process.Kill()
+		_ = b.cmd.Wait()
+	}
+	return err
+}
+
+// helperError includes what a helper wrote to stderr in its error
+func helperError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+const testArtifactHelper = `#!/bin/sh
+set -e
+dest="$STORE/${2#test://}/$3"
+case "$1" in
+  url)
+    echo "https://artifacts.example.com/$3"
+    ;;
+  upload)
+    mkdir -p "$(dirname "$dest")"
+    cat > "$dest"
+    echo "$BUILDKITE_ARTIFACT_CONTENT_TYPE $BUILDKITE_ARTIFACT_METADATA" > "$dest.meta"
+    ;;
+  download)
+    if [ ! -f "$dest" ]; then
+      echo "no such artifact" >&2
+      exit 1
+    fi
+    cat "$dest"
+    ;;
+esac
+`
+
+func TestBuiltInArtifactBackendsAreRegistered(t *testing.T) {
+	assert.Equal(t, []string{"az", "gs", "rt", "s3"}, ArtifactBackendSchemes())
+
+	assert.Panics(t, func() {
+		RegisterArtifactBackend("s3", s3Backend{})
+	})
+}
+
+func TestArtifactBackendForUnknownDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	_, err = artifactBackendFor("llamas://bucket/path")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "buildkite-artifact-llamas")
+	}
+
+	_, err = artifactBackendFor("bucket/path")
+	assert.Error(t, err)
+
+	backend, err := artifactBackendFor("s3://bucket/path")
+	assert.NoError(t, err)
+	assert.Equal(t, s3Backend{}, backend)
+}
+
+func TestHelperArtifactBackendUploadsAndDownloads(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Helpers are shell scripts in this test")
+	}
+
+	dir, err := ioutil.TempDir("", "artifact-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "buildkite-artifact-test"), []byte(testArtifactHelper), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	defer os.Unsetenv("STORE")
+	os.Setenv("STORE", filepath.Join(dir, "store"))
+
+	backend, err := artifactBackendFor("test://bucket/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploader, err := backend.NewUploader(logger.Discard, ArtifactBackendUploadConfig{
+		Destination: "test://bucket/prefix",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := &api.Artifact{
+		Path:        "llamas.txt",
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"team": "llamas"},
+	}
+	assert.Equal(t, "https://artifacts.example.com/llamas.txt", uploader.URL(artifact))
+	assert.NoError(t, uploader.(StreamUploader).UploadStream(artifact, strings.NewReader("llamas")))
+
+	meta, err := ioutil.ReadFile(filepath.Join(dir, "store", "bucket", "prefix", "llamas.txt.meta"))
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain {\"team\":\"llamas\"}\n", string(meta))
+
+	var downloaded bytes.Buffer
+	downloader, err := backend.NewDownloader(logger.Discard, ArtifactBackendDownloadConfig{
+		UploadDestination: "test://bucket/prefix",
+		Path:              "llamas.txt",
+		Retries:           1,
+		Writer:            &downloaded,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, downloader.Start())
+	assert.Equal(t, "llamas", downloaded.String())
+
+	downloader, err = backend.NewDownloader(logger.Discard, ArtifactBackendDownloadConfig{
+		UploadDestination: "test://bucket/prefix",
+		Path:              "alpacas.txt",
+		Retries:           1,
+		Writer:            &downloaded,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downloader.Start(); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no such artifact")
+	}
+}
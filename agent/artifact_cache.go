@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+var sha1SumRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ArtifactCache is a directory of previously downloaded artifacts, stored by
+// their sha1sum. Jobs on the same host that download identical artifacts
+// copy them out of the cache rather than downloading them again.
+//
+// Entries are stored in {dir}/{first 2 characters of sum}/{sum}, and their
+// modification times are updated whenever they're used, so that the least
+// recently used entries can be evicted when the cache is too big.
+type ArtifactCache struct {
+	// The directory the cache is kept in
+	Dir string
+
+	// The size in bytes the cache is trimmed to after adding an entry, or 0
+	// to let it grow until something else cleans it up
+	MaxSize int64
+
+	logger logger.Logger
+}
+
+// NewArtifactCache returns a cache stored in dir
+func NewArtifactCache(l logger.Logger, dir string, maxSize int64) *ArtifactCache {
+	return &ArtifactCache{Dir: dir, MaxSize: maxSize, logger: l}
+}
+
+func (c *ArtifactCache) path(sum string) string {
+	return filepath.Join(c.Dir, sum[:2], sum)
+}
+
+// Get copies the cached artifact with the sha1sum to targetFile, returning
+// false if it isn't in the cache. Entries are checked against their sha1sum
+// as they're copied, and evicted if they don't match, so that an entry that
+// has been corrupted or tampered with is downloaded again.
+func (c *ArtifactCache) Get(sum string, targetFile string, fsync bool) (bool, error) {
+	if !sha1SumRegexp.MatchString(sum) {
+		return false, nil
+	}
+
+	src, err := os.Open(c.path(sum))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(targetFile), 0777); err != nil {
+		return false, err
+	}
+
+	tempFile, err := createTempFile(filepath.Dir(targetFile), targetFile)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	hash := sha1.New()
+	if _, err = io.Copy(io.MultiWriter(tempFile, hash), src); err != nil {
+		return false, err
+	}
+
+	if actual := fmt.Sprintf("%x", hash.Sum(nil)); actual != sum {
+		c.logger.Warn("Removing %s from the artifact cache, as it has a sha1sum of %s", c.path(sum), actual)
+		if err := os.Remove(c.path(sum)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if err = finishDownload(tempFile, targetFile, fsync); err != nil {
+		return false, err
+	}
+
+	// Mark the entry as recently used
+	now := time.Now()
+	_ = os.Chtimes(c.path(sum), now, now)
+
+	return true, nil
+}
+
+// Put adds a downloaded file to the cache, as long as its contents match the
+// sha1sum. The cache is then trimmed to its maximum size.
+func (c *ArtifactCache) Put(sum string, file string) error {
+	if !sha1SumRegexp.MatchString(sum) {
+		return fmt.Errorf("Invalid sha1sum %q", sum)
+	}
+
+	target := c.path(sum)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+
+	tempFile, err := createTempFile(filepath.Dir(target), target)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	hash := sha1.New()
+	if _, err = io.Copy(io.MultiWriter(tempFile, hash), src); err != nil {
+		return err
+	}
+
+	// Never cache something under the wrong sum, as every later download of
+	// the artifact would get the wrong contents
+	if actual := fmt.Sprintf("%x", hash.Sum(nil)); actual != sum {
+		return fmt.Errorf("%s has a sha1sum of %s, expected %s", file, actual, sum)
+	}
+
+	if err = finishDownload(tempFile, target, false); err != nil {
+		return err
+	}
+
+	if c.MaxSize > 0 {
+		return c.Evict(c.MaxSize)
+	}
+
+	return nil
+}
+
+type artifactCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Evict removes the least recently used entries until the cache is no bigger
+// than maxSize bytes
+func (c *ArtifactCache) Evict(maxSize int64) error {
+	var entries []artifactCacheEntry
+	var total int64
+
+	err := filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Leave anything that isn't a cache entry alone, including the
+		// temporary files of downloads in progress
+		if info.IsDir() || !sha1SumRegexp.MatchString(info.Name()) {
+			return nil
+		}
+
+		entries = append(entries, artifactCacheEntry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	for _, entry := range entries {
+		if total <= maxSize {
+			break
+		}
+
+		c.logger.Debug("Removing %s from the artifact cache", entry.path)
+
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= entry.size
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha1Sum(s string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+}
+
+func TestArtifactCacheGetAndPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewArtifactCache(logger.Discard, filepath.Join(dir, "cache"), 0)
+	sum := sha1Sum("llamas")
+
+	hit, err := cache.Get(sum, filepath.Join(dir, "out", "llamas.txt"), false)
+	assert.NoError(t, err)
+	assert.False(t, hit)
+
+	src := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(src, []byte("llamas"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Contents that don't match the sum are never cached
+	assert.Error(t, cache.Put(sha1Sum("alpacas"), src))
+	assert.Error(t, cache.Put("../../etc/passwd", src))
+
+	assert.NoError(t, cache.Put(sum, src))
+
+	hit, err = cache.Get(sum, filepath.Join(dir, "out", "llamas.txt"), false)
+	assert.NoError(t, err)
+	assert.True(t, hit)
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "out", "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(contents))
+}
+
+func TestArtifactCacheEvictsEntriesThatDontMatchTheirSum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewArtifactCache(logger.Discard, filepath.Join(dir, "cache"), 0)
+	sum := sha1Sum("llamas")
+
+	// Another job has written to the cache directly
+	if err := os.MkdirAll(filepath.Dir(cache.path(sum)), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cache.path(sum), []byte("alpacas"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "out", "llamas.txt")
+
+	hit, err := cache.Get(sum, target, false)
+	assert.NoError(t, err)
+	assert.False(t, hit)
+
+	_, err = os.Stat(cache.path(sum))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArtifactCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewArtifactCache(logger.Discard, dir, 0)
+
+	// Three 10 byte entries, each used an hour after the last
+	for i, contents := range []string{"0123456789", "abcdefghij", "ABCDEFGHIJ"} {
+		src := filepath.Join(dir, "src")
+		if err := ioutil.WriteFile(src, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, cache.Put(sha1Sum(contents), src))
+
+		used := time.Now().Add(time.Duration(i-3) * time.Hour)
+		assert.NoError(t, os.Chtimes(cache.path(sha1Sum(contents)), used, used))
+	}
+
+	assert.NoError(t, cache.Evict(25))
+
+	exists := func(contents string) bool {
+		_, err := os.Stat(cache.path(sha1Sum(contents)))
+		return err == nil
+	}
+
+	assert.False(t, exists("0123456789"))
+	assert.True(t, exists("abcdefghij"))
+	assert.True(t, exists("ABCDEFGHIJ"))
+
+	// Files that aren't cache entries are left alone
+	_, err = os.Stat(filepath.Join(dir, "src"))
+	assert.NoError(t, err)
+}
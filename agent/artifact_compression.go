@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// ArtifactContentEncodingKey is the metadata key that records how an artifact
+// was compressed when it was uploaded, so that it can be decompressed again
+// when it's downloaded
+const ArtifactContentEncodingKey = "content-encoding"
+
+// ArtifactCompressions are the ways that artifacts can be compressed. There's
+// no zstd package vendored, so zstd uses the zstd command, which has to be
+// installed wherever artifacts are uploaded or downloaded.
+var ArtifactCompressions = []string{"gzip", "zstd"}
+
+// ValidateArtifactCompression returns an error if artifacts can't be
+// compressed with the encoding
+func ValidateArtifactCompression(encoding string) error {
+	for _, c := range ArtifactCompressions {
+		if c == encoding {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid artifact compression %q, expected one of %s", encoding, strings.Join(ArtifactCompressions, ", "))
+}
+
+// compressReader returns the contents of r compressed with the encoding, as
+// they're read
+func compressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		pr, pw := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(pw)
+			_, err := io.Copy(gz, r)
+			if cerr := gz.Close(); err == nil {
+				err = cerr
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	case "zstd":
+		cmd, stderr, err := zstdCommand("-q", "-c")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = r
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandOutput{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported artifact compression %q", encoding)
+	}
+}
+
+// decompressWriter returns a writer that decompresses what's written to it
+// into w. Close must be called once everything has been written, and returns
+// any error decompressing it.
+func decompressWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		pr, pw := io.Pipe()
+		d := &pipeDecompressor{PipeWriter: pw, done: make(chan error, 1)}
+		go func() {
+			gz, err := gzip.NewReader(pr)
+			if err == nil {
+				_, err = io.Copy(w, gz)
+			}
+			pr.CloseWithError(err)
+			d.done <- err
+		}()
+		return d, nil
+	case "zstd":
+		cmd, stderr, err := zstdCommand("-q", "-d", "-c")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandInput{WriteCloser: stdin, cmd: cmd, stderr: stderr}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported artifact content-encoding %q", encoding)
+	}
+}
+
+// pipeDecompressor is written to by a download, while something else reads
+// the other end of the pipe and decompresses it
+type pipeDecompressor struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (d *pipeDecompressor) Close() error {
+	d.PipeWriter.Close()
+	return <-d.done
+}
+
+// zstdCommand returns a zstd command with the args, along with what it
+// writes to stderr
+func zstdCommand(args ...string) (*exec.Cmd, *bytes.Buffer, error) {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, nil, fmt.Errorf("zstd compression needs the zstd command to be installed (%v)", err)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = stderr
+
+	return cmd, stderr, nil
+}
+
+// commandOutput is what a command writes to stdout, which fails at the end if
+// the command does
+type commandOutput struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	waited bool
+}
+
+func (c *commandOutput) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF && !c.waited {
+		c.waited = true
+		if werr := c.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s failed: %v", c.cmd.Path, helperError(werr, c.stderr))
+		}
+	}
+	return n, err
+}
+
+func (c *commandOutput) Close() error {
+	// Waiting closes stdout, so there's nothing left to do
+	if c.waited {
+		return nil
+	}
+
+	c.waited = true
+	err := c.ReadCloser.Close()
+	_ = c.cmd.Process.Kill()
+	_ = c.cmd.Wait()
+	return err
+}
+
+// commandInput is a command's stdin, and closing it waits for the command to
+// finish
+type commandInput struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *commandInput) Close() error {
+	c.WriteCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v", c.cmd.Path, helperError(err, c.stderr))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactCompressionRoundTrips(t *testing.T) {
+	for _, encoding := range ArtifactCompressions {
+		if _, err := exec.LookPath(encoding); encoding == "zstd" && err != nil {
+			t.Logf("Skipping %s, as it isn't installed", encoding)
+			continue
+		}
+
+		original := strings.Repeat("llamas are the best animals\n", 1000)
+
+		r, err := compressReader(encoding, strings.NewReader(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := ioutil.ReadAll(r)
+		assert.NoError(t, err, encoding)
+		assert.NoError(t, r.Close(), encoding)
+		assert.True(t, len(compressed) < len(original), encoding)
+
+		var decompressed bytes.Buffer
+		w, err := decompressWriter(encoding, &decompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(compressed)
+		assert.NoError(t, err, encoding)
+		assert.NoError(t, w.Close(), encoding)
+		assert.Equal(t, original, decompressed.String(), encoding)
+
+		// Corrupt data is an error when the writer is closed, if not before
+		w, err = decompressWriter(encoding, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, werr := w.Write([]byte("not compressed at all"))
+		assert.True(t, werr != nil || w.Close() != nil, encoding)
+	}
+
+	assert.NoError(t, ValidateArtifactCompression("zstd"))
+	assert.Error(t, ValidateArtifactCompression("lzma"))
+}
@@ -3,10 +3,11 @@ package agent
 import (
 	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/logger"
@@ -25,12 +26,75 @@ type ArtifactDownloaderConfig struct {
 
 	// Where we'll be downloading artifacts to
 	Destination string
+
+	// What to do when multiple artifacts would be downloaded to the same
+	// path, one of overwrite, skip, rename, fail or latest
+	OnConflict string
+
+	// Also download artifacts from jobs that have been retried
+	IncludeRetriedJobs bool
+
+	// Only download artifacts from jobs in these states, such as passed
+	JobStates []string
+
+	// Where to write files while they're downloading
+	TempDir string
+
+	// Whether to fsync files before moving them into place
+	Fsync bool
+
+	// Only download artifacts with all of these metadata key/value pairs
+	Metadata map[string]string
+
+	// Rules for changing where artifacts are saved, relative to Destination
+	PathRewrites []ArtifactPathRewrite
+
+	// Extra configuration for finding AWS credentials for S3
+	AWSCredentials AWSCredentialsConfig
+
+	// A directory to cache downloaded artifacts in by sha1sum, shared between
+	// jobs on the same host
+	CacheDir string
+
+	// The size in bytes the cache is trimmed to, or 0 for no limit
+	CacheMaxSize int64
+
+	// Where to report the progress of downloads, if anywhere
+	Transfers *TransferReporter
+
+	// The most bytes per second that downloads can read between them, or 0
+	// for no limit
+	Bandwidth int64
+
+	// How many artifacts to download at once, or 0 for no limit
+	Parallel int
+
+	// Don't check that downloaded artifacts have the checksums they were
+	// uploaded with
+	NoVerify bool
+
+	// Where to write the artifact instead of saving it to Destination, such
+	// as stdout. The query must match exactly one artifact.
+	Writer io.Writer
 }
 
+// The ways that ArtifactDownloader can handle multiple artifacts with the
+// same path
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictRename    = "rename"
+	ConflictFail      = "fail"
+	ConflictLatest    = "latest"
+)
+
 type ArtifactDownloader struct {
 	// The config for downloading
 	conf ArtifactDownloaderConfig
 
+	// Limits how fast all of the downloads are read, if they're limited
+	bandwidth *BandwidthLimiter
+
 	// The logger instance to use
 	logger logger.Logger
 
@@ -40,13 +104,18 @@ type ArtifactDownloader struct {
 
 func NewArtifactDownloader(l logger.Logger, ac *api.Client, c ArtifactDownloaderConfig) ArtifactDownloader {
 	return ArtifactDownloader{
-		logger:    l,
+		logger:    l.Named("artifact"),
 		apiClient: ac,
 		conf:      c,
+		bandwidth: NewBandwidthLimiter(c.Bandwidth),
 	}
 }
 
 func (a *ArtifactDownloader) Download() error {
+	if a.conf.Writer != nil {
+		return a.stream()
+	}
+
 	// Turn the download destination into an absolute path and confirm it exists
 	downloadDestination, _ := filepath.Abs(a.conf.Destination)
 	fileInfo, err := os.Stat(downloadDestination)
@@ -58,65 +127,34 @@ func (a *ArtifactDownloader) Download() error {
 		return fmt.Errorf("%s is not a directory", downloadDestination)
 	}
 
-	// Find the artifacts that we want to download
-	artifacts, err := NewArtifactSearcher(a.logger, a.apiClient, a.conf.BuildID).
-		Search(a.conf.Query, a.conf.Step)
+	downloads, err := a.findDownloads()
 	if err != nil {
 		return err
 	}
 
-	artifactCount := len(artifacts)
+	artifactCount := len(downloads)
 
 	if artifactCount == 0 {
 		return errors.New("No artifacts found for downloading")
 	} else {
 		a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
 
-		p := pool.New(pool.MaxConcurrencyLimit)
+		parallel := a.conf.Parallel
+		if parallel <= 0 {
+			parallel = pool.MaxConcurrencyLimit
+		}
+
+		p := pool.New(parallel)
 		errors := []error{}
 
-		for _, artifact := range artifacts {
+		for _, download := range downloads {
 			// Create new instance of the artifact for the goroutine
 			// See: http://golang.org/doc/effective_go.html#channels
-			artifact := artifact
+			artifact := download.artifact
+			localPath := download.localPath
 
 			p.Spawn(func() {
-				var err error
-
-				// Handle downloading from S3, GS, or RT
-				if strings.HasPrefix(artifact.UploadDestination, "s3://") {
-					err = NewS3Downloader(a.logger, S3DownloaderConfig{
-						Path:        artifact.Path,
-						Bucket:      artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.apiClient.DebugHTTP,
-					}).Start()
-				} else if strings.HasPrefix(artifact.UploadDestination, "gs://") {
-					err = NewGSDownloader(a.logger, GSDownloaderConfig{
-						Path:        artifact.Path,
-						Bucket:      artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.apiClient.DebugHTTP,
-					}).Start()
-				} else if strings.HasPrefix(artifact.UploadDestination, "rt://") {
-					err = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
-						Path:        artifact.Path,
-						Repository:  artifact.UploadDestination,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.apiClient.DebugHTTP,
-					}).Start()
-				} else {
-					err = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
-						URL:         artifact.URL,
-						Path:        artifact.Path,
-						Destination: downloadDestination,
-						Retries:     5,
-						DebugHTTP:   a.apiClient.DebugHTTP,
-					}).Start()
-				}
+				err := a.downloadArtifact(artifact, localPath, downloadDestination)
 
 				// If the downloaded encountered an error, lock
 				// the pool, collect it, then unlock the pool
@@ -140,3 +178,283 @@ func (a *ArtifactDownloader) Download() error {
 
 	return nil
 }
+
+// stream writes the one artifact that matches the query to the Writer,
+// without saving it anywhere
+func (a *ArtifactDownloader) stream() error {
+	downloads, err := a.findDownloads()
+	if err != nil {
+		return err
+	}
+
+	switch len(downloads) {
+	case 0:
+		return errors.New("No artifacts found for downloading")
+	case 1:
+	default:
+		return fmt.Errorf("Found %d artifacts, but only one can be written at a time", len(downloads))
+	}
+
+	artifact := downloads[0].artifact
+	a.logger.Info("Found \"%s\", writing it to %s", artifact.Path, writerName(a.conf.Writer))
+
+	return a.fetchArtifact(artifact, downloads[0].localPath, "")
+}
+
+// writerName describes where a writer writes to, for logging
+func writerName(w io.Writer) string {
+	if f, ok := w.(*os.File); ok {
+		return f.Name()
+	}
+	return fmt.Sprintf("%T", w)
+}
+
+// findDownloads finds the artifacts that match the query and filters, and
+// works out where each one will be saved, leaving out any that can't be
+// saved safely
+func (a *ArtifactDownloader) findDownloads() ([]artifactDownload, error) {
+	artifacts, err := NewArtifactSearcher(a.logger, a.apiClient, a.conf.BuildID).
+		SearchWithOptions(&api.ArtifactSearchOptions{
+			Query:              a.conf.Query,
+			Scope:              a.conf.Step,
+			IncludeRetriedJobs: a.conf.IncludeRetriedJobs,
+			JobStates:          a.conf.JobStates,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a.conf.Metadata) > 0 {
+		var matching []*api.Artifact
+		for _, artifact := range artifacts {
+			if ArtifactMatchesMetadata(artifact, a.conf.Metadata) {
+				matching = append(matching, artifact)
+			}
+		}
+		a.logger.Debug("%d of %d artifacts match the metadata filter", len(matching), len(artifacts))
+		artifacts = matching
+	}
+
+	return a.planDownloads(artifacts)
+}
+
+// downloadArtifact downloads a single artifact, copying it from the cache
+// instead if it's been downloaded on this host before
+func (a *ArtifactDownloader) downloadArtifact(artifact *api.Artifact, localPath string, destination string) error {
+	if a.conf.CacheDir == "" || artifact.Sha1Sum == "" {
+		return a.fetchArtifact(artifact, localPath, destination)
+	}
+
+	targetFile, err := downloadTarget(destination, localPath)
+	if err != nil {
+		return err
+	}
+
+	cache := NewArtifactCache(a.logger, a.conf.CacheDir, a.conf.CacheMaxSize)
+
+	hit, err := cache.Get(artifact.Sha1Sum, targetFile, a.conf.Fsync)
+	if err != nil {
+		a.logger.Warn("Failed to copy %s from the artifact cache: %v", artifact.Path, err)
+	} else if hit {
+		a.logger.Info("Copied \"%s\" from the artifact cache", artifact.Path)
+		return nil
+	}
+
+	if err := a.fetchArtifact(artifact, localPath, destination); err != nil {
+		return err
+	}
+
+	// A failure to cache the artifact isn't a failure to download it
+	if err := cache.Put(artifact.Sha1Sum, targetFile); err != nil {
+		a.logger.Warn("Failed to add %s to the artifact cache: %v", artifact.Path, err)
+	}
+
+	return nil
+}
+
+// fetchArtifact downloads a single artifact from wherever it was uploaded to,
+// saving it to localPath within the destination folder
+func (a *ArtifactDownloader) fetchArtifact(artifact *api.Artifact, localPath string, destination string) error {
+	progress := a.conf.Transfers.Track("download", artifact.Path, artifact.FileSize)
+	defer a.conf.Transfers.Finish(progress)
+
+	sha1Sum, sha256Sum := artifact.Sha1Sum, artifact.Sha256Sum
+	if a.conf.NoVerify {
+		sha1Sum, sha256Sum = "", ""
+	}
+
+	// Artifacts uploaded somewhere other than Buildkite are downloaded by the
+	// backend for their destination's scheme
+	if artifact.UploadDestination != "" {
+		backend, err := artifactBackendFor(artifact.UploadDestination)
+		if err == nil {
+			downloader, err := backend.NewDownloader(a.logger, ArtifactBackendDownloadConfig{
+				UploadDestination: artifact.UploadDestination,
+				Destination:       destination,
+				Path:              artifact.Path,
+				LocalPath:         localPath,
+				TempDir:           a.conf.TempDir,
+				Fsync:             a.conf.Fsync,
+				Retries:           5,
+				Progress:          progress,
+				Bandwidth:         a.bandwidth,
+				Sha1Sum:           sha1Sum,
+				Sha256Sum:         sha256Sum,
+				Writer:            a.conf.Writer,
+				ContentEncoding:   artifact.Metadata[ArtifactContentEncodingKey],
+				DebugHTTP:         a.apiClient.DebugHTTP,
+				AWSCredentials:    a.conf.AWSCredentials,
+			})
+			if err != nil {
+				return err
+			}
+			return downloader.Start()
+		}
+		a.logger.Debug("%v, downloading %s from its URL instead", err, artifact.Path)
+	}
+
+	return NewDownload(a.logger, newArtifactHTTPClient(), DownloadConfig{
+		URL:             artifact.URL,
+		Path:            artifact.Path,
+		LocalPath:       localPath,
+		TempDir:         a.conf.TempDir,
+		Fsync:           a.conf.Fsync,
+		Destination:     destination,
+		Retries:         5,
+		DebugHTTP:       a.apiClient.DebugHTTP,
+		Progress:        progress,
+		Bandwidth:       a.bandwidth,
+		Sha1Sum:         sha1Sum,
+		Sha256Sum:       sha256Sum,
+		Writer:          a.conf.Writer,
+		ContentEncoding: artifact.Metadata[ArtifactContentEncodingKey],
+	}).Start()
+}
+
+// artifactDownload is an artifact along with the path it will be saved to,
+// relative to the download destination
+type artifactDownload struct {
+	artifact  *api.Artifact
+	localPath string
+}
+
+// planDownloads works out where each artifact will be saved, after its path
+// has been rewritten by the PathRewrites rules. Artifacts with paths that
+// would escape the download destination are left out, and artifacts that
+// would be saved to the same path are handled according to the OnConflict
+// setting.
+func (a *ArtifactDownloader) planDownloads(artifacts []*api.Artifact) ([]artifactDownload, error) {
+	switch a.conf.OnConflict {
+	case "", ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail, ConflictLatest:
+	default:
+		return nil, fmt.Errorf("Unknown conflict behavior %q, must be one of overwrite, skip, rename, fail or latest", a.conf.OnConflict)
+	}
+
+	var downloads []artifactDownload
+	seen := map[string]int{}
+
+	for _, artifact := range artifacts {
+		// Rewritten paths are checked like any other, so they can't be
+		// rewritten to outside of the destination
+		path := rewriteArtifactPath(artifact.Path, a.conf.PathRewrites)
+		if path != artifact.Path {
+			a.logger.Debug("Rewrote the path of artifact %q to %q", artifact.Path, path)
+		}
+
+		localPath, err := safeArtifactPath(path)
+		if err != nil {
+			a.logger.Warn("Skipping artifact: %s", err)
+			continue
+		}
+
+		i, exists := seen[localPath]
+		if !exists {
+			seen[localPath] = len(downloads)
+			downloads = append(downloads, artifactDownload{artifact, localPath})
+			continue
+		}
+
+		switch a.conf.OnConflict {
+		case ConflictOverwrite, "":
+			a.logger.Warn("Multiple artifacts have the path %q, only the last one will be downloaded", path)
+			downloads[i].artifact = artifact
+
+		case ConflictSkip:
+			a.logger.Warn("Multiple artifacts have the path %q, only the first one will be downloaded", path)
+
+		case ConflictRename:
+			renamed := renameArtifactPath(localPath, seen)
+			a.logger.Info("Multiple artifacts have the path %q, this one will be downloaded to %q", path, renamed)
+			seen[renamed] = len(downloads)
+			downloads = append(downloads, artifactDownload{artifact, renamed})
+
+		case ConflictFail:
+			return nil, fmt.Errorf("Multiple artifacts have the path %q", path)
+
+		case ConflictLatest:
+			if !createdBefore(artifact, downloads[i].artifact) {
+				downloads[i].artifact = artifact
+			}
+			a.logger.Info("Multiple artifacts have the path %q, only the latest one (from job %s) will be downloaded", path, downloads[i].artifact.JobID)
+		}
+	}
+
+	return downloads, nil
+}
+
+// createdBefore returns whether artifact a was created before b. If either
+// creation time isn't known, the one that was found later is treated as the
+// latest.
+func createdBefore(a, b *api.Artifact) bool {
+	aTime, aErr := time.Parse(time.RFC3339Nano, a.CreatedAt)
+	bTime, bErr := time.Parse(time.RFC3339Nano, b.CreatedAt)
+	if aErr != nil || bErr != nil {
+		return false
+	}
+	return aTime.Before(bTime)
+}
+
+// safeArtifactPath turns an artifact path into a local path relative to the
+// download destination, returning an error if it would end up outside of it
+func safeArtifactPath(path string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+
+	if path == "" || cleaned == "." {
+		return "", fmt.Errorf("Artifact path %q is empty", path)
+	}
+
+	// Paths like /etc/passwd or C:\Windows are turned into relative ones by
+	// filepath.Join later on, but are almost certainly a mistake
+	if filepath.IsAbs(cleaned) || filepath.VolumeName(cleaned) != "" || strings.HasPrefix(cleaned, string(os.PathSeparator)) {
+		return "", fmt.Errorf("Artifact path %q is absolute", path)
+	}
+
+	if !isWithinDirectory(".", cleaned) {
+		return "", fmt.Errorf("Artifact path %q is outside of the download destination", path)
+	}
+
+	return cleaned, nil
+}
+
+// renameArtifactPath returns a path like "foo-1.txt" for "foo.txt" that isn't
+// in the seen paths
+func renameArtifactPath(path string, seen map[string]int) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	for n := 1; ; n++ {
+		renamed := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if _, exists := seen[renamed]; !exists {
+			return renamed
+		}
+	}
+}
+
+// isWithinDirectory returns whether path is dir, or is inside of it
+func isWithinDirectory(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
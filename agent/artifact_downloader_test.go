@@ -1,11 +1,19 @@
 package agent
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"github.com/buildkite/agent/logger"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestArtifactDownloaderConnectsToEndpoint(t *testing.T) {
@@ -32,12 +40,206 @@ func TestArtifactDownloaderConnectsToEndpoint(t *testing.T) {
 		Token:    `llamasforever`,
 	})
 
+	// Download somewhere that the test can clean up, rather than into the
+	// package
+	dir, err := ioutil.TempDir("", "artifact-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: dir,
+	})
+
+	err = d.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArtifactDownloaderStreamsOneArtifactToWriter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/builds/my-build/artifacts/search`:
+			paths := []string{"llamas.txt"}
+			if req.URL.Query().Get("query") == "*" {
+				paths = append(paths, "alpacas.txt")
+			}
+			var artifacts []map[string]interface{}
+			for _, path := range paths {
+				artifacts = append(artifacts, map[string]interface{}{
+					"path": path,
+					"url":  fmt.Sprintf("http://%s/download/%s", req.Host, path),
+				})
+			}
+			json.NewEncoder(rw).Encode(artifacts)
+		case `/download/llamas.txt`:
+			fmt.Fprint(rw, "llamas")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	var out bytes.Buffer
+
 	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
 		BuildID: "my-build",
+		Query:   "llamas.txt",
+		Writer:  &out,
 	})
+	assert.NoError(t, d.Download())
+	assert.Equal(t, "llamas", out.String())
 
+	// Only one artifact can be written at a time
+	out.Reset()
+	d = NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID: "my-build",
+		Query:   "*",
+		Writer:  &out,
+	})
 	err := d.Download()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Found 2 artifacts")
+	assert.Empty(t, out.String())
+}
+
+func TestArtifactDownloaderPlanDownloads(t *testing.T) {
+	artifacts := []*api.Artifact{
+		{Path: "coverage/index.html", URL: "1"},
+		{Path: "../../etc/passwd", URL: "2"},
+		{Path: "/etc/shadow", URL: "3"},
+		{Path: "coverage/index.html", URL: "4"},
+		{Path: "coverage/../coverage/index.html", URL: "5"},
+	}
+
+	plan := func(onConflict string) ([]artifactDownload, error) {
+		d := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{OnConflict: onConflict})
+		return d.planDownloads(artifacts)
+	}
+
+	summary := func(downloads []artifactDownload) []string {
+		var s []string
+		for _, d := range downloads {
+			s = append(s, d.artifact.URL+"="+filepath.ToSlash(d.localPath))
+		}
+		return s
+	}
+
+	downloads, err := plan(ConflictOverwrite)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"5=coverage/index.html"}, summary(downloads))
+
+	downloads, err = plan(ConflictSkip)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1=coverage/index.html"}, summary(downloads))
+
+	downloads, err = plan(ConflictRename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"1=coverage/index.html",
+		"4=coverage/index-1.html",
+		"5=coverage/index-2.html",
+	}, summary(downloads))
+
+	// Without creation times, the last one found is the latest
+	downloads, err = plan(ConflictLatest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"5=coverage/index.html"}, summary(downloads))
+
+	_, err = plan(ConflictFail)
+	assert.Error(t, err)
+
+	_, err = plan("llamas")
+	assert.Error(t, err)
+}
+
+func TestArtifactDownloaderPlanDownloadsLatest(t *testing.T) {
+	artifacts := []*api.Artifact{
+		{Path: "pkg/app", URL: "1", CreatedAt: "2019-03-01T10:00:00Z"},
+		{Path: "pkg/app", URL: "2", CreatedAt: "2019-03-01T12:00:00.5Z"},
+		{Path: "pkg/app", URL: "3", CreatedAt: "2019-03-01T11:00:00Z"},
+	}
+
+	d := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{OnConflict: ConflictLatest})
+	downloads, err := d.planDownloads(artifacts)
+	assert.NoError(t, err)
+
+	if assert.Len(t, downloads, 1) {
+		assert.Equal(t, "2", downloads[0].artifact.URL)
+	}
+}
+
+func TestArtifactDownloaderPlanDownloadsWithPathRewrites(t *testing.T) {
+	artifacts := []*api.Artifact{
+		{Path: "dist/app", URL: "1"},
+		{Path: "dist/lib/app.so", URL: "2"},
+		{Path: "docs/index.html", URL: "3"},
+		{Path: "tmp/secret", URL: "4"},
+	}
+
+	rewrites, err := ParseArtifactPathRewrites([]string{"dist/lib/=>lib/", "dist/=>bin/", "tmp/=>../"})
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	d := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{PathRewrites: rewrites})
+	downloads, err := d.planDownloads(artifacts)
+	assert.NoError(t, err)
+
+	var s []string
+	for _, d := range downloads {
+		s = append(s, d.artifact.URL+"="+filepath.ToSlash(d.localPath))
+	}
+
+	// Rewrites can't take artifacts outside of the destination
+	assert.Equal(t, []string{"1=bin/app", "2=lib/app.so", "3=docs/index.html"}, s)
+}
+
+func TestParseArtifactPathRewrites(t *testing.T) {
+	rewrites, err := ParseArtifactPathRewrites([]string{"dist/=>bin/", "build/=>"})
+	assert.NoError(t, err)
+	assert.Equal(t, []ArtifactPathRewrite{{From: "dist/", To: "bin/"}, {From: "build/", To: ""}}, rewrites)
+
+	for _, bad := range []string{"dist/", "=>bin/", "dist/->bin/"} {
+		_, err := ParseArtifactPathRewrites([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestArtifactSearcherFiltersByJob(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "true", req.URL.Query().Get("include_retried_jobs"))
+		assert.Equal(t, "passed,broken", req.URL.Query().Get("job_states"))
+
+		// This API doesn't filter by state itself
+		fmt.Fprint(rw, `[
+			{"path": "a", "job_id": "1", "job_state": "passed"},
+			{"path": "b", "job_id": "2", "job_state": "failed"},
+			{"path": "c", "job_id": "3"}
+		]`)
+	}))
+	defer server.Close()
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas"})
+
+	artifacts, err := NewArtifactSearcher(logger.Discard, ac, "my-build").SearchWithOptions(&api.ArtifactSearchOptions{
+		Query:              "*",
+		IncludeRetriedJobs: true,
+		JobStates:          []string{"passed", "broken"},
+	})
+	assert.NoError(t, err)
+
+	var paths []string
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.Equal(t, []string{"a", "c"}, paths)
 }
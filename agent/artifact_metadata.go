@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/api"
+)
+
+// ParseArtifactMetadata parses key=value pairs, like those given to
+// `artifact upload --metadata`
+func ParseArtifactMetadata(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	metadata := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid artifact metadata %q, expected key=value", pair)
+		}
+		metadata[strings.TrimSpace(parts[0])] = parts[1]
+	}
+
+	return metadata, nil
+}
+
+// ArtifactMatchesMetadata returns whether the artifact has all of the
+// key/value pairs in filter
+func ArtifactMatchesMetadata(artifact *api.Artifact, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := artifact.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// s3Tagging encodes metadata as S3 object tags, which are sent as a query
+// string in the x-amz-tagging header
+func s3Tagging(metadata map[string]string) string {
+	values := url.Values{}
+	for key, value := range metadata {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// artifactoryMatrixParams encodes metadata as Artifactory properties, which
+// are set on deploy with matrix parameters (;key=value) on the path
+func artifactoryMatrixParams(metadata map[string]string) string {
+	var keys []string
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params string
+	for _, key := range keys {
+		params += ";" + url.PathEscape(key) + "=" + url.PathEscape(metadata[key])
+	}
+	return params
+}
+
+// azureMetadataHeaders encodes metadata as Azure blob metadata headers. Their
+// names must be C# identifiers, so anything else in a key becomes _.
+func azureMetadataHeaders(metadata map[string]string) map[string]string {
+	headers := map[string]string{}
+	for key, value := range metadata {
+		name := []byte(key)
+		for i, c := range name {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+				name[i] = '_'
+			}
+		}
+		if len(name) == 0 {
+			continue
+		}
+		if name[0] >= '0' && name[0] <= '9' {
+			name = append([]byte{'_'}, name...)
+		}
+		headers["x-ms-meta-"+string(name)] = value
+	}
+	return headers
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArtifactMetadata(t *testing.T) {
+	metadata, err := ParseArtifactMetadata([]string{"team=payments", "kind=coverage", "query=a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"team":  "payments",
+		"kind":  "coverage",
+		"query": "a=b",
+	}, metadata)
+
+	for _, bad := range []string{"team", "=payments"} {
+		_, err := ParseArtifactMetadata([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestArtifactMatchesMetadata(t *testing.T) {
+	artifact := &api.Artifact{Metadata: map[string]string{"team": "payments", "kind": "coverage"}}
+
+	assert.True(t, ArtifactMatchesMetadata(artifact, nil))
+	assert.True(t, ArtifactMatchesMetadata(artifact, map[string]string{"team": "payments"}))
+	assert.False(t, ArtifactMatchesMetadata(artifact, map[string]string{"team": "search"}))
+	assert.False(t, ArtifactMatchesMetadata(&api.Artifact{}, map[string]string{"team": "payments"}))
+}
+
+func TestArtifactMetadataEncodings(t *testing.T) {
+	metadata := map[string]string{"team": "payments & billing", "kind": "coverage"}
+
+	assert.Equal(t, "kind=coverage&team=payments+%26+billing", s3Tagging(metadata))
+	assert.Equal(t, ";kind=coverage;team=payments%20&%20billing", artifactoryMatrixParams(metadata))
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ArtifactPathRewrite changes the start of the paths that artifacts are
+// downloaded to, such as from dist/ to bin/
+type ArtifactPathRewrite struct {
+	From string
+	To   string
+}
+
+// ParseArtifactPathRewrites parses from=>to rules, like those given to
+// `artifact download --path-rewrite`
+func ParseArtifactPathRewrites(rules []string) ([]ArtifactPathRewrite, error) {
+	var rewrites []ArtifactPathRewrite
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=>", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid path rewrite %q, expected from=>to (e.g. dist/=>bin/)", rule)
+		}
+		rewrites = append(rewrites, ArtifactPathRewrite{From: parts[0], To: parts[1]})
+	}
+	return rewrites, nil
+}
+
+// rewriteArtifactPath applies the first rule whose From the path starts with,
+// returning the path unchanged if none of them match
+func rewriteArtifactPath(path string, rewrites []ArtifactPathRewrite) string {
+	for _, r := range rewrites {
+		if strings.HasPrefix(path, r.From) {
+			return r.To + strings.TrimPrefix(path, r.From)
+		}
+	}
+	return path
+}
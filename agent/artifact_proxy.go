@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// ArtifactProxy serves the artifacts of a build over plain HTTP on localhost,
+// so that tools inside a job (a bazel remote cache, curl, etc) can fetch them
+// without needing an agent access token. Artifacts are fetched with:
+//
+//	GET $BUILDKITE_ARTIFACT_PROXY_URL/path/to/artifact[?step=...&build=...]
+//
+// Artifacts can also be uploaded to the destinations of artifact backends,
+// such as s3:// or gs://, with the agent's own credentials, which keeps them out of
+// containers and VMs that jobs run in:
+//
+//	PUT $BUILDKITE_ARTIFACT_PROXY_URL/path/to/artifact?destination=...[&metadata=k=v]
+//
+// The URL contains a random token, so other users on the host can't use it.
+//
+// Except on windows, the proxy also listens on a unix socket, which can be
+// mounted into containers that can't reach the host's localhost.
+type ArtifactProxy struct {
+	logger         logger.Logger
+	apiClient      *api.Client
+	buildID        string
+	jobID          string
+	token          string
+	listener       net.Listener
+	socketListener net.Listener
+	socketPath     string
+}
+
+func NewArtifactProxy(l logger.Logger, ac *api.Client, buildID, jobID string) *ArtifactProxy {
+	return &ArtifactProxy{
+		logger:    l,
+		apiClient: ac,
+		buildID:   buildID,
+		jobID:     jobID,
+	}
+}
+
+// Listen on a random port on localhost and start serving requests in the
+// background
+func (p *ArtifactProxy) Listen() error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	p.token = fmt.Sprintf("%x", token)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	p.listener = l
+
+	p.logger.Debug("[ArtifactProxy] Listening on tcp socket %s", l.Addr().String())
+
+	go func() {
+		_ = http.Serve(l, p)
+	}()
+
+	if runtime.GOOS != "windows" {
+		if err := p.listenOnUnixSocket(); err != nil {
+			_ = p.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ArtifactProxy) listenOnUnixSocket() error {
+	socket, err := ioutil.TempFile("", "artifact-proxy-socket")
+	if err != nil {
+		return err
+	}
+	socket.Close()
+
+	// The socket can't be created while the temp file exists
+	_ = os.Remove(socket.Name())
+
+	l, err := net.Listen("unix", socket.Name())
+	if err != nil {
+		return err
+	}
+	p.socketListener = l
+	p.socketPath = socket.Name()
+
+	// Restrict to owner r+w permissions
+	if err = os.Chmod(socket.Name(), 0600); err != nil {
+		return err
+	}
+
+	p.logger.Debug("[ArtifactProxy] Listening on unix socket %s", socket.Name())
+
+	go func() {
+		_ = http.Serve(l, p)
+	}()
+
+	return nil
+}
+
+// SocketPath returns the path of the proxy's unix socket, if it has one.
+// Requests to it use the same paths as the URL.
+func (p *ArtifactProxy) SocketPath() string {
+	return p.socketPath
+}
+
+// URL returns the base URL that artifact paths should be appended to
+func (p *ArtifactProxy) URL() string {
+	return fmt.Sprintf("http://%s/%s", p.listener.Addr().String(), p.token)
+}
+
+// Close stops the proxy
+func (p *ArtifactProxy) Close() error {
+	if p.socketListener != nil {
+		_ = p.socketListener.Close()
+		_ = os.Remove(p.socketPath)
+	}
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Close()
+}
+
+func (p *ArtifactProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/" + p.token + "/"
+	if p.token == "" || !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "PUT" {
+		http.Error(w, "Only GET, HEAD and PUT requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	if _, err := safeArtifactPath(path); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "PUT" {
+		p.upload(w, r, path)
+		return
+	}
+
+	buildID := p.buildID
+	if build := r.URL.Query().Get("build"); build != "" {
+		buildID = build
+	}
+
+	artifact, status, err := p.find(buildID, path, r.URL.Query().Get("step"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	p.logger.Debug("[ArtifactProxy] Fetching %s from build %s", path, buildID)
+
+	// Compressed artifacts are decompressed on the way through, so their
+	// uploaded size isn't what's sent
+	if artifact.Metadata[ArtifactContentEncodingKey] == "" && artifact.FileSize > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(artifact.FileSize, 10))
+	}
+	if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Accept-Ranges", "none")
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Stream the artifact with the same downloaders that `artifact
+	// download` uses, so that every storage backend is supported without
+	// the proxy having to store it anywhere
+	out := &proxyResponseWriter{w: w}
+	downloader := &ArtifactDownloader{
+		logger:    p.logger,
+		apiClient: p.apiClient,
+		conf:      ArtifactDownloaderConfig{Writer: out},
+	}
+	if err := downloader.fetchArtifact(artifact, filepath.Base(filepath.FromSlash(path)), ""); err != nil {
+		p.logger.Warn("[ArtifactProxy] Failed to fetch %s: %v", path, err)
+
+		// Once some of the artifact has been sent, the only way to tell
+		// the client that the rest isn't coming is to drop the connection
+		if out.wrote {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Length")
+		http.Error(w, fmt.Sprintf("Failed to fetch artifact: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// An empty artifact has nothing to write
+	if !out.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// proxyResponseWriter sends each part of an artifact as soon as it arrives,
+// rather than when the response's buffer fills up. It records whether any
+// has been sent, as after that the response's status can't be changed.
+type proxyResponseWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (p *proxyResponseWriter) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		p.wrote = true
+	}
+	n, err := p.w.Write(b)
+	if f, ok := p.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return n, err
+}
+
+// find returns the single artifact in the build with exactly the given path,
+// along with a http status to use if it can't be found
+func (p *ArtifactProxy) find(buildID, path, step string) (*api.Artifact, int, error) {
+	artifacts, err := NewArtifactSearcher(p.logger, p.apiClient, buildID).Search(path, step)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+
+	var matches []*api.Artifact
+	for _, artifact := range artifacts {
+		if artifact.Path == path {
+			matches = append(matches, artifact)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, http.StatusNotFound, fmt.Errorf("No artifact found with path %q", path)
+	case 1:
+		return matches[0], http.StatusOK, nil
+	default:
+		return nil, http.StatusConflict, fmt.Errorf("%d artifacts have the path %q, use ?step= to choose one", len(matches), path)
+	}
+}
@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactProxyServesArtifacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/builds/my-build/artifacts/search`:
+			fmt.Fprintf(rw, `[
+				{"path": "pkg/llamas.txt", "url": "http://%s/download/llamas", "file_size": 16},
+				{"path": "pkg/alpacas.txt", "url": "http://%s/download/alpacas"},
+				{"path": "pkg/alpacas.txt", "url": "http://%s/download/alpacas"}
+			]`, req.Host, req.Host, req.Host)
+		case `/download/llamas`:
+			fmt.Fprint(rw, "llamas are great")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	proxy := NewArtifactProxy(logger.Discard, ac, "my-build", "my-job")
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	get := func(url string) (int, string) {
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get(proxy.URL() + "/pkg/llamas.txt")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "llamas are great", body)
+
+	res, err := http.Head(proxy.URL() + "/pkg/llamas.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int64(16), res.ContentLength)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+
+	status, _ = get(proxy.URL() + "/pkg/alpacas.txt")
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, _ = get(proxy.URL() + "/pkg/nope.txt")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Requests without the token in the URL aren't served
+	status, _ = get("http://" + proxy.listener.Addr().String() + "/pkg/llamas.txt")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestArtifactProxyStreamsArtifacts(t *testing.T) {
+	halfway := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/builds/my-build/artifacts/search`:
+			fmt.Fprintf(rw, `[{"path": "llamas.txt", "url": "http://%s/download/llamas"}]`, req.Host)
+		case `/download/llamas`:
+			fmt.Fprint(rw, "llamas are ")
+			rw.(http.Flusher).Flush()
+
+			// The rest isn't sent until the client has the first half,
+			// which it only can if the proxy isn't waiting for all of it
+			<-halfway
+			fmt.Fprint(rw, "great")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	proxy := NewArtifactProxy(logger.Discard, ac, "my-build", "my-job")
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL() + "/llamas.txt")
+	if err != nil {
+		close(halfway)
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	first := make([]byte, len("llamas are "))
+	_, err = io.ReadFull(res.Body, first)
+	close(halfway)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rest, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "llamas are great", string(first)+string(rest))
+}
+
+func TestArtifactProxyUploadsArtifactsWithItsOwnCredentials(t *testing.T) {
+	uploaded := map[string]string{}
+	var created []*api.Artifact
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/my-repo/"):
+			body, _ := ioutil.ReadAll(req.Body)
+			uploaded[req.URL.Path] = string(body)
+		case req.Method == "POST" && req.URL.Path == "/jobs/my-job/artifacts":
+			var batch api.ArtifactBatch
+			json.NewDecoder(req.Body).Decode(&batch)
+			created = append(created, batch.Artifacts...)
+			fmt.Fprintf(rw, `{"id":"batch","artifact_ids":["artifact-%d"]}`, len(created))
+		case req.Method == "PUT" && req.URL.Path == "/jobs/my-job/artifacts":
+			fmt.Fprint(rw, `{}`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// Only the agent running the job should have credentials, but this test
+	// plays both parts
+	for k, v := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL,
+		"BUILDKITE_ARTIFACTORY_USER":     "user",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "password",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	proxy := NewArtifactProxy(logger.Discard, ac, "my-build", "my-job")
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	dir, err := ioutil.TempDir("", "artifact-proxy-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job's API client can't reach the API, so everything has to go
+	// through the proxy
+	jobClient := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: "http://localhost:1",
+		Token:    `llamasforever`,
+	})
+
+	uploader := NewArtifactUploader(logger.Discard, jobClient, ArtifactUploaderConfig{
+		JobID:       "my-job",
+		Paths:       filepath.Join(dir, "llamas.txt"),
+		Destination: "rt://my-repo",
+		Metadata:    map[string]string{"team": "llamas"},
+		ProxyURL:    proxy.URL(),
+	})
+	if err := uploader.Upload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Containers reach the proxy through its socket instead
+	if runtime.GOOS != "windows" {
+		uploader = NewArtifactUploader(logger.Discard, jobClient, ArtifactUploaderConfig{
+			JobID:       "my-job",
+			Destination: "rt://my-repo",
+			Metadata:    map[string]string{"team": "llamas"},
+			ProxyURL:    "http://localhost/" + proxy.token,
+			ProxySocket: proxy.SocketPath(),
+		})
+	}
+
+	err = uploader.UploadStream(strings.NewReader("alpacas"), "alpacas.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "alpacas", uploaded["/my-repo/alpacas.txt;team=llamas"])
+	assert.Len(t, uploaded, 2)
+
+	if assert.Len(t, created, 2) {
+		assert.Equal(t, int64(6), created[0].FileSize)
+		assert.Equal(t, map[string]string{"team": "llamas"}, created[0].Metadata)
+		assert.Equal(t, "alpacas.txt", created[1].Path)
+		assert.Equal(t, int64(7), created[1].FileSize)
+	}
+}
+
+func TestArtifactProxyRejectsUploadsToBuildkiteStorage(t *testing.T) {
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: "http://localhost:1",
+		Token:    `llamasforever`,
+	})
+
+	proxy := NewArtifactProxy(logger.Discard, ac, "my-build", "my-job")
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	err := newArtifactProxyClient(proxy.URL(), "").put("llamas.txt", strings.NewReader("llamas"), 6, "text/plain", ArtifactUploaderConfig{})
+	if perr, ok := err.(*artifactProxyError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, http.StatusBadRequest, perr.StatusCode)
+	}
+}
+
+func TestArtifactProxyStopsListeningIfTheUnixSocketFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the artifact proxy doesn't listen on a unix socket on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "artifact-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The socket is created in the temp dir, which won't exist
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: "http://localhost:1",
+		Token:    `llamasforever`,
+	})
+
+	proxy := NewArtifactProxy(logger.Discard, ac, "my-build", "my-job")
+	assert.Error(t, proxy.Listen())
+
+	if assert.NotNil(t, proxy.listener) {
+		_, err := net.Dial("tcp", proxy.listener.Addr().String())
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/pool"
+	"github.com/buildkite/agent/retry"
+)
+
+// isProxiedDestination returns whether uploads to a destination can be handed
+// to the artifact proxy. Buildkite's own storage is uploaded to with the
+// job's access token, so only the destinations of artifact backends, which
+// need credentials, are.
+func isProxiedDestination(destination string) bool {
+	return destination != ""
+}
+
+// upload handles a PUT of an artifact from the job, uploading the body to the
+// destination with the agent's own credentials, so that jobs in containers or
+// VMs don't need them. The artifact is created on the proxy's job once it has
+// been uploaded, in the same way as `artifact upload --stdin`.
+func (p *ArtifactProxy) upload(w http.ResponseWriter, r *http.Request, path string) {
+	query := r.URL.Query()
+
+	destination := query.Get("destination")
+	if !isProxiedDestination(destination) {
+		http.Error(w, "Uploads to Buildkite's artifact storage can't be made through the proxy, only those with a destination", http.StatusBadRequest)
+		return
+	}
+	if _, err := artifactBackendFor(destination); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid upload destination %q: %v", destination, err), http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := ParseArtifactMetadata(query["metadata"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s3Options := S3UploadOptions{
+		ACL:                  query.Get("s3_acl"),
+		ServerSideEncryption: query.Get("s3_server_side_encryption"),
+		SSEKMSKeyID:          query.Get("s3_sse_kms_key_id"),
+		StorageClass:         query.Get("s3_storage_class"),
+	}
+	if err := s3Options.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compress := query.Get("compress")
+	if compress != "" {
+		if err := ValidateArtifactCompression(compress); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	p.logger.Debug("[ArtifactProxy] Uploading %s to %s", path, destination)
+
+	uploader := NewArtifactUploader(p.logger, p.apiClient, ArtifactUploaderConfig{
+		JobID:       p.jobID,
+		Destination: destination,
+		ContentType: r.Header.Get("Content-Type"),
+		Metadata:    metadata,
+		S3Options:   s3Options,
+		Compress:    compress,
+	})
+
+	if err := uploader.UploadStream(r.Body, path); err != nil {
+		p.logger.Warn("[ArtifactProxy] Failed to upload %s: %v", path, err)
+		http.Error(w, fmt.Sprintf("Failed to upload artifact: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// artifactProxyError is a failed response from the artifact proxy
+type artifactProxyError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *artifactProxyError) Error() string {
+	return fmt.Sprintf("The artifact proxy responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// artifactProxyClient uploads artifacts through the artifact proxy of the
+// agent running the job, using its unix socket if there is one
+type artifactProxyClient struct {
+	url    string
+	client *http.Client
+}
+
+func newArtifactProxyClient(proxyURL, socket string) *artifactProxyClient {
+	transport := &http.Transport{}
+	if socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	return &artifactProxyClient{
+		url:    proxyURL,
+		client: &http.Client{Transport: transport},
+	}
+}
+
+// put uploads body as the artifact at path. size is -1 if it isn't known.
+func (c *artifactProxyClient) put(path string, body io.Reader, size int64, contentType string, conf ArtifactUploaderConfig) error {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + path
+
+	query := url.Values{}
+	query.Set("destination", conf.Destination)
+
+	// Sorted so that requests are the same every time
+	var keys []string
+	for k := range conf.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		query.Add("metadata", k+"="+conf.Metadata[k])
+	}
+
+	for k, v := range map[string]string{
+		"s3_acl":                    conf.S3Options.ACL,
+		"s3_server_side_encryption": conf.S3Options.ServerSideEncryption,
+		"s3_sse_kms_key_id":         conf.S3Options.SSEKMSKeyID,
+		"s3_storage_class":          conf.S3Options.StorageClass,
+		"compress":                  conf.Compress,
+	} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("PUT", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(res.Body)
+		return &artifactProxyError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	return nil
+}
+
+// useProxy returns whether uploads should be handed to the artifact proxy
+// instead of being uploaded with this process's own credentials
+func (a *ArtifactUploader) useProxy() bool {
+	return a.conf.ProxyURL != "" && isProxiedDestination(a.conf.Destination)
+}
+
+// uploadThroughProxy hands each artifact to the artifact proxy, which uploads
+// it and creates it on Buildkite. As nothing is created until an upload has
+// succeeded, failed uploads can be retried from the start.
+func (a *ArtifactUploader) uploadThroughProxy(artifacts []*api.Artifact) error {
+	client := newArtifactProxyClient(a.conf.ProxyURL, a.conf.ProxySocket)
+
+	p := pool.New(pool.MaxConcurrencyLimit)
+	errors := []error{}
+	var errorsMutex sync.Mutex
+
+	for _, artifact := range artifacts {
+		artifact := artifact
+
+		p.Spawn(func() {
+			a.logger.Info("Uploading artifact %s through the agent's artifact proxy (%d bytes)", artifact.Path, artifact.FileSize)
+
+			progress := a.conf.Transfers.Track("upload", artifact.Path, artifact.FileSize)
+
+			err := retry.Do(func(s *retry.Stats) error {
+				if s.Attempt > 1 {
+					progress.Retry()
+				}
+
+				f, err := os.Open(artifact.AbsolutePath)
+				if err != nil {
+					s.Break()
+					return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+				}
+				defer f.Close()
+
+				err = client.put(artifact.Path, a.bandwidth.Reader(progress.Reader(f)), artifact.FileSize, artifact.ContentType, a.conf)
+				if err != nil {
+					// The proxy won't accept the upload no matter how
+					// many times it's tried
+					if perr, ok := err.(*artifactProxyError); ok && perr.StatusCode < 500 {
+						s.Break()
+					}
+					a.logger.Warn("%s (%s)", err, s)
+				}
+
+				return err
+			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+
+			a.conf.Transfers.Finish(progress)
+
+			if err != nil {
+				a.logger.Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
+
+				errorsMutex.Lock()
+				errors = append(errors, err)
+				errorsMutex.Unlock()
+			}
+		})
+	}
+
+	p.Wait()
+
+	if len(errors) > 0 {
+		return fmt.Errorf("There were errors with uploading some of the artifacts")
+	}
+
+	return nil
+}
+
+// streamThroughProxy hands a stream to the artifact proxy as a single
+// artifact. Like any other stream, it can't be retried.
+func (a *ArtifactUploader) streamThroughProxy(r io.Reader, path string, contentType string) error {
+	a.logger.Info("Uploading artifact %s from a stream through the agent's artifact proxy", path)
+
+	progress := a.conf.Transfers.Track("upload", path, -1)
+	err := newArtifactProxyClient(a.conf.ProxyURL, a.conf.ProxySocket).
+		put(path, a.bandwidth.Reader(progress.Reader(r)), -1, contentType, a.conf)
+	a.conf.Transfers.Finish(progress)
+
+	if err != nil {
+		return fmt.Errorf("Error uploading artifact \"%s\": %v", path, err)
+	}
+
+	a.logger.Info("Uploaded artifact %s", path)
+	return nil
+}
@@ -0,0 +1,350 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/mime"
+	"github.com/buildkite/agent/retry"
+	"github.com/buildkite/shellwords"
+)
+
+const (
+	// Artifacts that scanning finds problems with aren't uploaded, and the
+	// upload fails once the rest have been uploaded
+	ArtifactScanBlock = "block"
+
+	// Artifacts that scanning finds problems with are uploaded anyway, and
+	// the problems are reported
+	ArtifactScanFlag = "flag"
+)
+
+// ValidateArtifactScanAction returns an error if action isn't one of the
+// things that can be done with artifacts that scanning finds problems with
+func ValidateArtifactScanAction(action string) error {
+	if action != ArtifactScanBlock && action != ArtifactScanFlag {
+		return fmt.Errorf("Unknown scan action %q, must be either %s or %s", action, ArtifactScanBlock, ArtifactScanFlag)
+	}
+	return nil
+}
+
+// ArtifactFinding is a problem that scanning found in an artifact. It
+// describes what was found, but never includes it, so that findings can be
+// logged and shown in annotations without leaking secrets.
+type ArtifactFinding struct {
+	// The path of the artifact, and the name of the scanner that found the
+	// problem, which are filled in by the uploader
+	Path    string
+	Scanner string
+
+	// The line the problem is on, or 0 if it isn't known
+	Line int
+
+	Description string
+}
+
+func (f ArtifactFinding) String() string {
+	if f.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s (%s)", f.Path, f.Line, f.Description, f.Scanner)
+	}
+	return fmt.Sprintf("%s: %s (%s)", f.Path, f.Description, f.Scanner)
+}
+
+// An ArtifactScanner checks artifacts for things that shouldn't be uploaded,
+// such as credentials or malware, after they've been collected and before
+// they're uploaded
+type ArtifactScanner interface {
+	// Name is shown alongside what the scanner finds
+	Name() string
+
+	// Scan returns the problems found in the file at path. An error means
+	// the file couldn't be scanned, not that it has problems.
+	Scan(path string) ([]ArtifactFinding, error)
+}
+
+type secretPattern struct {
+	description string
+	re          *regexp.Regexp
+
+	// The longest that a match can be, which bounds how far apart the
+	// chunks of a file can be scanned
+	maxLength int
+}
+
+var secretPatterns = []secretPattern{
+	{"AWS access key ID", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), 20},
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]{0,64}PRIVATE KEY( BLOCK)?-----`), 100},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,255}\b`), 259},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[0-9A-Za-z-]{10,255}`), 260},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}`), 39},
+	{"Stripe secret key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,255}`), 263},
+}
+
+// How much of a file is scanned for secrets at a time, so that files without
+// newlines, like minified javascript, don't have to be read all at once
+const secretScanChunkSize = 64 * 1024
+
+// SecretArtifactScanner finds well known kinds of credentials, such as AWS
+// access keys and private keys, in text artifacts. Binary artifacts are
+// skipped.
+type SecretArtifactScanner struct{}
+
+func (SecretArtifactScanner) Name() string {
+	return "secrets"
+}
+
+func (SecretArtifactScanner) Scan(path string) ([]ArtifactFinding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// Text files don't have NUL bytes near their start
+	head, _ := r.Peek(mime.SniffLength)
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	// Each chunk is scanned along with the end of the one before it, so
+	// that secrets split between them are still found. Every match is
+	// shorter than the overlap, so it's found whole in the window that it
+	// ends in, and only reported from that one.
+	overlap := 0
+	for _, pattern := range secretPatterns {
+		if pattern.maxLength >= overlap {
+			overlap = pattern.maxLength + 1
+		}
+	}
+
+	var findings []ArtifactFinding
+	reported := map[ArtifactFinding]bool{}
+
+	window := make([]byte, 0, overlap+secretScanChunkSize)
+	chunk := make([]byte, secretScanChunkSize)
+
+	// The line that the window starts on, and where in the window the
+	// matches that weren't in the last one start
+	line := 1
+	from := 0
+
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		last := err != nil
+
+		window = append(window, chunk[:n]...)
+
+		// Matches that end at the end of the window might carry on into
+		// the next chunk, so they're left for the next window
+		to := len(window)
+		if !last {
+			to--
+		}
+
+		for _, pattern := range secretPatterns {
+			for _, match := range pattern.re.FindAllIndex(window, -1) {
+				if match[1] <= from || match[1] > to {
+					continue
+				}
+
+				finding := ArtifactFinding{
+					Line:        line + bytes.Count(window[:match[0]], []byte("\n")),
+					Description: "Possible " + pattern.description,
+				}
+				if !reported[finding] {
+					reported[finding] = true
+					findings = append(findings, finding)
+				}
+			}
+		}
+
+		if last {
+			break
+		}
+
+		// Keep the end of the window for the next one
+		keep := len(window) - overlap
+		if keep < 0 {
+			keep = 0
+		}
+		line += bytes.Count(window[:keep], []byte("\n"))
+		window = append(window[:0], window[keep:]...)
+		from = to - keep
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Line < findings[j].Line
+	})
+
+	return findings, nil
+}
+
+// CommandArtifactScanner runs a command to scan each artifact, such as a
+// virus scanner, with the path of the artifact added to its arguments. Like
+// clamscan, it exits with 0 if the artifact is clean, 1 if it found
+// problems, and anything else if it couldn't scan the artifact. Each line it
+// prints when it finds problems is reported as one.
+type CommandArtifactScanner struct {
+	Command []string
+}
+
+// NewCommandArtifactScanner returns a scanner that runs command, which is
+// split into words like a shell would
+func NewCommandArtifactScanner(command string) (*CommandArtifactScanner, error) {
+	words, err := shellwords.Split(command)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to split scan command %q: %v", command, err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("The scan command is empty")
+	}
+
+	return &CommandArtifactScanner{Command: words}, nil
+}
+
+func (s *CommandArtifactScanner) Name() string {
+	return filepath.Base(s.Command[0])
+}
+
+func (s *CommandArtifactScanner) Scan(path string) ([]ArtifactFinding, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(s.Command[0], append(s.Command[1:], path)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return nil, nil
+	}
+
+	// Exit status 1 means problems were found, anything else is an error
+	found := false
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			found = status.ExitStatus() == 1
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var findings []ArtifactFinding
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			findings = append(findings, ArtifactFinding{Description: line})
+		}
+	}
+
+	if len(findings) == 0 {
+		findings = append(findings, ArtifactFinding{Description: "Flagged by " + s.Name()})
+	}
+
+	return findings, nil
+}
+
+// scan runs the scanners over the artifacts, and returns the ones to upload
+// and the paths of the ones that were blocked. Anything found is logged and
+// added to an annotation on the build. An artifact that can't be scanned
+// stops the whole upload, rather than being uploaded unchecked.
+func (a *ArtifactUploader) scan(artifacts []*api.Artifact) ([]*api.Artifact, []string, error) {
+	var upload []*api.Artifact
+	var blocked []string
+	var findings []ArtifactFinding
+
+	for _, artifact := range artifacts {
+		var found []ArtifactFinding
+
+		for _, scanner := range a.conf.Scanners {
+			a.logger.Debug("Scanning %s with %s", artifact.Path, scanner.Name())
+
+			scanned, err := scanner.Scan(artifact.AbsolutePath)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error scanning artifact \"%s\" with %s: %v", artifact.Path, scanner.Name(), err)
+			}
+
+			for _, finding := range scanned {
+				finding.Path = artifact.Path
+				finding.Scanner = scanner.Name()
+				a.logger.Warn("%s", finding)
+				found = append(found, finding)
+			}
+		}
+
+		if len(found) > 0 && a.conf.ScanAction != ArtifactScanFlag {
+			blocked = append(blocked, artifact.Path)
+		} else {
+			upload = append(upload, artifact)
+		}
+
+		findings = append(findings, found...)
+	}
+
+	if len(findings) > 0 {
+		a.annotateFindings(findings, blocked)
+	}
+
+	return upload, blocked, nil
+}
+
+// annotateFindings adds what scanning found to an annotation on the build.
+// Each upload's findings are appended to it, so that they're all shown
+// together.
+func (a *ArtifactUploader) annotateFindings(findings []ArtifactFinding, blocked []string) {
+	var b strings.Builder
+
+	style := "warning"
+	if len(blocked) > 0 {
+		style = "error"
+		fmt.Fprintf(&b, "**Artifact scanning blocked %d artifacts from being uploaded**\n\n", len(blocked))
+	} else {
+		fmt.Fprintf(&b, "**Artifact scanning found problems in artifacts that were uploaded anyway**\n\n")
+	}
+
+	escape := strings.NewReplacer("|", `\|`, "\n", " ")
+
+	fmt.Fprintf(&b, "| Artifact | Line | Problem | Scanner |\n")
+	fmt.Fprintf(&b, "| --- | --- | --- | --- |\n")
+	for _, f := range findings {
+		line := ""
+		if f.Line > 0 {
+			line = fmt.Sprintf("%d", f.Line)
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", escape.Replace(f.Path), line, escape.Replace(f.Description), escape.Replace(f.Scanner))
+	}
+	b.WriteString("\n")
+
+	annotation := &api.Annotation{
+		Body:    b.String(),
+		Context: "artifact-scan-" + a.conf.JobID,
+		Style:   style,
+		Append:  true,
+	}
+
+	err := retry.Do(func(s *retry.Stats) error {
+		resp, err := a.apiClient.Annotations.Create(a.conf.JobID, annotation)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+		}
+		return err
+	}, &retry.Config{Maximum: 3, Interval: 1 * time.Second, Jitter: true})
+	if err != nil {
+		a.logger.Warn("Failed to annotate the build with what artifact scanning found: %v", err)
+	}
+}
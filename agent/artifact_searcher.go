@@ -25,16 +25,45 @@ func NewArtifactSearcher(l logger.Logger, ac *api.Client, buildID string) *Artif
 }
 
 func (a *ArtifactSearcher) Search(query string, scope string) ([]*api.Artifact, error) {
-	if scope == "" {
-		a.logger.Info("Searching for artifacts: \"%s\"", query)
-	} else {
-		a.logger.Info("Searching for artifacts: \"%s\" within step: \"%s\"", query, scope)
-	}
-
-	artifacts, _, err := a.apiClient.Artifacts.Search(a.buildID, &api.ArtifactSearchOptions{
+	return a.SearchWithOptions(&api.ArtifactSearchOptions{
 		Query: query,
 		Scope: scope,
 	})
+}
+
+// SearchWithOptions searches with extra options, such as which jobs to
+// include
+func (a *ArtifactSearcher) SearchWithOptions(opt *api.ArtifactSearchOptions) ([]*api.Artifact, error) {
+	if opt.Scope == "" {
+		a.logger.Info("Searching for artifacts: \"%s\"", opt.Query)
+	} else {
+		a.logger.Info("Searching for artifacts: \"%s\" within step: \"%s\"", opt.Query, opt.Scope)
+	}
 
-	return artifacts, err
+	artifacts, _, err := a.apiClient.Artifacts.Search(a.buildID, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the job states too, in case the API doesn't filter by them
+	if len(opt.JobStates) > 0 {
+		var matching []*api.Artifact
+		for _, artifact := range artifacts {
+			if artifact.JobState == "" || containsString(opt.JobStates, artifact.JobState) {
+				matching = append(matching, artifact)
+			}
+		}
+		artifacts = matching
+	}
+
+	return artifacts, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
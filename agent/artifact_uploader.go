@@ -1,10 +1,13 @@
 package agent
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha1"
-	"errors"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -37,12 +40,48 @@ type ArtifactUploaderConfig struct {
 
 	// A specific Content-Type to use for all artifacts
 	ContentType string
+
+	// Key/value pairs stored with every artifact
+	Metadata map[string]string
+
+	// Extra configuration for finding AWS credentials for S3
+	AWSCredentials AWSCredentialsConfig
+
+	// How artifacts are stored in S3
+	S3Options S3UploadOptions
+
+	// Where to report the progress of uploads, if anywhere
+	Transfers *TransferReporter
+
+	// How to compress artifacts before they're uploaded, if at all, which
+	// is one of ArtifactCompressions
+	Compress string
+
+	// The most bytes per second that uploads can read between them, or 0
+	// for no limit
+	Bandwidth int64
+
+	// The artifact proxy of the agent running the job. Uploads to
+	// destinations are handed to it, so that they're made with the agent's
+	// credentials instead of the job's.
+	ProxyURL    string
+	ProxySocket string
+
+	// Scanners to check artifacts with before they're uploaded, and what to
+	// do with those they find problems with, which is ArtifactScanBlock or
+	// ArtifactScanFlag
+	Scanners   []ArtifactScanner
+	ScanAction string
 }
 
 type ArtifactUploader struct {
 	// The upload config
 	conf ArtifactUploaderConfig
 
+	// Limits how fast all of the uploads read their files, if they're
+	// limited
+	bandwidth *BandwidthLimiter
+
 	// The logger instance to use
 	logger logger.Logger
 
@@ -52,9 +91,10 @@ type ArtifactUploader struct {
 
 func NewArtifactUploader(l logger.Logger, ac *api.Client, c ArtifactUploaderConfig) *ArtifactUploader {
 	return &ArtifactUploader{
-		logger:    l,
+		logger:    l.Named("artifact"),
 		apiClient: ac,
 		conf:      c,
+		bandwidth: NewBandwidthLimiter(c.Bandwidth),
 	}
 }
 
@@ -67,15 +107,35 @@ func (a *ArtifactUploader) Upload() error {
 
 	if len(artifacts) == 0 {
 		a.logger.Info("No files matched paths: %s", a.conf.Paths)
-	} else {
-		a.logger.Info("Found %d files that match \"%s\"", len(artifacts), a.conf.Paths)
+		return nil
+	}
+
+	a.logger.Info("Found %d files that match \"%s\"", len(artifacts), a.conf.Paths)
+
+	// Check the artifacts before any of them are uploaded
+	var blocked []string
+	if len(a.conf.Scanners) > 0 {
+		artifacts, blocked, err = a.scan(artifacts)
+		if err != nil {
+			return err
+		}
+	}
 
-		err := a.upload(artifacts)
+	if len(artifacts) > 0 {
+		if a.useProxy() {
+			err = a.uploadThroughProxy(artifacts)
+		} else {
+			err = a.upload(artifacts)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
+	if len(blocked) > 0 {
+		return fmt.Errorf("Artifact scanning blocked %d artifacts from being uploaded: %s", len(blocked), strings.Join(blocked, ", "))
+	}
+
 	return nil
 }
 
@@ -169,21 +229,19 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 		return nil, err
 	}
 
-	// Generate a sha1 checksum for the file
-	hash := sha1.New()
-	io.Copy(hash, file)
-	checksum := fmt.Sprintf("%x", hash.Sum(nil))
-
-	// Determine the Content-Type to send
-	contentType := a.conf.ContentType
-
-	if contentType == "" {
-		extension := filepath.Ext(absolutePath)
-		contentType = mime.TypeByExtension(extension)
+	// Keep the start of the file, in case its type can only be told from
+	// its contents
+	head := make([]byte, mime.SniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
 
-		if contentType == "" {
-			contentType = ArtifactFallbackMimeType
-		}
+	// Generate sha1 and sha256 checksums for the file
+	sha1Hash, sha256Hash := sha1.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(sha1Hash, sha256Hash), io.MultiReader(bytes.NewReader(head), file)); err != nil {
+		return nil, err
 	}
 
 	// Create our new artifact data structure
@@ -192,37 +250,236 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 		AbsolutePath: absolutePath,
 		GlobPath:     globPath,
 		FileSize:     fileInfo.Size(),
-		Sha1Sum:      checksum,
-		ContentType:  contentType,
+		Sha1Sum:      fmt.Sprintf("%x", sha1Hash.Sum(nil)),
+		Sha256Sum:    fmt.Sprintf("%x", sha256Hash.Sum(nil)),
+		ContentType:  a.contentType(absolutePath, head),
+		Metadata:     a.metadata(),
 	}
 
 	return artifact, nil
 }
 
-func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
+// contentType determines the Content-Type to send for a path, from its
+// extension or otherwise the start of its contents, so that things like HTML
+// reports and images are shown in browsers rather than downloaded
+func (a *ArtifactUploader) contentType(path string, head []byte) string {
+	if a.conf.ContentType != "" {
+		return a.conf.ContentType
+	}
+
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+
+	if contentType := mime.TypeByContent(head); contentType != "" {
+		a.logger.Debug("Detected the content type of %s as %s", path, contentType)
+		return contentType
+	}
+
+	return ArtifactFallbackMimeType
+}
+
+// metadata returns the metadata to store with each artifact, which records
+// how it was compressed, if it was
+func (a *ArtifactUploader) metadata() map[string]string {
+	if a.conf.Compress == "" {
+		return a.conf.Metadata
+	}
+
+	metadata := map[string]string{ArtifactContentEncodingKey: a.conf.Compress}
+	for k, v := range a.conf.Metadata {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// UploadStream uploads everything read from r as a single artifact at path,
+// without writing it to disk first. The artifact's size and checksum aren't
+// known until the stream has been read, so it's only created on Buildkite
+// once it has been uploaded, and it can't be retried if the upload fails.
+func (a *ArtifactUploader) UploadStream(r io.Reader, path string) error {
+	// Peek at the start of the stream, in case its type can only be told
+	// from its contents. Any error reading it is hit again by the upload.
+	br := bufio.NewReaderSize(r, mime.SniffLength)
+	head, _ := br.Peek(mime.SniffLength)
+	contentType := a.contentType(path, head)
+	r = br
+
+	if a.useProxy() {
+		return a.streamThroughProxy(r, path, contentType)
+	}
+
+	uploader, err := a.newUploader()
+	if err != nil {
+		return err
+	}
+
+	streamUploader, ok := uploader.(StreamUploader)
+	if !ok {
+		return fmt.Errorf("Uploading a stream requires an upload destination, such as s3://")
+	}
+
+	artifact := &api.Artifact{
+		Path:         path,
+		AbsolutePath: path,
+		GlobPath:     path,
+		ContentType:  contentType,
+		Metadata:     a.metadata(),
+	}
+	artifact.URL = uploader.URL(artifact)
+
+	sha1Hash, sha256Hash := sha1.New(), sha256.New()
+	counter := &byteCounter{}
+
+	a.logger.Info("Uploading artifact %s from a stream", artifact.Path)
+
+	progress := a.conf.Transfers.Track("upload", artifact.Path, -1)
+	err = a.uploadCompressed(streamUploader, artifact, a.bandwidth.Reader(progress.Reader(io.TeeReader(r, io.MultiWriter(sha1Hash, sha256Hash, counter)))))
+	a.conf.Transfers.Finish(progress)
+
+	if err != nil {
+		return fmt.Errorf("Error uploading artifact \"%s\": %v", artifact.Path, err)
+	}
+
+	artifact.FileSize = counter.n
+	artifact.Sha1Sum = fmt.Sprintf("%x", sha1Hash.Sum(nil))
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+
+	a.logger.Info("Uploaded artifact %s (%d bytes)", artifact.Path, artifact.FileSize)
+
+	// Now that the upload is complete, the artifact can be created on Buildkite
+	batchCreator := NewArtifactBatchCreator(a.logger, a.apiClient, ArtifactBatchCreatorConfig{
+		JobID:             a.conf.JobID,
+		Artifacts:         []*api.Artifact{artifact},
+		UploadDestination: a.conf.Destination,
+	})
+
+	if _, err := batchCreator.Create(); err != nil {
+		return err
+	}
+
+	return retry.Do(func(s *retry.Stats) error {
+		_, err := a.apiClient.Artifacts.Update(a.conf.JobID, map[string]string{artifact.ID: "finished"})
+		if err != nil {
+			a.logger.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+}
+
+// byteCounter is an io.Writer that counts the bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// uploadArtifact uploads a single artifact, recording how it's going in
+// progress if there is one. Stream uploaders are given the file to read, so
+// that the bytes they read from it can be counted and limited.
+func (a *ArtifactUploader) uploadArtifact(uploader Uploader, artifact *api.Artifact, progress *TransferProgress) error {
+	if a.conf.Compress != "" {
+		return a.uploadCompressedFile(uploader, artifact, progress)
+	}
+
+	if progress == nil && a.bandwidth == nil {
+		return uploader.Upload(artifact)
+	}
+
+	if u, ok := uploader.(progressUploader); ok {
+		return u.uploadWithProgress(artifact, progress, a.bandwidth)
+	}
+
+	streamUploader, ok := uploader.(StreamUploader)
+	if !ok {
+		return uploader.Upload(artifact)
+	}
+
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	return streamUploader.UploadStream(artifact, &transferFile{f, progress, a.bandwidth})
+}
+
+// uploadCompressed uploads what's read from r, compressed if it should be
+func (a *ArtifactUploader) uploadCompressed(uploader StreamUploader, artifact *api.Artifact, r io.Reader) error {
+	if a.conf.Compress == "" {
+		return uploader.UploadStream(artifact, r)
+	}
+
+	compressed, err := compressReader(a.conf.Compress, r)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+
+	return uploader.UploadStream(artifact, compressed)
+}
+
+// uploadCompressedFile compresses an artifact as it's uploaded. Uploaders
+// that need to know the size up front, like Buildkite's own storage, are
+// given a compressed copy of the file instead.
+func (a *ArtifactUploader) uploadCompressedFile(uploader Uploader, artifact *api.Artifact, progress *TransferProgress) error {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = &transferFile{f, progress, a.bandwidth}
+
+	if streamUploader, ok := uploader.(StreamUploader); ok {
+		return a.uploadCompressed(streamUploader, artifact, r)
+	}
+
+	compressed, err := compressReader(a.conf.Compress, r)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+
+	tmp, err := ioutil.TempFile("", "buildkite-artifact-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, compressed); err != nil {
+		return fmt.Errorf("failed to compress file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	copied := *artifact
+	copied.AbsolutePath = tmp.Name()
+
+	return uploader.Upload(&copied)
+}
+
+// newUploader returns the Uploader for the configured destination
+func (a *ArtifactUploader) newUploader() (Uploader, error) {
 	var uploader Uploader
 	var err error
 
 	// Determine what uploader to use
 	if a.conf.Destination != "" {
-		if strings.HasPrefix(a.conf.Destination, "s3://") {
-			uploader, err = NewS3Uploader(a.logger, S3UploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.apiClient.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "gs://") {
-			uploader, err = NewGSUploader(a.logger, GSUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.apiClient.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "rt://") {
-			uploader, err = NewArtifactoryUploader(a.logger, ArtifactoryUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.apiClient.DebugHTTP,
-			})
-		} else {
-			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination))
+		backend, berr := artifactBackendFor(a.conf.Destination)
+		if berr != nil {
+			return nil, fmt.Errorf("Invalid upload destination: '%v'. %v. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination, berr)
 		}
+
+		uploader, err = backend.NewUploader(a.logger, ArtifactBackendUploadConfig{
+			Destination:    a.conf.Destination,
+			DebugHTTP:      a.apiClient.DebugHTTP,
+			AWSCredentials: a.conf.AWSCredentials,
+			S3Options:      a.conf.S3Options,
+		})
 	} else {
 		uploader = NewFormUploader(a.logger, FormUploaderConfig{
 			DebugHTTP: a.apiClient.DebugHTTP,
@@ -231,7 +488,16 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 
 	// Check if creation caused an error
 	if err != nil {
-		return fmt.Errorf("Error creating uploader: %v", err)
+		return nil, fmt.Errorf("Error creating uploader: %v", err)
+	}
+
+	return uploader, nil
+}
+
+func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
+	uploader, err := a.newUploader()
+	if err != nil {
+		return err
 	}
 
 	// Set the URL's of the artifacts based on the uploader
@@ -331,11 +597,17 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 			// Show a nice message that we're starting to upload the file
 			a.logger.Info("Uploading artifact %s %s (%d bytes)", artifact.ID, artifact.Path, artifact.FileSize)
 
+			progress := a.conf.Transfers.Track("upload", artifact.Path, artifact.FileSize)
+
 			// Upload the artifact and then set the state depending
 			// on whether or not it passed. We'll retry the upload
 			// a couple of times before giving up.
 			err = retry.Do(func(s *retry.Stats) error {
-				err := uploader.Upload(artifact)
+				if s.Attempt > 1 {
+					progress.Retry()
+				}
+
+				err := a.uploadArtifact(uploader, artifact, progress)
 				if err != nil {
 					a.logger.Warn("%s (%s)", err, s)
 				}
@@ -343,6 +615,8 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				return err
 			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
 
+			a.conf.Transfers.Finish(progress)
+
 			var state string
 
 			// Did the upload eventually fail?
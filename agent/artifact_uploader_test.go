@@ -1,7 +1,13 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -151,3 +157,196 @@ func TestCollectWithSomeGlobsThatDontMatchAnything(t *testing.T) {
 		t.Fatalf("Expected to match 3 artifacts, found %d", len(artifacts))
 	}
 }
+
+func TestUploadStream(t *testing.T) {
+	var uploaded string
+	var created *api.ArtifactBatch
+	var updated api.ArtifactBatchUpdateRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "PUT /my-repo/dump.sql":
+			body, _ := ioutil.ReadAll(req.Body)
+			uploaded = string(body)
+		case "POST /jobs/my-job/artifacts":
+			json.NewDecoder(req.Body).Decode(&created)
+			fmt.Fprint(rw, `{"id":"batch","artifact_ids":["artifact"]}`)
+		case "PUT /jobs/my-job/artifacts":
+			json.NewDecoder(req.Body).Decode(&updated)
+			fmt.Fprint(rw, `{}`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for k, v := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL,
+		"BUILDKITE_ARTIFACTORY_USER":     "user",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "password",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	uploader := NewArtifactUploader(logger.Discard, ac, ArtifactUploaderConfig{
+		JobID:       "my-job",
+		Destination: "rt://my-repo",
+	})
+
+	err := uploader.UploadStream(strings.NewReader("llamas"), "dump.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "llamas", uploaded)
+
+	if assert.Len(t, created.Artifacts, 1) {
+		assert.Equal(t, "dump.sql", created.Artifacts[0].Path)
+		assert.Equal(t, int64(6), created.Artifacts[0].FileSize)
+		assert.Equal(t, "f2e2d844b3e04d61109c4dead6e121bfbd98b0a3", created.Artifacts[0].Sha1Sum)
+		assert.Equal(t, "66f0d436b0469c570b3b8d7e11a681881d9a7bcd8b12d5c2db426015d3ddfd1c", created.Artifacts[0].Sha256Sum)
+	}
+
+	if assert.Len(t, updated.Artifacts, 1) {
+		assert.Equal(t, "artifact", updated.Artifacts[0].ID)
+		assert.Equal(t, "finished", updated.Artifacts[0].State)
+	}
+}
+
+func TestUploadStreamRequiresAStreamingDestination(t *testing.T) {
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: "http://localhost",
+		Token:    `llamasforever`,
+	})
+
+	// Buildkite's own artifact storage needs to know the size of the
+	// artifact before it's uploaded
+	uploader := NewArtifactUploader(logger.Discard, ac, ArtifactUploaderConfig{JobID: "my-job"})
+
+	err := uploader.UploadStream(strings.NewReader("llamas"), "dump.sql")
+	assert.Error(t, err)
+}
+
+func TestUploadStreamCompressesArtifacts(t *testing.T) {
+	var uploaded []byte
+	var created *api.ArtifactBatch
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "PUT /my-repo/dump.sql;content-encoding=gzip":
+			uploaded, _ = ioutil.ReadAll(req.Body)
+		case "POST /jobs/my-job/artifacts":
+			json.NewDecoder(req.Body).Decode(&created)
+			fmt.Fprint(rw, `{"id":"batch","artifact_ids":["artifact"]}`)
+		case "PUT /jobs/my-job/artifacts":
+			fmt.Fprint(rw, `{}`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for k, v := range map[string]string{
+		"BUILDKITE_ARTIFACTORY_URL":      server.URL,
+		"BUILDKITE_ARTIFACTORY_USER":     "user",
+		"BUILDKITE_ARTIFACTORY_PASSWORD": "password",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	uploader := NewArtifactUploader(logger.Discard, ac, ArtifactUploaderConfig{
+		JobID:       "my-job",
+		Destination: "rt://my-repo",
+		Compress:    "gzip",
+	})
+
+	err := uploader.UploadStream(strings.NewReader("llamas"), "dump.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(uploaded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(decompressed))
+
+	// The artifact describes what it decompresses to
+	if assert.Len(t, created.Artifacts, 1) {
+		assert.Equal(t, int64(6), created.Artifacts[0].FileSize)
+		assert.Equal(t, "66f0d436b0469c570b3b8d7e11a681881d9a7bcd8b12d5c2db426015d3ddfd1c", created.Artifacts[0].Sha256Sum)
+		assert.Equal(t, map[string]string{"content-encoding": "gzip"}, created.Artifacts[0].Metadata)
+	}
+}
+
+func TestCollectDetectsContentTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "content-types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"report.html": "llamas",
+		"report":      "<!DOCTYPE html><html><body>Llamas</body></html>",
+		"screenshot":  "\x89PNG\x0D\x0A\x1A\x0A",
+		"blob":        "\x00\x01\x02\x03",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ac := NewAPIClient(logger.Discard, APIClientConfig{
+		Endpoint: "http://localhost",
+		Token:    `llamasforever`,
+	})
+
+	uploader := NewArtifactUploader(logger.Discard, ac, ArtifactUploaderConfig{
+		Paths: filepath.Join(dir, "*"),
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contentType := range map[string]string{
+		"report.html": "text/html",
+		"report":      "text/html; charset=utf-8",
+		"screenshot":  "image/png",
+		"blob":        ArtifactFallbackMimeType,
+	} {
+		if a := findArtifact(artifacts, name); assert.NotNil(t, a, name) {
+			assert.Equal(t, contentType, a.ContentType, name)
+		}
+	}
+
+	// A content type that's given is used for everything
+	uploader = NewArtifactUploader(logger.Discard, ac, ArtifactUploaderConfig{
+		Paths:       filepath.Join(dir, "*"),
+		ContentType: "text/plain",
+	})
+
+	artifacts, err = uploader.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range artifacts {
+		assert.Equal(t, "text/plain", a.ContentType, a.Path)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
 	"strings"
 
@@ -22,9 +22,36 @@ type ArtifactoryDownloaderConfig struct {
 	// also it's location in the repo
 	Path string
 
+	// An optional path to save the file as instead of Path, relative to the
+	// download folder
+	LocalPath string
+
+	// Where to write the file while it's downloading, defaults to the folder
+	// it's being downloaded to
+	TempDir string
+
+	// Whether to fsync the file before moving it into place
+	Fsync bool
+
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// Where to record how the download is going, if anywhere
+	Progress *TransferProgress
+
+	// Limits how fast the download is read, if it's limited
+	Bandwidth *BandwidthLimiter
+
+	// The checksums the downloaded file must have, if they're known
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Where to write the file instead of saving it, if anywhere
+	Writer io.Writer
+
+	// How the file was compressed when it was uploaded, if it was
+	ContentEncoding string
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -66,13 +93,22 @@ func (d ArtifactoryDownloader) Start() error {
 	}
 
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
-		URL:         fullURL,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		Headers:     headers,
-		DebugHTTP:   d.conf.DebugHTTP,
+	return NewDownload(d.logger, newArtifactHTTPClient(), DownloadConfig{
+		URL:             fullURL,
+		Path:            d.conf.Path,
+		LocalPath:       d.conf.LocalPath,
+		TempDir:         d.conf.TempDir,
+		Fsync:           d.conf.Fsync,
+		Destination:     d.conf.Destination,
+		Retries:         d.conf.Retries,
+		Headers:         headers,
+		DebugHTTP:       d.conf.DebugHTTP,
+		Progress:        d.conf.Progress,
+		Bandwidth:       d.conf.Bandwidth,
+		Sha1Sum:         d.conf.Sha1Sum,
+		Sha256Sum:       d.conf.Sha256Sum,
+		Writer:          d.conf.Writer,
+		ContentEncoding: d.conf.ContentEncoding,
 	}).Start()
 }
 
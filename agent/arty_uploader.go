@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -14,6 +15,39 @@ import (
 	"github.com/buildkite/agent/logger"
 )
 
+func init() {
+	RegisterArtifactBackend("rt", artifactoryBackend{})
+}
+
+// artifactoryBackend stores artifacts in Artifactory
+type artifactoryBackend struct{}
+
+func (artifactoryBackend) NewUploader(l logger.Logger, c ArtifactBackendUploadConfig) (Uploader, error) {
+	return NewArtifactoryUploader(l, ArtifactoryUploaderConfig{
+		Destination: c.Destination,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
+
+func (artifactoryBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloadConfig) (Downloader, error) {
+	return NewArtifactoryDownloader(l, ArtifactoryDownloaderConfig{
+		Path:            c.Path,
+		LocalPath:       c.LocalPath,
+		TempDir:         c.TempDir,
+		Fsync:           c.Fsync,
+		Repository:      c.UploadDestination,
+		Destination:     c.Destination,
+		Retries:         c.Retries,
+		DebugHTTP:       c.DebugHTTP,
+		Progress:        c.Progress,
+		Bandwidth:       c.Bandwidth,
+		Sha1Sum:         c.Sha1Sum,
+		Sha256Sum:       c.Sha256Sum,
+		Writer:          c.Writer,
+		ContentEncoding: c.ContentEncoding,
+	}), nil
+}
+
 type ArtifactoryUploaderConfig struct {
 	// The destination which includes the Artifactory bucket name and the path.
 	// e.g artifactory://my-repo-name/foo/bar
@@ -66,7 +100,7 @@ func NewArtifactoryUploader(l logger.Logger, c ArtifactoryUploaderConfig) (*Arti
 	return &ArtifactoryUploader{
 		logger:     l,
 		conf:       c,
-		client:     &http.Client{},
+		client:     newArtifactHTTPClient(),
 		iURL:       parsedURL,
 		Path:       path,
 		Repository: repo,
@@ -99,11 +133,19 @@ func (u *ArtifactoryUploader) Upload(artifact *api.Artifact) error {
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
+
+	return u.UploadStream(artifact, f)
+}
 
+// UploadStream uploads the artifact's contents from r, which is sent with
+// chunked encoding if its length isn't known
+func (u *ArtifactoryUploader) UploadStream(artifact *api.Artifact, r io.Reader) error {
 	// Upload the file to Artifactory.
 	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.Repository)
 
-	req, err := http.NewRequest("PUT", u.URL(artifact), f)
+	// Any metadata is stored as properties on the artifact
+	req, err := http.NewRequest("PUT", u.URL(artifact)+artifactoryMatrixParams(artifact.Metadata), r)
 	req.SetBasicAuth(u.user, u.password)
 	if err != nil {
 		return err
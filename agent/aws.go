@@ -46,7 +46,8 @@ func awsSession() (*session.Session, error) {
 
 	if awsSess == nil {
 		awsSess, err = session.NewSession(&aws.Config{
-			Region: aws.String(region),
+			Region:     aws.String(region),
+			HTTPClient: newArtifactHTTPClient(),
 		})
 		if err != nil {
 			return nil, err
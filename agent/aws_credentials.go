@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// AWSCredentialsConfig configures the credentials used for S3, on top of
+// those found in the environment, shared config and instance meta-data
+type AWSCredentialsConfig struct {
+	// A role to assume with the credentials that are found, such as one that
+	// can access a bucket in another account
+	AssumeRoleARN string
+
+	// The external ID required to assume the role, if any
+	AssumeRoleExternalID string
+}
+
+// namedProvider is a credentials provider with a name to show in errors
+type namedProvider struct {
+	name string
+	credentials.Provider
+}
+
+// credentialChainError lists why each provider in a chain failed
+type credentialChainError struct {
+	errs []string
+}
+
+func (e *credentialChainError) Error() string {
+	return fmt.Sprintf("Could not find AWS credentials for S3, tried:\n  %s", strings.Join(e.errs, "\n  "))
+}
+
+// credentialChain uses the first provider that has credentials, like
+// credentials.ChainProvider, except that it names the providers that failed
+// and why
+type credentialChain struct {
+	providers []namedProvider
+	current   *namedProvider
+}
+
+func (c *credentialChain) Retrieve() (credentials.Value, error) {
+	var errs []string
+
+	for i := range c.providers {
+		p := &c.providers[i]
+
+		creds, err := p.Retrieve()
+		if err == nil {
+			c.current = p
+			return creds, nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %v", p.name, err))
+	}
+
+	c.current = nil
+	return credentials.Value{}, &credentialChainError{errs: errs}
+}
+
+func (c *credentialChain) IsExpired() bool {
+	if c.current == nil {
+		return true
+	}
+	return c.current.IsExpired()
+}
+
+// webIdentityProvider exchanges a web identity token (such as one from an
+// OIDC provider or a Kubernetes service account) for credentials, using the
+// same env as the AWS CLI and SDKs
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client *sts.STS
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+
+	if tokenFile == "" || roleARN == "" {
+		return credentials.Value{}, errors.New("AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN not found in environment")
+	}
+
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("buildkite-agent-%d", time.Now().UnixNano())
+	}
+
+	req, resp := p.client.AssumeRoleWithWebIdentityRequest(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(roleARN),
+		RoleSessionName:  aws.String(sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+
+	// The token is the authentication, so the request isn't signed
+	req.Config.Credentials = credentials.AnonymousCredentials
+
+	if err := req.Send(); err != nil {
+		return credentials.Value{}, fmt.Errorf("Failed to assume role %s: %v", roleARN, err)
+	}
+
+	p.SetExpiration(*resp.Credentials.Expiration, time.Minute)
+
+	return credentials.Value{
+		AccessKeyID:     *resp.Credentials.AccessKeyId,
+		SecretAccessKey: *resp.Credentials.SecretAccessKey,
+		SessionToken:    *resp.Credentials.SessionToken,
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
+
+// errorPrefixProvider adds context to the errors of a provider
+type errorPrefixProvider struct {
+	prefix string
+	credentials.Provider
+}
+
+func (p *errorPrefixProvider) Retrieve() (credentials.Value, error) {
+	creds, err := p.Provider.Retrieve()
+	if err != nil {
+		return creds, fmt.Errorf("%s: %v", p.prefix, err)
+	}
+	return creds, nil
+}
+
+// awsCredentials returns credentials from the first of these that has them:
+//
+//   - BUILDKITE_S3_ACCESS_KEY_ID and BUILDKITE_S3_SECRET_ACCESS_KEY
+//   - AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+//   - the shared credentials file, using the profile in BUILDKITE_S3_PROFILE
+//     or AWS_PROFILE
+//   - a web identity token in AWS_WEB_IDENTITY_TOKEN_FILE for AWS_ROLE_ARN
+//   - EC2 instance or ECS task meta-data
+//
+// If a role to assume is configured, those credentials are used to assume it.
+func awsCredentials(sess *session.Session, conf AWSCredentialsConfig) *credentials.Credentials {
+	chain := &credentialChain{
+		providers: []namedProvider{
+			{"BUILDKITE_S3_* env", &credentialsProvider{}},
+			{"AWS_* env", &credentials.EnvProvider{}},
+			{"shared config profile", &credentials.SharedCredentialsProvider{Profile: os.Getenv("BUILDKITE_S3_PROFILE")}},
+			{"web identity", &webIdentityProvider{client: sts.New(sess)}},
+			{"instance meta-data", defaults.RemoteCredProvider(*sess.Config, sess.Handlers)},
+		},
+	}
+
+	creds := credentials.NewCredentials(chain)
+	if conf.AssumeRoleARN == "" {
+		return creds
+	}
+
+	assumeRole := &stscreds.AssumeRoleProvider{
+		Client:          sts.New(sess, &aws.Config{Credentials: creds}),
+		RoleARN:         conf.AssumeRoleARN,
+		RoleSessionName: fmt.Sprintf("buildkite-agent-%d", time.Now().UnixNano()),
+		Duration:        stscreds.DefaultDuration,
+		ExpiryWindow:    time.Minute,
+	}
+	if conf.AssumeRoleExternalID != "" {
+		assumeRole.ExternalID = aws.String(conf.AssumeRoleExternalID)
+	}
+
+	return credentials.NewCredentials(&errorPrefixProvider{
+		prefix:   fmt.Sprintf("Failed to assume role %s", conf.AssumeRoleARN),
+		Provider: assumeRole,
+	})
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingProvider struct {
+	err error
+}
+
+func (p failingProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{}, p.err
+}
+
+func (p failingProvider) IsExpired() bool {
+	return true
+}
+
+func TestCredentialChainUsesFirstProviderWithCredentials(t *testing.T) {
+	chain := &credentialChain{
+		providers: []namedProvider{
+			{"first", failingProvider{errors.New("nope")}},
+			{"second", &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: "llamas", SecretAccessKey: "alpacas"}}},
+		},
+	}
+
+	creds, err := chain.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", creds.AccessKeyID)
+	assert.False(t, chain.IsExpired())
+}
+
+func TestCredentialChainErrorNamesEachProvider(t *testing.T) {
+	chain := &credentialChain{
+		providers: []namedProvider{
+			{"first", failingProvider{errors.New("nope")}},
+			{"second", failingProvider{errors.New("also nope")}},
+		},
+	}
+
+	_, err := chain.Retrieve()
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "first: nope"), err.Error())
+		assert.True(t, strings.Contains(err.Error(), "second: also nope"), err.Error())
+	}
+	assert.True(t, chain.IsExpired())
+}
+
+func TestWebIdentityProviderRequiresEnv(t *testing.T) {
+	defer os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+
+	_, err := (&webIdentityProvider{}).Retrieve()
+	assert.Error(t, err)
+}
+
+func TestAssumeRoleErrorsNameTheRole(t *testing.T) {
+	for _, name := range []string{
+		"BUILDKITE_S3_ACCESS_KEY_ID", "BUILDKITE_S3_ACCESS_KEY", "AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY",
+		"AWS_SHARED_CREDENTIALS_FILE", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_EC2_METADATA_DISABLED",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	// Keep the test from finding real credentials or talking to the network
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/does/not/exist")
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	sess, err := awsS3Session("us-east-1", AWSCredentialsConfig{AssumeRoleARN: "arn:aws:iam::123456789012:role/artifacts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sess.Config.Credentials.Get()
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "Failed to assume role arn:aws:iam::123456789012:role/artifacts"), err.Error())
+		assert.True(t, strings.Contains(err.Error(), "BUILDKITE_S3_* env"), err.Error())
+	}
+}
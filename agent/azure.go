@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+func init() {
+	RegisterArtifactBackend("az", azureBackend{})
+}
+
+// azureBackend stores artifacts in Azure Blob Storage
+type azureBackend struct{}
+
+func (azureBackend) NewUploader(l logger.Logger, c ArtifactBackendUploadConfig) (Uploader, error) {
+	return NewAzureBlobUploader(l, AzureBlobUploaderConfig{
+		Destination: c.Destination,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
+
+func (azureBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloadConfig) (Downloader, error) {
+	return NewAzureBlobDownloader(l, AzureBlobDownloaderConfig{
+		Path:            c.Path,
+		LocalPath:       c.LocalPath,
+		TempDir:         c.TempDir,
+		Fsync:           c.Fsync,
+		Container:       c.UploadDestination,
+		Destination:     c.Destination,
+		Retries:         c.Retries,
+		DebugHTTP:       c.DebugHTTP,
+		Progress:        c.Progress,
+		Bandwidth:       c.Bandwidth,
+		Sha1Sum:         c.Sha1Sum,
+		Sha256Sum:       c.Sha256Sum,
+		Writer:          c.Writer,
+		ContentEncoding: c.ContentEncoding,
+	}), nil
+}
+
+// The version of the Blob Storage REST API that requests are made with. Bearer
+// tokens need at least 2017-11-09.
+const azureStorageAPIVersion = "2019-12-12"
+
+// Where managed identities get their tokens from, which is only changed in
+// tests
+var azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// azureStorageAccount is an Azure storage account, and how requests to it are
+// authorized: with an account key, a shared access signature, or otherwise a
+// token for the VM's managed identity
+type azureStorageAccount struct {
+	name         string
+	blobEndpoint *url.URL
+	key          []byte
+	sas          url.Values
+	tokens       *azureTokenSource
+}
+
+// ParseAzureDestination splits an az://container/prefix destination
+func ParseAzureDestination(destination string) (container string, path string) {
+	parts := strings.Split(strings.TrimPrefix(destination, "az://"), "/")
+	path = strings.Join(parts[1:], "/")
+	container = parts[0]
+	return
+}
+
+// loadAzureStorageAccount finds the storage account from a connection string
+// in BUILDKITE_AZURE_STORAGE_CONNECTION_STRING or
+// AZURE_STORAGE_CONNECTION_STRING, or otherwise uses the account named in
+// BUILDKITE_AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_ACCOUNT with the VM's
+// managed identity. BUILDKITE_AZURE_CLIENT_ID or AZURE_CLIENT_ID chooses a
+// user-assigned identity.
+func loadAzureStorageAccount() (*azureStorageAccount, error) {
+	if connectionString := firstEnv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING", "AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+		return parseAzureConnectionString(connectionString)
+	}
+
+	name := firstEnv("BUILDKITE_AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_ACCOUNT")
+	if name == "" {
+		return nil, errors.New("Must set BUILDKITE_AZURE_STORAGE_CONNECTION_STRING, or BUILDKITE_AZURE_STORAGE_ACCOUNT to use a managed identity, when using az:// path")
+	}
+
+	endpoint, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &azureStorageAccount{
+		name:         name,
+		blobEndpoint: endpoint,
+		tokens: &azureTokenSource{
+			clientID: firstEnv("BUILDKITE_AZURE_CLIENT_ID", "AZURE_CLIENT_ID"),
+		},
+	}, nil
+}
+
+// parseAzureConnectionString parses a storage account connection string, such
+// as the one shown in the Azure portal:
+//
+//	DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net
+func parseAzureConnectionString(connectionString string) (*azureStorageAccount, error) {
+	settings := map[string]string{}
+	for _, part := range strings.Split(connectionString, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid Azure connection string setting %q", part)
+		}
+		settings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	account := &azureStorageAccount{name: settings["AccountName"]}
+
+	endpoint := settings["BlobEndpoint"]
+	if endpoint == "" {
+		if account.name == "" {
+			return nil, errors.New("The Azure connection string needs an AccountName or BlobEndpoint")
+		}
+
+		protocol := settings["DefaultEndpointsProtocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		suffix := settings["EndpointSuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, account.name, suffix)
+	}
+
+	var err error
+	if account.blobEndpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil {
+		return nil, fmt.Errorf("Invalid Azure blob endpoint %q: %v", endpoint, err)
+	}
+
+	switch {
+	case settings["SharedAccessSignature"] != "":
+		if account.sas, err = url.ParseQuery(strings.TrimPrefix(settings["SharedAccessSignature"], "?")); err != nil {
+			return nil, fmt.Errorf("Invalid Azure shared access signature: %v", err)
+		}
+	case settings["AccountKey"] != "":
+		if account.name == "" {
+			return nil, errors.New("The Azure connection string needs an AccountName to use an AccountKey")
+		}
+		if account.key, err = base64.StdEncoding.DecodeString(settings["AccountKey"]); err != nil {
+			return nil, fmt.Errorf("Invalid Azure account key: %v", err)
+		}
+	default:
+		return nil, errors.New("The Azure connection string needs an AccountKey or SharedAccessSignature")
+	}
+
+	return account, nil
+}
+
+// blobURL returns the URL of a blob, without any authorization
+func (a *azureStorageAccount) blobURL(container, blob string) *url.URL {
+	u := *a.blobEndpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + container + "/" + blob
+	return &u
+}
+
+// client returns a http client that authorizes its requests to the account
+func (a *azureStorageAccount) client() *http.Client {
+	base := newArtifactHTTPClient().Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &http.Client{Transport: &azureTransport{account: a, base: base}}
+}
+
+// azureTransport adds the API version and authorization to requests
+type azureTransport struct {
+	account *azureStorageAccount
+	base    http.RoundTripper
+}
+
+func (t *azureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't change the request it's given
+	r := new(http.Request)
+	*r = *req
+	r.URL = new(url.URL)
+	*r.URL = *req.URL
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+
+	r.Header.Set("x-ms-version", azureStorageAPIVersion)
+	r.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	switch {
+	case t.account.sas != nil:
+		query := r.URL.Query()
+		for k, v := range t.account.sas {
+			query[k] = v
+		}
+		r.URL.RawQuery = query.Encode()
+	case t.account.key != nil:
+		r.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", t.account.name, t.account.sign(r)))
+	default:
+		token, err := t.account.tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return t.base.RoundTrip(r)
+}
+
+// sign returns the Shared Key signature of a request, see
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (a *azureStorageAccount) sign(r *http.Request) string {
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+
+	lines := []string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		"", // Date, which x-ms-date is used instead of
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+	}
+
+	var headers []string
+	for k, v := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(headers)
+	lines = append(lines, headers...)
+
+	resource := "/" + a.name + r.URL.EscapedPath()
+	query := r.URL.Query()
+	var params []string
+	for k, v := range query {
+		values := append([]string(nil), v...)
+		sort.Strings(values)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+	lines = append(lines, strings.Join(append([]string{resource}, params...), "\n"))
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// azureTokenSource gets tokens for the VM's managed identity from the instance
+// metadata service, caching them until shortly before they expire
+type azureTokenSource struct {
+	clientID string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *azureTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expires.Add(-5*time.Minute)) {
+		return s.token, nil
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://storage.azure.com/")
+	if s.clientID != "" {
+		query.Set("client_id", s.clientID)
+	}
+
+	req, err := http.NewRequest("GET", azureIMDSTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get a token for the managed identity: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to get a token for the managed identity: %s", res.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("Failed to parse the managed identity's token: %v", err)
+	}
+
+	expiresOn, err := strconv.ParseInt(body.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse the managed identity's token expiry %q: %v", body.ExpiresOn, err)
+	}
+
+	s.token = body.AccessToken
+	s.expires = time.Unix(expiresOn, 0)
+
+	return s.token, nil
+}
+
+// firstEnv returns the value of the first of the env vars that's set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/buildkite/agent/logger"
+)
+
+type AzureBlobDownloaderConfig struct {
+	// The container name and path, e.g az://my-container-name/foo/bar
+	Container string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also it's location in the container
+	Path string
+
+	// An optional path to save the file as instead of Path, relative to the
+	// download folder
+	LocalPath string
+
+	// Where to write the file while it's downloading, defaults to the folder
+	// it's being downloaded to
+	TempDir string
+
+	// Whether to fsync the file before moving it into place
+	Fsync bool
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// Where to record how the download is going, if anywhere
+	Progress *TransferProgress
+
+	// Limits how fast the download is read, if it's limited
+	Bandwidth *BandwidthLimiter
+
+	// The checksums the downloaded file must have, if they're known
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Where to write the file instead of saving it, if anywhere
+	Writer io.Writer
+
+	// How the file was compressed when it was uploaded, if it was
+	ContentEncoding string
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+}
+
+type AzureBlobDownloader struct {
+	// The config for the downloader
+	conf AzureBlobDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewAzureBlobDownloader(l logger.Logger, c AzureBlobDownloaderConfig) *AzureBlobDownloader {
+	return &AzureBlobDownloader{
+		logger: l,
+		conf:   c,
+	}
+}
+
+func (d AzureBlobDownloader) Start() error {
+	account, err := loadAzureStorageAccount()
+	if err != nil {
+		return fmt.Errorf("Error creating Azure Blob Storage client: %v", err)
+	}
+
+	container, _ := ParseAzureDestination(d.conf.Container)
+
+	// The client authorizes each request, so the regular downloader can be
+	// used as is
+	return NewDownload(d.logger, account.client(), DownloadConfig{
+		URL:             account.blobURL(container, d.ContainerFileLocation()).String(),
+		Path:            d.conf.Path,
+		LocalPath:       d.conf.LocalPath,
+		TempDir:         d.conf.TempDir,
+		Fsync:           d.conf.Fsync,
+		Destination:     d.conf.Destination,
+		Retries:         d.conf.Retries,
+		DebugHTTP:       d.conf.DebugHTTP,
+		Progress:        d.conf.Progress,
+		Bandwidth:       d.conf.Bandwidth,
+		Sha1Sum:         d.conf.Sha1Sum,
+		Sha256Sum:       d.conf.Sha256Sum,
+		Writer:          d.conf.Writer,
+		ContentEncoding: d.conf.ContentEncoding,
+	}).Start()
+}
+
+func (d AzureBlobDownloader) ContainerFileLocation() string {
+	_, path := ParseAzureDestination(d.conf.Container)
+	if path != "" {
+		return strings.TrimSuffix(path, "/") + "/" + strings.TrimPrefix(d.conf.Path, "/")
+	}
+	return d.conf.Path
+}
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAzureDestination(t *testing.T) {
+	for _, tc := range []struct {
+		Destination, Container, Path string
+	}{
+		{"az://my-container/foo/bar", "my-container", "foo/bar"},
+		{"az://my-container", "my-container", ""},
+	} {
+		container, path := ParseAzureDestination(tc.Destination)
+		assert.Equal(t, tc.Container, container)
+		assert.Equal(t, tc.Path, path)
+	}
+}
+
+func TestParseAzureConnectionString(t *testing.T) {
+	account, err := parseAzureConnectionString("DefaultEndpointsProtocol=https;AccountName=llamas;AccountKey=c2VjcmV0;EndpointSuffix=core.windows.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "llamas", account.name)
+	assert.Equal(t, []byte("secret"), account.key)
+	assert.Equal(t, "https://llamas.blob.core.windows.net/c/a%20b.txt", account.blobURL("c", "a b.txt").String())
+
+	account, err = parseAzureConnectionString("BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1/;SharedAccessSignature=?sv=2019-12-12&sig=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "abc", account.sas.Get("sig"))
+	assert.Equal(t, "http://127.0.0.1:10000/devstoreaccount1/c/a.txt", account.blobURL("c", "a.txt").String())
+
+	for _, bad := range []string{
+		"AccountName=llamas",
+		"AccountName=llamas;AccountKey=not base64!",
+		"AccountKey=c2VjcmV0",
+		"llamas",
+	} {
+		_, err := parseAzureConnectionString(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAzureBlobUploaderUploadsLargeBlobsInBlocks(t *testing.T) {
+	defer func(size int) { azureBlockSize = size }(azureBlockSize)
+	azureBlockSize = 4
+
+	var mu sync.Mutex
+	blocks := map[string]string{}
+	var blockList string
+	var headers http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if req.Method != "PUT" || req.URL.Path != "/my-container/builds/llamas.txt" || req.URL.Query().Get("sig") != "abc" {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		switch req.URL.Query().Get("comp") {
+		case "block":
+			blocks[req.URL.Query().Get("blockid")] = string(body)
+		case "blocklist":
+			blockList = string(body)
+			headers = req.Header
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING", "BlobEndpoint="+server.URL+";SharedAccessSignature=sv=2019-12-12&sig=abc")
+	defer os.Unsetenv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING")
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination: "az://my-container/builds",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := &api.Artifact{
+		Path:        "llamas.txt",
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"team-name": "llamas"},
+	}
+	assert.Equal(t, server.URL+"/my-container/builds/llamas.txt", uploader.URL(artifact))
+
+	if err := uploader.UploadStream(artifact, strings.NewReader("llamas are great")); err != nil {
+		t.Fatal(err)
+	}
+
+	id := func(n int) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", n)))
+	}
+
+	assert.Equal(t, map[string]string{
+		id(0): "llam",
+		id(1): "as a",
+		id(2): "re g",
+		id(3): "reat",
+	}, blocks)
+	assert.Contains(t, blockList, "<Latest>"+id(0)+"</Latest><Latest>"+id(1)+"</Latest>")
+	assert.Equal(t, "text/plain", headers.Get("x-ms-blob-content-type"))
+	assert.Equal(t, "llamas", headers.Get("x-ms-meta-team_name"))
+	assert.Equal(t, azureStorageAPIVersion, headers.Get("x-ms-version"))
+}
+
+func TestAzureBlobUploaderSignsRequestsWithTheAccountKey(t *testing.T) {
+	var authorization, blobType string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		blobType = req.Header.Get("x-ms-blob-type")
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING", "AccountName=llamas;AccountKey=c2VjcmV0;BlobEndpoint="+server.URL)
+	defer os.Unsetenv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING")
+
+	uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+		Destination: "az://my-container",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = uploader.UploadStream(&api.Artifact{Path: "llamas.txt"}, strings.NewReader("llamas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(authorization, "SharedKey llamas:"), authorization)
+	assert.Equal(t, "BlockBlob", blobType)
+}
+
+func TestAzureManagedIdentityTokensAreCached(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		assert.Equal(t, "true", req.Header.Get("Metadata"))
+		assert.Equal(t, "my-identity", req.URL.Query().Get("client_id"))
+		fmt.Fprintf(rw, `{"access_token":"token-%d","expires_on":"%d"}`, requests, time.Now().Add(time.Hour).Unix())
+	}))
+	defer server.Close()
+
+	defer func(u string) { azureIMDSTokenURL = u }(azureIMDSTokenURL)
+	azureIMDSTokenURL = server.URL
+
+	tokens := &azureTokenSource{clientID: "my-identity"}
+	for i := 0; i < 3; i++ {
+		token, err := tokens.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "token-1", token)
+	}
+	assert.Equal(t, 1, requests)
+}
+
+func TestAzureBlobDownloaderDownloadsBlobs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/my-container/builds/pkg/llamas.txt" || req.URL.Query().Get("sig") != "abc" {
+			http.Error(rw, "Not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(rw, "llamas are great")
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING", "BlobEndpoint="+server.URL+";SharedAccessSignature=sig=abc")
+	defer os.Unsetenv("BUILDKITE_AZURE_STORAGE_CONNECTION_STRING")
+
+	dir, err := ioutil.TempDir("", "azure-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = NewAzureBlobDownloader(logger.Discard, AzureBlobDownloaderConfig{
+		Container:   "az://my-container/builds",
+		Path:        "pkg/llamas.txt",
+		Destination: dir,
+		Retries:     1,
+	}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "pkg", "llamas.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "llamas are great", string(data))
+}
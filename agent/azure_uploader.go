@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// Blobs are uploaded in blocks of this size, so that streams of unknown length
+// don't have to be buffered in full. A blob can have up to 50,000 blocks.
+var azureBlockSize = 8 * 1024 * 1024
+
+type AzureBlobUploaderConfig struct {
+	// The destination which includes the container name and the path.
+	// az://my-container-name/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+type AzureBlobUploader struct {
+	// The container path set from the destination
+	ContainerPath string
+
+	// The container name set from the destination
+	ContainerName string
+
+	// The storage account the container is in
+	account *azureStorageAccount
+
+	// The authorized client to use
+	client *http.Client
+
+	// The configuration
+	conf AzureBlobUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewAzureBlobUploader(l logger.Logger, c AzureBlobUploaderConfig) (*AzureBlobUploader, error) {
+	account, err := loadAzureStorageAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	containerName, containerPath := ParseAzureDestination(c.Destination)
+	return &AzureBlobUploader{
+		ContainerPath: containerPath,
+		ContainerName: containerName,
+		account:       account,
+		client:        account.client(),
+		conf:          c,
+		logger:        l,
+	}, nil
+}
+
+func (u *AzureBlobUploader) URL(artifact *api.Artifact) string {
+	return u.account.blobURL(u.ContainerName, u.artifactPath(artifact)).String()
+}
+
+func (u *AzureBlobUploader) Upload(artifact *api.Artifact) error {
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	return u.UploadStream(artifact, f)
+}
+
+// UploadStream uploads the artifact's contents from r. Anything bigger than a
+// block is uploaded a block at a time and then committed, so r doesn't need
+// to have a known length.
+func (u *AzureBlobUploader) UploadStream(artifact *api.Artifact, r io.Reader) error {
+	u.logger.Debug("Uploading \"%s\" to container \"%s\"", u.artifactPath(artifact), u.ContainerName)
+
+	block := make([]byte, azureBlockSize)
+	n, err := io.ReadFull(r, block)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return u.putBlob(artifact, block[:n])
+	} else if err != nil {
+		return err
+	}
+
+	var blockIDs []string
+	for n > 0 {
+		// Block IDs have to be the same length within a blob
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(blockIDs))))
+		if err := u.putBlock(artifact, id, block[:n]); err != nil {
+			return err
+		}
+		blockIDs = append(blockIDs, id)
+
+		n, err = io.ReadFull(r, block)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+
+	return u.putBlockList(artifact, blockIDs)
+}
+
+// putBlob uploads a whole blob in one request
+func (u *AzureBlobUploader) putBlob(artifact *api.Artifact, data []byte) error {
+	req, err := http.NewRequest("PUT", u.URL(artifact), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", artifact.ContentType)
+	req.Header.Set("x-ms-blob-content-disposition", u.contentDisposition(artifact))
+	for k, v := range azureMetadataHeaders(artifact.Metadata) {
+		req.Header.Set(k, v)
+	}
+
+	return u.do(req)
+}
+
+// putBlock uploads a block, which isn't part of the blob until it's committed
+func (u *AzureBlobUploader) putBlock(artifact *api.Artifact, id string, data []byte) error {
+	blobURL := u.account.blobURL(u.ContainerName, u.artifactPath(artifact))
+	query := blobURL.Query()
+	query.Set("comp", "block")
+	query.Set("blockid", id)
+	blobURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("PUT", blobURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return u.do(req)
+}
+
+// putBlockList commits the uploaded blocks as the blob
+func (u *AzureBlobUploader) putBlockList(artifact *api.Artifact, ids []string) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids})
+	if err != nil {
+		return err
+	}
+
+	blobURL := u.account.blobURL(u.ContainerName, u.artifactPath(artifact))
+	blobURL.RawQuery = "comp=blocklist"
+
+	req, err := http.NewRequest("PUT", blobURL.String(), bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("x-ms-blob-content-type", artifact.ContentType)
+	req.Header.Set("x-ms-blob-content-disposition", u.contentDisposition(artifact))
+	for k, v := range azureMetadataHeaders(artifact.Metadata) {
+		req.Header.Set(k, v)
+	}
+
+	return u.do(req)
+}
+
+func (u *AzureBlobUploader) do(req *http.Request) error {
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Failed to PUT file \"%s\" (%s: %s)", req.URL.Path, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func (u *AzureBlobUploader) artifactPath(artifact *api.Artifact) string {
+	if u.ContainerPath == "" {
+		return artifact.Path
+	}
+
+	return strings.TrimSuffix(u.ContainerPath, "/") + "/" + artifact.Path
+}
+
+func (u *AzureBlobUploader) contentDisposition(a *api.Artifact) string {
+	return fmt.Sprintf("inline; filename=\"%s\"", filepath.Base(a.Path))
+}
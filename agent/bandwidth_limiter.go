@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/utils"
+)
+
+// The most that's read at once by a limited reader, so that a single large
+// read doesn't stall a transfer for seconds at a time
+const bandwidthLimiterChunkSize = 32 * 1024
+
+// ParseBandwidth parses a bandwidth like "50MB/s" or "512KB" into bytes per
+// second. An empty bandwidth is 0, which is unlimited.
+func ParseBandwidth(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+
+	n, err := utils.ParseByteSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid bandwidth %q, expected something like 50MB/s", s)
+	}
+	return n, nil
+}
+
+// BandwidthLimiter is a token bucket that limits how fast transfers read
+// their data. Transfers that share a limiter share its bandwidth. All of its
+// methods can be called on a nil BandwidthLimiter, which doesn't limit
+// anything.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter for bytesPerSecond, or nil if it's 0
+// (or less), which is unlimited
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &BandwidthLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n bytes from the bucket, sleeping until they would have been
+// available if there weren't enough. Callers that overdraw it leave it in
+// debt, which later callers wait out in turn.
+func (l *BandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+
+	// The bucket refills at the rate, holding at most a second's worth so
+	// that idle time can't be saved up for a burst
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// chunk limits how much of b is read or written at once
+func (l *BandwidthLimiter) chunk(b []byte) []byte {
+	if l != nil && len(b) > bandwidthLimiterChunkSize {
+		return b[:bandwidthLimiterChunkSize]
+	}
+	return b
+}
+
+// Reader returns a reader that reads from r no faster than the limiter
+// allows
+func (l *BandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r, l}
+}
+
+// Writer returns a writer that writes to w no faster than the limiter
+// allows
+func (l *BandwidthLimiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{w, l}
+}
+
+type limitedReader struct {
+	io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(r.limiter.chunk(b))
+	r.limiter.wait(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	io.Writer
+	limiter *BandwidthLimiter
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := w.limiter.chunk(b[written:])
+		w.limiter.wait(len(chunk))
+
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// transferFile is a file being uploaded, which records the bytes read from
+// it in progress and reads them no faster than the limiter allows. It can
+// still be read at an offset or seeked, so that uploaders that send parts of
+// a file concurrently still can.
+type transferFile struct {
+	*os.File
+	progress *TransferProgress
+	limiter  *BandwidthLimiter
+}
+
+func (f *transferFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(f.limiter.chunk(b))
+	f.progress.Add(n)
+	f.limiter.wait(n)
+	return n, err
+}
+
+func (f *transferFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.progress.Add(n)
+	f.limiter.wait(n)
+	return n, err
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"":        0,
+		"50MB/s":  50 * 1024 * 1024,
+		"512KB":   512 * 1024,
+		"1.5GB/s": 1536 * 1024 * 1024,
+		"100":     100,
+	} {
+		n, err := ParseBandwidth(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, expected, n, s)
+		}
+	}
+
+	_, err := ParseBandwidth("fast")
+	assert.Error(t, err)
+}
+
+func TestNilBandwidthLimiterDoesNothing(t *testing.T) {
+	var l *BandwidthLimiter = NewBandwidthLimiter(0)
+	assert.Nil(t, l)
+
+	r := strings.NewReader("llamas")
+	assert.Equal(t, r, l.Reader(r))
+
+	b := &bytes.Buffer{}
+	assert.Equal(t, b, l.Writer(b))
+}
+
+func TestBandwidthLimiterReader(t *testing.T) {
+	// A second's worth is allowed straight away, so 3 seconds' worth takes
+	// around 2 seconds
+	l := NewBandwidthLimiter(100 * 1024)
+
+	start := time.Now()
+	data, err := ioutil.ReadAll(l.Reader(bytes.NewReader(make([]byte, 300*1024))))
+	elapsed := time.Since(start)
+
+	assert.NoError(t, err)
+	assert.Len(t, data, 300*1024)
+	assert.True(t, elapsed > 1500*time.Millisecond, "took %v", elapsed)
+	assert.True(t, elapsed < 3*time.Second, "took %v", elapsed)
+}
+
+func TestBandwidthLimiterIsShared(t *testing.T) {
+	l := NewBandwidthLimiter(100 * 1024)
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := l.Writer(ioutil.Discard)
+			_, err := w.Write(make([]byte, 100*1024))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Fatalf("Expected writers to share the limit, took %v", elapsed)
+	}
+}
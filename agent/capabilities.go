@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The built-in probes for capabilities the agent advertises when it
+// registers. Each returns whether the host has the capability.
+var capabilityProbes = map[string]func() bool{
+	"docker": func() bool {
+		if _, err := exec.LookPath("docker"); err != nil {
+			return false
+		}
+		// Having the client isn't enough, it needs a daemon to talk to
+		return exec.Command("docker", "info").Run() == nil
+	},
+	"kvm": func() bool {
+		_, err := os.Stat("/dev/kvm")
+		return err == nil
+	},
+	"git": func() bool {
+		_, err := exec.LookPath("git")
+		return err == nil
+	},
+}
+
+// Capabilities that are features of the agent itself, rather than the host
+var agentCapabilities = []string{"cache-v2"}
+
+// ProbeCapabilities returns the capabilities of the host and agent, along
+// with any extra ones that were configured, sorted and without duplicates
+func ProbeCapabilities(l logger.Logger, extra []string) []string {
+	found := map[string]bool{}
+
+	for _, name := range agentCapabilities {
+		found[name] = true
+	}
+
+	for name, probe := range capabilityProbes {
+		if probe() {
+			found[name] = true
+		} else {
+			l.Debug("Capability %q wasn't found", name)
+		}
+	}
+
+	for _, name := range extra {
+		if name = strings.TrimSpace(name); name != "" {
+			found[name] = true
+		}
+	}
+
+	var capabilities []string
+	for name := range found {
+		capabilities = append(capabilities, name)
+	}
+	sort.Strings(capabilities)
+
+	return capabilities
+}
+
+// MissingCapabilities returns the capabilities in required that aren't in
+// capabilities, in the order they were required
+func MissingCapabilities(capabilities []string, required []string) []string {
+	have := map[string]bool{}
+	for _, name := range capabilities {
+		have[name] = true
+	}
+
+	var missing []string
+	for _, name := range required {
+		if name = strings.TrimSpace(name); name != "" && !have[name] {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// parseCapabilities turns a step's capabilities, either a list or a single
+// string, into a list of names
+func parseCapabilities(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return parseCapabilities([]interface{}{v})
+	case []interface{}:
+		var names []string
+		for _, item := range v {
+			name, ok := item.(string)
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("Expected capabilities to be a list of names, got %v", item)
+			}
+			if strings.Contains(name, ",") {
+				return nil, fmt.Errorf("Capability %q can't contain a comma", name)
+			}
+			names = append(names, strings.TrimSpace(name))
+		}
+		return names, nil
+	default:
+		return nil, fmt.Errorf("Expected capabilities to be a list of names, got %T", value)
+	}
+}
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeCapabilitiesIncludesExtraAndAgentCapabilities(t *testing.T) {
+	capabilities := ProbeCapabilities(logger.Discard, []string{" gpu ", "cache-v2", ""})
+
+	assert.Contains(t, capabilities, "gpu")
+	assert.Contains(t, capabilities, "cache-v2")
+	assert.NotContains(t, capabilities, "")
+
+	// Configured capabilities don't duplicate built-in ones
+	count := 0
+	for _, name := range capabilities {
+		if name == "cache-v2" {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestMissingCapabilities(t *testing.T) {
+	assert.Empty(t, MissingCapabilities([]string{"docker", "kvm"}, []string{"kvm", "docker"}))
+	assert.Equal(t, []string{"gpu", "cache-v3"},
+		MissingCapabilities([]string{"docker"}, []string{"gpu", "docker", "cache-v3"}))
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+)
+
+// The ways the job runner can handle a host clock that has drifted too far
+// from Buildkite's
+const (
+	ClockDriftWarn = "warn"
+	ClockDriftFail = "fail"
+)
+
+// measureClockDrift estimates how far the host's clock is ahead of the
+// server's (or behind, if negative) from the Date header of a response to a
+// request that was sent and received at the given times
+func measureClockDrift(resp *http.Response, sent time.Time, received time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+
+	// The Date header is truncated to the second, so the server's time was
+	// half a second later on average. The request was most likely handled
+	// halfway between sending it and getting the response.
+	serverTime := date.Add(500 * time.Millisecond)
+	localTime := sent.Add(received.Sub(sent) / 2)
+
+	return localTime.Sub(serverTime), true
+}
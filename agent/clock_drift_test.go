@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasureClockDrift(t *testing.T) {
+	server := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	resp := &http.Response{Header: http.Header{"Date": []string{server.Format(http.TimeFormat)}}}
+
+	// Sent a minute after the server's time, and received a second later
+	sent := server.Add(time.Minute)
+	drift, ok := measureClockDrift(resp, sent, sent.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, drift)
+
+	sent = server.Add(-time.Minute)
+	drift, ok = measureClockDrift(resp, sent, sent.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, -time.Minute, drift)
+
+	_, ok = measureClockDrift(&http.Response{Header: http.Header{}}, sent, sent)
+	assert.False(t, ok)
+}
+
+func TestCheckClockDrift(t *testing.T) {
+	r := &JobRunner{
+		logger: logger.Discard,
+		output: &process.Buffer{},
+		conf: JobRunnerConfig{
+			AgentConfiguration: AgentConfiguration{
+				ClockDriftThreshold: 30 * time.Second,
+				ClockDriftAction:    ClockDriftWarn,
+			},
+		},
+	}
+
+	// Nothing is checked if the drift couldn't be measured
+	r.clockDrift = time.Hour
+	assert.NoError(t, r.checkClockDrift())
+	assert.Empty(t, r.output.String())
+
+	r.clockDriftKnown = true
+	r.clockDrift = -10 * time.Second
+	assert.NoError(t, r.checkClockDrift())
+	assert.Empty(t, r.output.String())
+
+	r.clockDrift = -2 * time.Minute
+	assert.NoError(t, r.checkClockDrift())
+	assert.Contains(t, r.output.String(), "about 2m0s behind Buildkite's")
+
+	r.conf.AgentConfiguration.ClockDriftAction = ClockDriftFail
+	r.clockDrift = 2 * time.Minute
+	err := r.checkClockDrift()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "about 2m0s ahead of Buildkite's")
+	}
+}
@@ -1,7 +1,10 @@
 package agent
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/http/httputil"
@@ -27,11 +30,42 @@ type DownloadConfig struct {
 	// The relative path that should be preserved in the download folder
 	Path string
 
+	// An optional path to save the file as instead of Path, relative to the
+	// download folder
+	LocalPath string
+
+	// Where to write the file while it's downloading, defaults to the folder
+	// it's being downloaded to
+	TempDir string
+
+	// Whether to fsync the file before moving it into place
+	Fsync bool
+
 	// How many times should it retry the download before giving up
 	Retries int
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// Where to record how the download is going, if anywhere
+	Progress *TransferProgress
+
+	// Limits how fast the download is read, if it's limited
+	Bandwidth *BandwidthLimiter
+
+	// The checksums the downloaded file must have, if they're known. A
+	// download that doesn't match is fetched again.
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Where to write the file instead of saving it to Destination, such as
+	// stdout
+	Writer io.Writer
+
+	// How the file was compressed when it was uploaded, if it was. It's
+	// decompressed as it's saved, and the checksums are of what it
+	// decompresses to.
+	ContentEncoding string
 }
 
 type Download struct {
@@ -54,8 +88,17 @@ func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Downlo
 }
 
 func (d Download) Start() error {
+	if d.conf.Writer != nil {
+		return d.stream()
+	}
+
+	// What's been downloaded so far, kept between attempts so that they
+	// can carry on from where the last one stopped
+	partial := &partialDownload{}
+	defer partial.remove()
+
 	return retry.Do(func(s *retry.Stats) error {
-		err := d.try()
+		err := d.try(partial, s.Attempt > 1)
 		if err != nil {
 			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, s)
 		}
@@ -63,33 +106,78 @@ func (d Download) Start() error {
 	}, &retry.Config{Maximum: d.conf.Retries, Interval: 5 * time.Second})
 }
 
-func (d Download) try() error {
-	// If we're downloading a file with a path of "pkg/foo.txt" to a folder
-	// called "pkg", we should merge the two paths together. So, instead of it
-	// downloading to: destination/pkg/pkg/foo.txt, it will just download to
-	// destination/pkg/foo.txt
-	destinationPaths := strings.Split(d.conf.Destination, string(os.PathSeparator))
-	downloadPaths := strings.Split(d.conf.Path, string(os.PathSeparator))
+// partialDownload is a temporary file that a download is being written to,
+// along with what's needed to ask the server for the rest of it
+type partialDownload struct {
+	file *os.File
 
-	for i := 0; i < len(downloadPaths); i += 100 {
-		// If the last part of the destination path matches
-		// this path in the download, then cut it out.
-		lastIndex := len(destinationPaths) - 1
+	// The response's strong ETag or Last-Modified, which is sent as
+	// If-Range so that the server only sends the rest of the file if it
+	// hasn't changed
+	validator string
+}
 
-		// Break if we've gone too far.
-		if lastIndex == -1 {
-			break
-		}
+// offset returns how many bytes can be resumed from, or 0 if the download
+// has to start from the beginning
+func (p *partialDownload) offset() int64 {
+	if p.file == nil || p.validator == "" {
+		return 0
+	}
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
 
-		lastPathInDestination := destinationPaths[lastIndex]
-		if lastPathInDestination == downloadPaths[i] {
-			destinationPaths = destinationPaths[:lastIndex]
-		}
+// reset empties the file, so the download starts from the beginning
+func (p *partialDownload) reset() error {
+	if err := p.file.Truncate(0); err != nil {
+		return err
 	}
+	_, err := p.file.Seek(0, io.SeekStart)
+	return err
+}
 
-	finalizedDestination := strings.Join(destinationPaths, string(os.PathSeparator))
+// remove deletes the file, if the download didn't finish
+func (p *partialDownload) remove() {
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+		p.file = nil
+	}
+}
+
+// rangeValidator returns the value to send as If-Range when resuming a
+// response, or "" if it can't be resumed safely
+func rangeValidator(response *http.Response) string {
+	if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return response.Header.Get("Last-Modified")
+}
 
-	targetFile := filepath.Join(finalizedDestination, d.conf.Path)
+// resumedFrom returns the offset that a 206 Partial Content response starts
+// at, from its Content-Range header
+func resumedFrom(response *http.Response) (int64, bool) {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+func (d Download) try(partial *partialDownload, retrying bool) error {
+	path := d.conf.Path
+	if d.conf.LocalPath != "" {
+		path = d.conf.LocalPath
+	}
+
+	targetFile, err := downloadTarget(d.conf.Destination, path)
+	if err != nil {
+		return err
+	}
 	targetDirectory, _ := filepath.Split(targetFile)
 
 	// Show a nice message that we're starting to download the file
@@ -103,6 +191,13 @@ func (d Download) try() error {
 		request.Header.Add(k, v)
 	}
 
+	// Ask for the rest of the file if an earlier attempt got part of it
+	offset := partial.offset()
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", partial.validator)
+	}
+
 	// Start by downloading the file
 	response, err := d.client.Do(request)
 	if err != nil {
@@ -117,6 +212,12 @@ func (d Download) try() error {
 			d.logger.Debug("\nERR: %s\n%s", err, string(responseDump))
 		}
 
+		// If what's been downloaded so far can't be resumed, start again
+		// next time
+		if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			partial.validator = ""
+		}
+
 		return &downloadError{response.Status}
 	}
 
@@ -126,24 +227,417 @@ func (d Download) try() error {
 		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
 	}
 
-	// Create a file to handle the file
-	fileBuffer, err := os.Create(targetFile)
-	if err != nil {
-		return fmt.Errorf("Failed to create file %s (%T: %v)", targetFile, err, err)
+	// Download to a temporary file first, so that an interrupted download
+	// never leaves a truncated file where the artifact should be
+	if partial.file == nil {
+		tempDir := d.conf.TempDir
+		if tempDir == "" {
+			tempDir = targetDirectory
+		} else if err = os.MkdirAll(tempDir, 0777); err != nil {
+			return fmt.Errorf("Failed to create temporary folder %s (%T: %v)", tempDir, err, err)
+		}
+
+		partial.file, err = createTempFile(tempDir, targetFile)
+		if err != nil {
+			return fmt.Errorf("Failed to create temporary file for %s (%T: %v)", targetFile, err, err)
+		}
+	}
+
+	// Carry on from the end of the file if the server sent the rest of it,
+	// otherwise start again
+	if start, ok := resumedFrom(response); response.StatusCode == http.StatusPartialContent && ok && start == offset {
+		d.logger.Debug("Resuming download of %s from byte %d", d.conf.URL, offset)
+		d.conf.Progress.Resume(offset)
+	} else {
+		offset = 0
+		if err = partial.reset(); err != nil {
+			return fmt.Errorf("Failed to truncate temporary file for %s (%T: %v)", targetFile, err, err)
+		}
+		if retrying {
+			d.conf.Progress.Retry()
+		}
+		partial.validator = rangeValidator(response)
 	}
-	defer fileBuffer.Close()
 
 	// Copy the data to the file
-	bytes, err := io.Copy(fileBuffer, response.Body)
+	bytes, err := io.Copy(partial.file, d.conf.Bandwidth.Reader(d.conf.Progress.Reader(response.Body)))
+	if err != nil {
+		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
+	}
+
+	if response.ContentLength >= 0 && bytes != response.ContentLength {
+		return fmt.Errorf("Expected %d bytes from %s but got %d", response.ContentLength, d.conf.URL, bytes)
+	}
+
+	// The compressed file is kept until the decompressed one is in place,
+	// in case it can be resumed
+	downloaded := partial.file
+	if d.conf.ContentEncoding != "" {
+		if downloaded, err = d.decompress(partial.file, targetFile); err != nil {
+			partial.validator = ""
+			return err
+		}
+	}
+
+	if err = d.verify(downloaded); err != nil {
+		// Start again from scratch, as it's not known which part is wrong
+		partial.validator = ""
+		if downloaded != partial.file {
+			downloaded.Close()
+			os.Remove(downloaded.Name())
+		}
+		return err
+	}
+
+	if err = finishDownload(downloaded, targetFile, d.conf.Fsync); err != nil {
+		if downloaded != partial.file {
+			os.Remove(downloaded.Name())
+		}
+		partial.remove()
+		return fmt.Errorf("Failed to move download into place at %s (%T: %v)", targetFile, err, err)
+	}
+
+	// It's been moved into place, so there's nothing left to remove
+	if downloaded != partial.file {
+		partial.remove()
+	}
+	partial.file = nil
+
+	d.logger.Info("Successfully downloaded \"%s\" %d bytes", d.conf.Path, offset+bytes)
+
+	return nil
+}
+
+// decompress writes what a compressed download decompresses to into another
+// temporary file beside it
+func (d Download) decompress(file *os.File, targetFile string) (*os.File, error) {
+	decompressed, err := createTempFile(filepath.Dir(file.Name()), targetFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create temporary file for %s (%T: %v)", targetFile, err, err)
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		var w io.WriteCloser
+		if w, err = decompressWriter(d.conf.ContentEncoding, decompressed); err == nil {
+			_, err = io.Copy(w, io.NewSectionReader(file, 0, info.Size()))
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+
+	if err != nil {
+		decompressed.Close()
+		os.Remove(decompressed.Name())
+		return nil, fmt.Errorf("Failed to decompress %s (%v)", d.conf.Path, err)
+	}
+
+	return decompressed, nil
+}
+
+// verify checks that the downloaded file has the expected checksum, using
+// SHA256 if it's known and SHA1 otherwise
+func (d Download) verify(file *os.File) error {
+	name, expected, hash := "sha256sum", d.conf.Sha256Sum, sha256.New()
+	if expected == "" {
+		name, expected, hash = "sha1sum", d.conf.Sha1Sum, sha1.New()
+	}
+	if expected == "" {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, info.Size())); err != nil {
+		return fmt.Errorf("Failed to read %s to verify it (%T: %v)", d.conf.Path, err, err)
+	}
+
+	if actual := fmt.Sprintf("%x", hash.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return &checksumError{d.conf.Path, name, expected, actual}
+	}
+
+	d.logger.Debug("Verified the %s of %s", name, d.conf.Path)
+	return nil
+}
+
+// streamedDownload is what's been written of a download that's being
+// streamed, along with what's needed to ask the server for the rest of it
+type streamedDownload struct {
+	written   int64
+	validator string
+	sha1      hash.Hash
+	sha256    hash.Hash
+
+	// Where the file is written to, which remembers errors writing to the
+	// Writer, as they aren't worth retrying
+	writer *errorWriter
+
+	// What decompresses the file before it's written, if it's compressed
+	decoder io.WriteCloser
+}
+
+// closeDecoder waits for everything written to the decoder to be
+// decompressed, if there is one
+func (s *streamedDownload) closeDecoder() error {
+	if s.decoder == nil {
+		return nil
+	}
+	err := s.decoder.Close()
+	s.decoder = nil
+	return err
+}
+
+// stream writes the file to the Writer as it's downloaded. What's been
+// written can't be taken back, so a failed attempt can only be retried if
+// the server can send the rest of the file, and a file that doesn't match
+// its checksum is an error rather than being downloaded again.
+func (d Download) stream() error {
+	streamed := &streamedDownload{
+		sha1:   sha1.New(),
+		sha256: sha256.New(),
+		writer: &errorWriter{w: d.conf.Writer},
+	}
+	defer streamed.closeDecoder()
+
+	return retry.Do(func(s *retry.Stats) error {
+		err := d.tryStream(streamed, s)
+		if err != nil {
+			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.URL, err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: d.conf.Retries, Interval: 5 * time.Second})
+}
+
+func (d Download) tryStream(streamed *streamedDownload, s *retry.Stats) error {
+	d.logger.Debug("Downloading %s", d.conf.URL)
+
+	if streamed.written > 0 && streamed.validator == "" {
+		s.Break()
+		return fmt.Errorf("Can't resume %s after %d bytes were written", d.conf.URL, streamed.written)
+	}
+
+	request, err := http.NewRequest("GET", d.conf.URL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range d.conf.Headers {
+		request.Header.Add(k, v)
+	}
+
+	if streamed.written > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", streamed.written))
+		request.Header.Set("If-Range", streamed.validator)
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error while downloading %s (%T: %v)", d.conf.URL, err, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 && response.StatusCode/100 != 3 {
+		if d.conf.DebugHTTP {
+			responseDump, err := httputil.DumpResponse(response, true)
+			d.logger.Debug("\nERR: %s\n%s", err, string(responseDump))
+		}
+		return &downloadError{response.Status}
+	}
+
+	if streamed.written > 0 {
+		if start, ok := resumedFrom(response); response.StatusCode != http.StatusPartialContent || !ok || start != streamed.written {
+			s.Break()
+			return fmt.Errorf("Can't resume %s after %d bytes were written, as the server sent the whole file", d.conf.URL, streamed.written)
+		}
+		d.logger.Debug("Resuming download of %s from byte %d", d.conf.URL, streamed.written)
+		d.conf.Progress.Resume(streamed.written)
+	} else {
+		if s.Attempt > 1 {
+			d.conf.Progress.Retry()
+		}
+		streamed.validator = rangeValidator(response)
+	}
+
+	// Compressed files are decompressed as they're written, so the
+	// checksums are of what they decompress to
+	var out io.Writer = io.MultiWriter(streamed.writer, streamed.sha1, streamed.sha256)
+	if d.conf.ContentEncoding != "" {
+		if streamed.decoder == nil {
+			if streamed.decoder, err = decompressWriter(d.conf.ContentEncoding, out); err != nil {
+				s.Break()
+				return err
+			}
+		}
+		out = streamed.decoder
+	}
+
+	bytes, err := io.Copy(out, d.conf.Bandwidth.Reader(d.conf.Progress.Reader(response.Body)))
+	streamed.written += bytes
+	if w := streamed.writer; w.err != nil {
+		s.Break()
+		return fmt.Errorf("Failed to write %s (%T: %v)", d.conf.Path, w.err, w.err)
+	}
 	if err != nil {
 		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
 	}
 
-	d.logger.Info("Successfully downloaded \"%s\" %d bytes", d.conf.Path, bytes)
+	if response.ContentLength >= 0 && bytes != response.ContentLength {
+		return fmt.Errorf("Expected %d bytes from %s but got %d", response.ContentLength, d.conf.URL, bytes)
+	}
+
+	if err := streamed.closeDecoder(); err != nil {
+		s.Break()
+		if w := streamed.writer; w.err != nil {
+			return fmt.Errorf("Failed to write %s (%T: %v)", d.conf.Path, w.err, w.err)
+		}
+		return fmt.Errorf("Failed to decompress %s (%v)", d.conf.Path, err)
+	}
+
+	name, expected, actual := "sha256sum", d.conf.Sha256Sum, streamed.sha256
+	if expected == "" {
+		name, expected, actual = "sha1sum", d.conf.Sha1Sum, streamed.sha1
+	}
+	if sum := fmt.Sprintf("%x", actual.Sum(nil)); expected != "" && !strings.EqualFold(sum, expected) {
+		s.Break()
+		return &checksumError{d.conf.Path, name, expected, sum}
+	}
+
+	d.logger.Info("Successfully downloaded \"%s\" %d bytes", d.conf.Path, streamed.written)
 
 	return nil
 }
 
+// errorWriter remembers the first error from writing to w, so that it can be
+// told apart from errors reading what's being copied to it
+type errorWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errorWriter) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// checksumError is returned when a downloaded file doesn't have the checksum
+// it was uploaded with
+type checksumError struct {
+	path     string
+	name     string
+	expected string
+	actual   string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("Downloaded %s has a %s of %s, expected %s", e.path, e.name, e.actual, e.expected)
+}
+
+// downloadTarget returns where a file at path should be downloaded to within
+// destination.
+//
+// If we're downloading a file with a path of "pkg/foo.txt" to a folder called
+// "pkg", we should merge the two paths together. So, instead of it
+// downloading to: destination/pkg/pkg/foo.txt, it will just download to
+// destination/pkg/foo.txt
+func downloadTarget(destination string, path string) (string, error) {
+	destinationPaths := strings.Split(destination, string(os.PathSeparator))
+	downloadPaths := strings.Split(path, string(os.PathSeparator))
+
+	for i := 0; i < len(downloadPaths); i += 100 {
+		// If the last part of the destination path matches
+		// this path in the download, then cut it out.
+		lastIndex := len(destinationPaths) - 1
+
+		// Break if we've gone too far.
+		if lastIndex == -1 {
+			break
+		}
+
+		lastPathInDestination := destinationPaths[lastIndex]
+		if lastPathInDestination == downloadPaths[i] {
+			destinationPaths = destinationPaths[:lastIndex]
+		}
+	}
+
+	finalizedDestination := strings.Join(destinationPaths, string(os.PathSeparator))
+
+	targetFile := filepath.Join(finalizedDestination, path)
+
+	// Never write outside of the download folder
+	if !isWithinDirectory(finalizedDestination, targetFile) {
+		return "", fmt.Errorf("Refusing to download %q outside of %s", path, finalizedDestination)
+	}
+
+	return targetFile, nil
+}
+
+// createTempFile creates a hidden file in dir to download targetFile to.
+// Unlike ioutil.TempFile, the file gets the same permissions that os.Create
+// would give it.
+func createTempFile(dir string, targetFile string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, fmt.Sprintf(".%s.%d.%d.tmp", filepath.Base(targetFile), os.Getpid(), time.Now().UnixNano()))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// renameFile is os.Rename, which tests replace to make renames fail as they
+// would between filesystems
+var renameFile = os.Rename
+
+// finishDownload closes a completed temporary file and renames it to the
+// target path. If the temporary file is on another filesystem it's copied
+// next to the target first, so the final rename is still atomic, and then
+// removed.
+func finishDownload(tempFile *os.File, targetFile string, fsync bool) error {
+	if fsync {
+		if err := tempFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	err := renameFile(tempFile.Name(), targetFile)
+	if err == nil || filepath.Dir(tempFile.Name()) == filepath.Dir(targetFile) {
+		return err
+	}
+
+	src, err := os.Open(tempFile.Name())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := createTempFile(filepath.Dir(targetFile), targetFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	if err = finishDownload(dst, targetFile, fsync); err != nil {
+		return err
+	}
+
+	return os.Remove(tempFile.Name())
+}
+
 type downloadError struct {
 	s string
 }
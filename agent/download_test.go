@@ -0,0 +1,394 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadMovesCompletedFileIntoPlace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "animals/llamas.txt",
+		Destination: dir,
+		TempDir:     filepath.Join(dir, "tmp"),
+		Fsync:       true,
+		Retries:     1,
+	}).Start()
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "animals", "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+
+	tempFiles, _ := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	assert.Empty(t, tempFiles)
+}
+
+func TestDownloadRemovesTempFilesCopiedFromAnotherFilesystem(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("llamas"))
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/compressed" {
+			rw.Write(compressed.Bytes())
+		} else {
+			rw.Write([]byte("llamas"))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Renames out of the temp dir fail like they would if it was on
+	// another device, so downloads are copied into place
+	defer func() { renameFile = os.Rename }()
+	renameFile = func(from, to string) error {
+		if filepath.Dir(from) != filepath.Dir(to) {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+		}
+		return os.Rename(from, to)
+	}
+
+	for _, encoding := range []string{"", "gzip"} {
+		path := "/plain"
+		if encoding != "" {
+			path = "/compressed"
+		}
+
+		err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+			URL:             server.URL + path,
+			Path:            "llamas" + path + ".txt",
+			Destination:     dir,
+			TempDir:         filepath.Join(dir, "tmp"),
+			Retries:         1,
+			ContentEncoding: encoding,
+		}).Start()
+		assert.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "llamas", path[1:]+".txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "llamas", string(data))
+
+		tempFiles, _ := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+		assert.Empty(t, tempFiles, encoding)
+	}
+}
+
+func TestDownloadDoesntLeaveTruncatedFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", "100")
+		rw.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "llamas.txt",
+		Destination: dir,
+		Retries:     1,
+	}).Start()
+	assert.Error(t, err)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestDownloadResumesInterruptedDownloads(t *testing.T) {
+	content := "llamas and alpacas"
+	var ranges []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		rw.Header().Set("ETag", `"llamas"`)
+
+		// The first response stops half way through
+		if len(ranges) == 1 {
+			rw.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			rw.Write([]byte(content[:6]))
+			return
+		}
+
+		assert.Equal(t, `"llamas"`, req.Header.Get("If-Range"))
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes 6-%d/%d", len(content)-1, len(content)))
+		rw.WriteHeader(http.StatusPartialContent)
+		rw.Write([]byte(content[6:]))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &TransferReporter{transfers: map[string]*TransferProgress{}}
+	progress := r.Track("download", "llamas.txt", int64(len(content)))
+
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "llamas.txt",
+		Destination: dir,
+		Retries:     2,
+		Progress:    progress,
+	}).Start()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "bytes=6-"}, ranges)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+
+	snapshot := progress.snapshot()
+	assert.Equal(t, int64(len(content)), snapshot.Bytes)
+	assert.Equal(t, 1, snapshot.Retries)
+}
+
+func TestDownloadStartsAgainWhenServerIgnoresRange(t *testing.T) {
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("ETag", `"llamas"`)
+		rw.Header().Set("Content-Length", "6")
+
+		if requests == 1 {
+			rw.Write([]byte("lla"))
+			return
+		}
+		rw.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "llamas.txt",
+		Destination: dir,
+		Retries:     2,
+	}).Start()
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+}
+
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+
+		// The first response is corrupted
+		if requests == 1 {
+			rw.Write([]byte("llamos"))
+			return
+		}
+		rw.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	download := func(sha256Sum string) error {
+		return NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+			URL:         server.URL,
+			Path:        "llamas.txt",
+			Destination: dir,
+			Retries:     2,
+			Sha1Sum:     "not checked when there's a sha256sum",
+			Sha256Sum:   sha256Sum,
+		}).Start()
+	}
+
+	// Neither response matches a made up checksum
+	err = download(fmt.Sprintf("%x", sha256.Sum256([]byte("alpacas"))))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "has a sha256sum of")
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+
+	requests = 0
+	err = download(fmt.Sprintf("%x", sha256.Sum256([]byte("llamas"))))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+}
+
+func TestDownloadStreamsToWriter(t *testing.T) {
+	content := "llamas and alpacas"
+	var ranges []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		rw.Header().Set("ETag", `"llamas"`)
+
+		// The first response stops half way through
+		if len(ranges) == 1 {
+			rw.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			rw.Write([]byte(content[:6]))
+			return
+		}
+
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes 6-%d/%d", len(content)-1, len(content)))
+		rw.WriteHeader(http.StatusPartialContent)
+		rw.Write([]byte(content[6:]))
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:       server.URL,
+		Path:      "llamas.txt",
+		Retries:   2,
+		Sha256Sum: fmt.Sprintf("%x", sha256.Sum256([]byte(content))),
+		Writer:    &out,
+	}).Start()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "bytes=6-"}, ranges)
+	assert.Equal(t, content, out.String())
+}
+
+func TestDownloadStreamDoesntRetryOnceWrittenUnlessItCanResume(t *testing.T) {
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("ETag", `"llamas"`)
+		rw.Header().Set("Content-Length", "6")
+
+		if requests == 1 {
+			rw.Write([]byte("lla"))
+			return
+		}
+		rw.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:     server.URL,
+		Path:    "llamas.txt",
+		Retries: 3,
+		Writer:  &out,
+	}).Start()
+	assert.Error(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, "lla", out.String())
+
+	// A checksum mismatch can't be fixed by downloading it again either
+	requests = 1
+	out.Reset()
+
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:     server.URL,
+		Path:    "llamas.txt",
+		Retries: 3,
+		Sha1Sum: "not the sha1sum",
+		Writer:  &out,
+	}).Start()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "has a sha1sum of")
+	assert.Equal(t, 2, requests)
+}
+
+func TestDownloadDecompressesCompressedFiles(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("llamas"))
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The checksum is of what the file decompresses to
+	sha256Sum := fmt.Sprintf("%x", sha256.Sum256([]byte("llamas")))
+
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:             server.URL,
+		Path:            "llamas.txt",
+		Destination:     dir,
+		Retries:         1,
+		Sha256Sum:       sha256Sum,
+		ContentEncoding: "gzip",
+	}).Start()
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	var streamed bytes.Buffer
+	err = NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:             server.URL,
+		Path:            "llamas.txt",
+		Retries:         1,
+		Sha256Sum:       sha256Sum,
+		Writer:          &streamed,
+		ContentEncoding: "gzip",
+	}).Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", streamed.String())
+}
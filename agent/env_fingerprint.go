@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The tag the environment fingerprint is published as
+const envFingerprintTag = "env_fingerprint"
+
+// The built-in probes that are run when no probe script is configured. Tools
+// that aren't installed are skipped.
+var envFingerprintProbes = map[string][]string{
+	"bash":    {"bash", "--version"},
+	"docker":  {"docker", "--version"},
+	"gcc":     {"gcc", "--version"},
+	"git":     {"git", "--version"},
+	"go":      {"go", "version"},
+	"java":    {"java", "-version"},
+	"node":    {"node", "--version"},
+	"python":  {"python", "--version"},
+	"python3": {"python3", "--version"},
+	"ruby":    {"ruby", "--version"},
+	"rustc":   {"rustc", "--version"},
+}
+
+// EnvFingerprint computes a short hash of the versions of the toolchains
+// available on the host, so that jobs can target agents with an identical
+// environment
+type EnvFingerprint struct {
+	// An optional script whose output is hashed instead of the built-in probes
+	ProbeScript string
+}
+
+// Get returns the fingerprint
+func (e EnvFingerprint) Get() (string, error) {
+	input, err := e.Probe()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(input)))[:12], nil
+}
+
+// Probe returns what the fingerprint is a hash of, either the versions found
+// by the built-in probes or the output of the probe script
+func (e EnvFingerprint) Probe() (string, error) {
+	if e.ProbeScript != "" {
+		output, err := exec.Command(e.ProbeScript).Output()
+		if err != nil {
+			return "", fmt.Errorf("Failed to run env fingerprint probe script %q: %v", e.ProbeScript, err)
+		}
+		return string(output), nil
+	}
+
+	return runEnvFingerprintProbes(), nil
+}
+
+func runEnvFingerprintProbes() string {
+	var names []string
+	for name := range envFingerprintProbes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		probe := envFingerprintProbes[name]
+		if _, err := exec.LookPath(probe[0]); err != nil {
+			continue
+		}
+
+		// Some tools (like java) print their version to stderr
+		output, err := exec.Command(probe[0], probe[1:]...).CombinedOutput()
+		if err != nil {
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%s=%s", name, strings.TrimSpace(string(output))))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// WatchEnvFingerprint recomputes the fingerprint on an interval and calls
+// onChange when it changes, so that the agent can re-register with the new
+// one. This blocks forever, so should be run in a goroutine.
+func WatchEnvFingerprint(l logger.Logger, e EnvFingerprint, current string, interval time.Duration, onChange func(fingerprint string)) {
+	for range time.Tick(interval) {
+		fingerprint, err := e.Get()
+		if err != nil {
+			l.Warn("%s", err)
+			continue
+		}
+
+		if fingerprint != current {
+			l.Info("The environment fingerprint has changed from %s to %s, updating the %s tag",
+				current, fingerprint, envFingerprintTag)
+			current = fingerprint
+			onChange(fingerprint)
+		} else {
+			l.Debug("The environment fingerprint is unchanged (%s)", fingerprint)
+		}
+	}
+}
+
+// WithEnvFingerprintTag returns the tags with the env_fingerprint tag set to
+// the fingerprint
+func WithEnvFingerprintTag(tags []string, fingerprint string) []string {
+	tag := fmt.Sprintf("%s=%s", envFingerprintTag, fingerprint)
+
+	updated := make([]string, 0, len(tags)+1)
+	for _, t := range tags {
+		if !strings.HasPrefix(t, envFingerprintTag+"=") {
+			updated = append(updated, t)
+		}
+	}
+	return append(updated, tag)
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvFingerprintFromProbeScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Probe script test uses a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "env-fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "probe")
+	if err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho go1.12\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint, err := EnvFingerprint{ProbeScript: script}.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, 12, len(fingerprint))
+
+	again, err := EnvFingerprint{ProbeScript: script}.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, fingerprint, again)
+
+	if err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho go1.13\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := EnvFingerprint{ProbeScript: script}.Get()
+	assert.NoError(t, err)
+	assert.NotEqual(t, fingerprint, changed)
+}
+
+func TestWithEnvFingerprintTag(t *testing.T) {
+	assert.Equal(t, []string{"queue=default", "env_fingerprint=def456"},
+		WithEnvFingerprintTag([]string{"env_fingerprint=abc123", "queue=default"}, "def456"))
+
+	assert.Equal(t, []string{"queue=default", "env_fingerprint=def456"},
+		WithEnvFingerprintTag([]string{"queue=default"}, "def456"))
+}
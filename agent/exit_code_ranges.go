@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExitCodeRanges are exit statuses like "42" or "100-110", such as the ones
+// that are treated as soft failures
+type ExitCodeRanges []exitCodeRange
+
+type exitCodeRange struct {
+	min, max int
+}
+
+// ParseExitCodeRanges parses exit statuses and ranges of them, such as
+// []string{"42", "100-110"}
+func ParseExitCodeRanges(specs []string) (ExitCodeRanges, error) {
+	var ranges ExitCodeRanges
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		min, max := spec, spec
+		if idx := strings.Index(spec, "-"); idx >= 0 {
+			min, max = spec[:idx], spec[idx+1:]
+		}
+
+		r, err := parseExitCodeRange(min, max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exit status %q, expected a number from 1 to 255 or a range like 100-110", spec)
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+func parseExitCodeRange(min, max string) (exitCodeRange, error) {
+	var r exitCodeRange
+	var err error
+
+	if r.min, err = strconv.Atoi(strings.TrimSpace(min)); err != nil {
+		return r, err
+	}
+	if r.max, err = strconv.Atoi(strings.TrimSpace(max)); err != nil {
+		return r, err
+	}
+
+	// A successful exit can't be a failure, soft or otherwise
+	if r.min < 1 || r.max > 255 || r.min > r.max {
+		return r, fmt.Errorf("out of range")
+	}
+
+	return r, nil
+}
+
+// Contains returns whether an exit status (as it's reported to Buildkite) is
+// in any of the ranges
+func (ranges ExitCodeRanges) Contains(exitStatus string) bool {
+	code, err := strconv.Atoi(exitStatus)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range ranges {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ranges ExitCodeRanges) String() string {
+	var specs []string
+	for _, r := range ranges {
+		if r.min == r.max {
+			specs = append(specs, strconv.Itoa(r.min))
+		} else {
+			specs = append(specs, fmt.Sprintf("%d-%d", r.min, r.max))
+		}
+	}
+	return strings.Join(specs, ",")
+}
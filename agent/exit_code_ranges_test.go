@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExitCodeRanges(t *testing.T) {
+	ranges, err := ParseExitCodeRanges([]string{"42", " 100 - 110 ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "42,100-110", ranges.String())
+
+	for status, expected := range map[string]bool{
+		"42":  true,
+		"100": true,
+		"105": true,
+		"110": true,
+		"0":   false,
+		"1":   false,
+		"111": false,
+		"-1":  false,
+		"":    false,
+	} {
+		assert.Equal(t, expected, ranges.Contains(status), "exit status %q", status)
+	}
+}
+
+func TestParseExitCodeRangesErrors(t *testing.T) {
+	for _, spec := range []string{"0", "256", "llamas", "110-100", "1-", "-5", "0-10"} {
+		_, err := ParseExitCodeRanges([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// An openFD is a file descriptor that's open in a process
+type openFD struct {
+	Path string
+	Kind string
+}
+
+// IsPTY returns whether the descriptor is a pseudo-terminal
+func (fd openFD) IsPTY() bool {
+	if fd.Kind != "char device" {
+		return false
+	}
+	for _, prefix := range []string{"/dev/ptmx", "/dev/pts/", "/dev/ttys", "/dev/pty"} {
+		if strings.HasPrefix(fd.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// A leakedProcess is a process that was still running in a bootstrap's
+// process group after the bootstrap exited
+type leakedProcess struct {
+	PID     int
+	Command string
+	FDs     map[int]openFD
+}
+
+// fdAuditor looks for processes that hooks and plugins leave running after a
+// job finishes, and the descriptors they hold open. On long-lived agents
+// these can eventually exhaust the system's PTYs and cause every job after
+// that to fail. The offenders are only logged, as they don't belong to the
+// agent.
+type fdAuditor struct {
+	// Used in tests to replace the system calls
+	list func(pgid int) ([]leakedProcess, error)
+}
+
+// jobFDAuditor is shared by all of the job runners in the agent's process
+var jobFDAuditor = &fdAuditor{list: listProcessGroup}
+
+// Audit logs the processes left running in the process group of a job's
+// bootstrap, and returns how many PTYs they hold open
+func (f *fdAuditor) Audit(l logger.Logger, jobID string, pgid int) int {
+	// The bootstrap never started
+	if pgid <= 0 {
+		return 0
+	}
+
+	processes, err := f.list(pgid)
+	if err != nil {
+		l.Debug("[FDAudit] Failed to list the processes left by job %s: %v", jobID, err)
+		return 0
+	}
+
+	ptys := 0
+	for _, p := range processes {
+		var fds []int
+		for fd := range p.FDs {
+			fds = append(fds, fd)
+		}
+		sort.Ints(fds)
+
+		l.Warn("[FDAudit] Process %d (%s) was left running by job %s", p.PID, p.Command, jobID)
+
+		for _, fd := range fds {
+			info := p.FDs[fd]
+
+			if !info.IsPTY() {
+				l.Debug("[FDAudit] Process %d (%s) holds file descriptor %d (%s %s)",
+					p.PID, p.Command, fd, info.Kind, info.Path)
+				continue
+			}
+
+			l.Warn("[FDAudit] Process %d (%s) holds PTY %s open (file descriptor %d)",
+				p.PID, p.Command, info.Path, fd)
+			ptys++
+		}
+	}
+
+	return ptys
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFDAuditorCountsPTYsHeldByLeakedProcesses(t *testing.T) {
+	var listed int
+
+	auditor := &fdAuditor{
+		list: func(pgid int) ([]leakedProcess, error) {
+			listed = pgid
+			return []leakedProcess{
+				{PID: 1235, Command: "sleep", FDs: map[int]openFD{
+					0: {Path: "/dev/pts/3", Kind: "char device"},
+					1: {Path: "/dev/pts/3", Kind: "char device"},
+					3: {Path: "pipe:[1234]", Kind: "pipe"},
+				}},
+				{PID: 1236, Command: "ssh-agent", FDs: map[int]openFD{
+					3: {Path: "/tmp/ssh-agent.sock", Kind: "socket"},
+				}},
+			}, nil
+		},
+	}
+
+	assert.Equal(t, 2, auditor.Audit(logger.Discard, "job-1", 1234))
+	assert.Equal(t, 1234, listed)
+}
+
+func TestOpenFDIsPTY(t *testing.T) {
+	assert.True(t, openFD{Path: "/dev/pts/3", Kind: "char device"}.IsPTY())
+	assert.True(t, openFD{Path: "/dev/ttys004", Kind: "char device"}.IsPTY())
+	assert.False(t, openFD{Path: "/dev/null", Kind: "char device"}.IsPTY())
+	assert.False(t, openFD{Path: "/dev/pts/3", Kind: "file"}.IsPTY())
+}
@@ -0,0 +1,66 @@
+// +build !windows
+
+package agent
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listProcessGroup returns the processes in a process group, along with the
+// file descriptors they have open
+func listProcessGroup(pgid int) ([]leakedProcess, error) {
+	output, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "pgid=", "-o", "comm=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []leakedProcess
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		if group, err := strconv.Atoi(fields[1]); err != nil || group != pgid {
+			continue
+		}
+
+		// The process may have exited since, or belong to another user
+		fds, err := processFDs(pid)
+		if err != nil {
+			fds = map[int]openFD{}
+		}
+
+		processes = append(processes, leakedProcess{
+			PID:     pid,
+			Command: strings.Join(fields[2:], " "),
+			FDs:     fds,
+		})
+	}
+
+	return processes, nil
+}
+
+func fdKind(mode uint32) string {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		return "char device"
+	case syscall.S_IFIFO:
+		return "pipe"
+	case syscall.S_IFSOCK:
+		return "socket"
+	case syscall.S_IFDIR:
+		return "directory"
+	case syscall.S_IFREG:
+		return "file"
+	default:
+		return "other"
+	}
+}
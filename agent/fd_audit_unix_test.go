@@ -0,0 +1,43 @@
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListProcessGroup(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	cmd := exec.Command("sleep", "30")
+	cmd.Stdin = r
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	processes, err := listProcessGroup(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, processes, 1) {
+		assert.Equal(t, cmd.Process.Pid, processes[0].PID)
+		assert.Equal(t, "sleep", processes[0].Command)
+		assert.Equal(t, "pipe", processes[0].FDs[0].Kind)
+	}
+}
@@ -0,0 +1,8 @@
+package agent
+
+import "errors"
+
+// listProcessGroup isn't supported on windows, which doesn't have PTYs
+func listProcessGroup(pgid int) ([]leakedProcess, error) {
+	return nil, errors.New("Listing process groups isn't supported on windows")
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processFDs returns the file descriptors open in another process. macOS has
+// no /proc, so this asks lsof.
+func processFDs(pid int) (map[int]openFD, error) {
+	output, err := exec.Command("lsof", "-n", "-P", "-a", "-p", strconv.Itoa(pid), "-F", "ftn").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	fds := map[int]openFD{}
+	fd := -1
+	for _, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+
+		value := line[1:]
+		switch line[0] {
+		case 'f':
+			// Named descriptors like cwd and txt aren't open files
+			if fd, err = strconv.Atoi(value); err != nil {
+				fd = -1
+			}
+		case 't':
+			if fd >= 0 {
+				fds[fd] = openFD{Kind: lsofKind(value)}
+			}
+		case 'n':
+			if info, ok := fds[fd]; ok {
+				info.Path = value
+				fds[fd] = info
+			}
+		}
+	}
+
+	return fds, nil
+}
+
+func lsofKind(lsofType string) string {
+	switch lsofType {
+	case "CHR":
+		return "char device"
+	case "FIFO", "PIPE":
+		return "pipe"
+	case "unix", "IPv4", "IPv6", "systm":
+		return "socket"
+	case "DIR":
+		return "directory"
+	case "REG":
+		return "file"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,44 @@
+// +build !windows,!darwin
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// processFDs returns the file descriptors open in another process
+func processFDs(pid int) (map[int]openFD, error) {
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fds := map[int]openFD{}
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Skip descriptors that have been closed since
+		path, err := os.Readlink(fmt.Sprintf("%s/%d", dir, fd))
+		if err != nil {
+			continue
+		}
+
+		var stat syscall.Stat_t
+		if err := syscall.Stat(fmt.Sprintf("%s/%d", dir, fd), &stat); err != nil {
+			continue
+		}
+
+		fds[fd] = openFD{Path: path, Kind: fdKind(uint32(stat.Mode))}
+	}
+
+	return fds, nil
+}
@@ -48,14 +48,18 @@ func (u *FormUploader) URL(artifact *api.Artifact) string {
 }
 
 func (u *FormUploader) Upload(artifact *api.Artifact) error {
+	return u.uploadWithProgress(artifact, nil, nil)
+}
+
+func (u *FormUploader) uploadWithProgress(artifact *api.Artifact, progress *TransferProgress, limiter *BandwidthLimiter) error {
 	// Create a HTTP request for uploading the file
-	request, err := createUploadRequest(artifact)
+	request, err := createUploadRequest(artifact, progress, limiter)
 	if err != nil {
 		return err
 	}
 
 	// Create the client
-	client := &http.Client{}
+	client := newArtifactHTTPClient()
 
 	// Perform the request
 	u.logger.Debug("%s %s", request.Method, request.URL)
@@ -90,16 +94,21 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 	return nil
 }
 
-// Creates a new file upload http request with optional extra params
-func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
-	file, err := os.Open(artifact.AbsolutePath)
+// Creates a new file upload http request with optional extra params. The
+// file is streamed from disk rather than buffered in memory, and the request
+// has a GetBody func so that the body can be read again if it needs to be
+// resent. The bytes read from the file are recorded in progress, and read no
+// faster than the limiter allows.
+func createUploadRequest(artifact *api.Artifact, progress *TransferProgress, limiter *BandwidthLimiter) (*http.Request, error) {
+	fileInfo, err := os.Stat(artifact.AbsolutePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	// The form fields and the file's part header are written before the
+	// file, and the closing boundary after it
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
 
 	// Set the post data for the request
 	for key, val := range artifact.UploadInstructions.Data {
@@ -117,17 +126,39 @@ func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
 	// It's important that we add the form field last because when
 	// uploading to an S3 form, they are really nit-picky about the field
 	// order, and the file needs to be the last one other it doesn't work.
-	part, err := writer.CreateFormFile(artifact.UploadInstructions.Action.FileInput, artifact.Path)
+	_, err = writer.CreateFormFile(artifact.UploadInstructions.Action.FileInput, artifact.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = io.Copy(part, file)
+	headerLength := form.Len()
+
+	err = writer.Close()
 	if err != nil {
 		return nil, err
 	}
 
-	err = writer.Close()
+	header := form.Bytes()[:headerLength]
+	footer := form.Bytes()[headerLength:]
+	fileSize := fileInfo.Size()
+
+	getBody := func() (io.ReadCloser, error) {
+		file, err := os.Open(artifact.AbsolutePath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &formBody{
+			Reader: io.MultiReader(
+				bytes.NewReader(header),
+				limiter.Reader(progress.Reader(io.LimitReader(file, fileSize))),
+				bytes.NewReader(footer),
+			),
+			file: file,
+		}, nil
+	}
+
+	body, err := getBody()
 	if err != nil {
 		return nil, err
 	}
@@ -135,6 +166,7 @@ func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
 	// Create the URL that we'll send data to
 	uri, err := url.Parse(artifact.UploadInstructions.Action.URL)
 	if err != nil {
+		body.Close()
 		return nil, err
 	}
 
@@ -143,11 +175,28 @@ func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
 	// Create the request
 	req, err := http.NewRequest(artifact.UploadInstructions.Action.Method, uri.String(), body)
 	if err != nil {
+		body.Close()
 		return nil, err
 	}
 
+	// S3 forms don't support chunked uploads, so the length of the body
+	// needs to be known up front
+	req.ContentLength = int64(len(header)) + fileSize + int64(len(footer))
+	req.GetBody = getBody
+
 	// Finally add the multipart content type to the request
 	req.Header.Add("Content-Type", writer.FormDataContentType())
 
 	return req, nil
 }
+
+// formBody is the multipart body of an upload, which closes the file being
+// uploaded once the request is done with it
+type formBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (b *formBody) Close() error {
+	return b.file.Close()
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFormUploadArtifact(t *testing.T, dir string, url string) *api.Artifact {
+	t.Helper()
+
+	path := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(path, []byte("llamas are great"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := &api.Artifact{
+		Path:               "llamas.txt",
+		AbsolutePath:       path,
+		UploadInstructions: &api.ArtifactUploadInstructions{Data: map[string]string{"key": "${artifact:path}"}},
+	}
+	artifact.UploadInstructions.Action.URL = url
+	artifact.UploadInstructions.Action.Method = "POST"
+	artifact.UploadInstructions.Action.Path = "/upload"
+	artifact.UploadInstructions.Action.FileInput = "file"
+
+	return artifact
+}
+
+func TestFormUploaderStreamsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "form-uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var attempts int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+
+		assert.NotEmpty(t, req.Header.Get("Content-Length"))
+		assert.Empty(t, req.TransferEncoding)
+
+		file, _, err := req.FormFile("file")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		contents, _ := ioutil.ReadAll(file)
+		assert.Equal(t, "llamas are great", string(contents))
+		assert.Equal(t, "llamas.txt", req.FormValue("key"))
+
+		// Fail the first attempt so it has to be sent again
+		if attempts == 1 {
+			http.Error(rw, "Try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	artifact := newFormUploadArtifact(t, dir, server.URL)
+	uploader := NewFormUploader(logger.Discard, FormUploaderConfig{})
+
+	assert.Error(t, uploader.Upload(artifact))
+	assert.NoError(t, uploader.Upload(artifact))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestFormUploadRequestBodyCanBeReadAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "form-uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	req, err := createUploadRequest(newFormUploadArtifact(t, dir, "http://example.com"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body.Close()
+
+	body, err := req.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	second, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(len(first)), req.ContentLength)
+	assert.Equal(t, string(first), string(second))
+	assert.Contains(t, string(first), "llamas are great")
+}
@@ -1,13 +1,12 @@
 package agent
 
 import (
-	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/buildkite/agent/logger"
-	"golang.org/x/oauth2/google"
 	storage "google.golang.org/api/storage/v1"
 )
 
@@ -22,9 +21,36 @@ type GSDownloaderConfig struct {
 	// also it's location in the bucket
 	Path string
 
+	// An optional path to save the file as instead of Path, relative to the
+	// download folder
+	LocalPath string
+
+	// Where to write the file while it's downloading, defaults to the folder
+	// it's being downloaded to
+	TempDir string
+
+	// Whether to fsync the file before moving it into place
+	Fsync bool
+
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// Where to record how the download is going, if anywhere
+	Progress *TransferProgress
+
+	// Limits how fast the download is read, if it's limited
+	Bandwidth *BandwidthLimiter
+
+	// The checksums the downloaded file must have, if they're known
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Where to write the file instead of saving it, if anywhere
+	Writer io.Writer
+
+	// How the file was compressed when it was uploaded, if it was
+	ContentEncoding string
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -45,7 +71,7 @@ func NewGSDownloader(l logger.Logger, c GSDownloaderConfig) *GSDownloader {
 }
 
 func (d GSDownloader) Start() error {
-	client, err := google.DefaultClient(context.Background(), storage.DevstorageReadOnlyScope)
+	client, err := newGoogleClient(storage.DevstorageReadOnlyScope)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
 	}
@@ -54,11 +80,20 @@ func (d GSDownloader) Start() error {
 
 	// We can now cheat and pass the URL onto our regular downloader
 	return NewDownload(d.logger, client, DownloadConfig{
-		URL:         url,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		DebugHTTP:   d.conf.DebugHTTP,
+		URL:             url,
+		Path:            d.conf.Path,
+		LocalPath:       d.conf.LocalPath,
+		TempDir:         d.conf.TempDir,
+		Fsync:           d.conf.Fsync,
+		Destination:     d.conf.Destination,
+		Retries:         d.conf.Retries,
+		DebugHTTP:       d.conf.DebugHTTP,
+		Progress:        d.conf.Progress,
+		Bandwidth:       d.conf.Bandwidth,
+		Sha1Sum:         d.conf.Sha1Sum,
+		Sha256Sum:       d.conf.Sha256Sum,
+		Writer:          d.conf.Writer,
+		ContentEncoding: d.conf.ContentEncoding,
 	}).Start()
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -19,6 +20,39 @@ import (
 	storage "google.golang.org/api/storage/v1"
 )
 
+func init() {
+	RegisterArtifactBackend("gs", gsBackend{})
+}
+
+// gsBackend stores artifacts in Google Cloud Storage
+type gsBackend struct{}
+
+func (gsBackend) NewUploader(l logger.Logger, c ArtifactBackendUploadConfig) (Uploader, error) {
+	return NewGSUploader(l, GSUploaderConfig{
+		Destination: c.Destination,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
+
+func (gsBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloadConfig) (Downloader, error) {
+	return NewGSDownloader(l, GSDownloaderConfig{
+		Path:            c.Path,
+		LocalPath:       c.LocalPath,
+		TempDir:         c.TempDir,
+		Fsync:           c.Fsync,
+		Bucket:          c.UploadDestination,
+		Destination:     c.Destination,
+		Retries:         c.Retries,
+		DebugHTTP:       c.DebugHTTP,
+		Progress:        c.Progress,
+		Bandwidth:       c.Bandwidth,
+		Sha1Sum:         c.Sha1Sum,
+		Sha256Sum:       c.Sha256Sum,
+		Writer:          c.Writer,
+		ContentEncoding: c.ContentEncoding,
+	}), nil
+}
+
 type GSUploaderConfig struct {
 	// The destination which includes the GS bucket name and the path.
 	// gs://my-bucket-name/foo/bar
@@ -71,19 +105,32 @@ func ParseGSDestination(destination string) (name string, path string) {
 	return
 }
 
+// newGoogleClient returns a client authenticated with the service account in
+// BUILDKITE_GS_APPLICATION_CREDENTIALS, or otherwise Google's application
+// default credentials (GOOGLE_APPLICATION_CREDENTIALS, gcloud's credentials,
+// or the instance's service account)
 func newGoogleClient(scope string) (*http.Client, error) {
-	if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS") != "" {
-		data, err := ioutil.ReadFile(os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS"))
+	// The authenticated client is built on top of the artifact client, so
+	// that it uses the same network config
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, newArtifactHTTPClient())
+
+	if path := os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS"); path != "" {
+		data, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to read BUILDKITE_GS_APPLICATION_CREDENTIALS: %v", err)
 		}
 		conf, err := google.JWTConfigFromJSON(data, scope)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to load BUILDKITE_GS_APPLICATION_CREDENTIALS from %s: %v", path, err)
 		}
-		return conf.Client(oauth2.NoContext), nil
+		return conf.Client(ctx), nil
+	}
+
+	client, err := google.DefaultClient(ctx, scope)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find Google Cloud credentials in BUILDKITE_GS_APPLICATION_CREDENTIALS or the application default credentials: %v", err)
 	}
-	return google.DefaultClient(context.Background(), scope)
+	return client, nil
 }
 
 func (u *GSUploader) URL(artifact *api.Artifact) string {
@@ -101,6 +148,18 @@ func (u *GSUploader) URL(artifact *api.Artifact) string {
 }
 
 func (u *GSUploader) Upload(artifact *api.Artifact) error {
+	file, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
+	}
+	defer file.Close()
+
+	return u.UploadStream(artifact, file)
+}
+
+// UploadStream uploads the artifact's contents from r. Media uploads are sent
+// in chunks, so r doesn't need to have a known length.
+func (u *GSUploader) UploadStream(artifact *api.Artifact, r io.Reader) error {
 	permission := os.Getenv("BUILDKITE_GS_ACL")
 
 	// The dirtiest validation method ever...
@@ -124,16 +183,13 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 		Name:               u.artifactPath(artifact),
 		ContentType:        artifact.ContentType,
 		ContentDisposition: u.contentDisposition(artifact),
-	}
-	file, err := os.Open(artifact.AbsolutePath)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
+		Metadata:           artifact.Metadata,
 	}
 	call := u.service.Objects.Insert(u.BucketName, object)
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
 	}
-	if res, err := call.Media(file, googleapi.ContentType("")).Do(); err == nil {
+	if res, err := call.Media(r, googleapi.ContentType("")).Do(); err == nil {
 		u.logger.Debug("Created object %v at location %v\n\n", res.Name, res.SelfLink)
 	} else {
 		return errors.New(fmt.Sprintf("Failed to PUT file \"%s\" (%v)", u.artifactPath(artifact), err))
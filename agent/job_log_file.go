@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jobLogPath expands the job's environment variables (such as
+// $BUILDKITE_JOB_ID) in the template to get the path to write a copy of its
+// log to. Path separators in the values are replaced, so that a variable
+// can't change which folder the log is written to.
+func jobLogPath(template string, env map[string]string) string {
+	return filepath.Clean(os.Expand(template, func(key string) string {
+		value := strings.NewReplacer("/", "_", `\`, "_").Replace(env[key])
+		if value == "." || value == ".." {
+			value = strings.Repeat("_", len(value))
+		}
+		return value
+	}))
+}
+
+// createJobLog creates the file to write a copy of a job's log to, along
+// with any folders it's in
+func createJobLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// The log may contain secrets, so only the agent's user can read it
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
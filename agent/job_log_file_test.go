@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobLogPath(t *testing.T) {
+	env := map[string]string{
+		"BUILDKITE_PIPELINE_SLUG": "llamas",
+		"BUILDKITE_JOB_ID":        "abc-123",
+		"BUILDKITE_LABEL":         "../../etc/passwd",
+		"BUILDKITE_BRANCH":        "..",
+	}
+
+	for template, expected := range map[string]string{
+		"/var/log/buildkite/$BUILDKITE_PIPELINE_SLUG/${BUILDKITE_JOB_ID}.log": "/var/log/buildkite/llamas/abc-123.log",
+		"/var/log/buildkite/$BUILDKITE_LABEL.log":                             "/var/log/buildkite/.._.._etc_passwd.log",
+		"/var/log/buildkite/$BUILDKITE_BRANCH/$BUILDKITE_JOB_ID.log":          "/var/log/buildkite/__/abc-123.log",
+		"/var/log/buildkite/$BUILDKITE_MISSING/job.log":                       "/var/log/buildkite/job.log",
+	} {
+		assert.Equal(t, filepath.FromSlash(expected), jobLogPath(template, env), template)
+	}
+}
+
+func TestLogStreamerWritesCopyInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := createJobLog(filepath.Join(dir, "llamas", "job.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var uploaded bytes.Buffer
+
+	ls := NewLogStreamer(logger.Discard, func(chunk *LogStreamerChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		uploaded.WriteString(chunk.Data)
+		return nil
+	}, LogStreamerConfig{Concurrency: 1, MaxChunkSizeBytes: 4, Copy: file})
+
+	assert.NoError(t, ls.Start())
+	ls.Process("llamas ")
+	ls.Process("llamas and alpacas\n")
+	ls.Stop()
+	file.Close()
+
+	data, err := ioutil.ReadFile(file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas and alpacas\n", string(data))
+	assert.Equal(t, uploaded.String(), string(data))
+}
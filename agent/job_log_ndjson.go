@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobLogRecord is a line of a job's output in an ndjson job log
+type jobLogRecord struct {
+	Timestamp string `json:"timestamp"`
+	Stream    string `json:"stream"`
+	Phase     string `json:"phase"`
+	Section   string `json:"section"`
+	Message   string `json:"message"`
+}
+
+// ndjsonJobLog writes each line of a job's output as a JSON record, so that
+// it can be ingested into something like Elasticsearch without parsing. The
+// section is the last header the line followed, and the phase is worked out
+// from the headers that the bootstrap prints as it goes.
+type ndjsonJobLog struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	streams []*ndjsonJobLogStream
+	phase   string
+	section string
+
+	// Returns the current time, which is only changed in tests
+	now func() time.Time
+}
+
+func newNDJSONJobLog(w io.Writer) *ndjsonJobLog {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	return &ndjsonJobLog{
+		encoder: encoder,
+		phase:   "setup",
+		now:     time.Now,
+	}
+}
+
+// Stream returns a writer for one of the job's output streams (stdout or
+// stderr). Jobs run in a PTY only have the one stream.
+func (l *ndjsonJobLog) Stream(name string) io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := &ndjsonJobLogStream{log: l, name: name}
+	l.streams = append(l.streams, s)
+	return s
+}
+
+// Flush writes any lines that weren't ended with a newline
+func (l *ndjsonJobLog) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.streams {
+		if len(s.partial) > 0 {
+			l.writeLine(s.name, string(s.partial))
+			s.partial = nil
+		}
+	}
+}
+
+// writeLine writes a record for a line, which must be called with the lock
+// held
+func (l *ndjsonJobLog) writeLine(stream, line string) {
+	line = ansiColorRegex.ReplaceAllString(strings.TrimRight(line, "\r"), "")
+
+	if isHeaderExpansion(line) {
+		return
+	}
+
+	if isHeader(line) {
+		l.section = strings.TrimSpace(headerRegex.FindStringSubmatch(line)[1])
+		l.phase = jobLogPhase(l.section, l.phase)
+	}
+
+	// Records can't be written once the file has failed, and failing the
+	// job's output because of it would be worse
+	_ = l.encoder.Encode(jobLogRecord{
+		Timestamp: l.now().UTC().Format(time.RFC3339Nano),
+		Stream:    stream,
+		Phase:     l.phase,
+		Section:   l.section,
+		Message:   line,
+	})
+}
+
+// ndjsonJobLogStream splits the output of a stream into lines
+type ndjsonJobLogStream struct {
+	log     *ndjsonJobLog
+	name    string
+	partial []byte
+}
+
+func (s *ndjsonJobLogStream) Write(p []byte) (int, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		s.log.writeLine(s.name, string(data[:i]))
+		data = data[i+1:]
+	}
+	s.partial = append([]byte(nil), data...)
+
+	return len(p), nil
+}
+
+// jobLogPhase returns the phase of the job that a header starts, or the
+// current phase if it doesn't start one
+func jobLogPhase(header, current string) string {
+	switch header {
+	case "Setting up plugins", "Setting up vendored plugins":
+		return "plugin"
+	case "Cleaning pipeline checkout", "Preparing working directory", "Creating an encrypted workspace":
+		return "checkout"
+	case "Running commands", "Running script", "Running batch script":
+		return "command"
+	case "Uploading artifacts":
+		return "artifact"
+	}
+
+	if strings.Contains(header, "Running command (in Docker") {
+		return "command"
+	}
+
+	// Hooks are headed "Running global pre-command hook" and the like
+	if strings.HasPrefix(header, "Running ") && strings.HasSuffix(header, " hook") {
+		words := strings.Fields(header)
+		switch words[len(words)-2] {
+		case "pre-checkout", "checkout", "post-checkout":
+			return "checkout"
+		case "pre-command", "command", "post-command":
+			return "command"
+		case "pre-artifact", "post-artifact":
+			return "artifact"
+		case "pre-exit":
+			return "exit"
+		}
+	}
+
+	return current
+}
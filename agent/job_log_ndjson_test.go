@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNDJSONJobLogWritesARecordPerLine(t *testing.T) {
+	var buf bytes.Buffer
+	log := newNDJSONJobLog(&buf)
+	log.now = func() time.Time {
+		return time.Date(2026, 10, 16, 9, 30, 0, 0, time.FixedZone("", 3600))
+	}
+
+	stdout, stderr := log.Stream("stdout"), log.Stream("stderr")
+
+	fmt.Fprint(stdout, "~~~ Preparing working directory\n$ git clone\r\n")
+	fmt.Fprint(stderr, "Cloning into '.'...\n")
+	fmt.Fprint(stdout, "~~~ Running global pre-command hook\n\x1b[31mred")
+	fmt.Fprint(stdout, "\x1b[0m\n^^^ +++\n--- Running commands\nno newline")
+	log.Flush()
+
+	var records []jobLogRecord
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var record jobLogRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	timestamp := "2026-10-16T08:30:00Z"
+	assert.Equal(t, []jobLogRecord{
+		{timestamp, "stdout", "checkout", "Preparing working directory", "~~~ Preparing working directory"},
+		{timestamp, "stdout", "checkout", "Preparing working directory", "$ git clone"},
+		{timestamp, "stderr", "checkout", "Preparing working directory", "Cloning into '.'..."},
+		{timestamp, "stdout", "command", "Running global pre-command hook", "~~~ Running global pre-command hook"},
+		{timestamp, "stdout", "command", "Running global pre-command hook", "red"},
+		{timestamp, "stdout", "command", "Running commands", "--- Running commands"},
+		{timestamp, "stdout", "command", "Running commands", "no newline"},
+	}, records)
+}
+
+func TestJobLogPhase(t *testing.T) {
+	for _, tc := range []struct {
+		Header, Current, Phase string
+	}{
+		{"Setting up plugins", "setup", "plugin"},
+		{"Running plugin docker environment hook", "plugin", "plugin"},
+		{"Running local post-checkout hook", "checkout", "checkout"},
+		{":docker: Running command (in Docker container)", "checkout", "command"},
+		{"Uploading artifacts", "command", "artifact"},
+		{"Running plugin docker pre-exit hook", "artifact", "exit"},
+		{"Running tests", "command", "command"},
+	} {
+		assert.Equal(t, tc.Phase, jobLogPhase(tc.Header, tc.Current), tc.Header)
+	}
+}
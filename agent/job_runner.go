@@ -2,21 +2,26 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/env"
 	"github.com/buildkite/agent/experiments"
+	"github.com/buildkite/agent/history"
 	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/agent/metrics"
 	"github.com/buildkite/agent/process"
 	"github.com/buildkite/agent/retry"
+	"github.com/buildkite/agent/tracing"
 	"github.com/buildkite/shellwords"
 )
 
@@ -29,6 +34,15 @@ type JobRunnerConfig struct {
 
 	// Whether to set debug in the job
 	Debug bool
+
+	// Tags set on the agent via a control command since it registered
+	LocalTags map[string]string
+
+	// The agent's access token, which can be rotated while the job runs
+	AccessTokens *api.RotatingToken
+
+	// Called whenever the job moves from one state to another
+	TransitionHooks []JobTransitionHook
 }
 
 type JobRunner struct {
@@ -50,6 +64,9 @@ type JobRunner struct {
 	// The APIProxy that will be exposed to the job bootstrap
 	apiProxy *APIProxy
 
+	// A proxy that serves the build's artifacts to the job
+	artifactProxy *ArtifactProxy
+
 	// A scope for metrics within a job
 	metrics *metrics.Scope
 
@@ -69,21 +86,34 @@ type JobRunner struct {
 	// The internal log streamer
 	logStreamer *LogStreamer
 
-	// If the job is being cancelled
-	cancelled bool
+	// Where the job is in its lifecycle
+	state *jobStateMachine
 
 	// Used to wait on various routines that we spin up
 	routineWaitGroup sync.WaitGroup
 
-	// A lock to protect concurrent calls to cancel
-	cancelLock sync.Mutex
-
 	// File containing a copy of the job env
 	envFile *os.File
+
+	// File that a copy of the job's log is written to, if any
+	jobLog *os.File
+
+	// Writes the job's output to jobLog as JSON records, if the log is
+	// in the ndjson format
+	jobLogNDJSON *ndjsonJobLog
+
+	// How far the host's clock was from Buildkite's when the job started,
+	// if it could be measured
+	clockDrift      time.Duration
+	clockDriftKnown bool
 }
 
 // Initializes the job runner
-func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterResponse, j *api.Job, conf JobRunnerConfig) (*JobRunner, error) {
+func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterResponse, j *api.Job, conf JobRunnerConfig) (_ *JobRunner, err error) {
+	// Everything the job runner does is logged as the job subsystem, so its
+	// level can be set separately
+	l = l.Named("job")
+
 	runner := &JobRunner{
 		agent:   ag,
 		job:     j,
@@ -94,23 +124,52 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 	runner.context, runner.contextCancel = context.WithCancel(context.Background())
 
+	// Transitions are logged before any other hooks see them
+	runner.state = newJobStateMachine(j, append([]JobTransitionHook{runner.logTransition}, conf.TransitionHooks...))
+
+	if runner.conf.AccessTokens == nil {
+		runner.conf.AccessTokens = api.NewRotatingToken(ag.AccessToken)
+	}
+
 	// Our own APIClient using the endpoint and the agents access token
 	runner.apiClient = NewAPIClient(l, APIClientConfig{
 		Endpoint: runner.conf.Endpoint,
-		Token:    ag.AccessToken,
+		Tokens:   runner.conf.AccessTokens,
 	})
 
 	// A proxy for the agent API that is expose to the bootstrap
-	runner.apiProxy = NewAPIProxy(l, conf.Endpoint, ag.AccessToken)
+	runner.apiProxy = NewAPIProxy(l, conf.Endpoint, runner.conf.AccessTokens)
 
 	// Create our header times struct
 	runner.headerTimesStreamer = newHeaderTimesStreamer(l, runner.onUploadHeaderTime)
 
+	// Keep a copy of the job's log on disk too, if configured to, so that
+	// it's there even if it can't be streamed to Buildkite
+	var logCopy io.Writer
+	if template := conf.AgentConfiguration.JobLogPathTemplate; template != "" {
+		path := jobLogPath(template, j.Env)
+		if file, err := createJobLog(path); err != nil {
+			l.Warn("[JobRunner] Failed to create job log file %s: %v", path, err)
+		} else {
+			l.Debug("[JobRunner] Writing a copy of the job log to %s", path)
+			runner.jobLog = file
+
+			// An ndjson log is written from the job's output streams,
+			// instead of the log that's sent to Buildkite
+			if conf.AgentConfiguration.JobLogFormat == "ndjson" {
+				runner.jobLogNDJSON = newNDJSONJobLog(file)
+			} else {
+				logCopy = file
+			}
+		}
+	}
+
 	// The log streamer that will take the output chunks, and send them to
 	// the Buildkite Agent API
 	runner.logStreamer = NewLogStreamer(l, runner.onUploadChunk, LogStreamerConfig{
 		Concurrency:       3,
 		MaxChunkSizeBytes: j.ChunksMaxSizeBytes,
+		Copy:              logCopy,
 	})
 
 	// Start a proxy to give to the job for api operations
@@ -120,6 +179,23 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		}
 	}
 
+	// Start a proxy to give to the job for fetching artifacts
+	if experiments.IsEnabled("artifact-proxy") {
+		runner.artifactProxy = NewArtifactProxy(l, runner.apiClient, j.Env["BUILDKITE_BUILD_ID"], j.ID)
+		if err := runner.artifactProxy.Listen(); err != nil {
+			runner.closeArtifactProxy()
+			return nil, err
+		}
+
+		// Run closes the proxy when the job finishes, but a job that can't
+		// be run never gets that far
+		defer func() {
+			if err != nil {
+				runner.closeArtifactProxy()
+			}
+		}()
+	}
+
 	// TempDir is not guaranteed to exist
 	tempDir := os.TempDir()
 	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
@@ -154,6 +230,10 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 	// The writer that output from the process goes into
 	var processWriter io.Writer
 
+	// Very long lines are truncated, so that one huge line (like a JSON blob
+	// printed by a test) can't stall log streaming or the log viewer
+	maxLineLength := conf.AgentConfiguration.MaxLogLineLength
+
 	// If we have timestamp lines on, we have to buffer lines before we flush them
 	if conf.AgentConfiguration.TimestampLines {
 		var pr *io.PipeReader
@@ -161,7 +241,10 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 
 		go func() {
 			// Use a scanner to process output line by line
-			err := process.NewScanner(l).ScanLines(pr, func(line string) {
+			scanner := process.NewScanner(l)
+			scanner.MaxLineLength = maxLineLength
+
+			err := scanner.ScanLines(pr, func(line string) {
 				// Send to our header streamer and determine if it's a header
 				isHeader := runner.headerTimesStreamer.Scan(line)
 
@@ -181,11 +264,14 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		pr, pw := io.Pipe()
 
 		// Write output directly to the line buffer so we
-		processWriter = io.MultiWriter(pw, runner.output)
+		processWriter = io.MultiWriter(pw, process.NewLineLimitWriter(runner.output, maxLineLength))
 
 		// Use a scanner to process output for headers only
 		go func() {
-			err := process.NewScanner(l).ScanLines(pr, func(line string) {
+			scanner := process.NewScanner(l)
+			scanner.MaxLineLength = maxLineLength
+
+			err := scanner.ScanLines(pr, func(line string) {
 				runner.headerTimesStreamer.Scan(line)
 			})
 			if err != nil {
@@ -194,6 +280,13 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		}()
 	}
 
+	// The ndjson log needs to know which stream each line came from
+	stdout, stderr := processWriter, processWriter
+	if runner.jobLogNDJSON != nil {
+		stdout = io.MultiWriter(processWriter, runner.jobLogNDJSON.Stream("stdout"))
+		stderr = io.MultiWriter(processWriter, runner.jobLogNDJSON.Stream("stderr"))
+	}
+
 	// Copy the current processes ENV and merge in the new ones. We do this
 	// so the sub process gets PATH and stuff. We merge our path in over
 	// the top of the current one so the ENV from Buildkite and the agent
@@ -206,8 +299,8 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		Args:   cmd[1:],
 		Env:    processEnv,
 		PTY:    conf.AgentConfiguration.RunInPty,
-		Stdout: processWriter,
-		Stderr: processWriter,
+		Stdout: stdout,
+		Stderr: stderr,
 	})
 
 	// Kick off our callback when the process starts
@@ -219,18 +312,44 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 	return runner, nil
 }
 
+// closeArtifactProxy stops the job's artifact proxy, if it has one
+func (r *JobRunner) closeArtifactProxy() {
+	if r.artifactProxy == nil {
+		return
+	}
+	if err := r.artifactProxy.Close(); err != nil {
+		r.logger.Warn("[JobRunner] Failed to close artifact proxy: %v", err)
+	}
+}
+
 // Runs the job
 func (r *JobRunner) Run() error {
 	r.logger.Info("Starting job %s", r.job.ID)
 
 	startedAt := time.Now()
 
+	// The job's tools can use the artifact proxy until the job finishes,
+	// however it finishes
+	defer r.closeArtifactProxy()
+
 	// Start the build in the Buildkite Agent API. This is the first thing
 	// we do so if it fails, we don't have to worry about cleaning things
 	// up like started log streamer workers, etc.
 	if err := r.startJob(startedAt); err != nil {
+		if r.state.Canceled() {
+			r.transition(JobStateCanceled)
+		} else {
+			r.transition(JobStateFinished)
+		}
 		return err
 	}
+	r.transition(JobStateStarted)
+
+	// Record that the checkout is in use, so that maintenance leaves it be
+	if checkout := checkoutPath(r.conf.AgentConfiguration.BuildPath, r.agent.Name, r.job.Env); checkout != "" {
+		activeWorkspaces.Start(r.logger, checkout)
+		defer activeWorkspaces.Finish(r.logger, checkout)
+	}
 
 	// Start the header time streamer
 	if err := r.headerTimesStreamer.Start(); err != nil {
@@ -242,17 +361,54 @@ func (r *JobRunner) Run() error {
 		return err
 	}
 
-	// Run the process. This will block until it finishes.
-	if err := r.process.Run(); err != nil {
-		// Send the error as output
-		r.logStreamer.Process(fmt.Sprintf("%s", err))
+	var exitStatus string
+
+	// Make sure this agent is new enough, has the capabilities to run the
+	// job and has a clock that can be trusted before running anything,
+	// otherwise fail the job with an explanation
+	err := r.checkMinimumAgentVersion()
+	if err == nil {
+		err = r.checkRequiredCapabilities()
+	}
+	if err == nil {
+		err = r.checkClockDrift()
+	}
+	if err != nil {
+		r.logger.Error("%s", err)
+		r.logStreamer.Process(fmt.Sprintf("%s\n", err))
+		exitStatus = "-1"
+	} else if !r.transition(JobStateRunning) {
+		// The job was canceled while it was being checked, so there's no
+		// need to run the bootstrap just to stop it again
+		r.logger.Info("Job %s was canceled before it started running", r.job.ID)
+		exitStatus = "-1"
 	} else {
-		// Add the final output to the streamer
-		r.logStreamer.Process(r.output.String())
+		usage := startResourceUsage()
+
+		// Run the process. This will block until it finishes.
+		runErr := r.process.Run()
+		exitStatus = fmt.Sprintf("%d", r.process.WaitStatus().ExitStatus())
+
+		if runErr != nil {
+			// Send the error as output
+			r.logStreamer.Process(fmt.Sprintf("%s", runErr))
+		} else {
+			r.checkSoftFailure(exitStatus)
+
+			// Add the final output to the streamer
+			r.logStreamer.Process(r.output.String())
+		}
+
+		r.reportResourceUsage(usage.finish(r.process))
+
+		// The bootstrap leads its own process group, so anything left in it
+		// was started by a hook or plugin and never cleaned up
+		jobFDAuditor.Audit(r.logger, r.job.ID, r.process.Pid())
 	}
 
 	// Store the finished at time
 	finishedAt := time.Now()
+	r.transition(JobStateFinishing)
 
 	// Stop the header time streamer. This will block until all the chunks
 	// have been uploaded
@@ -267,6 +423,16 @@ func (r *JobRunner) Run() error {
 		r.logger.Warn("%d chunks failed to upload for this job", count)
 	}
 
+	// Everything's been written to the local copy of the log too
+	if r.jobLogNDJSON != nil {
+		r.jobLogNDJSON.Flush()
+	}
+	if r.jobLog != nil {
+		if err := r.jobLog.Close(); err != nil {
+			r.logger.Warn("[JobRunner] Failed to close job log file %s: %v", r.jobLog.Name(), err)
+		}
+	}
+
 	// Wait for the routines that we spun up to finish
 	r.logger.Debug("[JobRunner] Waiting for all other routines to finish")
 	r.contextCancel()
@@ -287,8 +453,6 @@ func (r *JobRunner) Run() error {
 		}
 	}
 
-	exitStatus := fmt.Sprintf("%d", r.process.WaitStatus().ExitStatus())
-
 	jobMetrics := r.metrics.With(metrics.Tags{
 		"exit_code": exitStatus,
 	})
@@ -308,16 +472,106 @@ func (r *JobRunner) Run() error {
 	// sure everything else is done first.
 	r.finishJob(finishedAt, exitStatus, r.logStreamer.FailedChunks())
 
+	if r.state.Canceled() {
+		r.transition(JobStateCanceled)
+	} else {
+		r.transition(JobStateFinished)
+	}
+
+	// Keep a local record of the job for `buildkite-agent status --history`
+	if r.conf.AgentConfiguration.JobHistoryPath != "" {
+		r.recordHistory(startedAt, finishedAt, exitStatus)
+	}
+
 	r.logger.Info("Finished job %s", r.job.ID)
 
 	return nil
 }
 
+// reportResourceUsage logs what the job used, and annotates the build with
+// it if configured to
+func (r *JobRunner) reportResourceUsage(u ResourceUsage) {
+	r.logger.WithFields(u.fields()...).Info("Job %s used %s of CPU time over %s", r.job.ID, u.CPUTime(), u.Duration)
+
+	if !r.conf.AgentConfiguration.ResourceUsageAnnotation {
+		return
+	}
+
+	label := r.job.Env["BUILDKITE_LABEL"]
+	if label == "" {
+		label = r.job.ID
+	}
+
+	annotation := &api.Annotation{
+		Body:    u.markdown(label),
+		Context: "resource-usage-" + r.job.ID,
+		Style:   "info",
+	}
+
+	err := retry.Do(func(s *retry.Stats) error {
+		resp, err := r.apiClient.Annotations.Create(r.job.ID, annotation)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+		}
+		return err
+	}, &retry.Config{Maximum: 3, Interval: 1 * time.Second, Jitter: true})
+	if err != nil {
+		r.logger.Warn("[JobRunner] Failed to annotate the build with resource usage: %v", err)
+	}
+}
+
+func (r *JobRunner) recordHistory(startedAt, finishedAt time.Time, exitStatus string) {
+	store := history.NewStore(r.conf.AgentConfiguration.JobHistoryPath)
+
+	err := store.Add(history.Record{
+		JobID:      r.job.ID,
+		AgentName:  r.agent.Name,
+		Pipeline:   r.job.Env[`BUILDKITE_PIPELINE_SLUG`],
+		Label:      r.job.Env[`BUILDKITE_LABEL`],
+		StartedAt:  startedAt,
+		FinishedAt: finishedAt,
+		Duration:   finishedAt.Sub(startedAt),
+		ExitStatus: exitStatus,
+		PeakRSS:    r.process.MaxRSS(),
+	})
+	if err != nil {
+		r.logger.Warn("[JobRunner] Failed to record job history: %v", err)
+	}
+}
+
+// State returns where the job is in its lifecycle
+func (r *JobRunner) State() JobState {
+	return r.state.State()
+}
+
+// transition moves the job to another state, returning false if it can't
+// move there, such as when it's already been canceled
+func (r *JobRunner) transition(to JobState) bool {
+	if err := r.state.Transition(to); err != nil {
+		r.logger.Debug("[JobRunner] %v", err)
+		return false
+	}
+	return true
+}
+
+func (r *JobRunner) logTransition(job *api.Job, from, to JobState) {
+	r.logger.Debug("[JobRunner] Job %s is %s (was %s)", job.ID, to, from)
+}
+
+// Cancel stops the job's bootstrap, interrupting it and then terminating it
+// if it hasn't stopped after the cancel grace period. A job canceled before
+// the bootstrap is running never runs it. Only the first call does anything,
+// and calls after the job has started finishing are ignored.
 func (r *JobRunner) Cancel() error {
-	r.cancelLock.Lock()
-	defer r.cancelLock.Unlock()
+	from, err := r.state.transition(JobStateCanceling)
+	if err != nil {
+		r.logger.Debug("[JobRunner] %v", err)
+		return nil
+	}
 
-	if r.cancelled {
+	// The job can't move on to running now, so there's nothing to stop
+	if from != JobStateRunning {
+		r.logger.Info("Canceling job %s before it started running", r.job.ID)
 		return nil
 	}
 
@@ -352,6 +606,174 @@ func (r *JobRunner) Cancel() error {
 	}
 }
 
+// Checks that the running agent satisfies the BUILDKITE_MINIMUM_AGENT_VERSION
+// set in the jobs environment (usually via a pipelines minimum_agent_version)
+func (r *JobRunner) checkMinimumAgentVersion() error {
+	minimum, ok := r.job.Env[`BUILDKITE_MINIMUM_AGENT_VERSION`]
+	if !ok || minimum == "" {
+		return nil
+	}
+
+	cmp, err := CompareVersions(Version(), minimum)
+	if err != nil {
+		return fmt.Errorf("Failed to check BUILDKITE_MINIMUM_AGENT_VERSION: %v", err)
+	}
+
+	if cmp < 0 {
+		return fmt.Errorf("This job requires buildkite-agent v%s or newer, but this agent is running v%s. "+
+			"Please upgrade the agent to run this job.", minimum, Version())
+	}
+
+	return nil
+}
+
+// Checks that the agent has the BUILDKITE_REQUIRED_CAPABILITIES set in the
+// jobs environment (usually via a steps capabilities)
+func (r *JobRunner) checkRequiredCapabilities() error {
+	required, ok := r.job.Env[`BUILDKITE_REQUIRED_CAPABILITIES`]
+	if !ok || required == "" {
+		return nil
+	}
+
+	missing := MissingCapabilities(r.conf.AgentConfiguration.Capabilities, strings.Split(required, ","))
+	if len(missing) > 0 {
+		return fmt.Errorf("This job requires the agent capabilities %s, but this agent doesn't have %s (it has %s). "+
+			"Please run it on an agent with them, or remove them from the step's capabilities.",
+			required, strings.Join(missing, ", "), strings.Join(r.conf.AgentConfiguration.Capabilities, ", "))
+	}
+
+	return nil
+}
+
+// Checks that the host's clock is within the clock-drift-threshold of
+// Buildkite's. Drift makes TLS and signed URLs fail in ways that look like
+// network errors, so it either fails the job or adds a warning to its log.
+func (r *JobRunner) checkClockDrift() error {
+	threshold := r.conf.AgentConfiguration.ClockDriftThreshold
+	if threshold <= 0 || !r.clockDriftKnown {
+		return nil
+	}
+
+	drift, direction := r.clockDrift, "ahead of"
+	if drift < 0 {
+		drift, direction = -drift, "behind"
+	}
+
+	if drift <= threshold {
+		return nil
+	}
+
+	message := fmt.Sprintf("This host's clock is about %s %s Buildkite's, which is more than the %s allowed by "+
+		"clock-drift-threshold. Drift can make TLS and signed URLs fail with errors that look like network problems, "+
+		"so check that NTP is running on the host.", drift.Round(time.Second), direction, threshold)
+
+	if r.conf.AgentConfiguration.ClockDriftAction == ClockDriftFail {
+		return errors.New(message)
+	}
+
+	r.logger.Warn("%s", message)
+	r.output.Write([]byte(fmt.Sprintf("Warning: %s\n", message)))
+
+	return nil
+}
+
+// Marks the job as soft failed if the agent is configured to treat its exit
+// status as a soft failure, and explains why at the end of its log
+func (r *JobRunner) checkSoftFailure(exitStatus string) {
+	codes := r.conf.AgentConfiguration.SoftFailExitCodes
+	if !codes.Contains(exitStatus) {
+		return
+	}
+
+	message := fmt.Sprintf("Exit status %s is treated as a soft failure, as this agent's soft-fail-exit-codes are %s",
+		exitStatus, codes)
+
+	r.logger.Info("%s", message)
+	r.output.Write([]byte(message + "\n"))
+	r.job.SoftFailed = true
+}
+
+// loadJobEnvFiles returns the variables from the files matching the
+// job-env-file patterns, with later files taking precedence
+func (r *JobRunner) loadJobEnvFiles() (*env.Environment, error) {
+	result := env.New()
+
+	queue := r.job.Env["BUILDKITE_AGENT_META_DATA_QUEUE"]
+	if queue == "" {
+		queue = "default"
+	}
+
+	for _, pattern := range r.conf.AgentConfiguration.JobEnvFiles {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid job env file pattern %q: %v", pattern, err)
+		}
+
+		if len(paths) == 0 {
+			r.logger.Debug("[JobRunner] No job env files match %s", pattern)
+		}
+
+		for _, path := range paths {
+			fileEnv, err := env.FromFile(path, queue)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load job env file: %v", err)
+			}
+
+			r.logger.Debug("[JobRunner] Loaded %d variables from job env file %s", fileEnv.Length(), path)
+			result = result.Merge(fileEnv)
+		}
+	}
+
+	return result, nil
+}
+
+// traceEnv returns the trace context environment variables for the job. The
+// job's span continues the trace from the job payload (or the job's own
+// env), or starts the build's trace if there isn't one.
+func (r *JobRunner) traceEnv(env map[string]string) map[string]string {
+	parent := r.job.TraceContext[tracing.TraceparentKey]
+	state := r.job.TraceContext[tracing.TracestateKey]
+	baggage := r.job.TraceContext[tracing.BaggageKey]
+
+	if parent == "" {
+		parent, state = env[tracing.TraceparentEnv], env[tracing.TracestateEnv]
+	}
+	if baggage == "" {
+		baggage = env[tracing.BaggageEnv]
+	}
+
+	var span tracing.SpanContext
+	if sc, err := tracing.ParseTraceparent(parent); err == nil {
+		span = sc.Child()
+	} else {
+		if parent != "" {
+			r.logger.Warn("[JobRunner] Ignoring the job's trace context: %v", err)
+		}
+		span, state = tracing.NewTrace(env["BUILDKITE_BUILD_ID"]), ""
+	}
+
+	r.logger.Debug("[JobRunner] Job is span %x in trace %s", span.SpanID, span.TraceIDString())
+
+	b := tracing.ParseBaggage(baggage)
+	for _, member := range []struct{ key, env string }{
+		{"buildkite.organization", "BUILDKITE_ORGANIZATION_SLUG"},
+		{"buildkite.pipeline", "BUILDKITE_PIPELINE_SLUG"},
+		{"buildkite.build_id", "BUILDKITE_BUILD_ID"},
+		{"buildkite.build_number", "BUILDKITE_BUILD_NUMBER"},
+		{"buildkite.job_id", "BUILDKITE_JOB_ID"},
+	} {
+		if value := env[member.env]; value != "" {
+			b = b.Set(member.key, value)
+		}
+	}
+
+	return map[string]string{
+		tracing.TraceparentEnv: span.Traceparent(),
+		tracing.TracestateEnv:  state,
+		tracing.BaggageEnv:     b.String(),
+	}
+}
+
 // Creates the environment variables that will be used in the process and writes a flat environment file
 func (r *JobRunner) createEnvironment() ([]string, error) {
 	// Create a clone of our jobs environment. We'll then set the
@@ -372,8 +794,14 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	// We present only the clean environment - i.e only variables configured
 	// on the job upstream - and expose the path in another environment variable.
 	if r.envFile != nil {
-		for key, value := range env {
-			if _, err := r.envFile.WriteString(fmt.Sprintf("%s=%q\n", key, value)); err != nil {
+		var keys []string
+		for key := range env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, err := r.envFile.WriteString(fmt.Sprintf("%s=%q\n", key, env[key])); err != nil {
 				return nil, err
 			}
 		}
@@ -383,6 +811,18 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		env["BUILDKITE_ENV_FILE"] = r.envFile.Name()
 	}
 
+	// Add any variables from the host's env files that the job hasn't set. These
+	// aren't written to the env file above, as they're not part of the job.
+	hostEnv, err := r.loadJobEnvFiles()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range hostEnv.ToMap() {
+		if _, exists := env[key]; !exists {
+			env[key] = value
+		}
+	}
+
 	// Certain env can only be set by agent configuration.
 	// We show the user a warning in the bootstrap if they use any of these at a job level.
 
@@ -398,6 +838,9 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		`BUILDKITE_HOOKS_PATH`,
 		`BUILDKITE_PLUGINS_PATH`,
 		`BUILDKITE_SSH_KEYSCAN`,
+		`BUILDKITE_ENCRYPTED_WORKSPACE`,
+		`BUILDKITE_ENCRYPTED_WORKSPACE_SIZE`,
+		`BUILDKITE_CLEAN_CHECKOUT_EVERY`,
 		`BUILDKITE_GIT_SUBMODULES`,
 		`BUILDKITE_COMMAND_EVAL`,
 		`BUILDKITE_PLUGINS_ENABLED`,
@@ -407,6 +850,8 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		`BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT`,
 		`BUILDKITE_GIT_CLEAN_FLAGS`,
 		`BUILDKITE_SHELL`,
+		`BUILDKITE_ARTIFACT_PROXY_URL`,
+		`BUILDKITE_ARTIFACT_PROXY_SOCKET`,
 	}
 
 	var ignoredEnv []string
@@ -428,7 +873,34 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		env["BUILDKITE_AGENT_ACCESS_TOKEN"] = r.apiProxy.AccessToken()
 	} else {
 		env["BUILDKITE_AGENT_ENDPOINT"] = r.conf.Endpoint
-		env["BUILDKITE_AGENT_ACCESS_TOKEN"] = r.agent.AccessToken
+		env["BUILDKITE_AGENT_ACCESS_TOKEN"] = r.conf.AccessTokens.Get()
+	}
+
+	if r.artifactProxy != nil {
+		env["BUILDKITE_ARTIFACT_PROXY_URL"] = r.artifactProxy.URL()
+		if socket := r.artifactProxy.SocketPath(); socket != "" {
+			env["BUILDKITE_ARTIFACT_PROXY_SOCKET"] = socket
+		}
+	}
+
+	// Commands in the job resolve and connect to hosts the same way the
+	// agent does
+	for key, value := range networkConfig.env() {
+		env[key] = value
+	}
+
+	// Make the job part of the trace that triggered it
+	if r.conf.AgentConfiguration.Tracing {
+		for key, value := range r.traceEnv(env) {
+			env[key] = value
+		}
+	}
+
+	// Expose tags that were set locally the same way Buildkite exposes the
+	// tags the agent registered with
+	for key, value := range r.conf.LocalTags {
+		envKey := strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		env["BUILDKITE_AGENT_META_DATA_"+envKey] = value
 	}
 
 	// Add agent environment variables
@@ -447,6 +919,9 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
+	env["BUILDKITE_ENCRYPTED_WORKSPACE"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.EncryptedWorkspace)
+	env["BUILDKITE_ENCRYPTED_WORKSPACE_SIZE"] = r.conf.AgentConfiguration.EncryptedWorkspaceSize
+	env["BUILDKITE_CLEAN_CHECKOUT_EVERY"] = r.conf.AgentConfiguration.CleanCheckoutEvery
 	env["BUILDKITE_GIT_SUBMODULES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitSubmodules)
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.CommandEval)
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsEnabled)
@@ -477,6 +952,7 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	for key, value := range env {
 		envSlice = append(envSlice, fmt.Sprintf("%s=%s", key, value))
 	}
+	sort.Strings(envSlice)
 
 	return envSlice, nil
 }
@@ -489,7 +965,12 @@ func (r *JobRunner) startJob(startedAt time.Time) error {
 	r.job.StartedAt = startedAt.UTC().Format(time.RFC3339Nano)
 
 	return retry.Do(func(s *retry.Stats) error {
-		_, err := r.apiClient.Jobs.Start(r.job)
+		sent := time.Now()
+		response, err := r.apiClient.Jobs.Start(r.job)
+
+		if err == nil && response != nil {
+			r.clockDrift, r.clockDriftKnown = measureClockDrift(response.Response, sent, time.Now())
+		}
 
 		if err != nil {
 			if api.IsRetryableError(err) {
@@ -501,7 +982,7 @@ func (r *JobRunner) startJob(startedAt time.Time) error {
 		}
 
 		return err
-	}, &retry.Config{Maximum: 30, Interval: 5 * time.Second})
+	}, &retry.Config{Maximum: 30, Interval: 5 * time.Second, Multiplier: 1.5, MaxInterval: time.Minute, FullJitter: true})
 }
 
 // Finishes the job in the Buildkite Agent API. This call will keep on retrying
@@ -532,7 +1013,7 @@ func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, failedChu
 		}
 
 		return err
-	}, &retry.Config{Forever: true, Interval: 1 * time.Second})
+	}, &retry.Config{Forever: true, Interval: 1 * time.Second, Multiplier: 2, MaxInterval: time.Minute, FullJitter: true})
 }
 
 func (r *JobRunner) onProcessStartCallback() {
@@ -603,7 +1084,7 @@ func (r *JobRunner) onUploadHeaderTime(cursor int, total int, times map[string]s
 	retry.Do(func(s *retry.Stats) error {
 		response, err := r.apiClient.HeaderTimes.Save(r.job.ID, &api.HeaderTimes{Times: times})
 		if err != nil {
-			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
+			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499 && response.StatusCode != 429) {
 				r.logger.Warn("Buildkite rejected the header times (%s)", err)
 				s.Break()
 			} else {
@@ -626,6 +1107,8 @@ func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
 	// from Buildkite that it's considered the chunk (a 4xx will be
 	// returned if the chunk is invalid, and we shouldn't retry on that)
 	return retry.Do(func(s *retry.Stats) error {
+		r.logger.Trace("Uploading chunk %d (%d bytes at offset %d, %s)", chunk.Order, chunk.Size, chunk.Offset, s)
+
 		response, err := r.apiClient.Chunks.Upload(r.job.ID, &api.Chunk{
 			Data:     chunk.Data,
 			Sequence: chunk.Order,
@@ -633,7 +1116,7 @@ func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
 			Size:     chunk.Size,
 		})
 		if err != nil {
-			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
+			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499 && response.StatusCode != 429) {
 				r.logger.Warn("Buildkite rejected the chunk upload (%s)", err)
 				s.Break()
 			} else {
@@ -642,5 +1125,5 @@ func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
 		}
 
 		return err
-	}, &retry.Config{Forever: true, Jitter: true, Interval: 5 * time.Second})
+	}, &retry.Config{Forever: true, Interval: 5 * time.Second, Multiplier: 2, MaxInterval: time.Minute, FullJitter: true})
 }
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadJobEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job-env-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"10-proxy.env":  "HTTP_PROXY=http://proxy.internal\nREGION=us-east-1\n[queue=deploy]\nHTTP_PROXY=http://deploy-proxy.internal\n",
+		"20-region.env": "REGION=eu-west-1\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &JobRunner{
+		logger: logger.Discard,
+		job:    &api.Job{Env: map[string]string{"BUILDKITE_AGENT_META_DATA_QUEUE": "deploy"}},
+		conf: JobRunnerConfig{
+			AgentConfiguration: AgentConfiguration{JobEnvFiles: []string{filepath.Join(dir, "*.env")}},
+		},
+	}
+
+	env, err := r.loadJobEnvFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"HTTP_PROXY": "http://deploy-proxy.internal",
+		"REGION":     "eu-west-1",
+	}, env.ToMap())
+}
+
+func TestCheckRequiredCapabilities(t *testing.T) {
+	r := &JobRunner{
+		logger: logger.Discard,
+		job:    &api.Job{Env: map[string]string{}},
+		conf: JobRunnerConfig{
+			AgentConfiguration: AgentConfiguration{Capabilities: []string{"cache-v2", "docker"}},
+		},
+	}
+
+	assert.NoError(t, r.checkRequiredCapabilities())
+
+	r.job.Env["BUILDKITE_REQUIRED_CAPABILITIES"] = "docker,cache-v2"
+	assert.NoError(t, r.checkRequiredCapabilities())
+
+	r.job.Env["BUILDKITE_REQUIRED_CAPABILITIES"] = "docker,kvm"
+	err := r.checkRequiredCapabilities()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "doesn't have kvm")
+	}
+}
+
+func TestTraceEnvContinuesJobTraceContext(t *testing.T) {
+	r := &JobRunner{
+		logger: logger.Discard,
+		job: &api.Job{TraceContext: map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"tracestate":  "vendor=llamas",
+			"baggage":     "userId=alice",
+		}},
+	}
+
+	env := r.traceEnv(map[string]string{
+		"BUILDKITE_BUILD_ID": "0b1a9a1c-5b8b-4f8e-9f0a-2d3c4b5a6978",
+		"BUILDKITE_JOB_ID":   "llamas",
+	})
+
+	assert.Regexp(t, `^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$`, env["TRACEPARENT"])
+	assert.NotContains(t, env["TRACEPARENT"], "00f067aa0ba902b7")
+	assert.Equal(t, "vendor=llamas", env["TRACESTATE"])
+	assert.Equal(t, "userId=alice,buildkite.build_id=0b1a9a1c-5b8b-4f8e-9f0a-2d3c4b5a6978,buildkite.job_id=llamas", env["BAGGAGE"])
+}
+
+func TestTraceEnvStartsBuildTraceWithoutContext(t *testing.T) {
+	r := &JobRunner{logger: logger.Discard, job: &api.Job{}}
+
+	env := r.traceEnv(map[string]string{
+		"BUILDKITE_BUILD_ID": "0b1a9a1c-5b8b-4f8e-9f0a-2d3c4b5a6978",
+		"TRACEPARENT":        "llamas",
+		"TRACESTATE":         "vendor=llamas",
+	})
+
+	assert.Regexp(t, `^00-0b1a9a1c5b8b4f8e9f0a2d3c4b5a6978-[0-9a-f]{16}-01$`, env["TRACEPARENT"])
+	assert.Equal(t, "", env["TRACESTATE"])
+	assert.Equal(t, "buildkite.build_id=0b1a9a1c-5b8b-4f8e-9f0a-2d3c4b5a6978", env["BAGGAGE"])
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/buildkite/agent/api"
+)
+
+// JobState is where a job is in its lifecycle on the agent
+type JobState string
+
+const (
+	// The job has been accepted, but not started in Buildkite yet
+	JobStateAccepted JobState = "accepted"
+
+	// The job has been started in Buildkite, and is being checked before
+	// anything is run
+	JobStateStarted JobState = "started"
+
+	// The bootstrap is running the job's phases (checkout, plugins, the
+	// command and so on)
+	JobStateRunning JobState = "running"
+
+	// The job is being canceled, and the bootstrap is being stopped if it's
+	// running
+	JobStateCanceling JobState = "canceling"
+
+	// The job's log is being uploaded and it's being finished in Buildkite
+	JobStateFinishing JobState = "finishing"
+
+	// The job has finished, or was never started because Buildkite wouldn't
+	// let it be
+	JobStateFinished JobState = "finished"
+
+	// The job has finished after being canceled
+	JobStateCanceled JobState = "canceled"
+)
+
+// jobStateTransitions are the states each state can move to. Finished and
+// canceled are final.
+var jobStateTransitions = map[JobState][]JobState{
+	JobStateAccepted:  {JobStateStarted, JobStateCanceling, JobStateFinished},
+	JobStateStarted:   {JobStateRunning, JobStateCanceling, JobStateFinishing},
+	JobStateRunning:   {JobStateCanceling, JobStateFinishing},
+	JobStateCanceling: {JobStateFinishing, JobStateCanceled},
+	JobStateFinishing: {JobStateFinished, JobStateCanceled},
+}
+
+// IsFinal returns whether the job can't move to any other state
+func (s JobState) IsFinal() bool {
+	return len(jobStateTransitions[s]) == 0
+}
+
+// CanTransitionTo returns whether a job can move from this state to another
+func (s JobState) CanTransitionTo(to JobState) bool {
+	for _, allowed := range jobStateTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// A JobTransitionHook is called whenever a job moves from one state to
+// another
+type JobTransitionHook func(job *api.Job, from, to JobState)
+
+// jobStateMachine tracks a job's state, so that the job runner and anything
+// else acting on the job (like cancelation) agree on what it's doing
+type jobStateMachine struct {
+	job   *api.Job
+	hooks []JobTransitionHook
+
+	mu       sync.Mutex
+	state    JobState
+	canceled bool
+
+	// Held while hooks are called, so that they see transitions one at a
+	// time and in order
+	hooksMu sync.Mutex
+}
+
+func newJobStateMachine(job *api.Job, hooks []JobTransitionHook) *jobStateMachine {
+	return &jobStateMachine{
+		job:   job,
+		hooks: hooks,
+		state: JobStateAccepted,
+	}
+}
+
+// State returns the job's current state
+func (m *jobStateMachine) State() JobState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.state
+}
+
+// Canceled returns whether the job has been canceled, even if it's moved on
+// from canceling since
+func (m *jobStateMachine) Canceled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.canceled
+}
+
+// Transition moves the job to another state and calls the hooks, or returns
+// an error if it can't move there from its current state. Hooks mustn't
+// transition the job themselves.
+func (m *jobStateMachine) Transition(to JobState) error {
+	_, err := m.transition(to)
+	return err
+}
+
+// transition is Transition, but also returns the state the job moved from
+func (m *jobStateMachine) transition(to JobState) (JobState, error) {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+
+	m.mu.Lock()
+	from := m.state
+	if !from.CanTransitionTo(to) {
+		m.mu.Unlock()
+		return from, fmt.Errorf("Job %s can't be %s, as it's %s", m.job.ID, to, from)
+	}
+	m.state = to
+	if to == JobStateCanceling {
+		m.canceled = true
+	}
+	m.mu.Unlock()
+
+	for _, hook := range m.hooks {
+		hook(m.job, from, to)
+	}
+
+	return from, nil
+}
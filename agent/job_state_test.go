@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+var allJobStates = []JobState{
+	JobStateAccepted,
+	JobStateStarted,
+	JobStateRunning,
+	JobStateCanceling,
+	JobStateFinishing,
+	JobStateFinished,
+	JobStateCanceled,
+}
+
+func TestJobStateTransitions(t *testing.T) {
+	allowed := map[[2]JobState]bool{
+		{JobStateAccepted, JobStateStarted}:    true,
+		{JobStateAccepted, JobStateCanceling}:  true,
+		{JobStateAccepted, JobStateFinished}:   true,
+		{JobStateStarted, JobStateRunning}:     true,
+		{JobStateStarted, JobStateCanceling}:   true,
+		{JobStateStarted, JobStateFinishing}:   true,
+		{JobStateRunning, JobStateCanceling}:   true,
+		{JobStateRunning, JobStateFinishing}:   true,
+		{JobStateCanceling, JobStateFinishing}: true,
+		{JobStateCanceling, JobStateCanceled}:  true,
+		{JobStateFinishing, JobStateFinished}:  true,
+		{JobStateFinishing, JobStateCanceled}:  true,
+	}
+
+	for _, from := range allJobStates {
+		for _, to := range allJobStates {
+			assert.Equal(t, allowed[[2]JobState{from, to}], from.CanTransitionTo(to), "%s to %s", from, to)
+		}
+	}
+
+	for _, s := range allJobStates {
+		assert.Equal(t, s == JobStateFinished || s == JobStateCanceled, s.IsFinal(), "%s", s)
+	}
+}
+
+func TestJobStateMachineCallsHooksInOrder(t *testing.T) {
+	var seen [][2]JobState
+	hook := func(job *api.Job, from, to JobState) {
+		assert.Equal(t, "llamas", job.ID)
+		seen = append(seen, [2]JobState{from, to})
+	}
+
+	m := newJobStateMachine(&api.Job{ID: "llamas"}, []JobTransitionHook{hook})
+	assert.Equal(t, JobStateAccepted, m.State())
+
+	for _, to := range []JobState{JobStateStarted, JobStateRunning, JobStateFinishing, JobStateFinished} {
+		assert.NoError(t, m.Transition(to))
+	}
+
+	assert.Equal(t, JobStateFinished, m.State())
+	assert.False(t, m.Canceled())
+	assert.Equal(t, [][2]JobState{
+		{JobStateAccepted, JobStateStarted},
+		{JobStateStarted, JobStateRunning},
+		{JobStateRunning, JobStateFinishing},
+		{JobStateFinishing, JobStateFinished},
+	}, seen)
+}
+
+func TestJobStateMachineRejectsInvalidTransitions(t *testing.T) {
+	var calls int
+	m := newJobStateMachine(&api.Job{ID: "llamas"}, []JobTransitionHook{
+		func(job *api.Job, from, to JobState) { calls++ },
+	})
+
+	err := m.Transition(JobStateRunning)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Job llamas can't be running, as it's accepted", err.Error())
+	}
+	assert.Equal(t, JobStateAccepted, m.State())
+	assert.Equal(t, 0, calls)
+}
+
+func TestJobStateMachineRemembersCancelation(t *testing.T) {
+	m := newJobStateMachine(&api.Job{ID: "llamas"}, nil)
+
+	for _, to := range []JobState{JobStateStarted, JobStateRunning, JobStateCanceling, JobStateFinishing} {
+		assert.NoError(t, m.Transition(to))
+	}
+
+	assert.True(t, m.Canceled())
+	assert.Error(t, m.Transition(JobStateCanceling))
+	assert.NoError(t, m.Transition(JobStateCanceled))
+}
+
+func TestJobStateMachineOnlyCancelsOnce(t *testing.T) {
+	var mu sync.Mutex
+	var cancels int
+
+	m := newJobStateMachine(&api.Job{ID: "llamas"}, []JobTransitionHook{
+		func(job *api.Job, from, to JobState) {
+			mu.Lock()
+			defer mu.Unlock()
+			if to == JobStateCanceling {
+				cancels++
+			}
+		},
+	})
+	assert.NoError(t, m.Transition(JobStateStarted))
+	assert.NoError(t, m.Transition(JobStateRunning))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Transition(JobStateCanceling)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, cancels)
+	assert.Equal(t, JobStateCanceling, m.State())
+}
+
+func TestJobRunnerCancelsWithoutStoppingTheBootstrapBeforeItRuns(t *testing.T) {
+	for _, from := range []JobState{JobStateAccepted, JobStateStarted} {
+		r := &JobRunner{
+			logger: logger.Discard,
+			job:    &api.Job{ID: "llamas"},
+			conf: JobRunnerConfig{
+				AgentConfiguration: AgentConfiguration{CancelGracePeriod: 60},
+			},
+		}
+		r.state = newJobStateMachine(r.job, nil)
+		r.process = process.New(logger.Discard, process.Config{Path: "true"})
+		if from == JobStateStarted {
+			assert.True(t, r.transition(JobStateStarted))
+		}
+
+		// The bootstrap hasn't been run, so this would wait for the whole
+		// grace period if it tried to interrupt it
+		done := make(chan error)
+		go func() { done <- r.Cancel() }()
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Canceling a %s job waited for the grace period", from)
+		}
+
+		assert.Equal(t, JobStateCanceling, r.State())
+
+		// A canceled job doesn't start running, but still finishes
+		assert.False(t, r.transition(JobStateStarted))
+		assert.False(t, r.transition(JobStateRunning))
+		assert.True(t, r.transition(JobStateFinishing))
+		assert.True(t, r.transition(JobStateCanceled))
+	}
+}
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"errors"
+	"io"
 	"math"
 	"sync"
 	"sync/atomic"
@@ -15,6 +16,9 @@ type LogStreamerConfig struct {
 
 	// The maximum size of chunks
 	MaxChunkSizeBytes int
+
+	// If set, everything that's streamed is also written to it, in order
+	Copy io.Writer
 }
 
 type LogStreamer struct {
@@ -101,6 +105,15 @@ func (ls *LogStreamer) Process(output string) error {
 		// Grab the part of the log that we haven't seen yet
 		blob := output[ls.bytes:bytes]
 
+		// A failure to write the copy isn't a failure to stream the log, so
+		// it's only logged, and the copy is given up on
+		if ls.conf.Copy != nil {
+			if _, err := io.WriteString(ls.conf.Copy, blob); err != nil {
+				ls.logger.Warn("[LogStreamer] Failed to write a copy of the log: %v", err)
+				ls.conf.Copy = nil
+			}
+		}
+
 		// How many chunks do we have that fit within the MaxChunkSizeBytes?
 		numberOfChunks := int(math.Ceil(float64(len(blob)) / float64(ls.conf.MaxChunkSizeBytes)))
 
@@ -0,0 +1,369 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/cron"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/utils"
+	"github.com/buildkite/shellwords"
+)
+
+// MaintenanceTaskDelimiter separates tasks in the maintenance-tasks config.
+// Cron expressions can contain commas, so they can't be used.
+const MaintenanceTaskDelimiter = ";"
+
+// MaintenanceTaskFunc performs a maintenance task with the given arguments
+type MaintenanceTaskFunc func(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error
+
+// MaintenanceTasks are the tasks that can be scheduled, by name
+var MaintenanceTasks = map[string]MaintenanceTaskFunc{
+	"workspace-gc":       workspaceGC,
+	"git-mirrors-update": gitMirrorsTask("remote", "update", "--prune"),
+	"git-mirrors-fsck":   gitMirrorsTask("fsck", "--no-progress"),
+	"docker-prune":       dockerPrune,
+	"artifact-cache-gc":  artifactCacheGC,
+	"command":            runMaintenanceCommand,
+}
+
+// A MaintenanceTask is a registered task that runs on a cron schedule
+type MaintenanceTask struct {
+	Spec     string
+	Name     string
+	Args     []string
+	Schedule *cron.Schedule
+}
+
+func (t MaintenanceTask) String() string {
+	return strings.Join(append([]string{t.Name}, t.Args...), " ")
+}
+
+// ParseMaintenanceTasks parses tasks like "0 3 * * * docker-prune", separated
+// by semicolons. Each is a cron expression (5 fields, or a shorthand like
+// @daily), the name of a task and any arguments for it.
+func ParseMaintenanceTasks(s string) ([]MaintenanceTask, error) {
+	var tasks []MaintenanceTask
+
+	for _, entry := range strings.Split(s, MaintenanceTaskDelimiter) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		words, err := shellwords.Split(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse maintenance task %q: %v", entry, err)
+		}
+
+		specFields := 5
+		if strings.HasPrefix(entry, "@") {
+			specFields = 1
+		}
+
+		if len(words) <= specFields {
+			return nil, fmt.Errorf("Maintenance task %q needs a schedule and a task name", entry)
+		}
+
+		task := MaintenanceTask{
+			Spec: strings.Join(words[:specFields], " "),
+			Name: words[specFields],
+			Args: words[specFields+1:],
+		}
+
+		if _, ok := MaintenanceTasks[task.Name]; !ok {
+			return nil, fmt.Errorf("Unknown maintenance task %q, expected one of: %s", task.Name, maintenanceTaskNames())
+		}
+
+		if task.Schedule, err = cron.Parse(task.Spec); err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+func maintenanceTaskNames() string {
+	var names []string
+	for name := range MaintenanceTasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// MaintenanceScheduler runs maintenance tasks on their schedules. Tasks only
+// run while the agents are idle: they're paused so they don't accept new
+// jobs, any running jobs are allowed to finish, and they're resumed once the
+// task is done.
+type MaintenanceScheduler struct {
+	logger logger.Logger
+	pool   *AgentPool
+	conf   AgentConfiguration
+	tasks  []MaintenanceTask
+
+	// How often to check whether running jobs have finished
+	idleCheckInterval time.Duration
+
+	// Serializes tasks with the same schedule
+	runMutex sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewMaintenanceScheduler returns a scheduler for the tasks
+func NewMaintenanceScheduler(l logger.Logger, pool *AgentPool, conf AgentConfiguration, tasks []MaintenanceTask) *MaintenanceScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &MaintenanceScheduler{
+		logger:            l,
+		pool:              pool,
+		conf:              conf,
+		tasks:             tasks,
+		idleCheckInterval: 5 * time.Second,
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+}
+
+// Start schedules each of the tasks in the background
+func (s *MaintenanceScheduler) Start() {
+	for _, task := range s.tasks {
+		s.logger.Info("[Maintenance] Scheduled %q for %q", task.String(), task.Spec)
+		go s.schedule(task)
+	}
+}
+
+// Stop stops scheduling tasks, and cancels any that are running
+func (s *MaintenanceScheduler) Stop() {
+	s.cancel()
+}
+
+func (s *MaintenanceScheduler) schedule(task MaintenanceTask) {
+	for {
+		next := task.Schedule.Next(time.Now())
+		if next.IsZero() {
+			s.logger.Warn("[Maintenance] %q will never run, as %q never matches", task.String(), task.Spec)
+			return
+		}
+
+		s.logger.Debug("[Maintenance] %q will next run at %s", task.String(), next)
+
+		select {
+		case <-time.After(time.Until(next)):
+			s.Run(task)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Run runs a task once all the agents are idle
+func (s *MaintenanceScheduler) Run(task MaintenanceTask) error {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+
+	// Stop accepting jobs, remembering which agents were paused already so
+	// that they're left that way
+	var paused []*AgentWorker
+	for _, worker := range s.pool.workers {
+		if !worker.Paused() {
+			worker.Pause()
+			paused = append(paused, worker)
+		}
+	}
+
+	defer func() {
+		for _, worker := range paused {
+			worker.Resume()
+		}
+	}()
+
+	if err := s.waitForIdle(); err != nil {
+		return err
+	}
+
+	s.logger.Info("[Maintenance] Running %q", task.String())
+	startedAt := time.Now()
+
+	err := MaintenanceTasks[task.Name](s.ctx, s.logger, s.conf, task.Args)
+	if err != nil {
+		s.logger.Error("[Maintenance] %q failed after %s: %v", task.String(), time.Since(startedAt), err)
+		return err
+	}
+
+	s.logger.Info("[Maintenance] Finished %q in %s", task.String(), time.Since(startedAt))
+	return nil
+}
+
+func (s *MaintenanceScheduler) waitForIdle() error {
+	logged := false
+
+	for {
+		busy := 0
+		for _, worker := range s.pool.workers {
+			if worker.Busy() {
+				busy++
+			}
+		}
+
+		if busy == 0 {
+			return nil
+		}
+
+		if !logged {
+			s.logger.Info("[Maintenance] Waiting for %d running job(s) to finish", busy)
+			logged = true
+		}
+
+		select {
+		case <-time.After(s.idleCheckInterval):
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// workspaceGC removes pipeline checkouts in the build path that haven't been
+// used for a while, 7 days unless a duration is given
+func workspaceGC(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error {
+	maxAge := 7 * 24 * time.Hour
+	if len(args) > 0 {
+		var err error
+		if maxAge, err = time.ParseDuration(args[0]); err != nil {
+			return fmt.Errorf("Invalid maximum age %q: %v", args[0], err)
+		}
+	}
+
+	if conf.BuildPath == "" {
+		return fmt.Errorf("No build path is configured")
+	}
+
+	// Checkouts are in {build-path}/{agent}/{org}/{pipeline}. Dot
+	// directories alongside them, like .workspace-snapshots, hold other
+	// things that are kept in the build path, and aren't checkouts.
+	checkouts, err := filepath.Glob(filepath.Join(conf.BuildPath, "[^.]*", "[^.]*", "[^.]*"))
+	if err != nil {
+		return err
+	}
+
+	for _, checkout := range checkouts {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		info, err := os.Stat(checkout)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		if activeWorkspaces.Active(checkout) {
+			l.Debug("[Maintenance] Skipping %s, which is in use by a job", checkout)
+			continue
+		}
+
+		lastUsed := activeWorkspaces.LastUsed(checkout, info)
+		if time.Since(lastUsed) < maxAge {
+			continue
+		}
+
+		l.Info("[Maintenance] Removing %s, last used %s ago", checkout, time.Since(lastUsed).Round(time.Minute))
+		if err := os.RemoveAll(checkout); err != nil {
+			return err
+		}
+		_ = os.Remove(workspaceMarkerPath(checkout))
+	}
+
+	return nil
+}
+
+// artifactCacheGC removes the least recently used artifacts from the
+// artifact cache until it's smaller than a size, 10GB unless one is given
+func artifactCacheGC(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error {
+	maxSize := int64(10 << 30)
+	if len(args) > 0 {
+		var err error
+		if maxSize, err = utils.ParseByteSize(args[0]); err != nil {
+			return fmt.Errorf("Invalid maximum size %q: %v", args[0], err)
+		}
+	}
+
+	if conf.ArtifactCacheDir == "" {
+		return fmt.Errorf("No artifact cache dir is configured")
+	}
+
+	return NewArtifactCache(l, conf.ArtifactCacheDir, maxSize).Evict(maxSize)
+}
+
+// gitMirrorsTask returns a task that runs a git command in each git mirror
+func gitMirrorsTask(gitArgs ...string) MaintenanceTaskFunc {
+	return func(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error {
+		if conf.GitMirrorsPath == "" {
+			return fmt.Errorf("No git mirrors path is configured")
+		}
+
+		mirrors, err := ioutil.ReadDir(conf.GitMirrorsPath)
+		if err != nil {
+			return err
+		}
+
+		var failed []string
+
+		for _, mirror := range mirrors {
+			if !mirror.IsDir() {
+				continue
+			}
+
+			dir := filepath.Join(conf.GitMirrorsPath, mirror.Name())
+			cmd := exec.CommandContext(ctx, "git", append(gitArgs, args...)...)
+			cmd.Dir = dir
+
+			l.Debug("[Maintenance] Running git %s in %s", strings.Join(cmd.Args[1:], " "), dir)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				l.Warn("[Maintenance] git %s failed in %s: %v\n%s", strings.Join(cmd.Args[1:], " "), dir, err, output)
+				failed = append(failed, mirror.Name())
+			}
+		}
+
+		if len(failed) > 0 {
+			return fmt.Errorf("Failed for mirrors: %s", strings.Join(failed, ", "))
+		}
+
+		return nil
+	}
+}
+
+// dockerPrune removes unused docker containers, networks, images and build
+// cache, passing on any arguments (such as --all or --filter)
+func dockerPrune(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error {
+	return runMaintenanceCommand(ctx, l, conf, append([]string{"docker", "system", "prune", "--force"}, args...))
+}
+
+// runMaintenanceCommand runs an arbitrary command, such as a script that
+// refreshes a tool cache
+func runMaintenanceCommand(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("No command to run")
+	}
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if len(output) > 0 {
+		l.Debug("[Maintenance] Output of %s:\n%s", args[0], output)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaintenanceTasks(t *testing.T) {
+	tasks, err := ParseMaintenanceTasks(`0,30 3 * * * docker-prune --all; @daily workspace-gc 72h;; */5 * * * * command "/usr/local/bin/refresh cache"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, tasks, 3) {
+		assert.Equal(t, "0,30 3 * * *", tasks[0].Spec)
+		assert.Equal(t, "docker-prune", tasks[0].Name)
+		assert.Equal(t, []string{"--all"}, tasks[0].Args)
+
+		assert.Equal(t, "@daily", tasks[1].Spec)
+		assert.Equal(t, "workspace-gc", tasks[1].Name)
+		assert.Equal(t, []string{"72h"}, tasks[1].Args)
+
+		assert.Equal(t, "command", tasks[2].Name)
+		assert.Equal(t, []string{"/usr/local/bin/refresh cache"}, tasks[2].Args)
+	}
+
+	for _, bad := range []string{"0 3 * * *", "0 3 * * * llamas", "61 * * * * docker-prune"} {
+		_, err := ParseMaintenanceTasks(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestMaintenanceSchedulerWaitsForIdleAgents(t *testing.T) {
+	var ranWhileBusy, ranWhileAcceptingJobs bool
+
+	busy := &AgentWorker{logger: logger.Discard, stop: make(chan struct{}), jobRunner: &JobRunner{}}
+	paused := &AgentWorker{logger: logger.Discard, stop: make(chan struct{})}
+	paused.Pause()
+
+	pool := NewAgentPool(logger.Discard, []*AgentWorker{busy, paused})
+
+	MaintenanceTasks["test"] = func(ctx context.Context, l logger.Logger, conf AgentConfiguration, args []string) error {
+		ranWhileBusy = busy.Busy()
+		ranWhileAcceptingJobs = !busy.Paused()
+		return nil
+	}
+	defer delete(MaintenanceTasks, "test")
+
+	tasks, err := ParseMaintenanceTasks("@hourly test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewMaintenanceScheduler(logger.Discard, pool, AgentConfiguration{}, tasks)
+	scheduler.idleCheckInterval = time.Millisecond
+	defer scheduler.Stop()
+
+	// Finish the running job a little later
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		busy.setJobRunner(nil)
+	}()
+
+	assert.NoError(t, scheduler.Run(tasks[0]))
+	assert.False(t, ranWhileBusy)
+	assert.False(t, ranWhileAcceptingJobs)
+
+	// Agents are resumed afterwards, unless they were already paused
+	assert.False(t, busy.Paused())
+	assert.True(t, paused.Paused())
+}
+
+func TestWorkspaceGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "agent-1", "my-org", "old-pipeline")
+	recent := filepath.Join(dir, "agent-1", "my-org", "recent-pipeline")
+	recentlyUsed := filepath.Join(dir, "agent-1", "my-org", "recently-used-pipeline")
+	running := filepath.Join(dir, "agent-1", "my-org", "running-pipeline")
+	snapshots := filepath.Join(dir, ".workspace-snapshots", "my-org", "old-pipeline")
+
+	for _, checkout := range []string{old, recent, recentlyUsed, running, snapshots} {
+		if err := os.MkdirAll(checkout, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A job that finished recently marks its checkout as used
+	activeWorkspaces.Start(logger.Discard, recentlyUsed)
+	activeWorkspaces.Finish(logger.Discard, recentlyUsed)
+
+	// A job is still using this one
+	activeWorkspaces.Start(logger.Discard, running)
+	defer activeWorkspaces.Finish(logger.Discard, running)
+
+	lastWeek := time.Now().Add(-8 * 24 * time.Hour)
+	for _, checkout := range []string{old, recentlyUsed, running, snapshots} {
+		if err := os.Chtimes(checkout, lastWeek, lastWeek); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(workspaceMarkerPath(running), lastWeek, lastWeek); err != nil {
+		t.Fatal(err)
+	}
+
+	err = workspaceGC(context.Background(), logger.Discard, AgentConfiguration{BuildPath: dir}, nil)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err))
+
+	for _, checkout := range []string{recent, recentlyUsed, running, snapshots} {
+		_, err = os.Stat(checkout)
+		assert.NoError(t, err, checkout)
+	}
+}
+
+func TestCheckoutPath(t *testing.T) {
+	env := map[string]string{
+		"BUILDKITE_ORGANIZATION_SLUG": "my-org",
+		"BUILDKITE_PIPELINE_SLUG":     "my-pipeline",
+	}
+
+	assert.Equal(t, filepath.Join("/builds", "my-agent-1", "my-org", "my-pipeline"), checkoutPath("/builds", "my agent.1", env))
+	assert.Equal(t, "", checkoutPath("", "my-agent-1", env))
+
+	env["BUILDKITE_BUILD_CHECKOUT_PATH"] = "/custom"
+	assert.Equal(t, "/custom", checkoutPath("/builds", "my-agent-1", env))
+}
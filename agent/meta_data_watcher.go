@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// How long the API is asked to hold each meta-data watch request open for
+const metaDataWatchWait = 50 * time.Second
+
+// How many requests in a row can fail before a watch gives up
+const metaDataWatchMaxFailures = 10
+
+type MetaDataWatcherConfig struct {
+	// The job whose build the meta-data belongs to
+	JobID string
+
+	// The meta-data key to watch
+	Key string
+
+	// How often to check for changes when the API doesn't hold requests
+	// open, and how long to wait after a failed request
+	Interval time.Duration
+}
+
+// MetaDataWatcher reports changes to a meta-data value. Endpoints that
+// support it hold each request open until the value changes, and others are
+// polled at the interval.
+type MetaDataWatcher struct {
+	// The config for watching
+	conf MetaDataWatcherConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// The APIClient that will be used to get the value
+	apiClient *api.Client
+}
+
+func NewMetaDataWatcher(l logger.Logger, ac *api.Client, c MetaDataWatcherConfig) *MetaDataWatcher {
+	return &MetaDataWatcher{
+		logger:    l,
+		apiClient: ac,
+		conf:      c,
+	}
+}
+
+// Watch calls onChange with the value once it's set, and again every time
+// it's changed, until onChange returns true or the context is done. A key
+// that hasn't been set yet is waited for.
+func (w *MetaDataWatcher) Watch(ctx context.Context, onChange func(value string) bool) error {
+	var previous *string
+	var failures int
+
+	for {
+		metaData, resp, err := w.apiClient.MetaData.Watch(ctx, w.conf.JobID, w.conf.Key, previous, metaDataWatchWait)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		switch {
+		case err == nil:
+			failures = 0
+
+			if previous == nil || *previous != metaData.Value {
+				value := metaData.Value
+				previous = &value
+
+				if onChange(value) {
+					return nil
+				}
+			}
+
+		case resp != nil && resp.StatusCode == 404:
+			// The key hasn't been set yet
+			failures = 0
+
+		case resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 400):
+			return err
+
+		default:
+			failures++
+			if failures >= metaDataWatchMaxFailures {
+				return err
+			}
+			w.logger.Warn("%s (%d/%d failures in a row)", err, failures, metaDataWatchMaxFailures)
+		}
+
+		// Check again straight away if the API held the request open,
+		// otherwise wait for the interval
+		if failures == 0 && resp != nil && resp.Header.Get(api.LongPollHeader) != "" {
+			continue
+		}
+
+		timer := time.NewTimer(w.conf.Interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
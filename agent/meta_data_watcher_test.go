@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaDataWatcherReportsChangesUntilDone(t *testing.T) {
+	// What the value is on each request, with "" meaning it isn't set yet
+	values := []string{"", "waiting", "waiting", "approved"}
+	var requests int
+	var previous []interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		previous = append(previous, body["previous_value"])
+
+		assert.Equal(t, "/jobs/llamas/data/get", req.URL.Path)
+		assert.Equal(t, "50", req.URL.Query().Get("wait"))
+		assert.Equal(t, "deploy", body["key"])
+
+		value := values[requests]
+		requests++
+
+		rw.Header().Set(api.LongPollHeader, "50")
+		rw.Header().Set("Content-Type", "application/json")
+		if value == "" {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"message":"Not found"}`))
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]string{"key": "deploy", "value": value})
+	}))
+	defer server.Close()
+
+	watcher := NewMetaDataWatcher(logger.Discard,
+		NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas"}),
+		MetaDataWatcherConfig{JobID: "llamas", Key: "deploy", Interval: time.Hour})
+
+	var changes []string
+	err := watcher.Watch(context.Background(), func(value string) bool {
+		changes = append(changes, value)
+		return value == "approved"
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"waiting", "approved"}, changes)
+	assert.Equal(t, []interface{}{nil, nil, "waiting", "waiting"}, previous)
+}
+
+func TestMetaDataWatcherPollsWhenNotLongPolled(t *testing.T) {
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"key":"deploy","value":"waiting"}`))
+	}))
+	defer server.Close()
+
+	watcher := NewMetaDataWatcher(logger.Discard,
+		NewAPIClient(logger.Discard, APIClientConfig{Endpoint: server.URL, Token: "llamas"}),
+		MetaDataWatcherConfig{JobID: "llamas", Key: "deploy", Interval: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var changes int
+	err := watcher.Watch(ctx, func(value string) bool {
+		changes++
+		return false
+	})
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, changes)
+
+	// Without long polling, requests are spaced out by the interval
+	assert.True(t, requests >= 2 && requests <= 6, "made %d requests", requests)
+}
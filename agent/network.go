@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// NetworkConfig controls how hosts are resolved and connected to, both for
+// the Agent API and for artifact transfers
+type NetworkConfig struct {
+	// DNS servers (either host or host:port) that are used instead of the
+	// system's
+	DNSServers []string
+
+	// How long to wait for each DNS query to be answered, or 0 for the
+	// resolver's default
+	DNSTimeout time.Duration
+
+	// Which IP version is tried first when a host has addresses for both,
+	// either ipv4 or ipv6, or empty for the order they're resolved in
+	PreferIP string
+
+	// How long to wait for a connection with the first IP version before
+	// also trying the other. If it's negative, the other version is only
+	// tried once the first has failed. 0 uses Go's default of 300ms.
+	HappyEyeballsDelay time.Duration
+}
+
+// The network configuration used by every client that this process creates
+var networkConfig NetworkConfig
+
+// SetNetworkConfig changes how the API and artifact clients created after it
+// resolve and connect to hosts
+func SetNetworkConfig(c NetworkConfig) error {
+	switch c.PreferIP {
+	case "", PreferIPv4, PreferIPv6:
+	default:
+		return fmt.Errorf("The preferred IP version must be either %s or %s, not %q", PreferIPv4, PreferIPv6, c.PreferIP)
+	}
+
+	var servers []string
+	for _, server := range c.DNSServers {
+		address := server
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		if host, _, _ := net.SplitHostPort(address); net.ParseIP(host) == nil {
+			return fmt.Errorf("DNS server %q must be an IP address", server)
+		}
+		servers = append(servers, address)
+	}
+	c.DNSServers = servers
+
+	networkConfig = c
+	return nil
+}
+
+// env returns the environment variables that give commands run by jobs the
+// same config
+func (c NetworkConfig) env() map[string]string {
+	env := map[string]string{}
+
+	if len(c.DNSServers) > 0 {
+		env["BUILDKITE_AGENT_DNS_SERVERS"] = strings.Join(c.DNSServers, ",")
+	}
+	if c.DNSTimeout != 0 {
+		env["BUILDKITE_AGENT_DNS_TIMEOUT"] = c.DNSTimeout.String()
+	}
+	if c.PreferIP != "" {
+		env["BUILDKITE_AGENT_PREFER_IP"] = c.PreferIP
+	}
+	if c.HappyEyeballsDelay != 0 {
+		env["BUILDKITE_AGENT_HAPPY_EYEBALLS_DELAY"] = c.HappyEyeballsDelay.String()
+	}
+
+	return env
+}
+
+// isDefault returns whether the config leaves everything to Go's defaults
+func (c NetworkConfig) isDefault() bool {
+	return len(c.DNSServers) == 0 && c.DNSTimeout == 0 && c.PreferIP == "" && c.HappyEyeballsDelay == 0
+}
+
+// resolver returns the resolver to use with the config, or nil for the
+// system's
+func (c NetworkConfig) resolver() *net.Resolver {
+	if len(c.DNSServers) == 0 && c.DNSTimeout == 0 {
+		return nil
+	}
+
+	var next uint32
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// Spread queries (including the resolver's retries) across
+			// the servers, so that one that's down doesn't fail every
+			// lookup
+			if len(c.DNSServers) > 0 {
+				address = c.DNSServers[int(atomic.AddUint32(&next, 1)-1)%len(c.DNSServers)]
+			}
+
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if c.DNSTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(c.DNSTimeout))
+			}
+			return conn, nil
+		},
+	}
+}
+
+// dialContext returns a dial function for http.Transport that resolves and
+// connects to hosts according to the config
+func (c NetworkConfig) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.isDefault() {
+		return dialer.DialContext
+	}
+
+	d := *dialer
+	d.Resolver = c.resolver()
+	if c.HappyEyeballsDelay != 0 {
+		d.FallbackDelay = c.HappyEyeballsDelay
+	}
+
+	if c.PreferIP == "" {
+		return d.DialContext
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network != "tcp" {
+			return d.DialContext(ctx, network, address)
+		}
+
+		primary, fallback := "tcp4", "tcp6"
+		if c.PreferIP == PreferIPv6 {
+			primary, fallback = "tcp6", "tcp4"
+		}
+
+		return dialPreferring(ctx, &d, primary, fallback, address)
+	}
+}
+
+// dialPreferring connects with the primary network, and after the dialer's
+// fallback delay (or once the primary fails, if it's negative) starts
+// connecting with the fallback network too. The first connection made wins.
+func dialPreferring(ctx context.Context, d *net.Dialer, primary, fallback, address string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	results := make(chan result, 2)
+	dial := func(network string) {
+		conn, err := d.DialContext(ctx, network, address)
+		results <- result{conn, err, network == primary}
+	}
+
+	go dial(primary)
+
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = 300 * time.Millisecond
+	}
+
+	var timer <-chan time.Time
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	var firstErr error
+	started, pending := false, 1
+
+	for pending > 0 {
+		select {
+		case <-timer:
+			if !started {
+				started, pending = true, pending+1
+				go dial(fallback)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connection that loses the race, if there is one
+				if pending > 0 {
+					go func() {
+						if other := <-results; other.conn != nil {
+							other.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil || r.primary {
+				firstErr = r.err
+			}
+			if !started {
+				started, pending = true, pending+1
+				go dial(fallback)
+			}
+		}
+	}
+
+	return nil, firstErr
+}
+
+// newHTTPTransport returns a transport for talking to the Agent API and
+// artifact storage, which uses the network config
+func newHTTPTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:              http.ProxyFromEnvironment,
+		DisableCompression: false,
+		DisableKeepAlives:  false,
+		DialContext: networkConfig.dialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 30 * time.Second,
+	}
+}
+
+// NewHTTPClient returns a client for fetching things from hosts other than
+// the Agent API, which uses the network config and gives up after timeout
+func NewHTTPClient(timeout time.Duration, disableHTTP2 bool) *http.Client {
+	transport := newHTTPTransport()
+	if disableHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// newArtifactHTTPClient returns the client that artifacts are transferred
+// with, which is Go's default one unless the network config changes anything
+func newArtifactHTTPClient() *http.Client {
+	if networkConfig.isDefault() {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: newHTTPTransport()}
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetNetworkConfig(t *testing.T) {
+	defer SetNetworkConfig(NetworkConfig{})
+
+	err := SetNetworkConfig(NetworkConfig{
+		DNSServers: []string{"10.0.0.2", "10.0.0.3:5353", "[fd00::1]:53"},
+		PreferIP:   PreferIPv4,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2:53", "10.0.0.3:5353", "[fd00::1]:53"}, networkConfig.DNSServers)
+
+	assert.Equal(t, map[string]string{
+		"BUILDKITE_AGENT_DNS_SERVERS": "10.0.0.2:53,10.0.0.3:5353,[fd00::1]:53",
+		"BUILDKITE_AGENT_PREFER_IP":   "ipv4",
+	}, networkConfig.env())
+
+	assert.Error(t, SetNetworkConfig(NetworkConfig{PreferIP: "ipv5"}))
+	assert.Error(t, SetNetworkConfig(NetworkConfig{DNSServers: []string{"dns.example.com"}}))
+}
+
+func TestNetworkConfigIsDefault(t *testing.T) {
+	assert.True(t, NetworkConfig{}.isDefault())
+	assert.Nil(t, NetworkConfig{PreferIP: PreferIPv6}.resolver())
+	assert.False(t, NetworkConfig{DNSTimeout: time.Second}.isDefault())
+	assert.NotNil(t, NetworkConfig{DNSTimeout: time.Second}.resolver())
+	assert.Empty(t, NetworkConfig{}.env())
+}
+
+func TestDialPreferringFallsBackWhenPreferredFails(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	// There's nothing listening over IPv6 (and no IPv6 address to connect to),
+	// so the connection should only be made after falling back to IPv4
+	d := &net.Dialer{Timeout: 5 * time.Second, FallbackDelay: -1}
+	conn, err := dialPreferring(context.Background(), d, "tcp6", "tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "tcp", conn.RemoteAddr().Network())
+	assert.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+}
+
+func TestDialPreferringFailsWhenBothFail(t *testing.T) {
+	d := &net.Dialer{Timeout: time.Second, FallbackDelay: -1}
+
+	// Nothing listens on port 1, so neither network can connect
+	_, err := dialPreferring(context.Background(), d, "tcp6", "tcp4", "127.0.0.1:1")
+	assert.Error(t, err)
+}
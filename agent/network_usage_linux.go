@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// networkBytes returns the bytes received and sent by every interface other
+// than loopback in the agent's network namespace
+func networkBytes() (received int64, sent int64, ok bool) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	received, sent, err = parseNetDev(f)
+	return received, sent, err == nil
+}
+
+// parseNetDev totals the counters in the format of /proc/net/dev, which has
+// two header lines and then a line per interface like:
+//
+//	eth0: 1234 5 0 0 0 0 0 0 5678 6 0 0 0 0 0 0
+func parseNetDev(r io.Reader) (received int64, sent int64, err error) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+
+		rx, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		tx, err := strconv.ParseInt(fields[8], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		received += rx
+		sent += tx
+	}
+
+	return received, sent, scanner.Err()
+}
@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetDev(t *testing.T) {
+	received, sent, err := parseNetDev(strings.NewReader(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 9999999     100    0    0    0     0          0         0  9999999     100    0    0    0     0       0          0
+  eth0: 1000      10    0    0    0     0          0         0     200      2    0    0    0     0       0          0
+docker0:   30       1    0    0    0     0          0         0      40      1    0    0    0     0       0          0
+`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1030), received)
+	assert.Equal(t, int64(240), sent)
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package agent
+
+// networkBytes is only available on Linux
+func networkBytes() (received int64, sent int64, ok bool) {
+	return 0, 0, false
+}
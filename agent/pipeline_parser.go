@@ -1,15 +1,17 @@
 package agent
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"strings"
 
 	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/interpolation"
 	"github.com/buildkite/agent/yamltojson"
-	"github.com/buildkite/interpolate"
 
 	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
 	yaml "github.com/buildkite/yaml"
@@ -20,6 +22,10 @@ type PipelineParser struct {
 	Filename        string
 	Pipeline        []byte
 	NoInterpolation bool
+
+	// Interpolate unset variables without defaults as nothing, rather than
+	// it being an error
+	AllowUndefinedVariables bool
 }
 
 func (p PipelineParser) Parse() (*PipelineParserResult, error) {
@@ -34,27 +40,23 @@ func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 		errPrefix = fmt.Sprintf("Failed to parse %s", p.Filename)
 	}
 
-	var pipelineAsSlice []topLevelStep
-	var pipeline yaml.MapSlice
-
-	// We support top-level arrays of steps, so try that first
-	if err := yaml.Unmarshal(p.Pipeline, &pipelineAsSlice); err == nil {
-		var steps []interface{}
+	pipeline, err := p.decode()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+	}
 
-		// Unwrap our custom topLevelStep types for marshaling later
-		for _, step := range pipelineAsSlice {
-			if step.MapSlice != nil {
-				steps = append(steps, step.MapSlice)
-			} else {
-				steps = append(steps, step.Body)
-			}
-		}
+	// A top-level minimum_agent_version is passed through to jobs in their
+	// env, so the job runner can check it before running anything
+	pipeline, err = applyMinimumAgentVersion(pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errPrefix, err)
+	}
 
-		pipeline = yaml.MapSlice{
-			{Key: "steps", Value: steps},
-		}
-	} else if err := yaml.Unmarshal(p.Pipeline, &pipeline); err != nil {
-		return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+	// Capabilities that steps require are passed through to their jobs in
+	// the same way, so that agents without them refuse the job early
+	pipeline, err = applyRequiredCapabilities(pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errPrefix, err)
 	}
 
 	if p.NoInterpolation {
@@ -83,6 +85,216 @@ func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 	return &PipelineParserResult{pipeline: interpolated.(yaml.MapSlice)}, nil
 }
 
+// decode decodes each of the YAML documents in the pipeline and merges them
+// into one, so that large pipelines can be split across documents. Later
+// documents' steps are added after the earlier ones', and their env and
+// other top-level attributes take precedence.
+func (p PipelineParser) decode() (yaml.MapSlice, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(p.Pipeline))
+
+	var pipeline yaml.MapSlice
+	for documents := 0; ; documents++ {
+		var document pipelineDocument
+		if err := decoder.Decode(&document); err == io.EOF {
+			return pipeline, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if documents == 0 {
+			pipeline = document.MapSlice
+			continue
+		}
+
+		var err error
+		if pipeline, err = mergePipelineDocument(pipeline, document.MapSlice); err != nil {
+			return nil, fmt.Errorf("document %d: %v", documents+1, err)
+		}
+	}
+}
+
+// mergePipelineDocument merges a document of a pipeline into the documents
+// before it
+func mergePipelineDocument(pipeline, document yaml.MapSlice) (yaml.MapSlice, error) {
+	for _, item := range document {
+		idx := -1
+		if key, ok := item.Key.(string); ok {
+			for i, existing := range pipeline {
+				if k, ok := existing.Key.(string); ok && k == key {
+					idx = i
+					break
+				}
+			}
+		}
+
+		if idx < 0 {
+			pipeline = append(pipeline, item)
+			continue
+		}
+
+		switch item.Key {
+		case "steps":
+			existing, ok := pipeline[idx].Value.([]interface{})
+			if !ok && pipeline[idx].Value != nil {
+				return nil, fmt.Errorf("Expected steps to be a list, got %T", pipeline[idx].Value)
+			}
+			steps, ok := item.Value.([]interface{})
+			if !ok && item.Value != nil {
+				return nil, fmt.Errorf("Expected steps to be a list, got %T", item.Value)
+			}
+			pipeline[idx].Value = append(existing, steps...)
+
+		case "env":
+			existing, ok := pipeline[idx].Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", pipeline[idx].Value)
+			}
+			env, ok := item.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item.Value)
+			}
+			merged, err := mergePipelineDocument(append(yaml.MapSlice{}, existing...), env)
+			if err != nil {
+				return nil, err
+			}
+			pipeline[idx].Value = merged
+
+		default:
+			pipeline[idx].Value = item.Value
+		}
+	}
+
+	return pipeline, nil
+}
+
+// applyMinimumAgentVersion moves a top-level minimum_agent_version into the
+// top-level env block as BUILDKITE_MINIMUM_AGENT_VERSION
+func applyMinimumAgentVersion(pipeline yaml.MapSlice) (yaml.MapSlice, error) {
+	item, ok := mapSliceItem("minimum_agent_version", pipeline)
+	if !ok {
+		return pipeline, nil
+	}
+
+	// Versions like 3.10 would be parsed as a float and lose their trailing
+	// zero, so only strings and whole numbers are accepted
+	var version string
+	switch v := item.Value.(type) {
+	case string:
+		version = v
+	case int:
+		version = fmt.Sprintf("%d", v)
+	default:
+		return nil, fmt.Errorf("Expected minimum_agent_version to be a string, got %v (try quoting it)", item.Value)
+	}
+
+	if _, err := parseVersion(version); err != nil {
+		return nil, fmt.Errorf("Invalid minimum_agent_version %q", version)
+	}
+
+	var result yaml.MapSlice
+	var hasEnv bool
+
+	for _, i := range pipeline {
+		switch i.Key {
+		case "minimum_agent_version":
+			continue
+		case "env":
+			envMap, ok := i.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", i.Value)
+			}
+			i.Value = append(envMap, yaml.MapItem{Key: "BUILDKITE_MINIMUM_AGENT_VERSION", Value: version})
+			hasEnv = true
+		}
+		result = append(result, i)
+	}
+
+	if !hasEnv {
+		result = append(yaml.MapSlice{{
+			Key:   "env",
+			Value: yaml.MapSlice{{Key: "BUILDKITE_MINIMUM_AGENT_VERSION", Value: version}},
+		}}, result...)
+	}
+
+	return result, nil
+}
+
+// applyRequiredCapabilities moves the capabilities of each step (including
+// those within groups) into the step's env block as
+// BUILDKITE_REQUIRED_CAPABILITIES, a comma-separated list
+func applyRequiredCapabilities(pipeline yaml.MapSlice) (yaml.MapSlice, error) {
+	for i, item := range pipeline {
+		if k, ok := item.Key.(string); !ok || k != "steps" {
+			continue
+		}
+
+		steps, ok := item.Value.([]interface{})
+		if !ok {
+			continue
+		}
+
+		for j, step := range steps {
+			stepMap, ok := step.(yaml.MapSlice)
+			if !ok {
+				continue
+			}
+
+			// Groups have steps of their own
+			stepMap, err := applyRequiredCapabilities(stepMap)
+			if err != nil {
+				return nil, err
+			}
+
+			if steps[j], err = applyStepCapabilities(stepMap); err != nil {
+				return nil, err
+			}
+		}
+
+		pipeline[i].Value = steps
+	}
+
+	return pipeline, nil
+}
+
+func applyStepCapabilities(step yaml.MapSlice) (yaml.MapSlice, error) {
+	item, ok := mapSliceItem("capabilities", step)
+	if !ok {
+		return step, nil
+	}
+
+	capabilities, err := parseCapabilities(item.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	var result yaml.MapSlice
+	var hasEnv bool
+
+	for _, i := range step {
+		switch i.Key {
+		case "capabilities":
+			continue
+		case "env":
+			envMap, ok := i.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("Expected step env block to be a map, got %T", i.Value)
+			}
+			i.Value = append(envMap, yaml.MapItem{Key: "BUILDKITE_REQUIRED_CAPABILITIES", Value: strings.Join(capabilities, ",")})
+			hasEnv = true
+		}
+		result = append(result, i)
+	}
+
+	if !hasEnv {
+		result = append(result, yaml.MapItem{
+			Key:   "env",
+			Value: yaml.MapSlice{{Key: "BUILDKITE_REQUIRED_CAPABILITIES", Value: strings.Join(capabilities, ",")}},
+		})
+	}
+
+	return result, nil
+}
+
 func mapSliceItem(key string, s yaml.MapSlice) (yaml.MapItem, bool) {
 	for _, item := range s {
 		if k, ok := item.Key.(string); ok && k == key {
@@ -92,6 +304,13 @@ func mapSliceItem(key string, s yaml.MapSlice) (yaml.MapItem, bool) {
 	return yaml.MapItem{}, false
 }
 
+func (p PipelineParser) interpolator() interpolation.Interpolator {
+	return interpolation.Interpolator{
+		Env:            p.Env,
+		AllowUndefined: p.AllowUndefinedVariables,
+	}
+}
+
 func (p PipelineParser) interpolateEnvBlock(envMap yaml.MapSlice) error {
 	for _, item := range envMap {
 		k, ok := item.Key.(string)
@@ -100,7 +319,7 @@ func (p PipelineParser) interpolateEnvBlock(envMap yaml.MapSlice) error {
 		}
 		switch tv := item.Value.(type) {
 		case string:
-			interpolated, err := interpolate.Interpolate(p.Env, tv)
+			interpolated, err := p.interpolator().Interpolate(tv)
 			if err != nil {
 				return err
 			}
@@ -220,7 +439,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 			// Also interpolate the key if it's a string
 			if key.Kind() == reflect.String {
-				interpolatedKey, err := interpolate.Interpolate(p.Env, key.Interface().(string))
+				interpolatedKey, err := p.interpolator().Interpolate(key.Interface().(string))
 				if err != nil {
 					return err
 				}
@@ -232,7 +451,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	// If it is a string interpolate it (yay finally we're doing what we came for)
 	case reflect.String:
-		interpolated, err := interpolate.Interpolate(p.Env, original.Interface().(string))
+		interpolated, err := p.interpolator().Interpolate(original.Interface().(string))
 		if err != nil {
 			return err
 		}
@@ -255,6 +474,40 @@ func (p *PipelineParserResult) MarshalJSON() ([]byte, error) {
 	return yamltojson.MarshalMapSliceJSON(p.pipeline)
 }
 
+func (p *PipelineParserResult) MarshalYAML() (interface{}, error) {
+	return p.pipeline, nil
+}
+
+// pipelineDocument is a document of a pipeline, which is either a map with
+// steps and other top-level attributes, or just an array of steps
+type pipelineDocument struct {
+	yaml.MapSlice
+}
+
+func (d *pipelineDocument) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// We support top-level arrays of steps, so try that first
+	var pipelineAsSlice []topLevelStep
+	if err := unmarshal(&pipelineAsSlice); err != nil {
+		return unmarshal(&d.MapSlice)
+	}
+
+	var steps []interface{}
+
+	// Unwrap our custom topLevelStep types for marshaling later
+	for _, step := range pipelineAsSlice {
+		if step.MapSlice != nil {
+			steps = append(steps, step.MapSlice)
+		} else {
+			steps = append(steps, step.Body)
+		}
+	}
+
+	d.MapSlice = yaml.MapSlice{
+		{Key: "steps", Value: steps},
+	}
+	return nil
+}
+
 // topLevelStep is a custom type to support "step or string" which works around
 // an issue where ordered parsing of yaml doesn't work with a top-level slice
 type topLevelStep struct {
@@ -10,6 +10,9 @@ import (
 
 	"github.com/buildkite/agent/env"
 	"github.com/stretchr/testify/assert"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
 )
 
 func TestPipelineParserParsesYaml(t *testing.T) {
@@ -287,3 +290,110 @@ steps:
 	expected := `{"steps":[{"name":":s3: xxx","command":"script/buildkite/xxx.sh","plugins":{"xxx/aws-assume-role#v0.1.0":{"role":"arn:aws:iam::xxx:role/xxx"},"ecr#v1.1.4":{"login":true,"account_ids":"xxx","registry_region":"us-east-1"},"docker-compose#v2.5.1":{"run":"xxx","config":".buildkite/docker/docker-compose.yml","env":["AWS_ACCESS_KEY_ID","AWS_SECRET_ACCESS_KEY","AWS_SESSION_TOKEN"]}},"agents":{"queue":"xxx"}}]}`
 	assert.Equal(t, expected, strings.TrimSpace(buf.String()))
 }
+
+func TestPipelineParserMovesMinimumAgentVersionIntoEnv(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("minimum_agent_version: 3.11.0\nenv:\n  FOO: bar\nsteps:\n  - command: echo hello"),
+	}.Parse()
+
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"env":{"FOO":"bar","BUILDKITE_MINIMUM_AGENT_VERSION":"3.11.0"},"steps":[{"command":"echo hello"}]}`, string(j))
+
+	result, err = PipelineParser{
+		Pipeline:        []byte("minimum_agent_version: \"3.10\"\nsteps:\n  - command: echo hello"),
+		NoInterpolation: true,
+	}.Parse()
+
+	assert.NoError(t, err)
+	j, err = json.Marshal(result)
+	assert.Equal(t, `{"env":{"BUILDKITE_MINIMUM_AGENT_VERSION":"3.10"},"steps":[{"command":"echo hello"}]}`, string(j))
+}
+
+func TestPipelineParserRejectsInvalidMinimumAgentVersion(t *testing.T) {
+	_, err := PipelineParser{
+		Pipeline: []byte("minimum_agent_version: latest\nsteps:\n  - command: echo hello"),
+	}.Parse()
+
+	assert.Error(t, err)
+
+	_, err = PipelineParser{
+		Pipeline: []byte("minimum_agent_version: 3.10\nsteps:\n  - command: echo hello"),
+	}.Parse()
+
+	assert.Error(t, err)
+}
+
+func TestPipelineParserMovesStepCapabilitiesIntoEnv(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo hello\n    capabilities: [docker, kvm]\n    env:\n      FOO: bar\n  - wait\n  - group: tests\n    steps:\n      - command: echo hi\n        capabilities: cache-v2"),
+	}.Parse()
+
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"steps":[{"command":"echo hello","env":{"FOO":"bar","BUILDKITE_REQUIRED_CAPABILITIES":"docker,kvm"}},"wait",{"group":"tests","steps":[{"command":"echo hi","env":{"BUILDKITE_REQUIRED_CAPABILITIES":"cache-v2"}}]}]}`, string(j))
+}
+
+func TestPipelineParserRejectsInvalidCapabilities(t *testing.T) {
+	_, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo hello\n    capabilities: [docker, {kvm: true}]"),
+	}.Parse()
+
+	assert.Error(t, err)
+
+	_, err = PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo hello\n    capabilities: \"docker,kvm\""),
+	}.Parse()
+
+	assert.Error(t, err)
+}
+
+func TestPipelineParserMarshalsYaml(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - label: \"hello ${ENV_VAR_FRIEND}\"\n    command: echo hello"),
+		Env:      env.FromSlice([]string{`ENV_VAR_FRIEND=friend`}),
+	}.Parse()
+
+	assert.NoError(t, err)
+	y, err := yaml.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n- label: hello friend\n  command: echo hello\n", string(y))
+}
+
+func TestPipelineParserMergesMultipleDocuments(t *testing.T) {
+	result, err := PipelineParser{
+		Pipeline:        []byte("env:\n  FOO: foo\n  BAR: bar\nsteps:\n  - command: echo one\n---\n- wait\n---\nenv:\n  BAR: baz\nsteps:\n  - command: echo two\nnotify:\n  - email: llamas@example.com\n"),
+		NoInterpolation: true,
+	}.Parse()
+
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"env":{"FOO":"foo","BAR":"baz"},"steps":[{"command":"echo one"},"wait",{"command":"echo two"}],"notify":[{"email":"llamas@example.com"}]}`, string(j))
+}
+
+func TestPipelineParserRejectsDocumentsWithInvalidSteps(t *testing.T) {
+	_, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo one\n---\nsteps: nope\n"),
+	}.Parse()
+
+	assert.Error(t, err)
+}
+
+func TestPipelineParserRejectsUndefinedVariables(t *testing.T) {
+	_, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo ${LLAMAS_ARE_UNDEFINED}"),
+		Env:      env.FromSlice(nil),
+	}.Parse()
+
+	assert.Error(t, err)
+
+	result, err := PipelineParser{
+		Pipeline:                []byte("steps:\n  - command: echo ${LLAMAS_ARE_UNDEFINED}$${ALPACAS}${LLAMAS_ARE_UNDEFINED:-llamas}"),
+		Env:                     env.FromSlice(nil),
+		AllowUndefinedVariables: true,
+	}.Parse()
+
+	assert.NoError(t, err)
+	j, err := json.Marshal(result)
+	assert.Equal(t, `{"steps":[{"command":"echo ${ALPACAS}llamas"}]}`, string(j))
+}
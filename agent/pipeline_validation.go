@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
+)
+
+// PipelineError is a problem with a pipeline, and where in it the problem
+// is. The column is 0 if it isn't known.
+type PipelineError struct {
+	Filename string
+	Line     int
+	Column   int
+	Message  string
+}
+
+func (e *PipelineError) Error() string {
+	filename := e.Filename
+	if filename == "" {
+		filename = "pipeline"
+	}
+
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", filename, e.Line, e.Column, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", filename, e.Line, e.Message)
+	default:
+		return fmt.Sprintf("%s: %s", filename, e.Message)
+	}
+}
+
+// Validate checks the pipeline against the step attributes that Buildkite
+// knows about and their types, before anything is interpolated, so that
+// problems can be found without uploading it. It returns every problem
+// found, in the order they appear in the pipeline. Buildkite has the final
+// say on whether a pipeline is valid, so this can't catch everything.
+func (p PipelineParser) Validate() []*PipelineError {
+	decoder := yaml.NewDecoder(bytes.NewReader(p.Pipeline))
+	decoder.SetStrict(true)
+
+	// Each document is checked, stopping at the first that isn't valid YAML
+	var messages []string
+	for {
+		var document pipelineDocumentSchema
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		} else if typeErr, ok := err.(*yaml.TypeError); ok {
+			messages = append(messages, typeErr.Errors...)
+		} else if err != nil {
+			messages = append(messages, strings.TrimPrefix(err.Error(), "yaml: "))
+			break
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	lines := strings.Split(string(p.Pipeline), "\n")
+
+	var problems []*PipelineError
+	for _, message := range messages {
+		if problem := newPipelineError(p.Filename, lines, message); problem != nil {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+var (
+	yamlLineRegex      = regexp.MustCompile(`^line (\d+): (.*)$`)
+	yamlFieldRegex     = regexp.MustCompile(`^field (.+) (not found|already set) in type `)
+	yamlUnmarshalRegex = regexp.MustCompile("^cannot unmarshal (!!\\w+)(?: `(.*)`)? into (.+)$")
+)
+
+var yamlTagDescriptions = map[string]string{
+	"!!str":   "a string",
+	"!!int":   "a number",
+	"!!float": "a number",
+	"!!bool":  "true or false",
+	"!!null":  "nothing",
+	"!!seq":   "a list",
+	"!!map":   "a map",
+}
+
+var schemaTypeDescriptions = map[string]string{
+	"int":                          "a whole number",
+	"string":                       "a string",
+	"map[string]interface {}":      "a map",
+	"[]agent.pipelineStepSchema":   "a list of steps",
+	"agent.pipelineStepSchema":     "a step",
+	"agent.pipelineStepAttributes": "a step",
+}
+
+// newPipelineError turns an error from the YAML decoder into a problem with
+// a line and column, finding the column from the name or value that the
+// error is about. Unknown attributes that are interpolated aren't problems,
+// so nil is returned for them.
+func newPipelineError(filename string, lines []string, message string) *PipelineError {
+	problem := &PipelineError{Filename: filename, Message: message}
+
+	var token string
+	if m := yamlLineRegex.FindStringSubmatch(message); m != nil {
+		problem.Line, _ = strconv.Atoi(m[1])
+		problem.Message = m[2]
+	}
+
+	if m := yamlFieldRegex.FindStringSubmatch(problem.Message); m != nil {
+		token = m[1]
+		if strings.Contains(token, "$") {
+			return nil
+		}
+		if m[2] == "not found" {
+			problem.Message = fmt.Sprintf("unknown attribute %q", token)
+		} else {
+			problem.Message = fmt.Sprintf("%q is set more than once", token)
+		}
+	} else if m := yamlUnmarshalRegex.FindStringSubmatch(problem.Message); m != nil {
+		got, ok := yamlTagDescriptions[m[1]]
+		if !ok {
+			got = m[1]
+		}
+		want, ok := schemaTypeDescriptions[m[3]]
+		if !ok {
+			want = m[3]
+		}
+
+		problem.Message = fmt.Sprintf("expected %s, got %s", want, got)
+		if m[2] != "" {
+			problem.Message += fmt.Sprintf(" (%s)", m[2])
+			token = strings.TrimSuffix(m[2], "...")
+		}
+	}
+
+	if token != "" && problem.Line > 0 && problem.Line <= len(lines) {
+		if idx := strings.Index(lines[problem.Line-1], token); idx >= 0 {
+			problem.Column = idx + 1
+		}
+	}
+
+	return problem
+}
+
+// pipelineDocumentSchema is a document of a pipeline, which like in Parse
+// can be a top-level array of steps
+type pipelineDocumentSchema struct{}
+
+func (d *pipelineDocumentSchema) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []interface{}
+	if err := unmarshal(&list); err == nil {
+		var steps []pipelineStepSchema
+		return unmarshal(&steps)
+	}
+
+	var pipeline pipelineSchema
+	return unmarshal(&pipeline)
+}
+
+// pipelineSchema is the shape of a pipeline, for validating it with strict
+// YAML decoding
+type pipelineSchema struct {
+	Env   map[string]interface{} `yaml:"env"`
+	Steps []pipelineStepSchema   `yaml:"steps"`
+
+	// Anything else at the top level, such as blocks of YAML anchors to
+	// reuse in steps, is left alone
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// pipelineStepSchema is a step, which is either a string like "wait" or a
+// map of attributes
+type pipelineStepSchema struct {
+	attributes pipelineStepAttributes
+}
+
+func (s *pipelineStepSchema) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		return nil
+	}
+	return unmarshal(&s.attributes)
+}
+
+// pipelineStepAttributes are the attributes of command, wait, block, input,
+// trigger and group steps
+type pipelineStepAttributes struct {
+	AllowDependencyFailure interface{}            `yaml:"allow_dependency_failure"`
+	Agents                 interface{}            `yaml:"agents"`
+	AllowedTeams           interface{}            `yaml:"allowed_teams"`
+	ArtifactPaths          interface{}            `yaml:"artifact_paths"`
+	Async                  interface{}            `yaml:"async"`
+	Block                  interface{}            `yaml:"block"`
+	BlockedState           interface{}            `yaml:"blocked_state"`
+	Branches               interface{}            `yaml:"branches"`
+	Build                  interface{}            `yaml:"build"`
+	CancelOnBuildFailing   interface{}            `yaml:"cancel_on_build_failing"`
+	Capabilities           interface{}            `yaml:"capabilities"`
+	Command                interface{}            `yaml:"command"`
+	Commands               interface{}            `yaml:"commands"`
+	Concurrency            pipelineInt            `yaml:"concurrency"`
+	ConcurrencyGroup       interface{}            `yaml:"concurrency_group"`
+	ConcurrencyMethod      interface{}            `yaml:"concurrency_method"`
+	ContinueOnFailure      interface{}            `yaml:"continue_on_failure"`
+	DependsOn              interface{}            `yaml:"depends_on"`
+	Env                    map[string]interface{} `yaml:"env"`
+	Fields                 interface{}            `yaml:"fields"`
+	Group                  interface{}            `yaml:"group"`
+	ID                     interface{}            `yaml:"id"`
+	Identifier             interface{}            `yaml:"identifier"`
+	If                     interface{}            `yaml:"if"`
+	Input                  interface{}            `yaml:"input"`
+	Key                    interface{}            `yaml:"key"`
+	Label                  interface{}            `yaml:"label"`
+	Matrix                 interface{}            `yaml:"matrix"`
+	Name                   interface{}            `yaml:"name"`
+	Notify                 interface{}            `yaml:"notify"`
+	Parallelism            pipelineInt            `yaml:"parallelism"`
+	Plugins                interface{}            `yaml:"plugins"`
+	Priority               pipelineInt            `yaml:"priority"`
+	Prompt                 interface{}            `yaml:"prompt"`
+	Retry                  interface{}            `yaml:"retry"`
+	Skip                   interface{}            `yaml:"skip"`
+	SoftFail               interface{}            `yaml:"soft_fail"`
+	Steps                  []pipelineStepSchema   `yaml:"steps"`
+	TimeoutInMinutes       pipelineInt            `yaml:"timeout_in_minutes"`
+	Trigger                interface{}            `yaml:"trigger"`
+	Type                   interface{}            `yaml:"type"`
+	Wait                   interface{}            `yaml:"wait"`
+	Waiter                 interface{}            `yaml:"waiter"`
+}
+
+// pipelineInt is a whole number, or a string that could interpolate to one
+type pipelineInt struct{}
+
+func (i *pipelineInt) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var n int
+	if err := unmarshal(&n); err == nil {
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err == nil && strings.Contains(s, "$") {
+		return nil
+	}
+
+	return unmarshal(&n)
+}
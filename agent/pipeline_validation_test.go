@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validatePipeline(pipeline string) []string {
+	var problems []string
+	for _, problem := range (PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(pipeline)}).Validate() {
+		problems = append(problems, problem.Error())
+	}
+	return problems
+}
+
+func TestPipelineValidationAcceptsValidPipelines(t *testing.T) {
+	for _, pipeline := range []string{
+		"steps:\n  - command: echo hello\n    timeout_in_minutes: 10\n  - wait\n  - block: Deploy?\n",
+		"- command: echo hello\n- wait\n",
+		"defaults: &defaults\n  agents:\n    queue: deploy\nsteps:\n  - <<: *defaults\n    command: echo hello\n",
+		"steps:\n  - command: echo hello\n    parallelism: $PARALLELISM\n",
+		"steps:\n  - group: tests\n    steps:\n      - command: echo hello\n",
+		`{"steps": [{"command": "echo hello"}]}`,
+	} {
+		assert.Empty(t, validatePipeline(pipeline), pipeline)
+	}
+}
+
+func TestPipelineValidationReportsLinesAndColumns(t *testing.T) {
+	assert.Equal(t, []string{
+		`pipeline.yml:2:5: unknown attribute "comand"`,
+		`pipeline.yml:5:25: expected a whole number, got a string (ten)`,
+		`pipeline.yml:9:9: unknown attribute "lable"`,
+	}, validatePipeline("steps:\n"+
+		"  - comand: echo hello\n"+
+		"  - wait\n"+
+		"  - command: echo hello\n"+
+		"    timeout_in_minutes: ten\n"+
+		"  - group: tests\n"+
+		"    steps:\n"+
+		"      - command: echo hello\n"+
+		"        lable: hello\n"))
+}
+
+func TestPipelineValidationReportsWrongTypes(t *testing.T) {
+	assert.Equal(t, []string{
+		`pipeline.yml:1: expected a map, got a list`,
+		`pipeline.yml:3: expected a list of steps, got a map`,
+	}, validatePipeline("env: [FOO]\nsteps:\n  command: echo hello\n"))
+}
+
+func TestPipelineValidationReportsTopLevelSteps(t *testing.T) {
+	assert.Equal(t, []string{
+		`pipeline.yml:2:3: unknown attribute "agnets"`,
+	}, validatePipeline("- command: echo hello\n  agnets:\n    queue: deploy\n"))
+}
+
+func TestPipelineValidationReportsSyntaxErrors(t *testing.T) {
+	assert.Equal(t, []string{
+		`pipeline.yml:2: did not find expected '-' indicator`,
+	}, validatePipeline("steps:\n  - command: echo hello\n   label: hello\n"))
+}
+
+func TestPipelineValidationChecksEveryDocument(t *testing.T) {
+	assert.Equal(t, []string{
+		`pipeline.yml:2:5: unknown attribute "comand"`,
+		`pipeline.yml:5:3: unknown attribute "lable"`,
+	}, validatePipeline("steps:\n  - comand: echo hello\n---\n- command: echo hello\n  lable: hello\n"))
+}
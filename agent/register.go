@@ -54,8 +54,10 @@ func Register(l logger.Logger, ac *api.Client, req api.AgentRegisterRequest) (*a
 		return err
 	}
 
-	// Try to register, retrying every 10 seconds for a maximum of 30 attempts (5 minutes)
-	err = retry.Do(register, &retry.Config{Maximum: 30, Interval: 10 * time.Second})
+	// Try to register for a maximum of 30 attempts, backing off from 10
+	// seconds to 2 minutes between them so that a fleet of agents coming back
+	// after an outage don't all register at once
+	err = retry.Do(register, &retry.Config{Maximum: 30, Interval: 10 * time.Second, Multiplier: 1.5, MaxInterval: 2 * time.Minute, FullJitter: true})
 	if err != nil {
 		l.Info("Successfully registered agent \"%s\" with tags [%s]", registered.Name,
 			strings.Join(registered.Tags, ", "))
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+	"github.com/buildkite/agent/utils"
+)
+
+// ResourceUsage is what a job used while it ran, to help size the hosts
+// that agents run on
+type ResourceUsage struct {
+	// The CPU time, peak memory and disk IO of the job's process tree
+	process.Usage
+
+	// How long the job ran for
+	Duration time.Duration
+
+	// The bytes received and sent by everything in the agent's network
+	// namespace (such as its container) while the job ran, if NetworkKnown
+	NetworkReceivedBytes int64
+	NetworkSentBytes     int64
+	NetworkKnown         bool
+}
+
+// resourceUsageRecorder measures the resources used between it being
+// started and finished
+type resourceUsageRecorder struct {
+	startedAt time.Time
+	received  int64
+	sent      int64
+	networkOK bool
+}
+
+func startResourceUsage() *resourceUsageRecorder {
+	r := &resourceUsageRecorder{startedAt: time.Now()}
+	r.received, r.sent, r.networkOK = networkBytes()
+	return r
+}
+
+// finish returns the resources used by the finished process
+func (r *resourceUsageRecorder) finish(p *process.Process) ResourceUsage {
+	u := ResourceUsage{
+		Usage:    p.Usage(),
+		Duration: time.Since(r.startedAt),
+	}
+
+	if received, sent, ok := networkBytes(); ok && r.networkOK {
+		u.NetworkReceivedBytes = received - r.received
+		u.NetworkSentBytes = sent - r.sent
+		u.NetworkKnown = true
+	}
+
+	return u
+}
+
+// CPUTime is the total user and system CPU time
+func (u ResourceUsage) CPUTime() time.Duration {
+	return u.UserTime + u.SystemTime
+}
+
+// fields returns the usage as log fields, leaving out what isn't known
+func (u ResourceUsage) fields() []logger.Field {
+	fields := []logger.Field{
+		logger.DurationField("duration", u.Duration),
+		logger.DurationField("cpu_user", u.UserTime),
+		logger.DurationField("cpu_system", u.SystemTime),
+	}
+	if u.MaxRSS > 0 {
+		fields = append(fields, logger.Int64Field("peak_rss_kb", u.MaxRSS))
+	}
+	if u.DiskIOKnown {
+		fields = append(fields,
+			logger.Int64Field("disk_read_bytes", u.DiskReadBytes),
+			logger.Int64Field("disk_write_bytes", u.DiskWriteBytes))
+	}
+	if u.NetworkKnown {
+		fields = append(fields,
+			logger.Int64Field("network_received_bytes", u.NetworkReceivedBytes),
+			logger.Int64Field("network_sent_bytes", u.NetworkSentBytes))
+	}
+	return fields
+}
+
+// markdown returns the usage as a table for an annotation
+func (u ResourceUsage) markdown(label string) string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "**Resource usage of %s**\n\n", label)
+	fmt.Fprintf(&b, "| Duration | CPU time | Average CPUs | Peak memory | Disk read / written | Network received / sent |\n")
+	fmt.Fprintf(&b, "| --- | --- | --- | --- | --- | --- |\n")
+
+	cpus := "-"
+	if u.Duration > 0 {
+		cpus = fmt.Sprintf("%.2f", float64(u.CPUTime())/float64(u.Duration))
+	}
+
+	memory := "-"
+	if u.MaxRSS > 0 {
+		memory = utils.FormatByteSize(u.MaxRSS * 1024)
+	}
+
+	disk := "-"
+	if u.DiskIOKnown {
+		disk = utils.FormatByteSize(u.DiskReadBytes) + " / " + utils.FormatByteSize(u.DiskWriteBytes)
+	}
+
+	network := "-"
+	if u.NetworkKnown {
+		network = utils.FormatByteSize(u.NetworkReceivedBytes) + " / " + utils.FormatByteSize(u.NetworkSentBytes)
+	}
+
+	fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n",
+		u.Duration.Round(time.Second), u.CPUTime().Round(time.Millisecond), cpus, memory, disk, network)
+
+	return b.String()
+}
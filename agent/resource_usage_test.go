@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceUsageMarkdown(t *testing.T) {
+	u := ResourceUsage{
+		Usage: process.Usage{
+			UserTime:       90 * time.Second,
+			SystemTime:     30 * time.Second,
+			MaxRSS:         512 * 1024,
+			DiskReadBytes:  1 << 20,
+			DiskWriteBytes: 2 << 30,
+			DiskIOKnown:    true,
+		},
+		Duration: time.Minute,
+	}
+
+	assert.Equal(t, "**Resource usage of :llama: Tests**\n\n"+
+		"| Duration | CPU time | Average CPUs | Peak memory | Disk read / written | Network received / sent |\n"+
+		"| --- | --- | --- | --- | --- | --- |\n"+
+		"| 1m0s | 2m0s | 2.00 | 512.0MB | 1.0MB / 2.0GB | - |\n", u.markdown(":llama: Tests"))
+
+	// Only what's known is logged
+	var keys []string
+	for _, f := range u.fields() {
+		keys = append(keys, f.Key())
+	}
+	assert.Equal(t, []string{"duration", "cpu_user", "cpu_system", "peak_rss_kb", "disk_read_bytes", "disk_write_bytes"}, keys)
+}
@@ -7,13 +7,48 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/buildkite/agent/logger"
 )
 
+func init() {
+	RegisterArtifactBackend("s3", s3Backend{})
+}
+
+// s3Backend stores artifacts in Amazon S3
+type s3Backend struct{}
+
+func (s3Backend) NewUploader(l logger.Logger, c ArtifactBackendUploadConfig) (Uploader, error) {
+	return NewS3Uploader(l, S3UploaderConfig{
+		Destination:    c.Destination,
+		DebugHTTP:      c.DebugHTTP,
+		AWSCredentials: c.AWSCredentials,
+		Options:        c.S3Options,
+	})
+}
+
+func (s3Backend) NewDownloader(l logger.Logger, c ArtifactBackendDownloadConfig) (Downloader, error) {
+	return NewS3Downloader(l, S3DownloaderConfig{
+		Path:            c.Path,
+		LocalPath:       c.LocalPath,
+		TempDir:         c.TempDir,
+		Fsync:           c.Fsync,
+		Bucket:          c.UploadDestination,
+		Destination:     c.Destination,
+		Retries:         c.Retries,
+		DebugHTTP:       c.DebugHTTP,
+		AWSCredentials:  c.AWSCredentials,
+		Progress:        c.Progress,
+		Bandwidth:       c.Bandwidth,
+		Sha1Sum:         c.Sha1Sum,
+		Sha256Sum:       c.Sha256Sum,
+		Writer:          c.Writer,
+		ContentEncoding: c.ContentEncoding,
+	}), nil
+}
+
 type credentialsProvider struct {
 	retrieved bool
 }
@@ -73,7 +108,7 @@ func awsS3RegionFromEnv() (region string, err error) {
 	return "", fmt.Errorf("Unknown AWS S3 Region %q", regionName)
 }
 
-func awsS3Session(region string) (*session.Session, error) {
+func awsS3Session(region string, conf AWSCredentialsConfig) (*session.Session, error) {
 	// Chicken and egg... but this is kinda how they do it in the sdk
 	sess, err := session.NewSession()
 	if err != nil {
@@ -81,25 +116,20 @@ func awsS3Session(region string) (*session.Session, error) {
 	}
 
 	sess.Config.Region = aws.String(region)
+	sess.Config.HTTPClient = newArtifactHTTPClient()
 
-	sess.Config.Credentials = credentials.NewChainCredentials(
-		[]credentials.Provider{
-			&credentialsProvider{},
-			&credentials.EnvProvider{},
-			// EC2 and ECS meta-data providers
-			defaults.RemoteCredProvider(*sess.Config, sess.Handlers),
-		})
+	sess.Config.Credentials = awsCredentials(sess, conf)
 
 	return sess, nil
 }
 
-func newS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
+func newS3Client(l logger.Logger, bucket string, conf AWSCredentialsConfig) (*s3.S3, error) {
 	region, err := awsS3RegionFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	sess, err := awsS3Session(region)
+	sess, err := awsS3Session(region, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -114,11 +144,30 @@ func newS3Client(l logger.Logger, bucket string) (*s3.S3, error) {
 		MaxKeys: aws.Int64(0),
 	})
 	if err != nil {
-		if err == credentials.ErrNoValidProvidersFoundInChain {
-			return nil, fmt.Errorf("Could not find a valid authentication strategy to connect to S3. Try setting BUILDKITE_S3_ACCESS_KEY and BUILDKITE_S3_SECRET_KEY")
+		if _, ok := err.(*credentialChainError); ok {
+			return nil, err
 		}
 		return nil, fmt.Errorf("Failed to authenticate to bucket `%s` in region `%s` (%s)", bucket, region, err.Error())
 	}
 
 	return s3client, nil
 }
+
+// newS3ReadClient returns an S3 client for reading objects from the bucket.
+// Unlike newS3Client it doesn't check the bucket can be listed, as roles that
+// can read artifacts from private buckets often only have s3:GetObject.
+func newS3ReadClient(l logger.Logger, bucket string, conf AWSCredentialsConfig) (*s3.S3, error) {
+	region, err := awsS3RegionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := awsS3Session(region, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Debug("Using S3 credentials for bucket `%s` in region `%s`", bucket, region)
+
+	return s3.New(sess), nil
+}
@@ -2,7 +2,7 @@ package agent
 
 import (
 	"fmt"
-	"net/http"
+	"io"
 	"strings"
 	"time"
 
@@ -22,11 +22,41 @@ type S3DownloaderConfig struct {
 	// also it's location in the bucket
 	Path string
 
+	// An optional path to save the file as instead of Path, relative to the
+	// download folder
+	LocalPath string
+
+	// Where to write the file while it's downloading, defaults to the folder
+	// it's being downloaded to
+	TempDir string
+
+	// Whether to fsync the file before moving it into place
+	Fsync bool
+
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// Where to record how the download is going, if anywhere
+	Progress *TransferProgress
+
+	// Limits how fast the download is read, if it's limited
+	Bandwidth *BandwidthLimiter
+
+	// The checksums the downloaded file must have, if they're known
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Where to write the file instead of saving it, if anywhere
+	Writer io.Writer
+
+	// How the file was compressed when it was uploaded, if it was
+	ContentEncoding string
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// Extra configuration for finding AWS credentials
+	AWSCredentials AWSCredentialsConfig
 }
 
 type S3Downloader struct {
@@ -45,8 +75,8 @@ func NewS3Downloader(l logger.Logger, c S3DownloaderConfig) *S3Downloader {
 }
 
 func (d S3Downloader) Start() error {
-	// Initialize the s3 client, and authenticate it
-	s3Client, err := newS3Client(d.logger, d.BucketName())
+	// Initialize the s3 client, which is only used to sign the URL
+	s3Client, err := newS3ReadClient(d.logger, d.BucketName(), d.conf.AWSCredentials)
 	if err != nil {
 		return err
 	}
@@ -62,12 +92,21 @@ func (d S3Downloader) Start() error {
 	}
 
 	// We can now cheat and pass the URL onto our regular downloader
-	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
-		URL:         signedURL,
-		Path:        d.conf.Path,
-		Destination: d.conf.Destination,
-		Retries:     d.conf.Retries,
-		DebugHTTP:   d.conf.DebugHTTP,
+	return NewDownload(d.logger, newArtifactHTTPClient(), DownloadConfig{
+		URL:             signedURL,
+		Path:            d.conf.Path,
+		LocalPath:       d.conf.LocalPath,
+		TempDir:         d.conf.TempDir,
+		Fsync:           d.conf.Fsync,
+		Destination:     d.conf.Destination,
+		Retries:         d.conf.Retries,
+		DebugHTTP:       d.conf.DebugHTTP,
+		Progress:        d.conf.Progress,
+		Bandwidth:       d.conf.Bandwidth,
+		Sha1Sum:         d.conf.Sha1Sum,
+		Sha256Sum:       d.conf.Sha256Sum,
+		Writer:          d.conf.Writer,
+		ContentEncoding: d.conf.ContentEncoding,
 	}).Start()
 }
 
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"strings"
@@ -20,6 +21,74 @@ type S3UploaderConfig struct {
 
 	// Whether or not HTTP calls should be debugged
 	DebugHTTP bool
+
+	// Extra configuration for finding AWS credentials
+	AWSCredentials AWSCredentialsConfig
+
+	// How the artifacts are stored
+	Options S3UploadOptions
+}
+
+// S3UploadOptions are how artifacts are stored in S3
+type S3UploadOptions struct {
+	// The canned ACL, such as private or bucket-owner-full-control. If it's
+	// not set, $BUILDKITE_S3_ACL or $AWS_S3_ACL is used, or public-read.
+	ACL string
+
+	// The server-side encryption, either AES256 (SSE-S3) or aws:kms (SSE-KMS),
+	// or none to use the bucket's default
+	ServerSideEncryption string
+
+	// The KMS key to encrypt with, which implies aws:kms
+	SSEKMSKeyID string
+
+	// The storage class, such as STANDARD_IA, or none for STANDARD
+	StorageClass string
+}
+
+var s3ACLs = []string{
+	"private",
+	"public-read",
+	"public-read-write",
+	"authenticated-read",
+	"bucket-owner-read",
+	"bucket-owner-full-control",
+}
+
+var s3StorageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
+// Validate returns an error if any of the options aren't ones S3 supports
+func (o S3UploadOptions) Validate() error {
+	if o.ACL != "" && !containsString(s3ACLs, o.ACL) {
+		return fmt.Errorf("Invalid S3 ACL `%s`", o.ACL)
+	}
+
+	switch o.ServerSideEncryption {
+	case "":
+	case s3.ServerSideEncryptionAes256:
+		if o.SSEKMSKeyID != "" {
+			return fmt.Errorf("A KMS key ID can only be used with %s server-side encryption", s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("Invalid S3 server-side encryption `%s`, must be either %s or %s",
+			o.ServerSideEncryption, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+
+	if o.StorageClass != "" && !containsString(s3StorageClasses, o.StorageClass) {
+		return fmt.Errorf("Invalid S3 storage class `%s`, must be one of %s", o.StorageClass, strings.Join(s3StorageClasses, ", "))
+	}
+
+	return nil
 }
 
 type S3Uploader struct {
@@ -40,10 +109,14 @@ type S3Uploader struct {
 }
 
 func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
+	if err := c.Options.Validate(); err != nil {
+		return nil, err
+	}
+
 	bucketName, bucketPath := ParseS3Destination(c.Destination)
 
 	// Initialize the s3 client, and authenticate it
-	s3Client, err := newS3Client(l, bucketName)
+	s3Client, err := newS3Client(l, bucketName, c.AWSCredentials)
 	if err != nil {
 		return nil, err
 	}
@@ -79,44 +152,80 @@ func (u *S3Uploader) URL(artifact *api.Artifact) string {
 }
 
 func (u *S3Uploader) Upload(artifact *api.Artifact) error {
-	permission := "public-read"
-	if os.Getenv("BUILDKITE_S3_ACL") != "" {
-		permission = os.Getenv("BUILDKITE_S3_ACL")
-	} else if os.Getenv("AWS_S3_ACL") != "" {
-		permission = os.Getenv("AWS_S3_ACL")
+	// Open file from filesystem
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
 
-	// The dirtiest validation method ever...
-	if permission != "private" &&
-		permission != "public-read" &&
-		permission != "public-read-write" &&
-		permission != "authenticated-read" &&
-		permission != "bucket-owner-read" &&
-		permission != "bucket-owner-full-control" {
-		return fmt.Errorf("Invalid S3 ACL `%s`", permission)
+	return u.UploadStream(artifact, f)
+}
+
+// UploadStream uploads the artifact's contents from r. S3 multipart uploads
+// don't need to know the length up front, so r can be a pipe.
+func (u *S3Uploader) UploadStream(artifact *api.Artifact, r io.Reader) error {
+	input, err := u.uploadInput(artifact, r)
+	if err != nil {
+		return err
 	}
 
 	// Create an uploader with the session and default options
 	uploader := s3manager.NewUploaderWithClient(u.client)
 
-	// Open file from filesystem
-	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
-	f, err := os.Open(artifact.AbsolutePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	// Upload the file to S3.
+	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), *input.ACL)
+	_, err = uploader.Upload(input)
+
+	return err
+}
+
+// uploadInput returns the request to upload the artifact's contents from r
+func (u *S3Uploader) uploadInput(artifact *api.Artifact, r io.Reader) (*s3manager.UploadInput, error) {
+	opts := u.conf.Options
+
+	if opts.ACL == "" {
+		opts.ACL = "public-read"
+		if os.Getenv("BUILDKITE_S3_ACL") != "" {
+			opts.ACL = os.Getenv("BUILDKITE_S3_ACL")
+		} else if os.Getenv("AWS_S3_ACL") != "" {
+			opts.ACL = os.Getenv("AWS_S3_ACL")
+		}
 	}
 
-	// Upload the file to S3.
-	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	if opts.SSEKMSKeyID != "" && opts.ServerSideEncryption == "" {
+		opts.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	input := &s3manager.UploadInput{
 		Bucket:      aws.String(u.BucketName),
 		Key:         aws.String(u.artifactPath(artifact)),
 		ContentType: aws.String(artifact.ContentType),
-		ACL:         aws.String(permission),
-		Body:        f,
-	})
+		ACL:         aws.String(opts.ACL),
+		Body:        r,
+	}
 
-	return err
+	if opts.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(opts.ServerSideEncryption)
+	}
+	if opts.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(opts.SSEKMSKeyID)
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = aws.String(opts.StorageClass)
+	}
+
+	// Store any metadata as object tags
+	if len(artifact.Metadata) > 0 {
+		input.Tagging = aws.String(s3Tagging(artifact.Metadata))
+	}
+
+	return input, nil
 }
 
 func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
@@ -1,7 +1,11 @@
 package agent
 
 import (
+	"os"
 	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseS3DestinationBucketPath(t *testing.T) {
@@ -31,3 +35,61 @@ func TestParseS3DestinationBucketName(t *testing.T) {
 		}
 	}
 }
+
+func TestS3UploadOptionsValidate(t *testing.T) {
+	for _, opts := range []S3UploadOptions{
+		{},
+		{ACL: "bucket-owner-full-control", ServerSideEncryption: "AES256", StorageClass: "STANDARD_IA"},
+		{ServerSideEncryption: "aws:kms", SSEKMSKeyID: "alias/artifacts"},
+		{SSEKMSKeyID: "alias/artifacts"},
+	} {
+		assert.NoError(t, opts.Validate(), "%#v", opts)
+	}
+
+	for _, opts := range []S3UploadOptions{
+		{ACL: "llamas"},
+		{ServerSideEncryption: "aes256"},
+		{ServerSideEncryption: "AES256", SSEKMSKeyID: "alias/artifacts"},
+		{StorageClass: "standard"},
+	} {
+		assert.Error(t, opts.Validate(), "%#v", opts)
+	}
+}
+
+func TestS3UploaderUploadInput(t *testing.T) {
+	os.Unsetenv("BUILDKITE_S3_ACL")
+	os.Unsetenv("AWS_S3_ACL")
+
+	artifact := &api.Artifact{Path: "llamas.txt", ContentType: "text/plain"}
+
+	u := &S3Uploader{BucketName: "my-bucket", BucketPath: "builds", conf: S3UploaderConfig{
+		Options: S3UploadOptions{SSEKMSKeyID: "alias/artifacts", StorageClass: "STANDARD_IA"},
+	}}
+
+	input, err := u.uploadInput(artifact, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "builds/llamas.txt", *input.Key)
+	assert.Equal(t, "public-read", *input.ACL)
+	assert.Equal(t, "aws:kms", *input.ServerSideEncryption)
+	assert.Equal(t, "alias/artifacts", *input.SSEKMSKeyId)
+	assert.Equal(t, "STANDARD_IA", *input.StorageClass)
+
+	// Without options, the bucket's defaults are used
+	u.conf.Options = S3UploadOptions{ACL: "private"}
+
+	input, err = u.uploadInput(artifact, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "private", *input.ACL)
+	assert.Nil(t, input.ServerSideEncryption)
+	assert.Nil(t, input.SSEKMSKeyId)
+	assert.Nil(t, input.StorageClass)
+
+	// The ACL can still come from the environment
+	os.Setenv("AWS_S3_ACL", "bucket-owner-read")
+	defer os.Unsetenv("AWS_S3_ACL")
+	u.conf.Options = S3UploadOptions{}
+
+	input, err = u.uploadInput(artifact, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "bucket-owner-read", *input.ACL)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/logger"
@@ -19,6 +20,8 @@ type FetchTagsConfig struct {
 	TagsFromGCP             bool
 	TagsFromGCPLabels       bool
 	TagsFromHost            bool
+	TagsFromEnvFingerprint  bool
+	EnvFingerprintScript    string
 	WaitForEC2TagsTimeout   time.Duration
 	WaitForGCPLabelsTimeout time.Duration
 }
@@ -38,6 +41,9 @@ func FetchTags(l logger.Logger, conf FetchTagsConfig) []string {
 		gcpLabels: func() (map[string]string, error) {
 			return GCPLabels{}.Get()
 		},
+		envFingerprint: func() (string, error) {
+			return EnvFingerprint{ProbeScript: conf.EnvFingerprintScript}.Get()
+		},
 	}
 	return f.Fetch(l, conf)
 }
@@ -47,11 +53,25 @@ type tagFetcher struct {
 	ec2Tags     func() (map[string]string, error)
 	gcpMetadata func() (map[string]string, error)
 	gcpLabels   func() (map[string]string, error)
+
+	envFingerprint func() (string, error)
 }
 
 func (t *tagFetcher) Fetch(l logger.Logger, conf FetchTagsConfig) []string {
 	tags := conf.Tags
 
+	// Add a fingerprint of the toolchains on the host
+	if conf.TagsFromEnvFingerprint {
+		fingerprint, err := t.envFingerprint()
+		if err != nil {
+			// Don't blow up if we can't compute it, just show a nasty error.
+			l.Error("Failed to compute environment fingerprint: %s", err)
+		} else {
+			l.Info("Environment fingerprint is %s", fingerprint)
+			tags = append(tags, fmt.Sprintf("%s=%s", envFingerprintTag, fingerprint))
+		}
+	}
+
 	// Load tags from host
 	if conf.TagsFromHost {
 		hostname, err := os.Hostname()
@@ -166,3 +186,21 @@ func (t *tagFetcher) Fetch(l logger.Logger, conf FetchTagsConfig) []string {
 
 	return tags
 }
+
+// MissingTags returns the required tag keys that aren't in tags. Tags are
+// either a key and value ("queue=deploy") or just a key ("linux").
+func MissingTags(tags []string, required []string) []string {
+	keys := map[string]bool{}
+	for _, tag := range tags {
+		keys[strings.TrimSpace(strings.SplitN(tag, "=", 2)[0])] = true
+	}
+
+	var missing []string
+	for _, key := range required {
+		if !keys[key] {
+			missing = append(missing, key)
+		}
+	}
+
+	return missing
+}
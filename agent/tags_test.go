@@ -89,3 +89,31 @@ func TestFetchingTagsFromGCP(t *testing.T) {
 		t.Fatalf("bad tags: %#v", tags)
 	}
 }
+
+func TestFetchingTagsWithEnvFingerprint(t *testing.T) {
+	fetcher := &tagFetcher{
+		envFingerprint: func() (string, error) {
+			return "abc123def456", nil
+		},
+	}
+
+	tags := fetcher.Fetch(logger.Discard, FetchTagsConfig{
+		Tags:                   []string{"llamas"},
+		TagsFromEnvFingerprint: true,
+	})
+
+	assert.Equal(t, []string{"llamas", "env_fingerprint=abc123def456"}, tags)
+}
+
+func TestMissingTags(t *testing.T) {
+	tags := []string{"queue=deploy", "linux", "aws:instance-type=t2.small"}
+
+	if missing := MissingTags(tags, []string{"queue", "linux", "aws:instance-type"}); len(missing) != 0 {
+		t.Fatalf("bad missing tags: %#v", missing)
+	}
+
+	missing := MissingTags(tags, []string{"queue", "docker", "aws:instance-id"})
+	if !reflect.DeepEqual(missing, []string{"docker", "aws:instance-id"}) {
+		t.Fatalf("bad missing tags: %#v", missing)
+	}
+}
@@ -0,0 +1,336 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// Transfers that haven't been reported on for this long are assumed to
+// belong to a process that died without finishing them
+var transferStaleAfter = time.Minute
+
+// How often the progress of a process's transfers is reported
+var transferReportInterval = time.Second
+
+// Transfer is the progress of an artifact upload or download
+type Transfer struct {
+	ID        string `json:"id"`
+	JobID     string `json:"job_id,omitempty"`
+	Direction string `json:"direction"`
+	File      string `json:"file"`
+
+	// The size of the file in bytes, or -1 if it isn't known
+	Size int64 `json:"size"`
+
+	// How many bytes have been sent or received in the current attempt,
+	// and how fast in bytes per second
+	Bytes int64   `json:"bytes"`
+	Rate  float64 `json:"rate"`
+
+	Retries   int       `json:"retries"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Set when the transfer is reported for the last time
+	Done bool `json:"done,omitempty"`
+}
+
+// TransferRegistry keeps the progress of the artifact transfers of the jobs
+// running on this host, which are reported to it by the artifact commands
+// over the admin socket
+type TransferRegistry struct {
+	mu        sync.Mutex
+	transfers map[string]Transfer
+}
+
+func NewTransferRegistry() *TransferRegistry {
+	return &TransferRegistry{transfers: map[string]Transfer{}}
+}
+
+// Update records the progress of transfers, forgetting any that are done
+func (r *TransferRegistry) Update(transfers ...Transfer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, t := range transfers {
+		if t.Done {
+			delete(r.transfers, t.ID)
+		} else {
+			r.transfers[t.ID] = t
+		}
+	}
+}
+
+// List returns the transfers in progress, oldest first
+func (r *TransferRegistry) List() []Transfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	transfers := []Transfer{}
+	for id, t := range r.transfers {
+		if time.Since(t.UpdatedAt) > transferStaleAfter {
+			delete(r.transfers, id)
+			continue
+		}
+		transfers = append(transfers, t)
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].StartedAt.Before(transfers[j].StartedAt)
+	})
+
+	return transfers
+}
+
+// Handler returns a http handler that lists the transfers in progress, and
+// that transfer progress can be posted to as a JSON list
+func (r *TransferRegistry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, r.List())
+		case "POST":
+			var transfers []Transfer
+			if err := json.NewDecoder(req.Body).Decode(&transfers); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			r.Update(transfers...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Use GET or POST"})
+		}
+	})
+}
+
+// TransferProgress tracks a single transfer. All of its methods can be
+// called on a nil TransferProgress, which tracks nothing.
+type TransferProgress struct {
+	bytes int64
+
+	mu           sync.Mutex
+	transfer     Transfer
+	attemptStart time.Time
+}
+
+// Add records n more bytes as transferred
+func (p *TransferProgress) Add(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, int64(n))
+	}
+}
+
+// Retry records that the transfer is starting again from the beginning
+func (p *TransferProgress) Retry() {
+	p.Resume(0)
+}
+
+// Resume records that the transfer is starting again from offset, because
+// the bytes before it were transferred by an earlier attempt
+func (p *TransferProgress) Resume(offset int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	atomic.StoreInt64(&p.bytes, offset)
+	p.transfer.Retries++
+	p.attemptStart = time.Now()
+}
+
+// Reader returns a reader that records the bytes read from r
+func (p *TransferProgress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r, p}
+}
+
+func (p *TransferProgress) snapshot() Transfer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t := p.transfer
+	t.Bytes = atomic.LoadInt64(&p.bytes)
+	t.UpdatedAt = time.Now()
+
+	if elapsed := t.UpdatedAt.Sub(p.attemptStart).Seconds(); elapsed > 0 {
+		t.Rate = float64(t.Bytes) / elapsed
+	}
+
+	return t
+}
+
+type progressReader struct {
+	io.Reader
+	progress *TransferProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.progress.Add(n)
+	return n, err
+}
+
+// TransferReporter reports the progress of the artifact transfers of this
+// process to an agent's admin socket. All of its methods can be called on a
+// nil TransferReporter, which reports nothing.
+type TransferReporter struct {
+	logger logger.Logger
+	client *http.Client
+	url    string
+	jobID  string
+
+	mu        sync.Mutex
+	transfers map[string]*TransferProgress
+	done      []Transfer
+	count     int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewTransferReporter returns a reporter for the agent listening on the
+// admin socket, or nil if there isn't one
+func NewTransferReporter(l logger.Logger, socket string, jobID string) *TransferReporter {
+	if socket == "" {
+		return nil
+	}
+
+	client, baseURL := NewAdminClient(socket)
+
+	u := *baseURL
+	u.Path = "/transfers"
+
+	return &TransferReporter{
+		logger:    l,
+		client:    client,
+		url:       u.String(),
+		jobID:     jobID,
+		transfers: map[string]*TransferProgress{},
+		stop:      make(chan struct{}),
+	}
+}
+
+// Track starts tracking the transfer of a file, with a size of -1 if it
+// isn't known
+func (r *TransferReporter) Track(direction string, file string, size int64) *TransferProgress {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count++
+	now := time.Now()
+
+	p := &TransferProgress{
+		transfer: Transfer{
+			ID:        fmt.Sprintf("%d-%d", os.Getpid(), r.count),
+			JobID:     r.jobID,
+			Direction: direction,
+			File:      file,
+			Size:      size,
+			StartedAt: now,
+		},
+		attemptStart: now,
+	}
+	r.transfers[p.transfer.ID] = p
+
+	return p
+}
+
+// Finish stops tracking a transfer, whether or not it succeeded
+func (r *TransferReporter) Finish(p *TransferProgress) {
+	if r == nil || p == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := p.snapshot()
+	t.Done = true
+	r.done = append(r.done, t)
+	delete(r.transfers, t.ID)
+}
+
+// Start reports progress in the background until Stop is called
+func (r *TransferReporter) Start() {
+	if r == nil {
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(transferReportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.report()
+			case <-r.stop:
+				r.report()
+				return
+			}
+		}
+	}()
+}
+
+// Stop reports progress one last time and stops reporting
+func (r *TransferReporter) Stop() {
+	if r == nil {
+		return
+	}
+
+	close(r.stop)
+	r.wg.Wait()
+}
+
+func (r *TransferReporter) report() {
+	r.mu.Lock()
+	transfers := r.done
+	r.done = nil
+	for _, p := range r.transfers {
+		transfers = append(transfers, p.snapshot())
+	}
+	r.mu.Unlock()
+
+	if len(transfers) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(transfers)
+	if err != nil {
+		return
+	}
+
+	// Progress is only informational, so failures are only worth a debug
+	// line. The agent might be an older one without the endpoint.
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		r.logger.Debug("Failed to report transfer progress: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		r.logger.Debug("Failed to report transfer progress: %s", resp.Status)
+	}
+}
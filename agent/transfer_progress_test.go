@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRegistryForgetsDoneAndStaleTransfers(t *testing.T) {
+	r := NewTransferRegistry()
+	now := time.Now()
+
+	r.Update(
+		Transfer{ID: "1", File: "llamas.txt", StartedAt: now.Add(-time.Second), UpdatedAt: now},
+		Transfer{ID: "2", File: "alpacas.txt", StartedAt: now.Add(-2 * time.Second), UpdatedAt: now},
+		Transfer{ID: "3", File: "stale.txt", UpdatedAt: now.Add(-2 * transferStaleAfter)},
+	)
+	r.Update(Transfer{ID: "1", Done: true})
+
+	transfers := r.List()
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, "alpacas.txt", transfers[0].File)
+	}
+}
+
+func TestTransferProgressCountsBytesPerAttempt(t *testing.T) {
+	var p *TransferProgress
+
+	// A nil progress tracks nothing, but can still be used
+	p.Add(10)
+	p.Retry()
+	assert.Equal(t, "llamas", readAll(t, p.Reader(bytes.NewBufferString("llamas"))))
+
+	r := &TransferReporter{transfers: map[string]*TransferProgress{}}
+	p = r.Track("download", "llamas.txt", 12)
+
+	assert.Equal(t, "llamas", readAll(t, p.Reader(bytes.NewBufferString("llamas"))))
+	assert.Equal(t, int64(6), p.snapshot().Bytes)
+
+	p.Retry()
+	p.Add(3)
+
+	snapshot := p.snapshot()
+	assert.Equal(t, int64(3), snapshot.Bytes)
+	assert.Equal(t, 1, snapshot.Retries)
+	assert.Equal(t, int64(12), snapshot.Size)
+}
+
+func TestTransferReporterReportsToAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry := NewTransferRegistry()
+
+	socket := filepath.Join(dir, "agent.sock")
+	server := NewAdminServer(logger.Discard, socket)
+	server.Handle("/transfers", registry.Handler())
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	reporter := NewTransferReporter(logger.Discard, socket, "job-1")
+	p := reporter.Track("upload", "llamas.txt", 100)
+	p.Add(42)
+
+	reporter.report()
+
+	transfers := registry.List()
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, "job-1", transfers[0].JobID)
+		assert.Equal(t, "upload", transfers[0].Direction)
+		assert.Equal(t, int64(42), transfers[0].Bytes)
+	}
+
+	// Finished transfers are reported one last time when stopping
+	reporter.Start()
+	reporter.Finish(p)
+	reporter.Stop()
+
+	assert.Empty(t, registry.List())
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
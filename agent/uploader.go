@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"io"
+
 	"github.com/buildkite/agent/api"
 )
 
@@ -12,3 +14,19 @@ type Uploader interface {
 	// The actual uploading of the file
 	Upload(*api.Artifact) error
 }
+
+// A StreamUploader can also upload an artifact from a stream of unknown
+// length, such as STDIN, without it being written to disk first
+type StreamUploader interface {
+	Uploader
+
+	// Uploads the artifact's contents from the reader
+	UploadStream(*api.Artifact, io.Reader) error
+}
+
+// A progressUploader can record how many bytes of an artifact it has sent,
+// and limit how fast it sends them, for uploaders that can't be given a
+// stream to count them from
+type progressUploader interface {
+	uploadWithProgress(*api.Artifact, *TransferProgress, *BandwidthLimiter) error
+}
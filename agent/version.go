@@ -1,5 +1,11 @@
 package agent
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // You can overridden buildVersion at compile time by using:
 //
 //  go run -ldflags "-X github.com/buildkite/agent/agent.buildVersion abc" *.go --version
@@ -20,3 +26,54 @@ func BuildVersion() string {
 		return "x"
 	}
 }
+
+// CompareVersions compares two dotted version strings (such as "3.10.4"),
+// returning -1, 0 or 1 if a is older than, the same as, or newer than b. Any
+// pre-release or build suffix (such as "-beta.1") is ignored, and missing
+// components are treated as zero.
+func CompareVersions(a, b string) (int, error) {
+	as, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+
+	bs, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var av, bv int
+		if i < len(as) {
+			av = as[i]
+		}
+		if i < len(bs) {
+			bv = bs[i]
+		}
+		if av < bv {
+			return -1, nil
+		} else if av > bv {
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func parseVersion(version string) ([]int, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if idx := strings.IndexAny(v, "-+"); idx >= 0 {
+		v = v[:idx]
+	}
+
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("Invalid version %q", version)
+		}
+		parts = append(parts, i)
+	}
+
+	return parts, nil
+}
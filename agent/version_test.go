@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"3.10.4", "3.10.4", 0},
+		{"3.10.4", "3.11.0", -1},
+		{"3.11.0", "3.10.4", 1},
+		{"3.10", "3.10.0", 0},
+		{"3.9.1", "3.10", -1},
+		{"v3.10.4", "3.10.4", 0},
+		{"3.11.0-beta.1", "3.11.0", 0},
+	} {
+		cmp, err := CompareVersions(tc.a, tc.b)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, cmp, "CompareVersions(%q, %q)", tc.a, tc.b)
+	}
+}
+
+func TestCompareVersionsWithInvalidVersion(t *testing.T) {
+	_, err := CompareVersions("3.10.4", "latest")
+	assert.Error(t, err)
+}
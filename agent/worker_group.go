@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WorkerGroup is a number of workers that register with the same tags, so
+// that one agent process can run jobs from different queues, each with its
+// own number of workers
+type WorkerGroup struct {
+	// How many workers to run
+	Count int
+
+	// The priority the workers register with, which decides which agents
+	// are given jobs first, or "" for the agent's own priority
+	Priority string
+
+	// Tags added to the agent's own tags, replacing any with the same key
+	Tags []string
+}
+
+// ParseWorkerGroup parses a group like "count=2;queue=mac;xcode=10".
+// Settings are separated by semicolons, as commas separate groups. count
+// defaults to 1, priority is the priority the workers register with, and
+// everything else is a tag.
+func ParseWorkerGroup(s string) (WorkerGroup, error) {
+	g := WorkerGroup{Count: 1}
+
+	for _, setting := range strings.Split(s, ";") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+
+		key, value := setting, ""
+		if idx := strings.Index(setting, "="); idx >= 0 {
+			key, value = strings.TrimSpace(setting[:idx]), strings.TrimSpace(setting[idx+1:])
+		}
+
+		switch key {
+		case "count":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return WorkerGroup{}, fmt.Errorf("Invalid worker count %q in %q, expected a number of at least 1", value, s)
+			}
+			g.Count = n
+		case "priority":
+			if _, err := strconv.Atoi(value); err != nil {
+				return WorkerGroup{}, fmt.Errorf("Invalid worker priority %q in %q, expected a number", value, s)
+			}
+			g.Priority = value
+		default:
+			g.Tags = append(g.Tags, setting)
+		}
+	}
+
+	if len(g.Tags) == 0 {
+		return WorkerGroup{}, fmt.Errorf("Worker group %q has no tags, such as queue=name", s)
+	}
+
+	return g, nil
+}
+
+// MergeTags returns tags with the group's tags added, replacing any with the
+// same key
+func (g WorkerGroup) MergeTags(tags []string) []string {
+	replaced := map[string]bool{}
+	for _, tag := range g.Tags {
+		replaced[tagKey(tag)] = true
+	}
+
+	var merged []string
+	for _, tag := range tags {
+		if !replaced[tagKey(tag)] {
+			merged = append(merged, tag)
+		}
+	}
+
+	return append(merged, g.Tags...)
+}
+
+// tagKey is the key of a tag like "queue=deploy", or the whole tag if it's
+// just a key
+func tagKey(tag string) string {
+	return strings.TrimSpace(strings.SplitN(tag, "=", 2)[0])
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWorkerGroup(t *testing.T) {
+	g, err := ParseWorkerGroup("count=2; queue=mac ;xcode=10;priority=5;gpu")
+	if assert.NoError(t, err) {
+		assert.Equal(t, WorkerGroup{Count: 2, Priority: "5", Tags: []string{"queue=mac", "xcode=10", "gpu"}}, g)
+	}
+
+	g, err = ParseWorkerGroup("queue=linux")
+	if assert.NoError(t, err) {
+		assert.Equal(t, WorkerGroup{Count: 1, Tags: []string{"queue=linux"}}, g)
+	}
+
+	for _, s := range []string{"", "count=2", "count=0;queue=mac", "count=lots;queue=mac", "priority=high;queue=mac"} {
+		_, err := ParseWorkerGroup(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestWorkerGroupMergeTags(t *testing.T) {
+	g := WorkerGroup{Tags: []string{"queue=mac", "xcode=10"}}
+
+	assert.Equal(t,
+		[]string{"os=darwin", "ci", "queue=mac", "xcode=10"},
+		g.MergeTags([]string{"queue=default", "os=darwin", "ci", "xcode"}))
+}
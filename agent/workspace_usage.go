@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// workspaceUsage tracks which checkouts are in use by running jobs, and when
+// each was last used. A checkout directory's modification time doesn't change
+// when files inside it do, so it can't be relied on to tell whether the
+// checkout is stale. Instead, a marker file next to the checkout is touched
+// when a job starts and finishes using it.
+type workspaceUsage struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// activeWorkspaces is shared by all of the job runners in the agent's process
+var activeWorkspaces = &workspaceUsage{active: map[string]int{}}
+
+// Start records that a job is using a checkout
+func (w *workspaceUsage) Start(l logger.Logger, checkout string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.active[checkout]++
+	w.touch(l, checkout)
+}
+
+// Finish records that a job has finished using a checkout
+func (w *workspaceUsage) Finish(l logger.Logger, checkout string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active[checkout]--; w.active[checkout] <= 0 {
+		delete(w.active, checkout)
+	}
+	w.touch(l, checkout)
+}
+
+// Active returns whether a job is using a checkout
+func (w *workspaceUsage) Active(checkout string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.active[checkout] > 0
+}
+
+// LastUsed returns when a job last used a checkout, falling back to the
+// checkout directory's modification time for checkouts without a marker
+func (w *workspaceUsage) LastUsed(checkout string, info os.FileInfo) time.Time {
+	if marker, err := os.Stat(workspaceMarkerPath(checkout)); err == nil {
+		return marker.ModTime()
+	}
+	return info.ModTime()
+}
+
+func (w *workspaceUsage) touch(l logger.Logger, checkout string) {
+	marker := workspaceMarkerPath(checkout)
+
+	if err := os.MkdirAll(filepath.Dir(marker), 0777); err != nil {
+		l.Debug("[Workspace] Failed to create %s: %v", filepath.Dir(marker), err)
+		return
+	}
+
+	f, err := os.OpenFile(marker, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		l.Debug("[Workspace] Failed to create %s: %v", marker, err)
+		return
+	}
+	f.Close()
+
+	now := time.Now()
+	if err := os.Chtimes(marker, now, now); err != nil {
+		l.Debug("[Workspace] Failed to touch %s: %v", marker, err)
+	}
+}
+
+// workspaceMarkerPath returns the path of the file that records when a
+// checkout was last used. It's kept outside of the checkout, so that cleaning
+// the checkout doesn't remove it.
+func workspaceMarkerPath(checkout string) string {
+	return filepath.Join(filepath.Dir(checkout), "."+filepath.Base(checkout)+".last-used")
+}
+
+var agentNameDirPattern = regexp.MustCompile("[[:^alnum:]]")
+
+// checkoutPath returns where the bootstrap will check out a job, the same
+// way that it works it out
+func checkoutPath(buildPath string, agentName string, env map[string]string) string {
+	if path, ok := env["BUILDKITE_BUILD_CHECKOUT_PATH"]; ok {
+		return path
+	}
+	if buildPath == "" {
+		return ""
+	}
+	return filepath.Join(buildPath,
+		agentNameDirPattern.ReplaceAllString(agentName, "-"),
+		env["BUILDKITE_ORGANIZATION_SLUG"],
+		env["BUILDKITE_PIPELINE_SLUG"])
+}
@@ -25,6 +25,7 @@ type AgentRegisterRequest struct {
 	Tags              []string `json:"meta_data" msgpack:"meta_data"`
 	PID               int      `json:"pid,omitempty" msgpack:"pid,omitempty"`
 	MachineID         string   `json:"machine_id,omitempty" msgpack:"machine_id,omitempty"`
+	Capabilities      []string `json:"capabilities,omitempty" msgpack:"capabilities,omitempty"`
 }
 
 // AgentRegisterResponse is the response from the Buildkite Agent API
@@ -1,6 +1,9 @@
 package api
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+)
 
 // AnnotationsService handles communication with the annotation related methods of the
 // Buildkite Agent API.
@@ -27,3 +30,15 @@ func (cs *AnnotationsService) Create(jobId string, annotation *Annotation) (*Res
 
 	return cs.client.Do(req, nil)
 }
+
+// Removes the annotation with the context from a build
+func (cs *AnnotationsService) Remove(jobId string, context string) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/annotations/%s", jobId, url.PathEscape(context))
+
+	req, err := cs.client.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.client.Do(req, nil)
+}
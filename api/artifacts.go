@@ -31,6 +31,10 @@ type Artifact struct {
 	// A Sha1Sum calculation of the file
 	Sha1Sum string `json:"sha1sum"`
 
+	// A Sha256Sum calculation of the file, which downloads are verified
+	// against
+	Sha256Sum string `json:"sha256sum,omitempty"`
+
 	// The HTTP url to this artifact once it's been uploaded
 	URL string `json:"url,omitempty"`
 
@@ -43,6 +47,15 @@ type Artifact struct {
 
 	// A specific Content-Type to use on upload
 	ContentType string `json:"-"`
+
+	// Key/value pairs describing the artifact, such as the team that owns it
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// The job that uploaded the artifact, the state it's in and when the
+	// artifact was created, which are returned when searching
+	JobID     string `json:"job_id,omitempty"`
+	JobState  string `json:"job_state,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
 }
 
 type ArtifactBatch struct {
@@ -72,6 +85,12 @@ type ArtifactBatchCreateResponse struct {
 type ArtifactSearchOptions struct {
 	Query string `url:"query,omitempty"`
 	Scope string `url:"scope,omitempty"`
+
+	// Also search jobs that have been retried, which are left out by default
+	IncludeRetriedJobs bool `url:"include_retried_jobs,omitempty"`
+
+	// Only search jobs in these states, such as passed or failed
+	JobStates []string `url:"job_states,omitempty,comma"`
 }
 
 type ArtifactBatchUpdateArtifact struct {
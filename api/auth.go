@@ -3,6 +3,8 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type canceler interface {
@@ -15,6 +17,10 @@ type AuthenticatedTransport struct {
 	// organizations registration token, or the agents access token.
 	Token string
 
+	// An optional token that can be rotated while it's in use, which takes
+	// precedence over Token
+	Tokens *RotatingToken
+
 	// Transport is the underlying HTTP transport to use when making
 	// requests. It will default to http.DefaultTransport if nil.
 	Transport http.RoundTripper
@@ -22,13 +28,47 @@ type AuthenticatedTransport struct {
 
 // RoundTrip invoked each time a request is made
 func (t AuthenticatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if t.Token == "" {
+	token := t.Token
+	if t.Tokens != nil {
+		token = t.Tokens.Get()
+	}
+
+	if token == "" {
 		return nil, fmt.Errorf("Invalid token, empty string supplied")
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", t.Token))
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
+
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || t.Tokens == nil {
+		return resp, err
+	}
+
+	// The new token might not be accepted everywhere yet, so while the old
+	// one is still around try again with it
+	previous, ok := t.Tokens.Previous()
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
 
-	return t.transport().RoundTrip(req)
+	// A shallow copy with its own headers, as requests mustn't be modified
+	// by round trippers
+	retry := new(http.Request)
+	*retry = *req
+	retry.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		retry.Header[k] = append([]string(nil), v...)
+	}
+
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	retry.Header.Set("Authorization", fmt.Sprintf("Token %s", previous))
+
+	resp.Body.Close()
+	return t.transport().RoundTrip(retry)
 }
 
 // CancelRequest cancels an in-flight request by closing its connection.
@@ -45,3 +85,51 @@ func (t *AuthenticatedTransport) transport() http.RoundTripper {
 
 	return http.DefaultTransport
 }
+
+// RotatingToken is an access token that can be replaced while requests are
+// being made with it. For a while after it's rotated the previous token is
+// kept, and requests that the new token isn't authorized for are retried
+// with it, so that the old token can be retired gradually.
+type RotatingToken struct {
+	mu       sync.RWMutex
+	current  string
+	previous string
+	retireAt time.Time
+}
+
+func NewRotatingToken(token string) *RotatingToken {
+	return &RotatingToken{current: token}
+}
+
+// Get returns the current token
+func (t *RotatingToken) Get() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current
+}
+
+// Rotate replaces the current token, keeping the previous one for overlap
+func (t *RotatingToken) Rotate(token string, overlap time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if token == t.current {
+		return
+	}
+
+	t.previous = t.current
+	t.retireAt = time.Now().Add(overlap)
+	t.current = token
+}
+
+// Previous returns the token that was replaced by the last rotation, unless
+// it has been retired
+func (t *RotatingToken) Previous() (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.previous == "" || time.Now().After(t.retireAt) {
+		return "", false
+	}
+	return t.previous, true
+}
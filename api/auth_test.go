@@ -0,0 +1,49 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatedTransportFallsBackToPreviousToken(t *testing.T) {
+	var bodies []string
+
+	// Only the old token is accepted, as if the new one hasn't propagated
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, req.Header.Get("Authorization")+" "+string(body))
+
+		if req.Header.Get("Authorization") != "Token old" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	tokens := NewRotatingToken("old")
+	client := &http.Client{Transport: AuthenticatedTransport{Tokens: tokens}}
+
+	post := func() int {
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader("llamas"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tokens.Rotate("new", time.Minute)
+	assert.Equal(t, http.StatusOK, post())
+	assert.Equal(t, []string{"Token new llamas", "Token old llamas"}, bodies)
+
+	// Once the old token is retired it's no longer tried
+	bodies = nil
+	tokens.Rotate("newer", -time.Second)
+	assert.Equal(t, http.StatusUnauthorized, post())
+	assert.Equal(t, []string{"Token newer llamas"}, bodies)
+}
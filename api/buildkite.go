@@ -12,6 +12,7 @@ import (
 	"net/textproto"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,6 +44,9 @@ type Client struct {
 	// If true, requests and responses will be dumped and set to the logger
 	DebugHTTP bool
 
+	// If set, requests will fail fast when the API has been failing
+	CircuitBreaker *CircuitBreaker
+
 	// Services used for talking to different parts of the Buildkite Agent API.
 	Agents      *AgentsService
 	Pings       *PingsService
@@ -54,6 +58,7 @@ type Client struct {
 	Pipelines   *PipelinesService
 	Heartbeats  *HeartbeatsService
 	Annotations *AnnotationsService
+	Builds      *BuildsService
 }
 
 // NewClient returns a new Buildkite Agent API Client.
@@ -77,6 +82,7 @@ func NewClient(httpClient *http.Client, l logger.Logger) *Client {
 	c.Pipelines = &PipelinesService{c}
 	c.Heartbeats = &HeartbeatsService{c}
 	c.Annotations = &AnnotationsService{c}
+	c.Builds = &BuildsService{c}
 
 	return c
 }
@@ -163,6 +169,15 @@ type Response struct {
 	*http.Response
 }
 
+// RetryAfter returns how long the Retry-After header of the response asked
+// for the next request to be delayed, if it did
+func (r *Response) RetryAfter() (time.Duration, bool) {
+	if r == nil || r.Response == nil {
+		return 0, false
+	}
+	return parseRetryAfter(r.Header.Get("Retry-After"), time.Now())
+}
+
 // newResponse creates a new Response for the provided http.Response.
 func newResponse(r *http.Response) *Response {
 	response := &Response{Response: r}
@@ -194,14 +209,31 @@ func (c *Client) Do(req *http.Request, v interface{}) (*Response, error) {
 
 	ts := time.Now()
 
-	c.logger.Debug("%s %s", req.Method, req.URL)
+	c.logger.Trace("%s %s", req.Method, req.URL)
+
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
+		if c.CircuitBreaker != nil {
+			c.CircuitBreaker.Failure()
+		}
 		return nil, err
 	}
 
-	c.logger.Debug("↳ %s %s (%s %s %s)", req.Method, req.URL, resp.Proto, resp.Status, time.Now().Sub(ts))
+	if c.CircuitBreaker != nil {
+		if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+			c.CircuitBreaker.Failure()
+		} else {
+			c.CircuitBreaker.Success()
+		}
+	}
+
+	c.logger.Trace("↳ %s %s (%s %s %s)", req.Method, req.URL, resp.Proto, resp.Status, time.Now().Sub(ts))
 
 	defer resp.Body.Close()
 	defer io.Copy(ioutil.Discard, resp.Body)
@@ -253,6 +285,43 @@ func (r *ErrorResponse) Error() string {
 	return s
 }
 
+// RetryAfter returns how long the Retry-After header of a 429 or 503
+// response asked for the request to be delayed, if it did
+func (r *ErrorResponse) RetryAfter() (time.Duration, bool) {
+	if r.Response == nil {
+		return 0, false
+	}
+	if code := r.Response.StatusCode; code != http.StatusTooManyRequests && code != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return parseRetryAfter(r.Response.Header.Get("Retry-After"), time.Now())
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or a date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
 func checkResponse(r *http.Response) error {
 	if c := r.StatusCode; 200 <= c && c <= 299 {
 		return nil
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Sat, 01 Jun 2019 12:00:30 GMT", 30 * time.Second, true},
+		{"Sat, 01 Jun 2019 11:59:00 GMT", 0, true},
+		{"soon", 0, false},
+	} {
+		d, ok := parseRetryAfter(tc.value, now)
+		if d != tc.expected || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, expected %v, %v", tc.value, d, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestErrorResponseRetryAfter(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://agent.buildkite.com/v3/jobs/1/start", nil)
+	resp := &http.Response{StatusCode: 429, Header: http.Header{}, Request: req}
+	resp.Header.Set("Retry-After", "7")
+
+	err := &ErrorResponse{Response: resp}
+	if d, ok := err.RetryAfter(); !ok || d != 7*time.Second {
+		t.Fatalf("Expected 7s, got %v, %v", d, ok)
+	}
+	if !IsRetryableError(err) {
+		t.Fatalf("Expected a 429 to be retryable")
+	}
+
+	resp.StatusCode = 400
+	if _, ok := err.RetryAfter(); ok {
+		t.Fatalf("Expected Retry-After to be ignored on a 400")
+	}
+	if IsRetryableError(err) {
+		t.Fatalf("Expected a 400 not to be retryable")
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import "fmt"
+
+// BuildsService handles communication with the build related methods of the
+// Buildkite Agent API.
+type BuildsService struct {
+	client *Client
+}
+
+// Build represents a Buildkite Agent API Build
+type Build struct {
+	ID         string `json:"id,omitempty"`
+	Number     int    `json:"number,omitempty"`
+	State      string `json:"state,omitempty"`
+	Branch     string `json:"branch,omitempty"`
+	Commit     string `json:"commit,omitempty"`
+	Message    string `json:"message,omitempty"`
+	WebURL     string `json:"web_url,omitempty"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// Finished returns whether the build has reached a state it won't leave
+func (b *Build) Finished() bool {
+	switch b.State {
+	case "passed", "failed", "canceled", "skipped", "not_run":
+		return true
+	}
+	return false
+}
+
+// Fetches a build
+func (bs *BuildsService) Get(id string) (*Build, *Response, error) {
+	u := fmt.Sprintf("builds/%s", id)
+
+	req, err := bs.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := new(Build)
+	resp, err := bs.client.Do(req, b)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return b, resp, err
+}
+
+// BuildStep represents the state of one of a build's steps
+type BuildStep struct {
+	ID         string `json:"id,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Type       string `json:"type,omitempty"`
+	State      string `json:"state,omitempty"`
+	ExitStatus *int   `json:"exit_status,omitempty"`
+	SoftFailed bool   `json:"soft_failed,omitempty"`
+	WebURL     string `json:"web_url,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// Fetches the steps of a build, in the order they appear in it
+func (bs *BuildsService) Steps(id string) ([]*BuildStep, *Response, error) {
+	u := fmt.Sprintf("builds/%s/steps", id)
+
+	req, err := bs.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	steps := []*BuildStep{}
+	resp, err := bs.client.Do(req, &steps)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return steps, resp, err
+}
+
+// BuildCreate represents a request to create a new build
+type BuildCreate struct {
+	UUID     string            `json:"uuid"`
+	Pipeline string            `json:"pipeline"`
+	Commit   string            `json:"commit,omitempty"`
+	Branch   string            `json:"branch,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	MetaData map[string]string `json:"meta_data,omitempty"`
+}
+
+// Creates a build on behalf of the given job
+func (bs *BuildsService) Create(jobId string, b *BuildCreate) (*Build, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/builds", jobId)
+
+	req, err := bs.client.NewRequest("POST", u, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	build := new(Build)
+	resp, err := bs.client.Do(req, build)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return build, resp, err
+}
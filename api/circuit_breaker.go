@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of making a request when the circuit
+// breaker has tripped
+var ErrCircuitOpen = errors.New("Not contacting the Buildkite Agent API because of repeated failures")
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState string
+
+const (
+	// Requests are made as normal
+	CircuitClosed CircuitState = "closed"
+
+	// Requests fail immediately without contacting the API
+	CircuitOpen CircuitState = "open"
+
+	// A single request is allowed through to test whether the API is back
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitBreaker stops requests being made to the API after sustained
+// failures, so that every part of the agent retrying independently doesn't
+// amplify an outage. Once tripped, a single request is let through after a
+// cooldown, which doubles each time that request fails.
+type CircuitBreaker struct {
+	// How many consecutive failures trip the breaker
+	Threshold int
+
+	// How long to wait after tripping before letting a request through, and
+	// the most that this will grow to
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+
+	// Called whenever the state of the breaker changes
+	OnStateChange func(from, to CircuitState)
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	probing   bool
+	openUntil time.Time
+	cooldown  time.Duration
+}
+
+// NewCircuitBreaker returns a circuit breaker with sensible defaults
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold:   10,
+		Cooldown:    30 * time.Second,
+		MaxCooldown: 10 * time.Minute,
+	}
+}
+
+// State returns the current state of the breaker
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state()
+}
+
+func (cb *CircuitBreaker) state() CircuitState {
+	switch {
+	case !cb.open:
+		return CircuitClosed
+	case !cb.probing && !time.Now().Before(cb.openUntil):
+		return CircuitHalfOpen
+	default:
+		return CircuitOpen
+	}
+}
+
+// Allow returns ErrCircuitOpen if a request shouldn't be made right now
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state() {
+	case CircuitOpen:
+		return ErrCircuitOpen
+	case CircuitHalfOpen:
+		cb.probing = true
+	}
+
+	return nil
+}
+
+// Success records a request that reached the API
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	from := cb.state()
+
+	cb.failures = 0
+	cb.open = false
+	cb.probing = false
+	cb.cooldown = 0
+
+	cb.mu.Unlock()
+	cb.changed(from, CircuitClosed)
+}
+
+// Failure records a request that failed because the API couldn't be reached
+// or was erroring
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	from := cb.state()
+
+	cb.failures++
+
+	if cb.probing || (!cb.open && cb.failures >= cb.Threshold) {
+		if cb.cooldown == 0 {
+			cb.cooldown = cb.Cooldown
+		} else if cb.cooldown *= 2; cb.MaxCooldown > 0 && cb.cooldown > cb.MaxCooldown {
+			cb.cooldown = cb.MaxCooldown
+		}
+		cb.open = true
+		cb.probing = false
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+
+	to := cb.state()
+	cb.mu.Unlock()
+	cb.changed(from, to)
+}
+
+func (cb *CircuitBreaker) changed(from, to CircuitState) {
+	if from != to && cb.OnStateChange != nil {
+		cb.OnStateChange(from, to)
+	}
+}
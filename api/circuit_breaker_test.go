@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	var changes []CircuitState
+
+	cb := &CircuitBreaker{
+		Threshold:   2,
+		Cooldown:    20 * time.Millisecond,
+		MaxCooldown: time.Second,
+		OnStateChange: func(from, to CircuitState) {
+			changes = append(changes, to)
+		},
+	}
+
+	assert.NoError(t, cb.Allow())
+	cb.Failure()
+	assert.Equal(t, CircuitClosed, cb.State())
+
+	cb.Failure()
+	assert.Equal(t, CircuitOpen, cb.State())
+	assert.Equal(t, ErrCircuitOpen, cb.Allow())
+
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, CircuitHalfOpen, cb.State())
+
+	// Only a single request is let through when half-open
+	assert.NoError(t, cb.Allow())
+	assert.Equal(t, ErrCircuitOpen, cb.Allow())
+
+	// A failed probe re-opens the breaker for longer
+	cb.Failure()
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, CircuitOpen, cb.State())
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, cb.Allow())
+	cb.Success()
+	assert.Equal(t, CircuitClosed, cb.State())
+
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitClosed}, changes)
+}
+
+func TestClientFailsFastWhenCircuitIsOpen(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := NewClient(http.DefaultClient, logger.Discard)
+	client.BaseURL, _ = client.BaseURL.Parse(server.URL)
+	client.CircuitBreaker = &CircuitBreaker{Threshold: 3, Cooldown: time.Minute}
+
+	for i := 0; i < 5; i++ {
+		_, _, err := client.Pings.Get()
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, CircuitOpen, client.CircuitBreaker.State())
+}
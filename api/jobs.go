@@ -21,6 +21,13 @@ type Job struct {
 	StartedAt          string            `json:"started_at,omitempty"`
 	FinishedAt         string            `json:"finished_at,omitempty"`
 	ChunksFailedCount  int               `json:"chunks_failed_count,omitempty"`
+
+	// Whether the agent treated the job's exit status as a soft failure
+	SoftFailed bool `json:"soft_failed,omitempty"`
+
+	// The W3C trace context (traceparent, tracestate and baggage) of
+	// whatever triggered the build, if it was traced
+	TraceContext map[string]string `json:"trace_context,omitempty"`
 }
 
 type JobState struct {
@@ -35,6 +42,7 @@ type jobFinishRequest struct {
 	ExitStatus        string `json:"exit_status,omitempty"`
 	FinishedAt        string `json:"finished_at,omitempty"`
 	ChunksFailedCount int    `json:"chunks_failed_count"`
+	SoftFailed        bool   `json:"soft_failed,omitempty"`
 }
 
 // Fetches a job
@@ -97,6 +105,7 @@ func (js *JobsService) Finish(job *Job) (*Response, error) {
 		FinishedAt:        job.FinishedAt,
 		ExitStatus:        job.ExitStatus,
 		ChunksFailedCount: job.ChunksFailedCount,
+		SoftFailed:        job.SoftFailed,
 	})
 	if err != nil {
 		return nil, err
@@ -116,3 +125,25 @@ func (js *JobsService) StepUpdate(jobId string, stepUpdate *StepUpdate) (*Respon
 
 	return js.client.Do(req, nil)
 }
+
+// Gets an attribute of a step
+func (js *JobsService) StepGet(jobId string, attribute string) (*StepAttribute, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/step", jobId)
+	u, err := addOptions(u, &StepGetOptions{Attribute: attribute})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := js.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := new(StepAttribute)
+	resp, err := js.client.Do(req, a)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return a, resp, err
+}
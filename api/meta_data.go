@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"time"
 )
 
 // MetaDataService handles communication with the meta data related methods of
@@ -22,6 +24,27 @@ type MetaDataExists struct {
 	Exists bool `json:"exists"`
 }
 
+// MetaDataCompareAndSet sets a meta data value only if it currently has
+// PreviousValue, or only if it hasn't been set at all if PreviousValue is nil.
+// RequestID identifies the request, so that a retry can tell whether it was
+// set by an earlier attempt.
+type MetaDataCompareAndSet struct {
+	Key           string  `json:"key"`
+	Value         string  `json:"value"`
+	PreviousValue *string `json:"previous_value"`
+	RequestID     string  `json:"request_id"`
+}
+
+// MetaDataCompareAndSetResult represents a Buildkite Agent API MetaData
+// compare-and-set response. When the value wasn't set, Exists and Value are
+// what it currently is, and RequestID is the request that set it.
+type MetaDataCompareAndSetResult struct {
+	Set       bool   `json:"set"`
+	Exists    bool   `json:"exists"`
+	Value     string `json:"value,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
 // Sets the meta data value
 func (ps *MetaDataService) Set(jobId string, metaData *MetaData) (*Response, error) {
 	u := fmt.Sprintf("jobs/%s/data/set", jobId)
@@ -34,6 +57,42 @@ func (ps *MetaDataService) Set(jobId string, metaData *MetaData) (*Response, err
 	return ps.client.Do(req, nil)
 }
 
+type metaDataSetManyRequest struct {
+	MetaData []*MetaData `json:"meta_data"`
+}
+
+// SetMany sets many meta data values in one request
+func (ps *MetaDataService) SetMany(jobId string, metaData []*MetaData) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/set-many", jobId)
+
+	req, err := ps.client.NewRequest("POST", u, &metaDataSetManyRequest{MetaData: metaData})
+	if err != nil {
+		return nil, err
+	}
+
+	return ps.client.Do(req, nil)
+}
+
+// CompareAndSet sets the meta data value if it hasn't changed, which the API
+// checks and sets in one step, so that jobs running at the same time can't
+// both set it
+func (ps *MetaDataService) CompareAndSet(jobId string, cas *MetaDataCompareAndSet) (*MetaDataCompareAndSetResult, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/compare-and-set", jobId)
+
+	req, err := ps.client.NewRequest("POST", u, cas)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := new(MetaDataCompareAndSetResult)
+	resp, err := ps.client.Do(req, r)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return r, resp, err
+}
+
 // Gets the meta data value
 func (ps *MetaDataService) Get(jobId string, key string) (*MetaData, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/data/get", jobId)
@@ -52,6 +111,32 @@ func (ps *MetaDataService) Get(jobId string, key string) (*MetaData, *Response,
 	return m, resp, err
 }
 
+type metaDataWatchRequest struct {
+	Key           string  `json:"key"`
+	PreviousValue *string `json:"previous_value,omitempty"`
+}
+
+// Watch gets the meta data value, asking the API to wait up to the given time
+// for it to be set to something other than previous (or to be set at all, if
+// previous is nil) before responding. Endpoints that support it set
+// LongPollHeader on the response, others respond straight away like Get.
+func (ps *MetaDataService) Watch(ctx context.Context, jobId string, key string, previous *string, wait time.Duration) (*MetaData, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/get?wait=%d", jobId, int(wait.Seconds()))
+
+	req, err := ps.client.NewRequest("POST", u, &metaDataWatchRequest{Key: key, PreviousValue: previous})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &MetaData{Key: key}
+	resp, err := ps.client.Do(req.WithContext(ctx), m)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return m, resp, err
+}
+
 // Returns true if the meta data key has been set, false if it hasn't.
 func (ps *MetaDataService) Exists(jobId string, key string) (*MetaDataExists, *Response, error) {
 	u := fmt.Sprintf("jobs/%s/data/exists", jobId)
@@ -70,3 +155,39 @@ func (ps *MetaDataService) Exists(jobId string, key string) (*MetaDataExists, *R
 
 	return e, resp, err
 }
+
+// Keys returns the keys of all the meta data set on the job's build
+func (ps *MetaDataService) Keys(jobId string) ([]string, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/keys", jobId)
+
+	req, err := ps.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := []string{}
+	resp, err := ps.client.Do(req, &keys)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return keys, resp, err
+}
+
+// All returns all the meta data set on the job's build, by key
+func (ps *MetaDataService) All(jobId string) (map[string]string, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/all", jobId)
+
+	req, err := ps.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	all := map[string]string{}
+	resp, err := ps.client.Do(req, &all)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return all, resp, err
+}
@@ -1,5 +1,15 @@
 package api
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// LongPollHeader is set on ping responses by endpoints that held the ping
+// open until there was work (or the wait was up)
+const LongPollHeader = "Buildkite-Long-Poll"
+
 // PingsService handles communication with the ping related methods of the
 // Buildkite Agent API.
 type PingsService struct {
@@ -29,3 +39,21 @@ func (ps *PingsService) Get() (*Ping, *Response, error) {
 
 	return ping, resp, err
 }
+
+// GetWait pings the API, asking it to wait up to the given time for work
+// before responding. Endpoints that support it set LongPollHeader on the
+// response, others respond straight away like Get.
+func (ps *PingsService) GetWait(ctx context.Context, wait time.Duration) (*Ping, *Response, error) {
+	req, err := ps.client.NewRequest("GET", fmt.Sprintf("ping?wait=%d", int(wait.Seconds())), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ping := new(Ping)
+	resp, err := ps.client.Do(req.WithContext(ctx), ping)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return ping, resp, err
+}
@@ -21,6 +21,14 @@ var retrableErrorSuffixes = []string{
 // Looks at a bunch of connection related errors, and returns true if the error
 // matches one of them.
 func IsRetryableError(err error) bool {
+	// Being asked to slow down, or the API being unavailable for a moment,
+	// isn't a reason to give up
+	if errResp, ok := err.(*ErrorResponse); ok && errResp.Response != nil {
+		if code := errResp.Response.StatusCode; code == 429 || code == 503 {
+			return true
+		}
+	}
+
 	if neterr, ok := err.(net.Error); ok {
 		if neterr.Temporary() {
 			return true
@@ -7,3 +7,15 @@ type StepUpdate struct {
 	Value     string `json:"value,omitempty"`
 	Append    bool   `json:"append,omitempty"`
 }
+
+// StepAttribute is the value of an attribute of a step. Structured
+// attributes, such as retry rules, have their value encoded as JSON.
+type StepAttribute struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+}
+
+// StepGetOptions specifies the parameters to the JobsService.StepGet method
+type StepGetOptions struct {
+	Attribute string `url:"attribute"`
+}
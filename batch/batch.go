@@ -0,0 +1,205 @@
+// Package batch runs many commands with bounded parallelism, tagging each line
+// of their output with the command it came from
+package batch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+)
+
+// Config is how commands are run
+type Config struct {
+	// How many commands run at once
+	MaxParallel int
+
+	// The shell and its arguments that each command is appended to, such as
+	// ["/bin/bash", "-e", "-c"]
+	Shell []string
+
+	// Where the tagged output of every command is written
+	Output io.Writer
+
+	// Environment and working directory of the commands, which are
+	// inherited from this process if empty
+	Env []string
+	Dir string
+}
+
+// Result is how a command finished
+type Result struct {
+	Command    string
+	ExitStatus int
+	Duration   time.Duration
+
+	// Set when the command wasn't run because the context finished first
+	Skipped bool
+}
+
+// Run runs commands, at most MaxParallel at once, and returns their results
+// in the same order. When ctx finishes, running commands are terminated and
+// the rest are skipped.
+func Run(ctx context.Context, l logger.Logger, commands []string, cfg Config) ([]Result, error) {
+	if cfg.MaxParallel < 1 {
+		return nil, fmt.Errorf("Max parallel must be at least 1, got %d", cfg.MaxParallel)
+	}
+	if len(cfg.Shell) == 0 {
+		return nil, fmt.Errorf("A shell is required to run commands")
+	}
+
+	results := make([]Result, len(commands))
+	output := &lockedWriter{w: cfg.Output}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+
+	workers := cfg.MaxParallel
+	if workers > len(commands) {
+		workers = len(commands)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				results[index] = run(ctx, l, index, commands[index], cfg, output)
+			}
+		}()
+	}
+
+	for index := range commands {
+		if ctx.Err() != nil {
+			results[index] = Result{Command: commands[index], ExitStatus: -1, Skipped: true}
+			continue
+		}
+		select {
+		case queue <- index:
+		case <-ctx.Done():
+			results[index] = Result{Command: commands[index], ExitStatus: -1, Skipped: true}
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return results, nil
+}
+
+func run(ctx context.Context, l logger.Logger, index int, command string, cfg Config, output *lockedWriter) Result {
+	result := Result{Command: command}
+	tagged := &taggedWriter{tag: Tag(index), w: output}
+
+	args := append(append([]string{}, cfg.Shell[1:]...), command)
+
+	p := process.New(logger.Discard, process.Config{
+		Path:    cfg.Shell[0],
+		Args:    args,
+		Env:     cfg.Env,
+		Dir:     cfg.Dir,
+		Stdout:  tagged,
+		Stderr:  tagged,
+		Context: ctx,
+	})
+
+	startedAt := time.Now()
+	l.Debug("Starting %s %q", Tag(index), command)
+
+	if err := p.Run(); err != nil {
+		tagged.Flush()
+		fmt.Fprintf(tagged, "Failed to run %q: %v\n", command, err)
+		tagged.Flush()
+		result.ExitStatus = -1
+		result.Duration = time.Since(startedAt)
+		return result
+	}
+	tagged.Flush()
+
+	status := p.WaitStatus()
+	result.ExitStatus = status.ExitStatus()
+	if status.Signaled() {
+		result.ExitStatus = 128 + int(status.Signal())
+	}
+	result.Duration = time.Since(startedAt)
+
+	return result
+}
+
+// Tag is how lines of output from the command at index are prefixed
+func Tag(index int) string {
+	return fmt.Sprintf("[%d]", index+1)
+}
+
+// ExitStatus is the status to exit with for a set of results: that of the
+// first command that failed, or 0 if they all succeeded
+func ExitStatus(results []Result) int {
+	for _, result := range results {
+		if result.ExitStatus != 0 {
+			if result.ExitStatus < 0 {
+				return 1
+			}
+			return result.ExitStatus
+		}
+	}
+	return 0
+}
+
+// lockedWriter serializes writes from many commands, so that lines are
+// written whole
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+// taggedWriter buffers output until it has whole lines, and writes each
+// prefixed with a tag. As every line starts with the tag, lines from commands
+// that look like log section headers (like "--- Tests") can't start sections
+// that would swallow the output of the other commands.
+type taggedWriter struct {
+	tag     string
+	w       io.Writer
+	partial []byte
+}
+
+func (w *taggedWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+
+	var lines bytes.Buffer
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lines.WriteString(w.tag + " ")
+		lines.Write(w.partial[:i+1])
+		w.partial = w.partial[i+1:]
+	}
+
+	if lines.Len() > 0 {
+		if _, err := w.w.Write(lines.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flush writes any output that didn't end with a newline
+func (w *taggedWriter) Flush() {
+	if len(w.partial) > 0 {
+		_, _ = w.w.Write([]byte(w.tag + " " + string(w.partial) + "\n"))
+		w.partial = nil
+	}
+}
@@ -0,0 +1,76 @@
+// +build !windows
+
+package batch
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTagsOutputAndCollectsExitStatuses(t *testing.T) {
+	var out bytes.Buffer
+
+	results, err := Run(context.Background(), logger.Discard, []string{
+		"echo llamas; echo --- alpacas",
+		"printf partial; exit 3",
+		"echo to stderr >&2",
+	}, Config{
+		MaxParallel: 2,
+		Shell:       []string{"/bin/sh", "-c"},
+		Output:      &out,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, results[0].ExitStatus)
+	assert.Equal(t, 3, results[1].ExitStatus)
+	assert.Equal(t, 0, results[2].ExitStatus)
+	assert.Equal(t, "printf partial; exit 3", results[1].Command)
+	assert.Equal(t, 3, ExitStatus(results))
+
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	sort.Strings(lines)
+
+	assert.Equal(t, []string{
+		"[1] --- alpacas",
+		"[1] llamas",
+		"[2] partial",
+		"[3] to stderr",
+	}, lines)
+}
+
+func TestRunSkipsCommandsOnceCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := Run(ctx, logger.Discard, []string{"true", "true"}, Config{
+		MaxParallel: 1,
+		Shell:       []string{"/bin/sh", "-c"},
+		Output:      &bytes.Buffer{},
+	})
+	assert.NoError(t, err)
+
+	for _, result := range results {
+		assert.True(t, result.Skipped)
+	}
+	assert.Equal(t, 1, ExitStatus(results))
+}
+
+func TestRunRequiresParallelism(t *testing.T) {
+	_, err := Run(context.Background(), logger.Discard, []string{"true"}, Config{
+		Shell: []string{"/bin/sh", "-c"},
+	})
+	assert.Error(t, err)
+}
+
+func TestExitStatus(t *testing.T) {
+	assert.Equal(t, 0, ExitStatus(nil))
+	assert.Equal(t, 0, ExitStatus([]Result{{ExitStatus: 0}, {ExitStatus: 0}}))
+	assert.Equal(t, 2, ExitStatus([]Result{{ExitStatus: 0}, {ExitStatus: 2}, {ExitStatus: 1}}))
+	assert.Equal(t, 1, ExitStatus([]Result{{ExitStatus: -1}}))
+}
@@ -0,0 +1,132 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+)
+
+const (
+	archX86_64 = "x86_64"
+	archARM64  = "arm64"
+)
+
+// Where Rosetta 2 is installed on Apple Silicon Macs
+var rosettaPath = "/Library/Apple/usr/share/rosetta/rosetta"
+
+// Where Homebrew is installed for each architecture on macOS
+var homebrewPrefixes = map[string]string{
+	archX86_64: "/usr/local",
+	archARM64:  "/opt/homebrew",
+}
+
+// normalizeArch converts the different names for architectures (such as Go's
+// amd64) into the names used by macOS and BUILDKITE_ARCH
+func normalizeArch(arch string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(arch)) {
+	case "x86_64", "amd64", "x64", "intel":
+		return archX86_64, nil
+	case "arm64", "aarch64", "arm":
+		return archARM64, nil
+	default:
+		return "", fmt.Errorf("Unknown architecture %q, expected x86_64 or arm64", arch)
+	}
+}
+
+// archCommand returns cmd wrapped so that it runs as the requested
+// architecture, which on Apple Silicon Macs means x86_64 commands are run
+// under Rosetta. The environment is updated to use the Homebrew installation
+// for the architecture.
+func archCommand(goos string, hostArch string, requested string, environ *env.Environment, cmd []string) ([]string, error) {
+	arch, err := normalizeArch(requested)
+	if err != nil {
+		return nil, err
+	}
+
+	if goos != "darwin" {
+		if arch != hostArch {
+			return nil, fmt.Errorf("Can't run %s commands on a %s %s agent", arch, goos, hostArch)
+		}
+		return cmd, nil
+	}
+
+	if arch == archX86_64 && hostArch == archARM64 {
+		if _, err := os.Stat(rosettaPath); err != nil {
+			return nil, fmt.Errorf("Running x86_64 commands requires Rosetta 2, which can be installed with `softwareupdate --install-rosetta`")
+		}
+	} else if arch != hostArch {
+		return nil, fmt.Errorf("Can't run %s commands on a %s Mac", arch, hostArch)
+	}
+
+	switchHomebrewPrefix(environ, arch)
+
+	// Even when the architecture is the host's, the agent itself might be
+	// running under Rosetta, so arch is always used to be sure
+	return append([]string{"/usr/bin/arch", "-" + arch}, cmd...), nil
+}
+
+// switchHomebrewPrefix puts the Homebrew installation for arch first in the
+// PATH, and removes the one for any other architecture
+func switchHomebrewPrefix(environ *env.Environment, arch string) {
+	prefix := homebrewPrefixes[arch]
+
+	var paths []string
+	for _, prefixArch := range []string{archX86_64, archARM64} {
+		if prefixArch != arch {
+			other := homebrewPrefixes[prefixArch]
+			paths = append(paths, filepath.Join(other, "bin"), filepath.Join(other, "sbin"))
+		}
+	}
+
+	path, _ := environ.Get("PATH")
+
+	updated := []string{filepath.Join(prefix, "bin"), filepath.Join(prefix, "sbin")}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" || containsString(updated, dir) || containsString(paths, dir) {
+			continue
+		}
+		updated = append(updated, dir)
+	}
+
+	// /usr/local/bin also has things that aren't from Homebrew, so keep it
+	// at the end rather than removing it
+	if arch == archARM64 {
+		updated = append(updated, filepath.Join(homebrewPrefixes[archX86_64], "bin"))
+	}
+
+	environ.Set("PATH", strings.Join(updated, string(os.PathListSeparator)))
+	environ.Set("HOMEBREW_PREFIX", prefix)
+	environ.Set("HOMEBREW_CELLAR", filepath.Join(prefix, "Cellar"))
+
+	if arch == archARM64 {
+		environ.Set("HOMEBREW_REPOSITORY", prefix)
+	} else {
+		environ.Set("HOMEBREW_REPOSITORY", filepath.Join(prefix, "Homebrew"))
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hostArch returns the native architecture of the host
+func hostArch() string {
+	if runtime.GOOS == "darwin" && isAppleSilicon() {
+		return archARM64
+	}
+
+	arch, err := normalizeArch(runtime.GOARCH)
+	if err != nil {
+		return runtime.GOARCH
+	}
+	return arch
+}
@@ -0,0 +1,10 @@
+package bootstrap
+
+import "syscall"
+
+// isAppleSilicon returns whether this is an arm64 Mac, even if the agent is
+// running under Rosetta
+func isAppleSilicon() bool {
+	value, err := syscall.Sysctl("hw.optional.arm64")
+	return err == nil && len(value) > 0 && value[0] == 1
+}
@@ -0,0 +1,7 @@
+// +build !darwin
+
+package bootstrap
+
+func isAppleSilicon() bool {
+	return false
+}
@@ -0,0 +1,85 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeArch(t *testing.T) {
+	for input, expected := range map[string]string{
+		"x86_64":  "x86_64",
+		"amd64":   "x86_64",
+		"ARM64":   "arm64",
+		"aarch64": "arm64",
+	} {
+		arch, err := normalizeArch(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, arch, input)
+	}
+
+	_, err := normalizeArch("ppc")
+	assert.Error(t, err)
+}
+
+func TestArchCommandUsesRosettaOnAppleSilicon(t *testing.T) {
+	rosetta, err := ioutil.TempFile("", "rosetta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rosetta.Close()
+	defer os.Remove(rosetta.Name())
+
+	defer func(path string) { rosettaPath = path }(rosettaPath)
+	rosettaPath = rosetta.Name()
+
+	environ := env.FromSlice([]string{"PATH=/opt/homebrew/bin:/opt/homebrew/sbin:/usr/local/bin:/usr/bin:/bin"})
+
+	cmd, err := archCommand("darwin", "arm64", "amd64", environ, []string{"/bin/bash", "-c", "make"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"/usr/bin/arch", "-x86_64", "/bin/bash", "-c", "make"}, cmd)
+
+	path, _ := environ.Get("PATH")
+	assert.Equal(t, "/usr/local/bin:/usr/local/sbin:/usr/bin:/bin", path)
+
+	prefix, _ := environ.Get("HOMEBREW_PREFIX")
+	assert.Equal(t, "/usr/local", prefix)
+}
+
+func TestArchCommandSwitchesBackToNativeHomebrew(t *testing.T) {
+	environ := env.FromSlice([]string{"PATH=/usr/local/bin:/usr/bin:/bin"})
+
+	cmd, err := archCommand("darwin", "arm64", "arm64", environ, []string{"/bin/bash", "-c", "make"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"/usr/bin/arch", "-arm64", "/bin/bash", "-c", "make"}, cmd)
+
+	path, _ := environ.Get("PATH")
+	assert.Equal(t, "/opt/homebrew/bin:/opt/homebrew/sbin:/usr/bin:/bin:/usr/local/bin", path)
+}
+
+func TestArchCommandErrors(t *testing.T) {
+	defer func(path string) { rosettaPath = path }(rosettaPath)
+	rosettaPath = "/does/not/exist"
+
+	_, err := archCommand("darwin", "arm64", "x86_64", env.New(), []string{"make"})
+	assert.Error(t, err)
+
+	_, err = archCommand("darwin", "x86_64", "arm64", env.New(), []string{"make"})
+	assert.Error(t, err)
+
+	_, err = archCommand("linux", "x86_64", "arm64", env.New(), []string{"make"})
+	assert.Error(t, err)
+
+	cmd, err := archCommand("linux", "x86_64", "amd64", env.New(), []string{"make"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make"}, cmd)
+}
@@ -44,6 +44,13 @@ type Bootstrap struct {
 	// Directories to clean up at end of bootstrap
 	cleanupDirs []string
 
+	// The encrypted volume the checkout is on, if there is one
+	encryptedWorkspace *encryptedWorkspace
+
+	// Lets hooks read and change the job's environment with
+	// `buildkite-agent env`
+	envServer *envServer
+
 	// A channel to track cancellation
 	cancelCh chan struct{}
 }
@@ -134,6 +141,13 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	if phaseErr == nil && includePhase(`command`) {
 		phaseErr = b.CommandPhase()
 
+		// Only check outputs of commands that succeeded
+		if exitStatus, _ := b.shell.Env.Get(`BUILDKITE_COMMAND_EXIT_STATUS`); phaseErr == nil && exitStatus == "0" {
+			if err := b.checkReproducibility(); err != nil {
+				b.shell.Warningf("Failed to check outputs are reproducible: %v", err)
+			}
+		}
+
 		// Only upload artifacts as part of the command phase
 		if err := b.uploadArtifacts(); err != nil {
 			b.shell.Errorf("%v", err)
@@ -199,8 +213,13 @@ func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.
 		b.shell.Promptf("%s", process.FormatCommand(cleanHookPath, []string{}))
 	}
 
-	// Run the wrapper script
-	if err := b.shell.RunScript(script.Path(), extraEnviron); err != nil {
+	// Run the wrapper script, with the job's environment available to it
+	// over the env server too
+	b.envServer.startHook(b.shell.Env)
+	err = b.shell.RunScript(script.Path(), extraEnviron)
+	serverChanges := b.envServer.finishHook()
+
+	if err != nil {
 		exitCode := shell.GetExitCode(err)
 		b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", exitCode))
 
@@ -223,8 +242,18 @@ func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.
 		return errors.Wrapf(err, "Failed to get environment")
 	}
 
+	// Changes made with `buildkite-agent env set` win over those made with
+	// export, as they're more deliberate
+	environ := changes.Env
+	if serverChanges != nil && serverChanges.Length() > 0 {
+		if environ == nil {
+			environ = env.New()
+		}
+		environ = environ.Merge(serverChanges)
+	}
+
 	// Finally, apply changes to the current shell and config
-	b.applyEnvironmentChanges(changes.Env, changes.Dir)
+	b.applyEnvironmentChanges(environ, changes.Dir)
 	return nil
 }
 
@@ -249,12 +278,12 @@ func (b *Bootstrap) applyEnvironmentChanges(environ *env.Environment, dir string
 		// environment variable contains sensitive information (i.e.
 		// THIRD_PARTY_API_KEY) we'll just not show any values for
 		// anything not controlled by us.
-		for k, v := range environ.ToMap() {
-			_, ok := bootstrapConfigEnvChanges[k]
-			if ok {
-				b.shell.Commentf("%s is now %q", k, v)
+		for _, kv := range environ.ToSlice() {
+			parts := strings.SplitN(kv, "=", 2)
+			if _, ok := bootstrapConfigEnvChanges[parts[0]]; ok {
+				b.shell.Commentf("%s is now %q", parts[0], parts[1])
 			} else {
-				b.shell.Commentf("%s changed", k)
+				b.shell.Commentf("%s changed", parts[0])
 			}
 		}
 
@@ -399,6 +428,17 @@ func (b *Bootstrap) setUp() error {
 	// Create an empty env for us to keep track of our env changes in
 	b.shell.Env = env.FromSlice(os.Environ())
 
+	// Start the server that hooks can read and change the environment with,
+	// which isn't worth failing the job over if it can't start
+	b.envServer = &envServer{}
+	if err := b.envServer.Listen(); err != nil {
+		b.shell.Warningf("Failed to start the job environment server, `buildkite-agent env` won't work in hooks: %v", err)
+		b.envServer = nil
+	} else {
+		b.shell.Env.Set(EnvServerEndpointEnv, b.envServer.Endpoint())
+		b.shell.Env.Set(EnvServerTokenEnv, b.envServer.token)
+	}
+
 	// Add the $BUILDKITE_BIN_PATH to the $PATH if we've been given one
 	if b.BinPath != "" {
 		path, _ := b.shell.Env.Get("PATH")
@@ -433,10 +473,8 @@ func (b *Bootstrap) setUp() error {
 	if b.Debug {
 		b.shell.Headerf("Buildkite environment variables")
 		for _, e := range b.shell.Env.ToSlice() {
-			if strings.HasPrefix(e, "BUILDKITE_AGENT_ACCESS_TOKEN=") {
-				b.shell.Printf("BUILDKITE_AGENT_ACCESS_TOKEN=******************")
-			} else if strings.HasPrefix(e, "BUILDKITE") || strings.HasPrefix(e, "CI") || strings.HasPrefix(e, "PATH") {
-				b.shell.Printf("%s", strings.Replace(e, "\n", "\\n", -1))
+			if strings.HasPrefix(e, "BUILDKITE") || strings.HasPrefix(e, "CI") || strings.HasPrefix(e, "PATH") {
+				b.shell.Printf("%s", strings.Replace(maskSecretEnv(e), "\n", "\\n", -1))
 			}
 		}
 	}
@@ -450,8 +488,30 @@ func (b *Bootstrap) setUp() error {
 	return b.executeGlobalHook("environment")
 }
 
+// The env that holds credentials, which are masked when the environment is
+// shown in debug mode. The artifact proxy's URL contains its token.
+var secretEnv = []string{
+	`BUILDKITE_AGENT_ACCESS_TOKEN`,
+	EnvServerTokenEnv,
+	`BUILDKITE_ARTIFACT_PROXY_URL`,
+}
+
+// maskSecretEnv hides the value of a NAME=value pair if it's a credential
+func maskSecretEnv(e string) string {
+	name := strings.SplitN(e, "=", 2)[0]
+	for _, secret := range secretEnv {
+		if name == secret {
+			return name + "=******************"
+		}
+	}
+	return e
+}
+
 // tearDown is called before the bootstrap exits, even on error
 func (b *Bootstrap) tearDown() error {
+	// The env server is still needed by pre-exit hooks
+	defer b.envServer.Close()
+
 	if err := b.executeGlobalHook("pre-exit"); err != nil {
 		return err
 	}
@@ -469,6 +529,10 @@ func (b *Bootstrap) tearDown() error {
 		return tearDownDeprecatedDockerIntegration(b.shell)
 	}
 
+	if err := b.destroyEncryptedWorkspace(); err != nil {
+		return err
+	}
+
 	for _, dir := range b.cleanupDirs {
 		if err := os.RemoveAll(dir); err != nil {
 			b.shell.Warningf("Failed to remove dir %s: %v", dir, err)
@@ -841,12 +905,36 @@ func (b *Bootstrap) CheckoutPhase() error {
 		return err
 	}
 
-	// Remove the checkout directory if BUILDKITE_CLEAN_CHECKOUT is present
-	if b.CleanCheckout {
+	// Checkouts can be cleaned every so often, instead of every time
+	scheduleCleans := b.CleanCheckoutEvery != "" && b.Config.Repository != "" && !b.EncryptedWorkspace
+	var scheduledClean string
+	if scheduleCleans && !b.CleanCheckout {
+		var err error
+		if scheduledClean, err = b.scheduledCleanCheckout(time.Now()); err != nil {
+			return err
+		}
+	}
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	freshCheckout := !fileExists(checkoutPath)
+
+	// Remove the checkout directory if BUILDKITE_CLEAN_CHECKOUT is present,
+	// or if it's due to be cleaned
+	if b.CleanCheckout || scheduledClean != "" {
 		b.shell.Headerf("Cleaning pipeline checkout")
+		if scheduledClean != "" {
+			b.shell.Commentf("Cleaning the checkout, as %s", scheduledClean)
+		}
 		if err := b.removeCheckoutDir(); err != nil {
 			return err
 		}
+		freshCheckout = true
+	}
+
+	if scheduleCleans {
+		if err := b.recordCheckoutUse(freshCheckout, time.Now()); err != nil {
+			b.shell.Warningf("Failed to record the use of the checkout: %v", err)
+		}
 	}
 
 	b.shell.Headerf("Preparing working directory")
@@ -863,6 +951,13 @@ func (b *Bootstrap) CheckoutPhase() error {
 		b.cleanupDirs = append(b.cleanupDirs, buildDir)
 	}
 
+	// Put the checkout on a new encrypted volume if we've been asked to
+	if b.EncryptedWorkspace {
+		if err := b.createEncryptedWorkspace(); err != nil {
+			return err
+		}
+	}
+
 	// Make sure the build directory exists
 	if err := b.createCheckoutDir(); err != nil {
 		return err
@@ -1399,6 +1494,20 @@ func (b *Bootstrap) defaultCommandPhase() error {
 	cmd = append(cmd, shell...)
 	cmd = append(cmd, cmdToExec)
 
+	// Run the command as a different architecture if one was requested. The
+	// environment changes only apply to the command.
+	if b.Arch != "" {
+		originalEnv := b.shell.Env.Copy()
+		defer func() { b.shell.Env = originalEnv }()
+
+		host := hostArch()
+		b.shell.Commentf("Running command as %s on a %s host", b.Arch, host)
+
+		if cmd, err = archCommand(runtime.GOOS, host, b.Arch, b.shell.Env, cmd); err != nil {
+			return err
+		}
+	}
+
 	if b.Debug {
 		b.shell.Promptf("%s", process.FormatCommand(cmd[0], cmd[1:]))
 	} else {
@@ -22,3 +22,16 @@ func TestDirForAgentName(t *testing.T) {
 		assert.Equal(t, test.expected, dirForAgentName(test.agentName))
 	}
 }
+
+func TestMaskSecretEnv(t *testing.T) {
+	for _, e := range []string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN=llamas",
+		"BUILDKITE_JOB_ENV_TOKEN=llamas",
+		"BUILDKITE_ARTIFACT_PROXY_URL=http://127.0.0.1:1234/llamas",
+	} {
+		assert.NotContains(t, maskSecretEnv(e), "llamas")
+	}
+
+	assert.Equal(t, "BUILDKITE_JOB_ENV_ENDPOINT=/tmp/env.sock", maskSecretEnv("BUILDKITE_JOB_ENV_ENDPOINT=/tmp/env.sock"))
+	assert.Equal(t, "BUILDKITE_AGENT_ACCESS_TOKENS=llamas", maskSecretEnv("BUILDKITE_AGENT_ACCESS_TOKENS=llamas"))
+}
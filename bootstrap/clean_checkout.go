@@ -0,0 +1,138 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CleanCheckoutPolicy is how often a checkout is removed and cloned again,
+// so that untracked files and the side effects of hooks can't build up in it
+// forever. Whichever of the limits is reached first applies.
+type CleanCheckoutPolicy struct {
+	// How many jobs can use a checkout before it's cleaned, if limited
+	Jobs int
+
+	// How long a checkout can be used for before it's cleaned, if limited
+	Interval time.Duration
+}
+
+// ParseCleanCheckoutPolicy parses a policy like "50-jobs", "24h" or
+// "50-jobs,24h". An empty string is a policy that never cleans checkouts.
+func ParseCleanCheckoutPolicy(s string) (CleanCheckoutPolicy, error) {
+	var policy CleanCheckoutPolicy
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if n := strings.TrimSuffix(part, "-jobs"); n != part {
+			jobs, err := strconv.Atoi(n)
+			if err != nil || jobs < 1 {
+				return policy, fmt.Errorf("Invalid clean checkout job count %q, expected something like 50-jobs", part)
+			}
+			policy.Jobs = jobs
+			continue
+		}
+
+		interval, err := time.ParseDuration(part)
+		if err != nil || interval <= 0 {
+			return policy, fmt.Errorf("Invalid clean checkout interval %q, expected something like 24h or 50-jobs", part)
+		}
+		policy.Interval = interval
+	}
+
+	return policy, nil
+}
+
+// cleanCheckoutState is how much a checkout has been used since it was
+// last cleaned
+type cleanCheckoutState struct {
+	CleanedAt time.Time `json:"cleaned_at"`
+	Jobs      int       `json:"jobs"`
+}
+
+// due returns why the checkout needs cleaning under the policy, or "" if it
+// doesn't yet
+func (s cleanCheckoutState) due(policy CleanCheckoutPolicy, now time.Time) string {
+	if policy.Jobs > 0 && s.Jobs >= policy.Jobs {
+		return fmt.Sprintf("it has been used by %d jobs since it was last cleaned", s.Jobs)
+	}
+
+	if policy.Interval > 0 && now.Sub(s.CleanedAt) >= policy.Interval {
+		return fmt.Sprintf("it was last cleaned %s ago", now.Sub(s.CleanedAt).Round(time.Minute))
+	}
+
+	return ""
+}
+
+// cleanCheckoutStatePath returns where the state of a checkout is kept. It's
+// beside the checkout, so that it outlasts the checkout being removed.
+func cleanCheckoutStatePath(checkoutPath string) string {
+	return filepath.Join(filepath.Dir(checkoutPath), "."+filepath.Base(checkoutPath)+".buildkite-checkout")
+}
+
+func readCleanCheckoutState(path string) (cleanCheckoutState, bool) {
+	var state cleanCheckoutState
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false
+	}
+
+	return state, true
+}
+
+// scheduledCleanCheckout returns why the checkout should be cleaned under
+// the --clean-checkout-every policy, or "" if it shouldn't be. Checkouts
+// that haven't been seen before start being tracked from now, unless they
+// don't exist yet, in which case they're about to be fresh anyway.
+func (b *Bootstrap) scheduledCleanCheckout(now time.Time) (string, error) {
+	policy, err := ParseCleanCheckoutPolicy(b.CleanCheckoutEvery)
+	if err != nil {
+		return "", err
+	}
+
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+
+	state, ok := readCleanCheckoutState(cleanCheckoutStatePath(checkoutPath))
+	if !ok || !fileExists(checkoutPath) {
+		return "", nil
+	}
+
+	return state.due(policy, now), nil
+}
+
+// recordCheckoutUse counts this job's use of the checkout towards the
+// --clean-checkout-every policy, starting again if it was cleaned
+func (b *Bootstrap) recordCheckoutUse(cleaned bool, now time.Time) error {
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	path := cleanCheckoutStatePath(checkoutPath)
+
+	state, ok := readCleanCheckoutState(path)
+	if cleaned || !ok {
+		state = cleanCheckoutState{CleanedAt: now}
+	}
+	state.Jobs++
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
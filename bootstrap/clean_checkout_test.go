@@ -0,0 +1,80 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCleanCheckoutPolicy(t *testing.T) {
+	for s, expected := range map[string]CleanCheckoutPolicy{
+		"":            {},
+		"50-jobs":     {Jobs: 50},
+		"24h":         {Interval: 24 * time.Hour},
+		"50-jobs,24h": {Jobs: 50, Interval: 24 * time.Hour},
+		" 1-jobs , ":  {Jobs: 1},
+	} {
+		policy, err := ParseCleanCheckoutPolicy(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, expected, policy, s)
+		}
+	}
+
+	for _, s := range []string{"0-jobs", "lots-jobs", "-1h", "50", "daily"} {
+		_, err := ParseCleanCheckoutPolicy(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCleanCheckoutStateDue(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	policy := CleanCheckoutPolicy{Jobs: 3, Interval: 24 * time.Hour}
+
+	assert.Equal(t, "", cleanCheckoutState{CleanedAt: now.Add(-time.Hour), Jobs: 2}.due(policy, now))
+	assert.Equal(t, "it has been used by 3 jobs since it was last cleaned", cleanCheckoutState{CleanedAt: now.Add(-time.Hour), Jobs: 3}.due(policy, now))
+	assert.Equal(t, "it was last cleaned 25h0m0s ago", cleanCheckoutState{CleanedAt: now.Add(-25 * time.Hour), Jobs: 1}.due(policy, now))
+}
+
+func TestScheduledCleanCheckoutCountsJobsSinceTheLastClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clean-checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkoutPath := filepath.Join(dir, "llamas")
+
+	b := New(Config{CleanCheckoutEvery: "2-jobs"})
+	b.shell = newTestShell(t)
+	b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkoutPath)
+
+	now := time.Now()
+
+	// A checkout that doesn't exist yet is about to be fresh
+	reason, err := b.scheduledCleanCheckout(now)
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+	assert.NoError(t, b.recordCheckoutUse(true, now))
+
+	if err := os.MkdirAll(checkoutPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	reason, err = b.scheduledCleanCheckout(now)
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+	assert.NoError(t, b.recordCheckoutUse(false, now))
+
+	reason, err = b.scheduledCleanCheckout(now)
+	assert.NoError(t, err)
+	assert.Equal(t, "it has been used by 2 jobs since it was last cleaned", reason)
+	assert.NoError(t, b.recordCheckoutUse(true, now))
+
+	state, ok := readCleanCheckoutState(cleanCheckoutStatePath(checkoutPath))
+	assert.True(t, ok)
+	assert.Equal(t, 1, state.Jobs)
+}
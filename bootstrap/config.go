@@ -61,6 +61,17 @@ type Config struct {
 	// Should the bootstrap remove an existing checkout before running the job
 	CleanCheckout bool
 
+	// How often the checkout should be removed before running a job, such as
+	// "50-jobs" or "24h"
+	CleanCheckoutEvery string
+
+	// Should the checkout be on an encrypted volume that's destroyed when the
+	// job finishes
+	EncryptedWorkspace bool
+
+	// The size of the encrypted volume, such as "10GB"
+	EncryptedWorkspaceSize string
+
 	// Flags to pass to "git clone" command
 	GitCloneFlags string `env:"BUILDKITE_GIT_CLONE_FLAGS"`
 
@@ -109,12 +120,19 @@ type Config struct {
 	// A custom destination to upload artifacts to (i.e. s3://...)
 	ArtifactUploadDestination string `env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
 
+	// Paths to outputs that are hashed to check the build is reproducible
+	ReproducibleOutputPaths string `env:"BUILDKITE_REPRODUCIBLE_OUTPUTS"`
+
 	// Whether ssh-keyscan is run on ssh hosts before checkout
 	SSHKeyscan bool
 
 	// The shell used to execute commands
 	Shell string
 
+	// The architecture to run the command as, such as x86_64 to use Rosetta
+	// on Apple Silicon Macs
+	Arch string `env:"BUILDKITE_ARCH"`
+
 	// Phases to execute, defaults to all phases
 	Phases []string
 }
@@ -2,6 +2,9 @@ package bootstrap
 
 import (
 	"fmt"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/buildkite/agent/bootstrap/shell"
@@ -17,6 +20,79 @@ var dockerEnv = []string{
 	`BUILDKITE_DOCKER_COMPOSE_LEAVE_VOLUMES`,
 }
 
+// Where the agent's sockets are mounted inside containers
+const containerSocketsDir = "/buildkite/sockets"
+
+// The env that in-container `buildkite-agent` subcommands need
+var containerAgentEnv = []string{
+	`BUILDKITE_JOB_ID`,
+	`BUILDKITE_BUILD_ID`,
+	`BUILDKITE_AGENT_ACCESS_TOKEN`,
+	`BUILDKITE_AGENT_ENDPOINT`,
+	`BUILDKITE_ARTIFACT_PROXY_URL`,
+}
+
+// containerAgentArgs returns `docker run` arguments that forward the job's
+// API and artifact proxy sockets into the container, rewriting the env that
+// refers to them so that `buildkite-agent` subcommands still work. Env that
+// isn't rewritten is passed by name, so that the access token isn't shown in
+// the command.
+//
+// Containers only get the agent's credentials when
+// BUILDKITE_DOCKER_FORWARD_AGENT is set to true.
+func containerAgentArgs(sh *shell.Shell) []string {
+	if forward, _ := sh.Env.Get(`BUILDKITE_DOCKER_FORWARD_AGENT`); forward != "true" {
+		return nil
+	}
+
+	environ := map[string]string{}
+	for _, name := range containerAgentEnv {
+		if sh.Env.Exists(name) {
+			environ[name] = ""
+		}
+	}
+
+	var args []string
+	var mount = func(hostPath string, name string) string {
+		containerPath := path.Join(containerSocketsDir, name)
+		args = append(args, "-v", hostPath+":"+containerPath)
+		return containerPath
+	}
+
+	// The API proxy from the agent-socket experiment
+	if endpoint, _ := sh.Env.Get(`BUILDKITE_AGENT_ENDPOINT`); strings.HasPrefix(endpoint, "unix://") {
+		environ[`BUILDKITE_AGENT_ENDPOINT`] = "unix://" + mount(strings.TrimPrefix(endpoint, "unix://"), "agent-api.sock")
+	}
+
+	// localhost in the container isn't the host, so the artifact proxy is
+	// used through its socket instead
+	if socket, ok := sh.Env.Get(`BUILDKITE_ARTIFACT_PROXY_SOCKET`); ok && socket != "" {
+		environ[`BUILDKITE_ARTIFACT_PROXY_SOCKET`] = mount(socket, "artifact-proxy.sock")
+
+		rawURL, _ := sh.Env.Get(`BUILDKITE_ARTIFACT_PROXY_URL`)
+		if proxyURL, err := url.Parse(rawURL); err == nil {
+			proxyURL.Host = "localhost"
+			environ[`BUILDKITE_ARTIFACT_PROXY_URL`] = proxyURL.String()
+		}
+	}
+
+	var names []string
+	for name := range environ {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if environ[name] == "" {
+			args = append(args, "-e", name)
+		} else {
+			args = append(args, "-e", name+"="+environ[name])
+		}
+	}
+
+	return args
+}
+
 func hasDeprecatedDockerIntegration(sh *shell.Shell) bool {
 	for _, k := range dockerEnv {
 		if sh.Env.Exists(k) {
@@ -102,7 +178,11 @@ func runDockerCommand(sh *shell.Shell, cmd []string) error {
 	}
 
 	sh.Headerf(":docker: Running command (in Docker container)")
-	if err := sh.Run("docker", append([]string{"run", "--name", dockerContainer, dockerImage}, cmd...)...); err != nil {
+	args := []string{"run", "--name", dockerContainer}
+	args = append(args, containerAgentArgs(sh)...)
+	args = append(args, dockerImage)
+
+	if err := sh.Run("docker", append(args, cmd...)...); err != nil {
 		return err
 	}
 
@@ -133,7 +213,11 @@ func runDockerComposeCommand(sh *shell.Shell, cmd []string) error {
 	}
 
 	sh.Headerf(":docker: Running command (in Docker Compose container)")
-	return runDockerCompose(sh, projectName, append([]string{"run", composeContainer}, cmd...)...)
+	args := []string{"run"}
+	args = append(args, containerAgentArgs(sh)...)
+	args = append(args, composeContainer)
+
+	return runDockerCompose(sh, projectName, append(args, cmd...)...)
 }
 
 func runDockerCompose(sh *shell.Shell, projectName string, commandArgs ...string) error {
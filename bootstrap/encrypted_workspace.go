@@ -0,0 +1,93 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/utils"
+)
+
+// encryptedWorkspace is an encrypted volume mounted over the checkout
+// directory for the length of a job. Its key only ever exists in memory, so
+// once it's destroyed nothing written to it can be read back, even from the
+// file that backed it.
+type encryptedWorkspace struct {
+	// Where the volume is mounted
+	mountPoint string
+
+	// The file that backs the volume
+	imagePath string
+
+	// The loop device (Linux) the image is attached as
+	loopDevice string
+
+	// The name of the dm-crypt mapping (Linux)
+	mapping string
+
+	// Whether the volume is mounted
+	mounted bool
+}
+
+// createEncryptedWorkspace mounts a new encrypted volume at the checkout path.
+// Anything already there is removed first, so that none of the job's files
+// are left on unencrypted disk from earlier jobs.
+func (b *Bootstrap) createEncryptedWorkspace() error {
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+
+	size, err := utils.ParseByteSize(b.EncryptedWorkspaceSize)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("The encrypted workspace size must be more than 0")
+	}
+
+	b.shell.Headerf("Creating an encrypted workspace")
+
+	if fileExists(checkoutPath) {
+		if err := b.removeCheckoutDir(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(checkoutPath, 0777); err != nil {
+		return err
+	}
+
+	// The image sits next to the checkout, as the temp dir is often a small
+	// tmpfs that's shared with everything else on the host
+	image := filepath.Join(filepath.Dir(checkoutPath), fmt.Sprintf(".buildkite-workspace-%s", b.JobID))
+
+	b.shell.Commentf("Mounting a %s encrypted volume at %s", utils.FormatByteSize(size), checkoutPath)
+
+	ws, err := mountEncryptedWorkspace(b.shell, checkoutPath, image, size, "buildkite-"+b.JobID)
+	if err != nil {
+		return fmt.Errorf("Failed to create an encrypted workspace: %v", err)
+	}
+
+	b.encryptedWorkspace = ws
+	return nil
+}
+
+// destroyEncryptedWorkspace unmounts the encrypted volume, if there is one,
+// and removes the file that backed it
+func (b *Bootstrap) destroyEncryptedWorkspace() error {
+	if b.encryptedWorkspace == nil {
+		return nil
+	}
+
+	b.shell.Headerf("Destroying the encrypted workspace")
+
+	// Nothing can be running in the volume while it's unmounted
+	if err := b.shell.Chdir(filepath.Dir(b.encryptedWorkspace.mountPoint)); err != nil {
+		return err
+	}
+
+	if err := b.encryptedWorkspace.destroy(b.shell); err != nil {
+		return fmt.Errorf("Failed to destroy the encrypted workspace: %v", err)
+	}
+
+	b.encryptedWorkspace = nil
+	return nil
+}
@@ -0,0 +1,86 @@
+package bootstrap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+	"github.com/buildkite/agent/process"
+)
+
+// mountEncryptedWorkspace creates an encrypted APFS sparse image with a
+// random passphrase, which is only ever given to hdiutil on stdin, and
+// mounts it without it showing up in the Finder
+func mountEncryptedWorkspace(sh *shell.Shell, mountPoint, image string, size int64, name string) (*encryptedWorkspace, error) {
+	ws := &encryptedWorkspace{mountPoint: mountPoint}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	passphrase := hex.EncodeToString(key)
+
+	// hdiutil adds the extension to sparse images itself
+	os.Remove(image + ".sparseimage")
+
+	megabytes := (size + (1<<20 - 1)) >> 20
+	if err := runWithStdin(sh, passphrase, "hdiutil", "create",
+		"-size", fmt.Sprintf("%dm", megabytes),
+		"-type", "SPARSE", "-fs", "APFS", "-volname", name,
+		"-encryption", "AES-256", "-stdinpass", image); err != nil {
+		return nil, err
+	}
+	ws.imagePath = image + ".sparseimage"
+
+	if err := runWithStdin(sh, passphrase, "hdiutil", "attach",
+		"-stdinpass", "-nobrowse", "-mountpoint", mountPoint, ws.imagePath); err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+	ws.mounted = true
+
+	// The checkout needs an empty directory
+	os.RemoveAll(filepath.Join(mountPoint, ".fseventsd"))
+
+	return ws, nil
+}
+
+// destroy undoes as much of mountEncryptedWorkspace as was done. The
+// passphrase was never stored, so the image can't be opened again anyway.
+func (ws *encryptedWorkspace) destroy(sh *shell.Shell) error {
+	if ws.mounted {
+		if err := sh.Run("hdiutil", "detach", "-force", ws.mountPoint); err != nil {
+			return err
+		}
+		ws.mounted = false
+	}
+
+	if ws.imagePath != "" {
+		if err := os.Remove(ws.imagePath); err != nil {
+			return err
+		}
+		ws.imagePath = ""
+	}
+
+	return nil
+}
+
+// runWithStdin runs a command like sh.Run, but with stdin, which the shell
+// doesn't support
+func runWithStdin(sh *shell.Shell, stdin string, command string, arg ...string) error {
+	sh.Promptf("%s", process.FormatCommand(command, arg))
+
+	cmd := exec.Command(command, arg...)
+	cmd.Dir = sh.Getwd()
+	cmd.Env = sh.Env.ToSlice()
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = sh.Writer
+	cmd.Stderr = sh.Writer
+
+	return cmd.Run()
+}
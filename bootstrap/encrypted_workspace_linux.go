@@ -0,0 +1,103 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+)
+
+// mountEncryptedWorkspace creates a sparse image, attaches it as a loop device
+// and maps it with dm-crypt, using a random key read straight from
+// /dev/urandom by cryptsetup, so the key never leaves the kernel. Creating
+// loop devices and mappings needs root.
+func mountEncryptedWorkspace(sh *shell.Shell, mountPoint, image string, size int64, name string) (*encryptedWorkspace, error) {
+	ws := &encryptedWorkspace{mountPoint: mountPoint}
+
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ws.imagePath = image
+
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+
+	ws.loopDevice, err = sh.RunAndCapture("losetup", "--find", "--show", image)
+	if err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+
+	if err := sh.Run("cryptsetup", "open", "--type", "plain",
+		"--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--key-file", "/dev/urandom", "--keyfile-size", "64",
+		ws.loopDevice, name); err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+	ws.mapping = name
+
+	device := filepath.Join("/dev/mapper", name)
+
+	if err := sh.Run("mkfs.ext4", "-q", "-m", "0", device); err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+
+	if err := sh.Run("mount", device, mountPoint); err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+	ws.mounted = true
+
+	// The checkout needs an empty directory that the agent's user owns
+	if err := os.RemoveAll(filepath.Join(mountPoint, "lost+found")); err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+	if err := os.Chown(mountPoint, os.Getuid(), os.Getgid()); err != nil {
+		ws.destroy(sh)
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// destroy undoes as much of mountEncryptedWorkspace as was done. Once the
+// mapping is closed the key is gone, so the image is just random data.
+func (ws *encryptedWorkspace) destroy(sh *shell.Shell) error {
+	if ws.mounted {
+		if err := sh.Run("umount", ws.mountPoint); err != nil {
+			return err
+		}
+		ws.mounted = false
+	}
+
+	if ws.mapping != "" {
+		if err := sh.Run("cryptsetup", "close", ws.mapping); err != nil {
+			return err
+		}
+		ws.mapping = ""
+	}
+
+	if ws.loopDevice != "" {
+		if err := sh.Run("losetup", "--detach", ws.loopDevice); err != nil {
+			return err
+		}
+		ws.loopDevice = ""
+	}
+
+	if ws.imagePath != "" {
+		if err := os.Remove(ws.imagePath); err != nil {
+			return err
+		}
+		ws.imagePath = ""
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build !linux,!darwin
+
+package bootstrap
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+)
+
+func mountEncryptedWorkspace(sh *shell.Shell, mountPoint, image string, size int64, name string) (*encryptedWorkspace, error) {
+	return nil, fmt.Errorf("Encrypted workspaces aren't supported on %s", runtime.GOOS)
+}
+
+func (ws *encryptedWorkspace) destroy(sh *shell.Shell) error {
+	return nil
+}
@@ -0,0 +1,40 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateEncryptedWorkspaceRejectsBadSizesBeforeRemovingCheckout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := filepath.Join(dir, "README")
+	if err := ioutil.WriteFile(existing, []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []string{"", "0", "lots"} {
+		b := New(Config{EncryptedWorkspace: true, EncryptedWorkspaceSize: size, JobID: "llamas"})
+		b.shell = newTestShell(t)
+		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", dir)
+
+		assert.Error(t, b.createEncryptedWorkspace(), size)
+		assert.Nil(t, b.encryptedWorkspace)
+		assert.True(t, fileExists(existing))
+	}
+}
+
+func TestDestroyEncryptedWorkspaceWithoutOneDoesNothing(t *testing.T) {
+	b := New(Config{})
+	b.shell = newTestShell(t)
+
+	assert.NoError(t, b.destroyEncryptedWorkspace())
+}
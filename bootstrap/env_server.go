@@ -0,0 +1,294 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/env"
+)
+
+// The environment variables that tell `buildkite-agent env` how to reach the
+// bootstrap's env server
+const (
+	EnvServerEndpointEnv = "BUILDKITE_JOB_ENV_ENDPOINT"
+	EnvServerTokenEnv    = "BUILDKITE_JOB_ENV_TOKEN"
+)
+
+// envServer lets programs run by hooks that aren't written in bash, such as
+// Python or PowerShell scripts, read and change the job's environment with
+// `buildkite-agent env`. Like the changes bash hooks make with export, the
+// changes are only applied once the hook succeeds, so the server only
+// answers while a hook is running.
+//
+// It listens on a unix socket that only the bootstrap's user can use, or on
+// localhost on windows, and requests need the token it's given to the job.
+type envServer struct {
+	token      string
+	listener   net.Listener
+	socketPath string
+
+	mu      sync.Mutex
+	env     *env.Environment
+	changes *env.Environment
+}
+
+// Listen starts serving requests in the background
+func (s *envServer) Listen() error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	s.token = fmt.Sprintf("%x", token)
+
+	if runtime.GOOS == "windows" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		s.listener = l
+	} else {
+		socket, err := ioutil.TempFile("", "job-env-socket")
+		if err != nil {
+			return err
+		}
+		socket.Close()
+
+		// The socket can't be created while the temp file exists
+		_ = os.Remove(socket.Name())
+
+		l, err := net.Listen("unix", socket.Name())
+		if err != nil {
+			return err
+		}
+		s.listener = l
+		s.socketPath = socket.Name()
+
+		// Restrict to owner r+w permissions
+		if err = os.Chmod(socket.Name(), 0600); err != nil {
+			s.Close()
+			return err
+		}
+	}
+
+	go func() {
+		_ = http.Serve(s.listener, s)
+	}()
+
+	return nil
+}
+
+// Endpoint returns where the server is listening, either unix:// and the
+// path of a socket, or http:// and an address on localhost
+func (s *envServer) Endpoint() string {
+	if s.socketPath != "" {
+		return "unix://" + s.socketPath
+	}
+	return "http://" + s.listener.Addr().String()
+}
+
+// Close stops the server
+func (s *envServer) Close() error {
+	if s == nil || s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	if s.socketPath != "" {
+		_ = os.Remove(s.socketPath)
+	}
+	return err
+}
+
+// startHook lets a hook that's about to run with environ read and change it
+func (s *envServer) startHook(environ *env.Environment) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.env = environ.Copy()
+	s.changes = env.New()
+}
+
+// finishHook stops the hook that was running from making any more changes,
+// and returns the changes it made
+func (s *envServer) finishHook() *env.Environment {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := s.changes
+	s.env = nil
+	s.changes = nil
+
+	return changes
+}
+
+func (s *envServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Token "+s.token {
+		writeEnvError(w, http.StatusUnauthorized, "Invalid authorization token")
+		return
+	}
+
+	if r.URL.Path != "/env" {
+		writeEnvError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.env == nil {
+		writeEnvError(w, http.StatusConflict, "The job's environment can only be used while a hook is running")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeEnvJSON(w, http.StatusOK, s.env.ToMap())
+
+	case "PATCH":
+		var changes map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			writeEnvError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse the changes: %v", err))
+			return
+		}
+
+		for key := range changes {
+			if err := validateEnvKey(key); err != nil {
+				writeEnvError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		for key, value := range changes {
+			s.env.Set(key, value)
+			s.changes.Set(key, value)
+		}
+
+		writeEnvJSON(w, http.StatusOK, s.env.ToMap())
+
+	default:
+		writeEnvError(w, http.StatusMethodNotAllowed, "Only GET and PATCH are supported")
+	}
+}
+
+func validateEnvKey(key string) error {
+	if key == "" || strings.ContainsAny(key, "=\x00") {
+		return fmt.Errorf("Invalid environment variable name %q", key)
+	}
+	return nil
+}
+
+type envError struct {
+	Message string `json:"message"`
+}
+
+func writeEnvError(w http.ResponseWriter, status int, message string) {
+	writeEnvJSON(w, status, envError{Message: message})
+}
+
+func writeEnvJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// EnvClient reads and changes the environment of a running job, from one of
+// its hooks
+type EnvClient struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// NewEnvClient returns a client for the env server at endpoint, as given to
+// jobs in BUILDKITE_JOB_ENV_ENDPOINT and BUILDKITE_JOB_ENV_TOKEN
+func NewEnvClient(endpoint, token string) (*EnvClient, error) {
+	c := &EnvClient{
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		socket := strings.TrimPrefix(endpoint, "unix://")
+		c.baseURL = "http://buildkite-agent"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+
+	case strings.HasPrefix(endpoint, "http://"):
+		c.baseURL = strings.TrimSuffix(endpoint, "/")
+
+	default:
+		return nil, fmt.Errorf("Unsupported job environment endpoint %q, this command must be run from a hook", endpoint)
+	}
+
+	return c, nil
+}
+
+// Dump returns the job's environment, including changes made by the hook
+func (c *EnvClient) Dump() (map[string]string, error) {
+	return c.do("GET", nil)
+}
+
+// Set changes variables in the job's environment, which apply to the rest
+// of the job once the hook succeeds
+func (c *EnvClient) Set(changes map[string]string) (map[string]string, error) {
+	return c.do("PATCH", changes)
+}
+
+func (c *EnvClient) do(method string, body interface{}) (map[string]string, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+"/env", &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e envError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			return nil, fmt.Errorf("%s %s: %s", method, req.URL, resp.Status)
+		}
+		return nil, fmt.Errorf("%s", e.Message)
+	}
+
+	var environ map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&environ); err != nil {
+		return nil, err
+	}
+	return environ, nil
+}
@@ -0,0 +1,70 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvServer(t *testing.T) {
+	t.Parallel()
+
+	s := &envServer{}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	client, err := NewEnvClient(s.Endpoint(), s.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing can be read or changed outside of a hook
+	_, err = client.Dump()
+	assert.EqualError(t, err, "The job's environment can only be used while a hook is running")
+
+	s.startHook(env.FromSlice([]string{"LLAMAS=rock"}))
+
+	environ, err := client.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"LLAMAS": "rock"}, environ)
+
+	environ, err = client.Set(map[string]string{"ALPACAS": "are ok", "LLAMAS": "rock harder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"ALPACAS": "are ok", "LLAMAS": "rock harder"}, environ)
+
+	_, err = client.Set(map[string]string{"BAD=KEY": "llamas"})
+	assert.EqualError(t, err, `Invalid environment variable name "BAD=KEY"`)
+
+	changes := s.finishHook()
+	assert.Equal(t, []string{"ALPACAS=are ok", "LLAMAS=rock harder"}, changes.ToSlice())
+
+	_, err = client.Set(map[string]string{"LLAMAS": "too late"})
+	assert.Error(t, err)
+}
+
+func TestEnvServerNeedsTheToken(t *testing.T) {
+	t.Parallel()
+
+	s := &envServer{}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.startHook(env.New())
+
+	client, err := NewEnvClient(s.Endpoint(), "llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Dump()
+	assert.EqualError(t, err, "Invalid authorization token")
+}
@@ -14,6 +14,7 @@ import (
 const (
 	hookExitStatusEnv = `BUILDKITE_HOOK_EXIT_STATUS`
 	hookWorkingDirEnv = `BUILDKITE_HOOK_WORKING_DIR`
+	hookEnvFileEnv    = `BUILDKITE_HOOK_ENV_FILE`
 )
 
 // Hooks get "sourced" into the bootstrap in the sense that they get the
@@ -26,6 +27,11 @@ const (
 // Then we can use the diff of the two to figure out what changes to make to the
 // bootstrap. Horrible, but effective.
 
+// Diffing doesn't cope with every value (multi-line values can confuse the
+// parsing of `export -p`, and batch scripts can't export them at all), so hooks
+// can also write variables to the file in $BUILDKITE_HOOK_ENV_FILE, in the
+// format described by env.FromExports. Those take precedence over the diff.
+
 // hookScriptWrapper wraps a hook script with env collection and then provides
 // a way to get the difference between the environment before the hook is run and
 // after it
@@ -34,6 +40,7 @@ type hookScriptWrapper struct {
 	scriptFile    *os.File
 	beforeEnvFile *os.File
 	afterEnvFile  *os.File
+	exportsFile   *os.File
 	beforeWd      string
 }
 
@@ -84,6 +91,15 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	}
 	h.afterEnvFile.Close()
 
+	// And the hook can write the variables it exports to this one
+	h.exportsFile, err = shell.TempFileWithExtension(
+		`buildkite-agent-bootstrap-hook-env-exports`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	h.exportsFile.Close()
+
 	absolutePathToHook, err := filepath.Abs(h.hookPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to \"%s\" (%s)", h.hookPath, err)
@@ -99,6 +115,7 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	if runtime.GOOS == "windows" && !isBashHook {
 		script = "@echo off\n" +
 			"SETLOCAL ENABLEDELAYEDEXPANSION\n" +
+			"SET \"" + hookEnvFileEnv + "=" + h.exportsFile.Name() + "\"\n" +
 			"SET > \"" + h.beforeEnvFile.Name() + "\"\n" +
 			"CALL \"" + absolutePathToHook + "\"\n" +
 			"SET " + hookExitStatusEnv + "=!ERRORLEVEL!\n" +
@@ -106,7 +123,8 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 			"SET > \"" + h.afterEnvFile.Name() + "\"\n" +
 			"EXIT %" + hookExitStatusEnv + "%"
 	} else {
-		script = "export -p > \"" + filepath.ToSlash(h.beforeEnvFile.Name()) + "\"\n" +
+		script = "export " + hookEnvFileEnv + "=\"" + filepath.ToSlash(h.exportsFile.Name()) + "\"\n" +
+			"export -p > \"" + filepath.ToSlash(h.beforeEnvFile.Name()) + "\"\n" +
 			". \"" + filepath.ToSlash(absolutePathToHook) + "\"\n" +
 			"export " + hookExitStatusEnv + "=$?\n" +
 			"export " + hookWorkingDirEnv + "=$PWD\n" +
@@ -139,6 +157,7 @@ func (h *hookScriptWrapper) Close() {
 	os.Remove(h.scriptFile.Name())
 	os.Remove(h.beforeEnvFile.Name())
 	os.Remove(h.afterEnvFile.Name())
+	os.Remove(h.exportsFile.Name())
 }
 
 // Changes returns the changes in the environment and working dir after the hook script runs
@@ -153,13 +172,26 @@ func (h *hookScriptWrapper) Changes() (hookScriptChanges, error) {
 		return hookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", h.afterEnvFile.Name(), err)
 	}
 
+	exportsFile, err := os.Open(h.exportsFile.Name())
+	if err != nil {
+		return hookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", h.exportsFile.Name(), err)
+	}
+	defer exportsFile.Close()
+
+	exports, err := env.FromExports(exportsFile)
+	if err != nil {
+		return hookScriptChanges{}, fmt.Errorf("Failed to read the variables written to $%s (%s)", hookEnvFileEnv, err)
+	}
+
 	beforeEnv := env.FromExport(string(beforeEnvContents))
 	afterEnv := env.FromExport(string(afterEnvContents))
 	diff := afterEnv.Diff(beforeEnv)
 	wd, _ := diff.Get(hookWorkingDirEnv)
 
+	diff = diff.Merge(exports)
 	diff.Remove(hookExitStatusEnv)
 	diff.Remove(hookWorkingDirEnv)
+	diff.Remove(hookEnvFileEnv)
 
 	return hookScriptChanges{Env: diff, Dir: wd}, nil
 }
@@ -53,6 +53,54 @@ func TestRunningHookDetectsChangedEnvironment(t *testing.T) {
 	}
 }
 
+func TestRunningHookReadsExportedEnvironmentFile(t *testing.T) {
+	t.Parallel()
+
+	var script []string
+
+	if runtime.GOOS != "windows" {
+		script = []string{
+			"#!/bin/bash",
+			"export LLAMAS=\"are ok\"",
+			"echo \"LLAMAS=rock\" >> \"$BUILDKITE_HOOK_ENV_FILE\"",
+			"printf 'NOTES<<EOF\\nline one\\nline \"two\"\\nEOF\\n' >> \"$BUILDKITE_HOOK_ENV_FILE\"",
+		}
+	} else {
+		script = []string{
+			"@echo off",
+			"set LLAMAS=are ok",
+			"echo LLAMAS=rock>> \"%BUILDKITE_HOOK_ENV_FILE%\"",
+			"echo NOTES^<^<EOF>> \"%BUILDKITE_HOOK_ENV_FILE%\"",
+			"echo line one>> \"%BUILDKITE_HOOK_ENV_FILE%\"",
+			"echo line \"two\">> \"%BUILDKITE_HOOK_ENV_FILE%\"",
+			"echo EOF>> \"%BUILDKITE_HOOK_ENV_FILE%\"",
+		}
+	}
+
+	wrapper := newTestHookWrapper(t, script)
+	defer wrapper.Close()
+
+	sh := newTestShell(t)
+
+	if err := sh.RunScript(wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables written to the file win over ones that were exported
+	expected := env.New()
+	expected.Set("LLAMAS", "rock")
+	expected.Set("NOTES", "line one\nline \"two\"")
+
+	if !reflect.DeepEqual(changes.Env, expected) {
+		t.Fatalf("Unexpected env in %#v", changes.Env)
+	}
+}
+
 func TestRunningHookDetectsChangedWorkingDirectory(t *testing.T) {
 	t.Parallel()
 
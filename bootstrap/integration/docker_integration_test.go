@@ -271,3 +271,48 @@ func expectCommandHooks(exitStatus string, t *testing.T, tester *BootstrapTester
 	tester.ExpectGlobalHook("pre-exit").Once().AndCallFunc(preExitFunc)
 	tester.ExpectLocalHook("pre-exit").Once().AndCallFunc(preExitFunc)
 }
+
+func TestRunningCommandWithDockerForwardsAgentSockets(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER=llamas",
+		"BUILDKITE_DOCKER_FORWARD_AGENT=true",
+		"BUILDKITE_AGENT_ENDPOINT=unix:///tmp/agent-socket123",
+		"BUILDKITE_ARTIFACT_PROXY_URL=http://127.0.0.1:4567/token",
+		"BUILDKITE_ARTIFACT_PROXY_SOCKET=/tmp/artifact-proxy-socket123",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	imageId := "buildkite_" + jobId + "_image"
+	containerId := "buildkite_" + jobId + "_container"
+
+	docker := tester.MustMock(t, "docker")
+	docker.ExpectAll([][]interface{}{
+		{"build", "-f", "Dockerfile", "-t", imageId, "."},
+		{"run", "--name", containerId,
+			"-v", "/tmp/agent-socket123:/buildkite/sockets/agent-api.sock",
+			"-v", "/tmp/artifact-proxy-socket123:/buildkite/sockets/artifact-proxy.sock",
+			"-e", "BUILDKITE_AGENT_ACCESS_TOKEN",
+			"-e", "BUILDKITE_AGENT_ENDPOINT=unix:///buildkite/sockets/agent-api.sock",
+			"-e", "BUILDKITE_ARTIFACT_PROXY_SOCKET=/buildkite/sockets/artifact-proxy.sock",
+			"-e", "BUILDKITE_ARTIFACT_PROXY_URL=http://localhost/token",
+			"-e", "BUILDKITE_JOB_ID",
+			imageId, argumentForCommand("true")},
+		{"rm", "-f", "-v", containerId},
+	})
+
+	expectCommandHooks("0", t, tester)
+
+	tester.RunAndCheck(t, env...)
+}
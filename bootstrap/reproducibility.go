@@ -0,0 +1,251 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// reproducibilityRecord is the hashes of a job's outputs, which are compared
+// with those of the next job to build the same inputs
+type reproducibilityRecord struct {
+	BuildID string            `json:"build_id"`
+	JobID   string            `json:"job_id"`
+	Outputs map[string]string `json:"outputs"`
+}
+
+// checkReproducibility hashes the files matching ReproducibleOutputPaths and
+// compares them with the outputs of the last job that built the same step
+// from the same commit and environment. If any differ, the build is annotated
+// with the differences.
+//
+// The outputs of each job are uploaded as an artifact named after a hash of
+// its inputs, so that they can be found from any agent. Artifacts are looked
+// up per build, so they're compared with earlier attempts of the job in this
+// build, and with the build that this one is a rebuild of.
+func (b *Bootstrap) checkReproducibility() error {
+	if b.ReproducibleOutputPaths == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Checking outputs are reproducible")
+
+	outputs, err := hashOutputs(b.shell.Getwd(), b.ReproducibleOutputPaths)
+	if err != nil {
+		return err
+	}
+
+	if len(outputs) == 0 {
+		b.shell.Warningf("No outputs match %q", b.ReproducibleOutputPaths)
+		return nil
+	}
+
+	commit, err := b.shell.RunAndCapture("git", "rev-parse", "HEAD")
+	if err != nil {
+		commit = b.Commit
+	}
+
+	recordPath := reproducibilityRecordPath(reproducibilityKey(b.shell.Env, commit))
+
+	var previous reproducibilityRecord
+	for _, buildID := range reproducibilityBuilds(b.shell.Env) {
+		data, err := b.shell.RunAndCapture("buildkite-agent", "artifact", "download", recordPath, "-",
+			"--build", buildID, "--include-retried-jobs", "--on-conflict", "latest")
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &previous); err != nil {
+			b.shell.Warningf("Ignoring unreadable outputs of a previous build: %v", err)
+			continue
+		}
+		break
+	}
+
+	buildID, _ := b.shell.Env.Get("BUILDKITE_BUILD_ID")
+	current := reproducibilityRecord{BuildID: buildID, JobID: b.JobID, Outputs: outputs}
+
+	if previous.Outputs == nil {
+		b.shell.Commentf("Hashed %d outputs, no previous build with the same inputs to compare with", len(outputs))
+	} else if diffs := diffOutputs(previous.Outputs, outputs); len(diffs) > 0 {
+		b.shell.Warningf("%d outputs differ from those of job %s", len(diffs), previous.JobID)
+
+		body := fmt.Sprintf("Outputs of job %s aren't reproducible, they differ from job %s of build %s with the same inputs:\n\n- %s",
+			b.JobID, previous.JobID, previous.BuildID, strings.Join(diffs, "\n- "))
+
+		if err := b.shell.Run("buildkite-agent", "annotate", body,
+			"--style", "warning", "--context", "reproducibility-"+b.JobID); err != nil {
+			b.shell.Warningf("Failed to annotate the build: %v", err)
+		}
+	} else {
+		b.shell.Commentf("All %d outputs match job %s", len(outputs), previous.JobID)
+	}
+
+	return b.uploadReproducibilityRecord(recordPath, current)
+}
+
+// uploadReproducibilityRecord uploads the outputs of this job as an artifact,
+// for later jobs with the same inputs to compare with
+func (b *Bootstrap) uploadReproducibilityRecord(recordPath string, record reproducibilityRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "reproducibility")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(recordPath)), 0777); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, recordPath), data, 0600); err != nil {
+		return err
+	}
+
+	// Artifacts are named by their path relative to where they're uploaded
+	// from, so the upload has to happen from the temp dir
+	wd := b.shell.Getwd()
+	if err := b.shell.Chdir(dir); err != nil {
+		return err
+	}
+	defer func() {
+		_ = b.shell.Chdir(wd)
+	}()
+
+	return b.shell.Run("buildkite-agent", "artifact", "upload", recordPath)
+}
+
+// reproducibilityRecordPath returns the artifact path of the outputs of jobs
+// with the given inputs
+func reproducibilityRecordPath(key string) string {
+	return filepath.ToSlash(filepath.Join(".buildkite", "reproducibility", key+".json"))
+}
+
+// reproducibilityBuilds returns the builds to look for the outputs of previous
+// jobs in, most recent first
+func reproducibilityBuilds(environ *env.Environment) []string {
+	var builds []string
+	for _, name := range []string{"BUILDKITE_BUILD_ID", "BUILDKITE_REBUILT_FROM_BUILD_ID"} {
+		if id, _ := environ.Get(name); id != "" {
+			builds = append(builds, id)
+		}
+	}
+	return builds
+}
+
+// reproducibilityKey identifies the inputs of a job: the step, the commit and
+// the environment fingerprint if the agent has one
+func reproducibilityKey(environ *env.Environment, commit string) string {
+	h := sha256.New()
+
+	for _, name := range []string{
+		"BUILDKITE_ORGANIZATION_SLUG",
+		"BUILDKITE_PIPELINE_SLUG",
+		"BUILDKITE_STEP_KEY",
+		"BUILDKITE_LABEL",
+		"BUILDKITE_PARALLEL_JOB",
+		"BUILDKITE_AGENT_META_DATA_ENV_FINGERPRINT",
+	} {
+		value, _ := environ.Get(name)
+		fmt.Fprintf(h, "%s=%s\n", name, value)
+	}
+
+	fmt.Fprintf(h, "commit=%s\n", commit)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hashOutputs returns the sha256 of each file matching the paths, which are
+// globs separated by semicolons like artifact paths, keyed by their path
+// relative to dir
+func hashOutputs(dir string, paths string) (map[string]string, error) {
+	outputs := map[string]string{}
+
+	for _, pattern := range strings.Split(paths, ";") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		files, err := zglob.Glob(pattern)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				continue
+			}
+
+			sum, err := sha256File(file)
+			if err != nil {
+				return nil, err
+			}
+
+			rel, err := filepath.Rel(dir, file)
+			if err != nil {
+				rel = file
+			}
+			outputs[filepath.ToSlash(rel)] = sum
+		}
+	}
+
+	return outputs, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// diffOutputs describes how the current outputs differ from the previous ones
+func diffOutputs(previous, current map[string]string) []string {
+	var diffs []string
+
+	for path, sum := range current {
+		if previousSum, ok := previous[path]; !ok {
+			diffs = append(diffs, fmt.Sprintf("`%s` is new", path))
+		} else if previousSum != sum {
+			diffs = append(diffs, fmt.Sprintf("`%s` changed from %.12s to %.12s", path, previousSum, sum))
+		}
+	}
+
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			diffs = append(diffs, fmt.Sprintf("`%s` is missing", path))
+		}
+	}
+
+	sort.Strings(diffs)
+	return diffs
+}
@@ -0,0 +1,76 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reproducibility")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "dist", "bin"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dist/bin/app", "dist/app.tar.gz", "README.md"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("llamas"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputs, err := hashOutputs(dir, "dist/**/*;missing/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("llamas")))
+
+	assert.Equal(t, map[string]string{
+		"dist/bin/app":    sum,
+		"dist/app.tar.gz": sum,
+	}, outputs)
+}
+
+func TestDiffOutputs(t *testing.T) {
+	previous := map[string]string{"same": "aaa", "changed": "bbb", "removed": "ccc"}
+	current := map[string]string{"same": "aaa", "changed": "ddd", "added": "eee"}
+
+	assert.Equal(t, []string{
+		"`added` is new",
+		"`changed` changed from bbb to ddd",
+		"`removed` is missing",
+	}, diffOutputs(previous, current))
+
+	assert.Empty(t, diffOutputs(previous, previous))
+}
+
+func TestReproducibilityKeyChangesWithInputs(t *testing.T) {
+	environ := env.FromSlice([]string{"BUILDKITE_PIPELINE_SLUG=app", "BUILDKITE_LABEL=build"})
+	key := reproducibilityKey(environ, "abc123")
+
+	assert.Equal(t, key, reproducibilityKey(environ.Copy(), "abc123"))
+	assert.NotEqual(t, key, reproducibilityKey(environ, "def456"))
+
+	environ.Set("BUILDKITE_AGENT_META_DATA_ENV_FINGERPRINT", "1234")
+	assert.NotEqual(t, key, reproducibilityKey(environ, "abc123"))
+}
+
+func TestReproducibilityBuildsIncludesTheRebuiltBuild(t *testing.T) {
+	assert.Equal(t, []string{"build-1"},
+		reproducibilityBuilds(env.FromSlice([]string{"BUILDKITE_BUILD_ID=build-1"})))
+
+	assert.Equal(t, []string{"build-2", "build-1"},
+		reproducibilityBuilds(env.FromSlice([]string{"BUILDKITE_BUILD_ID=build-2", "BUILDKITE_REBUILT_FROM_BUILD_ID=build-1"})))
+
+	assert.Equal(t, ".buildkite/reproducibility/abc.json", reproducibilityRecordPath("abc"))
+}
@@ -0,0 +1,230 @@
+// Package buildsummary summarises the state and timing of a build's steps,
+// for steps that report on the build they're part of
+package buildsummary
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/api"
+)
+
+// Step is the state and timing of one of the build's steps
+type Step struct {
+	Key        string  `json:"key,omitempty"`
+	Label      string  `json:"label"`
+	Type       string  `json:"type,omitempty"`
+	State      string  `json:"state"`
+	ExitStatus *int    `json:"exit_status,omitempty"`
+	SoftFailed bool    `json:"soft_failed,omitempty"`
+	URL        string  `json:"url,omitempty"`
+	StartedAt  string  `json:"started_at,omitempty"`
+	FinishedAt string  `json:"finished_at,omitempty"`
+	Duration   float64 `json:"duration_seconds,omitempty"`
+}
+
+// Summary is the state and timing of a build and its steps
+type Summary struct {
+	ID       string         `json:"id"`
+	Number   int            `json:"number"`
+	State    string         `json:"state"`
+	Branch   string         `json:"branch,omitempty"`
+	Commit   string         `json:"commit,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	URL      string         `json:"url,omitempty"`
+	Duration float64        `json:"duration_seconds,omitempty"`
+	States   map[string]int `json:"states"`
+	Steps    []Step         `json:"steps"`
+}
+
+// Summarize collects the state of the build and its steps. Steps that are
+// still running are timed up until now, which also applies to the build.
+func Summarize(build *api.Build, steps []*api.BuildStep, now time.Time) *Summary {
+	s := &Summary{
+		ID:       build.ID,
+		Number:   build.Number,
+		State:    build.State,
+		Branch:   build.Branch,
+		Commit:   build.Commit,
+		Message:  build.Message,
+		URL:      build.WebURL,
+		Duration: duration(build.StartedAt, build.FinishedAt, now).Seconds(),
+		States:   map[string]int{},
+		Steps:    []Step{},
+	}
+
+	for _, step := range steps {
+		state := step.State
+		if step.SoftFailed {
+			state = "soft_failed"
+		}
+		s.States[state]++
+
+		s.Steps = append(s.Steps, Step{
+			Key:        step.Key,
+			Label:      stepLabel(step),
+			Type:       step.Type,
+			State:      step.State,
+			ExitStatus: step.ExitStatus,
+			SoftFailed: step.SoftFailed,
+			URL:        step.WebURL,
+			StartedAt:  step.StartedAt,
+			FinishedAt: step.FinishedAt,
+			Duration:   duration(step.StartedAt, step.FinishedAt, now).Seconds(),
+		})
+	}
+
+	return s
+}
+
+// JSON renders the summary as indented JSON
+func (s *Summary) JSON() (string, error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+// Markdown renders the summary as a heading, a count of the steps in each
+// state and a table of the steps
+func (s *Summary) Markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "### Build #%d %s", s.Number, stateName(s.State))
+	if s.Duration > 0 {
+		fmt.Fprintf(&b, " in %s", formatDuration(s.Duration))
+	}
+	fmt.Fprintf(&b, "\n\n")
+
+	var details []string
+	if s.Branch != "" {
+		details = append(details, fmt.Sprintf("`%s`", s.Branch))
+	}
+	if s.Commit != "" {
+		commit := s.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		details = append(details, fmt.Sprintf("`%s`", commit))
+	}
+	if message := firstLine(s.Message); message != "" {
+		details = append(details, html.EscapeString(message))
+	}
+	if s.URL != "" {
+		details = append(details, fmt.Sprintf("[View build](%s)", s.URL))
+	}
+	if len(details) > 0 {
+		fmt.Fprintf(&b, "%s\n\n", strings.Join(details, " · "))
+	}
+
+	var states []string
+	for state := range s.States {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	var counts []string
+	for _, state := range states {
+		counts = append(counts, fmt.Sprintf("**%d** %s", s.States[state], stateName(state)))
+	}
+	if len(counts) > 0 {
+		fmt.Fprintf(&b, "%s\n\n", strings.Join(counts, ", "))
+	}
+
+	if len(s.Steps) == 0 {
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "| Step | State | Duration |\n")
+	fmt.Fprintf(&b, "| --- | --- | --- |\n")
+	for _, step := range s.Steps {
+		label := markdownCell(step.Label)
+		if step.URL != "" {
+			label = fmt.Sprintf("[%s](%s)", label, step.URL)
+		}
+
+		state := stateName(step.State)
+		if step.SoftFailed {
+			state = stateName("soft_failed")
+		}
+		if step.ExitStatus != nil && *step.ExitStatus != 0 {
+			state += fmt.Sprintf(" (exit %d)", *step.ExitStatus)
+		}
+
+		took := ""
+		if step.Duration > 0 {
+			took = formatDuration(step.Duration)
+		}
+
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", label, state, took)
+	}
+
+	return b.String()
+}
+
+// stepLabel is how a step is shown, which is its key if it has no label
+func stepLabel(step *api.BuildStep) string {
+	switch {
+	case step.Label != "":
+		return step.Label
+	case step.Key != "":
+		return step.Key
+	case step.Type != "":
+		return step.Type
+	}
+	return "Unnamed step"
+}
+
+// duration returns how long something took, or has taken so far
+func duration(startedAt, finishedAt string, now time.Time) time.Duration {
+	start, err := time.Parse(time.RFC3339, startedAt)
+	if err != nil {
+		return 0
+	}
+
+	end := now
+	if finishedAt != "" {
+		if end, err = time.Parse(time.RFC3339, finishedAt); err != nil {
+			return 0
+		}
+	}
+
+	if end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// formatDuration formats seconds like 1h2m, 3m4s or 5s
+func formatDuration(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Second)
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%ds", int(d.Seconds()))
+}
+
+func stateName(state string) string {
+	if state == "" {
+		return "unknown"
+	}
+	return strings.Replace(state, "_", " ", -1)
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
+
+// markdownCell escapes what would break a table cell
+func markdownCell(s string) string {
+	s = html.EscapeString(firstLine(s))
+	return strings.Replace(s, "|", "\\|", -1)
+}
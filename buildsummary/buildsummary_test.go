@@ -0,0 +1,83 @@
+package buildsummary
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func testSummary() *Summary {
+	now := time.Date(2026, 10, 16, 12, 10, 0, 0, time.UTC)
+
+	build := &api.Build{
+		ID:        "build",
+		Number:    42,
+		State:     "failed",
+		Branch:    "main",
+		Commit:    "1a2b3c4d5e6f",
+		Message:   "Teach the llamas to spit\n\nThey asked for it",
+		WebURL:    "https://buildkite.com/llamas/build/42",
+		StartedAt: "2026-10-16T12:00:00Z",
+	}
+
+	steps := []*api.BuildStep{
+		{Label: ":rspec: Tests", State: "passed", ExitStatus: intPtr(0), StartedAt: "2026-10-16T12:00:00Z", FinishedAt: "2026-10-16T12:03:04Z", WebURL: "https://buildkite.com/llamas/build/42#a"},
+		{Key: "lint", State: "failed", ExitStatus: intPtr(2), SoftFailed: true, StartedAt: "2026-10-16T12:00:00Z", FinishedAt: "2026-10-16T12:00:05Z"},
+		{Label: "Deploy | prod", State: "failed", ExitStatus: intPtr(1), StartedAt: "2026-10-16T12:05:00Z", FinishedAt: "2026-10-16T13:06:00Z"},
+		{Label: "Report", State: "running", StartedAt: "2026-10-16T12:09:00Z"},
+		{Type: "wait", State: "not_run"},
+	}
+
+	return Summarize(build, steps, now)
+}
+
+func TestSummarize(t *testing.T) {
+	s := testSummary()
+
+	assert.Equal(t, float64(600), s.Duration)
+	assert.Equal(t, map[string]int{"passed": 1, "soft_failed": 1, "failed": 1, "running": 1, "not_run": 1}, s.States)
+
+	if assert.Len(t, s.Steps, 5) {
+		assert.Equal(t, float64(184), s.Steps[0].Duration)
+		assert.Equal(t, "lint", s.Steps[1].Label)
+		assert.Equal(t, float64(60), s.Steps[3].Duration)
+		assert.Equal(t, "wait", s.Steps[4].Label)
+		assert.Equal(t, float64(0), s.Steps[4].Duration)
+	}
+}
+
+func TestSummaryJSON(t *testing.T) {
+	out, err := testSummary().JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Summary
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, *testSummary(), decoded)
+}
+
+func TestSummaryMarkdown(t *testing.T) {
+	assert.Equal(t, "### Build #42 failed in 10m0s\n"+
+		"\n"+
+		"`main` · `1a2b3c4` · Teach the llamas to spit · [View build](https://buildkite.com/llamas/build/42)\n"+
+		"\n"+
+		"**1** failed, **1** not run, **1** passed, **1** running, **1** soft failed\n"+
+		"\n"+
+		"| Step | State | Duration |\n"+
+		"| --- | --- | --- |\n"+
+		"| [:rspec: Tests](https://buildkite.com/llamas/build/42#a) | passed | 3m4s |\n"+
+		"| lint | soft failed (exit 2) | 5s |\n"+
+		"| Deploy \\| prod | failed (exit 1) | 1h1m |\n"+
+		"| Report | running | 1m0s |\n"+
+		"| wait | not run |  |\n", testSummary().Markdown())
+}
@@ -5,14 +5,18 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/bootstrap"
 	"github.com/buildkite/agent/cliconfig"
 	"github.com/buildkite/agent/experiments"
 	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/agent/metrics"
+	"github.com/buildkite/agent/process"
+	"github.com/buildkite/agent/utils"
 	"github.com/buildkite/shellwords"
 	"github.com/urfave/cli"
 )
@@ -42,59 +46,94 @@ Example:
 
 type AgentStartConfig struct {
 	Config                     string   `cli:"config"`
+	Profile                    string   `cli:"profile"`
 	Name                       string   `cli:"name"`
 	Priority                   string   `cli:"priority"`
 	DisconnectAfterJob         bool     `cli:"disconnect-after-job"`
 	DisconnectAfterJobTimeout  int      `cli:"disconnect-after-job-timeout"`
 	DisconnectAfterIdleTimeout int      `cli:"disconnect-after-idle-timeout"`
+	AgentIdleHookTimeout       int      `cli:"agent-idle-hook-timeout"`
 	BootstrapScript            string   `cli:"bootstrap-script" normalize:"commandpath"`
 	CancelGracePeriod          int      `cli:"cancel-grace-period"`
 	BuildPath                  string   `cli:"build-path" normalize:"filepath" validate:"required"`
 	HooksPath                  string   `cli:"hooks-path" normalize:"filepath"`
 	PluginsPath                string   `cli:"plugins-path" normalize:"filepath"`
 	Shell                      string   `cli:"shell"`
-	Tags                       []string `cli:"tags" normalize:"list"`
-	TagsFromEC2                bool     `cli:"tags-from-ec2"`
-	TagsFromEC2Tags            bool     `cli:"tags-from-ec2-tags"`
-	TagsFromGCP                bool     `cli:"tags-from-gcp"`
+	Tags                       []string `cli:"tags" normalize:"list" aliases:"meta-data"`
+	TagsFromEC2                bool     `cli:"tags-from-ec2" aliases:"meta-data-ec2"`
+	TagsFromEC2Tags            bool     `cli:"tags-from-ec2-tags" aliases:"meta-data-ec2-tags"`
+	TagsFromGCP                bool     `cli:"tags-from-gcp" aliases:"meta-data-gcp"`
 	TagsFromGCPLabels          bool     `cli:"tags-from-gcp-labels"`
 	TagsFromHost               bool     `cli:"tags-from-host"`
+	TagsFromEnvFingerprint     bool     `cli:"tags-from-env-fingerprint"`
+	RequireTags                []string `cli:"require-tags" normalize:"list"`
+	Capabilities               []string `cli:"capabilities" normalize:"list"`
+	ClockDriftThreshold        string   `cli:"clock-drift-threshold"`
+	ClockDriftAction           string   `cli:"clock-drift-action"`
+	SoftFailExitCodes          []string `cli:"soft-fail-exit-codes" normalize:"list"`
+	WarnOnMissingTags          bool     `cli:"warn-on-missing-tags"`
+	EnvFingerprintScript       string   `cli:"env-fingerprint-script" normalize:"commandpath"`
+	EnvFingerprintInterval     string   `cli:"env-fingerprint-interval"`
 	WaitForEC2TagsTimeout      string   `cli:"wait-for-ec2-tags-timeout"`
 	WaitForGCPLabelsTimeout    string   `cli:"wait-for-gcp-labels-timeout"`
 	GitCloneFlags              string   `cli:"git-clone-flags"`
 	GitCloneMirrorFlags        string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags              string   `cli:"git-clean-flags"`
 	GitMirrorsPath             string   `cli:"git-mirrors-path" normalize:"filepath"`
+	ArtifactCacheDir           string   `cli:"artifact-cache-dir" normalize:"filepath"`
 	GitMirrorsLockTimeout      int      `cli:"git-mirrors-lock-timeout"`
 	NoGitSubmodules            bool     `cli:"no-git-submodules"`
-	NoSSHKeyscan               bool     `cli:"no-ssh-keyscan"`
+	NoSSHKeyscan               bool     `cli:"no-ssh-keyscan" aliases:"no-automatic-ssh-fingerprint-verification"`
 	NoCommandEval              bool     `cli:"no-command-eval"`
 	NoLocalHooks               bool     `cli:"no-local-hooks"`
 	NoPlugins                  bool     `cli:"no-plugins"`
 	NoPluginValidation         bool     `cli:"no-plugin-validation"`
 	NoPTY                      bool     `cli:"no-pty"`
 	TimestampLines             bool     `cli:"timestamp-lines"`
+	MaxLogLineLength           int      `cli:"max-log-line-length"`
 	MetricsDatadog             bool     `cli:"metrics-datadog"`
 	MetricsDatadogHost         string   `cli:"metrics-datadog-host"`
 	Spawn                      int      `cli:"spawn"`
+	Workers                    []string `cli:"worker" normalize:"list"`
+	JobHistoryPath             string   `cli:"job-history-path" normalize:"filepath"`
+	JobLogPathTemplate         string   `cli:"job-log-path-template"`
+	JobLogFormat               string   `cli:"job-log-format"`
+	JobEnvFiles                []string `cli:"job-env-file" normalize:"list"`
+	AdminSocketPath            string   `cli:"admin-socket-path" normalize:"filepath"`
+	MaintenanceTasks           string   `cli:"maintenance-tasks"`
+	AcquireWindow              string   `cli:"acquire-window"`
+	LongPoll                   bool     `cli:"long-poll"`
+	Tracing                    bool     `cli:"tracing"`
+	ResourceUsageAnnotation    bool     `cli:"resource-usage-annotation"`
+	EncryptedWorkspace         bool     `cli:"encrypted-workspace"`
+	EncryptedWorkspaceSize     string   `cli:"encrypted-workspace-size"`
+	CleanCheckoutEvery         string   `cli:"clean-checkout-every"`
+	LogFile                    string   `cli:"log-file" normalize:"filepath"`
+	LogFileFormat              string   `cli:"log-file-format"`
+	LogMaxSize                 string   `cli:"log-max-size"`
+	LogMaxAge                  string   `cli:"log-max-age"`
+	LogMaxBackups              int      `cli:"log-max-backups"`
+	LogBuffer                  string   `cli:"log-buffer"`
+	LogHideFields              []string `cli:"log-hide-fields" normalize:"list"`
+	LogPrefixFields            []string `cli:"log-prefix-fields" normalize:"list"`
+	LogFieldOrder              []string `cli:"log-field-order" normalize:"list"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
 	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
+	LogLevel    string   `cli:"log-level"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 
 	// API config
-	DebugHTTP bool   `cli:"debug-http"`
-	Token     string `cli:"token" validate:"required"`
-	Endpoint  string `cli:"endpoint" validate:"required"`
-	NoHTTP2   bool   `cli:"no-http2"`
-
-	// Deprecated
-	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification" deprecated-and-renamed-to:"NoSSHKeyscan"`
-	MetaData                     []string `cli:"meta-data" deprecated-and-renamed-to:"Tags"`
-	MetaDataEC2                  bool     `cli:"meta-data-ec2" deprecated-and-renamed-to:"TagsFromEC2"`
-	MetaDataEC2Tags              bool     `cli:"meta-data-ec2-tags" deprecated-and-renamed-to:"TagsFromEC2Tags"`
-	MetaDataGCP                  bool     `cli:"meta-data-gcp" deprecated-and-renamed-to:"TagsFromGCP"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	Token              string   `cli:"token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 func DefaultShell() string {
@@ -147,6 +186,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Path to a configuration file",
 			EnvVar: "BUILDKITE_AGENT_CONFIG",
 		},
+		cli.StringFlag{
+			Name:   "profile",
+			Value:  "",
+			Usage:  "The profile in the configuration file to use, such as \"linux-gpu\" for a [profile.linux-gpu] section",
+			EnvVar: "BUILDKITE_AGENT_PROFILE",
+		},
 		cli.StringFlag{
 			Name:   "name",
 			Value:  "",
@@ -176,6 +221,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "If no jobs have come in for the specified number of secconds, disconnect the agent",
 			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_IDLE_TIMEOUT",
 		},
+		cli.IntFlag{
+			Name:   "agent-idle-hook-timeout",
+			Value:  0,
+			Usage:  "If no jobs have come in for the specified number of seconds, run the agent-idle hook",
+			EnvVar: "BUILDKITE_AGENT_IDLE_HOOK_TIMEOUT",
+		},
 		cli.IntFlag{
 			Name:   "cancel-grace-period",
 			Value:  10,
@@ -199,6 +250,23 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Include tags from the host (hostname, machine-id, os)",
 			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_HOST",
 		},
+		cli.BoolFlag{
+			Name:   "tags-from-env-fingerprint",
+			Usage:  "Include a fingerprint of the toolchain versions on the host as the env_fingerprint tag",
+			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_ENV_FINGERPRINT",
+		},
+		cli.StringFlag{
+			Name:   "env-fingerprint-script",
+			Value:  "",
+			Usage:  "A script whose output is used to compute the environment fingerprint, instead of the built-in probes",
+			EnvVar: "BUILDKITE_AGENT_ENV_FINGERPRINT_SCRIPT",
+		},
+		cli.DurationFlag{
+			Name:   "env-fingerprint-interval",
+			Usage:  "How often to recompute the environment fingerprint, re-registering the agent with the new one if it has changed",
+			EnvVar: "BUILDKITE_AGENT_ENV_FINGERPRINT_INTERVAL",
+			Value:  time.Hour,
+		},
 		cli.BoolFlag{
 			Name:   "tags-from-ec2",
 			Usage:  "Include the host's EC2 meta-data as tags (instance-id, instance-type, and ami-id)",
@@ -219,6 +287,23 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Include the host's Google Cloud instance labels as tags",
 			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_GCP_LABELS",
 		},
+		cli.StringSliceFlag{
+			Name:   "require-tags",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of tag keys that the agent must have (e.g. \"queue,aws:instance-type\"), or it won't register",
+			EnvVar: "BUILDKITE_AGENT_REQUIRE_TAGS",
+		},
+		cli.BoolFlag{
+			Name:   "warn-on-missing-tags",
+			Usage:  "Register anyway if any tags from --require-tags are missing, logging a warning instead",
+			EnvVar: "BUILDKITE_AGENT_WARN_ON_MISSING_TAGS",
+		},
+		cli.StringSliceFlag{
+			Name:   "capabilities",
+			Value:  &cli.StringSlice{},
+			Usage:  "Capabilities to advertise as well as those found by probing the host, which steps can require (e.g. \"docker,kvm\")",
+			EnvVar: "BUILDKITE_AGENT_CAPABILITIES",
+		},
 		cli.DurationFlag{
 			Name:   "wait-for-ec2-tags-timeout",
 			Usage:  "The amount of time to wait for tags from EC2 before proceeding",
@@ -255,6 +340,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Path to where mirrors of git repositories are stored",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
 		},
+		cli.StringFlag{
+			Name:   "artifact-cache-dir",
+			Value:  "",
+			Usage:  "Path to a cache of downloaded artifacts for the artifact-cache-gc maintenance task to trim",
+			EnvVar: "BUILDKITE_ARTIFACT_CACHE_DIR",
+		},
 		cli.IntFlag{
 			Name:   "git-mirrors-lock-timeout",
 			Value:  300,
@@ -290,6 +381,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Prepend timestamps on each line of output.",
 			EnvVar: "BUILDKITE_TIMESTAMP_LINES",
 		},
+		cli.IntFlag{
+			Name:   "max-log-line-length",
+			Value:  process.DefaultMaxLineLength,
+			Usage:  "Lines of job output longer than this many bytes are truncated, or 0 to never truncate them",
+			EnvVar: "BUILDKITE_MAX_LOG_LINE_LENGTH",
+		},
 		cli.BoolFlag{
 			Name:   "no-pty",
 			Usage:  "Do not run jobs within a pseudo terminal",
@@ -336,25 +433,174 @@ var AgentStartCommand = cli.Command{
 			EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
 			Value:  "127.0.0.1:8125",
 		},
+		JobHistoryPathFlag,
+		cli.StringFlag{
+			Name:   "job-log-path-template",
+			Value:  "",
+			Usage:  "Write a copy of each job's log to this path, with the job's environment variables expanded, e.g. '/var/log/buildkite/$BUILDKITE_PIPELINE_SLUG/$BUILDKITE_JOB_ID.log'",
+			EnvVar: "BUILDKITE_AGENT_JOB_LOG_PATH_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "job-log-format",
+			Value:  "text",
+			Usage:  "The format of the job logs written with --job-log-path-template, either text or ndjson",
+			EnvVar: "BUILDKITE_AGENT_JOB_LOG_FORMAT",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-env-file",
+			Value:  &cli.StringSlice{},
+			Usage:  "Files (or glob patterns) of KEY=VALUE lines to add to every job's environment, where lines after [queue=name] only apply to that queue",
+			EnvVar: "BUILDKITE_JOB_ENV_FILE",
+		},
+		AdminSocketPathFlag,
+		cli.StringFlag{
+			Name:   "maintenance-tasks",
+			Value:  "",
+			Usage:  "Cron schedules of workspace-gc, git-mirrors-update, git-mirrors-fsck, docker-prune, artifact-cache-gc or command tasks to run between jobs, separated by semicolons, e.g. \"0 3 * * * docker-prune; @hourly git-mirrors-update\"",
+			EnvVar: "BUILDKITE_MAINTENANCE_TASKS",
+		},
+		cli.StringFlag{
+			Name:   "acquire-window",
+			Value:  "",
+			Usage:  "Only accept jobs during these days, times and optional time zones, separated by semicolons, e.g. \"Mon-Fri 08:00-20:00 Europe/Berlin\"",
+			EnvVar: "BUILDKITE_AGENT_ACQUIRE_WINDOW",
+		},
+		cli.BoolFlag{
+			Name:   "long-poll",
+			Usage:  "Ask the API to hold pings open until there's work, instead of pinging every few seconds, if the endpoint supports it",
+			EnvVar: "BUILDKITE_AGENT_LONG_POLL",
+		},
+		cli.BoolFlag{
+			Name:   "tracing",
+			Usage:  "Pass W3C trace context to jobs as $TRACEPARENT, $TRACESTATE and $BAGGAGE, continuing the trace that triggered the build if there is one",
+			EnvVar: "BUILDKITE_AGENT_TRACING",
+		},
+		cli.BoolFlag{
+			Name:   "resource-usage-annotation",
+			Usage:  "Annotate builds with the CPU time, peak memory, disk IO and network traffic of each job",
+			EnvVar: "BUILDKITE_AGENT_RESOURCE_USAGE_ANNOTATION",
+		},
+		cli.BoolFlag{
+			Name:   "encrypted-workspace",
+			Usage:  "Check out each job onto its own encrypted volume, which is destroyed when the job finishes (needs root on Linux)",
+			EnvVar: "BUILDKITE_ENCRYPTED_WORKSPACE",
+		},
+		cli.StringFlag{
+			Name:   "encrypted-workspace-size",
+			Value:  "10GB",
+			Usage:  "The size of each job's encrypted volume, which only uses disk space as it's filled",
+			EnvVar: "BUILDKITE_ENCRYPTED_WORKSPACE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "clean-checkout-every",
+			Value:  "",
+			Usage:  "Remove each pipeline's checkout every so many jobs or so long, such as 50-jobs, 24h or both (50-jobs,24h)",
+			EnvVar: "BUILDKITE_CLEAN_CHECKOUT_EVERY",
+		},
+		cli.DurationFlag{
+			Name:   "clock-drift-threshold",
+			Value:  30 * time.Second,
+			Usage:  "How far the host's clock can drift from Buildkite's before a job is warned about it or failed, or 0 to not check",
+			EnvVar: "BUILDKITE_AGENT_CLOCK_DRIFT_THRESHOLD",
+		},
+		cli.StringFlag{
+			Name:   "clock-drift-action",
+			Value:  "warn",
+			Usage:  "What to do with jobs when the clock has drifted past --clock-drift-threshold, either warn or fail",
+			EnvVar: "BUILDKITE_AGENT_CLOCK_DRIFT_ACTION",
+		},
+		cli.StringSliceFlag{
+			Name:   "soft-fail-exit-codes",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of job exit statuses to report as soft failures (e.g. \"42\" or \"100-110\"), which can be set per queue with a config file profile",
+			EnvVar: "BUILDKITE_AGENT_SOFT_FAIL_EXIT_CODES",
+		},
+		cli.StringFlag{
+			Name:   "log-file",
+			Value:  "",
+			Usage:  "Also write the agent's log to this file, which is reopened on SIGHUP so it can be rotated",
+			EnvVar: "BUILDKITE_AGENT_LOG_FILE",
+		},
+		cli.StringFlag{
+			Name:   "log-file-format",
+			Value:  "",
+			Usage:  "The format to use for --log-file, either text or json (defaults to --log-format, or text if that's syslog)",
+			EnvVar: "BUILDKITE_AGENT_LOG_FILE_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-max-size",
+			Value:  "",
+			Usage:  "Rotate --log-file once it grows past this size, e.g. 100MB",
+			EnvVar: "BUILDKITE_AGENT_LOG_MAX_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "log-max-age",
+			Value:  "",
+			Usage:  "Rotate --log-file once it has been written to for this long, e.g. 24h",
+			EnvVar: "BUILDKITE_AGENT_LOG_MAX_AGE",
+		},
+		cli.IntFlag{
+			Name:   "log-max-backups",
+			Value:  5,
+			Usage:  "How many rotated log files to keep, or 0 to keep all of them",
+			EnvVar: "BUILDKITE_AGENT_LOG_MAX_BACKUPS",
+		},
+		cli.StringFlag{
+			Name:   "log-buffer",
+			Value:  "",
+			Usage:  "Buffer log lines and write them this often, e.g. 1s, except for warnings and errors, which are written straight away",
+			EnvVar: "BUILDKITE_AGENT_LOG_BUFFER",
+		},
+		cli.StringSliceFlag{
+			Name:   "log-hide-fields",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of log fields to leave out of log lines (e.g. \"agent_name,job\")",
+			EnvVar: "BUILDKITE_AGENT_LOG_HIDE_FIELDS",
+		},
+		cli.StringSliceFlag{
+			Name:   "log-prefix-fields",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of log fields to show before the message, in order (default: \"worker,prefix\")",
+			EnvVar: "BUILDKITE_AGENT_LOG_PREFIX_FIELDS",
+		},
+		cli.StringSliceFlag{
+			Name:   "log-field-order",
+			Value:  &cli.StringSlice{},
+			Usage:  "A comma-separated list of log fields to show first after the message, in order",
+			EnvVar: "BUILDKITE_AGENT_LOG_FIELD_ORDER",
+		},
 		cli.IntFlag{
 			Name:   "spawn",
 			Usage:  "The number of agents to spawn in parallel",
 			Value:  1,
 			EnvVar: "BUILDKITE_AGENT_SPAWN",
 		},
+		cli.StringSliceFlag{
+			Name:   "worker",
+			Value:  &cli.StringSlice{},
+			Usage:  "A group of workers to run with their own tags instead of --spawn, which can be repeated (e.g. \"count=2;queue=mac\")",
+			EnvVar: "BUILDKITE_AGENT_WORKERS",
+		},
 
 		// API Flags
 		AgentRegisterTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		ExperimentsFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 
-		// Deprecated flags which will be removed in v4
+		// Deprecated flags which will be removed in v4. These are aliases for
+		// their replacements, see the `aliases` tags on AgentStartConfig
 		cli.StringSliceFlag{
 			Name:   "meta-data",
 			Value:  &cli.StringSlice{},
@@ -369,7 +615,7 @@ var AgentStartCommand = cli.Command{
 		cli.BoolFlag{
 			Name:   "meta-data-ec2-tags",
 			Hidden: true,
-			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2_TAGS",
+			EnvVar: "BUILDKITE_AGENT_META_DATA_EC2_TAGS",
 		},
 		cli.BoolFlag{
 			Name:   "meta-data-gcp",
@@ -383,7 +629,7 @@ var AgentStartCommand = cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := AgentStartConfig{}
@@ -399,22 +645,101 @@ var AgentStartCommand = cli.Command{
 
 		// Load the configuration
 		if err := loader.Load(); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		// Tee the log to a file, before any worker loggers are made from it
+		if cfg.LogFile != "" {
+			format := cfg.LogFileFormat
+			if strings.EqualFold(format, "syslog") {
+				fatal(l, ExitConfigError, "The --log-file-format can't be syslog, use --log-format syslog instead")
+			} else if format == "" && !strings.EqualFold(cfg.LogFormat, "syslog") {
+				format = cfg.LogFormat
+			}
+
+			rotation := logger.LogRotation{MaxBackups: cfg.LogMaxBackups}
+
+			if cfg.LogMaxSize != "" {
+				var err error
+				if rotation.MaxSize, err = utils.ParseByteSize(cfg.LogMaxSize); err != nil {
+					fatal(l, ExitConfigError, "Invalid --log-max-size: %s", err)
+				}
+			}
+
+			if cfg.LogMaxAge != "" {
+				var err error
+				if rotation.MaxAge, err = time.ParseDuration(cfg.LogMaxAge); err != nil {
+					fatal(l, ExitConfigError, "Invalid --log-max-age: %s", err)
+				}
+			}
+
+			file, err := logger.OpenLogFile(cfg.LogFile, rotation)
+			if err != nil {
+				fatal(l, ExitConfigError, "Failed to open log file: %s", err)
+			}
+
+			printer, err := logger.NewPrinter(format, file)
+			if err != nil {
+				fatal(l, ExitConfigError, "%s", err)
+			}
+
+			// Escape codes are only useful in a terminal
+			if textPrinter, ok := printer.(*logger.TextPrinter); ok {
+				textPrinter.Colors = false
+			}
+
+			logger.AddPrinter(l, printer)
+		}
+
+		if cfg.LogBuffer != "" {
+			interval, err := time.ParseDuration(cfg.LogBuffer)
+			if err != nil || interval <= 0 {
+				fatal(l, ExitConfigError, "Invalid --log-buffer %q, expected a duration like 1s", cfg.LogBuffer)
+			}
+
+			logger.BufferOutput(l, interval)
+			defer logger.Close(l)
+			logger.OnFatal(func() { logger.Close(l) })
+		}
+
+		if len(cfg.LogHideFields) > 0 || len(cfg.LogPrefixFields) > 0 || len(cfg.LogFieldOrder) > 0 {
+			presenter := logger.ConfigPresenter{
+				Hide:   cfg.LogHideFields,
+				Prefix: cfg.LogPrefixFields,
+				Order:  cfg.LogFieldOrder,
+			}
+			if len(presenter.Prefix) == 0 {
+				presenter.Prefix = []string{logger.WorkerField, logger.PrefixField}
+			}
+
+			logger.SetPresenter(l, presenter)
+		}
+
 		// Remove any config env from the environment to prevent them propagating to bootstrap
 		UnsetConfigFromEnvironment(c)
 
 		// Check if git-mirrors are enabled
 		if experiments.IsEnabled(`git-mirrors`) {
 			if cfg.GitMirrorsPath == `` {
-				l.Fatal("Must provide a git-mirrors-path in your configuration for git-mirrors experiment")
+				fatal(l, ExitConfigError, "Must provide a git-mirrors-path in your configuration for git-mirrors experiment")
 			}
 		}
 
+		acquireWindows, err := agent.ParseAcquireWindows(cfg.AcquireWindow)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Parse maintenance tasks up front so that mistakes are found
+		// before the agent registers
+		maintenanceTasks, err := agent.ParseMaintenanceTasks(cfg.MaintenanceTasks)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
 		// Force some settings if on Windows (these aren't supported yet)
 		if runtime.GOOS == "windows" {
 			cfg.NoPTY = true
@@ -451,9 +776,24 @@ var AgentStartCommand = cli.Command{
 			cfg.Shell = DefaultShell()
 		}
 
+		var workerGroups []agent.WorkerGroup
+		for _, worker := range cfg.Workers {
+			if strings.TrimSpace(worker) == "" {
+				continue
+			}
+			group, err := agent.ParseWorkerGroup(worker)
+			if err != nil {
+				fatal(l, ExitConfigError, "%v", err)
+			}
+			workerGroups = append(workerGroups, group)
+		}
+		if len(workerGroups) > 0 && cfg.Spawn > 1 {
+			fatal(l, ExitConfigError, "--spawn can't be used with --worker, set a count for each worker group instead")
+		}
+
 		// Make sure the DisconnectAfterJobTimeout value is correct
 		if cfg.DisconnectAfterJob && cfg.DisconnectAfterJobTimeout < 120 {
-			l.Fatal("The timeout for `disconnect-after-job` must be at least 120 seconds")
+			fatal(l, ExitConfigError, "The timeout for `disconnect-after-job` must be at least 120 seconds")
 		}
 
 		var ec2TagTimeout time.Duration
@@ -461,16 +801,50 @@ var AgentStartCommand = cli.Command{
 			var err error
 			ec2TagTimeout, err = time.ParseDuration(t)
 			if err != nil {
-				l.Fatal("Failed to parse ec2 tag timeout: %v", err)
+				fatal(l, ExitConfigError, "Failed to parse ec2 tag timeout: %v", err)
 			}
 		}
 
+		if cfg.EncryptedWorkspace {
+			if _, err := utils.ParseByteSize(cfg.EncryptedWorkspaceSize); err != nil {
+				fatal(l, ExitConfigError, "Failed to parse encrypted workspace size: %v", err)
+			}
+		}
+
+		if cfg.JobLogFormat != "text" && cfg.JobLogFormat != "ndjson" {
+			fatal(l, ExitConfigError, "Invalid job log format %q, expected text or ndjson", cfg.JobLogFormat)
+		}
+
+		if _, err := bootstrap.ParseCleanCheckoutPolicy(cfg.CleanCheckoutEvery); err != nil {
+			fatal(l, ExitConfigError, "%v", err)
+		}
+
+		var clockDriftThreshold time.Duration
+		if t := cfg.ClockDriftThreshold; t != "" {
+			var err error
+			clockDriftThreshold, err = time.ParseDuration(t)
+			if err != nil {
+				fatal(l, ExitConfigError, "Failed to parse clock drift threshold: %v", err)
+			}
+		}
+
+		switch cfg.ClockDriftAction {
+		case agent.ClockDriftWarn, agent.ClockDriftFail:
+		default:
+			fatal(l, ExitConfigError, "The clock-drift-action must be either warn or fail, not %q", cfg.ClockDriftAction)
+		}
+
+		softFailExitCodes, err := agent.ParseExitCodeRanges(cfg.SoftFailExitCodes)
+		if err != nil {
+			fatal(l, ExitConfigError, "Failed to parse soft-fail-exit-codes: %v", err)
+		}
+
 		var gcpLabelsTimeout time.Duration
 		if t := cfg.WaitForGCPLabelsTimeout; t != "" {
 			var err error
 			gcpLabelsTimeout, err = time.ParseDuration(t)
 			if err != nil {
-				l.Fatal("Failed to parse gcp labels timeout: %v", err)
+				fatal(l, ExitConfigError, "Failed to parse gcp labels timeout: %v", err)
 			}
 		}
 
@@ -479,11 +853,28 @@ var AgentStartCommand = cli.Command{
 			DatadogHost: cfg.MetricsDatadogHost,
 		})
 
+		// Find out what this agent can do, so that jobs that need something
+		// it can't do are refused before they run anything
+		capabilities := agent.ProbeCapabilities(l, cfg.Capabilities)
+		l.Info("Agent capabilities: %s", strings.Join(capabilities, ", "))
+
 		// AgentConfiguration is the runtime configuration for an agent
 		agentConf := agent.AgentConfiguration{
 			BootstrapScript:            cfg.BootstrapScript,
 			BuildPath:                  cfg.BuildPath,
 			GitMirrorsPath:             cfg.GitMirrorsPath,
+			ArtifactCacheDir:           cfg.ArtifactCacheDir,
+			AcquireWindows:             acquireWindows,
+			Capabilities:               capabilities,
+			ClockDriftThreshold:        clockDriftThreshold,
+			ClockDriftAction:           cfg.ClockDriftAction,
+			SoftFailExitCodes:          softFailExitCodes,
+			LongPoll:                   cfg.LongPoll,
+			Tracing:                    cfg.Tracing,
+			ResourceUsageAnnotation:    cfg.ResourceUsageAnnotation,
+			EncryptedWorkspace:         cfg.EncryptedWorkspace,
+			EncryptedWorkspaceSize:     cfg.EncryptedWorkspaceSize,
+			CleanCheckoutEvery:         cfg.CleanCheckoutEvery,
 			GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
 			HooksPath:                  cfg.HooksPath,
 			PluginsPath:                cfg.PluginsPath,
@@ -498,15 +889,22 @@ var AgentStartCommand = cli.Command{
 			LocalHooksEnabled:          !cfg.NoLocalHooks,
 			RunInPty:                   !cfg.NoPTY,
 			TimestampLines:             cfg.TimestampLines,
+			MaxLogLineLength:           cfg.MaxLogLineLength,
 			DisconnectAfterJob:         cfg.DisconnectAfterJob,
 			DisconnectAfterJobTimeout:  cfg.DisconnectAfterJobTimeout,
 			DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
+			AgentIdleHookTimeout:       cfg.AgentIdleHookTimeout,
 			CancelGracePeriod:          cfg.CancelGracePeriod,
 			Shell:                      cfg.Shell,
+			JobHistoryPath:             cfg.JobHistoryPath,
+			JobLogPathTemplate:         cfg.JobLogPathTemplate,
+			JobLogFormat:               cfg.JobLogFormat,
+			JobEnvFiles:                cfg.JobEnvFiles,
 		}
 
 		if loader.File != nil {
 			agentConf.ConfigPath = loader.File.Path
+			agentConf.ConfigProfile = loader.File.Profile
 		}
 
 		// Show the welcome banner
@@ -522,6 +920,7 @@ var AgentStartCommand = cli.Command{
 			Name:              cfg.Name,
 			Priority:          cfg.Priority,
 			ScriptEvalEnabled: !cfg.NoCommandEval,
+			Capabilities:      capabilities,
 			Tags: agent.FetchTags(l, agent.FetchTagsConfig{
 				Tags:                    cfg.Tags,
 				TagsFromEC2:             cfg.TagsFromEC2,
@@ -529,11 +928,46 @@ var AgentStartCommand = cli.Command{
 				TagsFromGCP:             cfg.TagsFromGCP,
 				TagsFromGCPLabels:       cfg.TagsFromGCPLabels,
 				TagsFromHost:            cfg.TagsFromHost,
+				TagsFromEnvFingerprint:  cfg.TagsFromEnvFingerprint,
+				EnvFingerprintScript:    cfg.EnvFingerprintScript,
 				WaitForEC2TagsTimeout:   ec2TagTimeout,
 				WaitForGCPLabelsTimeout: gcpLabelsTimeout,
 			}),
 		}
 
+		// Each worker registers with the agent's tags, unless worker groups
+		// give them tags of their own
+		var workerReqs []api.AgentRegisterRequest
+		if len(workerGroups) > 0 {
+			for _, group := range workerGroups {
+				req := registerReq
+				req.Tags = group.MergeTags(registerReq.Tags)
+				if group.Priority != "" {
+					req.Priority = group.Priority
+				}
+				for i := 0; i < group.Count; i++ {
+					workerReqs = append(workerReqs, req)
+				}
+			}
+		} else {
+			for i := 0; i < cfg.Spawn; i++ {
+				workerReqs = append(workerReqs, registerReq)
+			}
+		}
+
+		// Make sure misconfigured agents don't register without the tags they
+		// need, where they'd accept jobs they can't run
+		for _, req := range workerReqs {
+			if missing := agent.MissingTags(req.Tags, cfg.RequireTags); len(missing) > 0 {
+				if cfg.WarnOnMissingTags {
+					l.Warn("Agent is missing required tags: %s", strings.Join(missing, ", "))
+				} else {
+					fatal(l, ExitConfigError, "Agent is missing required tags: %s", strings.Join(missing, ", "))
+				}
+				break
+			}
+		}
+
 		// The common configuration for all workers
 		workerConf := agent.AgentWorkerConfig{
 			AgentConfiguration: agentConf,
@@ -544,27 +978,96 @@ var AgentStartCommand = cli.Command{
 
 		var workers []*agent.AgentWorker
 
-		for i := 1; i <= cfg.Spawn; i++ {
-			if cfg.Spawn == 1 {
+		for i := 1; i <= len(workerReqs); i++ {
+			req := workerReqs[i-1]
+
+			if len(workerReqs) == 1 {
 				l.Info("Registering agent with Buildkite...")
+			} else if len(workerGroups) > 0 {
+				l.Info("Registering agent %d of %d with Buildkite (%s)...", i, len(workerReqs), strings.Join(req.Tags, ", "))
 			} else {
-				l.Info("Registering agent %d of %d with Buildkite...", i, cfg.Spawn)
+				l.Info("Registering agent %d of %d with Buildkite...", i, len(workerReqs))
 			}
 
 			// Register the agent with the buildkite API
-			ag, err := agent.Register(l, client, registerReq)
+			ag, err := agent.Register(l, client, req)
 			if err != nil {
-				l.Fatal("%s", err)
+				fatal(l, exitCodeForError(err), "%s", err)
+			}
+			logger.Redact(l, ag.AccessToken)
+
+			// Tag each worker's log lines when there's more than one, as
+			// they'll be interleaved
+			workerLogger := l.WithPrefix(ag.Name)
+			if len(workerReqs) > 1 {
+				workerLogger = workerLogger.WithFields(logger.StringField(logger.WorkerField, fmt.Sprintf("w%d", i)))
 			}
 
 			// Create an agent worker to run the agent
 			workers = append(workers,
-				agent.NewAgentWorker(l.WithPrefix(ag.Name), ag, mc, workerConf))
+				agent.NewAgentWorker(workerLogger, ag, mc, workerConf))
+		}
+
+		// Keep an eye on the environment fingerprint, and re-register the
+		// workers with the new one when it changes
+		if cfg.TagsFromEnvFingerprint && cfg.EnvFingerprintInterval != "" {
+			interval, err := time.ParseDuration(cfg.EnvFingerprintInterval)
+			if err != nil {
+				fatal(l, ExitConfigError, "Failed to parse env fingerprint interval: %v", err)
+			}
+
+			for _, tag := range registerReq.Tags {
+				if strings.HasPrefix(tag, "env_fingerprint=") && interval > 0 {
+					go agent.WatchEnvFingerprint(l, agent.EnvFingerprint{ProbeScript: cfg.EnvFingerprintScript},
+						strings.TrimPrefix(tag, "env_fingerprint="), interval, func(fingerprint string) {
+							for i, worker := range workers {
+								req := workerReqs[i]
+								req.Tags = agent.WithEnvFingerprintTag(req.Tags, fingerprint)
+
+								ag, err := agent.Register(l, client, req)
+								if err != nil {
+									l.Error("Failed to re-register agent with the new environment fingerprint: %v", err)
+									continue
+								}
+								logger.Redact(l, ag.AccessToken)
+
+								workerReqs[i] = req
+								worker.Reregister(ag)
+							}
+						})
+				}
+			}
 		}
 
 		// Setup the agent pool that spawns agent workers
 		pool := agent.NewAgentPool(l, workers)
 
+		// Listen for local control and status requests
+		if cfg.AdminSocketPath != "" {
+			admin := agent.NewAdminServer(l, cfg.AdminSocketPath)
+			admin.Handle("/control", pool.ControlHandler())
+			admin.Handle("/healthz", pool.HealthHandler())
+			admin.Handle("/transfers", agent.NewTransferRegistry().Handler())
+
+			if err := admin.Listen(); err != nil {
+				l.Fatal("Failed to listen on admin socket: %v", err)
+			}
+			defer admin.Close()
+			logger.OnFatal(func() { admin.Close() })
+		}
+
+		// Run maintenance tasks on their schedules, in between jobs
+		if len(maintenanceTasks) > 0 {
+			scheduler := agent.NewMaintenanceScheduler(l, pool, agentConf, maintenanceTasks)
+			scheduler.Start()
+			defer scheduler.Stop()
+		}
+
+		// If one worker fails, the others are stopped before exiting, so
+		// that their jobs' processes are killed and they're disconnected
+		// rather than left running
+		logger.OnFatal(func() { pool.Stop(false) })
+
 		// Start the agent pool
 		if err := pool.Start(); err != nil {
 			l.Fatal("%s", err)
@@ -10,7 +10,6 @@ import (
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/cliconfig"
-	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/agent/retry"
 	"github.com/urfave/cli"
 )
@@ -42,11 +41,19 @@ Description:
    You can also update just the style of an existing annotation by omitting the
    body entirely and providing a new style value.
 
+   With --append, the body is added to the end of the existing annotation with
+   the same context, instead of replacing it, which is handy for building up
+   an annotation from several steps.
+
+   Annotations that are out of date can be removed with "buildkite-agent
+   annotation remove".
+
 Example:
 
    $ buildkite-agent annotate "All tests passed! :rocket:"
    $ cat annotation.md | buildkite-agent annotate --style "warning"
    $ buildkite-agent annotate --style "success" --context "junit"
+   $ buildkite-agent annotate "* deployed to staging" --context "deploys" --append
    $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"`
 
 type AnnotateConfig struct {
@@ -57,14 +64,20 @@ type AnnotateConfig struct {
 	Job     string `cli:"job" validate:"required"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var AnnotateCommand = cli.Command{
@@ -98,26 +111,40 @@ var AnnotateCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := AnnotateConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		// Check the style here, rather than finding out from a rejected
+		// request after the body's been read
+		switch cfg.Style {
+		case "", "success", "info", "warning", "error":
+		default:
+			fatal(l, ExitConfigError, "Unknown style %q, must be one of success, info, warning or error", cfg.Style)
+		}
+
 		var body string
 		var err error
 
@@ -167,7 +194,7 @@ var AnnotateCommand = cli.Command{
 
 		// Show a fatal error if we gave up trying to create the annotation
 		if err != nil {
-			l.Fatal("Failed to annotate build: %s", err)
+			fatal(l, exitCodeForError(err), "Failed to annotate build: %s", err)
 		}
 
 		l.Info("Successfully annotated build")
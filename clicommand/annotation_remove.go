@@ -0,0 +1,142 @@
+package clicommand
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var AnnotationRemoveHelpDescription = `Usage:
+
+   buildkite-agent annotation remove [arguments...]
+
+Description:
+
+   Removes an annotation from the build, which is handy for clearing ones
+   that are out of date, such as a "tests are running" annotation once the
+   tests have finished.
+
+   The annotation is found by its context, which is "default" for
+   annotations created without one. Removing an annotation that doesn't
+   exist isn't an error, so steps can clear annotations that earlier steps
+   may or may not have made.
+
+Example:
+
+   $ buildkite-agent annotation remove --context "tests-running"`
+
+type AnnotationRemoveConfig struct {
+	Context string `cli:"context" validate:"required"`
+	Job     string `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var AnnotationRemoveCommand = cli.Command{
+	Name:        "remove",
+	Usage:       "Remove an existing annotation from a Buildkite build",
+	Description: AnnotationRemoveHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "context",
+			Value:  "default",
+			Usage:  "The context of the annotation to remove",
+			EnvVar: "BUILDKITE_ANNOTATION_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build should the annotation be removed from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := AnnotationRemoveConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		var notFound bool
+
+		// Retry the removal a few times before giving up
+		err := retry.Do(func(s *retry.Stats) error {
+			resp, err := client.Annotations.Remove(cfg.Job, cfg.Context)
+
+			// There's nothing to remove
+			if resp != nil && resp.StatusCode == 404 {
+				notFound = true
+				s.Break()
+				return nil
+			}
+
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 400) {
+				s.Break()
+				return err
+			}
+
+			// Show the unexpected error
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+
+		// Show a fatal error if we gave up trying to remove the annotation
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to remove annotation: %s", err)
+		}
+
+		if notFound {
+			l.Info("There's no annotation with the context %q to remove", cfg.Context)
+			return
+		}
+
+		l.Info("Successfully removed annotation %q", cfg.Context)
+	},
+}
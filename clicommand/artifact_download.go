@@ -1,9 +1,12 @@
 package clicommand
 
 import (
+	"io"
+	"os"
+
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/cliconfig"
-	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/utils"
 	"github.com/urfave/cli"
 )
 
@@ -31,23 +34,104 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   If multiple artifacts have the same path (for example, from parallel jobs), the
+   last one is downloaded by default. Use --on-conflict to change this:
+
+   $ buildkite-agent artifact download "coverage/*" . --on-conflict rename --build xxx
+
+   Artifacts from jobs that have been retried are left out, unless
+   --include-retried-jobs is given. To download the newest binary that any
+   passing job uploaded, including retried ones:
+
+   $ buildkite-agent artifact download "pkg/app" . --include-retried-jobs --job-state passed --on-conflict latest --build xxx
+
+   To only download artifacts uploaded with particular metadata:
+
+   $ buildkite-agent artifact download "*" . --metadata kind=coverage --build xxx
+
+   Artifacts can be saved to a different layout than they were uploaded with
+   using --path-rewrite from=>to rules, which replace the start of the path.
+   The first rule that matches is used, and paths that none match are left
+   as they are:
+
+   $ buildkite-agent artifact download "dist/*" . --path-rewrite 'dist/=>bin/' --build xxx
+
+   When --cache-dir is set, artifacts are copied from a cache on the host if
+   one with the same sha1sum has been downloaded before, and added to it
+   otherwise. Cached artifacts are checked against their sha1sum before
+   they're used, and downloaded again if they don't match:
+
+   $ buildkite-agent artifact download "deps/*" . --cache-dir /var/cache/buildkite-artifacts --cache-max-size 10GB --build xxx
+
+   Every artifact is downloaded at once unless --parallel limits it. Each one
+   is retried if it fails, and if the server supports range requests an
+   interrupted download carries on from where it stopped instead of starting
+   again:
+
+   $ buildkite-agent artifact download "pkg/*" . --parallel 4 --build xxx
+
+   On hosts shared with services that are sensitive to latency,
+   --download-bandwidth caps how fast the downloads are read between them,
+   so that they don't saturate the network:
+
+   $ buildkite-agent artifact download "pkg/*" . --download-bandwidth 50MB/s --build xxx
+
+   Downloaded artifacts are checked against the sha256sum (or for artifacts
+   uploaded by older agents, the sha1sum) they were uploaded with, and are
+   downloaded again if they don't match. Use --no-verify to skip the check.
+
+   A single artifact can be written to stdout instead of being saved, by
+   giving a download path of "-" (or --stdout), so it can be piped straight
+   into another command. The query must match exactly one artifact. As what
+   was written can't be taken back, an interrupted download is only retried
+   if the server can send the rest of it, and one that doesn't match its
+   checksum fails the command rather than being downloaded again:
+
+   $ buildkite-agent artifact download "manifests/app.yml" - --build xxx | kubectl apply -f -`
 
 type ArtifactDownloadConfig struct {
-	Query       string `cli:"arg:0" label:"artifact search query" validate:"required"`
-	Destination string `cli:"arg:1" label:"artifact download path" validate:"required"`
-	Step        string `cli:"step"`
-	Build       string `cli:"build" validate:"required"`
+	Query              string   `cli:"arg:0" label:"artifact search query" validate:"required"`
+	Destination        string   `cli:"arg:1" label:"artifact download path" validate:"required"`
+	Step               string   `cli:"step"`
+	Build              string   `cli:"build" validate:"required"`
+	OnConflict         string   `cli:"on-conflict"`
+	IncludeRetriedJobs bool     `cli:"include-retried-jobs"`
+	JobStates          []string `cli:"job-state" normalize:"list"`
+	TempDir            string   `cli:"temp-dir" normalize:"filepath"`
+	Fsync              bool     `cli:"fsync"`
+	Metadata           []string `cli:"metadata"`
+	PathRewrites       []string `cli:"path-rewrite"`
+	CacheDir           string   `cli:"cache-dir" normalize:"filepath"`
+	CacheMaxSize       string   `cli:"cache-max-size"`
+	Parallel           int      `cli:"parallel"`
+	NoVerify           bool     `cli:"no-verify"`
+	DownloadBandwidth  string   `cli:"download-bandwidth"`
+	Stdout             bool     `cli:"stdout"`
+
+	// AWS credentials config
+	AssumeRoleARN        string `cli:"assume-role-arn"`
+	AssumeRoleExternalID string `cli:"assume-role-external-id"`
+
+	// Where to report progress to the agent running the job
+	AdminSocketPath string `cli:"admin-socket-path" normalize:"filepath"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var ArtifactDownloadCommand = cli.Command{
@@ -66,45 +150,187 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_BUILD_ID",
 			Usage:  "The build that the artifacts were uploaded to",
 		},
+		cli.StringFlag{
+			Name:   "on-conflict",
+			Value:  "overwrite",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_ON_CONFLICT",
+			Usage:  "What to do when multiple artifacts have the same path: overwrite, skip, rename, fail or latest",
+		},
+		cli.BoolFlag{
+			Name:   "include-retried-jobs",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_INCLUDE_RETRIED_JOBS",
+			Usage:  "Also download artifacts uploaded by jobs that have since been retried",
+		},
+		cli.StringSliceFlag{
+			Name:  "job-state",
+			Value: &cli.StringSlice{},
+			Usage: "Only download artifacts from jobs in this state, such as passed or failed, which can be repeated",
+		},
+		cli.StringFlag{
+			Name:   "temp-dir",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_TEMP_DIR",
+			Usage:  "Where to write artifacts while they're downloading, before they're moved into place (defaults to the download path)",
+		},
+		cli.BoolFlag{
+			Name:   "fsync",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_FSYNC",
+			Usage:  "Flush each artifact to disk before moving it into place",
+		},
+		cli.StringSliceFlag{
+			Name:  "metadata",
+			Value: &cli.StringSlice{},
+			Usage: "Only download artifacts with this key=value metadata, which can be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "path-rewrite",
+			Value: &cli.StringSlice{},
+			Usage: "Save artifacts whose paths start with one thing somewhere else instead, such as 'dist/=>bin/', which can be repeated",
+		},
+		cli.StringFlag{
+			Name:   "cache-dir",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_CACHE_DIR",
+			Usage:  "A directory on the host to cache artifacts in by sha1sum, so they're only downloaded once",
+		},
+		cli.StringFlag{
+			Name:   "cache-max-size",
+			Value:  "",
+			EnvVar: "BUILDKITE_ARTIFACT_CACHE_MAX_SIZE",
+			Usage:  "Remove the least recently used artifacts from the cache once it's bigger than this, e.g. \"10GB\"",
+		},
+		cli.IntFlag{
+			Name:   "parallel",
+			Value:  0,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_PARALLEL",
+			Usage:  "How many artifacts to download at once (defaults to all of them)",
+		},
+		cli.BoolFlag{
+			Name:   "no-verify",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_NO_VERIFY",
+			Usage:  "Don't check that downloaded artifacts have the checksums they were uploaded with",
+		},
+		cli.StringFlag{
+			Name:   "download-bandwidth",
+			Value:  "",
+			Usage:  "The most that downloads can read between them per second, e.g. 50MB/s, with no limit by default",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_BANDWIDTH",
+		},
+		cli.BoolFlag{
+			Name:  "stdout",
+			Usage: "Write the artifact to stdout instead of saving it, which is the same as a download path of \"-\"",
+		},
+
+		// AWS credentials flags
+		AssumeRoleARNFlag,
+		AssumeRoleExternalIDFlag,
+
+		// Progress is reported to the agent's admin socket, if it has one
+		AdminSocketPathFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := ArtifactDownloadConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		metadata, err := agent.ParseArtifactMetadata(cfg.Metadata)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		pathRewrites, err := agent.ParseArtifactPathRewrites(cfg.PathRewrites)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		if cfg.Parallel < 0 {
+			fatal(l, ExitConfigError, "--parallel can't be negative, got %d", cfg.Parallel)
+		}
+
+		// Log output goes to stderr, so stdout only has the artifact
+		var writer io.Writer
+		if cfg.Stdout || cfg.Destination == "-" {
+			if cfg.Destination != "-" {
+				fatal(l, ExitConfigError, "The download path must be \"-\" when using --stdout, got %q", cfg.Destination)
+			}
+			writer = os.Stdout
+		}
+
+		var cacheMaxSize int64
+		if cfg.CacheMaxSize != "" {
+			if cacheMaxSize, err = utils.ParseByteSize(cfg.CacheMaxSize); err != nil {
+				fatal(l, ExitConfigError, "Invalid --cache-max-size: %s", err)
+			}
+		}
+
+		bandwidth, err := agent.ParseBandwidth(cfg.DownloadBandwidth)
+		if err != nil {
+			fatal(l, ExitConfigError, "Invalid --download-bandwidth: %s", err)
+		}
+
 		// Create the API client
 		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
+		// Let the agent show how the downloads are going
+		transfers := agent.NewTransferReporter(l, cfg.AdminSocketPath, os.Getenv("BUILDKITE_JOB_ID"))
+		transfers.Start()
+
 		// Setup the downloader
 		downloader := agent.NewArtifactDownloader(l, client, agent.ArtifactDownloaderConfig{
-			Query:       cfg.Query,
-			Destination: cfg.Destination,
-			BuildID:     cfg.Build,
-			Step:        cfg.Step,
+			Query:              cfg.Query,
+			Destination:        cfg.Destination,
+			BuildID:            cfg.Build,
+			Step:               cfg.Step,
+			OnConflict:         cfg.OnConflict,
+			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
+			JobStates:          cfg.JobStates,
+			TempDir:            cfg.TempDir,
+			Fsync:              cfg.Fsync,
+			Metadata:           metadata,
+			PathRewrites:       pathRewrites,
+			CacheDir:           cfg.CacheDir,
+			CacheMaxSize:       cacheMaxSize,
+			AWSCredentials: agent.AWSCredentialsConfig{
+				AssumeRoleARN:        cfg.AssumeRoleARN,
+				AssumeRoleExternalID: cfg.AssumeRoleExternalID,
+			},
+			Transfers: transfers,
+			Parallel:  cfg.Parallel,
+			NoVerify:  cfg.NoVerify,
+			Bandwidth: bandwidth,
+			Writer:    writer,
 		})
 
 		// Download the artifacts
-		if err := downloader.Download(); err != nil {
-			l.Fatal("Failed to download artifacts: %s", err)
+		err = downloader.Download()
+		transfers.Stop()
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to download artifacts: %s", err)
 		}
 	},
 }
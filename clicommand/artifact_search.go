@@ -0,0 +1,193 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/utils"
+	"github.com/urfave/cli"
+)
+
+var SearchHelpDescription = `Usage:
+
+   buildkite-agent artifact search [arguments...]
+
+Description:
+
+   Lists the artifacts that match a search query, without downloading them,
+   so that scripts can decide what to download. Each artifact's path, size,
+   checksums and the job that uploaded it are shown.
+
+   With --format json, a JSON array of artifacts is printed instead of a
+   table. If no artifacts match, this command exits with a status of 100.
+
+   Note: You need to ensure that your search query is surrounded by quotes if
+   using a wild card as the built-in shell path globbing will provide files,
+   which will break the search.
+
+Example:
+
+   $ buildkite-agent artifact search "pkg/*.tar.gz" --build xxx
+   $ buildkite-agent artifact search "coverage/*" --step "tests" --format json --build xxx`
+
+type ArtifactSearchConfig struct {
+	Query              string   `cli:"arg:0" label:"artifact search query" validate:"required"`
+	Step               string   `cli:"step"`
+	Build              string   `cli:"build" validate:"required"`
+	IncludeRetriedJobs bool     `cli:"include-retried-jobs"`
+	JobStates          []string `cli:"job-state" normalize:"list"`
+	Format             string   `cli:"format"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+// artifactSearchResult is an artifact as it's printed by --format json
+type artifactSearchResult struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Sha1Sum   string `json:"sha1sum"`
+	Sha256Sum string `json:"sha256sum,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	JobState  string `json:"job_state,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+var ArtifactSearchCommand = cli.Command{
+	Name:        "search",
+	Usage:       "Lists the artifacts that match a search query, without downloading them",
+	Description: SearchHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "step",
+			Value: "",
+			Usage: "Scope the search to a paticular step by using either it's name or job ID",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			EnvVar: "BUILDKITE_BUILD_ID",
+			Usage:  "The build that the artifacts were uploaded to",
+		},
+		cli.BoolFlag{
+			Name:  "include-retried-jobs",
+			Usage: "Also list artifacts uploaded by jobs that have since been retried",
+		},
+		cli.StringSliceFlag{
+			Name:  "job-state",
+			Value: &cli.StringSlice{},
+			Usage: "Only list artifacts from jobs in this state, such as passed or failed, which can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "How to print the artifacts, either text or json",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := ArtifactSearchConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.Format != "text" && cfg.Format != "json" {
+			fatal(l, ExitConfigError, "Unknown format %q, must be either text or json", cfg.Format)
+		}
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		artifacts, err := agent.NewArtifactSearcher(l, client, cfg.Build).SearchWithOptions(&api.ArtifactSearchOptions{
+			Query:              cfg.Query,
+			Scope:              cfg.Step,
+			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
+			JobStates:          cfg.JobStates,
+		})
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to find artifacts: %s", err)
+		}
+
+		if cfg.Format == "json" {
+			results := []artifactSearchResult{}
+			for _, a := range artifacts {
+				results = append(results, artifactSearchResult{
+					Path:      a.Path,
+					Size:      a.FileSize,
+					Sha1Sum:   a.Sha1Sum,
+					Sha256Sum: a.Sha256Sum,
+					JobID:     a.JobID,
+					JobState:  a.JobState,
+					CreatedAt: a.CreatedAt,
+				})
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				l.Fatal("Failed to print artifacts: %s", err)
+			}
+		} else if len(artifacts) > 0 {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "PATH\tSIZE\tSHA1SUM\tJOB\tSTATE")
+			for _, a := range artifacts {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					a.Path, utils.FormatByteSize(a.FileSize), a.Sha1Sum, orDash(a.JobID), orDash(a.JobState))
+			}
+			w.Flush()
+		}
+
+		if len(artifacts) == 0 {
+			fatal(l, ExitNotFound, "No artifacts found")
+		}
+	},
+}
+
+// orDash returns s, or "-" if it's empty, for columns in tables
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
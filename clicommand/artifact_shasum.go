@@ -5,7 +5,6 @@ import (
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/cliconfig"
-	"github.com/buildkite/agent/logger"
 	"github.com/urfave/cli"
 )
 
@@ -42,14 +41,20 @@ type ArtifactShasumConfig struct {
 	Build string `cli:"build" validate:"required"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var ArtifactShasumCommand = cli.Command{
@@ -73,21 +78,27 @@ var ArtifactShasumCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := ArtifactShasumConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
@@ -101,13 +112,13 @@ var ArtifactShasumCommand = cli.Command{
 
 		artifacts, err := searcher.Search(cfg.Query, cfg.Step)
 		if err != nil {
-			l.Fatal("Failed to find artifacts: %s", err)
+			fatal(l, exitCodeForError(err), "Failed to find artifacts: %s", err)
 		}
 
 		artifactsFoundLength := len(artifacts)
 
 		if artifactsFoundLength == 0 {
-			l.Fatal("No artifacts found for downloading")
+			fatal(l, ExitNotFound, "No artifacts found for downloading")
 		} else if artifactsFoundLength > 1 {
 			l.Fatal("Multiple artifacts were found. Try being more specific with the search or scope by step")
 		} else {
@@ -1,15 +1,17 @@
 package clicommand
 
 import (
+	"os"
+
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/cliconfig"
-	"github.com/buildkite/agent/logger"
 	"github.com/urfave/cli"
 )
 
 var UploadHelpDescription = `Usage:
 
    buildkite-agent artifact upload <pattern> <destination> [arguments...]
+   buildkite-agent artifact upload --stdin --name <path> <destination> [arguments...]
 
 Description:
 
@@ -19,6 +21,10 @@ Description:
    built-in shell path globbing will provide the files, which is currently not
    supported.
 
+   With --stdin, STDIN is streamed straight to the destination as a single
+   artifact called --name, without being written to disk. This requires a
+   destination such as s3://, and the upload isn't retried if it fails.
+
 Example:
 
    $ buildkite-agent artifact upload "log/**/*.log"
@@ -31,26 +37,152 @@ Example:
    $ export BUILDKITE_S3_ACL=private # default is public-read
    $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID
 
+   Instead of access keys, credentials can come from AWS_ACCESS_KEY_ID and
+   AWS_SECRET_ACCESS_KEY, a profile in ~/.aws/credentials (set with
+   BUILDKITE_S3_PROFILE or AWS_PROFILE), a web identity token in
+   AWS_WEB_IDENTITY_TOKEN_FILE, or the EC2 instance or ECS task. To use a
+   bucket in another account, a role can be assumed with those credentials:
+
+   $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID \
+       --assume-role-arn arn:aws:iam::123456789012:role/artifacts --assume-role-external-id xxx
+
+   Artifacts can be encrypted with SSE-S3 (AES256) or SSE-KMS (aws:kms),
+   optionally with a particular KMS key, and given a storage class and
+   canned ACL. Downloads use the same credentials, so they work with private
+   buckets and KMS keys that those credentials can use:
+
+   $ buildkite-agent artifact upload "pkg/*" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID \
+       --s3-sse-kms-key-id alias/artifacts --s3-storage-class STANDARD_IA --s3-acl bucket-owner-full-control
+
    Or upload directly to Google Cloud Storage:
 
    $ export BUILDKITE_GS_ACL=private
-   $ buildkite-agent artifact upload "log/**/*.log" gs://name-of-your-gs-bucket/$BUILDKITE_JOB_ID`
+   $ buildkite-agent artifact upload "log/**/*.log" gs://name-of-your-gs-bucket/$BUILDKITE_JOB_ID
+
+   Or to Azure Blob Storage, with a connection string in
+   BUILDKITE_AZURE_STORAGE_CONNECTION_STRING, or otherwise the storage account
+   and the VM's managed identity (choosing a user-assigned identity with
+   BUILDKITE_AZURE_CLIENT_ID):
+
+   $ export BUILDKITE_AZURE_STORAGE_ACCOUNT=myaccount
+   $ buildkite-agent artifact upload "log/**/*.log" az://name-of-your-container/$BUILDKITE_JOB_ID
+
+   Destinations with any other scheme are handed to a helper program on the
+   PATH named after it, in the same way as git credential helpers. For
+   foo://bucket/path, buildkite-artifact-foo is run as:
+
+   $ buildkite-artifact-foo upload foo://bucket/path artifact/path < artifact
+   $ buildkite-artifact-foo download foo://bucket/path artifact/path > artifact
+   $ buildkite-artifact-foo url foo://bucket/path artifact/path
+
+   Uploads are given the content type and metadata (as a JSON object) in
+   BUILDKITE_ARTIFACT_CONTENT_TYPE and BUILDKITE_ARTIFACT_METADATA, and
+   anything the helper writes to stderr is shown if it fails. Backends can
+   also be compiled into the agent with agent.RegisterArtifactBackend.
+
+   The content type of each artifact is detected from its extension, or
+   otherwise from the start of its contents, so that HTML reports and images
+   are shown in browsers instead of being downloaded. It can be set instead
+   with --content-type:
+
+   $ buildkite-agent artifact upload "coverage/index" --content-type text/html
+
+   Artifacts can be tagged with metadata, which is also stored as object tags,
+   metadata or properties when uploading to S3, GCS, Artifactory or Azure:
+
+   $ buildkite-agent artifact upload "coverage/**/*" --metadata team=payments --metadata kind=coverage
+
+   Text artifacts can be much smaller compressed. With --compress, artifacts
+   are compressed with gzip or zstd as they're uploaded, which is recorded in
+   their content-encoding metadata, and they're decompressed again when
+   they're downloaded. Their size and checksums are of the uncompressed
+   files. zstd needs the zstd command to be installed where artifacts are
+   uploaded and downloaded:
+
+   $ buildkite-agent artifact upload "log/**/*.log" --compress zstd
+
+   On hosts shared with services that are sensitive to latency,
+   --upload-bandwidth caps how fast the uploads read artifacts between them,
+   so that they don't saturate the network:
+
+   $ buildkite-agent artifact upload "pkg/*" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID --upload-bandwidth 50MB/s
+
+   Artifacts can be scanned once they've been found and before any of them
+   are uploaded. --scan-secrets looks for well known kinds of credentials,
+   such as AWS access keys and private keys, in text files. --scan-command
+   runs a command such as a virus scanner with the path of each artifact,
+   which exits with 0 if it's clean, 1 if it found problems (printing one
+   per line) and anything else if it couldn't scan it. What's found is
+   added to an annotation on the build. With --scan-action block (the
+   default) artifacts with problems aren't uploaded and the upload fails,
+   and with --scan-action flag they're uploaded anyway. Artifacts that can't
+   be scanned stop the upload. To scan every job's artifacts, set
+   BUILDKITE_ARTIFACT_SCAN_SECRETS or BUILDKITE_ARTIFACT_SCAN_COMMAND in the
+   agent's environment hook:
+
+   $ buildkite-agent artifact upload "pkg/*" --scan-secrets --scan-command "clamscan --no-summary --infected"
+
+   When the agent running the job has an artifact proxy (the artifact-proxy
+   experiment), uploads to destinations such as s3:// are handed
+   to it, including from inside containers that the proxy's socket is
+   mounted into, and it uploads them with the agent's own credentials. This
+   keeps cloud credentials out of the job, but means that jobs can upload to
+   anywhere the agent's credentials can. To upload with this process's own
+   credentials instead, use --no-artifact-proxy.
+
+   Or stream the output of a command as an artifact:
+
+   $ pg_dump app | zstd | buildkite-agent artifact upload --stdin --name dump.sql.zst s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID`
 
 type ArtifactUploadConfig struct {
-	UploadPaths string `cli:"arg:0" label:"upload paths" validate:"required"`
-	Destination string `cli:"arg:1" label:"destination" env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
-	Job         string `cli:"job" validate:"required"`
-	ContentType string `cli:"content-type"`
+	UploadPaths string   `cli:"arg:0" label:"upload paths"`
+	Destination string   `cli:"arg:1" label:"destination" env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
+	Job         string   `cli:"job" validate:"required"`
+	ContentType string   `cli:"content-type"`
+	Stdin       bool     `cli:"stdin"`
+	Name        string   `cli:"name"`
+	Metadata    []string `cli:"metadata"`
+	Compress    string   `cli:"compress"`
+	Bandwidth   string   `cli:"upload-bandwidth"`
+
+	// Scanning config
+	ScanSecrets bool   `cli:"scan-secrets"`
+	ScanCommand string `cli:"scan-command"`
+	ScanAction  string `cli:"scan-action"`
+
+	// AWS credentials config
+	AssumeRoleARN        string `cli:"assume-role-arn"`
+	AssumeRoleExternalID string `cli:"assume-role-external-id"`
+
+	// S3 storage config
+	S3ACL                  string `cli:"s3-acl"`
+	S3ServerSideEncryption string `cli:"s3-server-side-encryption"`
+	S3SSEKMSKeyID          string `cli:"s3-sse-kms-key-id"`
+	S3StorageClass         string `cli:"s3-storage-class"`
+
+	// Where to report progress to the agent running the job
+	AdminSocketPath string `cli:"admin-socket-path" normalize:"filepath"`
+
+	// The artifact proxy of the agent running the job
+	ArtifactProxyURL    string `cli:"artifact-proxy-url"`
+	ArtifactProxySocket string `cli:"artifact-proxy-socket" normalize:"filepath"`
+	NoArtifactProxy     bool   `cli:"no-artifact-proxy"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var ArtifactUploadCommand = cli.Command{
@@ -70,45 +202,247 @@ var ArtifactUploadCommand = cli.Command{
 			Usage:  "A specific Content-Type to set for the artifacts (otherwise detected)",
 			EnvVar: "BUILDKITE_ARTIFACT_CONTENT_TYPE",
 		},
+		cli.BoolFlag{
+			Name:  "stdin",
+			Usage: "Upload STDIN as a single artifact instead of files matching a pattern",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Value: "",
+			Usage: "The path of the artifact uploaded with --stdin",
+		},
+		cli.StringSliceFlag{
+			Name:   "metadata",
+			Value:  &cli.StringSlice{},
+			Usage:  "A key=value pair to store with the artifacts, which can be repeated (e.g. --metadata team=payments)",
+			EnvVar: "BUILDKITE_ARTIFACT_METADATA",
+		},
+		cli.StringFlag{
+			Name:   "compress",
+			Value:  "",
+			Usage:  "Compress artifacts as they're uploaded, with either gzip or zstd. They're decompressed again when they're downloaded",
+			EnvVar: "BUILDKITE_ARTIFACT_COMPRESS",
+		},
+		cli.StringFlag{
+			Name:   "upload-bandwidth",
+			Value:  "",
+			Usage:  "The most that uploads can read between them per second, e.g. 50MB/s, with no limit by default",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_BANDWIDTH",
+		},
+
+		// Scanning flags
+		cli.BoolFlag{
+			Name:   "scan-secrets",
+			Usage:  "Scan artifacts for credentials such as AWS access keys and private keys before they're uploaded",
+			EnvVar: "BUILDKITE_ARTIFACT_SCAN_SECRETS",
+		},
+		cli.StringFlag{
+			Name:   "scan-command",
+			Value:  "",
+			Usage:  "A command to scan each artifact with before it's uploaded, such as a virus scanner, which is given the artifact's path",
+			EnvVar: "BUILDKITE_ARTIFACT_SCAN_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "scan-action",
+			Value:  "block",
+			Usage:  "What to do with artifacts that scanning finds problems with, either block (don't upload them) or flag (upload them anyway)",
+			EnvVar: "BUILDKITE_ARTIFACT_SCAN_ACTION",
+		},
+
+		// AWS credentials flags
+		AssumeRoleARNFlag,
+		AssumeRoleExternalIDFlag,
+
+		// S3 storage flags
+		cli.StringFlag{
+			Name:   "s3-acl",
+			Value:  "",
+			Usage:  "The canned ACL for artifacts uploaded to S3, such as private or bucket-owner-full-control (default: public-read)",
+			EnvVar: "BUILDKITE_S3_ACL",
+		},
+		cli.StringFlag{
+			Name:   "s3-server-side-encryption",
+			Value:  "",
+			Usage:  "How S3 encrypts artifacts, either AES256 (SSE-S3) or aws:kms (SSE-KMS), otherwise the bucket's default is used",
+			EnvVar: "BUILDKITE_S3_SERVER_SIDE_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "s3-sse-kms-key-id",
+			Value:  "",
+			Usage:  "The KMS key ID, ARN or alias to encrypt artifacts uploaded to S3 with, which implies aws:kms encryption",
+			EnvVar: "BUILDKITE_S3_SSE_KMS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "s3-storage-class",
+			Value:  "",
+			Usage:  "The storage class for artifacts uploaded to S3, such as STANDARD_IA (default: STANDARD)",
+			EnvVar: "BUILDKITE_S3_STORAGE_CLASS",
+		},
+
+		// Progress is reported to the agent's admin socket, if it has one
+		AdminSocketPathFlag,
+
+		// Artifact proxy flags
+		cli.StringFlag{
+			Name:   "artifact-proxy-url",
+			Value:  "",
+			Usage:  "The artifact proxy of the agent running the job, which uploads to destinations such as s3:// with the agent's credentials",
+			EnvVar: "BUILDKITE_ARTIFACT_PROXY_URL",
+			Hidden: true,
+		},
+		cli.StringFlag{
+			Name:   "artifact-proxy-socket",
+			Value:  "",
+			Usage:  "The unix socket to reach the artifact proxy through",
+			EnvVar: "BUILDKITE_ARTIFACT_PROXY_SOCKET",
+			Hidden: true,
+		},
+		cli.BoolFlag{
+			Name:   "no-artifact-proxy",
+			Usage:  "Upload with this process's own credentials, even if the agent running the job has an artifact proxy",
+			EnvVar: "BUILDKITE_NO_ARTIFACT_PROXY",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := ArtifactUploadConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		// With --stdin there's no pattern, so the first argument is the
+		// destination
+		if cfg.Stdin {
+			if c.NArg() > 1 {
+				fatal(l, ExitConfigError, "Upload paths can't be used with --stdin. See: `buildkite-agent artifact upload --help`")
+			}
+			if cfg.UploadPaths != "" {
+				cfg.Destination = cfg.UploadPaths
+				cfg.UploadPaths = ""
+			}
+			if cfg.Name == "" {
+				fatal(l, ExitConfigError, "Missing name, which is required with --stdin. See: `buildkite-agent artifact upload --help`")
+			}
+		} else if cfg.UploadPaths == "" {
+			fatal(l, ExitConfigError, "Missing upload paths. See: `buildkite-agent artifact upload --help`")
+		}
+
+		metadata, err := agent.ParseArtifactMetadata(cfg.Metadata)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		if cfg.Compress != "" {
+			if err := agent.ValidateArtifactCompression(cfg.Compress); err != nil {
+				fatal(l, ExitConfigError, "%s", err)
+			}
+		}
+
+		bandwidth, err := agent.ParseBandwidth(cfg.Bandwidth)
+		if err != nil {
+			fatal(l, ExitConfigError, "Invalid --upload-bandwidth: %s", err)
+		}
+
+		var scanners []agent.ArtifactScanner
+		if cfg.ScanSecrets {
+			scanners = append(scanners, agent.SecretArtifactScanner{})
+		}
+		if cfg.ScanCommand != "" {
+			scanner, err := agent.NewCommandArtifactScanner(cfg.ScanCommand)
+			if err != nil {
+				fatal(l, ExitConfigError, "%s", err)
+			}
+			scanners = append(scanners, scanner)
+		}
+		if err := agent.ValidateArtifactScanAction(cfg.ScanAction); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+		if cfg.Stdin && len(scanners) > 0 {
+			fatal(l, ExitConfigError, "Artifacts uploaded with --stdin can't be scanned. See: `buildkite-agent artifact upload --help`")
+		}
+
+		s3Options := agent.S3UploadOptions{
+			ACL:                  cfg.S3ACL,
+			ServerSideEncryption: cfg.S3ServerSideEncryption,
+			SSEKMSKeyID:          cfg.S3SSEKMSKeyID,
+			StorageClass:         cfg.S3StorageClass,
+		}
+		if err := s3Options.Validate(); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
 		// Create the API client
 		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
+		// Let the agent show how the uploads are going
+		transfers := agent.NewTransferReporter(l, cfg.AdminSocketPath, cfg.Job)
+		transfers.Start()
+
+		// Unless told otherwise, cloud uploads go through the agent's artifact
+		// proxy if it has one
+		var proxyURL, proxySocket string
+		if !cfg.NoArtifactProxy {
+			proxyURL, proxySocket = cfg.ArtifactProxyURL, cfg.ArtifactProxySocket
+		}
+
 		// Setup the uploader
 		uploader := agent.NewArtifactUploader(l, client, agent.ArtifactUploaderConfig{
 			JobID:       cfg.Job,
 			Paths:       cfg.UploadPaths,
 			Destination: cfg.Destination,
 			ContentType: cfg.ContentType,
+			Metadata:    metadata,
+			Compress:    cfg.Compress,
+			Bandwidth:   bandwidth,
+			AWSCredentials: agent.AWSCredentialsConfig{
+				AssumeRoleARN:        cfg.AssumeRoleARN,
+				AssumeRoleExternalID: cfg.AssumeRoleExternalID,
+			},
+			S3Options:   s3Options,
+			Transfers:   transfers,
+			ProxyURL:    proxyURL,
+			ProxySocket: proxySocket,
+			Scanners:    scanners,
+			ScanAction:  cfg.ScanAction,
 		})
 
+		if cfg.Stdin {
+			err := uploader.UploadStream(os.Stdin, cfg.Name)
+			transfers.Stop()
+			if err != nil {
+				fatal(l, exitCodeForError(err), "Failed to upload artifact: %s", err)
+			}
+			return
+		}
+
 		// Upload the artifacts
-		if err := uploader.Upload(); err != nil {
-			l.Fatal("Failed to upload artifacts: %s", err)
+		err = uploader.Upload()
+		transfers.Stop()
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to upload artifacts: %s", err)
 		}
 	},
 }
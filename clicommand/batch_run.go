@@ -0,0 +1,177 @@
+package clicommand
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/buildkite/agent/batch"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/shellwords"
+	"github.com/urfave/cli"
+)
+
+var BatchRunHelpDescription = `Usage:
+
+   buildkite-agent batch run [arguments...]
+
+Description:
+
+   Runs a list of commands, several at a time, within a single job. Commands
+   are read one per line from the --from file, or from STDIN if no file is
+   given. Blank lines and lines starting with # are ignored.
+
+   Every line of output is prefixed with the number of the command it came
+   from, such as [3], and lines are never split up by other commands'
+   output. Because of the prefix, commands can't start log sections (such as
+   with "--- Running tests"), which would otherwise swallow the output of the
+   commands running alongside them.
+
+   Once every command has finished, a summary of their exit statuses is
+   printed. This command exits with the status of the first command (in the
+   order they were given) that failed, or 0 if they all succeeded.
+
+Example:
+
+   $ buildkite-agent batch run --max-parallel 4 --from commands.txt
+   $ ls packages | sed 's/^/make -C packages\//' | buildkite-agent batch run`
+
+type BatchRunConfig struct {
+	MaxParallel int    `cli:"max-parallel"`
+	From        string `cli:"from" normalize:"filepath"`
+	Shell       string `cli:"shell"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var BatchRunCommand = cli.Command{
+	Name:        "run",
+	Usage:       "Runs many commands in parallel within a job",
+	Description: BatchRunHelpDescription,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "max-parallel",
+			Value:  4,
+			Usage:  "How many commands to run at once",
+			EnvVar: "BUILDKITE_BATCH_MAX_PARALLEL",
+		},
+		cli.StringFlag{
+			Name:  "from",
+			Value: "",
+			Usage: "A file containing the commands to run, one per line (defaults to STDIN)",
+		},
+		cli.StringFlag{
+			Name:   "shell",
+			Value:  DefaultShell(),
+			Usage:  "The shell command used to interpret each command, e.g /bin/bash -e -c",
+			EnvVar: "BUILDKITE_SHELL",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := BatchRunConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.MaxParallel < 1 {
+			fatal(l, ExitConfigError, "--max-parallel must be at least 1, got %d", cfg.MaxParallel)
+		}
+
+		shell, err := shellwords.Split(cfg.Shell)
+		if err != nil || len(shell) == 0 {
+			fatal(l, ExitConfigError, "Failed to parse shell %q: %v", cfg.Shell, err)
+		}
+
+		var r io.Reader = os.Stdin
+		if cfg.From != "" && cfg.From != "-" {
+			f, err := os.Open(cfg.From)
+			if err != nil {
+				fatal(l, ExitConfigError, "Failed to open commands: %v", err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		lines, err := readLines(r)
+		if err != nil {
+			l.Fatal("Failed to read commands: %v", err)
+		}
+
+		var commands []string
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "#") {
+				commands = append(commands, line)
+			}
+		}
+
+		if len(commands) == 0 {
+			l.Warn("No commands to run")
+			return
+		}
+
+		// Stop starting commands and terminate the running ones when the
+		// job is cancelled
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt,
+			syscall.SIGHUP,
+			syscall.SIGTERM,
+			syscall.SIGINT,
+			syscall.SIGQUIT)
+		defer signal.Stop(signals)
+
+		go func() {
+			for sig := range signals {
+				l.Warn("Received %v, stopping commands", sig)
+				cancel()
+			}
+		}()
+
+		l.Info("Running %d commands, %d at a time", len(commands), cfg.MaxParallel)
+
+		results, err := batch.Run(ctx, l, commands, batch.Config{
+			MaxParallel: cfg.MaxParallel,
+			Shell:       shell,
+			Output:      os.Stdout,
+		})
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		for i, result := range results {
+			switch {
+			case result.Skipped:
+				l.Warn("%s Skipped %q", batch.Tag(i), result.Command)
+			case result.ExitStatus != 0:
+				l.Error("%s %q failed with exit status %d after %s", batch.Tag(i), result.Command, result.ExitStatus, result.Duration)
+			default:
+				l.Info("%s %q finished in %s", batch.Tag(i), result.Command, result.Duration)
+			}
+		}
+
+		os.Exit(batch.ExitStatus(results))
+	},
+}
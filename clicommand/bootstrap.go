@@ -35,6 +35,18 @@ Description:
    The bootstrap is also responsible for executing hooks around the phases.
    See https://buildkite.com/docs/agent/v3/hooks for more details.
 
+   Variables that hooks export are passed on to the rest of the job. Hooks can
+   also write them to the file in $BUILDKITE_HOOK_ENV_FILE, which works the
+   same way in every shell and copes with any value. Each line is either
+   KEY=VALUE, where the value is the rest of the line as it is (no quoting or
+   escaping), or KEY<<DELIMITER, followed by the lines of a multi-line value
+   and then a line that is just DELIMITER. Blank lines and lines starting with
+   # are ignored, and the last value written for a key wins, including over
+   anything the hook exported.
+
+     echo "GOPATH=$HOME/go" >> "$BUILDKITE_HOOK_ENV_FILE"
+     printf 'NOTES<<EOF\n%s\nEOF\n' "$notes" >> "$BUILDKITE_HOOK_ENV_FILE"
+
 Example:
 
    $ eval $(curl -s -H "Authorization: Bearer xxx" \
@@ -59,7 +71,11 @@ type BootstrapConfig struct {
 	PipelineProvider             string   `cli:"pipeline-provider" validate:"required"`
 	AutomaticArtifactUploadPaths string   `cli:"artifact-upload-paths"`
 	ArtifactUploadDestination    string   `cli:"artifact-upload-destination"`
+	ReproducibleOutputPaths      string   `cli:"reproducible-outputs"`
 	CleanCheckout                bool     `cli:"clean-checkout"`
+	CleanCheckoutEvery           string   `cli:"clean-checkout-every"`
+	EncryptedWorkspace           bool     `cli:"encrypted-workspace"`
+	EncryptedWorkspaceSize       string   `cli:"encrypted-workspace-size"`
 	GitCloneFlags                string   `cli:"git-clone-flags"`
 	GitCloneMirrorFlags          string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags                string   `cli:"git-clean-flags"`
@@ -75,7 +91,10 @@ type BootstrapConfig struct {
 	LocalHooksEnabled            bool     `cli:"local-hooks-enabled"`
 	PTY                          bool     `cli:"pty"`
 	Debug                        bool     `cli:"debug"`
+	LogFormat                    string   `cli:"log-format"`
+	LogLevel                     string   `cli:"log-level"`
 	Shell                        string   `cli:"shell"`
+	Arch                         string   `cli:"arch"`
 	Experiments                  []string `cli:"experiment" normalize:"list"`
 	Phases                       []string `cli:"phases" normalize:"list"`
 }
@@ -175,11 +194,34 @@ var BootstrapCommand = cli.Command{
 			Usage:  "A custom location to upload artifact paths to (i.e. s3://my-custom-bucket)",
 			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
 		},
+		cli.StringFlag{
+			Name:   "reproducible-outputs",
+			Value:  "",
+			Usage:  "Paths to outputs of the command to hash and compare with earlier attempts of the job and the build it was rebuilt from, annotating the build if they differ",
+			EnvVar: "BUILDKITE_REPRODUCIBLE_OUTPUTS",
+		},
 		cli.BoolFlag{
 			Name:   "clean-checkout",
 			Usage:  "Whether or not the bootstrap should remove the existing repository before running the command",
 			EnvVar: "BUILDKITE_CLEAN_CHECKOUT",
 		},
+		cli.StringFlag{
+			Name:   "clean-checkout-every",
+			Value:  "",
+			Usage:  "Remove the existing repository every so many jobs or so long, such as 50-jobs, 24h or both (50-jobs,24h)",
+			EnvVar: "BUILDKITE_CLEAN_CHECKOUT_EVERY",
+		},
+		cli.BoolFlag{
+			Name:   "encrypted-workspace",
+			Usage:  "Check out the repository onto an encrypted volume that's destroyed when the job finishes",
+			EnvVar: "BUILDKITE_ENCRYPTED_WORKSPACE",
+		},
+		cli.StringFlag{
+			Name:   "encrypted-workspace-size",
+			Value:  "10GB",
+			Usage:  "The size of the encrypted volume, which only uses disk space as it's filled",
+			EnvVar: "BUILDKITE_ENCRYPTED_WORKSPACE_SIZE",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-flags",
 			Value:  "-v",
@@ -275,16 +317,24 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_SHELL",
 			Value:  DefaultShell(),
 		},
+		cli.StringFlag{
+			Name:   "arch",
+			Value:  "",
+			Usage:  "The architecture to run the command as, such as x86_64 to run it under Rosetta on Apple Silicon Macs",
+			EnvVar: "BUILDKITE_ARCH",
+		},
 		cli.StringSliceFlag{
 			Name:   "phases",
 			Usage:  "The specific phases to execute. The order they're defined is is irrelevant.",
 			EnvVar: "BUILDKITE_BOOTSTRAP_PHASES",
 		},
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := BootstrapConfig{}
@@ -341,7 +391,11 @@ var BootstrapCommand = cli.Command{
 			OrganizationSlug:             cfg.OrganizationSlug,
 			AutomaticArtifactUploadPaths: cfg.AutomaticArtifactUploadPaths,
 			ArtifactUploadDestination:    cfg.ArtifactUploadDestination,
+			ReproducibleOutputPaths:      cfg.ReproducibleOutputPaths,
 			CleanCheckout:                cfg.CleanCheckout,
+			CleanCheckoutEvery:           cfg.CleanCheckoutEvery,
+			EncryptedWorkspace:           cfg.EncryptedWorkspace,
+			EncryptedWorkspaceSize:       cfg.EncryptedWorkspaceSize,
 			BuildPath:                    cfg.BuildPath,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
@@ -356,6 +410,7 @@ var BootstrapCommand = cli.Command{
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
 			SSHKeyscan:                   cfg.SSHKeyscan,
 			Shell:                        cfg.Shell,
+			Arch:                         cfg.Arch,
 			Phases:                       cfg.Phases,
 		})
 
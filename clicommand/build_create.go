@@ -0,0 +1,205 @@
+package clicommand
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var BuildCreateHelpDescription = `Usage:
+
+   buildkite-agent build create [arguments...]
+
+Description:
+
+   Creates a new build of another pipeline, using the credentials of the
+   currently running job rather than a separate API token.
+
+   The ID of the new build is printed to STDOUT, so it can be passed to
+   "buildkite-agent build wait".
+
+Example:
+
+   $ buildkite-agent build create --pipeline "deploy" --branch "main" \
+       --env "ENVIRONMENT=production" --meta-data "release=v1.2.3"
+   $ buildkite-agent build wait "$(buildkite-agent build create --pipeline deploy)"`
+
+type BuildCreateConfig struct {
+	Pipeline string   `cli:"pipeline" validate:"required"`
+	Commit   string   `cli:"commit"`
+	Branch   string   `cli:"branch"`
+	Message  string   `cli:"message"`
+	Env      []string `cli:"env"`
+	MetaData []string `cli:"meta-data"`
+	Job      string   `cli:"job" validate:"required"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var BuildCreateCommand = cli.Command{
+	Name:        "create",
+	Usage:       "Creates a new build of a pipeline",
+	Description: BuildCreateHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "pipeline",
+			Value: "",
+			Usage: "The slug of the pipeline to create the build in",
+		},
+		cli.StringFlag{
+			Name:  "commit",
+			Value: "HEAD",
+			Usage: "The commit to build",
+		},
+		cli.StringFlag{
+			Name:  "branch",
+			Value: "",
+			Usage: "The branch to build, defaults to the pipelines default branch",
+		},
+		cli.StringFlag{
+			Name:  "message",
+			Value: "",
+			Usage: "The message for the build",
+		},
+		cli.StringSliceFlag{
+			Name:  "env",
+			Value: &cli.StringSlice{},
+			Usage: "An environment variable to set on the build in the form KEY=VALUE (can be specified multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "meta-data",
+			Value: &cli.StringSlice{},
+			Usage: "Meta-data to set on the build in the form KEY=VALUE (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should the build be created from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := BuildCreateConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		env, err := parseKeyValuePairs(cfg.Env)
+		if err != nil {
+			fatal(l, ExitConfigError, "Invalid --env: %s", err)
+		}
+
+		metaData, err := parseKeyValuePairs(cfg.MetaData)
+		if err != nil {
+			fatal(l, ExitConfigError, "Invalid --meta-data: %s", err)
+		}
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		// Generate a UUID that will identify this build. We do this outside
+		// of the retry loop so that if a request times out after the build
+		// was created, retrying it doesn't create another one.
+		create := &api.BuildCreate{
+			UUID:     api.NewUUID(),
+			Pipeline: cfg.Pipeline,
+			Commit:   cfg.Commit,
+			Branch:   cfg.Branch,
+			Message:  cfg.Message,
+			Env:      env,
+			MetaData: metaData,
+		}
+
+		var build *api.Build
+		var resp *api.Response
+
+		// Retry the build creation a few times before giving up
+		err = retry.Do(func(s *retry.Stats) error {
+			build, resp, err = client.Builds.Create(cfg.Job, create)
+
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 403 || resp.StatusCode == 404 || resp.StatusCode == 400 || resp.StatusCode == 422) {
+				s.Break()
+				return err
+			}
+
+			// Show the unexpected error
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to create build: %s", err)
+		}
+
+		l.Info("Created build #%d of %s %s", build.Number, cfg.Pipeline, build.WebURL)
+
+		// Output the build id so it can be used by other commands
+		fmt.Println(build.ID)
+	},
+}
+
+// parseKeyValuePairs turns a list of KEY=VALUE strings into a map
+func parseKeyValuePairs(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not in the form KEY=VALUE", pair)
+		}
+		m[parts[0]] = parts[1]
+	}
+
+	return m, nil
+}
@@ -0,0 +1,144 @@
+package clicommand
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/buildsummary"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var BuildSummaryHelpDescription = `Usage:
+
+   buildkite-agent build summary [build] [arguments...]
+
+Description:
+
+   Prints a summary of the state and timing of a build's steps, which is the
+   current build unless another one is given.
+
+   This is meant for a final step that reports on the build it's part of,
+   such as by posting to Slack or a wiki, without needing an API token of its
+   own. Steps that are still running (including the one running this
+   command) are timed up until now.
+
+   The summary can be printed as JSON, or as Markdown that can be posted as
+   it is, or used as an annotation.
+
+Example:
+
+   $ buildkite-agent build summary --format markdown | buildkite-agent annotate --context summary
+   $ buildkite-agent build summary --format json | jq '.states.failed'`
+
+type BuildSummaryConfig struct {
+	Build  string `cli:"arg:0" label:"build" env:"BUILDKITE_BUILD_ID" validate:"required"`
+	Format string `cli:"format"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var BuildSummaryCommand = cli.Command{
+	Name:        "summary",
+	Usage:       "Prints a summary of the state and timing of a build's steps",
+	Description: BuildSummaryHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "markdown",
+			Usage:  "How to print the summary, either markdown or json",
+			EnvVar: "BUILDKITE_BUILD_SUMMARY_FORMAT",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := BuildSummaryConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.Format != "markdown" && cfg.Format != "json" {
+			fatal(l, ExitConfigError, "Invalid format %q, expected markdown or json", cfg.Format)
+		}
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		var build *api.Build
+		var steps []*api.BuildStep
+
+		err := retry.Do(func(s *retry.Stats) error {
+			var resp *api.Response
+			var err error
+
+			build, resp, err = client.Builds.Get(cfg.Build)
+			if err == nil {
+				steps, resp, err = client.Builds.Steps(cfg.Build)
+			}
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				s.Break()
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to get build: %s", err)
+		}
+
+		summary := buildsummary.Summarize(build, steps, time.Now())
+
+		if cfg.Format == "json" {
+			out, err := summary.JSON()
+			if err != nil {
+				fatal(l, ExitError, "Failed to encode the summary: %s", err)
+			}
+			fmt.Print(out)
+			return
+		}
+
+		fmt.Print(summary.Markdown())
+	},
+}
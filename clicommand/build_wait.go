@@ -0,0 +1,181 @@
+package clicommand
+
+import (
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var BuildWaitHelpDescription = `Usage:
+
+   buildkite-agent build wait <build> [arguments...]
+
+Description:
+
+   Waits for another build (such as one created by a trigger step) to finish,
+   and exits with a status that reflects the result of that build.
+
+   The build is polled until it reaches a finished state, or until the
+   timeout is reached.
+
+   The exit status is:
+
+     0  The build passed
+     1  An error occurred whilst waiting for the build
+     2  The build failed
+     3  The build was canceled
+     4  The build was skipped or not run
+     5  The timeout was reached before the build finished
+
+   Other failures use the exit codes listed by "buildkite-agent --list-exit-codes".
+
+Example:
+
+   $ buildkite-agent build wait "0c8aa2f8-09c4-4c0d-a5a0-1f8ba3e2d1b9" --timeout 30m`
+
+type BuildWaitConfig struct {
+	Build        string `cli:"arg:0" label:"build" validate:"required"`
+	Timeout      string `cli:"timeout"`
+	PollInterval string `cli:"poll-interval"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var BuildWaitCommand = cli.Command{
+	Name:        "wait",
+	Usage:       "Waits for a build to finish and exits with a status reflecting its result",
+	Description: BuildWaitHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "timeout",
+			Value: "30m",
+			Usage: "How long to wait for the build to finish, such as 90s or 30m",
+		},
+		cli.StringFlag{
+			Name:  "poll-interval",
+			Value: "10s",
+			Usage: "How often to check the state of the build",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := BuildWaitConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			fatal(l, ExitConfigError, "Failed to parse timeout %q: %s", cfg.Timeout, err)
+		}
+
+		pollInterval, err := time.ParseDuration(cfg.PollInterval)
+		if err != nil {
+			fatal(l, ExitConfigError, "Failed to parse poll interval %q: %s", cfg.PollInterval, err)
+		}
+		if pollInterval <= 0 {
+			fatal(l, ExitConfigError, "The poll interval must be more than 0, not %q", cfg.PollInterval)
+		}
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		deadline := time.Now().Add(timeout)
+
+		for {
+			var build *api.Build
+			var resp *api.Response
+
+			err = retry.Do(func(s *retry.Stats) error {
+				build, resp, err = client.Builds.Get(cfg.Build)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+					s.Break()
+				}
+				if err != nil {
+					l.Warn("%s (%s)", err, s)
+				}
+
+				return err
+			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+			if err != nil {
+				fatal(l, exitCodeForError(err), "Failed to get build: %s", err)
+			}
+
+			if build.Finished() {
+				l.Info("Build %s finished with state %q", cfg.Build, build.State)
+				os.Exit(buildWaitExitStatus(build.State))
+			}
+
+			l.Debug("Build %s is %s", cfg.Build, build.State)
+
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				l.Error("Timed out after %s waiting for build %s to finish (it is %s)", timeout, cfg.Build, build.State)
+				os.Exit(ExitTimeout)
+			}
+
+			// Check one last time at the deadline, rather than giving up
+			// a poll early
+			if left < pollInterval {
+				time.Sleep(left)
+			} else {
+				time.Sleep(pollInterval)
+			}
+		}
+	},
+}
+
+func buildWaitExitStatus(state string) int {
+	switch state {
+	case "passed":
+		return ExitOK
+	case "failed":
+		return ExitBuildFailed
+	case "canceled":
+		return ExitBuildCanceled
+	default:
+		return ExitBuildNotRun
+	}
+}
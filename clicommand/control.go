@@ -0,0 +1,211 @@
+package clicommand
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var ControlHelpDescription = `Usage:
+
+   buildkite-agent control <command> [key] [value] [arguments...]
+   buildkite-agent control --stdin [arguments...]
+
+Description:
+
+   Sends commands to an agent running on this host via its admin socket (see
+   "buildkite-agent start --admin-socket-path").
+
+   The available commands are:
+
+     pause            Stop accepting new jobs (running jobs are unaffected)
+     resume           Start accepting new jobs again
+     set-tag          Set a tag in the environment of future jobs, e.g.
+                      "set-tag docker=true". It isn't used for job targeting
+     gc               Return unused memory to the operating system
+     stop-after-job   Disconnect once the current job (if any) has finished
+     log-level        Change the log level, e.g. "log-level debug", or the level
+                      of subsystems, e.g. "log-level api=debug". Go back to the
+                      levels the agent was started with with "log-level reset"
+     rotate-token     Switch to a new access token, e.g. "rotate-token agent-1 -"
+                      with the token on STDIN. The name of the agent can be left
+                      out if only one is running. The old token is still tried
+                      for 10 minutes in case the new one isn't accepted yet
+
+   With --stdin, newline-delimited JSON commands are read from STDIN and a JSON
+   response is written to STDOUT for each one, which is useful for driving the
+   agent from another long-running program. Each command is an object with a
+   "command" key, and "key" and "value" keys for set-tag. Any "id" is echoed
+   back in the response.
+
+Example:
+
+   $ buildkite-agent control pause
+   $ buildkite-agent control set-tag docker true
+   $ buildkite-agent control log-level debug
+   $ echo "$NEW_ACCESS_TOKEN" | buildkite-agent control rotate-token -
+   $ echo '{"id":"1","command":"gc"}' | buildkite-agent control --stdin
+   {"id":"1","command":"gc","ok":true,"message":"..."}`
+
+type ControlConfig struct {
+	Command         string `cli:"arg:0" label:"command"`
+	Key             string `cli:"arg:1" label:"key"`
+	Value           string `cli:"arg:2" label:"value"`
+	Stdin           bool   `cli:"stdin"`
+	AdminSocketPath string `cli:"admin-socket-path" normalize:"filepath" validate:"required"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var ControlCommand = cli.Command{
+	Name:        "control",
+	Usage:       "Sends commands to the agent running on this host",
+	Description: ControlHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "stdin",
+			Usage: "Read newline-delimited JSON commands from STDIN and write JSON responses to STDOUT",
+		},
+		AdminSocketPathFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := ControlConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		client, baseURL := agent.NewAdminClient(cfg.AdminSocketPath)
+
+		if cfg.Stdin {
+			if err := controlFromReader(client, baseURL, os.Stdin, os.Stdout); err != nil {
+				fatal(l, ExitTransportError, "%s", err)
+			}
+			return
+		}
+
+		if cfg.Command == "" {
+			fatal(l, ExitConfigError, "A command to send is required, or use --stdin")
+		}
+
+		cmd := agent.ControlCommand{Command: cfg.Command, Key: cfg.Key, Value: cfg.Value}
+
+		// Support "set-tag key=value" as well as "set-tag key value"
+		if cmd.Command == "set-tag" && cmd.Value == "" && strings.Contains(cmd.Key, "=") {
+			parts := strings.SplitN(cmd.Key, "=", 2)
+			cmd.Key, cmd.Value = parts[0], parts[1]
+		}
+
+		// Support "rotate-token token" as well as "rotate-token agent token",
+		// and reading the token from STDIN so it isn't in the process list
+		if cmd.Command == "rotate-token" {
+			if cmd.Value == "" {
+				cmd.Key, cmd.Value = "", cmd.Key
+			}
+			if cmd.Value == "-" {
+				token, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					fatal(l, ExitConfigError, "Failed to read the access token from STDIN: %s", err)
+				}
+				cmd.Value = strings.TrimSpace(string(token))
+			}
+		}
+
+		resp, err := sendControlCommand(client, baseURL, cmd)
+		if err != nil {
+			fatal(l, ExitTransportError, "Failed to send command: %s", err)
+		}
+
+		if !resp.OK {
+			fatal(l, ExitError, "%s", resp.Error)
+		}
+
+		l.Info("%s", resp.Message)
+	},
+}
+
+// controlFromReader sends each line of JSON from r as a control command and
+// writes each response as a line of JSON to w. Failures to send a command are
+// reported as responses, so a single bad line doesn't stop the stream.
+func controlFromReader(client *http.Client, baseURL *url.URL, r io.Reader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var resp *agent.ControlResponse
+		var cmd agent.ControlCommand
+
+		if err := json.Unmarshal(line, &cmd); err != nil {
+			resp = &agent.ControlResponse{Error: fmt.Sprintf("Invalid command: %v", err)}
+		} else if resp, err = sendControlCommand(client, baseURL, cmd); err != nil {
+			resp = &agent.ControlResponse{ID: cmd.ID, Command: cmd.Command, Error: err.Error()}
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func sendControlCommand(client *http.Client, baseURL *url.URL, cmd agent.ControlCommand) (*agent.ControlResponse, error) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *baseURL
+	u.Path = "/control"
+
+	res, err := client.Post(u.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp agent.ControlResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("Unexpected response from agent (%s): %s", res.Status, data)
+	}
+
+	return &resp, nil
+}
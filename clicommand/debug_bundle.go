@@ -0,0 +1,280 @@
+package clicommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/debugbundle"
+	"github.com/buildkite/agent/history"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var DebugBundleHelpDescription = `Usage:
+
+   buildkite-agent debug-bundle [arguments...]
+
+Description:
+
+   Gathers what's needed to diagnose a problem with the agents on this host
+   into a single tarball, which can be attached to a support ticket. The
+   bundle contains:
+
+   - the agent's configuration file and BUILDKITE_* environment variables
+   - the last lines of the agent's --log-file
+   - the results of the environment fingerprint probes
+   - the most recent jobs recorded in --job-history-path
+   - the health of the agent listening on --admin-socket-path
+   - a check of the connection to the agent API endpoint
+
+   The configuration file is found the same way "buildkite-agent start"
+   finds it, and settings such as --log-file and --job-history-path are read
+   from it, so usually no arguments are needed.
+
+   Tokens, passwords and secrets (settings and environment variables whose
+   names end in _TOKEN, _PASSWORD or _SECRET) are redacted, along with their
+   values wherever else they appear. Check the bundle before sharing it in
+   case anything else sensitive has made its way into the logs.
+
+   Anything that can't be collected is listed in errors.txt in the bundle,
+   rather than stopping the rest from being collected.
+
+Example:
+
+   $ buildkite-agent debug-bundle
+   $ buildkite-agent debug-bundle --output /tmp/agent-debug.tar.gz --log-lines 5000`
+
+type DebugBundleConfig struct {
+	Output               string `cli:"output" normalize:"filepath"`
+	Config               string `cli:"config"`
+	Profile              string `cli:"profile"`
+	LogFile              string `cli:"log-file" normalize:"filepath"`
+	LogLines             int    `cli:"log-lines"`
+	JobHistoryPath       string `cli:"job-history-path" normalize:"filepath"`
+	Jobs                 int    `cli:"jobs"`
+	AdminSocketPath      string `cli:"admin-socket-path" normalize:"filepath"`
+	Endpoint             string `cli:"endpoint"`
+	EnvFingerprintScript string `cli:"env-fingerprint-script" normalize:"commandpath"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var DebugBundleCommand = cli.Command{
+	Name:        "debug-bundle",
+	Usage:       "Gathers the agent's config, logs and recent jobs into a tarball for support",
+	Description: DebugBundleHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Value: "",
+			Usage: "Where to write the bundle (default: buildkite-agent-debug-<timestamp>.tar.gz in the current directory)",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to the agent's configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Value:  "",
+			Usage:  "The profile in the configuration file that the agent uses",
+			EnvVar: "BUILDKITE_AGENT_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "log-file",
+			Value:  "",
+			Usage:  "The file the agent writes its log to",
+			EnvVar: "BUILDKITE_AGENT_LOG_FILE",
+		},
+		cli.IntFlag{
+			Name:  "log-lines",
+			Value: 1000,
+			Usage: "How many of the last lines of the log file to include",
+		},
+		JobHistoryPathFlag,
+		cli.IntFlag{
+			Name:  "jobs",
+			Value: 20,
+			Usage: "How many of the most recent jobs to include",
+		},
+		AdminSocketPathFlag,
+		EndpointFlag,
+		cli.StringFlag{
+			Name:   "env-fingerprint-script",
+			Value:  "",
+			Usage:  "The script the agent uses to compute its environment fingerprint, instead of the built-in probes",
+			EnvVar: "BUILDKITE_AGENT_ENV_FINGERPRINT_SCRIPT",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := DebugBundleConfig{}
+
+		// Settings are read from the agent's config file too, so it's found
+		// the same way the agent finds it
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+			Logger:                 l,
+		}
+
+		// Load the configuration
+		if err := loader.Load(); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		now := time.Now()
+		if cfg.Output == "" {
+			cfg.Output = fmt.Sprintf("buildkite-agent-debug-%s.tar.gz", now.Format("20060102-150405"))
+		}
+
+		f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			l.Fatal("Failed to create %s: %s", cfg.Output, err)
+		}
+		defer f.Close()
+
+		dir := strings.TrimSuffix(filepath.Base(cfg.Output), ".tar.gz")
+		bundle := debugbundle.New(f, dir)
+
+		// Secrets from the config and environment are redacted from
+		// everything else that's bundled
+		var fileConfig map[string]string
+		if loader.File != nil {
+			fileConfig = loader.File.Config
+		}
+		secrets := append(debugbundle.ConfigSecrets(fileConfig), logger.SecretsFromEnvironment(os.Environ())...)
+
+		add := func(name string, data []byte) {
+			if err := bundle.Add(name, debugbundle.RedactSecrets(data, secrets)); err != nil {
+				l.Fatal("Failed to write %s: %s", cfg.Output, err)
+			}
+		}
+
+		l.Info("Collecting agent information")
+		add("agent.txt", debugBundleAgentInfo(now))
+
+		l.Info("Collecting configuration")
+		if loader.File != nil {
+			add("config.txt", append([]byte(fmt.Sprintf("# %s\n", loader.File.Path)),
+				debugbundle.FormatConfig(debugbundle.RedactConfig(fileConfig))...))
+		} else {
+			bundle.AddError("config", fmt.Errorf("No configuration file was found"))
+		}
+		add("environment.txt", debugBundleEnvironment(os.Environ()))
+
+		if cfg.LogFile != "" {
+			l.Info("Collecting the last %d lines of %s", cfg.LogLines, cfg.LogFile)
+			if tail, err := debugbundle.Tail(cfg.LogFile, cfg.LogLines); err != nil {
+				bundle.AddError("log", err)
+			} else {
+				add("agent.log", tail)
+			}
+		}
+
+		l.Info("Running environment probes")
+		if probe, err := (agent.EnvFingerprint{ProbeScript: cfg.EnvFingerprintScript}).Probe(); err != nil {
+			bundle.AddError("environment probes", err)
+		} else {
+			add("env-probes.txt", []byte(probe+"\n"))
+		}
+
+		if cfg.JobHistoryPath != "" {
+			l.Info("Collecting the last %d jobs from %s", cfg.Jobs, cfg.JobHistoryPath)
+			if records, err := history.NewStore(cfg.JobHistoryPath).Recent(cfg.Jobs); err != nil {
+				bundle.AddError("jobs", err)
+			} else if err := bundle.AddJSON("jobs.json", records); err != nil {
+				l.Fatal("Failed to write %s: %s", cfg.Output, err)
+			}
+		}
+
+		if cfg.AdminSocketPath != "" {
+			l.Info("Checking the health of the agent on %s", cfg.AdminSocketPath)
+			if health, err := debugBundleHealth(cfg.AdminSocketPath); err != nil {
+				bundle.AddError("health", err)
+			} else {
+				add("health.json", health)
+			}
+		}
+
+		l.Info("Checking the connection to %s", cfg.Endpoint)
+		add("connectivity.txt", debugbundle.CheckConnectivity(cfg.Endpoint, 10*time.Second))
+
+		for _, e := range bundle.Errors() {
+			l.Warn("Couldn't collect %s", e)
+		}
+
+		if err := bundle.Close(); err != nil {
+			l.Fatal("Failed to write %s: %s", cfg.Output, err)
+		}
+		if err := f.Close(); err != nil {
+			l.Fatal("Failed to write %s: %s", cfg.Output, err)
+		}
+
+		l.Info("Wrote debug bundle to %s", cfg.Output)
+	},
+}
+
+// debugBundleAgentInfo describes the agent binary and the host it's on
+func debugBundleAgentInfo(now time.Time) []byte {
+	hostname, _ := os.Hostname()
+
+	return []byte(fmt.Sprintf("Version: %s, build %s\nGo: %s\nOS: %s/%s\nHostname: %s\nCollected: %s\n",
+		agent.Version(), agent.BuildVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH,
+		hostname, now.Format(time.RFC3339)))
+}
+
+// debugBundleEnvironment returns the BUILDKITE_* environment variables,
+// sorted. The values of secrets are redacted along with everything else.
+func debugBundleEnvironment(env []string) []byte {
+	var lines []string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "BUILDKITE_") {
+			lines = append(lines, kv)
+		}
+	}
+	sort.Strings(lines)
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// debugBundleHealth gets the health of the agent listening on an admin socket
+func debugBundleHealth(socket string) ([]byte, error) {
+	client, baseURL := agent.NewAdminClient(socket)
+
+	u := *baseURL
+	u.Path = "/healthz"
+
+	res, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
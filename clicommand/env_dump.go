@@ -0,0 +1,134 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/buildkite/agent/bootstrap"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var EnvDumpHelpDescription = `Usage:
+
+   buildkite-agent env dump [arguments...]
+
+Description:
+
+   Prints the environment of the job that's running, from one of its hooks.
+   Along with "buildkite-agent env get" and "buildkite-agent env set", this
+   lets programs that hooks run which aren't written in bash (such as Python
+   or PowerShell scripts) read and change the job's environment, like bash
+   hooks do with export.
+
+   The environment is printed as a JSON object by default, or as KEY=VALUE
+   lines with --format text.
+
+   These commands talk to the bootstrap over the socket given to hooks in
+   BUILDKITE_JOB_ENV_ENDPOINT, so they only work while a hook is running.
+
+Example:
+
+   $ buildkite-agent env dump | jq -r .BUILDKITE_BRANCH`
+
+type EnvDumpConfig struct {
+	Format         string `cli:"format"`
+	JobEnvEndpoint string `cli:"job-env-endpoint" validate:"required"`
+	JobEnvToken    string `cli:"job-env-token" validate:"required"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var JobEnvEndpointFlag = cli.StringFlag{
+	Name:   "job-env-endpoint",
+	Value:  "",
+	Usage:  "Where the bootstrap is serving the job's environment",
+	EnvVar: bootstrap.EnvServerEndpointEnv,
+}
+
+var JobEnvTokenFlag = cli.StringFlag{
+	Name:   "job-env-token",
+	Value:  "",
+	Usage:  "The token for reading and changing the job's environment",
+	EnvVar: bootstrap.EnvServerTokenEnv,
+}
+
+var EnvDumpCommand = cli.Command{
+	Name:        "dump",
+	Usage:       "Prints the environment of the running job",
+	Description: EnvDumpHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: "json",
+			Usage: "How to print the environment, either json or text (KEY=VALUE lines)",
+		},
+		JobEnvEndpointFlag,
+		JobEnvTokenFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := EnvDumpConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.Format != "text" && cfg.Format != "json" {
+			fatal(l, ExitConfigError, "Unknown format %q, must be either text or json", cfg.Format)
+		}
+
+		client := newJobEnvClient(l, cfg.JobEnvEndpoint, cfg.JobEnvToken)
+
+		environ, err := client.Dump()
+		if err != nil {
+			fatal(l, ExitError, "Failed to get the job's environment: %v", err)
+		}
+
+		if cfg.Format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(environ); err != nil {
+				fatal(l, ExitError, "Failed to print the job's environment: %v", err)
+			}
+			return
+		}
+
+		keys := make([]string, 0, len(environ))
+		for key := range environ {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, environ[key])
+		}
+	},
+}
+
+func newJobEnvClient(l logger.Logger, endpoint, token string) *bootstrap.EnvClient {
+	client, err := bootstrap.NewEnvClient(endpoint, token)
+	if err != nil {
+		fatal(l, ExitConfigError, "%v", err)
+	}
+	return client
+}
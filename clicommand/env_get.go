@@ -0,0 +1,83 @@
+package clicommand
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var EnvGetHelpDescription = `Usage:
+
+   buildkite-agent env get <key> [arguments...]
+
+Description:
+
+   Prints the value of a variable in the environment of the job that's
+   running, from one of its hooks, without a trailing newline. If the
+   variable isn't set, nothing is printed and the command exits with status
+   100.
+
+   It includes changes made by the hook with "buildkite-agent env set", but
+   not those made with export, which are only applied once the hook
+   finishes.
+
+Example:
+
+   $ buildkite-agent env get BUILDKITE_BRANCH`
+
+type EnvGetConfig struct {
+	Key            string `cli:"arg:0" label:"key" validate:"required"`
+	JobEnvEndpoint string `cli:"job-env-endpoint" validate:"required"`
+	JobEnvToken    string `cli:"job-env-token" validate:"required"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var EnvGetCommand = cli.Command{
+	Name:        "get",
+	Usage:       "Prints a variable from the environment of the running job",
+	Description: EnvGetHelpDescription,
+	Flags: []cli.Flag{
+		JobEnvEndpointFlag,
+		JobEnvTokenFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := EnvGetConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		client := newJobEnvClient(l, cfg.JobEnvEndpoint, cfg.JobEnvToken)
+
+		environ, err := client.Dump()
+		if err != nil {
+			fatal(l, ExitError, "Failed to get the job's environment: %v", err)
+		}
+
+		value, ok := environ[cfg.Key]
+		if !ok {
+			fatal(l, ExitNotFound, "%s isn't set in the job's environment", cfg.Key)
+		}
+
+		fmt.Print(value)
+	},
+}
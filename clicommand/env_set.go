@@ -0,0 +1,88 @@
+package clicommand
+
+import (
+	"strings"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var EnvSetHelpDescription = `Usage:
+
+   buildkite-agent env set <key=value> [key=value...] [arguments...]
+
+Description:
+
+   Changes variables in the environment of the job that's running, from one
+   of its hooks. Like variables that bash hooks export, the changes apply to
+   the rest of the job once the hook succeeds, and are thrown away if it
+   fails. If a hook exports a variable and sets it with this command too,
+   the value set with this command wins.
+
+Example:
+
+   $ buildkite-agent env set NODE_ENV=production "GREETING=hello world"`
+
+type EnvSetConfig struct {
+	JobEnvEndpoint string `cli:"job-env-endpoint" validate:"required"`
+	JobEnvToken    string `cli:"job-env-token" validate:"required"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var EnvSetCommand = cli.Command{
+	Name:        "set",
+	Usage:       "Changes variables in the environment of the running job",
+	Description: EnvSetHelpDescription,
+	Flags: []cli.Flag{
+		JobEnvEndpointFlag,
+		JobEnvTokenFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := EnvSetConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if len(c.Args()) == 0 {
+			fatal(l, ExitConfigError, "Missing variables to set, they should be given as key=value")
+		}
+
+		changes := map[string]string{}
+		for _, arg := range c.Args() {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				fatal(l, ExitConfigError, "Invalid variable %q, it should be given as key=value", arg)
+			}
+			changes[parts[0]] = parts[1]
+		}
+
+		client := newJobEnvClient(l, cfg.JobEnvEndpoint, cfg.JobEnvToken)
+
+		if _, err := client.Set(changes); err != nil {
+			fatal(l, ExitError, "Failed to change the job's environment: %v", err)
+		}
+
+		for key := range changes {
+			l.Debug("Set %s in the job's environment", key)
+		}
+	},
+}
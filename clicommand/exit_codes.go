@@ -0,0 +1,108 @@
+package clicommand
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+// The exit codes used by all commands, so that scripts can tell different
+// kinds of failure apart. Once published these must never change.
+//
+// The bootstrap is the exception, as its exit status becomes the job's, so it
+// always fails with ExitError rather than changing job results.
+const (
+	ExitOK             = 0
+	ExitError          = 1
+	ExitBuildFailed    = 2
+	ExitBuildCanceled  = 3
+	ExitBuildNotRun    = 4
+	ExitTimeout        = 5
+	ExitTransportError = 69
+	ExitAuthError      = 77
+	ExitConfigError    = 78
+	ExitNotFound       = 100
+	ExitConflict       = 101
+)
+
+// ExitCode describes one of the exit codes above
+type ExitCode struct {
+	Code        int
+	Name        string
+	Description string
+}
+
+// ExitCodes is the documented list of exit codes, in the order they're shown
+// by --list-exit-codes
+var ExitCodes = []ExitCode{
+	{ExitOK, "ok", "The command succeeded"},
+	{ExitError, "error", "The command failed for a reason not covered below"},
+	{ExitBuildFailed, "build-failed", "The build being waited on failed (build wait)"},
+	{ExitBuildCanceled, "build-canceled", "The build being waited on was canceled (build wait)"},
+	{ExitBuildNotRun, "build-not-run", "The build being waited on was skipped or not run (build wait)"},
+	{ExitTimeout, "timeout", "The command gave up waiting for something to happen"},
+	{ExitTransportError, "transport-error", "The Buildkite Agent API couldn't be reached, or returned a server error"},
+	{ExitAuthError, "auth-error", "The access token was missing, invalid, or not allowed to do that"},
+	{ExitConfigError, "config-error", "The command was called with invalid arguments, flags or configuration"},
+	{ExitNotFound, "not-found", "The thing being asked about doesn't exist (e.g. meta-data exists, or a 404 from the API)"},
+	{ExitConflict, "conflict", "A conditional change wasn't made, as the current value didn't match (e.g. meta-data set --if-value)"},
+}
+
+var ListExitCodesFlag = cli.BoolFlag{
+	Name:  "list-exit-codes",
+	Usage: "List the exit codes used by buildkite-agent commands and what they mean",
+}
+
+// PrintExitCodes writes the list of exit codes as a table
+func PrintExitCodes(w io.Writer) {
+	for _, e := range ExitCodes {
+		fmt.Fprintf(w, "%4d  %-16s %s\n", e.Code, e.Name, e.Description)
+	}
+}
+
+// exitCodeForError works out the exit code for an error returned from the API
+// client
+func exitCodeForError(err error) int {
+	// Retried calls are judged by how the last attempt failed
+	if retryErr, ok := err.(*retry.Error); ok {
+		err = retryErr.Last()
+	}
+
+	switch e := err.(type) {
+	case *api.ErrorResponse:
+		switch code := e.Response.StatusCode; {
+		case code == 401 || code == 403:
+			return ExitAuthError
+		case code == 404:
+			return ExitNotFound
+		case code >= 500:
+			return ExitTransportError
+		}
+	case *url.Error, net.Error:
+		return ExitTransportError
+	}
+
+	if err == api.ErrCircuitOpen {
+		return ExitTransportError
+	}
+
+	return ExitError
+}
+
+// fatal logs a fatal message like l.Fatal, but exits with the given code
+func fatal(l logger.Logger, code int, format string, v ...interface{}) {
+	if consoleLogger, ok := l.(*logger.ConsoleLogger); ok {
+		consoleLogger.ExitFn = telemetryExitFn(func() { os.Exit(code) })
+	}
+	l.Fatal(format, v...)
+
+	// Only reached by loggers that don't exit
+	os.Exit(code)
+}
@@ -1,9 +1,11 @@
 package clicommand
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/experiments"
@@ -43,6 +45,32 @@ var NoHTTP2Flag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_NO_HTTP2",
 }
 
+var DNSServersFlag = cli.StringSliceFlag{
+	Name:   "dns-servers",
+	Value:  &cli.StringSlice{},
+	Usage:  "DNS servers to resolve the Agent API and artifact storage hosts with, instead of the system's (e.g. \"10.0.0.2,10.0.0.3:53\")",
+	EnvVar: "BUILDKITE_AGENT_DNS_SERVERS",
+}
+
+var DNSTimeoutFlag = cli.DurationFlag{
+	Name:   "dns-timeout",
+	Usage:  "How long to wait for each DNS query to be answered, or 0 for the resolver's default",
+	EnvVar: "BUILDKITE_AGENT_DNS_TIMEOUT",
+}
+
+var PreferIPFlag = cli.StringFlag{
+	Name:   "prefer-ip",
+	Value:  "",
+	Usage:  "Which IP version to connect with first when a host has addresses for both, either ipv4 or ipv6",
+	EnvVar: "BUILDKITE_AGENT_PREFER_IP",
+}
+
+var HappyEyeballsDelayFlag = cli.DurationFlag{
+	Name:   "happy-eyeballs-delay",
+	Usage:  "How long to wait for a connection with the first IP version before also trying the other, or a negative duration to only try it once the first fails (defaults to 300ms)",
+	EnvVar: "BUILDKITE_AGENT_HAPPY_EYEBALLS_DELAY",
+}
+
 var DebugFlag = cli.BoolFlag{
 	Name:   "debug",
 	Usage:  "Enable debug mode",
@@ -61,6 +89,41 @@ var NoColorFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_AGENT_NO_COLOR",
 }
 
+var LogFormatFlag = cli.StringFlag{
+	Name:   "log-format",
+	Value:  "text",
+	Usage:  "The format to use for the logger output, either text, json or syslog (to send it to the local syslog daemon or journald)",
+	EnvVar: "BUILDKITE_AGENT_LOG_FORMAT",
+}
+
+var LogLevelFlag = cli.StringFlag{
+	Name:   "log-level",
+	Value:  "",
+	Usage:  "The log level (trace, debug, notice, info, warn or error), or levels for subsystems (api, job or artifact) and a default for the rest, e.g. \"api=trace,default=warn\"",
+	EnvVar: "BUILDKITE_AGENT_LOG_LEVEL",
+}
+
+var AdminSocketPathFlag = cli.StringFlag{
+	Name:   "admin-socket-path",
+	Value:  "",
+	Usage:  "Path to a unix socket that the agent listens on for local control and status requests",
+	EnvVar: "BUILDKITE_AGENT_ADMIN_SOCKET_PATH",
+}
+
+var AssumeRoleARNFlag = cli.StringFlag{
+	Name:   "assume-role-arn",
+	Value:  "",
+	Usage:  "An AWS IAM role to assume for accessing S3, such as one that can access a bucket in another account",
+	EnvVar: "BUILDKITE_S3_ASSUME_ROLE_ARN",
+}
+
+var AssumeRoleExternalIDFlag = cli.StringFlag{
+	Name:   "assume-role-external-id",
+	Value:  "",
+	Usage:  "The external ID required to assume the --assume-role-arn role",
+	EnvVar: "BUILDKITE_S3_ASSUME_ROLE_EXTERNAL_ID",
+}
+
 var ExperimentsFlag = cli.StringSliceFlag{
 	Name:   "experiment",
 	Value:  &cli.StringSlice{},
@@ -68,19 +131,105 @@ var ExperimentsFlag = cli.StringSliceFlag{
 	EnvVar: "BUILDKITE_AGENT_EXPERIMENT",
 }
 
+// CreateLogger returns a logger that writes to stderr in the format given by
+// the --log-format flag, so that even errors loading the config are written
+// in that format
+func CreateLogger(c *cli.Context) logger.Logger {
+	l := logger.NewTextLogger()
+
+	if err := setLogFormat(l, c.String("log-format")); err != nil {
+		fatal(l, ExitConfigError, "%s", err)
+	}
+
+	// Keep credentials out of the log, especially the request dumps of
+	// --debug-http
+	logger.Redact(l, logger.SecretsFromEnvironment(os.Environ())...)
+	logger.Redact(l, c.String("token"), c.String("agent-access-token"))
+
+	return l
+}
+
+// setLogFormat changes the printer that a logger uses, keeping any redaction
+// in place
+func setLogFormat(l logger.Logger, format string) error {
+	printer, err := logger.NewPrinter(format, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	if consoleLogger, ok := l.(*logger.ConsoleLogger); ok {
+		target := &consoleLogger.Printer
+		if r, ok := consoleLogger.Printer.(*logger.RedactingPrinter); ok {
+			target = &r.Printer
+		}
+
+		// Don't leave a connection to syslog open when the format changes
+		(*target).Close()
+		*target = printer
+	}
+
+	return nil
+}
+
 func HandleGlobalFlags(l logger.Logger, cfg interface{}) {
+	// Set the log levels if a LogLevel option is present, which can be
+	// different for each subsystem
+	logLevel, err := reflections.GetField(cfg, "LogLevel")
+	if levels, ok := logLevel.(string); ok && err == nil && levels != "" {
+		named, level, hasDefault, err := logger.ParseLevels(levels)
+		if err != nil {
+			fatal(l, ExitConfigError, "Invalid log-level: %s", err)
+		}
+		if hasDefault {
+			l.SetLevel(level)
+		}
+		logger.SetNamedLevels(named)
+	}
+
 	// Enable debugging if a Debug option is present
 	debug, _ := reflections.GetField(cfg, "Debug")
 	if debug.(bool) {
 		l.SetLevel(logger.DEBUG)
 	}
 
+	// The log format might have come from a config file, rather than the
+	// flag that CreateLogger used
+	logFormat, err := reflections.GetField(cfg, "LogFormat")
+	if format, ok := logFormat.(string); ok && err == nil {
+		if err := setLogFormat(l, format); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+	}
+
+	// Tokens might have come from a config file too
+	for _, name := range []string{"Token", "AgentAccessToken"} {
+		if token, err := reflections.GetField(cfg, name); err == nil {
+			if s, ok := token.(string); ok {
+				logger.Redact(l, s)
+			}
+		}
+	}
+
 	// Turn off color if a NoColor option is present
 	noColor, err := reflections.GetField(cfg, "NoColor")
-	if textLogger, ok := l.(*logger.TextLogger); ok && noColor == true && err == nil {
-		textLogger.Colors = false
-	} else {
-		textLogger.Colors = true
+	if consoleLogger, ok := l.(*logger.ConsoleLogger); ok {
+		printer := consoleLogger.Printer
+		if r, ok := printer.(*logger.RedactingPrinter); ok {
+			printer = r.Printer
+		}
+		if textPrinter, ok := printer.(*logger.TextPrinter); ok {
+			textPrinter.Colors = !(noColor == true && err == nil)
+		}
+	}
+
+	// Make sure usage telemetry is sent if the command exits fatally
+	if consoleLogger, ok := l.(*logger.ConsoleLogger); ok {
+		consoleLogger.ExitFn = telemetryExitFn(consoleLogger.ExitFn)
+	}
+
+	// Configure how hosts are resolved and connected to
+	if err := handleNetworkFlags(cfg); err != nil {
+		fatal(l, ExitConfigError, "%s", err)
 	}
 
 	// Enable experiments
@@ -96,6 +245,36 @@ func HandleGlobalFlags(l logger.Logger, cfg interface{}) {
 	}
 }
 
+// handleNetworkFlags sets the network config of the API and artifact clients
+// from the DNS and IP options that are present
+func handleNetworkFlags(cfg interface{}) error {
+	var c agent.NetworkConfig
+
+	if servers, err := reflections.GetField(cfg, "DNSServers"); err == nil {
+		c.DNSServers, _ = servers.([]string)
+	}
+
+	if preferIP, err := reflections.GetField(cfg, "PreferIP"); err == nil {
+		c.PreferIP, _ = preferIP.(string)
+	}
+
+	dnsTimeout, err := reflections.GetField(cfg, "DNSTimeout")
+	if s, ok := dnsTimeout.(string); ok && err == nil && s != "" {
+		if c.DNSTimeout, err = time.ParseDuration(s); err != nil {
+			return fmt.Errorf("Failed to parse dns-timeout: %v", err)
+		}
+	}
+
+	delay, err := reflections.GetField(cfg, "HappyEyeballsDelay")
+	if s, ok := delay.(string); ok && err == nil && s != "" {
+		if c.HappyEyeballsDelay, err = time.ParseDuration(s); err != nil {
+			return fmt.Errorf("Failed to parse happy-eyeballs-delay: %v", err)
+		}
+	}
+
+	return agent.SetNetworkConfig(c)
+}
+
 func UnsetConfigFromEnvironment(c *cli.Context) {
 	flags := append(c.App.Flags, c.Command.Flags...)
 	for _, fl := range flags {
@@ -1,13 +1,13 @@
 package clicommand
 
 import (
+	"context"
 	"os"
 	"time"
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/cliconfig"
-	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/agent/retry"
 	"github.com/urfave/cli"
 )
@@ -19,7 +19,8 @@ var MetaDataExistsHelpDescription = `Usage:
 Description:
 
    The command exits with a status of 0 if the key has been set, or it will
-   exit with a status of 100 if the key doesn't exist.
+   exit with a status of 100 if the key doesn't exist. Other failures use the
+   exit codes listed by "buildkite-agent --list-exit-codes".
 
 Example:
 
@@ -30,14 +31,20 @@ type MetaDataExistsConfig struct {
 	Job string `cli:"job" validate:"required"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var MetaDataExistsCommand = cli.Command{
@@ -56,21 +63,27 @@ var MetaDataExistsCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := MetaDataExistsConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
@@ -83,24 +96,21 @@ var MetaDataExistsCommand = cli.Command{
 		var err error
 		var exists *api.MetaDataExists
 		var resp *api.Response
-		err = retry.Do(func(s *retry.Stats) error {
+		err = retry.DoWithContext(context.Background(), func(_ context.Context, s *retry.Stats) error {
 			exists, resp, err = client.MetaData.Exists(cfg.Job, cfg.Key)
 			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
 				s.Break()
 			}
-			if err != nil {
-				l.Warn("%s (%s)", err, s)
-			}
 
 			return err
-		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second, Logger: l})
 		if err != nil {
-			l.Fatal("Failed to see if meta-data exists: %s", err)
+			fatal(l, exitCodeForError(err), "Failed to see if meta-data exists: %s", err)
 		}
 
 		// If the meta data didn't exist, exit with an error.
 		if !exists.Exists {
-			os.Exit(100)
+			os.Exit(ExitNotFound)
 		}
 	},
 }
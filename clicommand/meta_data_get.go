@@ -1,7 +1,12 @@
 package clicommand
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/buildkite/agent/agent"
@@ -20,24 +25,59 @@ Description:
 
    Get data from a builds key/value store.
 
+   With --watch, the value is printed (followed by a newline) once it's set,
+   and again every time it changes, until the command is interrupted. With
+   --until-value, it stops once the value is set to that. Endpoints that
+   support it hold each request open until the value changes, and others are
+   checked every --watch-interval.
+
+   If the key doesn't exist, the command fails unless there's a --default,
+   which is printed instead, and the command exits with a status of 0. This
+   saves pairing "meta-data exists" with "meta-data get".
+
+   With --format json, the value is printed as a JSON object with the key,
+   the value and whether it exists (which is false when the default was
+   used), so that values containing newlines are read back safely. When
+   watching, each value is printed as a JSON object on its own line.
+
+   With --all, every key set on the build is fetched in a single request,
+   and printed as a JSON object of keys and values, which requires --format
+   json. This can be saved and set again with "meta-data set --from-file".
+
 Example:
 
-   $ buildkite-agent meta-data get "foo"`
+   $ buildkite-agent meta-data get "foo"
+   $ buildkite-agent meta-data get "release-notes" --default "" --format json | jq -r .value
+   $ buildkite-agent meta-data get "deploy-approved" --until-value "yes"
+   $ buildkite-agent meta-data get --all --format json > meta-data.json`
 
 type MetaDataGetConfig struct {
-	Key     string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Key     string `cli:"arg:0" label:"meta-data key"`
 	Default string `cli:"default"`
 	Job     string `cli:"job" validate:"required"`
+	Format  string `cli:"format"`
+	All     bool   `cli:"all"`
+
+	// Watch config
+	Watch         bool   `cli:"watch"`
+	UntilValue    string `cli:"until-value"`
+	WatchInterval string `cli:"watch-interval"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var MetaDataGetCommand = cli.Command{
@@ -56,34 +96,90 @@ var MetaDataGetCommand = cli.Command{
 			Usage:  "Which job should the meta-data be retrieved from",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "How to print the value, either text (as it is) or json",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "Get every key set on the build, instead of just one",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "Print the value every time it changes, until interrupted",
+		},
+		cli.StringFlag{
+			Name:  "until-value",
+			Value: "",
+			Usage: "Watch the value until it's set to this, then exit",
+		},
+		cli.DurationFlag{
+			Name:   "watch-interval",
+			Value:  5 * time.Second,
+			Usage:  "How often to check for changes when watching, if the API doesn't hold requests open",
+			EnvVar: "BUILDKITE_META_DATA_WATCH_INTERVAL",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := MetaDataGetConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		if cfg.Format != "text" && cfg.Format != "json" {
+			fatal(l, ExitConfigError, "Unknown format %q, must be either text or json", cfg.Format)
+		}
+
 		// Create the API client
 		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
 
+		if cfg.All {
+			switch {
+			case len(c.Args()) > 0:
+				fatal(l, ExitConfigError, "A meta-data key can't be given with --all")
+			case cfg.Format != "json":
+				fatal(l, ExitConfigError, "--all requires --format json")
+			case cfg.Watch || c.IsSet("until-value") || c.IsSet("default"):
+				fatal(l, ExitConfigError, "--all can't be used with --watch, --until-value or --default")
+			}
+			printAllMetaData(l, client, cfg.Job)
+			return
+		}
+
+		if cfg.Key == "" {
+			fatal(l, ExitConfigError, "Missing meta-data key. See: `%s %s --help`", c.App.Name, c.Command.Name)
+		}
+
+		if cfg.Watch || c.IsSet("until-value") {
+			watchMetaData(c, l, client, cfg)
+			return
+		}
+
 		// Find the meta data value
 		var metaData *api.MetaData
 		var err error
@@ -110,17 +206,160 @@ var MetaDataGetCommand = cli.Command{
 			//
 			// We also use `IsSet` instead of `cfg.Default != ""`
 			// to allow people to use a default of a blank string.
-			if resp.StatusCode == 404 && c.IsSet("default") {
+			if resp != nil && resp.StatusCode == 404 && c.IsSet("default") {
 				l.Warn("No meta-data value exists with key `%s`, returning the supplied default \"%s\"", cfg.Key, cfg.Default)
 
-				fmt.Print(cfg.Default)
+				printMetaData(l, cfg, cfg.Default, false, false)
 				return
 			} else {
-				l.Fatal("Failed to get meta-data: %s", err)
+				fatal(l, exitCodeForError(err), "Failed to get meta-data: %s", err)
 			}
 		}
 
 		// Output the value to STDOUT
-		fmt.Print(metaData.Value)
+		printMetaData(l, cfg, metaData.Value, true, false)
 	},
 }
+
+// metaDataGetResult is a meta-data value as it's printed by --format json
+type metaDataGetResult struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Exists bool   `json:"exists"`
+}
+
+// printMetaData prints a value in the configured format. Watched values are
+// each printed on their own line.
+func printMetaData(l logger.Logger, cfg MetaDataGetConfig, value string, exists bool, watching bool) {
+	if cfg.Format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(metaDataGetResult{
+			Key:    cfg.Key,
+			Value:  value,
+			Exists: exists,
+		}); err != nil {
+			l.Fatal("Failed to print meta-data: %s", err)
+		}
+		return
+	}
+
+	if watching {
+		fmt.Println(value)
+	} else {
+		fmt.Print(value)
+	}
+}
+
+// printAllMetaData prints every meta-data value set on the build as a JSON
+// object of keys and values
+func printAllMetaData(l logger.Logger, client *api.Client, job string) {
+	var all map[string]string
+
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+
+		all, resp, err = client.MetaData.All(job)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		fatal(l, exitCodeForError(err), "Failed to get meta-data: %s", err)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(all); err != nil {
+		l.Fatal("Failed to print meta-data: %s", err)
+	}
+}
+
+// watchMetaData prints the meta-data value every time it changes, until it
+// matches --until-value (if it's set) or the command is interrupted
+func watchMetaData(c *cli.Context, l logger.Logger, client *api.Client, cfg MetaDataGetConfig) {
+	if c.IsSet("default") {
+		fatal(l, ExitConfigError, "--default can't be used when watching meta-data")
+	}
+
+	interval, err := time.ParseDuration(cfg.WatchInterval)
+	if err != nil || interval <= 0 {
+		fatal(l, ExitConfigError, "Invalid --watch-interval %q", cfg.WatchInterval)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt,
+		syscall.SIGHUP,
+		syscall.SIGTERM,
+		syscall.SIGINT,
+		syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	go func() {
+		for sig := range signals {
+			l.Debug("Received %v, stopping watching", sig)
+			cancel()
+		}
+	}()
+
+	untilValue := c.IsSet("until-value")
+	if untilValue {
+		l.Info("Waiting for meta-data `%s` to be \"%s\"", cfg.Key, cfg.UntilValue)
+	}
+
+	watcher := agent.NewMetaDataWatcher(l, client, agent.MetaDataWatcherConfig{
+		JobID:    cfg.Job,
+		Key:      cfg.Key,
+		Interval: interval,
+	})
+
+	err = watcher.Watch(ctx, func(value string) bool {
+		printMetaData(l, cfg, value, true, true)
+		return untilValue && value == cfg.UntilValue
+	})
+
+	switch {
+	case err == nil:
+	case err == context.Canceled && !untilValue:
+		// Watching until interrupted is the expected way to stop
+	case err == context.Canceled:
+		fatal(l, ExitError, "Stopped waiting for meta-data `%s` to be \"%s\"", cfg.Key, cfg.UntilValue)
+	default:
+		fatal(l, exitCodeForError(err), "Failed to watch meta-data: %s", err)
+	}
+}
+
+// fetchMetaData gets a meta-data value for tools that read their
+// configuration from it. A key that hasn't been set isn't an error, and is
+// returned with found set to false.
+func fetchMetaData(l logger.Logger, client *api.Client, job string, key string) (value string, found bool, err error) {
+	var metaData *api.MetaData
+	var resp *api.Response
+
+	err = retry.Do(func(s *retry.Stats) error {
+		metaData, resp, err = client.MetaData.Get(job, key)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+			return err
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+
+	if resp != nil && resp.StatusCode == 404 {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return metaData.Value, true, nil
+}
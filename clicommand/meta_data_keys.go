@@ -0,0 +1,144 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var MetaDataKeysHelpDescription = `Usage:
+
+   buildkite-agent meta-data keys [arguments...]
+
+Description:
+
+   Lists the keys of all the meta-data set on the build, one per line, in
+   alphabetical order. This is handy for debugging dynamic pipelines, where
+   the keys that steps set aren't written down anywhere.
+
+   With --show-values, each key is printed with its value as key=value.
+   Values are printed as they are, so ones containing newlines take up more
+   than one line.
+
+Example:
+
+   $ buildkite-agent meta-data keys
+   $ buildkite-agent meta-data keys --show-values`
+
+type MetaDataKeysConfig struct {
+	Job        string `cli:"job" validate:"required"`
+	ShowValues bool   `cli:"show-values"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var MetaDataKeysCommand = cli.Command{
+	Name:        "keys",
+	Usage:       "Lists the meta-data keys set on a build",
+	Description: MetaDataKeysHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build should the meta-data keys be listed for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.BoolFlag{
+			Name:  "show-values",
+			Usage: "Print each key's value along with it, as key=value",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := MetaDataKeysConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		// Find the meta data keys
+		var err error
+		var keys []string
+		var resp *api.Response
+		err = retry.DoWithContext(context.Background(), func(_ context.Context, s *retry.Stats) error {
+			keys, resp, err = client.MetaData.Keys(cfg.Job)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+				s.Break()
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second, Logger: l})
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to list meta-data keys: %s", err)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if !cfg.ShowValues {
+				fmt.Println(key)
+				continue
+			}
+
+			value, found, err := fetchMetaData(l, client, cfg.Job, key)
+			if err != nil {
+				fatal(l, exitCodeForError(err), "Failed to get meta-data %q: %s", key, err)
+			}
+
+			// A key that's gone by the time its value is fetched isn't
+			// worth failing for
+			if !found {
+				l.Warn("Meta-data `%s` was listed but couldn't be found", key)
+				continue
+			}
+
+			fmt.Printf("%s=%s\n", key, value)
+		}
+	},
+}
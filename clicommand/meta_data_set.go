@@ -1,8 +1,11 @@
 package clicommand
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/buildkite/agent/agent"
@@ -24,26 +27,52 @@ Description:
    You can supply the value as an argument to the command, or pipe in a file or
    script output.
 
+   With --if-not-exists, the value is only set if the key hasn't been set
+   yet, and with --if-value, only if it's currently set to that value. The
+   check and the change are made together by Buildkite, so jobs running at
+   the same time can't both make it, which is handy for electing a leader or
+   incrementing a counter. If the value isn't set, the command exits with a
+   status of 101.
+
+   With --from-file, many keys are set at once from a JSON object of keys
+   and string values, in a single request. This is much quicker than setting
+   them one at a time, and the output of "meta-data get --all --format json"
+   can be used as it is. Use --from-file - to read the object from STDIN.
+
 Example:
 
    $ buildkite-agent meta-data set "foo" "bar"
    $ buildkite-agent meta-data set "foo" < ./tmp/meta-data-value
-   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"`
+   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"
+   $ buildkite-agent meta-data set "leader" "$BUILDKITE_JOB_ID" --if-not-exists && ./lead.sh
+   $ buildkite-agent meta-data set "count" "3" --if-value "2"
+   $ buildkite-agent meta-data set --from-file meta-data.json`
 
 type MetaDataSetConfig struct {
-	Key   string `cli:"arg:0" label:"meta-data key" validate:"required"`
-	Value string `cli:"arg:1" label:"meta-data value"`
-	Job   string `cli:"job" validate:"required"`
+	Key      string `cli:"arg:0" label:"meta-data key"`
+	Value    string `cli:"arg:1" label:"meta-data value"`
+	Job      string `cli:"job" validate:"required"`
+	FromFile string `cli:"from-file"`
+
+	// Conditions for setting the value
+	IfNotExists bool   `cli:"if-not-exists"`
+	IfValue     string `cli:"if-value"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var MetaDataSetCommand = cli.Command{
@@ -57,31 +86,77 @@ var MetaDataSetCommand = cli.Command{
 			Usage:  "Which job should the meta-data be set on",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:  "from-file",
+			Value: "",
+			Usage: "Set many keys at once from a JSON file of keys and values, or - to read it from STDIN",
+		},
+		cli.BoolFlag{
+			Name:  "if-not-exists",
+			Usage: "Only set the value if the key hasn't been set yet",
+		},
+		cli.StringFlag{
+			Name:  "if-value",
+			Value: "",
+			Usage: "Only set the value if it's currently set to this",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := MetaDataSetConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		if cfg.IfNotExists && c.IsSet("if-value") {
+			fatal(l, ExitConfigError, "--if-not-exists and --if-value can't be used together")
+		}
+
+		if cfg.FromFile != "" {
+			if len(c.Args()) > 0 {
+				fatal(l, ExitConfigError, "A meta-data key can't be given with --from-file")
+			}
+			if cfg.IfNotExists || c.IsSet("if-value") {
+				fatal(l, ExitConfigError, "--if-not-exists and --if-value can't be used with --from-file")
+			}
+
+			metaData, err := readMetaDataFile(cfg.FromFile)
+			if err != nil {
+				fatal(l, ExitConfigError, "%s", err)
+			}
+
+			client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+			setManyMetaData(l, client, cfg.Job, metaData)
+			return
+		}
+
+		if cfg.Key == "" {
+			fatal(l, ExitConfigError, "Missing meta-data key. See: `%s %s --help`", c.App.Name, c.Command.Name)
+		}
+
 		// Read the value from STDIN if argument omitted entirely
 		if len(c.Args()) < 2 {
 			l.Info("Reading meta-data value from STDIN")
@@ -102,6 +177,15 @@ var MetaDataSetCommand = cli.Command{
 			Value: cfg.Value,
 		}
 
+		if cfg.IfNotExists || c.IsSet("if-value") {
+			var previous *string
+			if c.IsSet("if-value") {
+				previous = &cfg.IfValue
+			}
+			compareAndSetMetaData(l, client, cfg.Job, metaData, previous)
+			return
+		}
+
 		// Set the meta data
 		err := retry.Do(func(s *retry.Stats) error {
 			resp, err := client.MetaData.Set(cfg.Job, metaData)
@@ -115,7 +199,118 @@ var MetaDataSetCommand = cli.Command{
 			return err
 		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
 		if err != nil {
-			l.Fatal("Failed to set meta-data: %s", err)
+			fatal(l, exitCodeForError(err), "Failed to set meta-data: %s", err)
 		}
 	},
 }
+
+// readMetaDataFile reads a JSON object of keys and string values from a file,
+// or STDIN if the path is -, and returns them sorted by key
+func readMetaDataFile(path string) ([]*api.MetaData, error) {
+	var data []byte
+	var err error
+
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read meta-data from %s: %v", path, err)
+	}
+
+	values := map[string]string{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("Failed to parse meta-data from %s, expected a JSON object of keys and string values: %v", path, err)
+	}
+
+	var metaData []*api.MetaData
+	for key, value := range values {
+		if key == "" {
+			return nil, fmt.Errorf("Failed to parse meta-data from %s, keys can't be blank", path)
+		}
+		metaData = append(metaData, &api.MetaData{Key: key, Value: value})
+	}
+
+	sort.Slice(metaData, func(i, j int) bool {
+		return metaData[i].Key < metaData[j].Key
+	})
+
+	return metaData, nil
+}
+
+// setManyMetaData sets many meta-data values in one request
+func setManyMetaData(l logger.Logger, client *api.Client, job string, metaData []*api.MetaData) {
+	if len(metaData) == 0 {
+		l.Info("No meta-data to set")
+		return
+	}
+
+	err := retry.Do(func(s *retry.Stats) error {
+		resp, err := client.MetaData.SetMany(job, metaData)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		fatal(l, exitCodeForError(err), "Failed to set meta-data: %s", err)
+	}
+
+	l.Info("Set %d meta-data keys", len(metaData))
+}
+
+// compareAndSetMetaData sets the meta-data if it's currently previous, or if
+// it isn't set at all if previous is nil, and exits with ExitConflict if it
+// isn't
+func compareAndSetMetaData(l logger.Logger, client *api.Client, job string, metaData *api.MetaData, previous *string) {
+	var result *api.MetaDataCompareAndSetResult
+
+	// Every attempt sends the same request ID, which the API returns with
+	// the value when it isn't set. If an earlier attempt set the value but
+	// its response was lost, that's how a retry can tell it apart from
+	// another job setting the same value.
+	cas := &api.MetaDataCompareAndSet{
+		Key:           metaData.Key,
+		Value:         metaData.Value,
+		PreviousValue: previous,
+		RequestID:     api.NewUUID(),
+	}
+
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+
+		result, resp, err = client.MetaData.CompareAndSet(job, cas)
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+			return err
+		}
+
+		if s.Attempt > 1 && !result.Set && result.Exists && result.RequestID == cas.RequestID {
+			l.Debug("Meta-data `%s` was set by an earlier attempt", metaData.Key)
+			result.Set = true
+		}
+
+		return nil
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	if err != nil {
+		fatal(l, exitCodeForError(err), "Failed to set meta-data: %s", err)
+	}
+
+	if !result.Set {
+		if result.Exists {
+			l.Info("Meta-data `%s` wasn't set, as it's currently \"%s\"", metaData.Key, result.Value)
+		} else {
+			l.Info("Meta-data `%s` wasn't set, as it doesn't exist", metaData.Key)
+		}
+		os.Exit(ExitConflict)
+	}
+}
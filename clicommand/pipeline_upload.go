@@ -14,10 +14,12 @@ import (
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/cliconfig"
 	"github.com/buildkite/agent/env"
-	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/agent/retry"
 	"github.com/buildkite/agent/stdin"
 	"github.com/urfave/cli"
+
+	// This is a fork of gopkg.in/yaml.v2 that fixes anchors with MapSlice
+	yaml "github.com/buildkite/yaml"
 )
 
 var PipelineUploadHelpDescription = `Usage:
@@ -38,30 +40,64 @@ Description:
    - .buildkite/pipeline.json
 
    You can also pipe build pipelines to the command allowing you to create
-   scripts that generate dynamic pipelines.
+   scripts that generate dynamic pipelines. Use - as the file to always
+   read the pipeline from STDIN.
+
+   A YAML pipeline can be split into multiple documents separated by ---,
+   which are merged into one. The steps of each document are added after
+   the steps of the documents before it, and later documents' env and other
+   top-level settings take precedence. YAML anchors can't be shared between
+   documents.
+
+   Environment variables in the pipeline are interpolated before it's
+   uploaded, with $VAR or ${VAR}. ${VAR:-default} and ${VAR-default} give a
+   default if the variable is unset (or empty, with :-), ${VAR:?message}
+   and ${VAR?message} fail with a message if it's unset (or empty, with :?),
+   and $$ is a literal $, for variables to be expanded when the job runs.
+   Using a variable that isn't set and has no default is an error, unless
+   --allow-undefined-variables is given.
+
+   With --dry-run, the pipeline is checked and printed as it would be
+   uploaded, without needing a job or calling the API, which helps when
+   debugging pipelines that are generated by scripts. It's checked against
+   the step attributes that Buildkite knows about and their types, and any
+   problems are printed with the line and column they're on. Buildkite can
+   still reject pipelines that pass these checks. The pipeline is printed
+   as JSON, or YAML with --format yaml, and with --no-interpolation it's
+   printed before any environment variables are interpolated.
 
 Example:
 
    $ buildkite-agent pipeline upload
    $ buildkite-agent pipeline upload my-custom-pipeline.yml
-   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload`
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload -
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload --dry-run --format yaml`
 
 type PipelineUploadConfig struct {
 	FilePath        string `cli:"arg:0" label:"upload paths"`
 	Replace         bool   `cli:"replace"`
 	Job             string `cli:"job"`
 	DryRun          bool   `cli:"dry-run"`
+	Format          string `cli:"format"`
 	NoInterpolation bool   `cli:"no-interpolation"`
+	AllowUndefined  bool   `cli:"allow-undefined-variables"`
 
 	// Global flags
-	Debug   bool `cli:"debug"`
-	NoColor bool `cli:"no-color"`
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
 }
 
 var PipelineUploadCommand = cli.Command{
@@ -85,43 +121,71 @@ var PipelineUploadCommand = cli.Command{
 			Usage:  "Rather than uploading the pipeline, it will be echoed to stdout",
 			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN",
 		},
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "json",
+			Usage:  "How to print the pipeline with --dry-run, either json or yaml",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN_FORMAT",
+		},
 		cli.BoolFlag{
 			Name:   "no-interpolation",
 			Usage:  "Skip variable interpolation the pipeline when uploaded",
 			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
 		},
+		cli.BoolFlag{
+			Name:   "allow-undefined-variables",
+			Usage:  "Interpolate variables that aren't set and have no default as nothing, rather than failing",
+			EnvVar: "BUILDKITE_PIPELINE_ALLOW_UNDEFINED_VARIABLES",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
 		DebugHTTPFlag,
 
 		// Global flags
 		NoColorFlag,
 		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
 	},
 	Action: func(c *cli.Context) {
-		l := logger.NewTextLogger()
+		l := CreateLogger(c)
 
 		// The configuration will be loaded into this struct
 		cfg := PipelineUploadConfig{}
 
 		// Load the configuration
 		if err := cliconfig.Load(c, l, &cfg); err != nil {
-			l.Fatal("%s", err)
+			fatal(l, ExitConfigError, "%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(l, cfg)
 
+		if cfg.Format != "json" && cfg.Format != "yaml" {
+			fatal(l, ExitConfigError, "Unknown format %q, must be either json or yaml", cfg.Format)
+		}
+
 		// Find the pipeline file either from STDIN or the first
 		// argument
 		var input []byte
 		var err error
 		var filename string
 
-		if cfg.FilePath != "" {
+		if cfg.FilePath == "-" {
+			l.Info("Reading pipeline config from STDIN")
+
+			input, err = ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				l.Fatal("Failed to read from STDIN: %s", err)
+			}
+		} else if cfg.FilePath != "" {
 			l.Info("Reading pipeline config from \"%s\"", cfg.FilePath)
 
 			filename = filepath.Base(cfg.FilePath)
@@ -160,9 +224,9 @@ var PipelineUploadCommand = cli.Command{
 			// If more than 1 of the config files exist, throw an
 			// error. There can only be one!!
 			if len(exists) > 1 {
-				l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
+				fatal(l, ExitConfigError, "Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
 			} else if len(exists) == 0 {
-				l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
+				fatal(l, ExitConfigError, "Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
 			}
 
 			found := exists[0]
@@ -197,26 +261,49 @@ var PipelineUploadCommand = cli.Command{
 			}
 		}
 
-		// Parse the pipeline
-		result, err := agent.PipelineParser{
+		parser := agent.PipelineParser{
 			Env:             environ,
 			Filename:        filename,
 			Pipeline:        input,
 			NoInterpolation: cfg.NoInterpolation,
-		}.Parse()
+
+			AllowUndefinedVariables: cfg.AllowUndefined,
+		}
+
+		// In dry-run mode the pipeline is checked before anything else, so
+		// that problems are shown where they are in the file
+		if cfg.DryRun {
+			if problems := parser.Validate(); len(problems) > 0 {
+				for _, problem := range problems {
+					l.Error("%s", problem)
+				}
+				l.Fatal("Pipeline validation failed")
+			}
+		}
+
+		// Parse the pipeline
+		result, err := parser.Parse()
 		if err != nil {
 			l.Fatal("Pipeline parsing of \"%s\" failed (%s)", filename, err)
 		}
 
 		// In dry-run mode we just output the generated pipeline to stdout
 		if cfg.DryRun {
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", "  ")
+			// Dump it to stdout. All logging happens to stderr this can be
+			// used with other tools to get the interpolated pipeline
+			if cfg.Format == "yaml" {
+				out, err := yaml.Marshal(result)
+				if err != nil {
+					l.Fatal("%#v", err)
+				}
+				os.Stdout.Write(out)
+			} else {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
 
-			// Dump json indented to stdout. All logging happens to stderr
-			// this can be used with other tools to get interpolated json
-			if err := enc.Encode(result); err != nil {
-				l.Fatal("%#v", err)
+				if err := enc.Encode(result); err != nil {
+					l.Fatal("%#v", err)
+				}
 			}
 
 			os.Exit(0)
@@ -224,12 +311,12 @@ var PipelineUploadCommand = cli.Command{
 
 		// Check we have a job id set if not in dry run
 		if cfg.Job == "" {
-			l.Fatal("Missing job parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_JOB_ID.")
+			fatal(l, ExitConfigError, "Missing job parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_JOB_ID.")
 		}
 
 		// Check we have an agent access token if not in dry run
 		if cfg.AgentAccessToken == "" {
-			l.Fatal("Missing agent-access-token parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
+			fatal(l, ExitConfigError, "Missing agent-access-token parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
 		}
 
 		// Create the API client
@@ -258,7 +345,7 @@ var PipelineUploadCommand = cli.Command{
 			// need to retry. Let's retry every 5 seconds, for a total of 5 minutes.
 		}, &retry.Config{Maximum: 60, Interval: 5 * time.Second})
 		if err != nil {
-			l.Fatal("Failed to upload and process pipeline: %s", err)
+			fatal(l, exitCodeForError(err), "Failed to upload and process pipeline: %s", err)
 		}
 
 		l.Info("Successfully uploaded and parsed pipeline config")
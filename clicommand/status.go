@@ -0,0 +1,244 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/history"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var StatusHelpDescription = `Usage:
+
+   buildkite-agent status [arguments...]
+
+Description:
+
+   Shows information about the jobs that agents on this host have recently
+   run. Agents only record their jobs when started with --job-history-path.
+
+   By default a summary of the recorded jobs is shown, along with suggested
+   timeouts for steps that have run successfully a few times. Use --history
+   to list the recent jobs themselves.
+
+   With --transfers, the artifact uploads and downloads that the jobs of the
+   agent listening on --admin-socket-path are doing right now are shown
+   instead, which helps to find out what a job that seems stuck is up to.
+
+Example:
+
+   $ buildkite-agent status --job-history-path /var/lib/buildkite-agent/jobs.jsonl
+   $ buildkite-agent status --history --limit 50
+   $ buildkite-agent status --transfers --admin-socket-path /var/run/buildkite-agent.sock`
+
+type StatusConfig struct {
+	History         bool   `cli:"history"`
+	Limit           int    `cli:"limit"`
+	JobHistoryPath  string `cli:"job-history-path" normalize:"filepath"`
+	Transfers       bool   `cli:"transfers"`
+	AdminSocketPath string `cli:"admin-socket-path" normalize:"filepath"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var JobHistoryPathFlag = cli.StringFlag{
+	Name:   "job-history-path",
+	Value:  "",
+	Usage:  "Path to a file where a history of the jobs run on this host is recorded",
+	EnvVar: "BUILDKITE_JOB_HISTORY_PATH",
+}
+
+var StatusCommand = cli.Command{
+	Name:        "status",
+	Usage:       "Shows the recent jobs run by agents on this host",
+	Description: StatusHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "history",
+			Usage: "List the most recent jobs",
+		},
+		cli.IntFlag{
+			Name:  "limit",
+			Value: 20,
+			Usage: "How many jobs to list with --history",
+		},
+		JobHistoryPathFlag,
+		cli.BoolFlag{
+			Name:  "transfers",
+			Usage: "Show the artifact transfers in progress, instead of the job history",
+		},
+		AdminSocketPathFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := StatusConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.Transfers {
+			if cfg.AdminSocketPath == "" {
+				fatal(l, ExitConfigError, "An admin socket path is required with --transfers")
+			}
+			if err := showTransfers(cfg.AdminSocketPath); err != nil {
+				fatal(l, ExitTransportError, "Failed to get transfers: %s", err)
+			}
+			return
+		}
+
+		if cfg.JobHistoryPath == "" {
+			fatal(l, ExitConfigError, "A job history path is required")
+		}
+
+		store := history.NewStore(cfg.JobHistoryPath)
+
+		if cfg.History {
+			records, err := store.Recent(cfg.Limit)
+			if err != nil {
+				l.Fatal("Failed to read job history: %s", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "JOB\tAGENT\tPIPELINE\tLABEL\tFINISHED\tDURATION\tEXIT\tPEAK RSS")
+			for _, r := range records {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					r.JobID, r.AgentName, r.Pipeline, r.Label,
+					r.FinishedAt.Local().Format(logger.DateFormat),
+					r.Duration.Round(time.Second), r.ExitStatus, formatKilobytes(r.PeakRSS))
+			}
+			w.Flush()
+			return
+		}
+
+		records, err := store.Recent(0)
+		if err != nil {
+			l.Fatal("Failed to read job history: %s", err)
+		}
+
+		if len(records) == 0 {
+			fmt.Printf("No jobs have been recorded in %s\n", cfg.JobHistoryPath)
+			return
+		}
+
+		var passed int
+		var total time.Duration
+		steps := map[[2]string]bool{}
+
+		for _, r := range records {
+			if r.ExitStatus == "0" {
+				passed++
+			}
+			total += r.Duration
+			steps[[2]string{r.Pipeline, r.Label}] = true
+		}
+
+		fmt.Printf("Jobs recorded:     %d (%d passed, %d failed)\n", len(records), passed, len(records)-passed)
+		fmt.Printf("Average duration:  %s\n", (total / time.Duration(len(records))).Round(time.Second))
+		fmt.Printf("Last job finished: %s\n", records[0].FinishedAt.Local().Format(logger.DateFormat))
+
+		var keys [][2]string
+		for k := range steps {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0]+keys[i][1] < keys[j][0]+keys[j][1]
+		})
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		var header bool
+		for _, k := range keys {
+			timeout, err := store.SuggestedTimeout(k[0], k[1])
+			if err != nil {
+				l.Fatal("Failed to read job history: %s", err)
+			}
+			if timeout == 0 {
+				continue
+			}
+			if !header {
+				fmt.Fprintln(w, "\nPIPELINE\tLABEL\tSUGGESTED TIMEOUT")
+				header = true
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", k[0], k[1], timeout)
+		}
+		w.Flush()
+	},
+}
+
+// showTransfers lists the artifact transfers in progress on an agent
+func showTransfers(socket string) error {
+	client, baseURL := agent.NewAdminClient(socket)
+
+	u := *baseURL
+	u.Path = "/transfers"
+
+	res, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s (is the agent new enough to report transfers?)", res.Status)
+	}
+
+	var transfers []agent.Transfer
+	if err := json.NewDecoder(res.Body).Decode(&transfers); err != nil {
+		return err
+	}
+
+	if len(transfers) == 0 {
+		fmt.Println("No artifact transfers in progress")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tDIRECTION\tFILE\tPROGRESS\tRATE\tRETRIES\tRUNNING FOR")
+	for _, t := range transfers {
+		progress := formatKilobytes(t.Bytes / 1024)
+		if t.Size > 0 {
+			progress = fmt.Sprintf("%s of %s (%d%%)", progress, formatKilobytes(t.Size/1024), t.Bytes*100/t.Size)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s/s\t%d\t%s\n",
+			t.JobID, t.Direction, t.File, progress, formatKilobytes(int64(t.Rate/1024)),
+			t.Retries, time.Since(t.StartedAt).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func formatKilobytes(kb int64) string {
+	switch {
+	case kb <= 0:
+		return "-"
+	case kb >= 1024*1024:
+		return fmt.Sprintf("%.1fGB", float64(kb)/(1024*1024))
+	case kb >= 1024:
+		return fmt.Sprintf("%.1fMB", float64(kb)/1024)
+	default:
+		return fmt.Sprintf("%dKB", kb)
+	}
+}
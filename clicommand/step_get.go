@@ -0,0 +1,143 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var StepGetHelpDescription = `Usage:
+
+   buildkite-agent step get <attribute> [arguments...]
+
+Description:
+
+   Get the value of an attribute of a step associated with a job, such as
+   its label, state or retry rules.
+
+   The value is printed as it is, without a trailing newline. Structured
+   attributes such as retry rules are printed as JSON.
+
+   With --format json, the value is printed as a JSON object with the
+   attribute and its value, which is easier to handle in scripts.
+
+Example:
+
+   $ buildkite-agent step get "label"
+   $ buildkite-agent step get "state" --job "$OTHER_JOB_ID"
+   $ buildkite-agent step get "retry" --format json | jq -r .value`
+
+type StepGetConfig struct {
+	Attribute string `cli:"arg:0" label:"attribute" validate:"required"`
+	Job       string `cli:"job" validate:"required"`
+	Format    string `cli:"format"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var StepGetCommand = cli.Command{
+	Name:        "get",
+	Usage:       "Get the value of an attribute on a step",
+	Description: StepGetHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Target the step of a specific job in the build",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "How to print the value, either text (as it is) or json",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := StepGetConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.Format != "text" && cfg.Format != "json" {
+			fatal(l, ExitConfigError, "Unknown format %q, must be either text or json", cfg.Format)
+		}
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		var attribute *api.StepAttribute
+
+		err := retry.Do(func(s *retry.Stats) error {
+			var resp *api.Response
+			var err error
+
+			attribute, resp, err = client.Jobs.StepGet(cfg.Job, cfg.Attribute)
+			if resp != nil && (resp.StatusCode == 400 || resp.StatusCode == 401 || resp.StatusCode == 404) {
+				s.Break()
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to get step: %s", err)
+		}
+
+		if cfg.Format == "json" {
+			attribute.Attribute = cfg.Attribute
+			if err := json.NewEncoder(os.Stdout).Encode(attribute); err != nil {
+				l.Fatal("Failed to print step attribute: %s", err)
+			}
+			return
+		}
+
+		fmt.Print(attribute.Value)
+	},
+}
@@ -0,0 +1,135 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/telemetry"
+	"github.com/urfave/cli"
+)
+
+// The report for the currently running command, which is sent by
+// telemetryExitFn if the command exits via a fatal log message
+var pendingTelemetry struct {
+	sync.Mutex
+	reporter  *telemetry.Reporter
+	report    *telemetry.Report
+	startedAt time.Time
+}
+
+var TelemetryEndpointFlag = cli.StringFlag{
+	Name:   "telemetry-endpoint",
+	Value:  "",
+	Usage:  "Opt-in to sending anonymous usage reports (command, flag and experiment names, and error categories) to this URL",
+	EnvVar: "BUILDKITE_AGENT_TELEMETRY_ENDPOINT",
+}
+
+// WithTelemetry wraps the actions of the given commands (and their
+// subcommands) so that a usage report is sent once they finish, if a
+// telemetry endpoint has been configured
+func WithTelemetry(commands []cli.Command) []cli.Command {
+	for i := range commands {
+		if len(commands[i].Subcommands) > 0 {
+			commands[i].Subcommands = WithTelemetry(commands[i].Subcommands)
+		}
+		if commands[i].Action != nil {
+			commands[i].Action = telemetryAction(commands[i].Action)
+		}
+	}
+	return commands
+}
+
+// ReportTelemetryError sends a report for an invocation that failed before
+// any command action was run, such as an unknown command or bad flags
+func ReportTelemetryError(c *cli.Context, command string, category string) {
+	reporter := telemetry.NewReporter(c.GlobalString(TelemetryEndpointFlag.Name))
+	if reporter == nil {
+		return
+	}
+
+	report := telemetry.NewReport(agent.Version(), command, nil, nil)
+	report.ErrorCategory = category
+
+	_ = reporter.Send(report)
+}
+
+func telemetryAction(action interface{}) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		reporter := telemetry.NewReporter(c.GlobalString(TelemetryEndpointFlag.Name))
+		if reporter == nil {
+			return cli.HandleAction(action, c)
+		}
+
+		report := telemetry.NewReport(agent.Version(), c.Command.FullName(), setFlagNames(c), c.StringSlice(ExperimentsFlag.Name))
+
+		pendingTelemetry.Lock()
+		pendingTelemetry.reporter = reporter
+		pendingTelemetry.report = report
+		pendingTelemetry.startedAt = time.Now()
+		pendingTelemetry.Unlock()
+
+		defer func() {
+			if r := recover(); r != nil {
+				sendPendingTelemetry(telemetry.CategoryPanic)
+				panic(r)
+			}
+		}()
+
+		err := cli.HandleAction(action, c)
+		if err != nil {
+			sendPendingTelemetry(telemetry.CategoryUsage)
+		} else {
+			sendPendingTelemetry(telemetry.CategoryNone)
+		}
+
+		return err
+	}
+}
+
+// telemetryExitFn wraps a loggers exit function so that a pending usage
+// report is sent before the process exits
+func telemetryExitFn(exitFn func()) func() {
+	return func() {
+		sendPendingTelemetry(telemetry.CategoryFatal)
+		if exitFn != nil {
+			exitFn()
+		} else {
+			os.Exit(1)
+		}
+	}
+}
+
+// sendPendingTelemetry sends the report for the current command (if there is
+// one) with the given error category. Reports are only ever sent once.
+func sendPendingTelemetry(category string) {
+	pendingTelemetry.Lock()
+	defer pendingTelemetry.Unlock()
+
+	if pendingTelemetry.report == nil {
+		return
+	}
+
+	report := pendingTelemetry.report
+	report.ErrorCategory = category
+	report.DurationMS = int64(time.Since(pendingTelemetry.startedAt) / time.Millisecond)
+	pendingTelemetry.report = nil
+
+	if err := pendingTelemetry.reporter.Send(report); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send telemetry report: %v\n", err)
+	}
+}
+
+// setFlagNames returns the names of the flags that were explicitly provided,
+// either on the command line or via the environment
+func setFlagNames(c *cli.Context) []string {
+	var names []string
+	for _, name := range c.FlagNames() {
+		if c.IsSet(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,279 @@
+package clicommand
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/junit"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	zglob "github.com/mattn/go-zglob"
+	"github.com/urfave/cli"
+)
+
+var ToolJUnitAnnotateHelpDescription = `Usage:
+
+   buildkite-agent tool junit-annotate <glob> [arguments...]
+
+Description:
+
+   Parses JUnit XML reports matching the glob and annotates the build with a
+   summary of the failing tests.
+
+   Failures are grouped by test suite, with the details of each failure
+   collapsed underneath the name of the test. Tests that appear in more than
+   one report (such as when tests are sharded across parallel jobs, or are
+   retried) are only shown once, and tests that failed in one report but
+   passed in another are listed separately as flaky.
+
+   If no failures are found, no annotation is created.
+
+   Known flaky tests can be quarantined, so that their failures are shown
+   separately in the annotation but don't fail the build. The quarantine list
+   has one test per line, as "Name", "Classname.Name" or "Suite/Classname.Name",
+   and can use * as a wildcard. Lines starting with # are ignored. It can be
+   read from a file, a URL, or build meta-data. When a quarantine list is
+   given, this command exits with a status of 1 if there are any failures that
+   aren't quarantined or flaky, so it can be used as the step's result.
+
+Example:
+
+   $ buildkite-agent tool junit-annotate "tmp/junit-*.xml"
+   $ buildkite-agent tool junit-annotate "reports/**/*.xml" --context "rspec"
+   $ buildkite-agent tool junit-annotate "tmp/junit-*.xml" --quarantine-url "https://example.com/quarantine.txt"`
+
+type ToolJUnitAnnotateConfig struct {
+	Glob    string `cli:"arg:0" label:"JUnit report glob" validate:"required"`
+	Context string `cli:"context"`
+	Style   string `cli:"style"`
+	Job     string `cli:"job" validate:"required"`
+
+	QuarantineFile        string `cli:"quarantine-file" normalize:"filepath"`
+	QuarantineURL         string `cli:"quarantine-url"`
+	QuarantineMetaDataKey string `cli:"quarantine-meta-data-key"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token" validate:"required"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var ToolJUnitAnnotateCommand = cli.Command{
+	Name:        "junit-annotate",
+	Usage:       "Annotates the build with a summary of failures from JUnit XML reports",
+	Description: ToolJUnitAnnotateHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "context",
+			Value: "junit",
+			Usage: "The context of the annotation used to differentiate this annotation from others",
+		},
+		cli.StringFlag{
+			Name:  "style",
+			Value: "error",
+			Usage: "The style of the annotation (`success`, `info`, `warning` or `error`)",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job should the annotation come from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.StringFlag{
+			Name:   "quarantine-file",
+			Value:  "",
+			Usage:  "A file listing quarantined tests",
+			EnvVar: "BUILDKITE_TEST_QUARANTINE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "quarantine-url",
+			Value:  "",
+			Usage:  "A URL to fetch the list of quarantined tests from",
+			EnvVar: "BUILDKITE_TEST_QUARANTINE_URL",
+		},
+		cli.StringFlag{
+			Name:   "quarantine-meta-data-key",
+			Value:  "",
+			Usage:  "A build meta-data key containing the list of quarantined tests",
+			EnvVar: "BUILDKITE_TEST_QUARANTINE_META_DATA_KEY",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := ToolJUnitAnnotateConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		files, err := zglob.Glob(cfg.Glob)
+		if err != nil {
+			fatal(l, ExitConfigError, "Failed to find JUnit reports matching %q: %s", cfg.Glob, err)
+		}
+
+		if len(files) == 0 {
+			fatal(l, ExitNotFound, "No JUnit reports found matching %q", cfg.Glob)
+		}
+
+		var suites []junit.TestSuite
+		for _, file := range files {
+			l.Debug("Parsing JUnit report %s", file)
+
+			f, err := os.Open(file)
+			if err != nil {
+				fatal(l, ExitError, "Failed to open %s: %s", file, err)
+			}
+
+			parsed, err := junit.Parse(f)
+			f.Close()
+			if err != nil {
+				fatal(l, ExitError, "Failed to parse %s: %s", file, err)
+			}
+
+			suites = append(suites, parsed...)
+		}
+
+		summary := junit.Summarize(suites)
+		if len(summary.Failed) == 0 {
+			l.Info("No failures found in %d JUnit reports", len(files))
+			return
+		}
+
+		// Create the API client
+		client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		quarantine, err := loadQuarantine(l, client, cfg)
+		if os.IsNotExist(err) {
+			fatal(l, ExitNotFound, "Failed to load quarantine list: %v", err)
+		} else if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to load quarantine list: %v", err)
+		}
+
+		style := cfg.Style
+		if quarantine != nil {
+			summary.Quarantine(quarantine)
+
+			// Don't shout about failures that aren't failing the build
+			if len(summary.Blocking()) == 0 && style == "error" {
+				style = "warning"
+			}
+		}
+
+		annotation := &api.Annotation{
+			Body:    summary.Markdown(),
+			Style:   style,
+			Context: cfg.Context,
+		}
+
+		// Retry the annotation a few times before giving up
+		err = retry.Do(func(s *retry.Stats) error {
+			resp, err := client.Annotations.Create(cfg.Job, annotation)
+
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				s.Break()
+				return err
+			}
+
+			// Show the unexpected error
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+
+		// Show a fatal error if we gave up trying to create the annotation
+		if err != nil {
+			fatal(l, exitCodeForError(err), "Failed to annotate build: %s", err)
+		}
+
+		l.Info("Annotated build with %d failing tests from %d JUnit reports", len(summary.Failed), len(files))
+
+		if quarantine != nil {
+			if blocking := summary.Blocking(); len(blocking) > 0 {
+				l.Error("%d tests failed that aren't quarantined", len(blocking))
+				os.Exit(ExitError)
+			}
+		}
+	},
+}
+
+// How long to wait for the quarantine list from --quarantine-url
+const quarantineURLTimeout = 30 * time.Second
+
+// loadQuarantine reads the quarantine list from whichever source was
+// configured, returning nil if there isn't one
+func loadQuarantine(l logger.Logger, client *api.Client, cfg ToolJUnitAnnotateConfig) (*junit.Quarantine, error) {
+	switch {
+	case cfg.QuarantineFile != "":
+		f, err := os.Open(cfg.QuarantineFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return junit.ParseQuarantine(f)
+
+	case cfg.QuarantineURL != "":
+		res, err := agent.NewHTTPClient(quarantineURLTimeout, cfg.NoHTTP2).Get(cfg.QuarantineURL)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", cfg.QuarantineURL, res.Status)
+		}
+		return junit.ParseQuarantine(res.Body)
+
+	case cfg.QuarantineMetaDataKey != "":
+		value, found, err := fetchMetaData(l, client, cfg.Job, cfg.QuarantineMetaDataKey)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			l.Warn("No quarantine list found in meta-data key %q", cfg.QuarantineMetaDataKey)
+		}
+		return junit.ParseQuarantine(strings.NewReader(value))
+	}
+
+	return nil, nil
+}
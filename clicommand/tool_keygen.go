@@ -0,0 +1,159 @@
+package clicommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/sshkey"
+	"github.com/urfave/cli"
+)
+
+var ToolKeygenHelpDescription = `Usage:
+
+   buildkite-agent tool keygen --output <path> [arguments...]
+
+Description:
+
+   Generates an SSH keypair for use as a repository deploy key.
+
+   The private key is written to the output path, readable only by the
+   current user, and the public key is written alongside it with a .pub
+   extension. The public key is also printed to STDOUT, ready to be pasted
+   into the deploy key settings of your repository.
+
+   With --ssh-add, the private key is also added to the ssh-agent at
+   $SSH_AUTH_SOCK, so that it can be used by the rest of the job without
+   being written anywhere else.
+
+Example:
+
+   $ buildkite-agent tool keygen --output ~/.ssh/id_ed25519
+   $ buildkite-agent tool keygen --type rsa --output ./deploy_key --ssh-add`
+
+type ToolKeygenConfig struct {
+	Type    string `cli:"type"`
+	Output  string `cli:"output" normalize:"filepath" validate:"required"`
+	Comment string `cli:"comment"`
+	Force   bool   `cli:"force"`
+	SSHAdd  bool   `cli:"ssh-add"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var ToolKeygenCommand = cli.Command{
+	Name:        "keygen",
+	Usage:       "Generates an SSH keypair for use as a deploy key",
+	Description: ToolKeygenHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Value: sshkey.TypeED25519,
+			Usage: "The type of key to generate (`ed25519`, `ecdsa` or `rsa`)",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Value: "",
+			Usage: "Where to write the private key. The public key is written to the same path with .pub appended",
+		},
+		cli.StringFlag{
+			Name:  "comment",
+			Value: "",
+			Usage: "A comment to add to the public key (defaults to buildkite-agent@<hostname>)",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Overwrite any existing key at the output path",
+		},
+		cli.BoolFlag{
+			Name:  "ssh-add",
+			Usage: "Add the private key to the running ssh-agent",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := ToolKeygenConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		if cfg.Comment == "" {
+			hostname, _ := os.Hostname()
+			cfg.Comment = "buildkite-agent@" + hostname
+		}
+
+		publicKeyPath := cfg.Output + ".pub"
+
+		if !cfg.Force {
+			for _, path := range []string{cfg.Output, publicKeyPath} {
+				if _, err := os.Stat(path); err == nil {
+					fatal(l, ExitConfigError, "%s already exists, use --force to overwrite it", path)
+				}
+			}
+		}
+
+		kp, err := sshkey.Generate(cfg.Type, cfg.Comment)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(cfg.Output), 0700); err != nil {
+			l.Fatal("Failed to create folder for %s: %v", cfg.Output, err)
+		}
+
+		if err := writeKeyFile(cfg.Output, kp.PrivateKey, 0600); err != nil {
+			l.Fatal("Failed to write private key: %v", err)
+		}
+
+		if err := writeKeyFile(publicKeyPath, kp.PublicKey, 0644); err != nil {
+			l.Fatal("Failed to write public key: %v", err)
+		}
+
+		l.Info("Wrote %s key %s to %s and %s", cfg.Type, kp.Fingerprint, cfg.Output, publicKeyPath)
+
+		if cfg.SSHAdd {
+			if os.Getenv("SSH_AUTH_SOCK") == "" {
+				l.Fatal("Can't add the key to ssh-agent because SSH_AUTH_SOCK isn't set")
+			}
+
+			output, err := exec.Command("ssh-add", cfg.Output).CombinedOutput()
+			if err != nil {
+				l.Fatal("Failed to add the key to ssh-agent: %v (%s)", err, output)
+			}
+
+			l.Info("Added the key to ssh-agent")
+		}
+
+		l.Info("Add the following public key to your repository's deploy keys:")
+		fmt.Print(string(kp.PublicKey))
+	},
+}
+
+// writeKeyFile writes a key, making sure it ends up with exactly the given
+// permissions even if the file already existed
+func writeKeyFile(path string, data []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
@@ -0,0 +1,147 @@
+package clicommand
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+	"github.com/urfave/cli"
+)
+
+var ToolRunHelpDescription = `Usage:
+
+   buildkite-agent tool run [arguments...] -- <command> [command arguments...]
+
+Description:
+
+   Runs a command, printing a line to the job log every so often while it's
+   running. This stops long commands that don't print anything (like some
+   compilers and linkers) from being mistaken for a hung job by no-output
+   timeouts.
+
+   Once the command finishes, how long it took and how much memory it used at
+   its peak are printed, and this command exits with the same status as the
+   command it ran.
+
+Example:
+
+   $ buildkite-agent tool run --heartbeat 60s -- make release
+   $ buildkite-agent tool run -- cargo build --release`
+
+type ToolRunConfig struct {
+	Heartbeat string `cli:"heartbeat"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var ToolRunCommand = cli.Command{
+	Name:        "run",
+	Usage:       "Runs a command, reporting that it's still running and how many resources it used",
+	Description: ToolRunHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "heartbeat",
+			Value:  "60s",
+			Usage:  "How often to print that the command is still running, or 0 to never print it",
+			EnvVar: "BUILDKITE_TOOL_RUN_HEARTBEAT",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := ToolRunConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		args := c.Args()
+		if len(args) == 0 {
+			fatal(l, ExitConfigError, "A command to run is required. See: `buildkite-agent tool run --help`")
+		}
+
+		heartbeat, err := time.ParseDuration(cfg.Heartbeat)
+		if err != nil {
+			fatal(l, ExitConfigError, "Failed to parse heartbeat %q: %v", cfg.Heartbeat, err)
+		}
+
+		command := strings.Join(args, " ")
+
+		p := process.New(logger.Discard, process.Config{
+			Path:   args[0],
+			Args:   args[1:],
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		})
+
+		// Pass on any signals, as the command runs in its own process group
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt,
+			syscall.SIGHUP,
+			syscall.SIGTERM,
+			syscall.SIGINT,
+			syscall.SIGQUIT)
+		defer signal.Stop(signals)
+
+		go func() {
+			for range signals {
+				if err := p.Interrupt(); err != nil {
+					l.Error("Failed to interrupt %q: %v", command, err)
+				}
+			}
+		}()
+
+		startedAt := time.Now()
+
+		if heartbeat > 0 {
+			go func() {
+				ticker := time.NewTicker(heartbeat)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ticker.C:
+						l.Info("Still running %q (%s elapsed)", command, time.Since(startedAt).Round(time.Second))
+					case <-p.Done():
+						return
+					}
+				}
+			}()
+		}
+
+		if err := p.Run(); err != nil {
+			l.Fatal("Failed to run %q: %v", command, err)
+		}
+
+		status := p.WaitStatus()
+		exitStatus := status.ExitStatus()
+		if status.Signaled() {
+			exitStatus = 128 + int(status.Signal())
+		}
+
+		l.Info("Finished %q in %s with exit status %d (peak memory %s)",
+			command, time.Since(startedAt), exitStatus, formatKilobytes(p.MaxRSS()))
+
+		os.Exit(exitStatus)
+	},
+}
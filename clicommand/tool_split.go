@@ -0,0 +1,213 @@
+package clicommand
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/split"
+	"github.com/urfave/cli"
+)
+
+var ToolSplitHelpDescription = `Usage:
+
+   buildkite-agent tool split [--inputs <file>] [arguments...]
+
+Description:
+
+   Splits a list of inputs (such as test files) between the parallel jobs of
+   a step, and prints the inputs this job should run to STDOUT, one per line.
+
+   Inputs are read one per line from the --inputs file, or from STDIN if no
+   file is given. Every job computes the same split, so each input is run
+   exactly once.
+
+   By default inputs are dealt out evenly. If timings are provided, inputs are
+   split so that each job takes roughly the same amount of time. Timings are a
+   JSON object of input to duration (in any unit, as long as it's the same
+   for every input), read from a file with --timings or from the build's
+   meta-data with --timings-meta-data-key. Inputs without a timing are
+   assumed to take the average time.
+
+Example:
+
+   $ buildkite-agent tool split --inputs tests.txt --timings timings.json | xargs rspec
+   $ find spec -name "*_spec.rb" | buildkite-agent tool split \
+       --timings-meta-data-key "rspec-timings" | xargs rspec`
+
+type ToolSplitConfig struct {
+	Index              int    `cli:"index"`
+	Total              int    `cli:"total"`
+	Inputs             string `cli:"inputs" normalize:"filepath"`
+	Timings            string `cli:"timings" normalize:"filepath"`
+	TimingsMetaDataKey string `cli:"timings-meta-data-key"`
+	Job                string `cli:"job"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+
+	// API config
+	DebugHTTP          bool     `cli:"debug-http"`
+	AgentAccessToken   string   `cli:"agent-access-token"`
+	Endpoint           string   `cli:"endpoint" validate:"required"`
+	NoHTTP2            bool     `cli:"no-http2"`
+	DNSServers         []string `cli:"dns-servers" normalize:"list"`
+	DNSTimeout         string   `cli:"dns-timeout"`
+	PreferIP           string   `cli:"prefer-ip"`
+	HappyEyeballsDelay string   `cli:"happy-eyeballs-delay"`
+}
+
+var ToolSplitCommand = cli.Command{
+	Name:        "split",
+	Usage:       "Splits a list of inputs between the parallel jobs of a step",
+	Description: ToolSplitHelpDescription,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "index",
+			Value:  0,
+			Usage:  "The index of this job, starting from 0",
+			EnvVar: "BUILDKITE_PARALLEL_JOB",
+		},
+		cli.IntFlag{
+			Name:   "total",
+			Value:  1,
+			Usage:  "The total number of jobs the inputs are being split between",
+			EnvVar: "BUILDKITE_PARALLEL_JOB_COUNT",
+		},
+		cli.StringFlag{
+			Name:  "inputs",
+			Value: "",
+			Usage: "A file containing the inputs to split, one per line (defaults to STDIN)",
+		},
+		cli.StringFlag{
+			Name:  "timings",
+			Value: "",
+			Usage: "A JSON file of timings for each input",
+		},
+		cli.StringFlag{
+			Name:  "timings-meta-data-key",
+			Value: "",
+			Usage: "A build meta-data key containing JSON timings for each input",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build should the timings meta-data be read from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+
+		// API Flags
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoHTTP2Flag,
+		DNSServersFlag,
+		DNSTimeoutFlag,
+		PreferIPFlag,
+		HappyEyeballsDelayFlag,
+		DebugHTTPFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := ToolSplitConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		var r io.Reader = os.Stdin
+		if cfg.Inputs != "" && cfg.Inputs != "-" {
+			f, err := os.Open(cfg.Inputs)
+			if err != nil {
+				fatal(l, ExitConfigError, "Failed to open inputs: %v", err)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		inputs, err := readLines(r)
+		if err != nil {
+			l.Fatal("Failed to read inputs: %v", err)
+		}
+
+		var timingsJSON []byte
+
+		if cfg.Timings != "" {
+			timingsJSON, err = ioutil.ReadFile(cfg.Timings)
+			if err != nil {
+				fatal(l, ExitConfigError, "Failed to read timings: %v", err)
+			}
+		} else if cfg.TimingsMetaDataKey != "" {
+			if cfg.Job == "" || cfg.AgentAccessToken == "" {
+				fatal(l, ExitConfigError, "Reading timings from meta-data requires --job and --agent-access-token")
+			}
+
+			client := agent.NewAPIClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+			value, found, err := fetchMetaData(l, client, cfg.Job, cfg.TimingsMetaDataKey)
+
+			// No timings yet (such as on the first build) isn't an error,
+			// the inputs are just split evenly instead
+			if err != nil {
+				fatal(l, exitCodeForError(err), "Failed to get timings from meta-data: %s", err)
+			} else if !found {
+				l.Warn("No timings found in meta-data key %q, splitting inputs evenly", cfg.TimingsMetaDataKey)
+			} else {
+				timingsJSON = []byte(value)
+			}
+		}
+
+		var timings map[string]float64
+		if timingsJSON != nil {
+			if err := json.Unmarshal(timingsJSON, &timings); err != nil {
+				fatal(l, ExitConfigError, "Failed to parse timings: %v", err)
+			}
+		}
+
+		bucket, err := split.Split(inputs, timings, cfg.Index, cfg.Total)
+		if err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		l.Debug("Job %d of %d was given %d of %d inputs", cfg.Index+1, cfg.Total, len(bucket), len(inputs))
+
+		for _, input := range bucket {
+			fmt.Println(input)
+		}
+	},
+}
+
+// readLines returns the non-blank lines from r, with surrounding whitespace
+// removed
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
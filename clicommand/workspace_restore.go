@@ -0,0 +1,92 @@
+package clicommand
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/workspace"
+	"github.com/urfave/cli"
+)
+
+var WorkspaceRestoreHelpDescription = `Usage:
+
+   buildkite-agent workspace restore <name> [arguments...]
+
+Description:
+
+   Replaces the contents of the job's checkout directory with a snapshot
+   saved by "buildkite-agent workspace snapshot" on this host. Anything in
+   the checkout directory that isn't in the snapshot is removed.
+
+   If there's no snapshot with that name on this host, the checkout
+   directory is left alone and the command exits with status 100, so that
+   the step can fall back to preparing the workspace itself.
+
+Example:
+
+   $ buildkite-agent workspace restore node-modules || npm ci`
+
+type WorkspaceRestoreConfig struct {
+	Name          string `cli:"arg:0" label:"snapshot name" validate:"required"`
+	Dir           string `cli:"dir" normalize:"filepath"`
+	SnapshotsPath string `cli:"snapshots-path" normalize:"filepath"`
+	BuildPath     string `cli:"build-path" normalize:"filepath"`
+	Organization  string `cli:"organization"`
+	Pipeline      string `cli:"pipeline"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var WorkspaceRestoreCommand = cli.Command{
+	Name:        "restore",
+	Usage:       "Replaces the workspace with a snapshot saved on this host",
+	Description: WorkspaceRestoreHelpDescription,
+	Flags: []cli.Flag{
+		WorkspaceDirFlag,
+		WorkspaceSnapshotsPathFlag,
+		WorkspaceBuildPathFlag,
+		WorkspaceOrganizationFlag,
+		WorkspacePipelineFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := WorkspaceRestoreConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		store := workspaceStore(l, cfg.SnapshotsPath, cfg.BuildPath, cfg.Organization, cfg.Pipeline)
+
+		if err := workspace.ValidateName(cfg.Name); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		l.Info("Restoring snapshot %q to %s", cfg.Name, cfg.Dir)
+
+		result, err := store.Restore(cfg.Name, cfg.Dir)
+		if err == workspace.ErrNotFound {
+			fatal(l, ExitNotFound, "There's no snapshot %q on this host", cfg.Name)
+		} else if err != nil {
+			fatal(l, ExitError, "Failed to restore the workspace: %v", err)
+		}
+
+		l.Info("Snapshot %q restored in %s (%s)", cfg.Name, result.Duration.Round(time.Millisecond), describeWorkspaceResult(result))
+	},
+}
@@ -0,0 +1,162 @@
+package clicommand
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/workspace"
+	"github.com/urfave/cli"
+)
+
+var WorkspaceSnapshotHelpDescription = `Usage:
+
+   buildkite-agent workspace snapshot <name> [arguments...]
+
+Description:
+
+   Saves the job's checkout directory as a named snapshot on this host, so
+   that later steps that run on the same host can start from it with
+   "buildkite-agent workspace restore", rather than building it up again
+   (such as installing dependencies). It's a middle ground between caching
+   to somewhere shared and sharing a workspace between steps.
+
+   On filesystems with copy-on-write clones (APFS, btrfs and XFS with
+   reflinks) snapshots are close to instant and take up no extra space until
+   files change. Elsewhere the files are copied. Snapshots are kept in
+   --snapshots-path, which defaults to a directory in the agent's build path
+   so that they're on the same filesystem as the checkouts.
+
+   Snapshots belong to a pipeline, and a snapshot with the same name is
+   replaced once the new one is complete. Nothing removes old snapshots, so
+   clean up --snapshots-path if space is a concern.
+
+Example:
+
+   $ npm ci
+   $ buildkite-agent workspace snapshot node-modules`
+
+type WorkspaceSnapshotConfig struct {
+	Name          string `cli:"arg:0" label:"snapshot name" validate:"required"`
+	Dir           string `cli:"dir" normalize:"filepath"`
+	SnapshotsPath string `cli:"snapshots-path" normalize:"filepath"`
+	BuildPath     string `cli:"build-path" normalize:"filepath"`
+	Organization  string `cli:"organization"`
+	Pipeline      string `cli:"pipeline"`
+
+	// Global flags
+	Debug     bool   `cli:"debug"`
+	NoColor   bool   `cli:"no-color"`
+	LogFormat string `cli:"log-format"`
+	LogLevel  string `cli:"log-level"`
+}
+
+var WorkspaceDirFlag = cli.StringFlag{
+	Name:   "dir",
+	Value:  ".",
+	Usage:  "The workspace directory",
+	EnvVar: "BUILDKITE_BUILD_CHECKOUT_PATH",
+}
+
+var WorkspaceSnapshotsPathFlag = cli.StringFlag{
+	Name:   "snapshots-path",
+	Value:  "",
+	Usage:  "Where snapshots are kept (default: .workspace-snapshots in --build-path)",
+	EnvVar: "BUILDKITE_WORKSPACE_SNAPSHOTS_PATH",
+}
+
+var WorkspaceBuildPathFlag = cli.StringFlag{
+	Name:   "build-path",
+	Value:  "",
+	Usage:  "The agent's build path, where snapshots are kept unless --snapshots-path is set",
+	EnvVar: "BUILDKITE_BUILD_PATH",
+}
+
+var WorkspaceOrganizationFlag = cli.StringFlag{
+	Name:   "organization",
+	Value:  "",
+	Usage:  "The slug of the organization the snapshots belong to",
+	EnvVar: "BUILDKITE_ORGANIZATION_SLUG",
+}
+
+var WorkspacePipelineFlag = cli.StringFlag{
+	Name:   "pipeline",
+	Value:  "",
+	Usage:  "The slug of the pipeline the snapshots belong to",
+	EnvVar: "BUILDKITE_PIPELINE_SLUG",
+}
+
+var WorkspaceSnapshotCommand = cli.Command{
+	Name:        "snapshot",
+	Usage:       "Saves the workspace as a snapshot for later steps on this host",
+	Description: WorkspaceSnapshotHelpDescription,
+	Flags: []cli.Flag{
+		WorkspaceDirFlag,
+		WorkspaceSnapshotsPathFlag,
+		WorkspaceBuildPathFlag,
+		WorkspaceOrganizationFlag,
+		WorkspacePipelineFlag,
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogFormatFlag,
+		LogLevelFlag,
+	},
+	Action: func(c *cli.Context) {
+		l := CreateLogger(c)
+
+		// The configuration will be loaded into this struct
+		cfg := WorkspaceSnapshotConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(l, cfg)
+
+		store := workspaceStore(l, cfg.SnapshotsPath, cfg.BuildPath, cfg.Organization, cfg.Pipeline)
+
+		if err := workspace.ValidateName(cfg.Name); err != nil {
+			fatal(l, ExitConfigError, "%s", err)
+		}
+
+		l.Info("Saving %s as snapshot %q", cfg.Dir, cfg.Name)
+
+		result, err := store.Snapshot(cfg.Dir, cfg.Name)
+		if err != nil {
+			fatal(l, ExitError, "Failed to snapshot the workspace: %v", err)
+		}
+
+		l.Info("Snapshot %q saved in %s (%s)", cfg.Name, result.Duration.Round(time.Millisecond), describeWorkspaceResult(result))
+	},
+}
+
+// workspaceStore returns the store for the pipeline's snapshots, so that
+// pipelines sharing a host can't restore each other's workspaces
+func workspaceStore(l logger.Logger, snapshotsPath, buildPath, organization, pipeline string) workspace.Store {
+	if snapshotsPath == "" {
+		if buildPath == "" {
+			fatal(l, ExitConfigError, "Either --snapshots-path or --build-path must be set")
+		}
+		snapshotsPath = filepath.Join(buildPath, ".workspace-snapshots")
+	}
+
+	for _, slug := range []string{organization, pipeline} {
+		if slug != "" {
+			snapshotsPath = filepath.Join(snapshotsPath, filepath.Base(slug))
+		}
+	}
+
+	return workspace.Store{Path: snapshotsPath}
+}
+
+func describeWorkspaceResult(result workspace.Result) string {
+	if result.Cloned {
+		return "cloned"
+	}
+	return "copied, as copy-on-write clones aren't supported here"
+}
@@ -0,0 +1,80 @@
+package cliconfig
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// DeprecationReportEnv is the environment variable that can be set to the
+// path of a file that deprecated config usages are appended to, so that
+// fleets can find hosts that still need their configuration updated.
+const DeprecationReportEnv = "BUILDKITE_AGENT_DEPRECATION_REPORT"
+
+// The places a deprecated config option can be set from
+const (
+	SourceFlag       = "flag"
+	SourceEnv        = "env"
+	SourceConfigFile = "config-file"
+)
+
+// Deprecation records the use of a config option that has been renamed or
+// retired
+type Deprecation struct {
+	// The deprecated name that was used
+	Option string `json:"option"`
+
+	// The name of the option that replaced it, if there is one
+	ReplacedBy string `json:"replaced_by,omitempty"`
+
+	// Where the option was set from, one of the Source constants
+	Source string `json:"source"`
+
+	// The environment variable or config file the option was set in
+	EnvVar     string `json:"env_var,omitempty"`
+	ConfigFile string `json:"config_file,omitempty"`
+}
+
+// Where returns a human readable description of where the option was set
+func (d Deprecation) Where() string {
+	switch d.Source {
+	case SourceEnv:
+		return "the environment variable " + d.EnvVar
+	case SourceConfigFile:
+		return "the config file " + d.ConfigFile
+	default:
+		return "the command line flag --" + d.Option
+	}
+}
+
+type deprecationReportLine struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Deprecation
+}
+
+// WriteDeprecationReport writes each deprecation as a line of JSON
+func WriteDeprecationReport(w io.Writer, command string, deprecations []Deprecation) error {
+	enc := json.NewEncoder(w)
+	now := time.Now().UTC()
+
+	for _, d := range deprecations {
+		if err := enc.Encode(deprecationReportLine{Time: now, Command: command, Deprecation: d}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendDeprecationReport adds the deprecations to the end of the report file
+func appendDeprecationReport(path string, command string, deprecations []Deprecation) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return WriteDeprecationReport(f, command, deprecations)
+}
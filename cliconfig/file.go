@@ -3,6 +3,7 @@ package cliconfig
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -13,10 +14,21 @@ type File struct {
 	// The path to the file
 	Path string
 
+	// The profile to use on top of the settings at the top of the file, if
+	// any
+	Profile string
+
 	// A map of key/values that was loaded from the file
 	Config map[string]string
 }
 
+// The prefix of the sections that profiles are defined in, like
+// [profile.linux-gpu]
+const profileSectionPrefix = "profile."
+
+// The key a profile uses to inherit the settings of another profile
+const profileInheritsKey = "inherits"
+
 func (f *File) Load() error {
 	// Set the default config
 	f.Config = map[string]string{}
@@ -43,21 +55,101 @@ func (f *File) Load() error {
 		lines = append(lines, scanner.Text())
 	}
 
+	// Settings before the first section apply to every profile, and the
+	// ones in each [profile.name] section are kept separately
+	base := map[string]string{}
+	profiles := map[string]map[string]string{}
+	section := base
+
 	// Parse each line
 	for _, fullLine := range lines {
-		if !isIgnoredLine(fullLine) {
-			key, value, err := parseLine(fullLine)
-			if err != nil {
-				return err
+		if isIgnoredLine(fullLine) {
+			continue
+		}
+
+		if name, ok := parseSection(fullLine); ok {
+			if !strings.HasPrefix(name, profileSectionPrefix) || name == profileSectionPrefix {
+				return fmt.Errorf("Unknown section [%s] in config file, expected one like [profile.name]", name)
+			}
+
+			name = strings.TrimPrefix(name, profileSectionPrefix)
+			if _, exists := profiles[name]; exists {
+				return fmt.Errorf("Profile %q is defined more than once in config file", name)
 			}
 
-			f.Config[key] = value
+			section = map[string]string{}
+			profiles[name] = section
+			continue
+		}
+
+		key, value, err := parseLine(fullLine)
+		if err != nil {
+			return err
+		}
+
+		section[key] = value
+	}
+
+	for key, value := range base {
+		f.Config[key] = value
+	}
+
+	if f.Profile == "" {
+		return nil
+	}
+
+	// Apply the profile's ancestors first, so that each one can override
+	// the settings of the ones it inherits from
+	chain, err := profileChain(profiles, f.Profile)
+	if err != nil {
+		return err
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		for key, value := range profiles[chain[i]] {
+			if key != profileInheritsKey {
+				f.Config[key] = value
+			}
 		}
 	}
 
 	return nil
 }
 
+// profileChain returns the profile followed by the profiles it inherits from,
+// nearest first
+func profileChain(profiles map[string]map[string]string, name string) ([]string, error) {
+	var chain []string
+
+	for name != "" {
+		if containsString(chain, name) {
+			return nil, fmt.Errorf("Profile %q inherits from itself", name)
+		}
+
+		profile, ok := profiles[name]
+		if !ok {
+			if len(chain) == 0 {
+				return nil, fmt.Errorf("Profile %q isn't defined in config file", name)
+			}
+			return nil, fmt.Errorf("Profile %q inherits from %q, which isn't defined in config file", chain[len(chain)-1], name)
+		}
+
+		chain = append(chain, name)
+		name = profile[profileInheritsKey]
+	}
+
+	return chain, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (f File) AbsolutePath() (string, error) {
 	return utils.NormalizeFilePath(f.Path)
 }
@@ -150,6 +242,15 @@ func parseLine(line string) (key string, value string, err error) {
 	return
 }
 
+// parseSection returns the name of a section from a line like "[name]"
+func parseSection(line string) (string, bool) {
+	trimmedLine := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmedLine, "[") || !strings.HasSuffix(trimmedLine, "]") {
+		return "", false
+	}
+	return strings.TrimSpace(trimmedLine[1 : len(trimmedLine)-1]), true
+}
+
 func isIgnoredLine(line string) bool {
 	trimmedLine := strings.Trim(line, " \n\t")
 	return len(trimmedLine) == 0 || strings.HasPrefix(trimmedLine, "#")
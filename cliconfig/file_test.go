@@ -0,0 +1,84 @@
+package cliconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const profilesConfig = `name="agent-%n"
+tags="os=linux"
+queue=default
+
+# Profiles add to (and replace) the settings above
+[profile.linux-gpu]
+tags="os=linux,gpu=true"
+queue=gpu
+
+[profile.linux-gpu-large]
+inherits=linux-gpu
+spawn=4
+
+[ profile.mac ]
+tags="os=macos"
+`
+
+func loadTestFile(t *testing.T, dir string, contents string, profile string) (*File, error) {
+	t.Helper()
+
+	path := filepath.Join(dir, "buildkite-agent.cfg")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &File{Path: path, Profile: profile}
+	return f, f.Load()
+}
+
+func TestFileLoadsProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		profile  string
+		expected map[string]string
+	}{
+		{"", map[string]string{"name": "agent-%n", "tags": "os=linux", "queue": "default"}},
+		{"linux-gpu", map[string]string{"name": "agent-%n", "tags": "os=linux,gpu=true", "queue": "gpu"}},
+		{"linux-gpu-large", map[string]string{"name": "agent-%n", "tags": "os=linux,gpu=true", "queue": "gpu", "spawn": "4"}},
+		{"mac", map[string]string{"name": "agent-%n", "tags": "os=macos", "queue": "default"}},
+	} {
+		f, err := loadTestFile(t, dir, profilesConfig, tc.profile)
+		assert.NoError(t, err, tc.profile)
+		assert.Equal(t, tc.expected, f.Config, tc.profile)
+	}
+}
+
+func TestFileProfileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		contents string
+		profile  string
+		err      string
+	}{
+		{profilesConfig, "windows", `Profile "windows" isn't defined in config file`},
+		{"[profile.a]\ninherits=b\n", "a", `Profile "a" inherits from "b", which isn't defined in config file`},
+		{"[profile.a]\ninherits=b\n[profile.b]\ninherits=a\n", "a", `Profile "a" inherits from itself`},
+		{"[profile.a]\n[profile.a]\n", "", `Profile "a" is defined more than once in config file`},
+		{"[agent]\nqueue=default\n", "", "Unknown section [agent] in config file, expected one like [profile.name]"},
+	} {
+		_, err := loadTestFile(t, dir, tc.contents, tc.profile)
+		assert.EqualError(t, err, tc.err)
+	}
+}
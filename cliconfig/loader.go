@@ -29,6 +29,9 @@ type Loader struct {
 
 	// The file that was used when loading this configuration
 	File *File
+
+	// Any renamed or retired config options that were used
+	Deprecations []Deprecation
 }
 
 var argCliNameRegexp = regexp.MustCompile(`arg:(\d+)`)
@@ -71,6 +74,14 @@ func (l *Loader) Load() error {
 		}
 	}
 
+	// Profiles are sections of the config file, so there has to be one
+	if profile := l.CLI.String("profile"); profile != "" {
+		if l.File == nil {
+			return fmt.Errorf("The %q profile can't be used without a configuration file", profile)
+		}
+		l.File.Profile = profile
+	}
+
 	// If a file was found, then we should load it
 	if l.File != nil {
 		// Attempt to load the config file we've found
@@ -98,6 +109,15 @@ func (l *Loader) Load() error {
 			}
 		}
 
+		// Fall back to any old names the option had before it was renamed
+		aliases, _ := reflections.GetFieldTag(l.Config, fieldName, "aliases")
+		if aliases != "" {
+			err := l.setFieldValueFromAliases(fieldName, cliName, strings.Split(aliases, ","))
+			if err != nil {
+				return err
+			}
+		}
+
 		// Are there any normalizations we need to make?
 		normalization, _ := reflections.GetFieldTag(l.Config, fieldName, "normalize")
 		if normalization != "" {
@@ -115,9 +135,7 @@ func (l *Loader) Load() error {
 			// log a message, and set the proper config for them.
 			if !l.fieldValueIsEmpty(fieldName) {
 				renamedFieldCliName, _ := reflections.GetFieldTag(l.Config, renamedToFieldName, "cli")
-				if renamedFieldCliName != "" {
-					l.Logger.Warn("The config option `%s` has been renamed to `%s`. Please update your configuration.", cliName, renamedFieldCliName)
-				}
+				l.deprecated(cliName, renamedFieldCliName)
 
 				value, _ := reflections.GetField(l.Config, fieldName)
 
@@ -172,6 +190,13 @@ func (l *Loader) Load() error {
 		}
 	}
 
+	// Let fleets find the hosts that are still using deprecated options
+	if reportPath := os.Getenv(DeprecationReportEnv); reportPath != "" && len(l.Deprecations) > 0 {
+		if err := appendDeprecationReport(reportPath, l.commandName(), l.Deprecations); err != nil {
+			l.Logger.Warn("Failed to write the deprecation report to %s (%s)", reportPath, err)
+		}
+	}
+
 	return nil
 }
 
@@ -220,16 +245,9 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 		if l.File != nil {
 			if configFileValue, ok := l.File.Config[cliName]; ok {
 				// Convert the config file value to it's correct type
-				if fieldKind == reflect.String {
-					value = configFileValue
-				} else if fieldKind == reflect.Slice {
-					value = strings.Split(configFileValue, ",")
-				} else if fieldKind == reflect.Bool {
-					value, _ = strconv.ParseBool(configFileValue)
-				} else if fieldKind == reflect.Int {
-					value, _ = strconv.Atoi(configFileValue)
-				} else {
-					return fmt.Errorf("Unable to convert string to type %s", fieldKind)
+				value, err = convertConfigFileValue(configFileValue, fieldKind)
+				if err != nil {
+					return err
 				}
 			}
 		}
@@ -237,16 +255,9 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 		// If a value hasn't been found in a config file, but there
 		// _is_ one provided by the CLI context, then use that.
 		if value == nil || l.cliValueIsSet(cliName) {
-			if fieldKind == reflect.String {
-				value = l.CLI.String(cliName)
-			} else if fieldKind == reflect.Slice {
-				value = l.CLI.StringSlice(cliName)
-			} else if fieldKind == reflect.Bool {
-				value = l.CLI.Bool(cliName)
-			} else if fieldKind == reflect.Int {
-				value = l.CLI.Int(cliName)
-			} else {
-				return fmt.Errorf("Unable to handle type: %s", fieldKind)
+			value, err = l.cliValue(cliName, fieldKind)
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -268,28 +279,165 @@ func (l Loader) Errorf(format string, v ...interface{}) error {
 	return fmt.Errorf(format+suffix, v...)
 }
 
+func (l *Loader) setFieldValueFromAliases(fieldName string, cliName string, aliases []string) error {
+	fieldKind, err := reflections.GetFieldKind(l.Config, fieldName)
+	if err != nil {
+		return fmt.Errorf(`Failed to get the type of struct field %s`, fieldName)
+	}
+
+	// The name of the option that the field's value came from, if it was
+	// explicitly set
+	var setBy string
+	if l.optionIsSet(cliName) {
+		setBy = cliName
+	}
+
+	for _, alias := range aliases {
+		alias = strings.TrimSpace(alias)
+
+		var value interface{}
+
+		if l.cliValueIsSet(alias) {
+			value, err = l.cliValue(alias, fieldKind)
+		} else if l.File != nil {
+			if configFileValue, ok := l.File.Config[alias]; ok {
+				value, err = convertConfigFileValue(configFileValue, fieldKind)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// The old name wasn't used
+		if value == nil {
+			continue
+		}
+
+		l.deprecated(alias, cliName)
+
+		// Error if they specify the deprecated version and the new version
+		if setBy != "" {
+			return fmt.Errorf("Can't set config option `%s` because `%s` has already been set", alias, setBy)
+		}
+
+		err = reflections.SetField(l.Config, fieldName, value)
+		if err != nil {
+			return fmt.Errorf("Could not set value `%s` to field `%s` (%s)", value, fieldName, err)
+		}
+
+		setBy = alias
+	}
+
+	return nil
+}
+
+// deprecated warns about and records the use of a renamed config option
+func (l *Loader) deprecated(cliName string, renamedTo string) {
+	d := Deprecation{
+		Option:     cliName,
+		ReplacedBy: renamedTo,
+		Source:     SourceFlag,
+	}
+
+	// cli.Context#IsSet is also true for flags set via the environment, so
+	// check for that first
+	if envVar := l.cliEnvVar(cliName); envVar != "" && os.Getenv(envVar) != "" {
+		d.Source = SourceEnv
+		d.EnvVar = envVar
+	} else if !l.CLI.IsSet(cliName) && l.File != nil {
+		d.Source = SourceConfigFile
+		d.ConfigFile = l.File.Path
+	}
+
+	if renamedTo != "" {
+		l.Logger.Warn("The config option `%s` (set by %s) has been renamed to `%s`. Please update your configuration.", cliName, d.Where(), renamedTo)
+	}
+
+	l.Deprecations = append(l.Deprecations, d)
+}
+
+func (l Loader) commandName() string {
+	if l.CLI.Command.Name != "" {
+		return l.CLI.Command.FullName()
+	}
+	return l.CLI.App.Name
+}
+
+func (l Loader) cliValue(cliName string, fieldKind reflect.Kind) (interface{}, error) {
+	if fieldKind == reflect.String {
+		return l.CLI.String(cliName), nil
+	} else if fieldKind == reflect.Slice {
+		return l.CLI.StringSlice(cliName), nil
+	} else if fieldKind == reflect.Bool {
+		return l.CLI.Bool(cliName), nil
+	} else if fieldKind == reflect.Int {
+		return l.CLI.Int(cliName), nil
+	}
+
+	return nil, fmt.Errorf("Unable to handle type: %s", fieldKind)
+}
+
+func convertConfigFileValue(configFileValue string, fieldKind reflect.Kind) (interface{}, error) {
+	if fieldKind == reflect.String {
+		return configFileValue, nil
+	} else if fieldKind == reflect.Slice {
+		return strings.Split(configFileValue, ","), nil
+	} else if fieldKind == reflect.Bool {
+		value, _ := strconv.ParseBool(configFileValue)
+		return value, nil
+	} else if fieldKind == reflect.Int {
+		value, _ := strconv.Atoi(configFileValue)
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("Unable to convert string to type %s", fieldKind)
+}
+
+// optionIsSet returns whether the option was set on the command line, in the
+// environment or in the config file, rather than being left as the default
+func (l Loader) optionIsSet(cliName string) bool {
+	if l.cliValueIsSet(cliName) {
+		return true
+	}
+
+	if l.File != nil {
+		if _, ok := l.File.Config[cliName]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (l Loader) cliValueIsSet(cliName string) bool {
 	if l.CLI.IsSet(cliName) {
 		return true
-	} else {
-		// cli.Context#IsSet only checks to see if the command was set via the cli, not
-		// via the environment. So here we do some hacks to find out the name of the
-		// EnvVar, and return true if it was set.
-		for _, flag := range l.CLI.Command.Flags {
-			name, _ := reflections.GetField(flag, "Name")
-			envVar, _ := reflections.GetField(flag, "EnvVar")
-			if name == cliName && envVar != "" {
-				// Make sure envVar is a string
-				if envVarStr, ok := envVar.(string); ok {
-					envVarStr = strings.TrimSpace(string(envVarStr))
-
-					return os.Getenv(envVarStr) != ""
-				}
+	}
+
+	// cli.Context#IsSet only checks to see if the command was set via the cli, not
+	// via the environment. So here we do some hacks to find out the name of the
+	// EnvVar, and return true if it was set.
+	if envVar := l.cliEnvVar(cliName); envVar != "" {
+		return os.Getenv(envVar) != ""
+	}
+
+	return false
+}
+
+// cliEnvVar returns the name of the environment variable for a flag
+func (l Loader) cliEnvVar(cliName string) string {
+	for _, flag := range l.CLI.Command.Flags {
+		name, _ := reflections.GetField(flag, "Name")
+		envVar, _ := reflections.GetField(flag, "EnvVar")
+		if name == cliName {
+			// Make sure envVar is a string
+			if envVarStr, ok := envVar.(string); ok {
+				return strings.TrimSpace(envVarStr)
 			}
 		}
 	}
 
-	return false
+	return ""
 }
 
 func (l Loader) fieldValueIsEmpty(fieldName string) bool {
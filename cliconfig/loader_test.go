@@ -0,0 +1,187 @@
+package cliconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+type aliasedConfig struct {
+	Tags    []string `cli:"tags" normalize:"list" aliases:"meta-data"`
+	NoPTY   bool     `cli:"no-pty" aliases:"no-tty"`
+	Queue   string   `cli:"queue"`
+	Retired string   `cli:"retired" deprecated-and-renamed-to:"Queue"`
+}
+
+// The flags are created for each test, as cli.StringSlice values are
+// appended to when they're parsed
+func aliasedFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "config"},
+		cli.StringFlag{Name: "profile"},
+		cli.StringSliceFlag{Name: "tags", Value: &cli.StringSlice{}, EnvVar: "TEST_CLICONFIG_TAGS"},
+		cli.BoolFlag{Name: "no-pty"},
+		cli.StringFlag{Name: "queue"},
+		cli.StringSliceFlag{Name: "meta-data", Value: &cli.StringSlice{}, Hidden: true, EnvVar: "TEST_CLICONFIG_META_DATA"},
+		cli.BoolFlag{Name: "no-tty", Hidden: true},
+		cli.StringFlag{Name: "retired", Hidden: true},
+	}
+}
+
+func loadAliased(t *testing.T, args ...string) (aliasedConfig, *Loader, error) {
+	t.Helper()
+
+	var cfg aliasedConfig
+	var loader *Loader
+	var loadErr error
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{{
+		Name:  "test",
+		Flags: aliasedFlags(),
+		Action: func(c *cli.Context) {
+			loader = &Loader{CLI: c, Config: &cfg, Logger: logger.Discard}
+			loadErr = loader.Load()
+		},
+	}}
+
+	if err := app.Run(append([]string{"buildkite-agent", "test"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg, loader, loadErr
+}
+
+func TestLoaderAliasesFromFlags(t *testing.T) {
+	cfg, loader, err := loadAliased(t, "--meta-data", "a=b,c=d", "--no-tty")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"a=b", "c=d"}, cfg.Tags)
+	assert.True(t, cfg.NoPTY)
+	assert.Equal(t, []Deprecation{
+		{Option: "meta-data", ReplacedBy: "tags", Source: SourceFlag},
+		{Option: "no-tty", ReplacedBy: "no-pty", Source: SourceFlag},
+	}, loader.Deprecations)
+}
+
+func TestLoaderAliasesFromEnv(t *testing.T) {
+	os.Setenv("TEST_CLICONFIG_META_DATA", "old=true")
+	defer os.Unsetenv("TEST_CLICONFIG_META_DATA")
+
+	cfg, loader, err := loadAliased(t)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"old=true"}, cfg.Tags)
+	assert.Equal(t, []Deprecation{
+		{Option: "meta-data", ReplacedBy: "tags", Source: SourceEnv, EnvVar: "TEST_CLICONFIG_META_DATA"},
+	}, loader.Deprecations)
+}
+
+func TestLoaderAliasesFromConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "buildkite-agent.cfg")
+	if err := ioutil.WriteFile(path, []byte("no-tty=true\nretired=\"default\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, loader, err := loadAliased(t, "--config", path)
+	assert.NoError(t, err)
+
+	assert.True(t, cfg.NoPTY)
+	assert.Equal(t, "default", cfg.Queue)
+	assert.Equal(t, []Deprecation{
+		{Option: "no-tty", ReplacedBy: "no-pty", Source: SourceConfigFile, ConfigFile: path},
+		{Option: "retired", ReplacedBy: "queue", Source: SourceConfigFile, ConfigFile: path},
+	}, loader.Deprecations)
+}
+
+func TestLoaderAliasesErrorWhenBothNamesAreSet(t *testing.T) {
+	_, _, err := loadAliased(t, "--tags", "new", "--meta-data", "old")
+	assert.EqualError(t, err, "Can't set config option `meta-data` because `tags` has already been set")
+
+	os.Setenv("TEST_CLICONFIG_TAGS", "new")
+	defer os.Unsetenv("TEST_CLICONFIG_TAGS")
+
+	_, _, err = loadAliased(t, "--meta-data", "old")
+	assert.Error(t, err)
+}
+
+func TestLoaderWithoutAliasesHasNoDeprecations(t *testing.T) {
+	cfg, loader, err := loadAliased(t, "--tags", "a", "--no-pty")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"a"}, cfg.Tags)
+	assert.True(t, cfg.NoPTY)
+	assert.Empty(t, loader.Deprecations)
+}
+
+func TestLoaderWritesDeprecationReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deprecations.json")
+	os.Setenv(DeprecationReportEnv, path)
+	defer os.Unsetenv(DeprecationReportEnv)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := loadAliased(t, "--no-tty"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(report), []byte("\n"))
+	assert.Len(t, lines, 2)
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(lines[0], &line))
+	assert.Equal(t, "test", line["command"])
+	assert.Equal(t, "no-tty", line["option"])
+	assert.Equal(t, "no-pty", line["replaced_by"])
+	assert.Equal(t, "flag", line["source"])
+}
+
+func TestLoaderUsesProfileFromConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "buildkite-agent.cfg")
+	if err := ioutil.WriteFile(path, []byte("queue=default\ntags=os=linux\n[profile.gpu]\nqueue=gpu\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := loadAliased(t, "--config", path, "--profile", "gpu")
+	assert.NoError(t, err)
+	assert.Equal(t, "gpu", cfg.Queue)
+	assert.Equal(t, []string{"os=linux"}, cfg.Tags)
+
+	// The command line still takes precedence over the profile
+	cfg, _, err = loadAliased(t, "--config", path, "--profile", "gpu", "--queue", "cli")
+	assert.NoError(t, err)
+	assert.Equal(t, "cli", cfg.Queue)
+
+	_, _, err = loadAliased(t, "--profile", "gpu")
+	assert.Error(t, err)
+}
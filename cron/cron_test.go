@@ -0,0 +1,79 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParse(t *testing.T, spec string) *Schedule {
+	t.Helper()
+
+	s, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNext(t *testing.T) {
+	var tests = []struct {
+		Spec     string
+		From     string
+		Expected string
+	}{
+		{"* * * * *", "2019-03-04 10:15", "2019-03-04 10:16"},
+		{"*/15 * * * *", "2019-03-04 10:15", "2019-03-04 10:30"},
+		{"0 3 * * *", "2019-03-04 10:15", "2019-03-05 03:00"},
+		{"30 2 1 * *", "2019-12-04 10:15", "2020-01-01 02:30"},
+		{"0 0 * * 0", "2019-03-04 10:15", "2019-03-10 00:00"},
+		{"0 0 * * 7", "2019-03-04 10:15", "2019-03-10 00:00"},
+		{"0 9-17/4 * * 1-5", "2019-03-08 18:00", "2019-03-11 09:00"},
+		{"0,30 12 * * *", "2019-03-04 12:00", "2019-03-04 12:30"},
+		{"0 0 29 2 *", "2019-03-04 10:15", "2020-02-29 00:00"},
+		{"@hourly", "2019-03-04 10:15", "2019-03-04 11:00"},
+		{"@weekly", "2019-03-04 10:15", "2019-03-10 00:00"},
+
+		// When both day fields are restricted, either can match
+		{"0 0 13 * 5", "2019-03-04 10:15", "2019-03-08 00:00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Spec, func(t *testing.T) {
+			next := mustParse(t, test.Spec).Next(date(test.From))
+			assert.Equal(t, date(test.Expected), next)
+		})
+	}
+}
+
+func TestNextWithImpossibleSchedule(t *testing.T) {
+	assert.True(t, mustParse(t, "0 0 30 2 *").Next(date("2019-03-04 10:15")).IsZero())
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@fortnightly",
+	} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,78 @@
+package debugbundle
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CheckConnectivity checks that the agent API endpoint can be reached, step
+// by step so that a failure shows where things went wrong: looking up the
+// host, connecting to it, then making a request. It returns a report of each
+// step and how long it took, and stops at the first one that fails.
+func CheckConnectivity(endpoint string, timeout time.Duration) []byte {
+	var b bytes.Buffer
+
+	step := func(what string, f func() (string, error)) bool {
+		start := time.Now()
+		result, err := f()
+		took := time.Since(start).Round(time.Millisecond)
+
+		if err != nil {
+			fmt.Fprintf(&b, "%s: failed after %s: %v\n", what, took, err)
+			return false
+		}
+		fmt.Fprintf(&b, "%s: %s (%s)\n", what, result, took)
+		return true
+	}
+
+	fmt.Fprintf(&b, "Endpoint: %s\n", endpoint)
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		fmt.Fprintf(&b, "Invalid endpoint: %v\n", err)
+		return b.Bytes()
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	if !step("DNS lookup of "+u.Hostname(), func() (string, error) {
+		addrs, err := net.LookupHost(u.Hostname())
+		return strings.Join(addrs, ", "), err
+	}) {
+		return b.Bytes()
+	}
+
+	if !step("TCP connection to "+net.JoinHostPort(u.Hostname(), port), func() (string, error) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), timeout)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return "connected from " + conn.LocalAddr().String(), nil
+	}) {
+		return b.Bytes()
+	}
+
+	step("HTTP request to "+endpoint, func() (string, error) {
+		client := &http.Client{Timeout: timeout}
+		res, err := client.Get(endpoint)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		return res.Status, nil
+	})
+
+	return b.Bytes()
+}
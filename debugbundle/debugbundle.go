@@ -0,0 +1,204 @@
+// Package debugbundle collects what's useful for diagnosing a problem with an
+// agent into a single tarball, which can be attached to a support ticket
+package debugbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The most of a log file that's read to find its last lines
+const maxTailBytes = 8 * 1024 * 1024
+
+// Bundle writes files into a gzipped tarball, all in a directory named after
+// the bundle
+type Bundle struct {
+	dir  string
+	now  time.Time
+	gz   *gzip.Writer
+	tar  *tar.Writer
+	errs []string
+}
+
+// New returns a bundle that writes to w, with its files in a directory
+// called dir
+func New(w io.Writer, dir string) *Bundle {
+	gz := gzip.NewWriter(w)
+
+	return &Bundle{
+		dir: dir,
+		now: time.Now(),
+		gz:  gz,
+		tar: tar.NewWriter(gz),
+	}
+}
+
+// Add adds a file with the contents
+func (b *Bundle) Add(name string, data []byte) error {
+	if err := b.tar.WriteHeader(&tar.Header{
+		Name:    b.dir + "/" + name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	}); err != nil {
+		return err
+	}
+
+	_, err := b.tar.Write(data)
+	return err
+}
+
+// AddJSON adds a file with v encoded as indented JSON
+func (b *Bundle) AddJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.Add(name, append(data, '\n'))
+}
+
+// AddError records that something couldn't be collected, rather than
+// failing the whole bundle. Errors are written to errors.txt when the bundle
+// is closed.
+func (b *Bundle) AddError(what string, err error) {
+	b.errs = append(b.errs, fmt.Sprintf("%s: %v", what, err))
+}
+
+// Errors returns what couldn't be collected
+func (b *Bundle) Errors() []string {
+	return b.errs
+}
+
+// Close writes errors.txt if anything couldn't be collected, and finishes
+// the tarball. It doesn't close the writer underneath.
+func (b *Bundle) Close() error {
+	if len(b.errs) > 0 {
+		if err := b.Add("errors.txt", []byte(strings.Join(b.errs, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := b.tar.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
+
+// RedactConfig returns a copy of an agent's config with the values of
+// secrets, such as the registration token, replaced
+func RedactConfig(config map[string]string) map[string]string {
+	redacted := map[string]string{}
+
+	for key, value := range config {
+		if isSecretSetting(key, value) {
+			value = logger.RedactedValue
+		}
+		redacted[key] = value
+	}
+
+	return redacted
+}
+
+// ConfigSecrets returns the values of the secrets in an agent's config, so
+// that they can be redacted from anything else that's bundled
+func ConfigSecrets(config map[string]string) []string {
+	var secrets []string
+
+	for key, value := range config {
+		if isSecretSetting(key, value) {
+			secrets = append(secrets, value)
+		}
+	}
+
+	return secrets
+}
+
+// isSecretSetting treats settings like the environment variables they can
+// also be set with, so names ending in token, password or secret are secrets
+func isSecretSetting(key, value string) bool {
+	env := "BUILDKITE_AGENT_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+	return len(logger.SecretsFromEnvironment([]string{env + "=" + value})) > 0
+}
+
+// RedactSecrets returns data with any of the secrets in it replaced
+func RedactSecrets(data []byte, secrets []string) []byte {
+	var oldnew []string
+	for _, secret := range secrets {
+		if secret != "" {
+			oldnew = append(oldnew, secret, logger.RedactedValue)
+		}
+	}
+
+	if len(oldnew) == 0 {
+		return data
+	}
+	return []byte(strings.NewReplacer(oldnew...).Replace(string(data)))
+}
+
+// FormatConfig formats config like an agent config file, with the settings
+// sorted by name
+func FormatConfig(config map[string]string) []byte {
+	var keys []string
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%q\n", key, config[key])
+	}
+	return b.Bytes()
+}
+
+// Tail returns the last n lines of a file, reading at most the last 8MB of
+// it
+func Tail(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := info.Size() - maxTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+
+	data := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// A partial first line is dropped, unless it's all there is
+	if offset > 0 {
+		if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+			data = data[idx+1:]
+		}
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return bytes.Join(lines, nil), nil
+}
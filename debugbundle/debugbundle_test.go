@@ -0,0 +1,150 @@
+package debugbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readBundle(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(contents)
+	}
+
+	return files
+}
+
+func TestBundle(t *testing.T) {
+	var buf bytes.Buffer
+	b := New(&buf, "debug")
+
+	assert.NoError(t, b.Add("version.txt", []byte("3.0.0\n")))
+	assert.NoError(t, b.AddJSON("jobs.json", []string{"llamas"}))
+	b.AddError("connectivity", errors.New("no route to host"))
+	assert.NoError(t, b.Close())
+
+	assert.Equal(t, map[string]string{
+		"debug/version.txt": "3.0.0\n",
+		"debug/jobs.json":   "[\n  \"llamas\"\n]\n",
+		"debug/errors.txt":  "connectivity: no route to host\n",
+	}, readBundle(t, buf.Bytes()))
+}
+
+func TestRedactConfig(t *testing.T) {
+	config := RedactConfig(map[string]string{
+		"token":           "llamas-are-secret",
+		"name":            "my-agent",
+		"git-clone-flags": "-v",
+		"s3-secret":       "alpacas-too",
+	})
+
+	assert.Equal(t, "[REDACTED]", config["token"])
+	assert.Equal(t, "[REDACTED]", config["s3-secret"])
+	assert.Equal(t, "my-agent", config["name"])
+
+	assert.Equal(t, []string{"llamas-are-secret"}, ConfigSecrets(map[string]string{
+		"token": "llamas-are-secret",
+		"name":  "my-agent",
+	}))
+
+	assert.Equal(t, "git-clone-flags=\"-v\"\nname=\"my-agent\"\ns3-secret=\"[REDACTED]\"\ntoken=\"[REDACTED]\"\n", string(FormatConfig(config)))
+}
+
+func TestRedactSecrets(t *testing.T) {
+	assert.Equal(t, "registering with [REDACTED] as my-agent",
+		string(RedactSecrets([]byte("registering with llamas-are-secret as my-agent"), []string{"llamas-are-secret", ""})))
+}
+
+func TestTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debugbundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+	if err := ioutil.WriteFile(path, []byte("one\ntwo\nthree\nfour\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tail, err := Tail(path, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "three\nfour\n", string(tail))
+
+	tail, err = Tail(path, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\nthree\nfour\n", string(tail))
+}
+
+func TestTailOfLargeFileDropsPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debugbundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+	line := strings.Repeat("x", 1023) + "\n"
+	if err := ioutil.WriteFile(path, []byte("partial"+strings.Repeat(line, maxTailBytes/1024)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tail, err := Tail(path, maxTailBytes)
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(tail), "partial"))
+	assert.Equal(t, maxTailBytes/1024-1, strings.Count(string(tail), "\n"))
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	report := string(CheckConnectivity(server.URL, 5*time.Second))
+
+	assert.Contains(t, report, "DNS lookup of 127.0.0.1: 127.0.0.1")
+	assert.Contains(t, report, "TCP connection to "+strings.TrimPrefix(server.URL, "http://")+": connected")
+	assert.Contains(t, report, "HTTP request to "+server.URL+": 404 Not Found")
+}
+
+func TestCheckConnectivityStopsAtFirstFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	report := string(CheckConnectivity(url, 5*time.Second))
+
+	assert.Contains(t, report, "TCP connection to "+strings.TrimPrefix(url, "http://")+": failed")
+	assert.NotContains(t, report, "HTTP request")
+}
@@ -0,0 +1,95 @@
+package env
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var exportKeyRegex = regexp.MustCompile(`\A[a-zA-Z_][a-zA-Z0-9_]*\z`)
+
+// FromExports parses the environment variables that a hook exports by
+// writing them to a file, which looks like this:
+//
+//     # Comments and blank lines are ignored
+//     GOPATH=/tmp/go
+//     GREETING=hello "friends"
+//     RELEASE_NOTES<<EOF
+//     Fixed the llamas
+//     Added more alpacas
+//     EOF
+//
+// A KEY=VALUE line sets the key to the rest of the line exactly as it is, so
+// values never need quoting or escaping. A KEY<<DELIMITER line starts a
+// value spanning the following lines, up to a line that is just DELIMITER,
+// and the newline before the delimiter isn't part of the value. Windows line
+// endings are treated as plain newlines. Keys can be set more than once, and
+// the last value wins.
+func FromExports(r io.Reader) (*Environment, error) {
+	env := New()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	lineNumber := 0
+	scan := func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		lineNumber++
+		return strings.TrimSuffix(scanner.Text(), "\r"), true
+	}
+
+	for {
+		line, ok := scan()
+		if !ok {
+			break
+		}
+
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		equals := strings.Index(line, "=")
+		heredoc := strings.Index(line, "<<")
+
+		switch {
+		case heredoc >= 0 && (equals < 0 || heredoc < equals):
+			key, delimiter := line[:heredoc], line[heredoc+2:]
+			if !exportKeyRegex.MatchString(key) {
+				return nil, fmt.Errorf("line %d: invalid name %q", lineNumber, key)
+			}
+			if delimiter == "" {
+				return nil, fmt.Errorf("line %d: missing delimiter after %s<<", lineNumber, key)
+			}
+
+			start := lineNumber
+			var value []string
+			for {
+				valueLine, ok := scan()
+				if !ok {
+					return nil, fmt.Errorf("line %d: the value of %s is missing its closing %s line", start, key, delimiter)
+				}
+				if valueLine == delimiter {
+					break
+				}
+				value = append(value, valueLine)
+			}
+			env.Set(key, strings.Join(value, "\n"))
+
+		case equals >= 0:
+			key, value := line[:equals], line[equals+1:]
+			if !exportKeyRegex.MatchString(key) {
+				return nil, fmt.Errorf("line %d: invalid name %q", lineNumber, key)
+			}
+			env.Set(key, value)
+
+		default:
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE or KEY<<DELIMITER", lineNumber)
+		}
+	}
+
+	return env, scanner.Err()
+}
@@ -0,0 +1,54 @@
+package env
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromExports(t *testing.T) {
+	t.Parallel()
+
+	env, err := FromExports(strings.NewReader("# Comments are ignored\r\n" +
+		"GOPATH=/tmp/go\r\n" +
+		"\n" +
+		"GREETING=hello \"friends\" <<not a heredoc\n" +
+		"EMPTY=\n" +
+		"NOTES<<EOF\n" +
+		"Fixed the llamas\r\n" +
+		"\n" +
+		"  EOF but not quite\n" +
+		"EOF\n" +
+		"GOPATH=/tmp/go2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"GOPATH":   "/tmp/go2",
+		"GREETING": `hello "friends" <<not a heredoc`,
+		"EMPTY":    "",
+		"NOTES":    "Fixed the llamas\n\n  EOF but not quite",
+	}, env.ToMap())
+}
+
+func TestFromExportsErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		exports string
+		err     string
+	}{
+		{"LLAMAS\n", "line 1: expected KEY=VALUE or KEY<<DELIMITER"},
+		{"# ok\n1LLAMA=rock\n", `line 2: invalid name "1LLAMA"`},
+		{"MY LLAMA=rock\n", `line 1: invalid name "MY LLAMA"`},
+		{"NOTES<<\n", "line 1: missing delimiter after NOTES<<"},
+		{"A=b\nNOTES<<EOF\nunfinished\n", "line 2: the value of NOTES is missing its closing EOF line"},
+	} {
+		_, err := FromExports(strings.NewReader(tc.exports))
+		if assert.Error(t, err, tc.exports) {
+			assert.Equal(t, tc.err, err.Error())
+		}
+	}
+}
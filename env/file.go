@@ -0,0 +1,91 @@
+package env
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FromFile parses environment variables from a file of KEY=VALUE lines. See
+// FromEnvFile for the format.
+func FromFile(path string, queue string) (*Environment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env, err := FromEnvFile(f, queue)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return env, nil
+}
+
+// FromEnvFile parses environment variables from an env file, which looks
+// like this:
+//
+//     # Used by every job
+//     HTTP_PROXY=http://proxy.internal:3128
+//     export GOPROXY="https://goproxy.internal"
+//
+//     # Only used by jobs on the deploy queue, overriding the above
+//     [queue=deploy]
+//     HTTP_PROXY=http://deploy-proxy.internal:3128
+//
+// Values can be quoted, and double quoted values can contain escapes like \n.
+// Variables in a [queue=...] section are only included if it matches queue.
+func FromEnvFile(r io.Reader, queue string) (*Environment, error) {
+	env := New()
+	included := true
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			if !strings.HasPrefix(section, "queue=") {
+				return nil, fmt.Errorf("line %d: unknown section %q, expected [queue=name]", lineNumber, section)
+			}
+			included = strings.TrimPrefix(section, "queue=") == queue
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNumber)
+		}
+
+		value, err := unquote(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		if included {
+			env.Set(strings.TrimSpace(parts[0]), value)
+		}
+	}
+
+	return env, scanner.Err()
+}
+
+func unquote(value string) (string, error) {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			return strconv.Unquote(value)
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1], nil
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,65 @@
+package env
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testEnvFile = `
+# Used by every job
+HTTP_PROXY=http://proxy.internal:3128
+export GOPROXY="https://goproxy.internal"
+MESSAGE="hello\nworld"
+LITERAL='hello\nworld'
+
+[queue=deploy]
+HTTP_PROXY=http://deploy-proxy.internal:3128
+
+[queue=other]
+OTHER=true
+`
+
+func TestFromEnvFile(t *testing.T) {
+	t.Parallel()
+
+	env, err := FromEnvFile(strings.NewReader(testEnvFile), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"HTTP_PROXY": "http://proxy.internal:3128",
+		"GOPROXY":    "https://goproxy.internal",
+		"MESSAGE":    "hello\nworld",
+		"LITERAL":    `hello\nworld`,
+	}, env.ToMap())
+}
+
+func TestFromEnvFileWithQueueOverrides(t *testing.T) {
+	t.Parallel()
+
+	env, err := FromEnvFile(strings.NewReader(testEnvFile), "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := env.Get("HTTP_PROXY")
+	assert.Equal(t, "http://deploy-proxy.internal:3128", v)
+	assert.False(t, env.Exists("OTHER"))
+}
+
+func TestFromEnvFileErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, contents := range []string{
+		"NOT A VARIABLE",
+		"=value",
+		"[pipeline=llamas]",
+		`BAD="\q"`,
+	} {
+		_, err := FromEnvFile(strings.NewReader(contents), "default")
+		assert.Error(t, err, contents)
+	}
+}
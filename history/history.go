@@ -0,0 +1,228 @@
+// Package history stores a record of the recent jobs run on a host
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// DefaultMaxRecords is how many records are kept if no limit is configured
+const DefaultMaxRecords = 500
+
+// Record is a single job that was run by an agent
+type Record struct {
+	JobID      string        `json:"job_id"`
+	AgentName  string        `json:"agent_name,omitempty"`
+	Pipeline   string        `json:"pipeline,omitempty"`
+	Label      string        `json:"label,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Duration   time.Duration `json:"duration"`
+	ExitStatus string        `json:"exit_status"`
+
+	// The peak resident set size of the job process, in kilobytes
+	PeakRSS int64 `json:"peak_rss_kb,omitempty"`
+}
+
+// Store is a file of job records, one JSON document per line, that is safe to
+// share between agents on the same host
+type Store struct {
+	// The path to the file the records are stored in
+	Path string
+
+	// How many records to keep, the oldest are removed first
+	MaxRecords int
+
+	mu sync.Mutex
+}
+
+// NewStore returns a store for the given path
+func NewStore(path string) *Store {
+	return &Store{
+		Path:       path,
+		MaxRecords: DefaultMaxRecords,
+	}
+}
+
+// Add appends a record to the store, removing the oldest records if there are
+// more than MaxRecords
+func (s *Store) Add(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	records = append(records, r)
+	if s.MaxRecords > 0 && len(records) > s.MaxRecords {
+		records = records[len(records)-s.MaxRecords:]
+	}
+
+	return s.write(records)
+}
+
+// Recent returns up to n of the most recent records, newest first. If n is
+// zero, all records are returned.
+func (s *Store) Recent(n int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].FinishedAt.After(records[j].FinishedAt)
+	})
+
+	if n > 0 && len(records) > n {
+		records = records[:n]
+	}
+
+	return records, nil
+}
+
+// SuggestedTimeout returns a suggested timeout for jobs of the given pipeline
+// and label based on how long previous successful runs took, or zero if there
+// isn't enough history to make a suggestion
+func (s *Store) SuggestedTimeout(pipeline, label string) (time.Duration, error) {
+	records, err := s.Recent(0)
+	if err != nil {
+		return 0, err
+	}
+
+	var durations []time.Duration
+	for _, r := range records {
+		if r.Pipeline == pipeline && r.Label == label && r.ExitStatus == "0" {
+			durations = append(durations, r.Duration)
+		}
+	}
+
+	return suggestTimeout(durations), nil
+}
+
+// suggestTimeout is double the 95th percentile duration, rounded up to the
+// nearest minute. At least 3 durations are needed for a suggestion.
+func suggestTimeout(durations []time.Duration) time.Duration {
+	if len(durations) < 3 {
+		return 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	idx := int(float64(len(durations))*0.95+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+
+	suggested := durations[idx] * 2
+	if rounded := suggested.Truncate(time.Minute); rounded < suggested {
+		suggested = rounded + time.Minute
+	}
+
+	return suggested
+}
+
+func (s *Store) read() ([]Record, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		// Skip lines we can't parse, rather than losing the whole history
+		if err := json.Unmarshal(scanner.Bytes(), &r); err == nil {
+			records = append(records, r)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+func (s *Store) write(records []Record) error {
+	dir := filepath.Dir(s.Path)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.Path))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// lock acquires a lock file next to the store, so that agents in other
+// processes don't clobber each others records
+func (s *Store) lock() (func(), error) {
+	absPath, err := filepath.Abs(s.Path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(absPath), 0777); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockfile.New(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = lock.TryLock()
+		if err == nil {
+			return func() { _ = lock.Unlock() }, nil
+		}
+		if attempt >= 50 {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,61 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreKeepsMostRecentRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewStore(filepath.Join(dir, "jobs.jsonl"))
+	store.MaxRecords = 3
+
+	started := time.Now().Add(-time.Hour)
+	for i, id := range []string{"a", "b", "c", "d"} {
+		err := store.Add(Record{
+			JobID:      id,
+			StartedAt:  started,
+			FinishedAt: started.Add(time.Duration(i) * time.Minute),
+			ExitStatus: "0",
+		})
+		assert.NoError(t, err)
+	}
+
+	records, err := store.Recent(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "d", records[0].JobID)
+	assert.Equal(t, "c", records[1].JobID)
+
+	records, err = store.Recent(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+}
+
+func TestStoreWithNoFile(t *testing.T) {
+	store := NewStore(filepath.Join(os.TempDir(), "does-not-exist", "jobs.jsonl"))
+
+	records, err := store.Recent(10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestSuggestTimeout(t *testing.T) {
+	assert.Equal(t, time.Duration(0), suggestTimeout([]time.Duration{time.Minute, time.Minute}))
+
+	assert.Equal(t, 21*time.Minute, suggestTimeout([]time.Duration{
+		5 * time.Minute,
+		10*time.Minute + 30*time.Second,
+		4 * time.Minute,
+	}))
+}
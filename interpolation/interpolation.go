@@ -0,0 +1,163 @@
+// Package interpolation expands environment variables in strings like a
+// shell would, for pipelines and anything else that's given variables to
+// expand
+package interpolation
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Env is where variables are looked up, such as an *env.Environment
+type Env interface {
+	Get(key string) (string, bool)
+}
+
+// Interpolator expands variables in strings. It supports:
+//
+//     $VAR or ${VAR}       the value of VAR
+//     ${VAR:-default}      default if VAR is unset or empty
+//     ${VAR-default}       default if VAR is unset
+//     ${VAR:?message}      an error with message if VAR is unset or empty
+//     ${VAR?message}       an error with message if VAR is unset
+//     ${VAR:offset:length} a substring of VAR, where negative numbers count
+//                          from the end (the length is optional)
+//     $$ or \$             a literal $
+//
+// Defaults and messages can have variables in them too. $( is left alone, so
+// that shell command substitution is kept for the shell.
+type Interpolator struct {
+	Env Env
+
+	// By default, an unset variable without a default is an error, rather
+	// than silently expanding to nothing. This expands them to nothing
+	// instead, like a shell does.
+	AllowUndefined bool
+}
+
+// Interpolate expands the variables in s, with unset variables being an
+// error unless they have a default
+func Interpolate(env Env, s string) (string, error) {
+	return Interpolator{Env: env}.Interpolate(s)
+}
+
+// Interpolate expands the variables in s
+func (i Interpolator) Interpolate(s string) (string, error) {
+	expr, err := newParser(s).parse()
+	if err != nil {
+		return "", err
+	}
+	return i.expand(expr)
+}
+
+func (i Interpolator) get(name string) (string, bool) {
+	if i.Env == nil {
+		return "", false
+	}
+	return i.Env.Get(name)
+}
+
+func (i Interpolator) expand(expr expression) (string, error) {
+	var b bytes.Buffer
+
+	for _, item := range expr {
+		if item.expansion == nil {
+			b.WriteString(item.text)
+			continue
+		}
+
+		value, err := i.expandVariable(item.expansion)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+
+	return b.String(), nil
+}
+
+func (i Interpolator) expandVariable(e *expansion) (string, error) {
+	value, ok := i.get(e.name)
+
+	switch e.operator {
+	case "":
+		if !ok && !i.AllowUndefined {
+			return "", undefinedError(e.name)
+		}
+		return value, nil
+
+	case ":-":
+		if value == "" {
+			return i.expand(e.word)
+		}
+		return value, nil
+
+	case "-":
+		if !ok {
+			return i.expand(e.word)
+		}
+		return value, nil
+
+	case ":?", "?":
+		if ok && (value != "" || e.operator == "?") {
+			return value, nil
+		}
+
+		message, err := i.expand(e.word)
+		if err != nil {
+			return "", err
+		}
+		if message == "" && e.operator == ":?" {
+			message = "not set or empty"
+		} else if message == "" {
+			message = "not set"
+		}
+		return "", fmt.Errorf("$%s: %s", e.name, message)
+
+	case ":":
+		if !ok && !i.AllowUndefined {
+			return "", undefinedError(e.name)
+		}
+		return substring(value, e.offset, e.length, e.hasLength), nil
+	}
+
+	return "", fmt.Errorf("Unknown operator %q in the expansion of $%s", e.operator, e.name)
+}
+
+func undefinedError(name string) error {
+	return fmt.Errorf("$%s is not set. Use ${%s:-} to default it to nothing, or $$%s to leave it to be expanded when the job runs", name, name, name)
+}
+
+// substring returns part of s like bash does, where negative offsets and
+// lengths count back from the end and anything out of range is truncated
+func substring(s string, offset, length int, hasLength bool) string {
+	from := offset
+	if from < 0 {
+		from += len(s)
+	}
+	if from < 0 {
+		from = 0
+	}
+	if from > len(s) {
+		from = len(s)
+	}
+
+	if !hasLength {
+		return s[from:]
+	}
+
+	to := length
+	if to >= 0 {
+		to += from
+	} else {
+		to += len(s)
+		if to < from {
+			to = from
+		}
+	}
+	if to > len(s) {
+		to = len(s)
+	}
+
+	return s[from:to]
+}
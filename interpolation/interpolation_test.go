@@ -0,0 +1,121 @@
+package interpolation
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+)
+
+func TestInterpolate(t *testing.T) {
+	environ := env.FromSlice([]string{
+		"LLAMAS=llamas",
+		"EMPTY=",
+		"NUMBERS=0123456789",
+		"_PRIVATE=private",
+	})
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{"Hello $LLAMAS!", "Hello llamas!"},
+		{"Hello ${LLAMAS}!", "Hello llamas!"},
+		{"$_PRIVATE", "private"},
+		{"${EMPTY}", ""},
+		{"${MISSING:-alpacas}", "alpacas"},
+		{"${EMPTY:-alpacas}", "alpacas"},
+		{"${LLAMAS:-alpacas}", "llamas"},
+		{"${MISSING-alpacas}", "alpacas"},
+		{"${EMPTY-alpacas}", ""},
+		{"${MISSING:-}", ""},
+		{"${MISSING:-${LLAMAS} and alpacas}", "llamas and alpacas"},
+		{"${MISSING:-${ALSO_MISSING:-nested}}", "nested"},
+		{"${LLAMAS:?must be set}", "llamas"},
+		{"${EMPTY?must be set}", ""},
+		{"${NUMBERS:7}", "789"},
+		{"${NUMBERS:2:3}", "234"},
+		{"${NUMBERS:-3}", "789"},
+		{"${NUMBERS:-3:2}", "78"},
+		{"${NUMBERS:2:-2}", "234567"},
+		{"${NUMBERS:20}", ""},
+		{"$$LLAMAS", "$LLAMAS"},
+		{`\$LLAMAS`, "$LLAMAS"},
+		{"$${LLAMAS}", "${LLAMAS}"},
+		{`\\`, `\\`},
+		{"$(echo hello)", "$(echo hello)"},
+		{"costs 5$", "costs 5$"},
+		{"🦙 $LLAMAS 🦙", "🦙 llamas 🦙"},
+	} {
+		actual, err := Interpolate(environ, tc.input)
+		if err != nil {
+			t.Errorf("Interpolating %q failed: %v", tc.input, err)
+			continue
+		}
+		if actual != tc.expected {
+			t.Errorf("Interpolating %q gave %q, expected %q", tc.input, actual, tc.expected)
+		}
+	}
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	environ := env.FromSlice([]string{
+		"LLAMAS=llamas",
+		"EMPTY=",
+	})
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{"$MISSING", "$MISSING is not set. Use ${MISSING:-} to default it to nothing, or $$MISSING to leave it to be expanded when the job runs"},
+		{"${MISSING}", "$MISSING is not set. Use ${MISSING:-} to default it to nothing, or $$MISSING to leave it to be expanded when the job runs"},
+		{"${MISSING:0:2}", "$MISSING is not set. Use ${MISSING:-} to default it to nothing, or $$MISSING to leave it to be expanded when the job runs"},
+		{"${MISSING:-$ALSO_MISSING}", "$ALSO_MISSING is not set. Use ${ALSO_MISSING:-} to default it to nothing, or $$ALSO_MISSING to leave it to be expanded when the job runs"},
+		{"${MISSING?}", "$MISSING: not set"},
+		{"${MISSING?needs to be set for $LLAMAS}", "$MISSING: needs to be set for llamas"},
+		{"${EMPTY:?}", "$EMPTY: not set or empty"},
+		{"${EMPTY:?can't be empty}", "$EMPTY: can't be empty"},
+		{"${LLAMAS", "Expected the expansion of $LLAMAS to end with }"},
+		{"${LLAMAS:-alpacas", "Expected the expansion of $LLAMAS to end with }"},
+		{"${LLAMAS/a/b}", "Expected an operator in the expansion of $LLAMAS, got /"},
+		{"${LLAMAS:x}", `Unable to parse the offset of $LLAMAS: strconv.Atoi: parsing "x": invalid syntax`},
+		{"$5", "Expected a variable name after $, got 5. Use $$ for a literal $"},
+	} {
+		_, err := Interpolate(environ, tc.input)
+		if err == nil {
+			t.Errorf("Interpolating %q should have failed", tc.input)
+		} else if err.Error() != tc.expected {
+			t.Errorf("Interpolating %q failed with %q, expected %q", tc.input, err, tc.expected)
+		}
+	}
+}
+
+func TestInterpolateAllowingUndefinedVariables(t *testing.T) {
+	i := Interpolator{
+		Env:            env.FromSlice([]string{"LLAMAS=llamas"}),
+		AllowUndefined: true,
+	}
+
+	actual, err := i.Interpolate("$LLAMAS and ${ALPACAS}${MISSING:0:2}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != "llamas and " {
+		t.Fatalf("Unexpected: %q", actual)
+	}
+
+	// Required variables are still required
+	if _, err := i.Interpolate("${ALPACAS?}"); err == nil {
+		t.Fatal("Expected $ALPACAS to be required")
+	}
+}
+
+func TestInterpolateWithoutAnEnvironment(t *testing.T) {
+	actual, err := Interpolate(nil, "${LLAMAS:-alpacas}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != "alpacas" {
+		t.Fatalf("Unexpected: %q", actual)
+	}
+}
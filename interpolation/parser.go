@@ -0,0 +1,255 @@
+package interpolation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This is a recursive descent parser, as expansions can be nested, like
+// ${LLAMAS:-${ALPACAS:-none}}. The grammar is:
+//
+//     EscapedBackslash = "\\"
+//     EscapedDollar    = "\$" | "$$"
+//     Identifier       = ( letter | "_" ) { letter | digit | "_" }
+//     Expansion        = "$" ( Identifier | Brace )
+//     Brace            = "{" Identifier [ Operation ] "}"
+//     Operation        = ( ":-" | "-" | ":?" | "?" ) Expression | Substring
+//     Substring        = ":" number [ ":" number ]
+//     Text             = { EscapedBackslash | EscapedDollar | "$(" | any character except "$" }
+//     Expression       = { Text | Expansion }
+
+const eof = -1
+
+// expression is a sequence of text and expansions
+type expression []item
+
+// item is either text or an expansion, never both
+type item struct {
+	text      string
+	expansion *expansion
+}
+
+// expansion is a variable to expand, and how to expand it
+type expansion struct {
+	name     string
+	operator string
+
+	// The default or error message, for the :-, -, :? and ? operators
+	word expression
+
+	// The substring, for the : operator
+	offset    int
+	length    int
+	hasLength bool
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func newParser(s string) *parser {
+	return &parser{input: s}
+}
+
+func (p *parser) parse() (expression, error) {
+	return p.parseExpression(false)
+}
+
+// parseExpression parses text and expansions up to the end of the input, or
+// the closing brace of the expansion it's in
+func (p *parser) parseExpression(inBrace bool) (expression, error) {
+	var expr expression
+
+	for {
+		c := p.peek()
+		if c == eof || (inBrace && c == '}') {
+			return expr, nil
+		}
+
+		rest := p.input[p.pos:]
+
+		switch {
+		case strings.HasPrefix(rest, `\\`):
+			// Escaped backslashes are kept as they are
+			p.pos += 2
+			expr = append(expr, item{text: `\\`})
+
+		case strings.HasPrefix(rest, `\$`), strings.HasPrefix(rest, `$$`):
+			p.pos += 2
+			expr = append(expr, item{text: `$`})
+
+		case strings.HasPrefix(rest, `$(`):
+			// Command substitution is left for the shell
+			p.pos += 2
+			expr = append(expr, item{text: `$(`})
+
+		case c == '$' && len(rest) > 1:
+			e, err := p.parseExpansion()
+			if err != nil {
+				return nil, err
+			}
+			expr = append(expr, item{expansion: e})
+
+		default:
+			// Take the character, and as much text after it as possible
+			start := p.pos
+			p.next()
+			p.scanUntil(func(r rune) bool {
+				return r == '$' || r == '\\' || (inBrace && r == '}')
+			})
+			expr = append(expr, item{text: p.input[start:p.pos]})
+		}
+	}
+}
+
+func (p *parser) parseExpansion() (*expansion, error) {
+	p.next() // $
+
+	if p.peek() == '{' {
+		return p.parseBraceExpansion()
+	}
+
+	name, err := p.scanIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	return &expansion{name: name}, nil
+}
+
+func (p *parser) parseBraceExpansion() (*expansion, error) {
+	p.next() // {
+
+	name, err := p.scanIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	e := &expansion{name: name}
+
+	switch c := p.next(); c {
+	case '}':
+		return e, nil
+
+	case ':':
+		switch p.peek() {
+		case '-':
+			p.next()
+
+			// ${VAR:-1} is the last character rather than a default, like
+			// in bash
+			if unicode.IsDigit(p.peek()) {
+				if err := p.parseSubstring(e); err != nil {
+					return nil, err
+				}
+				e.offset = -e.offset
+				break
+			}
+
+			e.operator = ":-"
+			if e.word, err = p.parseExpression(true); err != nil {
+				return nil, err
+			}
+
+		case '?':
+			p.next()
+			e.operator = ":?"
+			if e.word, err = p.parseExpression(true); err != nil {
+				return nil, err
+			}
+
+		default:
+			if err := p.parseSubstring(e); err != nil {
+				return nil, err
+			}
+		}
+
+	case '-', '?':
+		e.operator = string(c)
+		if e.word, err = p.parseExpression(true); err != nil {
+			return nil, err
+		}
+
+	case eof:
+		return nil, fmt.Errorf("Expected the expansion of $%s to end with }", name)
+
+	default:
+		return nil, fmt.Errorf("Expected an operator in the expansion of $%s, got %c", name, c)
+	}
+
+	if c := p.next(); c != '}' {
+		return nil, fmt.Errorf("Expected the expansion of $%s to end with }", name)
+	}
+
+	return e, nil
+}
+
+func (p *parser) parseSubstring(e *expansion) error {
+	e.operator = ":"
+
+	offset := p.scanUntil(func(r rune) bool { return r == ':' || r == '}' })
+	n, err := strconv.Atoi(strings.TrimSpace(offset))
+	if err != nil {
+		return fmt.Errorf("Unable to parse the offset of $%s: %v", e.name, err)
+	}
+	e.offset = n
+
+	if p.peek() != ':' {
+		return nil
+	}
+	p.next()
+
+	length := p.scanUntil(func(r rune) bool { return r == '}' })
+	n, err = strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		return fmt.Errorf("Unable to parse the length of $%s: %v", e.name, err)
+	}
+	e.length = n
+	e.hasLength = true
+
+	return nil
+}
+
+func (p *parser) scanIdentifier() (string, error) {
+	if c := p.peek(); !unicode.IsLetter(c) && c != '_' {
+		if c == eof {
+			return "", fmt.Errorf("Expected a variable name after $")
+		}
+		return "", fmt.Errorf("Expected a variable name after $, got %c. Use $$ for a literal $", c)
+	}
+
+	return p.scanUntil(func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	}), nil
+}
+
+func (p *parser) scanUntil(f func(rune) bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c, size := utf8.DecodeRuneInString(p.input[p.pos:])
+		if c == utf8.RuneError || f(c) {
+			break
+		}
+		p.pos += size
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *parser) next() rune {
+	if p.pos >= len(p.input) {
+		return eof
+	}
+	c, size := utf8.DecodeRuneInString(p.input[p.pos:])
+	p.pos += size
+	return c
+}
+
+func (p *parser) peek() rune {
+	if p.pos >= len(p.input) {
+		return eof
+	}
+	c, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	return c
+}
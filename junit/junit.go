@@ -0,0 +1,310 @@
+// Package junit parses JUnit XML reports and summarises their failures
+package junit
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TestCase is a single test case from a JUnit report
+type TestCase struct {
+	Name      string    `xml:"name,attr"`
+	Classname string    `xml:"classname,attr"`
+	File      string    `xml:"file,attr"`
+	Failure   *Failure  `xml:"failure"`
+	Error     *Failure  `xml:"error"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+// Failure is the failure or error element of a test case
+type Failure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// TestSuite is a collection of test cases, which may contain nested suites
+type TestSuite struct {
+	Name       string      `xml:"name,attr"`
+	TestCases  []TestCase  `xml:"testcase"`
+	TestSuites []TestSuite `xml:"testsuite"`
+}
+
+// Parse reads a JUnit XML report, which can either have a <testsuites> or a
+// single <testsuite> as its root element, and returns the test suites in it
+func Parse(r io.Reader) ([]TestSuite, error) {
+	var root struct {
+		XMLName xml.Name
+		TestSuite
+	}
+
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	switch root.XMLName.Local {
+	case "testsuites":
+		return root.TestSuites, nil
+	case "testsuite":
+		return []TestSuite{root.TestSuite}, nil
+	default:
+		return nil, fmt.Errorf("Unexpected root element <%s>, expected <testsuites> or <testsuite>", root.XMLName.Local)
+	}
+}
+
+// FailedTest is a failing test, deduplicated across all of the reports it
+// appeared in
+type FailedTest struct {
+	Suite     string
+	Classname string
+	Name      string
+	Failure   Failure
+
+	// How many times the test failed, and passed, across all reports
+	Failures int
+	Passes   int
+
+	// Whether the test is in the quarantine list
+	Quarantined bool
+}
+
+// Flaky returns whether the test both failed and passed, such as when it was
+// retried or run on multiple shards
+func (f *FailedTest) Flaky() bool {
+	return f.Passes > 0
+}
+
+// Summary is the collected failures of a number of JUnit reports
+type Summary struct {
+	Tests  int
+	Failed []*FailedTest
+}
+
+// Summarize collects the failures of the given test suites, deduplicating
+// tests that appear more than once (such as when reports from several shards
+// or retries are combined)
+func Summarize(suites []TestSuite) *Summary {
+	summary := &Summary{}
+	seen := map[string]*FailedTest{}
+	passes := map[string]int{}
+
+	var walk func(suites []TestSuite)
+	walk = func(suites []TestSuite) {
+		for _, suite := range suites {
+			for _, tc := range suite.TestCases {
+				if tc.Skipped != nil {
+					continue
+				}
+
+				key := strings.Join([]string{suite.Name, tc.Classname, tc.Name}, "\x00")
+
+				failure := tc.Failure
+				if failure == nil {
+					failure = tc.Error
+				}
+
+				if failure == nil {
+					passes[key]++
+					continue
+				}
+
+				if f, ok := seen[key]; ok {
+					f.Failures++
+					continue
+				}
+
+				summary.Tests++
+				f := &FailedTest{
+					Suite:     suite.Name,
+					Classname: tc.Classname,
+					Name:      tc.Name,
+					Failure:   *failure,
+					Failures:  1,
+				}
+				seen[key] = f
+				summary.Failed = append(summary.Failed, f)
+			}
+			walk(suite.TestSuites)
+		}
+	}
+	walk(suites)
+
+	for key, count := range passes {
+		if f, ok := seen[key]; ok {
+			f.Passes = count
+		} else {
+			summary.Tests++
+		}
+	}
+
+	sort.SliceStable(summary.Failed, func(i, j int) bool {
+		return summary.Failed[i].Suite < summary.Failed[j].Suite
+	})
+
+	return summary
+}
+
+// Markdown renders the failures as an annotation body, grouped by test suite
+// with the details of each failure in a collapsible section
+func (s *Summary) Markdown() string {
+	var b strings.Builder
+
+	var failed, flaky, quarantined []*FailedTest
+	for _, f := range s.Failed {
+		switch {
+		case f.Quarantined:
+			quarantined = append(quarantined, f)
+		case f.Flaky():
+			flaky = append(flaky, f)
+		default:
+			failed = append(failed, f)
+		}
+	}
+
+	if len(quarantined) > 0 {
+		fmt.Fprintf(&b, "**%s**, **%s** and **%s** in %s\n",
+			pluralize(len(failed), "failure", "failures"),
+			pluralize(len(flaky), "flaky test", "flaky tests"),
+			pluralize(len(quarantined), "quarantined failure", "quarantined failures"),
+			pluralize(s.Tests, "test", "tests"))
+	} else {
+		fmt.Fprintf(&b, "**%s** and **%s** in %s\n",
+			pluralize(len(failed), "failure", "failures"),
+			pluralize(len(flaky), "flaky test", "flaky tests"),
+			pluralize(s.Tests, "test", "tests"))
+	}
+
+	writeGroups(&b, failed)
+
+	if len(flaky) > 0 {
+		fmt.Fprintf(&b, "\n### Flaky tests\n\n")
+		fmt.Fprintf(&b, "These tests failed, but also passed in another run.\n")
+		writeGroups(&b, flaky)
+	}
+
+	if len(quarantined) > 0 {
+		fmt.Fprintf(&b, "\n### Quarantined tests\n\n")
+		fmt.Fprintf(&b, "These tests failed, but are quarantined so didn't fail the build.\n")
+		writeGroups(&b, quarantined)
+	}
+
+	return b.String()
+}
+
+func writeGroups(b *strings.Builder, tests []*FailedTest) {
+	var suite string
+	for i, f := range tests {
+		if i == 0 || f.Suite != suite {
+			suite = f.Suite
+			fmt.Fprintf(b, "\n#### %s\n", html.EscapeString(suiteName(suite)))
+		}
+
+		name := f.Name
+		if f.Classname != "" {
+			name = f.Classname + " " + f.Name
+		}
+
+		fmt.Fprintf(b, "\n<details>\n<summary><code>%s</code>", html.EscapeString(name))
+		if f.Failures > 1 || f.Passes > 0 {
+			fmt.Fprintf(b, " (failed %d of %d runs)", f.Failures, f.Failures+f.Passes)
+		}
+		fmt.Fprintf(b, "</summary>\n\n")
+
+		details := strings.TrimSpace(f.Failure.Body)
+		if message := strings.TrimSpace(f.Failure.Message); message != "" && !strings.Contains(details, message) {
+			details = strings.TrimSpace(message + "\n\n" + details)
+		}
+
+		fmt.Fprintf(b, "<pre><code>%s</code></pre>\n\n</details>\n", html.EscapeString(details))
+	}
+}
+
+func suiteName(name string) string {
+	if name == "" {
+		return "Unnamed test suite"
+	}
+	return name
+}
+
+func pluralize(count int, singular string, plural string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, singular)
+	}
+	return fmt.Sprintf("%d %s", count, plural)
+}
+
+// Quarantine is a list of tests whose failures shouldn't fail the build, such
+// as known flaky tests that are being fixed
+type Quarantine struct {
+	patterns []string
+}
+
+// ParseQuarantine reads a quarantine list, which has one test per line. Tests
+// can be given as "Name", "Classname.Name" or "Suite/Classname.Name", and may
+// use * as a wildcard. Blank lines and lines starting with # are ignored.
+func ParseQuarantine(r io.Reader) (*Quarantine, error) {
+	q := &Quarantine{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("Invalid quarantine pattern %q: %v", line, err)
+		}
+		q.patterns = append(q.patterns, line)
+	}
+
+	return q, scanner.Err()
+}
+
+// Matches returns whether the failed test is quarantined
+func (q *Quarantine) Matches(f *FailedTest) bool {
+	names := []string{f.Name}
+	if f.Classname != "" {
+		names = append(names, f.Classname+"."+f.Name)
+	}
+	for _, name := range names {
+		names = append(names, f.Suite+"/"+name)
+	}
+
+	for _, pattern := range q.patterns {
+		for _, name := range names {
+			if pattern == name {
+				return true
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Quarantine marks the failures that match the quarantine list
+func (s *Summary) Quarantine(q *Quarantine) {
+	for _, f := range s.Failed {
+		f.Quarantined = q.Matches(f)
+	}
+}
+
+// Blocking returns the failures that should fail the build, which are those
+// that aren't flaky or quarantined
+func (s *Summary) Blocking() []*FailedTest {
+	var blocking []*FailedTest
+	for _, f := range s.Failed {
+		if !f.Flaky() && !f.Quarantined {
+			blocking = append(blocking, f)
+		}
+	}
+	return blocking
+}
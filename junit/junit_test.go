@@ -0,0 +1,99 @@
+package junit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const shard1 = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="models">
+    <testcase classname="User" name="validates email"/>
+    <testcase classname="User" name="saves &lt;name&gt;">
+      <failure message="expected true" type="AssertionError">expected true, got false
+  at user_test.rb:12</failure>
+    </testcase>
+    <testcase classname="Order" name="is flaky">
+      <failure message="timeout"/>
+    </testcase>
+    <testcase classname="Order" name="is skipped"><skipped/></testcase>
+  </testsuite>
+</testsuites>`
+
+const shard2 = `<testsuite name="models">
+  <testcase classname="User" name="saves &lt;name&gt;">
+    <error message="expected true">expected true, got false</error>
+  </testcase>
+  <testcase classname="Order" name="is flaky"/>
+</testsuite>`
+
+func TestParseAndSummarize(t *testing.T) {
+	suites1, err := Parse(strings.NewReader(shard1))
+	assert.NoError(t, err)
+
+	suites2, err := Parse(strings.NewReader(shard2))
+	assert.NoError(t, err)
+
+	summary := Summarize(append(suites1, suites2...))
+	assert.Equal(t, 3, summary.Tests)
+	assert.Equal(t, 2, len(summary.Failed))
+
+	assert.Equal(t, "saves <name>", summary.Failed[0].Name)
+	assert.Equal(t, 2, summary.Failed[0].Failures)
+	assert.False(t, summary.Failed[0].Flaky())
+
+	assert.Equal(t, "is flaky", summary.Failed[1].Name)
+	assert.True(t, summary.Failed[1].Flaky())
+
+	md := summary.Markdown()
+	assert.Contains(t, md, "**1 failure** and **1 flaky test** in 3 tests")
+	assert.Contains(t, md, "#### models")
+	assert.Contains(t, md, "<summary><code>User saves &lt;name&gt;</code> (failed 2 of 2 runs)</summary>")
+	assert.Contains(t, md, "<pre><code>expected true, got false\n  at user_test.rb:12</code></pre>")
+	assert.Contains(t, md, "### Flaky tests")
+	assert.Contains(t, md, "<pre><code>timeout</code></pre>")
+}
+
+func TestParseRejectsUnknownRootElement(t *testing.T) {
+	_, err := Parse(strings.NewReader(`<llamas/>`))
+	assert.Error(t, err)
+}
+
+func TestQuarantine(t *testing.T) {
+	suites, err := Parse(strings.NewReader(shard1))
+	assert.NoError(t, err)
+
+	q, err := ParseQuarantine(strings.NewReader("# Flaky, see #123\n\nmodels/User.saves *\n"))
+	assert.NoError(t, err)
+
+	summary := Summarize(suites)
+	assert.Equal(t, 2, len(summary.Blocking()))
+
+	summary.Quarantine(q)
+	assert.True(t, summary.Failed[0].Quarantined)
+	assert.False(t, summary.Failed[1].Quarantined)
+	assert.Equal(t, []*FailedTest{summary.Failed[1]}, summary.Blocking())
+
+	md := summary.Markdown()
+	assert.Contains(t, md, "**1 failure**, **0 flaky tests** and **1 quarantined failure** in 3 tests")
+	assert.Contains(t, md, "### Quarantined tests")
+}
+
+func TestQuarantineMatchesNames(t *testing.T) {
+	f := &FailedTest{Suite: "models", Classname: "User", Name: "saves"}
+
+	for _, pattern := range []string{"saves", "User.saves", "models/User.saves", "User.*", "models/*"} {
+		q, err := ParseQuarantine(strings.NewReader(pattern))
+		assert.NoError(t, err)
+		assert.True(t, q.Matches(f), pattern)
+	}
+
+	q, err := ParseQuarantine(strings.NewReader("Order.*"))
+	assert.NoError(t, err)
+	assert.False(t, q.Matches(f))
+
+	_, err = ParseQuarantine(strings.NewReader("[llamas"))
+	assert.Error(t, err)
+}
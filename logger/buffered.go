@@ -0,0 +1,160 @@
+package logger
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// BufferedWriter collects what's written to it and writes it on every
+// interval, rather than making a syscall for every line. Printers flush it
+// straight away for warnings and anything worse, so that they're never held
+// back.
+type BufferedWriter struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// NewBufferedWriter returns a writer that writes to w every interval, or
+// when its buffer fills up
+func NewBufferedWriter(w io.Writer, interval time.Duration) *BufferedWriter {
+	b := &BufferedWriter{
+		w:    bufio.NewWriterSize(w, 64*1024),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(b.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_ = b.Flush()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	return b
+}
+
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Once closed, lines are written straight through rather than being
+	// left in the buffer forever
+	if b.closed {
+		n, err := b.w.Write(p)
+		if err == nil {
+			err = b.w.Flush()
+		}
+		return n, err
+	}
+
+	return b.w.Write(p)
+}
+
+// Flush writes anything that's buffered
+func (b *BufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Flush()
+}
+
+// Close stops flushing periodically and writes anything that's buffered. It
+// doesn't close the writer underneath.
+func (b *BufferedWriter) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.stop)
+	<-b.done
+
+	return b.Flush()
+}
+
+// flushWriter flushes w if it buffers what's written to it
+func flushWriter(w io.Writer) error {
+	if b, ok := w.(*BufferedWriter); ok {
+		return b.Flush()
+	}
+	return nil
+}
+
+// closeWriter closes w if it buffers what's written to it. Other writers,
+// such as stderr, aren't the printer's to close.
+func closeWriter(w io.Writer) error {
+	if b, ok := w.(*BufferedWriter); ok {
+		return b.Close()
+	}
+	return nil
+}
+
+// BufferOutput makes the text and JSON printers of a logger buffer what they
+// write, flushing it every interval or as soon as a warning or anything worse
+// is logged. Printers added afterwards aren't buffered.
+func BufferOutput(l Logger, interval time.Duration) {
+	if consoleLogger, ok := l.(*ConsoleLogger); ok {
+		bufferPrinter(consoleLogger.Printer, interval)
+	}
+}
+
+func bufferPrinter(p Printer, interval time.Duration) {
+	switch p := p.(type) {
+	case *TextPrinter:
+		bufferWriter(&p.Writer, interval)
+	case *JSONPrinter:
+		bufferWriter(&p.Writer, interval)
+	case *RedactingPrinter:
+		bufferPrinter(p.Printer, interval)
+	case *Sink:
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		for _, printer := range p.printers {
+			bufferPrinter(printer, interval)
+		}
+	}
+}
+
+// bufferWriter swaps a printer's writer for a buffered one, while nothing is
+// printing to it
+func bufferWriter(w *io.Writer, interval time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := (*w).(*BufferedWriter); !ok {
+		*w = NewBufferedWriter(*w, interval)
+	}
+}
+
+// Flush writes anything a logger's printers have buffered
+func Flush(l Logger) error {
+	if consoleLogger, ok := l.(*ConsoleLogger); ok {
+		return consoleLogger.Printer.Flush()
+	}
+	return nil
+}
+
+// Close flushes a logger's printers and releases anything they hold, such as
+// a connection to syslog
+func Close(l Logger) error {
+	if consoleLogger, ok := l.(*ConsoleLogger); ok {
+		return consoleLogger.Printer.Close()
+	}
+	return nil
+}
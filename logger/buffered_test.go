@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that can be read while it's written to
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func TestBufferedOutputFlushesOnWarnings(t *testing.T) {
+	b := &lockedBuffer{}
+
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil)
+	l.SetLevel(DEBUG)
+	BufferOutput(l, time.Hour)
+	defer Close(l)
+
+	l.Debug("Llamas")
+	l.Info("Alpacas")
+	if b.String() != "" {
+		t.Fatalf("expected nothing to be written yet, got %q", b.String())
+	}
+
+	// Warnings are written straight away, along with everything before them
+	l.Warn("Camels")
+	if lines := strings.Split(strings.TrimSpace(b.String()), "\n"); len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", b.String())
+	}
+
+	l.Info("Vicuñas")
+	if err := Flush(l); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(b.String(), "Vicuñas\n") {
+		t.Fatalf("expected the line to be flushed, got %q", b.String())
+	}
+}
+
+func TestBufferedOutputFlushesPeriodically(t *testing.T) {
+	b := &lockedBuffer{}
+
+	l := NewConsoleLogger(NewJSONPrinter(b), nil)
+	l.SetLevel(INFO)
+	BufferOutput(l, 10*time.Millisecond)
+	defer Close(l)
+
+	l.Info("Llamas")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(b.String(), `"msg":"Llamas"`) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the line to be flushed, got %q", b.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClosingBufferedOutputWritesEverything(t *testing.T) {
+	b := &lockedBuffer{}
+
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil)
+	AddPrinter(l, NewJSONPrinter(b))
+	Redact(l, "secret-llama-token")
+	l.SetLevel(INFO)
+	BufferOutput(l, time.Hour)
+
+	l.Info("Llamas")
+	if err := Close(l); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(b.String(), "Llamas") != 2 {
+		t.Fatalf("expected both printers to be flushed, got %q", b.String())
+	}
+
+	// Once closed, lines aren't held back
+	l.Info("Alpacas")
+	if strings.Count(b.String(), "Alpacas") != 2 {
+		t.Fatalf("expected lines to be written straight through, got %q", b.String())
+	}
+}
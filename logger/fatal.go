@@ -0,0 +1,84 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// FatalHookTimeout is how long the hooks registered with OnFatal have to
+// finish, before the process exits anyway
+var FatalHookTimeout = 30 * time.Second
+
+var fatalHooks = struct {
+	sync.Mutex
+	hooks []*fatalHook
+	once  sync.Once
+	done  chan struct{}
+}{done: make(chan struct{})}
+
+type fatalHook struct {
+	fn func()
+}
+
+// OnFatal registers fn to run when a fatal message is logged, before the
+// process exits, for cleanup that deferred calls would otherwise have done,
+// such as disconnecting agents or killing child processes. Hooks run in the
+// reverse order they were registered in, like deferred calls. The returned
+// func unregisters fn, for once the cleanup isn't needed.
+func OnFatal(fn func()) func() {
+	hook := &fatalHook{fn: fn}
+
+	fatalHooks.Lock()
+	fatalHooks.hooks = append(fatalHooks.hooks, hook)
+	fatalHooks.Unlock()
+
+	return func() {
+		fatalHooks.Lock()
+		defer fatalHooks.Unlock()
+
+		for i, h := range fatalHooks.hooks {
+			if h == hook {
+				fatalHooks.hooks = append(fatalHooks.hooks[:i], fatalHooks.hooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// runFatalHooks runs the hooks registered with OnFatal. They're only ever run
+// once, so fatal messages logged by other goroutines while they're running
+// (or by the hooks themselves) wait for them to finish rather than running
+// them again. Hooks that panic or take longer than FatalHookTimeout don't
+// stop the process from exiting.
+func runFatalHooks() {
+	fatalHooks.Lock()
+	done := fatalHooks.done
+	fatalHooks.Unlock()
+
+	fatalHooks.once.Do(func() {
+		fatalHooks.Lock()
+		hooks := append([]*fatalHook{}, fatalHooks.hooks...)
+		fatalHooks.Unlock()
+
+		go func() {
+			defer close(done)
+
+			for i := len(hooks) - 1; i >= 0; i-- {
+				runFatalHook(hooks[i])
+			}
+		}()
+	})
+
+	select {
+	case <-done:
+	case <-time.After(FatalHookTimeout):
+	}
+}
+
+func runFatalHook(hook *fatalHook) {
+	defer func() {
+		_ = recover()
+	}()
+
+	hook.fn()
+}
@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func resetFatalHooks() {
+	fatalHooks.Lock()
+	defer fatalHooks.Unlock()
+
+	fatalHooks.hooks = nil
+	fatalHooks.once = sync.Once{}
+	fatalHooks.done = make(chan struct{})
+}
+
+func TestFatalRunsHooksInReverseBeforeExiting(t *testing.T) {
+	resetFatalHooks()
+	defer resetFatalHooks()
+
+	var calls []string
+	OnFatal(func() { calls = append(calls, "first") })
+	OnFatal(func() { panic("llamas") })
+	OnFatal(func() { calls = append(calls, "second") })
+	remove := OnFatal(func() { calls = append(calls, "removed") })
+	remove()
+
+	l := NewConsoleLogger(NewTextPrinter(&bytes.Buffer{}), func() {
+		calls = append(calls, "exit")
+	})
+	l.Fatal("Oh no")
+
+	if got := len(calls); got != 3 || calls[0] != "second" || calls[1] != "first" || calls[2] != "exit" {
+		t.Fatalf("bad calls, got %v", calls)
+	}
+}
+
+func TestFatalHooksOnlyRunOnce(t *testing.T) {
+	resetFatalHooks()
+	defer resetFatalHooks()
+
+	var mu sync.Mutex
+	runs, exits := 0, 0
+
+	OnFatal(func() {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	l := NewConsoleLogger(NewTextPrinter(&bytes.Buffer{}), func() {
+		mu.Lock()
+		exits++
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Fatal("Oh no")
+		}()
+	}
+	wg.Wait()
+
+	if runs != 1 || exits != 3 {
+		t.Fatalf("expected 1 run and 3 exits, got %d and %d", runs, exits)
+	}
+}
+
+func TestFatalHooksTimeOut(t *testing.T) {
+	resetFatalHooks()
+	defer resetFatalHooks()
+
+	timeout := FatalHookTimeout
+	FatalHookTimeout = 10 * time.Millisecond
+	defer func() { FatalHookTimeout = timeout }()
+
+	block := make(chan struct{})
+	defer close(block)
+	OnFatal(func() { <-block })
+
+	exited := make(chan struct{})
+	l := NewConsoleLogger(NewTextPrinter(&bytes.Buffer{}), func() { close(exited) })
+	go l.Fatal("Oh no")
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("expected to exit despite the hook blocking")
+	}
+}
@@ -0,0 +1,74 @@
+package logger
+
+import (
+	"strconv"
+	"time"
+)
+
+// A Field is a key/value pair logged along with a message. Text printers
+// show it as key=String(), and JSON printers use the key and value from
+// JSON() so that numbers and booleans aren't quoted.
+type Field interface {
+	Key() string
+	String() string
+	JSON() (string, interface{})
+}
+
+type field struct {
+	key       string
+	text      string
+	jsonKey   string
+	jsonValue interface{}
+}
+
+func (f field) Key() string {
+	return f.key
+}
+
+func (f field) String() string {
+	return f.text
+}
+
+func (f field) JSON() (string, interface{}) {
+	return f.jsonKey, f.jsonValue
+}
+
+// StringField returns a field with a string value
+func StringField(key string, value string) Field {
+	return field{key, value, key, value}
+}
+
+// IntField returns a field with an integer value
+func IntField(key string, value int) Field {
+	return field{key, strconv.Itoa(value), key, value}
+}
+
+// Int64Field returns a field with a 64-bit integer value, such as a size in
+// bytes
+func Int64Field(key string, value int64) Field {
+	return field{key, strconv.FormatInt(value, 10), key, value}
+}
+
+// BoolField returns a field with a boolean value
+func BoolField(key string, value bool) Field {
+	return field{key, strconv.FormatBool(value), key, value}
+}
+
+// DurationField returns a field with a duration, shown like "1.5s" in text.
+// In JSON it's a number of milliseconds, with the key suffixed with "_ms".
+func DurationField(key string, value time.Duration) Field {
+	return field{key, value.String(), key + "_ms", float64(value) / float64(time.Millisecond)}
+}
+
+// ErrorField returns a field with the key "error" and the message of err
+func ErrorField(err error) Field {
+	if err == nil {
+		return field{"error", "", "error", nil}
+	}
+	return field{"error", err.Error(), "error", err.Error()}
+}
+
+// TimeField returns a field with a time, formatted as RFC3339
+func TimeField(key string, value time.Time) Field {
+	return field{key, value.Format(time.RFC3339), key, value.Format(time.RFC3339Nano)}
+}
@@ -1,9 +1,16 @@
 package logger
 
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
 type Level int
 
 const (
-	DEBUG Level = iota
+	TRACE Level = iota
+	DEBUG
 	NOTICE
 	INFO
 	ERROR
@@ -12,6 +19,7 @@ const (
 )
 
 var levelNames = []string{
+	"TRACE",
 	"DEBUG",
 	"NOTICE",
 	"INFO",
@@ -24,3 +32,88 @@ var levelNames = []string{
 func (p Level) String() string {
 	return levelNames[p]
 }
+
+// LevelFromString returns the logging level with the given name, which is
+// case insensitive
+func LevelFromString(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q", s)
+}
+
+// DefaultLevelName sets the level of loggers without their own level in a
+// list of levels
+const DefaultLevelName = "default"
+
+// The levels of named loggers, shared by every logger with that name
+var namedLevels = struct {
+	sync.RWMutex
+	levels map[string]Level
+}{}
+
+// ParseLevels parses a list of levels for named loggers, such as
+// "api=debug,job=info,default=warn". The default level (which can also be
+// given on its own, like "debug") is returned separately, if there is one.
+func ParseLevels(s string) (named map[string]Level, def Level, hasDefault bool, err error) {
+	named = map[string]Level{}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value := DefaultLevelName, item
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			name, value = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+
+		level, err := LevelFromString(value)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if name == DefaultLevelName {
+			def, hasDefault = level, true
+		} else {
+			named[name] = level
+		}
+	}
+
+	return named, def, hasDefault, nil
+}
+
+// SetNamedLevels replaces the levels of named loggers. Loggers with names
+// that aren't in levels go back to their own level.
+func SetNamedLevels(levels map[string]Level) {
+	namedLevels.Lock()
+	defer namedLevels.Unlock()
+	namedLevels.levels = levels
+}
+
+// NamedLevels returns the levels of named loggers
+func NamedLevels() map[string]Level {
+	namedLevels.RLock()
+	defer namedLevels.RUnlock()
+
+	levels := map[string]Level{}
+	for name, level := range namedLevels.levels {
+		levels[name] = level
+	}
+	return levels
+}
+
+func namedLevel(name string) (Level, bool) {
+	if name == "" {
+		return 0, false
+	}
+
+	namedLevels.RLock()
+	defer namedLevels.RUnlock()
+
+	level, ok := namedLevels.levels[name]
+	return level, ok
+}
@@ -2,37 +2,27 @@ package logger
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"runtime"
-	"sync"
-	"time"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-const (
-	nocolor   = "0"
-	red       = "31"
-	green     = "38;5;48"
-	yellow    = "33"
-	blue      = "34"
-	gray      = "38;5;251"
-	lightgray = "38;5;243"
-	cyan      = "1;36"
-)
-
 const (
 	DateFormat = "2006-01-02 15:04:05"
-)
 
-var (
-	mutex         = sync.Mutex{}
-	windowsColors bool
+	// DefaultMaxLineLength is the longest message that's logged whole by
+	// NewConsoleLogger, anything after it is truncated
+	DefaultMaxLineLength = 64 * 1024
 )
 
+var windowsColors bool
+
 type Logger interface {
+	Trace(format string, v ...interface{})
 	Debug(format string, v ...interface{})
 	Error(format string, v ...interface{})
 	Fatal(format string, v ...interface{})
@@ -41,26 +31,61 @@ type Logger interface {
 	Info(format string, v ...interface{})
 
 	WithPrefix(prefix string) Logger
+	WithFields(fields ...Field) Logger
+	Named(name string) Logger
 	SetLevel(level Level)
 	GetLevel() Level
 }
 
-type TextLogger struct {
-	Level  Level
-	Colors bool
-	Prefix string
-	Writer io.Writer
-	ExitFn func()
+// ConsoleLogger is a Logger that formats each line with a Printer
+type ConsoleLogger struct {
+	Name    string
+	Prefix  string
+	Fields  Fields
+	Printer Printer
+	ExitFn  func()
+
+	// Messages longer than this many bytes are truncated, unless it's 0
+	MaxLineLength int
+
+	// The level is shared with every copy of the logger made with
+	// WithPrefix, WithFields or Named, so that changing it while the agent
+	// is running affects all of them
+	level *sharedLevel
 }
 
-func NewTextLogger() Logger {
-	return &TextLogger{
-		Level:  NOTICE,
-		Colors: ColorsAvailable(),
-		Writer: os.Stderr,
+// sharedLevel is a level that can be changed while loggers are using it
+type sharedLevel struct {
+	value int32
+}
+
+func newSharedLevel(level Level) *sharedLevel {
+	return &sharedLevel{value: int32(level)}
+}
+
+func (s *sharedLevel) get() Level {
+	return Level(atomic.LoadInt32(&s.value))
+}
+
+func (s *sharedLevel) set(level Level) {
+	atomic.StoreInt32(&s.value, int32(level))
+}
+
+// NewConsoleLogger returns a logger that writes lines with the printer
+func NewConsoleLogger(printer Printer, exitFn func()) Logger {
+	return &ConsoleLogger{
+		Printer:       printer,
+		ExitFn:        exitFn,
+		MaxLineLength: DefaultMaxLineLength,
+		level:         newSharedLevel(NOTICE),
 	}
 }
 
+// NewTextLogger returns a logger that writes human readable lines to stderr
+func NewTextLogger() Logger {
+	return NewConsoleLogger(NewTextPrinter(os.Stderr), func() { os.Exit(1) })
+}
+
 func ColorsAvailable() bool {
 	// Color support for windows is set in init
 	if runtime.GOOS == "windows" && !windowsColors {
@@ -76,97 +101,120 @@ func ColorsAvailable() bool {
 }
 
 // WithPrefix returns a copy of the logger with the provided prefix
-func (l *TextLogger) WithPrefix(prefix string) Logger {
+func (l *ConsoleLogger) WithPrefix(prefix string) Logger {
 	clone := *l
 	clone.Prefix = prefix
 	return &clone
 }
 
-// SetLevel sets the level for the logger
-func (l *TextLogger) SetLevel(level Level) {
-	l.Level = level
+// WithFields returns a copy of the logger that logs the fields with every
+// message
+func (l *ConsoleLogger) WithFields(fields ...Field) Logger {
+	clone := *l
+	clone.Fields = append(append(Fields{}, l.Fields...), fields...)
+	return &clone
 }
 
-func (l *TextLogger) Debug(format string, v ...interface{}) {
-	if l.Level == DEBUG {
+// Named returns a copy of the logger for a subsystem, such as "api", which
+// uses the level set for that name with SetNamedLevels instead of its own
+func (l *ConsoleLogger) Named(name string) Logger {
+	clone := *l
+	clone.Name = name
+	return &clone
+}
+
+// SetLevel sets the level for the logger, and every logger made from it
+func (l *ConsoleLogger) SetLevel(level Level) {
+	l.level.set(level)
+}
+
+// enabled returns whether messages at level should be logged
+func (l *ConsoleLogger) enabled(level Level) bool {
+	if named, ok := namedLevel(l.Name); ok {
+		return level >= named
+	}
+	return level >= l.level.get()
+}
+
+// Trace logs very high volume messages (such as every API request), which
+// are too noisy to be included in debug output
+func (l *ConsoleLogger) Trace(format string, v ...interface{}) {
+	if l.enabled(TRACE) {
+		l.log(TRACE, format, v...)
+	}
+}
+
+func (l *ConsoleLogger) Debug(format string, v ...interface{}) {
+	if l.enabled(DEBUG) {
 		l.log(DEBUG, format, v...)
 	}
 }
 
-func (l *TextLogger) Error(format string, v ...interface{}) {
+func (l *ConsoleLogger) Error(format string, v ...interface{}) {
 	l.log(ERROR, format, v...)
 }
 
-func (l *TextLogger) Fatal(format string, v ...interface{}) {
+// Fatal logs the message, runs the hooks registered with OnFatal and exits
+func (l *ConsoleLogger) Fatal(format string, v ...interface{}) {
 	l.log(FATAL, format, v...)
-	os.Exit(1)
+	runFatalHooks()
+	if l.ExitFn != nil {
+		l.ExitFn()
+	} else {
+		os.Exit(1)
+	}
 }
 
-func (l *TextLogger) Notice(format string, v ...interface{}) {
-	if l.Level <= NOTICE {
+func (l *ConsoleLogger) Notice(format string, v ...interface{}) {
+	if l.enabled(NOTICE) {
 		l.log(NOTICE, format, v...)
 	}
 }
 
-func (l *TextLogger) Info(format string, v ...interface{}) {
-	if l.Level <= INFO {
+func (l *ConsoleLogger) Info(format string, v ...interface{}) {
+	if l.enabled(INFO) {
 		l.log(INFO, format, v...)
 	}
 }
 
-func (l *TextLogger) Warn(format string, v ...interface{}) {
-	if l.Level <= WARN {
+func (l *ConsoleLogger) Warn(format string, v ...interface{}) {
+	if l.enabled(WARN) {
 		l.log(WARN, format, v...)
 	}
 }
 
-func (l *TextLogger) GetLevel() Level {
-	return l.Level
-}
-
-func (l *TextLogger) log(level Level, format string, v ...interface{}) {
-	message := fmt.Sprintf(format, v...)
-	now := time.Now().Format(DateFormat)
-	line := ""
-
-	if l.Colors {
-		levelColor := green
-		messageColor := nocolor
-
-		switch level {
-		case DEBUG:
-			levelColor = gray
-			messageColor = gray
-		case NOTICE:
-			levelColor = cyan
-		case WARN:
-			levelColor = yellow
-		case ERROR:
-			levelColor = red
-		case FATAL:
-			levelColor = red
-			messageColor = red
-		}
-
-		if l.Prefix != "" {
-			line = fmt.Sprintf("\x1b[%sm%s %-6s\x1b[0m \x1b[%sm%s\x1b[0m \x1b[%sm%s\x1b[0m\n", levelColor, now, level, lightgray, l.Prefix, messageColor, message)
-		} else {
-			line = fmt.Sprintf("\x1b[%sm%s %-6s\x1b[0m \x1b[%sm%s\x1b[0m\n", levelColor, now, level, messageColor, message)
-		}
-	} else {
-		if l.Prefix != "" {
-			line = fmt.Sprintf("%s %-6s %s %s\n", now, level, l.Prefix, message)
-		} else {
-			line = fmt.Sprintf("%s %-6s %s\n", now, level, message)
-		}
+func (l *ConsoleLogger) GetLevel() Level {
+	return l.level.get()
+}
+
+func (l *ConsoleLogger) log(level Level, format string, v ...interface{}) {
+	message := truncate(fmt.Sprintf(format, v...), l.MaxLineLength)
+
+	var fields Fields
+	if l.Prefix != "" {
+		fields = append(fields, StringField(PrefixField, l.Prefix))
+	}
+	fields = append(fields, l.Fields...)
+
+	l.Printer.Print(level, message, fields)
+}
+
+// truncate shortens a message to at most max bytes (without splitting a
+// character), noting how much was removed
+func truncate(message string, max int) string {
+	if max <= 0 || len(message) <= max {
+		return message
+	}
+
+	cut := max
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
 	}
 
-	// Make sure we're only outputing a line one at a time
-	mutex.Lock()
-	fmt.Fprint(l.Writer, line)
-	mutex.Unlock()
+	return fmt.Sprintf("%s [... %d bytes truncated]", message[:cut], len(message)-cut)
 }
 
-var Discard = &TextLogger{
-	Writer: ioutil.Discard,
+var Discard = &ConsoleLogger{
+	Printer: NewTextPrinter(ioutil.Discard),
+	level:   newSharedLevel(TRACE),
 }
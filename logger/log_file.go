@@ -0,0 +1,188 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logFilesMutex sync.Mutex
+	logFiles      []*LogFile
+)
+
+// LogRotation configures when a LogFile is rotated, and how many of the old
+// files are kept. Rotated files have the same path with .1 (the newest), .2
+// and so on appended.
+type LogRotation struct {
+	// Rotate once the file would grow past this many bytes, unless it's 0
+	MaxSize int64
+
+	// Rotate once the file has been written to for this long, unless it's 0.
+	// The age of a file starts when the agent opens it.
+	MaxAge time.Duration
+
+	// How many rotated files to keep, or 0 to keep all of them
+	MaxBackups int
+}
+
+// LogFile is a log file that rotates itself according to its LogRotation. It
+// can also be rotated by something else by renaming it and then calling
+// ReopenLogFiles (on SIGHUP, for logrotate).
+type LogFile struct {
+	mu       sync.Mutex
+	path     string
+	rotation LogRotation
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// Used instead of time.Now in tests
+	now func() time.Time
+}
+
+// OpenLogFile opens a file to append log lines to, creating it if needed
+func OpenLogFile(path string, rotation LogRotation) (*LogFile, error) {
+	f := &LogFile{path: path, rotation: rotation, now: time.Now}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+
+	logFilesMutex.Lock()
+	logFiles = append(logFiles, f)
+	logFilesMutex.Unlock()
+
+	return f, nil
+}
+
+func (f *LogFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.shouldRotate(len(b)) {
+		if err := f.rotate(); err != nil {
+			// Carry on writing to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %v\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *LogFile) shouldRotate(n int) bool {
+	// A file with nothing in it is never rotated, so a single line longer
+	// than MaxSize doesn't cause a rotation every time
+	if f.size == 0 {
+		return false
+	}
+
+	if f.rotation.MaxSize > 0 && f.size+int64(n) > f.rotation.MaxSize {
+		return true
+	}
+
+	return f.rotation.MaxAge > 0 && f.now().Sub(f.openedAt) >= f.rotation.MaxAge
+}
+
+// Reopen closes the file and opens it again by path
+func (f *LogFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reopen()
+}
+
+func (f *LogFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = f.now()
+
+	return nil
+}
+
+// rotate moves each of the rotated files along by one, removing any beyond
+// MaxBackups, and then moves the current file to .1 and opens a new one
+func (f *LogFile) rotate() error {
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		n := backups[i]
+		if f.rotation.MaxBackups > 0 && n >= f.rotation.MaxBackups {
+			if err := os.Remove(f.backupPath(n)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(f.backupPath(n), f.backupPath(n+1)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(f.path, f.backupPath(1)); err != nil {
+		return err
+	}
+
+	return f.reopen()
+}
+
+// backups returns the numbers of the rotated files that exist, in order
+func (f *LogFile) backups() ([]int, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []int
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, f.path+"."))
+		if err == nil && n > 0 {
+			backups = append(backups, n)
+		}
+	}
+
+	sort.Ints(backups)
+	return backups, nil
+}
+
+func (f *LogFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
+
+// ReopenLogFiles reopens every file opened with OpenLogFile, returning the
+// first error
+func ReopenLogFiles() error {
+	logFilesMutex.Lock()
+	defer logFilesMutex.Unlock()
+
+	var firstErr error
+	for _, f := range logFiles {
+		if err := f.Reopen(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
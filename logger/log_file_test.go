@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogFileCanBeReopened(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+	f, err := OpenLogFile(path, LogRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("before\n"))
+
+	// Rotate it like logrotate would
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReopenLogFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("after\n"))
+
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	current, _ := ioutil.ReadFile(path)
+
+	if string(rotated) != "before\n" || string(current) != "after\n" {
+		t.Fatalf("bad contents, rotated %q and current %q", rotated, current)
+	}
+}
+
+func TestLogFileRotatesBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+	f, err := OpenLogFile(path, LogRotation{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "six\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "three\n",
+	}
+
+	for p, contents := range expected {
+		actual, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != contents {
+			t.Errorf("expected %s to contain %q, got %q", p, contents, actual)
+		}
+	}
+
+	// Only MaxBackups rotated files are kept
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected %s.3 to have been removed", path)
+	}
+}
+
+func TestLogFileRotatesByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+
+	path := filepath.Join(dir, "agent.log")
+	f, err := OpenLogFile(path, LogRotation{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.now = func() time.Time { return now }
+
+	f.Write([]byte("old\n"))
+	now = now.Add(2 * time.Hour)
+	f.Write([]byte("new\n"))
+
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	current, _ := ioutil.ReadFile(path)
+
+	if string(rotated) != "old\n" || string(current) != "new\n" {
+		t.Fatalf("bad contents, rotated %q and current %q", rotated, current)
+	}
+}
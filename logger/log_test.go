@@ -2,16 +2,18 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTextLogger(t *testing.T) {
 	b := &bytes.Buffer{}
-	l := NewTextLogger().(*TextLogger)
-	l.Level = INFO
-	l.Colors = false
-	l.Writer = b
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil).(*ConsoleLogger)
+	l.SetLevel(INFO)
 
 	l.Debug("Debug %q", "llamas")
 	l.Info("Info %q", "llamas")
@@ -36,3 +38,216 @@ func TestTextLogger(t *testing.T) {
 		t.Fatalf("line 0 bad, got %q", lines[2])
 	}
 }
+
+func TestTextLoggerTruncatesLongMessages(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil).(*ConsoleLogger)
+	l.SetLevel(INFO)
+	l.MaxLineLength = 10
+
+	l.Info("%s", strings.Repeat("llamas", 10))
+
+	if !strings.HasSuffix(b.String(), "llamasllam [... 50 bytes truncated]\n") {
+		t.Fatalf("line not truncated, got %q", b.String())
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(NewJSONPrinter(b), nil).WithPrefix("agent-1")
+	l.SetLevel(INFO)
+
+	l.Debug("Debug %q", "llamas")
+	l.Info("Info %q", "llamas")
+
+	var line map[string]string
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("line isn't JSON, got %q: %v", b.String(), err)
+	}
+
+	if line["level"] != "INFO" || line["msg"] != `Info "llamas"` || line["prefix"] != "agent-1" {
+		t.Fatalf("line bad, got %q", b.String())
+	}
+
+	if _, err := time.Parse(time.RFC3339, line["ts"]); err != nil {
+		t.Fatalf("bad timestamp, got %q", line["ts"])
+	}
+}
+
+func TestNewPrinter(t *testing.T) {
+	if p, err := NewPrinter("JSON", os.Stderr); err != nil {
+		t.Fatal(err)
+	} else if _, ok := p.(*JSONPrinter); !ok {
+		t.Fatalf("expected a JSONPrinter, got %T", p)
+	}
+
+	if p, err := NewPrinter("", os.Stderr); err != nil {
+		t.Fatal(err)
+	} else if _, ok := p.(*TextPrinter); !ok {
+		t.Fatalf("expected a TextPrinter, got %T", p)
+	}
+
+	if _, err := NewPrinter("llamas", os.Stderr); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestTextLoggerShowsWorkerTag(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil).
+		WithPrefix("agent-1").
+		WithFields(StringField(WorkerField, "w2"), StringField("job", "llamas"))
+	l.SetLevel(INFO)
+
+	l.Info("Hello")
+
+	if !strings.HasSuffix(b.String(), " [w2] agent-1 Hello job=llamas\n") {
+		t.Fatalf("line bad, got %q", b.String())
+	}
+}
+
+func TestWorkerColor(t *testing.T) {
+	if workerColor("w1") == workerColor("w2") {
+		t.Fatalf("neighbouring workers have the same color")
+	}
+
+	if workerColor("llamas") != workerColor("llamas") {
+		t.Fatalf("colors aren't stable")
+	}
+}
+
+func TestJSONPrinterTypedFields(t *testing.T) {
+	b := &bytes.Buffer{}
+	p := NewJSONPrinter(b)
+
+	p.Print(INFO, "Uploaded", Fields{
+		StringField("path", "llamas.txt"),
+		IntField("count", 3),
+		BoolField("cached", true),
+		DurationField("duration", 1500*time.Millisecond),
+		ErrorField(errors.New("oh no")),
+	})
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("line isn't JSON, got %q: %v", b.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"path":        "llamas.txt",
+		"count":       float64(3),
+		"cached":      true,
+		"duration_ms": float64(1500),
+		"error":       "oh no",
+	}
+
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("expected %s to be %#v, got %#v", k, v, line[k])
+		}
+	}
+}
+
+func TestTextPrinterTypedFields(t *testing.T) {
+	b := &bytes.Buffer{}
+	p := &TextPrinter{Writer: b}
+
+	p.Print(INFO, "Uploaded", Fields{IntField("count", 3), DurationField("duration", 1500*time.Millisecond)})
+
+	if !strings.HasSuffix(b.String(), "Uploaded count=3 duration=1.5s\n") {
+		t.Fatalf("line bad, got %q", b.String())
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	named, def, hasDefault, err := ParseLevels("api=debug, job=warn,default=error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(named) != 2 || named["api"] != DEBUG || named["job"] != WARN {
+		t.Fatalf("bad named levels: %v", named)
+	}
+	if !hasDefault || def != ERROR {
+		t.Fatalf("bad default level: %v %v", def, hasDefault)
+	}
+
+	named, def, hasDefault, err = ParseLevels("notice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(named) != 0 || !hasDefault || def != NOTICE {
+		t.Fatalf("bad levels: %v %v %v", named, def, hasDefault)
+	}
+
+	if _, _, _, err = ParseLevels("api=loud"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+}
+
+func TestNamedLoggerUsesNamedLevel(t *testing.T) {
+	defer SetNamedLevels(nil)
+
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil).(*ConsoleLogger)
+	l.SetLevel(WARN)
+
+	SetNamedLevels(map[string]Level{"api": DEBUG})
+
+	l.Named("api").Debug("api %q", "llamas")
+	l.Named("job").Debug("job %q", "llamas")
+	l.Debug("root %q", "llamas")
+
+	lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], `api "llamas"`) {
+		t.Fatalf("bad lines, got %q", lines)
+	}
+}
+
+func TestTraceIsBelowDebug(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil).(*ConsoleLogger)
+	l.SetLevel(DEBUG)
+
+	l.Trace("Trace %q", "llamas")
+	l.Debug("Debug %q", "llamas")
+
+	l.SetLevel(TRACE)
+	l.Trace("Trace %q", "alpacas")
+
+	lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("bad number of lines, got %d", len(lines))
+	}
+
+	if !strings.HasSuffix(lines[0], `Debug "llamas"`) {
+		t.Fatalf("line 0 bad, got %q", lines[0])
+	}
+
+	if !strings.Contains(lines[1], "TRACE") || !strings.HasSuffix(lines[1], `Trace "alpacas"`) {
+		t.Fatalf("line 1 bad, got %q", lines[1])
+	}
+
+	if level, err := LevelFromString("trace"); err != nil || level != TRACE {
+		t.Fatalf("bad level from string: %v %v", level, err)
+	}
+}
+
+func TestSetLevelAffectsCopiesOfTheLogger(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil)
+	l.SetLevel(INFO)
+
+	job := l.WithPrefix("agent-1").Named("job")
+	job.Debug("Debug %q", "llamas")
+
+	l.SetLevel(DEBUG)
+	job.Debug("Debug %q", "alpacas")
+
+	lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], `Debug "alpacas"`) {
+		t.Fatalf("bad lines, got %q", lines)
+	}
+}
@@ -0,0 +1,91 @@
+package logger
+
+// A Presenter decides which of a line's fields are shown and where. Prefix
+// fields are shown before the message (text lines show just their values),
+// and the rest are shown after it.
+type Presenter interface {
+	Present(fields Fields) (prefix Fields, rest Fields)
+}
+
+// DefaultPresenter shows the worker tag and the logger's prefix before the
+// message, and every other field after it in the order it was logged
+var DefaultPresenter Presenter = ConfigPresenter{
+	Prefix: []string{WorkerField, PrefixField},
+}
+
+// ConfigPresenter presents fields by name
+type ConfigPresenter struct {
+	// Hide are fields that aren't shown at all
+	Hide []string
+
+	// Prefix are fields that are shown before the message, in this order
+	Prefix []string
+
+	// Order are fields that are shown first after the message, in this
+	// order, with any others following in the order they were logged
+	Order []string
+}
+
+func (p ConfigPresenter) Present(fields Fields) (Fields, Fields) {
+	var prefix, rest Fields
+	used := make([]bool, len(fields))
+
+	take := func(keys []string, into *Fields) {
+		for _, key := range keys {
+			for i, field := range fields {
+				if !used[i] && field.Key() == key {
+					used[i] = true
+					*into = append(*into, field)
+				}
+			}
+		}
+	}
+
+	// Hidden fields are taken first so that they can't be shown elsewhere
+	var hidden Fields
+	take(p.Hide, &hidden)
+	take(p.Prefix, &prefix)
+	take(p.Order, &rest)
+
+	for i, field := range fields {
+		if !used[i] {
+			rest = append(rest, field)
+		}
+	}
+
+	return prefix, rest
+}
+
+// SetPresenter sets how the text and JSON printers of a logger present
+// fields. It should be called before anything else is logging with it.
+func SetPresenter(l Logger, presenter Presenter) {
+	if consoleLogger, ok := l.(*ConsoleLogger); ok {
+		setPrinterPresenter(consoleLogger.Printer, presenter)
+	}
+}
+
+func setPrinterPresenter(p Printer, presenter Presenter) {
+	switch p := p.(type) {
+	case *TextPrinter:
+		p.Presenter = presenter
+	case *JSONPrinter:
+		p.Presenter = presenter
+	case *RedactingPrinter:
+		setPrinterPresenter(p.Printer, presenter)
+	case *Sink:
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		for _, printer := range p.printers {
+			setPrinterPresenter(printer, presenter)
+		}
+	}
+}
+
+// present returns how fields are presented, using the default presenter if
+// there isn't one
+func present(presenter Presenter, fields Fields) (Fields, Fields) {
+	if presenter == nil {
+		presenter = DefaultPresenter
+	}
+	return presenter.Present(fields)
+}
@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func fieldKeys(fields Fields) []string {
+	var keys []string
+	for _, field := range fields {
+		keys = append(keys, field.Key())
+	}
+	return keys
+}
+
+func TestConfigPresenter(t *testing.T) {
+	p := ConfigPresenter{
+		Hide:   []string{"agent_name"},
+		Prefix: []string{"job", PrefixField},
+		Order:  []string{"c", "missing"},
+	}
+
+	prefix, rest := p.Present(Fields{
+		StringField(PrefixField, "agent-1"),
+		StringField("agent_name", "llamas"),
+		StringField("a", "1"),
+		StringField("job", "123"),
+		StringField("c", "3"),
+		StringField("b", "2"),
+	})
+
+	if got := strings.Join(fieldKeys(prefix), ","); got != "job,prefix" {
+		t.Fatalf("bad prefix fields, got %q", got)
+	}
+	if got := strings.Join(fieldKeys(rest), ","); got != "c,a,b" {
+		t.Fatalf("bad fields, got %q", got)
+	}
+}
+
+func TestTextPrinterUsesPresenter(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(&TextPrinter{Writer: b}, nil).
+		WithPrefix("agent-1").
+		WithFields(StringField(WorkerField, "w2"), StringField("job", "llamas"), StringField("agent_name", "alpacas"))
+	l.SetLevel(INFO)
+
+	SetPresenter(l, ConfigPresenter{
+		Hide:   []string{"agent_name"},
+		Prefix: []string{WorkerField, "job"},
+	})
+
+	l.Info("Hello")
+
+	if !strings.HasSuffix(b.String(), " [w2] llamas Hello prefix=agent-1\n") {
+		t.Fatalf("line bad, got %q", b.String())
+	}
+}
+
+func TestJSONPrinterUsesPresenter(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewConsoleLogger(NewJSONPrinter(b), nil).
+		WithPrefix("agent-1").
+		WithFields(StringField("agent_name", "alpacas"))
+	l.SetLevel(INFO)
+
+	SetPresenter(l, ConfigPresenter{Hide: []string{"agent_name"}})
+
+	l.Info("Hello")
+
+	var line map[string]string
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("line isn't JSON, got %q: %v", b.String(), err)
+	}
+
+	if _, ok := line["agent_name"]; ok || line["prefix"] != "agent-1" {
+		t.Fatalf("line bad, got %q", b.String())
+	}
+}
@@ -0,0 +1,256 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nocolor   = "0"
+	red       = "31"
+	green     = "38;5;48"
+	yellow    = "33"
+	blue      = "34"
+	gray      = "38;5;251"
+	lightgray = "38;5;243"
+	cyan      = "1;36"
+)
+
+const (
+	// PrefixField is the field that holds a logger's prefix
+	PrefixField = "prefix"
+
+	// WorkerField holds a short tag for the agent worker that logged a
+	// message, such as "w1", when a process runs more than one
+	WorkerField = "worker"
+)
+
+// Colors for worker tags, chosen so that neighbouring workers look different
+var workerColors = []string{"38;5;39", "38;5;170", "38;5;214", "38;5;77", "38;5;203", "38;5;141"}
+
+// Make sure we're only outputing a line one at a time, even when printers
+// share a writer
+var mutex = sync.Mutex{}
+
+// Fields are logged in order after the message
+type Fields []Field
+
+// Get returns the value of the field with the key, if there is one
+func (f Fields) Get(key string) (string, bool) {
+	for _, field := range f {
+		if field.Key() == key {
+			return field.String(), true
+		}
+	}
+	return "", false
+}
+
+// A Printer formats and writes a log line. Printers can buffer what they
+// write, which Flush writes out, and Close also releases anything else they
+// hold.
+type Printer interface {
+	Print(level Level, msg string, fields Fields)
+	Flush() error
+	Close() error
+}
+
+// LogFormats are the names of the formats that NewPrinter accepts
+var LogFormats = []string{"text", "json", "syslog"}
+
+// NewPrinter returns a printer for a log format, either text, json or
+// syslog. Syslog lines are sent to the local syslog daemon rather than w.
+func NewPrinter(format string, w io.Writer) (Printer, error) {
+	switch strings.ToLower(format) {
+	case "", "text":
+		return NewTextPrinter(w), nil
+	case "json":
+		return NewJSONPrinter(w), nil
+	case "syslog":
+		return NewSyslogPrinter()
+	default:
+		return nil, fmt.Errorf("Unknown log format %q, expected one of: %s", format, strings.Join(LogFormats, ", "))
+	}
+}
+
+// TextPrinter writes human readable lines, colored if colors are available
+type TextPrinter struct {
+	Colors bool
+	Writer io.Writer
+
+	// Presenter decides which fields are shown and where, which is
+	// DefaultPresenter if it's nil
+	Presenter Presenter
+}
+
+func NewTextPrinter(w io.Writer) *TextPrinter {
+	return &TextPrinter{
+		Colors: ColorsAvailable(),
+		Writer: w,
+	}
+}
+
+func (p *TextPrinter) Print(level Level, msg string, fields Fields) {
+	now := time.Now().Format(DateFormat)
+	prefixFields, rest := present(p.Presenter, fields)
+	line := ""
+
+	// Any other fields are shown as key=value after the message
+	for _, field := range rest {
+		msg += fmt.Sprintf(" %s=%s", field.Key(), field.String())
+	}
+
+	// Prefix fields are shown by value before the message. The worker is
+	// shown as a tag, so that the interleaved lines of different workers can
+	// be told apart at a glance.
+	var prefixes []string
+	for _, field := range prefixFields {
+		value := field.String()
+		switch {
+		case field.Key() == WorkerField && p.Colors:
+			prefixes = append(prefixes, fmt.Sprintf("\x1b[%sm[%s]\x1b[0m\x1b[%sm", workerColor(value), value, lightgray))
+		case field.Key() == WorkerField:
+			prefixes = append(prefixes, "["+value+"]")
+		case value != "":
+			prefixes = append(prefixes, value)
+		}
+	}
+	prefix := strings.Join(prefixes, " ")
+
+	if p.Colors {
+		levelColor := green
+		messageColor := nocolor
+
+		switch level {
+		case TRACE, DEBUG:
+			levelColor = gray
+			messageColor = gray
+		case NOTICE:
+			levelColor = cyan
+		case WARN:
+			levelColor = yellow
+		case ERROR:
+			levelColor = red
+		case FATAL:
+			levelColor = red
+			messageColor = red
+		}
+
+		if prefix != "" {
+			line = fmt.Sprintf("\x1b[%sm%s %-6s\x1b[0m \x1b[%sm%s\x1b[0m \x1b[%sm%s\x1b[0m\n", levelColor, now, level, lightgray, prefix, messageColor, msg)
+		} else {
+			line = fmt.Sprintf("\x1b[%sm%s %-6s\x1b[0m \x1b[%sm%s\x1b[0m\n", levelColor, now, level, messageColor, msg)
+		}
+	} else {
+		if prefix != "" {
+			line = fmt.Sprintf("%s %-6s %s %s\n", now, level, prefix, msg)
+		} else {
+			line = fmt.Sprintf("%s %-6s %s\n", now, level, msg)
+		}
+	}
+
+	mutex.Lock()
+	fmt.Fprint(p.Writer, line)
+	if level >= WARN {
+		_ = flushWriter(p.Writer)
+	}
+	mutex.Unlock()
+}
+
+func (p *TextPrinter) Flush() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return flushWriter(p.Writer)
+}
+
+func (p *TextPrinter) Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return closeWriter(p.Writer)
+}
+
+// workerColor picks a color for a worker tag like "w3" by its number, falling
+// back to a hash for any other tag
+func workerColor(worker string) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(worker, "w"))
+	if err != nil || n < 0 {
+		h := fnv.New32a()
+		h.Write([]byte(worker))
+		n = int(h.Sum32() % uint32(len(workerColors)))
+	}
+	return workerColors[n%len(workerColors)]
+}
+
+// JSONPrinter writes each line as a JSON object with ts, level and msg keys,
+// followed by a key for each field
+type JSONPrinter struct {
+	Writer io.Writer
+
+	// Presenter decides which fields are shown, which is DefaultPresenter if
+	// it's nil. Prefix fields come first, straight after the message.
+	Presenter Presenter
+}
+
+func NewJSONPrinter(w io.Writer) *JSONPrinter {
+	return &JSONPrinter{
+		Writer: w,
+	}
+}
+
+func (p *JSONPrinter) Print(level Level, msg string, fields Fields) {
+	var b bytes.Buffer
+
+	// Written by hand rather than marshalling a map, so that the keys stay
+	// in a predictable order
+	writeJSONField(&b, "ts", time.Now().Format(time.RFC3339))
+	writeJSONField(&b, "level", level.String())
+	writeJSONField(&b, "msg", msg)
+	prefixFields, rest := present(p.Presenter, fields)
+	for _, field := range append(prefixFields, rest...) {
+		key, value := field.JSON()
+		writeJSONField(&b, key, value)
+	}
+	b.WriteString("}\n")
+
+	mutex.Lock()
+	p.Writer.Write(b.Bytes())
+	if level >= WARN {
+		_ = flushWriter(p.Writer)
+	}
+	mutex.Unlock()
+}
+
+func (p *JSONPrinter) Flush() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return flushWriter(p.Writer)
+}
+
+func (p *JSONPrinter) Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return closeWriter(p.Writer)
+}
+
+func writeJSONField(b *bytes.Buffer, key string, value interface{}) {
+	if b.Len() == 0 {
+		b.WriteString("{")
+	} else {
+		b.WriteString(",")
+	}
+
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(k)
+	b.WriteString(":")
+	b.Write(v)
+}
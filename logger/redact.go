@@ -0,0 +1,134 @@
+package logger
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedValue replaces secrets in log lines
+const RedactedValue = "[REDACTED]"
+
+// Secrets shorter than this aren't redacted, as they'd match all sorts of
+// innocent text (and are hardly secret anyway)
+const minRedactedLength = 6
+
+// RedactedVars are patterns for the names of environment variables whose
+// values are treated as secrets
+var RedactedVars = []string{"*_TOKEN", "*_PASSWORD", "*_SECRET"}
+
+// RedactingPrinter replaces any secrets in a line with [REDACTED] before
+// passing it on to another printer
+type RedactingPrinter struct {
+	Printer Printer
+
+	mu       sync.RWMutex
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+func NewRedactingPrinter(p Printer, secrets ...string) *RedactingPrinter {
+	r := &RedactingPrinter{Printer: p}
+	r.Add(secrets...)
+	return r
+}
+
+// Add starts redacting more secrets
+func (r *RedactingPrinter) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, secret := range secrets {
+		if len(secret) >= minRedactedLength && !containsString(r.secrets, secret) {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+
+	// Longer secrets go first, so that one that contains another is
+	// redacted whole
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+
+	var oldnew []string
+	for _, secret := range r.secrets {
+		oldnew = append(oldnew, secret, RedactedValue)
+	}
+	r.replacer = strings.NewReplacer(oldnew...)
+}
+
+func (r *RedactingPrinter) Print(level Level, msg string, fields Fields) {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+
+	if replacer == nil {
+		r.Printer.Print(level, msg, fields)
+		return
+	}
+
+	var redacted Fields
+	for _, field := range fields {
+		if value := replacer.Replace(field.String()); value != field.String() {
+			field = StringField(field.Key(), value)
+		}
+		redacted = append(redacted, field)
+	}
+
+	r.Printer.Print(level, replacer.Replace(msg), redacted)
+}
+
+// Redact makes a logger replace secrets with [REDACTED] in everything it
+// prints, including to printers added later with AddPrinter
+func Redact(l Logger, secrets ...string) {
+	consoleLogger, ok := l.(*ConsoleLogger)
+	if !ok {
+		return
+	}
+
+	if r, ok := consoleLogger.Printer.(*RedactingPrinter); ok {
+		r.Add(secrets...)
+	} else {
+		consoleLogger.Printer = NewRedactingPrinter(consoleLogger.Printer, secrets...)
+	}
+}
+
+// SecretsFromEnvironment returns the values of the variables in env (in
+// KEY=value form) with names matching RedactedVars
+func SecretsFromEnvironment(env []string) []string {
+	var secrets []string
+
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+
+		for _, pattern := range RedactedVars {
+			if matched, _ := path.Match(pattern, strings.ToUpper(parts[0])); matched {
+				secrets = append(secrets, parts[1])
+				break
+			}
+		}
+	}
+
+	return secrets
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RedactingPrinter) Flush() error {
+	return r.Printer.Flush()
+}
+
+func (r *RedactingPrinter) Close() error {
+	return r.Printer.Close()
+}
@@ -0,0 +1,78 @@
+package logger
+
+import "sync"
+
+// A Sink is a Printer that prints each line to several other printers, such
+// as colored text to the terminal and JSON to a file
+type Sink struct {
+	mu       sync.RWMutex
+	printers []Printer
+}
+
+func NewSink(printers ...Printer) *Sink {
+	return &Sink{printers: printers}
+}
+
+// Add starts printing lines to another printer
+func (s *Sink) Add(p Printer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.printers = append(s.printers, p)
+}
+
+func (s *Sink) Print(level Level, msg string, fields Fields) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.printers {
+		p.Print(level, msg, fields)
+	}
+}
+
+// Flush flushes every printer, returning the first error
+func (s *Sink) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var err error
+	for _, p := range s.printers {
+		if perr := p.Flush(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// Close closes every printer, returning the first error
+func (s *Sink) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var err error
+	for _, p := range s.printers {
+		if perr := p.Close(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// AddPrinter makes a logger print to another printer as well as the ones it
+// already prints to. If the logger redacts secrets, so does the new printer.
+func AddPrinter(l Logger, p Printer) {
+	consoleLogger, ok := l.(*ConsoleLogger)
+	if !ok {
+		return
+	}
+
+	target := &consoleLogger.Printer
+	if r, ok := consoleLogger.Printer.(*RedactingPrinter); ok {
+		target = &r.Printer
+	}
+
+	if sink, ok := (*target).(*Sink); ok {
+		sink.Add(p)
+	} else {
+		*target = NewSink(*target, p)
+	}
+}
@@ -0,0 +1,26 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSinkPrintsToEveryPrinter(t *testing.T) {
+	text := &bytes.Buffer{}
+	jsonLines := &bytes.Buffer{}
+
+	l := NewConsoleLogger(&TextPrinter{Writer: text}, nil)
+	AddPrinter(l, NewJSONPrinter(jsonLines))
+	l.SetLevel(INFO)
+
+	l.Info("Hello")
+
+	if !strings.HasSuffix(text.String(), "Hello\n") {
+		t.Fatalf("text line bad, got %q", text.String())
+	}
+
+	if !strings.Contains(jsonLines.String(), `"msg":"Hello"`) {
+		t.Fatalf("json line bad, got %q", jsonLines.String())
+	}
+}
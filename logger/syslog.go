@@ -0,0 +1,150 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sockets that local syslog daemons (and journald) listen on, in the
+// order they're tried
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+const (
+	// Messages are logged with the daemon facility
+	syslogFacility = 3
+
+	syslogAppName = "buildkite-agent"
+
+	// The structured data element that fields are logged in. Names that
+	// aren't registered with IANA need an enterprise number, so this uses
+	// the one reserved for examples in RFC 5612.
+	syslogStructuredDataID = "fields@32473"
+)
+
+// Syslog severities for each of our levels
+var syslogSeverities = map[Level]int{
+	TRACE:  7,
+	DEBUG:  7,
+	INFO:   6,
+	NOTICE: 5,
+	WARN:   4,
+	ERROR:  3,
+	FATAL:  2,
+}
+
+// SyslogPrinter sends lines to the local syslog daemon in RFC 5424 format,
+// with fields as structured data
+type SyslogPrinter struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	hostname string
+	pid      int
+}
+
+// NewSyslogPrinter connects to the local syslog daemon
+func NewSyslogPrinter() (*SyslogPrinter, error) {
+	p := &SyslogPrinter{pid: os.Getpid()}
+
+	p.hostname, _ = os.Hostname()
+	if p.hostname == "" {
+		p.hostname = "-"
+	}
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *SyslogPrinter) connect() error {
+	for _, socket := range syslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.Dial(network, socket)
+			if err == nil {
+				p.conn = conn
+				return nil
+			}
+		}
+	}
+	return errors.New("Couldn't connect to the local syslog daemon")
+}
+
+func (p *SyslogPrinter) Print(level Level, msg string, fields Fields) {
+	line := p.format(level, msg, fields, time.Now())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The daemon might have been restarted, so try again with a new
+	// connection before giving up on the line
+	if _, err := p.conn.Write(line); err != nil {
+		p.conn.Close()
+		if p.connect() == nil {
+			_, _ = p.conn.Write(line)
+		}
+	}
+}
+
+// Flush does nothing, as lines are sent to syslog as they're printed
+func (p *SyslogPrinter) Flush() error {
+	return nil
+}
+
+// Close disconnects from the syslog daemon
+func (p *SyslogPrinter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn.Close()
+}
+
+func (p *SyslogPrinter) format(level Level, msg string, fields Fields, t time.Time) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ",
+		syslogFacility*8+syslogSeverities[level],
+		t.Format(time.RFC3339Nano), p.hostname, syslogAppName, p.pid)
+
+	if len(fields) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + syslogStructuredDataID)
+		for _, field := range fields {
+			fmt.Fprintf(&b, " %s=\"%s\"", syslogParamName(field.Key()), syslogParamValue(field.String()))
+		}
+		b.WriteString("]")
+	}
+
+	b.WriteString(" ")
+	b.WriteString(msg)
+
+	return b.Bytes()
+}
+
+// syslogParamName removes the characters that can't be in a parameter name,
+// and shortens it to the maximum of 32 characters
+func syslogParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+var syslogParamValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func syslogParamValue(value string) string {
+	return syslogParamValueEscaper.Replace(value)
+}
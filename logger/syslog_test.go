@@ -0,0 +1,29 @@
+package logger
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyslogPrinterFormatsRFC5424(t *testing.T) {
+	p := &SyslogPrinter{hostname: "llamas.local", pid: 42}
+	ts := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	line := p.format(INFO, "Hello", nil, ts)
+	expected := `<30>1 2019-03-04T05:06:07Z llamas.local buildkite-agent 42 - - Hello`
+	if string(line) != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+
+	line = p.format(ERROR, "Failed", Fields{
+		StringField(PrefixField, "agent-1"),
+		ErrorField(errors.New(`bad "thing" [1]`)),
+		StringField("weird key=", `back\slash`),
+	}, ts)
+	expected = `<27>1 2019-03-04T05:06:07Z llamas.local buildkite-agent 42 - ` +
+		`[fields@32473 prefix="agent-1" error="bad \"thing\" [1\]" weird_key_="back\\slash"] Failed`
+	if string(line) != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/clicommand"
+	"github.com/buildkite/agent/telemetry"
 	"github.com/urfave/cli"
 )
 
@@ -18,6 +19,7 @@ Available commands are:
   {{range .Commands}}{{.Name}}{{with .ShortName}}, {{.}}{{end}}{{ "\t" }}{{.Usage}}
   {{end}}
 Use "{{.Name}} <command> --help" for more information about a command.
+Use "{{.Name}} --list-exit-codes" to see what each exit code means.
 
 `
 
@@ -56,9 +58,20 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "buildkite-agent"
 	app.Version = agent.Version()
-	app.Commands = []cli.Command{
+	app.Flags = []cli.Flag{
+		clicommand.ListExitCodesFlag,
+		clicommand.TelemetryEndpointFlag,
+	}
+	app.Commands = clicommand.WithTelemetry([]cli.Command{
 		clicommand.AgentStartCommand,
 		clicommand.AnnotateCommand,
+		{
+			Name:  "annotation",
+			Usage: "Make changes to the annotations on a build",
+			Subcommands: []cli.Command{
+				clicommand.AnnotationRemoveCommand,
+			},
+		},
 		{
 			Name:  "artifact",
 			Usage: "Upload/download artifacts from Buildkite jobs",
@@ -66,6 +79,16 @@ func main() {
 				clicommand.ArtifactUploadCommand,
 				clicommand.ArtifactDownloadCommand,
 				clicommand.ArtifactShasumCommand,
+				clicommand.ArtifactSearchCommand,
+			},
+		},
+		{
+			Name:  "env",
+			Usage: "Read and change the environment of the running job from its hooks",
+			Subcommands: []cli.Command{
+				clicommand.EnvDumpCommand,
+				clicommand.EnvGetCommand,
+				clicommand.EnvSetCommand,
 			},
 		},
 		{
@@ -75,6 +98,7 @@ func main() {
 				clicommand.MetaDataSetCommand,
 				clicommand.MetaDataGetCommand,
 				clicommand.MetaDataExistsCommand,
+				clicommand.MetaDataKeysCommand,
 			},
 		},
 		{
@@ -86,28 +110,71 @@ func main() {
 		},
 		{
 			Name:  "step",
-			Usage: "Make changes to a step",
+			Usage: "Get or make changes to a step",
 			Subcommands: []cli.Command{
+				clicommand.StepGetCommand,
 				clicommand.StepUpdateCommand,
 			},
 		},
+		{
+			Name:  "batch",
+			Usage: "Run many commands within a job",
+			Subcommands: []cli.Command{
+				clicommand.BatchRunCommand,
+			},
+		},
+		{
+			Name:  "build",
+			Usage: "Interact with other builds",
+			Subcommands: []cli.Command{
+				clicommand.BuildCreateCommand,
+				clicommand.BuildWaitCommand,
+				clicommand.BuildSummaryCommand,
+			},
+		},
+		{
+			Name:  "workspace",
+			Usage: "Snapshot and restore workspaces on this host",
+			Subcommands: []cli.Command{
+				clicommand.WorkspaceSnapshotCommand,
+				clicommand.WorkspaceRestoreCommand,
+			},
+		},
+		{
+			Name:  "tool",
+			Usage: "Utility commands for working with builds",
+			Subcommands: []cli.Command{
+				clicommand.ToolJUnitAnnotateCommand,
+				clicommand.ToolKeygenCommand,
+				clicommand.ToolRunCommand,
+				clicommand.ToolSplitCommand,
+			},
+		},
+		clicommand.StatusCommand,
+		clicommand.DebugBundleCommand,
+		clicommand.ControlCommand,
 		clicommand.BootstrapCommand,
-	}
+	})
 
 	// When no sub command is used
 	app.Action = func(c *cli.Context) {
+		if c.Bool(clicommand.ListExitCodesFlag.Name) {
+			clicommand.PrintExitCodes(os.Stdout)
+			os.Exit(clicommand.ExitOK)
+		}
 		cli.ShowAppHelp(c)
-		os.Exit(1)
+		os.Exit(clicommand.ExitError)
 	}
 
 	// When a sub command can't be found
 	app.CommandNotFound = func(c *cli.Context, command string) {
+		clicommand.ReportTelemetryError(c, command, telemetry.CategoryUnknownCommand)
 		cli.ShowAppHelp(c)
-		os.Exit(1)
+		os.Exit(clicommand.ExitConfigError)
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		os.Exit(clicommand.ExitConfigError)
 	}
 }
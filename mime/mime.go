@@ -2,16 +2,34 @@ package mime
 
 import (
 	"mime"
+	"net/http"
+	"strings"
 )
 
-// Return a mime type for an extension.
+// SniffLength is how much of the start of a file TypeByContent looks at
+const SniffLength = 512
+
+// Return a mime type for an extension, such as ".html".
 func TypeByExtension(ext string) string {
-	if mimeType, ok := types[ext]; ok {
+	if mimeType, ok := types[strings.ToLower(strings.TrimPrefix(ext, "."))]; ok {
 		return mimeType
 	}
 	return mime.TypeByExtension(ext)
 }
 
+// TypeByContent returns a mime type for the start of a file, or "" if it
+// can't be told from it. Only the first SniffLength bytes are looked at.
+func TypeByContent(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	if mimeType := http.DetectContentType(data); mimeType != "application/octet-stream" {
+		return mimeType
+	}
+	return ""
+}
+
 // This list is generated from NGINX
 // http://hg.nginx.org/nginx/raw-file/default/conf/mime.types
 
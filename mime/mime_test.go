@@ -0,0 +1,20 @@
+package mime
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeByExtension(t *testing.T) {
+	assert.Equal(t, "text/html", TypeByExtension(".html"))
+	assert.Equal(t, "image/png", TypeByExtension(".PNG"))
+	assert.Equal(t, "", TypeByExtension(".llamas"))
+}
+
+func TestTypeByContent(t *testing.T) {
+	assert.Equal(t, "text/html; charset=utf-8", TypeByContent([]byte("<!DOCTYPE html><html><body>Llamas</body></html>")))
+	assert.Equal(t, "image/png", TypeByContent([]byte("\x89PNG\x0D\x0A\x1A\x0A")))
+	assert.Equal(t, "", TypeByContent([]byte{0, 1, 2, 3}))
+	assert.Equal(t, "", TypeByContent(nil))
+}
@@ -0,0 +1,99 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// DefaultMaxLineLength is the longest line of job output that's kept whole,
+// anything after it is truncated
+const DefaultMaxLineLength = 1024 * 1024
+
+// LineLimitWriter passes writes on to W, truncating any line longer than
+// Limit bytes. The rest of a long line is discarded as it's written rather
+// than being buffered, and a marker saying how much was dropped is written
+// when the line ends. Both \n and \r end a line.
+type LineLimitWriter struct {
+	W     io.Writer
+	Limit int
+
+	lineLength int
+	truncated  int
+}
+
+// NewLineLimitWriter returns a LineLimitWriter, or w itself if limit is 0
+func NewLineLimitWriter(w io.Writer, limit int) io.Writer {
+	if limit <= 0 {
+		return w
+	}
+	return &LineLimitWriter{W: w, Limit: limit}
+}
+
+func (w *LineLimitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	var out bytes.Buffer
+	out.Grow(len(p))
+
+	for len(p) > 0 {
+		segment := p
+		end := bytes.IndexAny(p, "\r\n")
+		if end >= 0 {
+			segment = p[:end]
+		}
+
+		// Once a line has been truncated, drop the rest of it
+		room := w.Limit - w.lineLength
+		if w.truncated > 0 {
+			room = 0
+		}
+
+		if len(segment) <= room {
+			out.Write(segment)
+			w.lineLength += len(segment)
+		} else {
+			cut := runeBoundary(segment, room)
+			out.Write(segment[:cut])
+			w.lineLength += cut
+			w.truncated += len(segment) - cut
+		}
+
+		if end < 0 {
+			break
+		}
+
+		if w.truncated > 0 {
+			out.WriteString(TruncatedLineMarker(w.truncated))
+		}
+		out.WriteByte(p[end])
+
+		w.lineLength = 0
+		w.truncated = 0
+		p = p[end+1:]
+	}
+
+	if _, err := w.W.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// TruncatedLineMarker is appended to lines that have been truncated
+func TruncatedLineMarker(truncated int) string {
+	return fmt.Sprintf(" [... %d bytes truncated]", truncated)
+}
+
+// runeBoundary returns the largest offset no more than n that doesn't split
+// a UTF-8 encoded character
+func runeBoundary(b []byte, n int) int {
+	if n >= len(b) {
+		return len(b)
+	}
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package process_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/process"
+)
+
+func TestLineLimitWriter(t *testing.T) {
+	var tests = []struct {
+		Name     string
+		Writes   []string
+		Expected string
+	}{
+		{
+			Name:     "Short lines",
+			Writes:   []string{"llamas\n", "alpaca\r\n"},
+			Expected: "llamas\nalpaca\r\n",
+		},
+		{
+			Name:     "Long line",
+			Writes:   []string{"llamas and alpacas\nok\n"},
+			Expected: "llamas [... 12 bytes truncated]\nok\n",
+		},
+		{
+			Name:     "Long line across writes",
+			Writes:   []string{"lla", "mas and", " alpacas", "\nok"},
+			Expected: "llamas [... 12 bytes truncated]\nok",
+		},
+		{
+			Name:     "Carriage returns end lines",
+			Writes:   []string{"10%\r20%\r100% done\n"},
+			Expected: "10%\r20%\r100% d [... 3 bytes truncated]\n",
+		},
+		{
+			Name:     "Characters aren't split",
+			Writes:   []string{"llamaé!\n"},
+			Expected: "llama [... 3 bytes truncated]\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := process.NewLineLimitWriter(&buf, 6)
+
+			for _, s := range test.Writes {
+				n, err := w.Write([]byte(s))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(s) {
+					t.Fatalf("Expected to write %d bytes, wrote %d", len(s), n)
+				}
+			}
+
+			if buf.String() != test.Expected {
+				t.Fatalf("Wanted %q, got %q", test.Expected, buf.String())
+			}
+		})
+	}
+}
@@ -66,6 +66,48 @@ func (p *Process) WaitStatus() syscall.WaitStatus {
 	return p.status
 }
 
+// MaxRSS returns the peak resident set size of the finished process in
+// kilobytes, or zero if it isn't known
+func (p *Process) MaxRSS() int64 {
+	if p.command == nil {
+		return 0
+	}
+	return maxRSS(p.command.ProcessState)
+}
+
+// Usage is the resources used by a finished process, including the children
+// that it waited for
+type Usage struct {
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// The peak resident set size of the process (or its largest child) in
+	// kilobytes, or zero if it isn't known
+	MaxRSS int64
+
+	// The bytes read from and written to disk, if DiskIOKnown
+	DiskReadBytes  int64
+	DiskWriteBytes int64
+	DiskIOKnown    bool
+}
+
+// Usage returns the resources used by the finished process
+func (p *Process) Usage() Usage {
+	if p.command == nil || p.command.ProcessState == nil {
+		return Usage{}
+	}
+
+	state := p.command.ProcessState
+	u := Usage{
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+		MaxRSS:     maxRSS(state),
+	}
+	u.DiskReadBytes, u.DiskWriteBytes, u.DiskIOKnown = diskIO(state)
+
+	return u
+}
+
 // Run the command and block until it finishes
 func (p *Process) Run() error {
 	if p.command != nil {
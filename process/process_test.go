@@ -46,6 +46,34 @@ func TestProcessOutput(t *testing.T) {
 	assertProcessDoesntExist(t, p)
 }
 
+func TestProcessUsage(t *testing.T) {
+	p := process.New(logger.Discard, process.Config{
+		Path:   os.Args[0],
+		Env:    []string{"TEST_MAIN=output"},
+		Stdout: &bytes.Buffer{},
+		Stderr: &bytes.Buffer{},
+	})
+
+	if u := p.Usage(); u != (process.Usage{}) {
+		t.Fatalf("Expected no usage before running, got %+v", u)
+	}
+
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	u := p.Usage()
+	if u.UserTime+u.SystemTime <= 0 {
+		t.Errorf("Expected some CPU time, got %+v", u)
+	}
+	if runtime.GOOS != `windows` && u.MaxRSS <= 0 {
+		t.Errorf("Expected a peak RSS, got %+v", u)
+	}
+	if u.DiskIOKnown != (runtime.GOOS == `linux`) {
+		t.Errorf("Expected disk IO to only be known on linux, got %+v", u)
+	}
+}
+
 func TestProcessOutputPTY(t *testing.T) {
 	if runtime.GOOS == `windows` {
 		t.Skip("PTY not supported on windows")
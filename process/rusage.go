@@ -0,0 +1,44 @@
+// +build !windows
+
+package process
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// maxRSS returns the peak resident set size in kilobytes of a finished process
+func maxRSS(state *os.ProcessState) int64 {
+	if state == nil {
+		return 0
+	}
+
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+
+	// macOS reports ru_maxrss in bytes, everywhere else uses kilobytes
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss) / 1024
+	}
+
+	return int64(rusage.Maxrss)
+}
+
+// diskIO returns the bytes a finished process read from and wrote to disk,
+// which is only known on Linux
+func diskIO(state *os.ProcessState) (read int64, written int64, ok bool) {
+	if state == nil || runtime.GOOS != "linux" {
+		return 0, 0, false
+	}
+
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0, 0, false
+	}
+
+	// Linux counts blocks of 512 bytes, whatever the filesystem's block size
+	return int64(rusage.Inblock) * 512, int64(rusage.Oublock) * 512, true
+}
@@ -0,0 +1,13 @@
+package process
+
+import "os"
+
+// maxRSS isn't available on windows
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
+
+// diskIO isn't available on windows
+func diskIO(state *os.ProcessState) (read int64, written int64, ok bool) {
+	return 0, 0, false
+}
@@ -11,6 +11,10 @@ import (
 
 type Scanner struct {
 	logger logger.Logger
+
+	// If set, lines longer than this many bytes are truncated, and the rest
+	// of the line is discarded instead of being buffered until it ends
+	MaxLineLength int
 }
 
 func NewScanner(l logger.Logger) *Scanner {
@@ -22,6 +26,7 @@ func NewScanner(l logger.Logger) *Scanner {
 func (s *Scanner) ScanLines(r io.Reader, f func(line string)) error {
 	var reader = bufio.NewReader(r)
 	var appending []byte
+	var truncated int
 
 	s.logger.Debug("[LineScanner] Starting to read lines")
 
@@ -49,15 +54,15 @@ func (s *Scanner) ScanLines(r io.Reader, f func(line string)) error {
 			// since it points to its own internal buffer array. To accumulate the entire
 			// result we make a copy of the first prefix, and ensure there is spare capacity
 			// for future appends to minimize the need for resizing on append.
-			appending = make([]byte, len(line), (cap(line))*2)
-			copy(appending, line)
+			appending = make([]byte, 0, (cap(line))*2)
+			appending, truncated = s.appendLimited(appending, line, truncated)
 
 			continue
 		}
 
 		// Should we be appending?
 		if appending != nil {
-			appending = append(appending, line...)
+			appending, truncated = s.appendLimited(appending, line, truncated)
 
 			// No more isPrefix! Line is finished!
 			if !isPrefix {
@@ -69,16 +74,41 @@ func (s *Scanner) ScanLines(r io.Reader, f func(line string)) error {
 			} else {
 				continue
 			}
+		} else if s.MaxLineLength > 0 && len(line) > s.MaxLineLength {
+			cut := runeBoundary(line, s.MaxLineLength)
+			line, truncated = line[:cut], len(line)-cut
 		}
 
 		// Write to the handler function
-		f(string(line))
+		if truncated > 0 {
+			f(string(line) + TruncatedLineMarker(truncated))
+			truncated = 0
+		} else {
+			f(string(line))
+		}
 	}
 
 	s.logger.Debug("[LineScanner] Finished")
 	return nil
 }
 
+// appendLimited appends as much of b to line as fits within MaxLineLength,
+// and returns the line and the number of bytes that have been truncated
+func (s *Scanner) appendLimited(line []byte, b []byte, truncated int) ([]byte, int) {
+	if s.MaxLineLength <= 0 {
+		return append(line, b...), 0
+	}
+
+	// Once a line has been truncated, drop the rest of it
+	room := s.MaxLineLength - len(line)
+	if truncated > 0 {
+		room = 0
+	}
+
+	cut := runeBoundary(b, room)
+	return append(line, b[:cut]...), truncated + len(b) - cut
+}
+
 type Buffer struct {
 	mu  sync.RWMutex
 	buf bytes.Buffer
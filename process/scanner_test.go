@@ -57,3 +57,29 @@ func TestScanLines(t *testing.T) {
 		t.Fatalf("Lines was unexpected:\nWanted: %v\nGot: %v\n", expected, lines)
 	}
 }
+
+func TestScanLinesTruncatesLongLines(t *testing.T) {
+	var lines []string
+
+	input := "short\n" + strings.Repeat("x", 10000) + "\nafter\n"
+
+	scanner := process.NewScanner(logger.Discard)
+	scanner.MaxLineLength = 5000
+
+	err := scanner.ScanLines(strings.NewReader(input), func(l string) {
+		lines = append(lines, l)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected = []string{
+		"short",
+		strings.Repeat("x", 5000) + " [... 5000 bytes truncated]",
+		"after",
+	}
+
+	if !reflect.DeepEqual(expected, lines) {
+		t.Fatalf("Lines was unexpected:\nWanted: %q\nGot: %q\n", expected, lines)
+	}
+}
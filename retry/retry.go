@@ -1,10 +1,13 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"time"
+
+	"github.com/buildkite/agent/logger"
 )
 
 type Stats struct {
@@ -19,6 +22,75 @@ type Config struct {
 	Interval time.Duration
 	Forever  bool
 	Jitter   bool
+
+	// If greater than 1, the interval is multiplied by it after every
+	// attempt (exponential backoff), up to MaxInterval (or an hour if it
+	// isn't set)
+	Multiplier  float64
+	MaxInterval time.Duration
+
+	// With full jitter, a random interval between 0 and the backoff is
+	// waited, so that many clients that failed at the same time don't all
+	// retry at the same time too
+	FullJitter bool
+
+	// If set, every failed attempt is logged as a warning
+	Logger logger.Logger
+
+	// If set, called after every failed attempt
+	OnFailure func(a Attempt, s *Stats)
+}
+
+// RetryAfterError is an error that says how long to wait before trying
+// again, such as an API response with a Retry-After header
+type RetryAfterError interface {
+	error
+	RetryAfter() (time.Duration, bool)
+}
+
+// Attempt is a failed call of the callback
+type Attempt struct {
+	Number    int
+	Err       error
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
+// Error is returned by DoWithContext when no attempt succeeded, and records
+// every attempt that failed
+type Error struct {
+	Attempts []Attempt
+
+	// The context's error, if it finished before an attempt succeeded
+	Cancelled error
+}
+
+// Last returns the error of the last attempt, or the context's error if
+// there weren't any attempts
+func (e *Error) Last() error {
+	if len(e.Attempts) == 0 {
+		return e.Cancelled
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%v", e.Last())
+
+	if len(e.Attempts) > 1 {
+		msg = fmt.Sprintf("%s (after %d attempts)", msg, len(e.Attempts))
+	}
+	if e.Cancelled != nil && e.Cancelled != e.Last() {
+		msg = fmt.Sprintf("%s, then %v", msg, e.Cancelled)
+	}
+
+	return msg
+}
+
+// Unwrap returns the error of the last attempt, so that it can be inspected
+// with errors.As
+func (e *Error) Unwrap() error {
+	return e.Last()
 }
 
 // A human readable representation often useful for debugging.
@@ -43,9 +115,23 @@ func (s *Stats) Break() {
 	s.breakNext = true
 }
 
+// Do calls the callback until it succeeds or runs out of attempts, and
+// returns the error of the last attempt
 func Do(callback func(*Stats) error, config *Config) error {
-	var err error
+	err := DoWithContext(context.Background(), func(_ context.Context, s *Stats) error {
+		return callback(s)
+	}, config)
 
+	if e, ok := err.(*Error); ok {
+		return e.Last()
+	}
+	return err
+}
+
+// DoWithContext calls the callback until it succeeds, runs out of attempts,
+// or the context finishes. The callback is given the context so that it can
+// cancel whatever it's doing. If no attempt succeeds, the error is an *Error.
+func DoWithContext(ctx context.Context, callback func(context.Context, *Stats) error, config *Config) error {
 	// Setup a default config for the retry
 	if config == nil {
 		config = &Config{Forever: true, Interval: 1 * time.Second, Jitter: false}
@@ -65,34 +151,76 @@ func Do(callback func(*Stats) error, config *Config) error {
 	// The stats struct that is passed to every attempt of the callback
 	stats := &Stats{Attempt: 1, Config: config}
 
+	// Every failed attempt, for the error if they all fail
+	retryErr := &Error{}
+
 	// Needed for jitter calcs
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	for {
+		if err := ctx.Err(); err != nil {
+			retryErr.Cancelled = err
+			return retryErr
+		}
+
 		// Preconfigure the interval that will be used (so that we have
 		// access to it in the callback)
-		stats.Interval = config.Interval
+		stats.Interval = backoff(config, stats.Attempt)
+		if config.FullJitter {
+			stats.Interval = time.Duration(random.Int63n(int64(stats.Interval) + 1))
+		}
 		if config.Jitter {
 			stats.Interval = stats.Interval + (time.Duration(1000*random.Float32()) * time.Millisecond)
 		}
 
 		// Attempt the callback
-		err = callback(stats)
+		startedAt := time.Now()
+		err := callback(ctx, stats)
 		if err == nil {
 			return nil
 		}
 
+		// Wait at least as long as the server asked, if it did
+		if e, ok := err.(RetryAfterError); ok {
+			if after, ok := e.RetryAfter(); ok && after > stats.Interval {
+				stats.Interval = after
+			}
+		}
+
+		attempt := Attempt{
+			Number:    stats.Attempt,
+			Err:       err,
+			StartedAt: startedAt,
+			Duration:  time.Since(startedAt),
+		}
+		retryErr.Attempts = append(retryErr.Attempts, attempt)
+
+		if config.Logger != nil {
+			config.Logger.Warn("%s (%s)", err, stats)
+		}
+		if config.OnFailure != nil {
+			config.OnFailure(attempt, stats)
+		}
+
 		// If the loop has callen stats.Break(), we should cancel out
 		// of the loop
 		if stats.breakNext {
-			return err
+			return retryErr
 		}
 
 		// Bump the attempt number
 		stats.Attempt = stats.Attempt + 1
 
-		// Try the callback again after the interval
-		time.Sleep(stats.Interval)
+		// Try the callback again after the interval, unless the context
+		// finishes first
+		timer := time.NewTimer(stats.Interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			retryErr.Cancelled = ctx.Err()
+			return retryErr
+		}
 
 		if !stats.Config.Forever {
 			// Should we give up?
@@ -102,5 +230,31 @@ func Do(callback func(*Stats) error, config *Config) error {
 		}
 	}
 
-	return err
+	return retryErr
+}
+
+// The longest exponential backoff when there's no MaxInterval
+const defaultMaxBackoff = time.Hour
+
+// backoff returns the interval before the next attempt, before any jitter
+func backoff(config *Config, attempt int) time.Duration {
+	interval := config.Interval
+
+	if config.Multiplier > 1 {
+		max := config.MaxInterval
+		if max <= 0 {
+			max = defaultMaxBackoff
+		}
+
+		for i := 1; i < attempt && interval < max; i++ {
+			interval = time.Duration(float64(interval) * config.Multiplier)
+		}
+		if interval > max {
+			interval = max
+		}
+	} else if config.MaxInterval > 0 && interval > config.MaxInterval {
+		interval = config.MaxInterval
+	}
+
+	return interval
 }
@@ -0,0 +1,160 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoReturnsLastError(t *testing.T) {
+	var calls int
+
+	err := Do(func(s *Stats) error {
+		calls++
+		return fmt.Errorf("attempt %d", s.Attempt)
+	}, &Config{Maximum: 3, Interval: time.Millisecond})
+
+	assert.Equal(t, 3, calls)
+	assert.EqualError(t, err, "attempt 3")
+}
+
+func TestDoStopsOnSuccess(t *testing.T) {
+	var calls int
+
+	err := Do(func(s *Stats) error {
+		calls++
+		if s.Attempt < 2 {
+			return errors.New("llamas")
+		}
+		return nil
+	}, &Config{Maximum: 5, Interval: time.Millisecond})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestDoWithContextRecordsEveryAttempt(t *testing.T) {
+	var failures []int
+
+	err := DoWithContext(context.Background(), func(_ context.Context, s *Stats) error {
+		if s.Attempt == 2 {
+			s.Break()
+		}
+		return fmt.Errorf("attempt %d", s.Attempt)
+	}, &Config{
+		Maximum:  5,
+		Interval: time.Millisecond,
+		OnFailure: func(a Attempt, s *Stats) {
+			failures = append(failures, a.Number)
+		},
+	})
+
+	retryErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected a *Error, got %T", err)
+	}
+
+	assert.Equal(t, []int{1, 2}, failures)
+	assert.Len(t, retryErr.Attempts, 2)
+	assert.EqualError(t, retryErr.Attempts[0].Err, "attempt 1")
+	assert.False(t, retryErr.Attempts[1].StartedAt.IsZero())
+	assert.EqualError(t, retryErr.Last(), "attempt 2")
+	assert.EqualError(t, err, "attempt 2 (after 2 attempts)")
+}
+
+func TestDoWithContextStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := DoWithContext(ctx, func(ctx context.Context, s *Stats) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}, &Config{Forever: true, Interval: time.Hour})
+
+	retryErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected a *Error, got %T", err)
+	}
+
+	assert.Len(t, retryErr.Attempts, 1)
+	assert.Equal(t, context.Canceled, retryErr.Cancelled)
+	assert.EqualError(t, err, "context canceled")
+}
+
+func TestDoWithContextDoesntStartWhenAlreadyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := DoWithContext(ctx, func(_ context.Context, s *Stats) error {
+		t.Fatal("callback shouldn't be called")
+		return nil
+	}, nil)
+
+	assert.EqualError(t, err, "context canceled")
+}
+
+func TestForeverRequiresInterval(t *testing.T) {
+	err := Do(func(s *Stats) error { return nil }, &Config{Forever: true})
+	assert.Error(t, err)
+}
+
+func TestBackoff(t *testing.T) {
+	config := &Config{Interval: time.Second, Multiplier: 2, MaxInterval: 5 * time.Second}
+
+	var intervals []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		intervals = append(intervals, backoff(config, attempt))
+	}
+
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	}, intervals)
+
+	// Without a maximum, it stops growing after an hour
+	config.MaxInterval = 0
+	assert.Equal(t, time.Hour, backoff(config, 1000))
+
+	// Without a multiplier, it's fixed
+	assert.Equal(t, time.Second, backoff(&Config{Interval: time.Second}, 10))
+}
+
+func TestFullJitterStaysWithinBackoff(t *testing.T) {
+	var intervals []time.Duration
+
+	Do(func(s *Stats) error {
+		intervals = append(intervals, s.Interval)
+		return errors.New("llamas")
+	}, &Config{Maximum: 4, Interval: time.Millisecond, Multiplier: 2, FullJitter: true})
+
+	for i, interval := range intervals {
+		if max := time.Millisecond << uint(i); interval < 0 || interval > max {
+			t.Errorf("interval %d was %v, expected at most %v", i, interval, max)
+		}
+	}
+}
+
+type retryAfterError time.Duration
+
+func (e retryAfterError) Error() string { return "slow down" }
+
+func (e retryAfterError) RetryAfter() (time.Duration, bool) { return time.Duration(e), true }
+
+func TestRetryAfterExtendsInterval(t *testing.T) {
+	var waits []time.Duration
+
+	Do(func(s *Stats) error {
+		return retryAfterError(20 * time.Millisecond)
+	}, &Config{
+		Maximum:  2,
+		Interval: time.Millisecond,
+		OnFailure: func(a Attempt, s *Stats) {
+			waits = append(waits, s.Interval)
+		},
+	})
+
+	assert.Equal(t, []time.Duration{20 * time.Millisecond, 20 * time.Millisecond}, waits)
+}
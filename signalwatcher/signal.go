@@ -11,4 +11,6 @@ const (
 	QUIT = Signal("QUIT")
 	TERM = Signal("TERM")
 	INT  = Signal("INT")
+	USR1 = Signal("USR1")
+	USR2 = Signal("USR2")
 )
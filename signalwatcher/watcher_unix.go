@@ -14,7 +14,9 @@ func Watch(callback func(Signal)) {
 		syscall.SIGHUP,
 		syscall.SIGTERM,
 		syscall.SIGINT,
-		syscall.SIGQUIT)
+		syscall.SIGQUIT,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2)
 
 	go func() {
 		sig := <-signals
@@ -25,6 +27,10 @@ func Watch(callback func(Signal)) {
 			go callback(TERM)
 		} else if sig == syscall.SIGINT {
 			go callback(INT)
+		} else if sig == syscall.SIGUSR1 {
+			go callback(USR1)
+		} else if sig == syscall.SIGUSR2 {
+			go callback(USR2)
 		} else {
 			go callback(QUIT)
 		}
@@ -0,0 +1,107 @@
+// Package split divides work (such as test files) between parallel jobs
+package split
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Split divides items between total buckets and returns the bucket at index.
+// The result only depends on the items and timings, not their order, so every
+// parallel job computes the same split.
+//
+// Without timings, items are sorted and dealt out in turn. With timings
+// (durations in any unit, keyed by item), items are assigned longest first to
+// the bucket with the least total duration so far. Items without a timing are
+// assumed to take the average of the known timings.
+func Split(items []string, timings map[string]float64, index, total int) ([]string, error) {
+	if total < 1 {
+		return nil, fmt.Errorf("Total must be at least 1, got %d", total)
+	}
+	if index < 0 || index >= total {
+		return nil, fmt.Errorf("Index must be between 0 and %d, got %d", total-1, index)
+	}
+
+	sorted := unique(items)
+
+	if len(timings) == 0 {
+		var bucket []string
+		for i, item := range sorted {
+			if i%total == index {
+				bucket = append(bucket, item)
+			}
+		}
+		return bucket, nil
+	}
+
+	durations := estimate(sorted, timings)
+
+	// Longest first, falling back to the name so that ties are stable
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return durations[sorted[i]] > durations[sorted[j]]
+	})
+
+	totals := make([]float64, total)
+	buckets := make([][]string, total)
+
+	for _, item := range sorted {
+		smallest := 0
+		for i := range totals {
+			if totals[i] < totals[smallest] {
+				smallest = i
+			}
+		}
+		totals[smallest] += durations[item]
+		buckets[smallest] = append(buckets[smallest], item)
+	}
+
+	// Return the bucket in the same order as it would be without timings
+	sort.Strings(buckets[index])
+	return buckets[index], nil
+}
+
+// unique returns the sorted, de-duplicated items
+func unique(items []string) []string {
+	seen := map[string]bool{}
+	var result []string
+
+	for _, item := range items {
+		if item != "" && !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// estimate returns a duration for each item, using the average of the known
+// timings for items that don't have one
+func estimate(items []string, timings map[string]float64) map[string]float64 {
+	var sum float64
+	var known int
+
+	for _, item := range items {
+		if d, ok := timings[item]; ok && d > 0 {
+			sum += d
+			known++
+		}
+	}
+
+	average := 1.0
+	if known > 0 {
+		average = sum / float64(known)
+	}
+
+	durations := make(map[string]float64, len(items))
+	for _, item := range items {
+		if d, ok := timings[item]; ok && d > 0 {
+			durations[item] = d
+		} else {
+			durations[item] = average
+		}
+	}
+
+	return durations
+}
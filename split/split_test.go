@@ -0,0 +1,56 @@
+package split
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitWithoutTimingsDealsOutSortedItems(t *testing.T) {
+	items := []string{"e", "b", "d", "a", "c", "a"}
+
+	var all []string
+	for i := 0; i < 2; i++ {
+		bucket, err := Split(items, nil, i, 2)
+		assert.NoError(t, err)
+		all = append(all, bucket...)
+	}
+
+	assert.Equal(t, []string{"a", "c", "e", "b", "d"}, all)
+}
+
+func TestSplitWithTimingsBalancesDuration(t *testing.T) {
+	items := []string{"slow", "medium", "fast1", "fast2", "unknown"}
+	timings := map[string]float64{
+		"slow":   10,
+		"medium": 6,
+		"fast1":  2,
+		"fast2":  2,
+	}
+
+	first, err := Split(items, timings, 0, 2)
+	assert.NoError(t, err)
+	second, err := Split(items, timings, 1, 2)
+	assert.NoError(t, err)
+
+	// unknown is assumed to take the average of 5, so the totals are 12 and 13
+	assert.Equal(t, []string{"fast1", "slow"}, first)
+	assert.Equal(t, []string{"fast2", "medium", "unknown"}, second)
+}
+
+func TestSplitIsIndependentOfInputOrder(t *testing.T) {
+	timings := map[string]float64{"a": 3, "b": 3, "c": 3, "d": 1}
+
+	one, _ := Split([]string{"a", "b", "c", "d"}, timings, 1, 3)
+	two, _ := Split([]string{"d", "c", "b", "a"}, timings, 1, 3)
+
+	assert.Equal(t, one, two)
+}
+
+func TestSplitValidatesIndex(t *testing.T) {
+	_, err := Split([]string{"a"}, nil, 2, 2)
+	assert.Error(t, err)
+
+	_, err = Split([]string{"a"}, nil, 0, 0)
+	assert.Error(t, err)
+}
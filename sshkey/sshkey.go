@@ -0,0 +1,144 @@
+// Package sshkey generates SSH keypairs, such as deploy keys for repositories
+package sshkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// The supported key types
+const (
+	TypeED25519 = "ed25519"
+	TypeECDSA   = "ecdsa"
+	TypeRSA     = "rsa"
+)
+
+// The size of generated RSA keys
+const rsaBits = 4096
+
+// KeyPair is a generated keypair
+type KeyPair struct {
+	// The private key in PEM format, readable by ssh
+	PrivateKey []byte
+
+	// The public key in authorized_keys format, which is also what GitHub,
+	// Bitbucket and GitLab expect for deploy keys
+	PublicKey []byte
+
+	// The SHA256 fingerprint of the public key
+	Fingerprint string
+}
+
+// Generate creates a new keypair of the given type, with a comment that is
+// included in the public key
+func Generate(keyType string, comment string) (*KeyPair, error) {
+	var privateKey []byte
+	var publicKey interface{}
+
+	switch keyType {
+	case TypeED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err = marshalED25519PrivateKey(pub, priv, comment)
+		if err != nil {
+			return nil, err
+		}
+		publicKey = pub
+
+	case TypeECDSA:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		publicKey = &priv.PublicKey
+
+	case TypeRSA:
+		priv, err := rsa.GenerateKey(rand.Reader, rsaBits)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+		publicKey = &priv.PublicKey
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type %q, must be one of %s, %s or %s", keyType, TypeED25519, TypeECDSA, TypeRSA)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizedKey := bytes.TrimSpace(ssh.MarshalAuthorizedKey(sshPublicKey))
+	if comment != "" {
+		authorizedKey = append(authorizedKey, ' ')
+		authorizedKey = append(authorizedKey, comment...)
+	}
+	authorizedKey = append(authorizedKey, '\n')
+
+	return &KeyPair{
+		PrivateKey:  privateKey,
+		PublicKey:   authorizedKey,
+		Fingerprint: ssh.FingerprintSHA256(sshPublicKey),
+	}, nil
+}
+
+// marshalED25519PrivateKey encodes an ed25519 key in the "openssh-key-v1"
+// format, which is the only format ssh reads ed25519 keys from. See
+// PROTOCOL.key in the OpenSSH source.
+func marshalED25519PrivateKey(pub ed25519.PublicKey, priv ed25519.PrivateKey, comment string) ([]byte, error) {
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+
+	pubKey := new(bytes.Buffer)
+	writeString(pubKey, []byte(ssh.KeyAlgoED25519))
+	writeString(pubKey, pub)
+
+	private := new(bytes.Buffer)
+	private.Write(check)
+	private.Write(check)
+	writeString(private, []byte(ssh.KeyAlgoED25519))
+	writeString(private, pub)
+	writeString(private, priv)
+	writeString(private, []byte(comment))
+
+	// Pad to the block size of the (lack of a) cipher
+	for i := byte(1); private.Len()%8 != 0; i++ {
+		private.WriteByte(i)
+	}
+
+	key := new(bytes.Buffer)
+	key.WriteString("openssh-key-v1\x00")
+	writeString(key, []byte("none"))
+	writeString(key, []byte("none"))
+	writeString(key, nil)
+	binary.Write(key, binary.BigEndian, uint32(1))
+	writeString(key, pubKey.Bytes())
+	writeString(key, private.Bytes())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: key.Bytes()}), nil
+}
+
+func writeString(b *bytes.Buffer, s []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.Write(s)
+}
@@ -0,0 +1,40 @@
+package sshkey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeysThatSSHCanRead(t *testing.T) {
+	for _, keyType := range []string{TypeED25519, TypeECDSA, TypeRSA} {
+		t.Run(keyType, func(t *testing.T) {
+			kp, err := Generate(keyType, "llamas@buildkite")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := ssh.ParsePrivateKey(kp.PrivateKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pub, comment, _, _, err := ssh.ParseAuthorizedKey(kp.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, "llamas@buildkite", comment)
+			assert.True(t, bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()))
+			assert.True(t, strings.HasPrefix(kp.Fingerprint, "SHA256:"))
+		})
+	}
+}
+
+func TestGenerateRejectsUnknownTypes(t *testing.T) {
+	_, err := Generate("dsa", "")
+	assert.Error(t, err)
+}
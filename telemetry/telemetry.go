@@ -0,0 +1,97 @@
+// Package telemetry provides opt-in, anonymous usage reporting for the agent.
+//
+// Nothing is collected or sent unless an endpoint has been configured. Reports
+// only ever contain the names of commands, flags and experiments (never their
+// values), so that maintainers of self-hosted distributions can see which
+// features are still in use before deprecating them.
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Error categories that a report can be tagged with
+const (
+	CategoryNone           = ""
+	CategoryUsage          = "usage"
+	CategoryUnknownCommand = "unknown_command"
+	CategoryFatal          = "fatal"
+	CategoryPanic          = "panic"
+)
+
+// Report is a single record of a subcommand invocation
+type Report struct {
+	Command       string   `json:"command"`
+	Flags         []string `json:"flags,omitempty"`
+	Experiments   []string `json:"experiments,omitempty"`
+	ErrorCategory string   `json:"error_category,omitempty"`
+	Version       string   `json:"version"`
+	OS            string   `json:"os"`
+	Arch          string   `json:"arch"`
+	DurationMS    int64    `json:"duration_ms"`
+}
+
+// NewReport returns a report for the command with the OS and architecture
+// filled in. Flag and experiment names are sorted so reports are stable.
+func NewReport(version string, command string, flags []string, experiments []string) *Report {
+	sort.Strings(flags)
+	sort.Strings(experiments)
+
+	return &Report{
+		Command:     command,
+		Flags:       flags,
+		Experiments: experiments,
+		Version:     version,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+	}
+}
+
+// Reporter sends reports to a configured endpoint
+type Reporter struct {
+	// The URL that reports are POSTed to as JSON
+	Endpoint string
+
+	// The HTTP client to use, defaults to one with a short timeout
+	Client *http.Client
+}
+
+// NewReporter returns a reporter for the endpoint, or nil if the endpoint is
+// empty (which means telemetry hasn't been opted into)
+func NewReporter(endpoint string) *Reporter {
+	if endpoint == "" {
+		return nil
+	}
+
+	return &Reporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Send posts the report to the endpoint. Failures are returned but callers
+// should never let them affect the outcome of the command.
+func (r *Reporter) Send(report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.Client.Post(r.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Telemetry endpoint returned %s", resp.Status)
+	}
+
+	return nil
+}
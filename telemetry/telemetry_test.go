@@ -0,0 +1,49 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReporterWithoutEndpointIsDisabled(t *testing.T) {
+	assert.Nil(t, NewReporter(""))
+}
+
+func TestReporterSendsReportAsJSON(t *testing.T) {
+	var received Report
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		if err := json.NewDecoder(req.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	report := NewReport("1.2.3", "artifact upload", []string{"job", "debug"}, []string{"msgpack"})
+	report.ErrorCategory = CategoryUsage
+
+	err := NewReporter(server.URL).Send(report)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "artifact upload", received.Command)
+	assert.Equal(t, []string{"debug", "job"}, received.Flags)
+	assert.Equal(t, []string{"msgpack"}, received.Experiments)
+	assert.Equal(t, "usage", received.ErrorCategory)
+	assert.Equal(t, "1.2.3", received.Version)
+}
+
+func TestReporterReturnsErrorOnBadStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := NewReporter(server.URL).Send(NewReport("1.2.3", "start", nil, nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+// Package tracing propagates W3C Trace Context (traceparent and tracestate)
+// and W3C Baggage between whatever triggered a build, the agent and the
+// tools that jobs run, so that their traces can be joined up.
+//
+// It doesn't record or export any spans itself. See
+// https://www.w3.org/TR/trace-context/ and https://www.w3.org/TR/baggage/
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The keys of a trace context carrier, such as a job payload's trace_context
+const (
+	TraceparentKey = "traceparent"
+	TracestateKey  = "tracestate"
+	BaggageKey     = "baggage"
+)
+
+// The environment variables that trace context is passed to commands in
+const (
+	TraceparentEnv = "TRACEPARENT"
+	TracestateEnv  = "TRACESTATE"
+	BaggageEnv     = "BAGGAGE"
+)
+
+// The trace flag that says the trace is being recorded
+const FlagSampled byte = 0x01
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// ParseTraceparent parses a traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("Invalid traceparent %q", value)
+	}
+
+	// Version ff is forbidden, and version 00 has exactly four parts. Later
+	// versions may add more, which are ignored.
+	version := parts[0]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("Invalid traceparent %q", value)
+	}
+
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil || isZero(sc.TraceID[:]) {
+		return sc, fmt.Errorf("Invalid trace ID in traceparent %q", value)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil || isZero(sc.SpanID[:]) {
+		return sc, fmt.Errorf("Invalid parent ID in traceparent %q", value)
+	}
+
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, fmt.Errorf("Invalid trace flags in traceparent %q", value)
+	}
+	sc.Flags = flags[0]
+
+	return sc, nil
+}
+
+// Traceparent returns the span context as a version 00 traceparent header
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// TraceIDString returns the trace ID in hex
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// Child returns a new span within the same trace
+func (sc SpanContext) Child() SpanContext {
+	child := sc
+	child.SpanID = newSpanID()
+	return child
+}
+
+// NewTrace starts a new sampled trace. If the ID is a UUID (such as a build
+// ID) it's used as the trace ID, so that everything given the same ID ends
+// up in the same trace, otherwise a random trace ID is used.
+func NewTrace(id string) SpanContext {
+	sc := SpanContext{SpanID: newSpanID(), Flags: FlagSampled}
+
+	if err := decodeHex(sc.TraceID[:], strings.Replace(id, "-", "", -1)); err != nil || isZero(sc.TraceID[:]) {
+		rand.Read(sc.TraceID[:])
+	}
+
+	return sc
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for isZero(id[:]) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func decodeHex(dst []byte, s string) error {
+	// Upper case hex isn't allowed
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return errors.New("wrong length or case")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Member is a single key and value of baggage. Properties after the value
+// (separated by semicolons) are kept as they were.
+type Member struct {
+	Key        string
+	Value      string
+	Properties string
+}
+
+// Baggage is an ordered list of members, without duplicate keys
+type Baggage []Member
+
+// ParseBaggage parses a baggage header, such as "userId=alice,isProduction=false".
+// Members that can't be parsed are dropped, as the spec requires.
+func ParseBaggage(value string) Baggage {
+	var b Baggage
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var properties string
+		if i := strings.Index(item, ";"); i >= 0 {
+			item, properties = item[:i], strings.TrimSpace(item[i+1:])
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(kv[0])
+		value, err := url.PathUnescape(strings.TrimSpace(kv[1]))
+		if key == "" || err != nil {
+			continue
+		}
+
+		b = b.Set(key, value)
+		b[len(b)-1].Properties = properties
+	}
+
+	return b
+}
+
+// Get returns the value of the member with the key
+func (b Baggage) Get(key string) (string, bool) {
+	for _, m := range b {
+		if m.Key == key {
+			return m.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set returns the baggage with the member with the key replaced (or added to
+// the end if there isn't one)
+func (b Baggage) Set(key, value string) Baggage {
+	for i, m := range b {
+		if m.Key == key {
+			b[i] = Member{Key: key, Value: value}
+			return b
+		}
+	}
+	return append(b, Member{Key: key, Value: value})
+}
+
+// String returns the baggage as a header value
+func (b Baggage) String() string {
+	items := make([]string, 0, len(b))
+
+	for _, m := range b {
+		item := m.Key + "=" + escapeBaggageValue(m.Value)
+		if m.Properties != "" {
+			item += ";" + m.Properties
+		}
+		items = append(items, item)
+	}
+
+	return strings.Join(items, ",")
+}
+
+// escapeBaggageValue percent-encodes the characters that baggage values
+// can't contain
+func escapeBaggageValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= 0x20 || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
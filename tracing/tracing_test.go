@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceIDString())
+	assert.Equal(t, FlagSampled, sc.Flags)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// Later versions can have more fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-llamas")
+	assert.NoError(t, err)
+}
+
+func TestParseTraceparentRejectsInvalidValues(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"llamas",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestChildKeepsTraceWithNewSpan(t *testing.T) {
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	child := parent.Child()
+
+	assert.Equal(t, parent.TraceID, child.TraceID)
+	assert.Equal(t, parent.Flags, child.Flags)
+	assert.NotEqual(t, parent.SpanID, child.SpanID)
+}
+
+func TestNewTraceUsesUUIDAsTraceID(t *testing.T) {
+	sc := NewTrace("4bf92f35-77b3-4da6-a3ce-929d0e0e4736")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceIDString())
+	assert.Equal(t, FlagSampled, sc.Flags)
+
+	// Anything else gets a random trace ID
+	assert.NotEqual(t, NewTrace("llamas").TraceID, NewTrace("llamas").TraceID)
+}
+
+func TestBaggage(t *testing.T) {
+	b := ParseBaggage("userId=alice, serverNode=DF%2028;region=eu , broken,=nokey")
+
+	value, ok := b.Get("serverNode")
+	assert.True(t, ok)
+	assert.Equal(t, "DF 28", value)
+
+	b = b.Set("userId", "bob").Set("buildkite.job_id", "a,b")
+
+	assert.Equal(t, "userId=bob,serverNode=DF%2028;region=eu,buildkite.job_id=a%2Cb", b.String())
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longest suffixes first, so "MB" isn't matched as "B"
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"TIB", 1 << 40},
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"TB", 1 << 40},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size like "512MB" or "10G" into bytes. Units are
+// powers of 1024, and a number without a unit is in bytes.
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q, expected something like 512MB or 10GB", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// FormatByteSize formats bytes as a size like "1.5MB", the opposite of
+// ParseByteSize
+func FormatByteSize(n int64) string {
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if n >= unit.multiplier {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(unit.multiplier), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
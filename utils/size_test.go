@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"512B":   512,
+		"4k":     4096,
+		"1.5KB":  1536,
+		"10MB":   10 << 20,
+		"10 MiB": 10 << 20,
+		"2G":     2 << 30,
+		"1TB":    1 << 40,
+	} {
+		size, err := ParseByteSize(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, size, input)
+	}
+
+	for _, input := range []string{"", "MB", "-1GB", "ten"} {
+		_, err := ParseByteSize(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	for input, expected := range map[int64]string{
+		0:        "0B",
+		512:      "512B",
+		1536:     "1.5KB",
+		10 << 20: "10.0MB",
+		2 << 30:  "2.0GB",
+		3 << 40:  "3.0TB",
+	} {
+		assert.Equal(t, expected, FormatByteSize(input), input)
+	}
+}
@@ -0,0 +1,25 @@
+package workspace
+
+import (
+	"os"
+	"os/exec"
+)
+
+// cloneTree clones src to dst with cp, which uses clonefile(2) with -c and
+// fails on filesystems other than APFS so that it can be copied instead
+func cloneTree(src, dst string) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	// The trailing slash copies the contents of src, rather than src itself
+	if err := exec.Command("/bin/cp", "-c", "-p", "-R", src+"/", dst).Run(); err != nil {
+		return errCloneUnsupported
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
+}
@@ -0,0 +1,24 @@
+package workspace
+
+import (
+	"os"
+	"syscall"
+)
+
+// The FICLONE ioctl, which makes one file share the extents of another on
+// filesystems with reflinks, like btrfs and XFS
+const ficlone = 0x40049409
+
+// cloneTree clones src to dst file by file, failing on the first file that
+// can't be cloned so that it can be copied instead
+func cloneTree(src, dst string) error {
+	return walkTree(src, dst, ficloneFile)
+}
+
+func ficloneFile(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errCloneUnsupported
+	}
+	return nil
+}
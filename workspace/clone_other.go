@@ -0,0 +1,7 @@
+// +build !linux,!darwin
+
+package workspace
+
+func cloneTree(src, dst string) error {
+	return errCloneUnsupported
+}
@@ -0,0 +1,129 @@
+package workspace
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// errCloneUnsupported is returned by cloneTree when copy-on-write clones
+// aren't supported by the OS or filesystem
+var errCloneUnsupported = errors.New("Copy-on-write clones aren't supported")
+
+// copyTree copies the directory src to dst, which must either not exist or
+// be empty. Files are cloned with copy-on-write where the filesystem
+// supports it (APFS, btrfs, XFS with reflinks), which is close to instant,
+// and copied otherwise. It returns whether the files were cloned.
+func copyTree(src, dst string) (bool, error) {
+	if err := cloneTree(src, dst); err == nil {
+		return true, nil
+	}
+
+	// Start again from scratch, rather than working out which files made it
+	if _, err := os.Lstat(dst); err == nil {
+		if err := emptyDir(dst); err != nil {
+			return false, err
+		}
+	}
+
+	return false, walkTree(src, dst, nil)
+}
+
+// walkTree recreates the directories, files and symlinks in src in dst,
+// preserving their permissions and modification times, so that build tools
+// that look at them don't think everything has changed. Files are copied
+// with clone if it's given, and with io.Copy otherwise. Sockets, pipes and
+// devices are skipped, as they don't belong in a workspace.
+func walkTree(src, dst string, clone func(dst, src *os.File) error) error {
+	type dirTimes struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dirTimes
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{target, info})
+			return nil
+
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case mode.IsRegular():
+			return copyFile(path, target, info, clone)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories are only given their permissions and times once they're
+	// full, as adding files would change their times, and read-only
+	// directories can't have files added to them. This goes deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := os.Chmod(d.path, d.info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.info.ModTime(), d.info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, info os.FileInfo, clone func(dst, src *os.File) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if clone != nil {
+		err = clone(out, in)
+	} else {
+		_, err = io.Copy(out, in)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// The permissions given to OpenFile are masked by the umask
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,233 @@
+// Package workspace snapshots build workspaces and restores them, so that
+// later steps on the same host can start from a prepared workspace rather
+// than building it up again
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// ErrNotFound is returned when restoring a snapshot that doesn't exist
+var ErrNotFound = errors.New("Snapshot not found")
+
+// LockTimeout is how long to wait for another agent to finish with a
+// snapshot before giving up
+var LockTimeout = 10 * time.Minute
+
+var nameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Store is a directory of snapshots. It should be on the same filesystem as
+// the workspaces, so that they can be cloned rather than copied.
+type Store struct {
+	// The directory the snapshots are kept in
+	Path string
+}
+
+// Result describes a snapshot or restore that was made
+type Result struct {
+	// Whether the files were cloned with copy-on-write, rather than copied
+	Cloned bool
+
+	Duration time.Duration
+}
+
+// ValidateName returns an error if the name can't be used for a snapshot
+func ValidateName(name string) error {
+	if !nameRegex.MatchString(name) {
+		return fmt.Errorf("Invalid snapshot name %q, it must start with a letter or number and only contain letters, numbers, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// Exists returns whether there's a snapshot with the given name
+func (s Store) Exists(name string) bool {
+	if ValidateName(name) != nil {
+		return false
+	}
+	info, err := os.Stat(s.path(name))
+	return err == nil && info.IsDir()
+}
+
+// Snapshot saves the contents of dir as the named snapshot, replacing any
+// snapshot with that name once it's complete
+func (s Store) Snapshot(dir, name string) (Result, error) {
+	start := time.Now()
+
+	if err := ValidateName(name); err != nil {
+		return Result{}, err
+	}
+	if err := s.checkDir(dir); err != nil {
+		return Result{}, err
+	}
+
+	unlock, err := s.lock(name)
+	if err != nil {
+		return Result{}, err
+	}
+	defer unlock()
+
+	// The snapshot is made next to where it ends up, so that a snapshot that
+	// fails part way through doesn't replace the last good one
+	final := s.path(name)
+	tmp := filepath.Join(s.Path, "."+name+".tmp")
+	old := filepath.Join(s.Path, "."+name+".old")
+
+	for _, path := range []string{tmp, old} {
+		if err := os.RemoveAll(path); err != nil {
+			return Result{}, err
+		}
+	}
+
+	// The workspace is often a symlink, and it's what it points to that's
+	// wanted rather than the symlink itself
+	src, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return Result{}, err
+	}
+
+	cloned, err := copyTree(src, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return Result{}, err
+	}
+
+	if _, err := os.Lstat(final); err == nil {
+		if err := os.Rename(final, old); err != nil {
+			os.RemoveAll(tmp)
+			return Result{}, err
+		}
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		os.RemoveAll(tmp)
+		return Result{}, err
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		return Result{}, err
+	}
+
+	return Result{Cloned: cloned, Duration: time.Since(start)}, nil
+}
+
+// Restore replaces the contents of dir with the named snapshot. The
+// directory itself is kept, so that anything holding it open still can.
+func (s Store) Restore(name, dir string) (Result, error) {
+	start := time.Now()
+
+	if err := ValidateName(name); err != nil {
+		return Result{}, err
+	}
+	if err := s.checkDir(dir); err != nil {
+		return Result{}, err
+	}
+
+	unlock, err := s.lock(name)
+	if err != nil {
+		return Result{}, err
+	}
+	defer unlock()
+
+	if !s.Exists(name) {
+		return Result{}, ErrNotFound
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return Result{}, err
+	}
+	if err := emptyDir(dir); err != nil {
+		return Result{}, err
+	}
+
+	cloned, err := copyTree(s.path(name), dir)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{Cloned: cloned, Duration: time.Since(start)}, nil
+}
+
+func (s Store) path(name string) string {
+	return filepath.Join(s.Path, name)
+}
+
+// checkDir makes sure the workspace and the store don't overlap, as a
+// snapshot would otherwise include itself, and a restore would delete the
+// snapshot it's restoring
+func (s Store) checkDir(dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	absStore, err := filepath.Abs(s.Path)
+	if err != nil {
+		return err
+	}
+
+	if absDir == filepath.Dir(absDir) {
+		return fmt.Errorf("Refusing to use %s as a workspace", absDir)
+	}
+	if within(absStore, absDir) || within(absDir, absStore) {
+		return fmt.Errorf("The workspace %s and the snapshots in %s can't be inside each other", absDir, absStore)
+	}
+
+	return nil
+}
+
+// within returns whether path is dir or inside it
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// lock acquires a lock file for the named snapshot, so that agents in other
+// processes don't restore a snapshot while it's being replaced
+func (s Store) lock(name string) (func(), error) {
+	absPath, err := filepath.Abs(filepath.Join(s.Path, "."+name+".lock"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(absPath), 0777); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockfile.New(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err = lock.TryLock()
+		if err == nil {
+			return func() { _ = lock.Unlock() }, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for the lock on snapshot %q: %v", name, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// emptyDir removes everything inside dir, but not dir itself
+func emptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
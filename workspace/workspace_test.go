@@ -0,0 +1,165 @@
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := Store{Path: filepath.Join(dir, "snapshots")}
+	ws := filepath.Join(dir, "workspace")
+
+	writeFile(t, filepath.Join(ws, "package.json"), "{}")
+	writeFile(t, filepath.Join(ws, "node_modules", "llamas", "index.js"), "module.exports = 'llamas'")
+	if err := os.Chmod(filepath.Join(ws, "package.json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(ws, "package.json"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("node_modules/llamas", filepath.Join(ws, "llamas")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Snapshot(ws, "deps"); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, store.Exists("deps"))
+
+	// Change the workspace after the snapshot
+	writeFile(t, filepath.Join(ws, "package.json"), `{"changed": true}`)
+	writeFile(t, filepath.Join(ws, "build.log"), "building")
+	if err := os.RemoveAll(filepath.Join(ws, "node_modules")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Restore("deps", ws); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "{}", readFile(t, filepath.Join(ws, "package.json")))
+	assert.Equal(t, "module.exports = 'llamas'", readFile(t, filepath.Join(ws, "node_modules", "llamas", "index.js")))
+
+	_, err = os.Stat(filepath.Join(ws, "build.log"))
+	assert.True(t, os.IsNotExist(err), "build.log should have been removed")
+
+	info, err := os.Stat(filepath.Join(ws, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, info.ModTime().Equal(mtime), "mtime should be preserved, got %v", info.ModTime())
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		link, err := os.Readlink(filepath.Join(ws, "llamas"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "node_modules/llamas", link)
+	}
+}
+
+func TestSnapshotReplacesExistingSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := Store{Path: filepath.Join(dir, "snapshots")}
+	ws := filepath.Join(dir, "workspace")
+
+	writeFile(t, filepath.Join(ws, "old.txt"), "old")
+	if _, err := store.Snapshot(ws, "deps"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(ws, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(ws, "new.txt"), "new")
+	if _, err := store.Snapshot(ws, "deps"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(store.Path, "deps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "new.txt", entries[0].Name())
+}
+
+func TestRestoringAMissingSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := Store{Path: filepath.Join(dir, "snapshots")}
+	ws := filepath.Join(dir, "workspace")
+	writeFile(t, filepath.Join(ws, "llamas.txt"), "llamas")
+
+	_, err = store.Restore("deps", ws)
+	assert.Equal(t, ErrNotFound, err)
+
+	// The workspace is left alone
+	assert.Equal(t, "llamas", readFile(t, filepath.Join(ws, "llamas.txt")))
+}
+
+func TestSnapshotNamesAndDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"", ".", "..", "../llamas", "llamas/alpacas", ".hidden", "llamas alpacas"} {
+		assert.Error(t, ValidateName(name), "%q should be invalid", name)
+	}
+	for _, name := range []string{"deps", "node-modules_v2", "1.2.3"} {
+		assert.NoError(t, ValidateName(name), "%q should be valid", name)
+	}
+
+	// A workspace can't contain its snapshots, or be inside them
+	store := Store{Path: filepath.Join(dir, "snapshots")}
+	_, err = store.Snapshot(dir, "deps")
+	assert.Error(t, err)
+	_, err = store.Restore("deps", filepath.Join(store.Path, "deps"))
+	assert.Error(t, err)
+}